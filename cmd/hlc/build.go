@@ -0,0 +1,454 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/cache"
+	"github.com/Dr-H-PhD/h-lang/pkg/codegen"
+	"github.com/Dr-H-PhD/h-lang/pkg/version"
+)
+
+// builder compiles programs to executables, reusing the generated C and
+// the object files of earlier builds from the build cache
+type builder struct {
+	gc    bool
+	tests bool // build test binaries
+	roots []string
+	trace bool         // -x: report cache hits and misses and print commands
+	cache *cache.Cache // nil when caching is disabled
+
+	libs    listFlag // -l: C libraries every program links against
+	libDirs listFlag // -L: directories searched for them
+	tc      *toolchain
+
+	compiler   string
+	ccArgs     []string // the words after the compiler's name in -cc or $CC
+	compilerID string   // identifies the C compiler in object keys
+	toolID     string   // identifies this hlc binary in frontend keys
+}
+
+// newBuilder returns a builder using the default cache directory. A
+// cache that cannot be opened only disables caching.
+func newBuilder(gc, trace bool) *builder {
+	b := &builder{gc: gc, trace: trace, tc: &toolchain{optimise: -1}}
+	dir, err := cache.DefaultDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: build cache disabled: %v\n", err)
+		return b
+	}
+	if dir == "" {
+		return b
+	}
+	if b.cache, err = cache.Open(dir); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: build cache disabled: %v\n", err)
+	}
+	return b
+}
+
+// listFlag is a flag that may be repeated, such as -l m -l pthread
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// linkFlags registers the -l and -L flags of a command
+func linkFlags(flags *flag.FlagSet) (libs, libDirs *listFlag) {
+	libs, libDirs = new(listFlag), new(listFlag)
+	flags.Var(libs, "l", "Link against the C library `name` (repeatable)")
+	flags.Var(libDirs, "L", "Search `dir` for C libraries (repeatable)")
+	return libs, libDirs
+}
+
+// includeFlags returns the flag that lets the C compiler find headers
+// named by cinclude "file.h" next to the main file
+func includeFlags(inputFile string) []string {
+	return []string{"-I" + filepath.Dir(absPath(inputFile))}
+}
+
+func (b *builder) tracef(format string, args ...interface{}) {
+	if b.trace {
+		fmt.Fprintf(os.Stderr, format+"\n", args...)
+	}
+}
+
+// session records the files a compilation read, including import
+// candidates that did not exist, and the warnings it printed, so that a
+// cached result can be validated and replayed
+type session struct {
+	Inputs   []input
+	Warnings []string
+}
+
+type input struct {
+	Path string
+	Hash string // "" if the file did not exist
+}
+
+func (s *session) read(path string, data []byte) {
+	if s != nil {
+		s.Inputs = append(s.Inputs, input{Path: absPath(path), Hash: cache.Hash(data)})
+	}
+}
+
+func (s *session) missing(path string) {
+	if s != nil {
+		s.Inputs = append(s.Inputs, input{Path: absPath(path)})
+	}
+}
+
+func (s *session) warn(msg string) {
+	if s != nil {
+		s.Warnings = append(s.Warnings, msg)
+	}
+}
+
+// unchanged reports whether every recorded input is as it was
+func (s *session) unchanged() bool {
+	for _, in := range s.Inputs {
+		data, err := os.ReadFile(in.Path)
+		if in.Hash == "" {
+			if err == nil {
+				return false
+			}
+			continue
+		}
+		if err != nil || cache.Hash(data) != in.Hash {
+			return false
+		}
+	}
+	return true
+}
+
+// frontendEntry is the cached result of translating a program to C
+type frontendEntry struct {
+	session
+	Units     []*codegen.Unit
+	Libraries []string // from link directives
+}
+
+// units translates a program to C translation units, or returns the
+// cached units if none of the files it read have changed. It also
+// returns the C libraries the program's link directives name.
+func (b *builder) units(source []byte, inputFile string) ([]*codegen.Unit, []string, []string) {
+	key := b.frontendKey(inputFile)
+	if entry := b.cachedFrontend(key); entry != nil {
+		b.tracef("cache hit: %s", inputFile)
+		for _, w := range entry.Warnings {
+			fmt.Fprintln(os.Stderr, w)
+		}
+		return entry.Units, entry.Libraries, nil
+	}
+	b.tracef("cache miss: %s", inputFile)
+
+	s := &session{}
+	s.read(inputFile, source)
+	program, g, errors := frontend(string(source), inputFile, b.gc, b.tests, b.roots, s)
+	if len(errors) > 0 {
+		return nil, nil, errors
+	}
+
+	// Debuggers read the H source through line directives. Diagnostics
+	// are translated through the source map instead, which keeps the
+	// columns.
+	g.SetLineDirectives(b.tc.debug)
+	units := g.GenerateUnits(program)
+	if len(g.Errors()) > 0 {
+		return nil, nil, g.Errors()
+	}
+	libs := g.Libraries()
+
+	if b.cache != nil {
+		data, err := json.Marshal(&frontendEntry{session: *s, Units: units, Libraries: libs})
+		if err == nil {
+			err = b.cache.Put(key, data)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: cannot cache %s: %v\n", inputFile, err)
+		}
+	}
+	return units, libs, nil
+}
+
+func (b *builder) cachedFrontend(key string) *frontendEntry {
+	if b.cache == nil {
+		return nil
+	}
+	data, ok := b.cache.Get(key)
+	if !ok {
+		return nil
+	}
+	var entry frontendEntry
+	if err := json.Unmarshal(data, &entry); err != nil || !entry.unchanged() {
+		return nil
+	}
+	return &entry
+}
+
+// frontendKey identifies a translation by the compiler that performs it,
+// its options and the program's entry file. The files it reads are
+// checked separately, since they are only known after parsing.
+func (b *builder) frontendKey(inputFile string) string {
+	return cache.Key(append([]string{"frontend", b.tool(), strconv.FormatBool(b.gc), strconv.FormatBool(b.tests), strconv.FormatBool(b.tc.debug), absPath(inputFile), inputFile}, b.roots...)...)
+}
+
+// tool identifies this hlc binary by the hash of its executable, so that
+// a rebuilt compiler never reuses translations of an older one
+func (b *builder) tool() string {
+	if b.toolID != "" {
+		return b.toolID
+	}
+	b.toolID = version.Full()
+	if exe, err := os.Executable(); err == nil {
+		if data, err := os.ReadFile(exe); err == nil {
+			b.toolID += " " + cache.Hash(data)
+		}
+	}
+	return b.toolID
+}
+
+// cCompiler identifies the C compiler by its command and version output
+func (b *builder) cCompiler() (string, string) {
+	if b.compiler == "" {
+		b.compiler, b.ccArgs = b.tc.compiler()
+		if b.compiler != "" {
+			out, _ := exec.Command(b.compiler, append(append([]string{}, b.ccArgs...), "--version")...).Output()
+			b.compilerID = commandLine(b.compiler, b.ccArgs) + "\n" + string(out)
+		}
+	}
+	return b.compiler, b.compilerID
+}
+
+var includeLine = regexp.MustCompile(`(?m)^[ \t]*#[ \t]*include[ \t]*"([^"]+)"`)
+
+// objectKey identifies the object file of a unit by the compiler, the
+// flags, the unit's source and every header it includes with quotes:
+// generated headers, and the C headers of cinclude "file.h", which are
+// looked for as the C compiler does, beside the header including them
+// and then in the -I directories of the flags. A header found nowhere
+// counts as missing, so that creating it changes the key.
+func (b *builder) objectKey(u *codegen.Unit, headers map[string]string, cflags []string) string {
+	_, id := b.cCompiler()
+	parts := []string{"object", id, strings.Join(cflags, "\x00"), u.Name, u.Source}
+
+	dirs := includeDirs(cflags)
+	generated := make(map[string]bool)
+	files := make(map[string]string) // the contents of C headers by path
+	var visit func(code, dir string)
+	visit = func(code, dir string) {
+		for _, m := range includeLine.FindAllStringSubmatch(code, -1) {
+			// Generated headers sit beside the generated code
+			name, ok := strings.CutSuffix(m[1], ".h")
+			if h, found := headers[name]; ok && found && dir == "" {
+				if !generated[name] {
+					generated[name] = true
+					visit(h, "")
+				}
+				continue
+			}
+			path, data := findHeader(m[1], dir, dirs)
+			if _, ok := files[path]; !ok {
+				files[path] = data
+				visit(data, filepath.Dir(path))
+			}
+		}
+	}
+	visit(u.Source, "")
+
+	var names []string
+	for name := range generated {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		parts = append(parts, name, headers[name])
+	}
+	var paths []string
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		parts = append(parts, "file", path, files[path])
+	}
+	return cache.Key(parts...)
+}
+
+// includeDirs returns the directories of the -I flags, in order
+func includeDirs(cflags []string) []string {
+	var dirs []string
+	for i := 0; i < len(cflags); i++ {
+		switch {
+		case cflags[i] == "-I":
+			if i+1 < len(cflags) {
+				i++
+				dirs = append(dirs, cflags[i])
+			}
+		case strings.HasPrefix(cflags[i], "-I"):
+			dirs = append(dirs, cflags[i][2:])
+		}
+	}
+	return dirs
+}
+
+// findHeader looks for a header named with quotes in dir, the directory
+// of the header including it, then in dirs. It returns the path of the
+// header found and its contents, or the name and "" if there is none.
+func findHeader(name, dir string, dirs []string) (string, string) {
+	if filepath.IsAbs(name) {
+		dir, dirs = "", []string{""}
+	}
+	if dir != "" {
+		dirs = append([]string{dir}, dirs...)
+	}
+	for _, d := range dirs {
+		path := filepath.Join(d, name)
+		if data, err := os.ReadFile(path); err == nil {
+			return path, string(data)
+		}
+	}
+	return name, ""
+}
+
+// link compiles each unit to an object file, in parallel, and links the
+// objects into outputName with libs and the libraries given by -l.
+// Objects found in the cache are not rebuilt.
+func (b *builder) link(units []*codegen.Unit, outputName string, cflags, libs []string) error {
+	compiler, _ := b.cCompiler()
+	if cc := b.tc.requested(); compiler == "" && cc != "" {
+		return fmt.Errorf("C compiler %q not found", cc)
+	}
+	if compiler == "" {
+		return fmt.Errorf("no C compiler found (tried gcc, clang, cc)")
+	}
+	// The words after the compiler's name in $CC come before every flag
+	cflags = append(append(append([]string{}, b.ccArgs...), b.tc.compileFlags()...), cflags...)
+
+	tmpDir, err := os.MkdirTemp("", "hlc-*")
+	if err != nil {
+		return fmt.Errorf("creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	headers := make(map[string]string)
+	maps := make(map[string]*codegen.SourceMap)
+	for _, u := range units {
+		headers[u.Name] = u.Header
+		maps[filepath.Join(tmpDir, u.Name+".c")] = u.Map
+		if err := os.WriteFile(filepath.Join(tmpDir, u.Name+".h"), []byte(u.Header), 0644); err != nil {
+			return fmt.Errorf("writing temp C file: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(tmpDir, u.Name+".c"), []byte(u.Source), 0644); err != nil {
+			return fmt.Errorf("writing temp C file: %v", err)
+		}
+	}
+
+	objects := make([]string, len(units))
+	keys := make([]string, len(units))
+	var misses []int
+	for i, u := range units {
+		keys[i] = b.objectKey(u, headers, cflags)
+		if b.cache != nil && b.cache.Has(keys[i]) {
+			b.tracef("cache hit: %s.o", u.Name)
+			objects[i] = b.cache.Path(keys[i])
+			continue
+		}
+		b.tracef("cache miss: %s.o", u.Name)
+		objects[i] = filepath.Join(tmpDir, u.Name+".o")
+		misses = append(misses, i)
+	}
+
+	outputs := make([][]byte, len(units))
+	errs := make([]error, len(units))
+	slots := make(chan struct{}, runtime.NumCPU())
+	var wg sync.WaitGroup
+	for _, i := range misses {
+		args := append(append([]string{}, cflags...), "-c", "-o", objects[i], filepath.Join(tmpDir, units[i].Name+".c"))
+		b.printCommand(compiler, args)
+
+		wg.Add(1)
+		go func(i int, args []string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			outputs[i], errs[i] = exec.Command(compiler, args...).CombinedOutput()
+		}(i, args)
+	}
+	wg.Wait()
+
+	// Report diagnostics in unit order rather than completion order
+	for _, i := range misses {
+		os.Stderr.Write(translateDiagnostics(outputs[i], maps))
+		if errs[i] != nil {
+			return fmt.Errorf("compiling %s.c: %v", units[i].Name, errs[i])
+		}
+		if b.tc.strict && len(outputs[i]) > 0 {
+			return fmt.Errorf("internal compiler error: the C compiler reported warnings for %s.c", units[i].Name)
+		}
+		// Objects with warnings are rebuilt, so the warnings show again
+		if b.cache != nil && len(outputs[i]) == 0 {
+			data, err := os.ReadFile(objects[i])
+			if err == nil {
+				err = b.cache.Put(keys[i], data)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "warning: cannot cache %s.o: %v\n", units[i].Name, err)
+			}
+		}
+	}
+
+	args := append([]string{}, cflags...)
+	args = append(args, "-o", outputName)
+	args = append(args, objects...)
+	args = append(args, b.tc.linkFlags()...)
+	for _, dir := range b.libDirs {
+		args = append(args, "-L"+dir)
+	}
+	seen := make(map[string]bool)
+	for _, lib := range append(append([]string{}, libs...), b.libs...) {
+		if !seen[lib] {
+			seen[lib] = true
+			args = append(args, "-l"+lib)
+		}
+	}
+	b.printCommand(compiler, args)
+	out, err := exec.Command(compiler, args...).CombinedOutput()
+	os.Stderr.Write(translateDiagnostics(out, maps))
+	if err != nil {
+		return fmt.Errorf("linking %s: %v", outputName, err)
+	}
+	if b.tc.strict && len(out) > 0 {
+		return fmt.Errorf("internal compiler error: the C compiler reported warnings linking %s", outputName)
+	}
+	return nil
+}
+
+// printCommand shows a C compiler command with -v or -x
+func (b *builder) printCommand(name string, args []string) {
+	if b.tc.verbose || b.trace {
+		fmt.Fprintln(os.Stderr, commandLine(name, args))
+	}
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/cache"
+	"github.com/Dr-H-PhD/h-lang/pkg/codegen"
+)
+
+// testBuilder returns a builder with a cache of its own that never runs
+// the C compiler to identify it
+func testBuilder(t *testing.T) *builder {
+	t.Helper()
+	c, err := cache.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &builder{
+		cache:      c,
+		tc:         &toolchain{optimise: -1},
+		compiler:   "cc",
+		compilerID: "cc 1.0",
+		toolID:     "hlc test",
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// translate runs the frontend of a builder on a file, caching the result
+func translate(t *testing.T, b *builder, inputFile string) {
+	t.Helper()
+	source, err := os.ReadFile(inputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, errors := b.units(source, inputFile); len(errors) > 0 {
+		t.Fatalf("unexpected errors: %v", errors)
+	}
+}
+
+func TestSession_Unchanged(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "util.hl")
+	absent := filepath.Join(dir, "lib", "util.hl")
+	writeFile(t, file, "public function one() int { return 1; }\n")
+
+	tests := []struct {
+		name   string
+		change func()
+		want   bool
+	}{
+		{"nothing changed", func() {}, true},
+		{"file rewritten with the same content", func() {
+			writeFile(t, file, "public function one() int { return 1; }\n")
+		}, true},
+		{"file changed", func() {
+			writeFile(t, file, "public function one() int { return 2; }\n")
+		}, false},
+		{"file removed", func() { os.Remove(file) }, false},
+		{"missing file appears", func() { writeFile(t, absent, "") }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeFile(t, file, "public function one() int { return 1; }\n")
+			os.RemoveAll(filepath.Dir(absent))
+			data, _ := os.ReadFile(file)
+			s := &session{}
+			s.read(file, data)
+			s.missing(absent)
+
+			tt.change()
+			if got := s.unchanged(); got != tt.want {
+				t.Errorf("expected unchanged() = %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestUnits_ImportChanged(t *testing.T) {
+	dir := t.TempDir()
+	entry := filepath.Join(dir, "main.hl")
+	util := filepath.Join(dir, "util.hl")
+	writeFile(t, entry, "import \"util.hl\";\nfunction main() {\n    print(one());\n}\n")
+	writeFile(t, util, "public function one() int { return 1; }\n")
+
+	b := testBuilder(t)
+	key := b.frontendKey(entry)
+	if b.cachedFrontend(key) != nil {
+		t.Fatal("expected a miss before the first build")
+	}
+	translate(t, b, entry)
+	if b.cachedFrontend(key) == nil {
+		t.Fatal("expected a hit after the first build")
+	}
+
+	writeFile(t, util, "public function one() int { return 2; }\n")
+	if b.cachedFrontend(key) != nil {
+		t.Error("expected a miss after the import changed")
+	}
+}
+
+func TestUnits_ImportCandidateAppears(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	entry := filepath.Join(dir, "app", "main.hl")
+	writeFile(t, entry, "import \"lib/util.hl\";\nfunction main() {\n    print(one());\n}\n")
+	writeFile(t, filepath.Join(root, "lib", "util.hl"), "public function one() int { return 1; }\n")
+
+	b := testBuilder(t)
+	b.roots = []string{root}
+	key := b.frontendKey(entry)
+	translate(t, b, entry)
+	if b.cachedFrontend(key) == nil {
+		t.Fatal("expected a hit after the first build")
+	}
+
+	// The import now resolves next to the main file instead of in the root
+	writeFile(t, filepath.Join(dir, "app", "lib", "util.hl"), "public function one() int { return 2; }\n")
+	if b.cachedFrontend(key) != nil {
+		t.Error("expected a miss once an earlier import candidate exists")
+	}
+}
+
+func TestFrontendKey(t *testing.T) {
+	key := func(change func(b *builder)) string {
+		b := testBuilder(t)
+		change(b)
+		return b.frontendKey("main.hl")
+	}
+	base := key(func(*builder) {})
+	if key(func(*builder) {}) != base {
+		t.Fatal("expected the same key for the same options")
+	}
+
+	tests := []struct {
+		name   string
+		change func(b *builder)
+	}{
+		{"gc", func(b *builder) { b.gc = true }},
+		{"tests", func(b *builder) { b.tests = true }},
+		{"-g", func(b *builder) { b.tc.debug = true }},
+		{"roots", func(b *builder) { b.roots = []string{"lib"} }},
+		{"compiler", func(b *builder) { b.toolID = "hlc other" }},
+	}
+	for _, tt := range tests {
+		if key(tt.change) == base {
+			t.Errorf("%s: expected a different key", tt.name)
+		}
+	}
+}
+
+func TestObjectKey(t *testing.T) {
+	units := []*codegen.Unit{
+		{Name: "main", Header: "/* main */", Source: "#include \"main.h\"\n#include \"util.h\"\nint main(void) { return 0; }\n"},
+		{Name: "util", Header: "/* util */", Source: "#include \"util.h\"\n"},
+		{Name: "other", Header: "/* other */", Source: "#include \"other.h\"\n"},
+	}
+	key := func(change func(b *builder, u []*codegen.Unit)) string {
+		b := testBuilder(t)
+		u := make([]*codegen.Unit, len(units))
+		for i := range units {
+			copied := *units[i]
+			u[i] = &copied
+		}
+		change(b, u)
+		headers := make(map[string]string)
+		for _, unit := range u {
+			headers[unit.Name] = unit.Header
+		}
+		return b.objectKey(u[0], headers, b.tc.compileFlags())
+	}
+	base := key(func(*builder, []*codegen.Unit) {})
+	if key(func(*builder, []*codegen.Unit) {}) != base {
+		t.Fatal("expected the same key for the same unit and flags")
+	}
+	if key(func(b *builder, u []*codegen.Unit) { u[2].Header = "/* changed */" }) != base {
+		t.Error("expected a header the unit does not include to keep the key")
+	}
+
+	tests := []struct {
+		name   string
+		change func(b *builder, u []*codegen.Unit)
+	}{
+		{"-O2", func(b *builder, u []*codegen.Unit) { b.tc.optimise = 2 }},
+		{"-g", func(b *builder, u []*codegen.Unit) { b.tc.debug = true }},
+		{"-cflags", func(b *builder, u []*codegen.Unit) { b.tc.cflags = []string{"-DNDEBUG"} }},
+		{"C compiler", func(b *builder, u []*codegen.Unit) { b.compilerID = "cc 2.0" }},
+		{"source", func(b *builder, u []*codegen.Unit) { u[0].Source += "\n" }},
+		{"own header", func(b *builder, u []*codegen.Unit) { u[0].Header = "/* changed */" }},
+		{"included header", func(b *builder, u []*codegen.Unit) { u[1].Header = "/* changed */" }},
+	}
+	for _, tt := range tests {
+		if key(tt.change) == base {
+			t.Errorf("%s: expected a different key", tt.name)
+		}
+	}
+}
+
+func TestObjectKey_CHeaders(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "foo.h"), "#include \"sub/bar.h\"\n")
+	writeFile(t, filepath.Join(dir, "sub", "bar.h"), "#define BAR 1\n")
+	unit := &codegen.Unit{Name: "main", Source: "#include \"foo.h\"\n#include \"gone.h\"\nint main(void) { return BAR; }\n"}
+	b := testBuilder(t)
+	key := func() string { return b.objectKey(unit, map[string]string{"main": ""}, []string{"-O2", "-I", dir}) }
+
+	base := key()
+	if key() != base {
+		t.Fatal("expected the same key for the same headers")
+	}
+	// Each change is kept, so foo.h changes last to keep including bar.h
+	changes := []struct {
+		name string
+		path string
+	}{
+		{"header included by a header", "sub/bar.h"},
+		{"missing header", "gone.h"},
+		{"included header", "foo.h"},
+	}
+	for _, tt := range changes {
+		writeFile(t, filepath.Join(dir, tt.path), "#define CHANGED 1\n")
+		changed := key()
+		if changed == base {
+			t.Errorf("%s: expected a different key", tt.name)
+		}
+		base = changed
+	}
+}
+
+func TestIncludeDirs(t *testing.T) {
+	got := includeDirs([]string{"-I", "a", "-O2", "-Ib", "-I"})
+	if want := []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
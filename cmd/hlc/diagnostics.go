@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/codegen"
+)
+
+// diagnosticLocation matches a message of gcc or clang about a line of a
+// file: "file:line:column: error: ..." or, from the linker, "file:line: ..."
+var diagnosticLocation = regexp.MustCompile(`^(.+?):(\d+):(?:(\d+):)?( .*)$`)
+
+// diagnosticContext matches the lines gcc adds to place a message in a
+// function, which the H location makes redundant
+var diagnosticContext = regexp.MustCompile(`^(.+?): (In function|In member function|At top level)`)
+
+// diagnosticExcerpt matches the source excerpt and caret lines gcc and
+// clang print under a message
+var diagnosticExcerpt = regexp.MustCompile(`^ *\d* *\|`)
+
+// translateDiagnostics rewrites the C compiler's messages about generated
+// C files as messages about the H source, through each file's source map,
+// and shows the H line instead of the C one. Messages about code hlc adds
+// itself, headers and everything else pass through unchanged.
+func translateDiagnostics(output []byte, maps map[string]*codegen.SourceMap) []byte {
+	if len(output) == 0 {
+		return output
+	}
+	var b bytes.Buffer
+	sources := make(map[string][]string)
+	translated := false
+	for _, line := range strings.SplitAfter(string(output), "\n") {
+		if line == "" {
+			continue
+		}
+		text := strings.TrimSuffix(line, "\n")
+		if m := diagnosticContext.FindStringSubmatch(text); m != nil && maps[m[1]] != nil {
+			continue
+		}
+		if translated && diagnosticExcerpt.MatchString(text) {
+			continue
+		}
+		translated = false
+
+		m := diagnosticLocation.FindStringSubmatch(text)
+		if m == nil || maps[m[1]] == nil {
+			b.WriteString(line)
+			continue
+		}
+		n, _ := strconv.Atoi(m[2])
+		mapping := maps[m[1]].Lookup(n)
+		if mapping == nil {
+			b.WriteString(line)
+			continue
+		}
+		fmt.Fprintf(&b, "%s:%d:%d:%s\n", mapping.Source, mapping.Line, mapping.Column, m[4])
+		writeExcerpt(&b, sources, mapping)
+		translated = true
+	}
+	return b.Bytes()
+}
+
+// writeExcerpt shows the H line a message is about, with a caret at the
+// start of the statement, as gcc does for C
+func writeExcerpt(b *bytes.Buffer, sources map[string][]string, m *codegen.Mapping) {
+	lines, ok := sources[m.Source]
+	if !ok {
+		if data, err := os.ReadFile(m.Source); err == nil {
+			lines = strings.Split(string(data), "\n")
+		}
+		sources[m.Source] = lines
+	}
+	if m.Line < 1 || m.Line > len(lines) {
+		return
+	}
+	text := strings.TrimRight(lines[m.Line-1], "\r")
+	fmt.Fprintf(b, "%5d | %s\n", m.Line, text)
+
+	// Tabs before the caret keep it under the column
+	indent := []rune(text)
+	if m.Column-1 < len(indent) {
+		indent = indent[:max(m.Column-1, 0)]
+	}
+	for i, r := range indent {
+		if r != '\t' {
+			indent[i] = ' '
+		}
+	}
+	fmt.Fprintf(b, "%5s | %s^\n", "", string(indent))
+}
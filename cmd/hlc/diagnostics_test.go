@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/codegen"
+)
+
+func TestTranslateDiagnostics(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "prog.hl")
+	err := os.WriteFile(source, []byte("function main() {\n    y = 1;\n\tmissing();\n}\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cFile := filepath.Join(dir, "build", "prog.c")
+	maps := map[string]*codegen.SourceMap{
+		cFile: {File: "prog.c", Mappings: []codegen.Mapping{
+			{Start: 10, End: 10, Source: source, Line: 1, Column: 1, Node: "FunctionStatement"},
+			{Start: 11, End: 12, Source: source, Line: 2, Column: 5, Node: "ExpressionStatement"},
+			{Start: 13, End: 13, Source: source, Line: 3, Column: 2, Node: "ExpressionStatement"},
+			{Start: 14, End: 14, Source: filepath.Join(dir, "gone.hl"), Line: 7, Column: 1, Node: "ReturnStatement"},
+		}},
+	}
+
+	tests := []struct {
+		name   string
+		output string
+		want   string
+	}{
+		{
+			name: "gcc error with context, excerpt and caret",
+			output: "C: In function 'main':\n" +
+				"C:12:5: error: 'y' undeclared (first use in this function)\n" +
+				"   12 |     y = 1;\n" +
+				"      |     ^\n",
+			want: "H:2:5: error: 'y' undeclared (first use in this function)\n" +
+				"    2 |     y = 1;\n" +
+				"      |     ^\n",
+		},
+		{
+			name: "clang error and summary",
+			output: "C:11:5: error: use of undeclared identifier 'y'\n" +
+				"   11 |     y = 1;\n" +
+				"      |     ^\n" +
+				"1 error generated.\n",
+			want: "H:2:5: error: use of undeclared identifier 'y'\n" +
+				"    2 |     y = 1;\n" +
+				"      |     ^\n" +
+				"1 error generated.\n",
+		},
+		{
+			name: "gcc note at top level",
+			output: "C: At top level:\n" +
+				"C:10:6: warning: 'main' defined but not used [-Wunused-function]\n",
+			want: "H:1:1: warning: 'main' defined but not used [-Wunused-function]\n" +
+				"    1 | function main() {\n" +
+				"      | ^\n",
+		},
+		{
+			name: "linker message without a column",
+			output: "/usr/bin/ld: /tmp/ccQ1.o: in function `main':\n" +
+				"C:13: undefined reference to `missing'\n" +
+				"collect2: error: ld returned 1 exit status\n",
+			want: "/usr/bin/ld: /tmp/ccQ1.o: in function `main':\n" +
+				"H:3:2: undefined reference to `missing'\n" +
+				"    3 | \tmissing();\n" +
+				"      | \t^\n" +
+				"collect2: error: ld returned 1 exit status\n",
+		},
+		{
+			name: "unmapped line of a generated file keeps its location and excerpt",
+			output: "C: In function 'main':\n" +
+				"C:3:10: warning: unused variable 'n' [-Wunused-variable]\n" +
+				"    3 |     int n;\n" +
+				"      |         ^\n",
+			want: "C:3:10: warning: unused variable 'n' [-Wunused-variable]\n" +
+				"    3 |     int n;\n" +
+				"      |         ^\n",
+		},
+		{
+			name: "file without a map",
+			output: "/usr/include/stdio.h: In function 'f':\n" +
+				"/usr/include/stdio.h:12:5: note: declared here\n" +
+				"   12 | int printf(const char *, ...);\n" +
+				"      |     ^~~~~~\n",
+			want: "/usr/include/stdio.h: In function 'f':\n" +
+				"/usr/include/stdio.h:12:5: note: declared here\n" +
+				"   12 | int printf(const char *, ...);\n" +
+				"      |     ^~~~~~\n",
+		},
+		{
+			name:   "source that cannot be read has no excerpt",
+			output: "C:14:1: error: expected ';' before '}' token\n   14 | }\n      | ^\n",
+			want:   "GONE:7:1: error: expected ';' before '}' token\n",
+		},
+	}
+	paths := strings.NewReplacer("C:", cFile+":", "H:", source+":", "GONE:", filepath.Join(dir, "gone.hl")+":")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := paths.Replace(tt.want)
+			got := string(translateDiagnostics([]byte(paths.Replace(tt.output)), maps))
+			if got != want {
+				t.Errorf("expected\n%s\ngot\n%s", want, got)
+			}
+		})
+	}
+}
+
+func TestTranslateDiagnostics_Empty(t *testing.T) {
+	if got := translateDiagnostics(nil, nil); len(got) != 0 {
+		t.Errorf("expected no output, got %q", got)
+	}
+}
+
+func TestWriteExcerpt(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapping codegen.Mapping
+		want    string
+	}{
+		{"spaces", codegen.Mapping{Line: 1, Column: 5}, "    1 |     x := 1;\n      |     ^\n"},
+		{"tabs keep the caret under the column", codegen.Mapping{Line: 2, Column: 3}, "    2 | \t\tprint(x);\n      | \t\t^\n"},
+		{"carriage return", codegen.Mapping{Line: 3, Column: 1}, "    3 | }\n      | ^\n"},
+		{"column past the end", codegen.Mapping{Line: 3, Column: 9}, "    3 | }\n      |  ^\n"},
+		{"line past the end", codegen.Mapping{Line: 9, Column: 1}, ""},
+		{"no line", codegen.Mapping{Line: 0, Column: 1}, ""},
+	}
+	sources := map[string][]string{"prog.hl": {"    x := 1;", "\t\tprint(x);", "}\r"}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			m := tt.mapping
+			m.Source = "prog.hl"
+			writeExcerpt(&b, sources, &m)
+			if b.String() != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, b.String())
+			}
+		})
+	}
+}
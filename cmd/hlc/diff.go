@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around a change
+const diffContext = 3
+
+// diffLine is one line of an edit script: ' ' kept, '-' removed, '+' added
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// unifiedDiff returns the changes from a to b as a unified diff, or ""
+// if they are equal
+func unifiedDiff(name string, a, b []byte) string {
+	if string(a) == string(b) {
+		return ""
+	}
+	script := editScript(splitLines(string(a)), splitLines(string(b)))
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s.orig\n+++ %s\n", name, name)
+
+	for i := 0; i < len(script); {
+		if script[i].op == ' ' {
+			i++
+			continue
+		}
+		// A hunk runs from the change, with context, until the next gap
+		// of unchanged lines too long to bridge
+		start := max(i-diffContext, 0)
+		end := i
+		for j := i; j < len(script); j++ {
+			if script[j].op != ' ' {
+				end = j + 1
+			} else if j-end >= 2*diffContext {
+				break
+			}
+		}
+		end = min(end+diffContext, len(script))
+		writeHunk(&out, script, start, end)
+		i = end
+	}
+	return out.String()
+}
+
+// writeHunk writes script[start:end] with its @@ header
+func writeHunk(out *strings.Builder, script []diffLine, start, end int) {
+	// Line numbers in a and b of the hunk's first line
+	aLine, bLine := 1, 1
+	for _, l := range script[:start] {
+		if l.op != '+' {
+			aLine++
+		}
+		if l.op != '-' {
+			bLine++
+		}
+	}
+	aLen, bLen := 0, 0
+	for _, l := range script[start:end] {
+		if l.op != '+' {
+			aLen++
+		}
+		if l.op != '-' {
+			bLen++
+		}
+	}
+	if aLen == 0 {
+		aLine--
+	}
+	if bLen == 0 {
+		bLine--
+	}
+
+	fmt.Fprintf(out, "@@ -%d,%d +%d,%d @@\n", aLine, aLen, bLine, bLen)
+	for _, l := range script[start:end] {
+		out.WriteByte(l.op)
+		out.WriteString(l.text)
+		out.WriteByte('\n')
+	}
+}
+
+// editScript returns the lines of a and b as a shortest edit from a to b,
+// found from their longest common subsequence
+func editScript(a, b []string) []diffLine {
+	// Only the lines between a common prefix and suffix need comparing
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	ma, mb := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+
+	// lcs[i][j] is the length of the longest common subsequence of
+	// ma[i:] and mb[j:]
+	lcs := make([][]int, len(ma)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(mb)+1)
+	}
+	for i := len(ma) - 1; i >= 0; i-- {
+		for j := len(mb) - 1; j >= 0; j-- {
+			if ma[i] == mb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var script []diffLine
+	for _, l := range a[:prefix] {
+		script = append(script, diffLine{' ', l})
+	}
+	i, j := 0, 0
+	for i < len(ma) || j < len(mb) {
+		switch {
+		case i < len(ma) && j < len(mb) && ma[i] == mb[j]:
+			script = append(script, diffLine{' ', ma[i]})
+			i++
+			j++
+		case i < len(ma) && (j == len(mb) || lcs[i+1][j] >= lcs[i][j+1]):
+			script = append(script, diffLine{'-', ma[i]})
+			i++
+		default:
+			script = append(script, diffLine{'+', mb[j]})
+			j++
+		}
+	}
+	for _, l := range a[len(a)-suffix:] {
+		script = append(script, diffLine{' ', l})
+	}
+	return script
+}
+
+// splitLines splits text into lines without their newlines
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/doc"
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+	"github.com/Dr-H-PhD/h-lang/pkg/parser"
+)
+
+// runDoc implements "hlc doc": it prints the documentation of the public
+// declarations of files, or writes it as a Markdown or HTML reference
+func runDoc(args []string) int {
+	flags := flag.NewFlagSet("doc", flag.ExitOnError)
+	formatFlag := flags.String("format", "text", "Output format: text, markdown or html")
+	outputFlag := flags.String("o", "", "Write the documentation to this file instead of standard output")
+	titleFlag := flags.String("title", "", "Title of a Markdown or HTML reference (default: the first path)")
+	flags.Parse(args)
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	names, err := fmtFiles(paths)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	status := 0
+	var files []*doc.File
+	for _, name := range names {
+		source, err := os.ReadFile(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading file: %v\n", err)
+			status = 1
+			continue
+		}
+		p := parser.New(lexer.New(string(source)))
+		program := p.ParseProgram()
+		if len(p.Errors()) > 0 {
+			for _, msg := range p.Errors() {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", name, msg)
+			}
+			status = 1
+			continue
+		}
+
+		f := doc.New(name, program)
+		for _, w := range f.Warnings() {
+			fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+		}
+		files = append(files, f)
+	}
+	if status != 0 {
+		return status
+	}
+
+	title := *titleFlag
+	if title == "" {
+		title = filepath.Base(filepath.Clean(paths[0]))
+		if abs, err := filepath.Abs(paths[0]); err == nil && title == "." {
+			title = filepath.Base(abs)
+		}
+	}
+
+	var out string
+	switch strings.ToLower(*formatFlag) {
+	case "text":
+		out = doc.Text(files)
+	case "markdown", "md":
+		out = doc.Markdown(title, files)
+	case "html":
+		out = doc.HTML(title, files)
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown format %q (want text, markdown or html)\n", *formatFlag)
+		return 1
+	}
+
+	if *outputFlag == "" {
+		fmt.Print(out)
+		return 0
+	}
+	if err := os.WriteFile(*outputFlag, []byte(out), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing file: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+	"github.com/Dr-H-PhD/h-lang/pkg/parser"
+)
+
+// tokenDump is the JSON form of -dump-tokens, which shares the version of
+// the syntax tree schema
+type tokenDump struct {
+	Version int           `json:"version"`
+	File    string        `json:"file"`
+	Tokens  []lexer.Token `json:"tokens"`
+}
+
+// dumpTokens writes the tokens of source, comments and the final EOF
+// included, one per line or as JSON
+func dumpTokens(w io.Writer, source, inputFile string, asJSON bool) error {
+	dump := tokenDump{Version: ast.SchemaVersion, File: inputFile}
+	l := lexer.New(source)
+	for {
+		tok := l.NextToken()
+		dump.Tokens = append(dump.Tokens, tok)
+		if tok.Type == lexer.EOF {
+			break
+		}
+	}
+
+	if asJSON {
+		return writeJSON(w, dump)
+	}
+	for _, tok := range dump.Tokens {
+		if _, err := fmt.Fprintf(w, "%-8s %-10s %q\n", tok.Position(), tok.Type, tok.Literal); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dumpAST writes the syntax tree of source as text or as JSON. It returns
+// the parse errors, if any, instead.
+func dumpAST(w io.Writer, source, inputFile string, asJSON bool) ([]string, error) {
+	p := parser.New(lexer.New(source))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		return p.Errors(), nil
+	}
+	program.File = inputFile
+
+	if asJSON {
+		return nil, writeJSON(w, program)
+	}
+	_, err := io.WriteString(w, ast.Dump(program))
+	return nil, err
+}
+
+func writeJSON(w io.Writer, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/format"
+)
+
+// runFmt implements "hlc fmt": it formats files, or standard input, in
+// the canonical style
+func runFmt(args []string) int {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	writeFlag := flags.Bool("w", false, "Write the result back to the files instead of printing it")
+	listFlag := flags.Bool("l", false, "List the files whose formatting differs")
+	diffFlag := flags.Bool("d", false, "Print diffs instead of the formatted source")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		if *writeFlag {
+			fmt.Fprintf(os.Stderr, "Error: cannot use -w with standard input\n")
+			return 1
+		}
+		source, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading standard input: %v\n", err)
+			return 1
+		}
+		return fmtSource("<standard input>", source, false, *listFlag, *diffFlag)
+	}
+
+	files, err := fmtFiles(flags.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	status := 0
+	for _, file := range files {
+		source, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading file: %v\n", err)
+			status = 1
+			continue
+		}
+		if fmtSource(file, source, *writeFlag, *listFlag, *diffFlag) != 0 {
+			status = 1
+		}
+	}
+	return status
+}
+
+// fmtSource formats the source of one file and reports or writes the
+// result as the flags ask
+func fmtSource(name string, source []byte, write, list, diff bool) int {
+	formatted, err := format.Source(source)
+	if err != nil {
+		for _, msg := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", name, msg)
+		}
+		return 1
+	}
+
+	changed := !bytes.Equal(source, formatted)
+	if list && changed {
+		fmt.Println(name)
+	}
+	if write && changed {
+		info, err := os.Stat(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		if err := os.WriteFile(name, formatted, info.Mode().Perm()); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing file: %v\n", err)
+			return 1
+		}
+	}
+	if diff {
+		fmt.Print(unifiedDiff(name, source, formatted))
+	}
+	if !list && !write && !diff {
+		os.Stdout.Write(formatted)
+	}
+	return 0
+}
+
+// fmtFiles expands the command line into the files to format: files as
+// given and the .hl files under directories, outside hidden directories
+func fmtFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		var found []string
+		err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if p != path && strings.HasPrefix(d.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if filepath.Ext(p) == ".hl" {
+				found = append(found, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(found)
+		files = append(files, found...)
+	}
+	return files, nil
+}
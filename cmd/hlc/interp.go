@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/interp"
+)
+
+// interpret runs an H file with the interpreter instead of compiling it
+// and returns its exit status. args are the arguments after the file.
+func interpret(source, inputFile string, gc bool, args []string) int {
+	program, _, errs := frontend(source, inputFile, gc, false, nil, nil)
+	if len(errs) > 0 {
+		printErrors(errs)
+		return 1
+	}
+
+	in := interp.New()
+	in.GC = gc
+	in.Args = append([]string{inputFile}, args...)
+	in.SetSourceName(inputFile)
+	basePath := filepath.Dir(inputFile)
+	if basePath == "" {
+		basePath = "."
+	}
+	in.SetImportResolver(importResolver(nil, nil), basePath)
+
+	err := in.Load(program)
+	status := 1
+	if err == nil {
+		status, err = in.Main()
+	}
+
+	var exit *interp.ExitError
+	var runtime *interp.Error
+	switch {
+	case err == nil:
+		return status
+	case errors.As(err, &exit):
+		return exit.Status
+	case errors.As(err, &runtime):
+		if runtime.Module == "" {
+			fmt.Fprintf(os.Stderr, "runtime error: %s: %v\n", inputFile, err)
+		} else {
+			fmt.Fprintf(os.Stderr, "runtime error: %v\n", err)
+		}
+	default:
+		// Problems found while loading, one per line
+		printErrors(strings.Split(err.Error(), "\n"))
+	}
+	return 1
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/lsp"
+)
+
+// runLsp implements "hlc lsp": it serves the Language Server Protocol on
+// standard input and output for editors
+func runLsp(args []string) int {
+	flags := flag.NewFlagSet("lsp", flag.ExitOnError)
+	flags.Parse(args)
+
+	if err := lsp.Run(os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
@@ -11,17 +12,51 @@ import (
 	"github.com/Dr-H-PhD/h-lang/pkg/ast"
 	"github.com/Dr-H-PhD/h-lang/pkg/codegen"
 	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+	"github.com/Dr-H-PhD/h-lang/pkg/memcheck"
 	"github.com/Dr-H-PhD/h-lang/pkg/parser"
 	"github.com/Dr-H-PhD/h-lang/pkg/version"
 )
 
 func main() {
+	// Project subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "build":
+			os.Exit(runBuild(os.Args[2:]))
+		case "init":
+			os.Exit(runInit(os.Args[2:]))
+		case "clean":
+			os.Exit(runClean(os.Args[2:]))
+		case "test":
+			os.Exit(runTest(os.Args[2:]))
+		case "fmt":
+			os.Exit(runFmt(os.Args[2:]))
+		case "lsp":
+			os.Exit(runLsp(os.Args[2:]))
+		case "repl":
+			os.Exit(runRepl(os.Args[2:]))
+		case "doc":
+			os.Exit(runDoc(os.Args[2:]))
+		case "vet":
+			os.Exit(runVet(os.Args[2:]))
+		}
+	}
+
 	// Flags
 	outputFlag := flag.String("o", "", "Output file name")
 	emitC := flag.Bool("emit-c", false, "Emit C code instead of compiling")
+	sourceMapFlag := flag.Bool("source-map", false, "With -emit-c, also write the source map as JSON")
+	dumpTokensFlag := flag.Bool("dump-tokens", false, "Print the tokens of the file instead of compiling")
+	dumpASTFlag := flag.Bool("dump-ast", false, "Print the syntax tree of the file instead of compiling")
+	jsonFlag := flag.Bool("json", false, "With -dump-tokens or -dump-ast, print JSON")
 	runFlag := flag.Bool("run", false, "Compile and run immediately")
+	interpFlag := flag.Bool("interp", false, "Run the file with the interpreter instead of compiling it")
+	gcFlag := flag.Bool("gc", false, "Use the garbage collector instead of manual free")
+	traceFlag := flag.Bool("x", false, "Report build cache hits and misses and print C compiler commands")
 	versionFlag := flag.Bool("version", false, "Print version")
 	helpFlag := flag.Bool("help", false, "Print help")
+	libs, libDirs := linkFlags(flag.CommandLine)
+	tc := toolchainFlags(flag.CommandLine)
 
 	flag.Parse()
 
@@ -50,84 +85,139 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Compile
-	cCode, errors := compile(string(source), inputFile)
-	if len(errors) > 0 {
-		fmt.Fprintf(os.Stderr, "Compilation errors:\n")
-		for _, e := range errors {
-			fmt.Fprintf(os.Stderr, "  %s\n", e)
+	if *dumpTokensFlag {
+		if err := dumpTokens(os.Stdout, string(source), inputFile, *jsonFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
 		}
-		os.Exit(1)
+		return
+	}
+	if *dumpASTFlag {
+		errors, err := dumpAST(os.Stdout, string(source), inputFile, *jsonFlag)
+		if len(errors) > 0 {
+			printErrors(errors)
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *interpFlag {
+		os.Exit(interpret(string(source), inputFile, *gcFlag, programArgs(flag.Args()[1:])))
 	}
 
 	// Determine output names
 	baseName := strings.TrimSuffix(filepath.Base(inputFile), ".hl")
-	cFileName := baseName + ".c"
 	outputName := baseName
 	if *outputFlag != "" {
 		outputName = *outputFlag
-		if *emitC {
-			cFileName = outputName
-		}
 	}
 
 	if *emitC {
-		// Just emit C code
+		// Just emit C code, as a single file, with line directives
+		// only when debugging since the C file is kept
+		cFileName := baseName + ".c"
+		if *outputFlag != "" {
+			cFileName = outputName
+		}
+		cCode, sourceMap, errors := compile(string(source), inputFile, cFileName, *gcFlag, tc.debug, nil)
+		if len(errors) > 0 {
+			printErrors(errors)
+			os.Exit(1)
+		}
 		err := os.WriteFile(cFileName, []byte(cCode), 0644)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error writing C file: %v\n", err)
 			os.Exit(1)
 		}
 		fmt.Printf("Generated: %s\n", cFileName)
-		return
-	}
 
-	// Write temporary C file
-	tmpDir, err := os.MkdirTemp("", "hlc-*")
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating temp directory: %v\n", err)
-		os.Exit(1)
+		if *sourceMapFlag {
+			mapFileName := strings.TrimSuffix(cFileName, ".c") + ".map.json"
+			data, err := json.MarshalIndent(sourceMap, "", "  ")
+			if err == nil {
+				err = os.WriteFile(mapFileName, append(data, '\n'), 0644)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing source map: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Generated: %s\n", mapFileName)
+		}
+		return
 	}
-	defer os.RemoveAll(tmpDir)
 
-	tmpCFile := filepath.Join(tmpDir, cFileName)
-	err = os.WriteFile(tmpCFile, []byte(cCode), 0644)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error writing temp C file: %v\n", err)
+	// Compile each module separately and link
+	b := newBuilder(*gcFlag, *traceFlag)
+	b.libs, b.libDirs = *libs, *libDirs
+	b.tc = tc
+	units, linked, errors := b.units(source, inputFile)
+	if len(errors) > 0 {
+		printErrors(errors)
 		os.Exit(1)
 	}
 
-	// Compile with gcc/clang
-	compiler := findCompiler()
-	if compiler == "" {
-		fmt.Fprintf(os.Stderr, "Error: no C compiler found (tried gcc, clang)\n")
-		os.Exit(1)
-	}
-
-	cmd := exec.Command(compiler, "-o", outputName, tmpCFile)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	err = cmd.Run()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error compiling C code: %v\n", err)
+	if err := b.link(units, outputName, includeFlags(inputFile), linked); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 
 	fmt.Printf("Compiled: %s\n", outputName)
 
-	// Run if requested
+	// Run if requested, passing on the arguments after the input file
+	// and the program's exit status
 	if *runFlag {
 		fmt.Println("---")
-		runCmd := exec.Command("./" + outputName)
+		runCmd := exec.Command("./"+outputName, programArgs(flag.Args()[1:])...)
 		runCmd.Stdout = os.Stdout
 		runCmd.Stderr = os.Stderr
 		runCmd.Stdin = os.Stdin
-		runCmd.Run()
+		if err := runCmd.Run(); err != nil {
+			if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() >= 0 {
+				os.Exit(exit.ExitCode())
+			}
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
 	}
 }
 
-func compile(source string, inputFile string) (string, []string) {
+// programArgs returns the arguments after the input file, without the
+// "--" that may separate them
+func programArgs(args []string) []string {
+	if len(args) > 0 && args[0] == "--" {
+		return args[1:]
+	}
+	return args
+}
+
+// compile translates H source to the C file cFile and returns it with
+// its source map. Imports are resolved relative to the input file, then
+// against each of roots in order. With lines, #line directives map the C
+// back to the H source.
+func compile(source string, inputFile, cFile string, gc, lines bool, roots []string) (string, *codegen.SourceMap, []string) {
+	program, g, errors := frontend(source, inputFile, gc, false, roots, nil)
+	if len(errors) > 0 {
+		return "", nil, errors
+	}
+	g.SetLineDirectives(lines)
+	g.SetCFileName(cFile)
+
+	cCode := g.Generate(program)
+	if len(g.Errors()) > 0 {
+		return "", nil, g.Errors()
+	}
+
+	return cCode, g.SourceMap(), nil
+}
+
+// frontend parses source, runs the memory checks and returns the program
+// with a generator ready to translate it, into a test binary if tests is
+// set. The files read and warnings printed are recorded in s, if given.
+func frontend(source string, inputFile string, gc, tests bool, roots []string, s *session) (*ast.Program, *codegen.Generator, []string) {
 	// Lexer
 	l := lexer.New(source)
 
@@ -136,67 +226,116 @@ func compile(source string, inputFile string) (string, []string) {
 	program := p.ParseProgram()
 
 	if len(p.Errors()) > 0 {
-		return "", p.Errors()
+		return nil, nil, p.Errors()
+	}
+
+	// Memory safety analysis (warnings only, irrelevant when collected)
+	if !gc {
+		for _, w := range memcheck.Check(program) {
+			msg := fmt.Sprintf("warning: %s:%s", inputFile, w)
+			fmt.Fprintln(os.Stderr, msg)
+			s.warn(msg)
+		}
 	}
 
 	// Code generation
 	g := codegen.New()
+	g.SetGC(gc)
+	g.SetTestMode(tests)
+	g.SetSourceName(inputFile)
 
 	// Set up import resolver
 	basePath := filepath.Dir(inputFile)
 	if basePath == "" {
 		basePath = "."
 	}
-	g.SetImportResolver(resolveImport, basePath)
+	g.SetImportResolver(importResolver(roots, s), basePath)
 
-	cCode := g.Generate(program)
-
-	return cCode, nil
+	return program, g, nil
 }
 
-// resolveImport reads and parses an imported file
-func resolveImport(importPath, basePath string) (*ast.Program, error) {
-	// Resolve the full path
-	fullPath := filepath.Join(basePath, importPath)
+// importResolver returns a resolver that looks for an import next to the
+// importing file first and then under each root
+func importResolver(roots []string, s *session) codegen.ImportResolver {
+	return func(importPath, basePath string) (*ast.Program, error) {
+		fullPath := filepath.Join(basePath, importPath)
+		if _, err := os.Stat(fullPath); err != nil && !filepath.IsAbs(importPath) {
+			s.missing(fullPath)
+			for _, root := range roots {
+				candidate := filepath.Join(root, importPath)
+				if _, err := os.Stat(candidate); err == nil {
+					fullPath = candidate
+					break
+				}
+				s.missing(candidate)
+			}
+		}
 
-	// Read the file
-	source, err := os.ReadFile(fullPath)
-	if err != nil {
-		return nil, fmt.Errorf("cannot import %q: %v", importPath, err)
-	}
+		// Read the file
+		source, err := os.ReadFile(fullPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot import %q: %v", importPath, err)
+		}
+		s.read(fullPath, source)
 
-	// Parse the file
-	l := lexer.New(string(source))
-	p := parser.New(l)
-	program := p.ParseProgram()
+		// Parse the file
+		l := lexer.New(string(source))
+		p := parser.New(l)
+		program := p.ParseProgram()
 
-	if len(p.Errors()) > 0 {
-		return nil, fmt.Errorf("errors in imported file %q: %v", importPath, p.Errors())
-	}
+		if len(p.Errors()) > 0 {
+			return nil, fmt.Errorf("errors in imported file %q: %v", importPath, p.Errors())
+		}
+		program.File = fullPath
 
-	return program, nil
+		return program, nil
+	}
 }
 
-func findCompiler() string {
-	compilers := []string{"gcc", "clang", "cc"}
-	for _, c := range compilers {
-		path, err := exec.LookPath(c)
-		if err == nil {
-			return path
-		}
+func printErrors(errors []string) {
+	fmt.Fprintf(os.Stderr, "Compilation errors:\n")
+	for _, e := range errors {
+		fmt.Fprintf(os.Stderr, "  %s\n", e)
 	}
-	return ""
 }
 
 func printUsage() {
 	fmt.Println("H-lang Compiler (hlc)")
 	fmt.Println()
 	fmt.Println("Usage: hlc [options] <file.hl>")
+	fmt.Println("       hlc <command> [arguments]")
+	fmt.Println()
+	fmt.Println("Commands:")
+	fmt.Println("  build [flags] [bin...]     Build the targets in hl.toml (all by default)")
+	fmt.Println("  init [dir]                 Create a new project in dir (default: .)")
+	fmt.Println("  clean [-cache]             Remove the project's build output or the build cache")
+	fmt.Println("  test [flags] [path...]     Run the test blocks of files or directories (default: .)")
+	fmt.Println("  fmt [-w] [-l] [-d] [path...]  Format files or directories, or standard input")
+	fmt.Println("  lsp                        Run the language server on standard input and output")
+	fmt.Println("  repl [flags]               Start an interactive session")
+	fmt.Println("  doc [flags] [path...]      Print or generate the documentation of public declarations")
+	fmt.Println("  vet [-fix] [path...]       Report likely mistakes such as unused variables and unreachable code")
 	fmt.Println()
 	fmt.Println("Options:")
 	fmt.Println("  -o <file>     Output file name")
-	fmt.Println("  -emit-c       Emit C code instead of compiling")
+	fmt.Println("  -emit-c       Emit C code as a single file instead of compiling")
+	fmt.Println("  -source-map   With -emit-c, also write the source map as JSON")
+	fmt.Println("  -dump-tokens  Print the tokens of the file")
+	fmt.Println("  -dump-ast     Print the syntax tree of the file")
+	fmt.Println("  -json         With -dump-tokens or -dump-ast, print JSON")
 	fmt.Println("  -run          Compile and run immediately")
+	fmt.Println("  -interp       Run with the interpreter; no C compiler is needed")
+	fmt.Println("  -gc           Garbage-collected mode (free becomes a hint)")
+	fmt.Println("  -x            Report build cache hits and misses and print C compiler commands")
+	fmt.Println("  -l <name>     Link against a C library (repeatable)")
+	fmt.Println("  -L <dir>      Search dir for C libraries (repeatable)")
+	fmt.Println("  -cc <cmd>     C compiler to use (default: $CC, or gcc, clang or cc)")
+	fmt.Println("  -O0 .. -O3    Optimisation level of the generated C")
+	fmt.Println("  -g            Compile with debug information and #line directives")
+	fmt.Println("  -static       Link a static executable")
+	fmt.Println("  -cflags \"..\"  Extra C compiler flags, added after $CFLAGS")
+	fmt.Println("  -v            Print the C compiler commands")
+	fmt.Println("  -strict       Treat C compiler warnings as internal compiler errors")
 	fmt.Println("  -version      Print version")
 	fmt.Println("  -help         Print this help")
 	fmt.Println()
@@ -205,4 +344,14 @@ func printUsage() {
 	fmt.Println("  hlc -o myapp hello.hl     Compile to ./myapp")
 	fmt.Println("  hlc -emit-c hello.hl      Generate hello.c")
 	fmt.Println("  hlc -run hello.hl         Compile and run")
+	fmt.Println("  hlc -run prog.hl -- a b   Compile and run with arguments")
+	fmt.Println("  hlc -gc -run script.hl    Compile with the garbage collector and run")
+	fmt.Println("  hlc -interp script.hl     Run without compiling")
+	fmt.Println("  hlc -l sqlite3 db.hl      Compile and link against libsqlite3")
+	fmt.Println("  hlc -O2 -g -v prog.hl     Optimise with debug information, showing the C commands")
+	fmt.Println("  hlc init hello && cd hello && hlc build")
+	fmt.Println()
+	fmt.Println("Builds are cached in $HLC_CACHE, or $XDG_CACHE_HOME/hlc by default.")
+	fmt.Println("Set HLC_CACHE=off to disable the cache. $CFLAGS and $LDFLAGS are passed to")
+	fmt.Println("the C compiler.")
 }
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/cache"
+	"github.com/Dr-H-PhD/h-lang/pkg/manifest"
+)
+
+// loadManifest finds and loads the hl.toml governing the current directory
+func loadManifest() (*manifest.Manifest, error) {
+	path, err := manifest.Find(".")
+	if err != nil {
+		return nil, err
+	}
+	return manifest.Load(path)
+}
+
+// runBuild implements "hlc build": it compiles every [[bin]] target, or
+// only the named ones, into the manifest's output directory
+func runBuild(args []string) int {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	gcFlag := fs.Bool("gc", false, "Use the garbage collector (overrides build.gc)")
+	traceFlag := fs.Bool("x", false, "Report build cache hits and misses and print C compiler commands")
+	libs, libDirs := linkFlags(fs)
+	tc := toolchainFlags(fs)
+	fs.Parse(args)
+
+	m, err := loadManifest()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	targets := m.Bins
+	if fs.NArg() > 0 {
+		targets = nil
+		for _, name := range fs.Args() {
+			b := m.Bin(name)
+			if b == nil {
+				fmt.Fprintf(os.Stderr, "Error: no [[bin]] named %q in %s\n", name, manifest.FileName)
+				return 1
+			}
+			targets = append(targets, b)
+		}
+	}
+
+	if err := os.MkdirAll(m.OutputDir(), 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating output directory: %v\n", err)
+		return 1
+	}
+
+	bld := newBuilder(m.Build.GC || *gcFlag, *traceFlag)
+	bld.roots = m.ImportRoots()
+	bld.libs, bld.libDirs = *libs, *libDirs
+	bld.tc = tc
+	status := 0
+	for _, b := range targets {
+		if err := buildTarget(bld, m, b); err != nil {
+			fmt.Fprintf(os.Stderr, "Error building %s: %v\n", b.Name, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// buildTarget compiles one binary of a project
+func buildTarget(bld *builder, m *manifest.Manifest, b *manifest.Binary) error {
+	mainPath := m.MainPath(b)
+	source, err := os.ReadFile(mainPath)
+	if err != nil {
+		return err
+	}
+
+	units, linked, errors := bld.units(source, displayPath(mainPath))
+	if len(errors) > 0 {
+		printErrors(errors)
+		return fmt.Errorf("%d compilation error(s)", len(errors))
+	}
+
+	output := filepath.Join(m.OutputDir(), b.Name)
+	cflags := append(m.CFlags(b), includeFlags(mainPath)...)
+	if err := bld.link(units, output, cflags, append(m.Libs(b), linked...)); err != nil {
+		return err
+	}
+	fmt.Printf("Built: %s\n", displayPath(output))
+	return nil
+}
+
+// runInit implements "hlc init": it scaffolds a project with a manifest,
+// an entry file and an empty import root
+func runInit(args []string) int {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	fs.Parse(args)
+
+	dir := "."
+	if fs.NArg() > 0 {
+		dir = fs.Arg(0)
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	if _, err := os.Stat(filepath.Join(abs, manifest.FileName)); err == nil {
+		fmt.Fprintf(os.Stderr, "Error: %s already exists in %s\n", manifest.FileName, dir)
+		return 1
+	}
+
+	name := filepath.Base(abs)
+	files := []struct {
+		path    string
+		content string
+	}{
+		{manifest.FileName, manifest.Template(name)},
+		{filepath.Join("src", "main.hl"), fmt.Sprintf("# main.hl - entry point of %s\n\nfunction main() {\n    print(\"Hello, %s!\");\n}\n", name, name)},
+		{".gitignore", "/build/\n"},
+	}
+
+	for _, sub := range []string{"src", "lib"} {
+		if err := os.MkdirAll(filepath.Join(abs, sub), 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+	}
+	for _, f := range files {
+		path := filepath.Join(abs, f.path)
+		if _, err := os.Stat(path); err == nil {
+			// Never overwrite existing sources
+			continue
+		}
+		if err := os.WriteFile(path, []byte(f.content), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+	}
+
+	fmt.Printf("Created project %s in %s\n", name, dir)
+	return 0
+}
+
+// runClean implements "hlc clean": it removes the output directory, or
+// with -cache the build cache
+func runClean(args []string) int {
+	fs := flag.NewFlagSet("clean", flag.ExitOnError)
+	cacheFlag := fs.Bool("cache", false, "Remove the build cache instead of the project output")
+	fs.Parse(args)
+
+	if *cacheFlag {
+		dir, err := cache.DefaultDir()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		if dir == "" {
+			return 0
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Removed: %s\n", dir)
+		return 0
+	}
+
+	m, err := loadManifest()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	out := m.OutputDir()
+	if _, err := os.Stat(out); os.IsNotExist(err) {
+		return 0
+	}
+	if err := os.RemoveAll(out); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Removed: %s\n", displayPath(out))
+	return 0
+}
+
+// displayPath returns path relative to the working directory if possible
+func displayPath(path string) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return path
+	}
+	if rel, err := filepath.Rel(wd, path); err == nil {
+		return rel
+	}
+	return path
+}
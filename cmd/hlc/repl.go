@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/manifest"
+	"github.com/Dr-H-PhD/h-lang/pkg/repl"
+)
+
+const replHelp = `Enter declarations, statements or expressions; an expression's value
+is printed. An input continues over several lines until its brackets
+are balanced.
+
+Commands:
+  :type <expr>  Print the type of an expression
+  :ast <expr>   Print the parse tree of an expression
+  :c <expr>     Print the C an expression translates to
+  :reset        Forget everything entered so far
+  :help         Print this help
+  :quit         Leave the session (or end of input)
+`
+
+// runRepl implements "hlc repl": it reads declarations and statements
+// line by line and compiles and runs them as they are entered
+func runRepl(args []string) int {
+	flags := flag.NewFlagSet("repl", flag.ExitOnError)
+	gcFlag := flags.Bool("gc", false, "Use the garbage collector")
+	timeout := flags.Duration("timeout", repl.DefaultTimeout, "Stop an input that runs longer than this, 0 for no limit")
+	tc := toolchainFlags(flags)
+	libs, libDirs := linkFlags(flags)
+	flags.Parse(args)
+
+	compiler, ccArgs := tc.compiler()
+	if cc := tc.requested(); compiler == "" && cc != "" {
+		fmt.Fprintf(os.Stderr, "Error: C compiler %q not found\n", cc)
+		return 1
+	}
+	if compiler == "" {
+		fmt.Fprintf(os.Stderr, "Error: no C compiler found (install gcc or clang)\n")
+		return 1
+	}
+
+	s, err := repl.New(compiler)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	defer s.Close()
+	s.GC = *gcFlag
+	s.Timeout = *timeout
+	s.Strict = tc.strict
+	if tc.verbose {
+		s.Log = os.Stderr
+	}
+	cflags := append(ccArgs, tc.compileFlags()...)
+	ldflags := tc.linkFlags()
+	for _, dir := range *libDirs {
+		ldflags = append(ldflags, "-L"+dir)
+	}
+	for _, lib := range *libs {
+		ldflags = append(ldflags, "-l"+lib)
+	}
+
+	// Inside a project, imports resolve as they do for hlc build
+	var roots []string
+	if path, err := manifest.Find("."); err == nil {
+		m, err := manifest.Load(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		roots = m.ImportRoots()
+		s.GC = s.GC || m.Build.GC
+		cflags = append(cflags, m.Build.CFlags...)
+		for _, lib := range m.Build.Libs {
+			ldflags = append(ldflags, "-l"+lib)
+		}
+	}
+	s.Flags, s.LinkFlags = cflags, ldflags
+	s.Resolver = importResolver(roots, nil)
+
+	in := bufio.NewReader(os.Stdin)
+	for {
+		input, ok := readInput(in)
+		if !ok {
+			fmt.Println()
+			return 0
+		}
+		if quit := evalInput(s, strings.TrimSpace(input)); quit {
+			return 0
+		}
+	}
+}
+
+// readInput reads one input, prompting for more lines until it is
+// complete. It returns false at the end of the input.
+func readInput(in *bufio.Reader) (string, bool) {
+	var buf strings.Builder
+	prompt := "> "
+	for {
+		fmt.Print(prompt)
+		line, err := in.ReadString('\n')
+		buf.WriteString(line)
+		if err == io.EOF && buf.Len() == 0 {
+			return "", false
+		}
+		if err != nil || repl.Complete(buf.String()) {
+			return buf.String(), true
+		}
+		prompt = "... "
+	}
+}
+
+// evalInput runs a command or evaluates an input and prints the result.
+// It reports whether the session should end.
+func evalInput(s *repl.Session, input string) bool {
+	if input == "" {
+		return false
+	}
+
+	var out string
+	var err error
+	command, arg, _ := strings.Cut(input, " ")
+	switch command {
+	case ":quit", ":q":
+		return true
+	case ":help":
+		out = replHelp
+	case ":reset":
+		s.Reset()
+	case ":type":
+		out, err = s.TypeOf(arg)
+		out += "\n"
+	case ":ast":
+		out, err = repl.AST(arg)
+	case ":c":
+		out, err = s.C(arg)
+		out += "\n"
+	default:
+		if strings.HasPrefix(command, ":") {
+			err = fmt.Errorf("unknown command %s (try :help)", command)
+		} else {
+			out, err = s.Eval(input)
+		}
+	}
+
+	if err != nil {
+		// Output printed before a failure is still shown
+		if out != "" && strings.TrimSpace(out) != "" {
+			fmt.Print(out)
+		}
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return false
+	}
+	fmt.Print(out)
+	return false
+}
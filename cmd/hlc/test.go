@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+	"github.com/Dr-H-PhD/h-lang/pkg/manifest"
+	"github.com/Dr-H-PhD/h-lang/pkg/parser"
+)
+
+// runTest implements "hlc test": it builds a test binary for every file
+// with test blocks, runs it and reports each file as ok or FAIL
+func runTest(args []string) int {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	gcFlag := flags.Bool("gc", false, "Use the garbage collector")
+	traceFlag := flags.Bool("x", false, "Report build cache hits and misses and print C compiler commands")
+	verboseFlag := flags.Bool("v", false, "Report every test, not only failures")
+	runFlag := flags.String("run", "", "Run only the tests whose names match this extended regular expression")
+	libs, libDirs := linkFlags(flags)
+	tc := toolchainFlags(flags)
+	flags.Parse(args)
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	files, err := testFiles(paths)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	bld := newBuilder(*gcFlag, *traceFlag)
+	bld.tests = true
+	bld.libs, bld.libDirs = *libs, *libDirs
+	bld.tc = tc
+	// Inside a project, imports resolve as they do for hlc build
+	if path, err := manifest.Find("."); err == nil {
+		m, err := manifest.Load(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		bld.roots = m.ImportRoots()
+		bld.gc = bld.gc || m.Build.GC
+	}
+
+	var runArgs []string
+	if *verboseFlag {
+		runArgs = append(runArgs, "-v")
+	}
+	if *runFlag != "" {
+		runArgs = append(runArgs, "-run", *runFlag)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "hlc-test-*")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating temp directory: %v\n", err)
+		return 1
+	}
+	defer os.RemoveAll(tmpDir)
+
+	status := 0
+	for i, file := range files {
+		start := time.Now()
+		result := testFile(bld, file, filepath.Join(tmpDir, fmt.Sprintf("test%d", i)), runArgs)
+		elapsed := time.Since(start).Seconds()
+		switch result {
+		case testPassed:
+			fmt.Printf("ok  \t%s\t%.2fs\n", file, elapsed)
+		case testNone:
+			fmt.Printf("?   \t%s\t[no tests]\n", file)
+		case testBuildFailed:
+			fmt.Printf("FAIL\t%s\t[build failed]\n", file)
+			status = 1
+		default:
+			fmt.Printf("FAIL\t%s\t%.2fs\n", file, elapsed)
+			status = 1
+		}
+	}
+	return status
+}
+
+type testResult int
+
+const (
+	testPassed testResult = iota
+	testFailed
+	testBuildFailed
+	testNone
+)
+
+// testFile builds the test binary of one file as output and runs it
+func testFile(bld *builder, file, output string, runArgs []string) testResult {
+	source, err := os.ReadFile(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading file: %v\n", err)
+		return testBuildFailed
+	}
+	if has, parsed := hasTests(string(source)); parsed && !has {
+		return testNone
+	}
+
+	units, linked, errs := bld.units(source, file)
+	if len(errs) > 0 {
+		printErrors(errs)
+		return testBuildFailed
+	}
+	if err := bld.link(units, output, includeFlags(file), linked); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return testBuildFailed
+	}
+
+	cmd := exec.Command(output, runArgs...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		var exit *exec.ExitError
+		if !errors.As(err, &exit) || exit.ExitCode() < 0 {
+			// Killed by a signal, such as a crash inside a test
+			fmt.Printf("%s: %v\n", file, err)
+		}
+		return testFailed
+	}
+	return testPassed
+}
+
+// testFiles expands the command line into the files to test. Files are
+// tested as given; directories contribute the .hl files in them that
+// declare tests, and dir/... also those in its subdirectories.
+func testFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		recursive := false
+		if path == "..." || strings.HasSuffix(path, "/...") {
+			recursive = true
+			path = filepath.Clean(strings.TrimSuffix(path, "..."))
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		var found []string
+		err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if p != path && (!recursive || strings.HasPrefix(d.Name(), ".")) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if filepath.Ext(p) != ".hl" {
+				return nil
+			}
+			source, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			// Files that do not parse are kept so their errors are reported
+			if has, parsed := hasTests(string(source)); has || !parsed {
+				found = append(found, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(found)
+		files = append(files, found...)
+	}
+	return files, nil
+}
+
+// hasTests reports whether source declares test blocks, and whether it
+// could be parsed to find out
+func hasTests(source string) (has, parsed bool) {
+	p := parser.New(lexer.New(source))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		return false, false
+	}
+	for _, stmt := range program.Statements {
+		if _, ok := stmt.(*ast.TestStatement); ok {
+			return true, true
+		}
+	}
+	return false, true
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// toolchain holds how a command invokes the C compiler: which one, and
+// the flags it adds to each compile and link step
+type toolchain struct {
+	cc       string   // -cc, overriding $CC and the search for gcc, clang and cc
+	optimise int      // -O0 to -O3, or -1 to leave the compiler's default
+	debug    bool     // -g
+	static   bool     // -static
+	envFlags []string // $CFLAGS
+	cflags   []string // -cflags
+	ldflags  []string // $LDFLAGS
+	verbose  bool     // -v: print every C compiler command
+	strict   bool     // treat C compiler warnings as internal compiler errors
+}
+
+// toolchainFlags registers the C compiler flags of a command
+func toolchainFlags(flags *flag.FlagSet) *toolchain {
+	tc := &toolchain{optimise: -1}
+	flags.StringVar(&tc.cc, "cc", "", "C compiler to use (default: $CC, or the first of gcc, clang and cc)")
+	for level := 0; level <= 3; level++ {
+		flags.Var(optimiseFlag{tc, level}, fmt.Sprintf("O%d", level), fmt.Sprintf("Compile the generated C with -O%d", level))
+	}
+	flags.BoolVar(&tc.debug, "g", false, "Compile with debug information")
+	flags.BoolVar(&tc.static, "static", false, "Link a static executable")
+	flags.Func("cflags", "Extra C compiler `flags`, separated by spaces", func(value string) error {
+		tc.cflags = append(tc.cflags, strings.Fields(value)...)
+		return nil
+	})
+	// hlc test keeps -v for reporting every test
+	if flags.Lookup("v") == nil {
+		flags.BoolVar(&tc.verbose, "v", false, "Print the C compiler commands")
+	}
+	flags.BoolVar(&tc.strict, "strict", false, "Treat C compiler warnings as internal compiler errors")
+
+	tc.envFlags = strings.Fields(os.Getenv("CFLAGS"))
+	tc.ldflags = strings.Fields(os.Getenv("LDFLAGS"))
+	return tc
+}
+
+// optimiseFlag is one of -O0 to -O3. Like the C compiler's, the flags
+// take no value.
+type optimiseFlag struct {
+	tc    *toolchain
+	level int
+}
+
+func (f optimiseFlag) IsBoolFlag() bool { return true }
+
+func (f optimiseFlag) String() string { return "" }
+
+func (f optimiseFlag) Set(value string) error {
+	if value != "true" {
+		return fmt.Errorf("-O%d takes no value", f.level)
+	}
+	f.tc.optimise = f.level
+	return nil
+}
+
+// compileFlags returns the flags of every step, compiling and linking,
+// before the flags of a project or file. Later flags win, so the command
+// line comes after the environment.
+func (tc *toolchain) compileFlags() []string {
+	flags := append([]string{}, tc.envFlags...)
+	if tc.optimise >= 0 {
+		flags = append(flags, fmt.Sprintf("-O%d", tc.optimise))
+	}
+	if tc.debug {
+		flags = append(flags, "-g")
+	}
+	return append(flags, tc.cflags...)
+}
+
+// linkFlags returns the flags only the link step takes
+func (tc *toolchain) linkFlags() []string {
+	flags := append([]string{}, tc.ldflags...)
+	if tc.static {
+		flags = append(flags, "-static")
+	}
+	return flags
+}
+
+// compiler returns the path of the C compiler and the words that follow
+// its name in -cc or $CC, or "" if none is found
+func (tc *toolchain) compiler() (string, []string) {
+	if tc.cc != "" {
+		return lookCompiler(tc.cc)
+	}
+	return findCompiler()
+}
+
+// requested returns the C compiler named by -cc or $CC, if any
+func (tc *toolchain) requested() string {
+	if tc.cc != "" {
+		return tc.cc
+	}
+	return os.Getenv("CC")
+}
+
+// findCompiler returns the C compiler named by $CC or, without it, the
+// first of gcc, clang and cc on the PATH
+func findCompiler() (string, []string) {
+	if cc := os.Getenv("CC"); cc != "" {
+		return lookCompiler(cc)
+	}
+	for _, c := range []string{"gcc", "clang", "cc"} {
+		if path, err := exec.LookPath(c); err == nil {
+			return path, nil
+		}
+	}
+	return "", nil
+}
+
+// lookCompiler splits a C compiler command into words, as make does with
+// $CC, so that "gcc -m64" and "ccache gcc" work. It returns the path of
+// the first word and the rest, or "" if the first is not found.
+func lookCompiler(cc string) (string, []string) {
+	words := strings.Fields(cc)
+	if len(words) == 0 {
+		return "", nil
+	}
+	path, err := exec.LookPath(words[0])
+	if err != nil {
+		return "", nil
+	}
+	return path, words[1:]
+}
+
+// commandLine spells out a command so that it can be pasted into a shell
+func commandLine(name string, args []string) string {
+	words := []string{shellQuote(name)}
+	for _, arg := range args {
+		words = append(words, shellQuote(arg))
+	}
+	return strings.Join(words, " ")
+}
+
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./=:,+@%", r))
+	}) == -1 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
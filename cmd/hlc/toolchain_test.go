@@ -0,0 +1,194 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/codegen"
+)
+
+func TestToolchainFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		args    []string
+		compile []string
+		link    []string
+		strict  bool
+	}{
+		{"defaults", nil, nil, nil, nil, false},
+		{"-O0", nil, []string{"-O0"}, []string{"-O0"}, nil, false},
+		{"-O1", nil, []string{"-O1"}, []string{"-O1"}, nil, false},
+		{"-O2", nil, []string{"-O2"}, []string{"-O2"}, nil, false},
+		{"-O3", nil, []string{"-O3"}, []string{"-O3"}, nil, false},
+		{"last -O wins", nil, []string{"-O3", "-O1"}, []string{"-O1"}, nil, false},
+		{"-g", nil, []string{"-g", "-O2"}, []string{"-O2", "-g"}, nil, false},
+		{"-cflags", nil, []string{"-cflags", "-Wall  -DX", "-cflags=-DY"}, []string{"-Wall", "-DX", "-DY"}, nil, false},
+		{"$CFLAGS before -O and -cflags", map[string]string{"CFLAGS": "-O1 -DENV"}, []string{"-cflags", "-DX", "-O2"}, []string{"-O1", "-DENV", "-O2", "-DX"}, nil, false},
+		{"-static", nil, []string{"-static"}, nil, []string{"-static"}, false},
+		{"$LDFLAGS before -static", map[string]string{"LDFLAGS": "-L/opt/lib -lm"}, []string{"-static"}, nil, []string{"-L/opt/lib", "-lm", "-static"}, false},
+		{"-strict", nil, []string{"-strict"}, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CFLAGS", tt.env["CFLAGS"])
+			t.Setenv("LDFLAGS", tt.env["LDFLAGS"])
+			flags := flag.NewFlagSet("build", flag.ContinueOnError)
+			tc := toolchainFlags(flags)
+			if err := flags.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if got := tc.compileFlags(); len(got) > 0 || len(tt.compile) > 0 {
+				if !reflect.DeepEqual(got, tt.compile) {
+					t.Errorf("compile flags: got %q, want %q", got, tt.compile)
+				}
+			}
+			if got := tc.linkFlags(); len(got) > 0 || len(tt.link) > 0 {
+				if !reflect.DeepEqual(got, tt.link) {
+					t.Errorf("link flags: got %q, want %q", got, tt.link)
+				}
+			}
+			if tc.strict != tt.strict {
+				t.Errorf("strict: got %v, want %v", tc.strict, tt.strict)
+			}
+		})
+	}
+}
+
+func TestToolchainFlags_OptimiseValue(t *testing.T) {
+	flags := flag.NewFlagSet("build", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	toolchainFlags(flags)
+	if err := flags.Parse([]string{"-O2=3"}); err == nil || !strings.Contains(err.Error(), "-O2 takes no value") {
+		t.Errorf("got %v, want -O2 takes no value", err)
+	}
+}
+
+// fakeCompiler writes an executable script to dir that logs its
+// arguments to $HLC_CC_LOG and prints a warning
+func fakeCompiler(t *testing.T, dir, name string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	script := "#!/bin/sh\necho \"$@\" >> \"$HLC_CC_LOG\"\necho \"warning: fake\" >&2\n"
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLookCompiler(t *testing.T) {
+	dir := t.TempDir()
+	gcc := fakeCompiler(t, dir, "gcc")
+	ccache := fakeCompiler(t, dir, "ccache")
+	t.Setenv("PATH", dir)
+
+	tests := []struct {
+		cc   string
+		path string
+		args []string
+	}{
+		{"gcc", gcc, []string{}},
+		{"gcc -m64", gcc, []string{"-m64"}},
+		{"  ccache gcc ", ccache, []string{"gcc"}},
+		{gcc + " -m32 -std=c99", gcc, []string{"-m32", "-std=c99"}},
+		{"clang", "", nil},
+		{"", "", nil},
+	}
+	for _, tt := range tests {
+		path, args := lookCompiler(tt.cc)
+		if path != tt.path || !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("%q: got %q %q, want %q %q", tt.cc, path, args, tt.path, tt.args)
+		}
+	}
+
+	t.Setenv("CC", "ccache gcc")
+	if path, args := findCompiler(); path != ccache || !reflect.DeepEqual(args, []string{"gcc"}) {
+		t.Errorf("$CC: got %q %q, want %q [gcc]", path, args, ccache)
+	}
+	tc := &toolchain{cc: "gcc -m64", optimise: -1}
+	if path, args := tc.compiler(); path != gcc || !reflect.DeepEqual(args, []string{"-m64"}) {
+		t.Errorf("-cc: got %q %q, want %q [-m64]", path, args, gcc)
+	}
+}
+
+func TestLink(t *testing.T) {
+	dir := t.TempDir()
+	fakeCompiler(t, dir, "gcc")
+	t.Setenv("PATH", dir)
+	units := []*codegen.Unit{{Name: "main", Source: "int main(void) { return 0; }\n"}}
+
+	tests := []struct {
+		name    string
+		cc      string
+		env     string // $CC
+		strict  bool
+		err     string
+		command string // how each command starts
+	}{
+		{"-cc not found", "no-such-cc", "", false, `C compiler "no-such-cc" not found`, ""},
+		{"$CC not found", "", "no-such-cc -m64", false, `C compiler "no-such-cc -m64" not found`, ""},
+		{"warnings", "gcc", "", false, "", "-O2 "},
+		{"-strict", "gcc", "", true, "internal compiler error: the C compiler reported warnings for main.c", "-O2 "},
+		{"-cc words", "gcc -m64", "", false, "", "-m64 -O2 "},
+		{"$CC words", "", "gcc -m32", false, "", "-m32 -O2 "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := filepath.Join(t.TempDir(), "log")
+			t.Setenv("HLC_CC_LOG", log)
+			t.Setenv("CC", tt.env)
+			b := testBuilder(t)
+			b.compiler, b.compilerID = "", ""
+			b.tc.cc, b.tc.strict, b.tc.optimise = tt.cc, tt.strict, 2
+
+			err := b.link(units, filepath.Join(dir, "out"), nil, nil)
+			if tt.err == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.err != "" && (err == nil || err.Error() != tt.err) {
+				t.Fatalf("got %v, want %s", err, tt.err)
+			}
+			if tt.command == "" {
+				return
+			}
+			data, err := os.ReadFile(log)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+				if !strings.HasSuffix(line, "--version") && !strings.HasPrefix(line, tt.command) {
+					t.Errorf("command %q does not start with %q", line, tt.command)
+				}
+			}
+		})
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"gcc", "gcc"},
+		{"-O2", "-O2"},
+		{"-DNAME=1", "-DNAME=1"},
+		{"/tmp/hlc-1/main.c", "/tmp/hlc-1/main.c"},
+		{"", "''"},
+		{"two words", "'two words'"},
+		{"$HOME", "'$HOME'"},
+		{"it's", `'it'\''s'`},
+		{"a*b", "'a*b'"},
+	}
+	for _, tt := range tests {
+		if got := shellQuote(tt.in); got != tt.want {
+			t.Errorf("shellQuote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+	if got := commandLine("cc", []string{"-o", "my prog", "main.c"}); got != "cc -o 'my prog' main.c" {
+		t.Errorf("commandLine: got %s", got)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/analysis"
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+	"github.com/Dr-H-PhD/h-lang/pkg/codegen"
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+	"github.com/Dr-H-PhD/h-lang/pkg/manifest"
+	"github.com/Dr-H-PhD/h-lang/pkg/parser"
+)
+
+// runVet implements "hlc vet": it runs the static checks over files the
+// compiler accepts and reports what they find
+func runVet(args []string) int {
+	flags := flag.NewFlagSet("vet", flag.ExitOnError)
+	fixFlag := flags.Bool("fix", false, "Apply the suggested fixes to the files")
+	enabled := make(map[*analysis.Analyzer]*bool)
+	for _, a := range analysis.All {
+		summary, _, _ := strings.Cut(a.Doc, "\n")
+		enabled[a] = flags.Bool(a.Name, false, "Enable the check to "+summary)
+	}
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: hlc vet [flags] [path...]\n\n")
+		fmt.Fprintf(flags.Output(), "Naming checks runs only those; -name=false runs all but those.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	// As with go vet, enabling checks selects them and disabling checks
+	// leaves out only those
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	only := false
+	for _, a := range analysis.All {
+		only = only || set[a.Name] && *enabled[a]
+	}
+	var analyzers []*analysis.Analyzer
+	for _, a := range analysis.All {
+		if only && *enabled[a] || !only && !set[a.Name] {
+			analyzers = append(analyzers, a)
+		}
+	}
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	files, err := fmtFiles(paths)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	// Inside a project, imports resolve as they do for hlc build
+	var roots []string
+	if path, err := manifest.Find("."); err == nil {
+		m, err := manifest.Load(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		roots = m.ImportRoots()
+	}
+
+	status := 0
+	for _, file := range files {
+		if vetFile(file, roots, analyzers, *fixFlag) != 0 {
+			status = 1
+		}
+	}
+	return status
+}
+
+// vetFile checks one file, fixing what it can if fix is set
+func vetFile(file string, roots []string, analyzers []*analysis.Analyzer, fix bool) int {
+	module, errs := vetModule(file, roots)
+	if len(errs) > 0 {
+		for _, msg := range errs {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", file, msg)
+		}
+		return 1
+	}
+	diagnostics, err := analysis.Run(module, analyzers)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	// What remains after fixing is reported against the fixed file
+	if fix {
+		fixed, n, err := analysis.ApplyFixes(module, diagnostics)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		if n > 0 {
+			// A fix that breaks the file is a bug in its analyzer; leave
+			// the file as it was rather than write what cannot be read
+			p := parser.New(lexer.New(fixed))
+			p.ParseProgram()
+			if len(p.Errors()) > 0 {
+				fmt.Fprintf(os.Stderr, "%s: not fixed: the fixed source does not parse: %s\n", file, p.Errors()[0])
+				return 1
+			}
+			info, err := os.Stat(file)
+			if err == nil {
+				err = os.WriteFile(file, []byte(fixed), info.Mode().Perm())
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error writing file: %v\n", err)
+				return 1
+			}
+			return vetFile(file, roots, analyzers, false)
+		}
+	}
+
+	status := 0
+	for _, d := range diagnostics {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", module.File.Position(d.Pos), d.Message)
+		status = 1
+	}
+	return status
+}
+
+// vetModule parses a file and everything it imports, and compiles it to
+// make sure the checks only see programs the compiler accepts
+func vetModule(file string, roots []string) (*analysis.Module, []string) {
+	source, err := os.ReadFile(file)
+	if err != nil {
+		return nil, []string{err.Error()}
+	}
+	l := lexer.NewFile(lexer.NewFileSet().AddFile(file, string(source)), string(source))
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		return nil, p.Errors()
+	}
+	program.File = file
+
+	programs := make(map[string]*ast.Program)
+	resolve := importResolver(roots, nil)
+	g := codegen.New()
+	g.SetImportResolver(func(importPath, basePath string) (*ast.Program, error) {
+		imported, err := resolve(importPath, basePath)
+		if err == nil {
+			programs[importPath] = imported
+		}
+		return imported, err
+	}, filepath.Dir(file))
+	g.Generate(program)
+	if len(g.Errors()) > 0 {
+		return nil, g.Errors()
+	}
+
+	// Each module reached through an import counts as a use of that
+	// import, unless the file imports it directly
+	module := &analysis.Module{Program: program, Source: string(source), File: l.File()}
+	seen := make(map[string]bool)
+	var direct []*ast.ImportStatement
+	for _, stmt := range program.Statements {
+		if imp, ok := stmt.(*ast.ImportStatement); ok && !seen[imp.Path] && programs[imp.Path] != nil {
+			seen[imp.Path] = true
+			direct = append(direct, imp)
+			module.Imports = append(module.Imports, &analysis.Import{Path: imp.Path, Program: programs[imp.Path], Via: imp})
+		}
+	}
+	var follow func(program *ast.Program, via *ast.ImportStatement)
+	follow = func(program *ast.Program, via *ast.ImportStatement) {
+		for _, stmt := range program.Statements {
+			imp, ok := stmt.(*ast.ImportStatement)
+			if !ok || seen[imp.Path] || programs[imp.Path] == nil {
+				continue
+			}
+			seen[imp.Path] = true
+			module.Imports = append(module.Imports, &analysis.Import{Path: imp.Path, Program: programs[imp.Path], Via: via})
+			follow(programs[imp.Path], via)
+		}
+	}
+	for _, imp := range direct {
+		follow(programs[imp.Path], imp)
+	}
+	return module, nil
+}
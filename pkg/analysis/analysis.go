@@ -0,0 +1,197 @@
+// Package analysis runs static checks over H modules. An Analyzer
+// inspects a module the compiler has accepted and reports diagnostics,
+// optionally with fixes; it may build on the results of the analyzers it
+// requires, such as the identifier resolution of Resolve.
+package analysis
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+)
+
+// Analyzer is a static check, or a computation other checks build on
+type Analyzer struct {
+	Name     string // a short lower-case name, such as unusedvar
+	Doc      string // what the analyzer reports; the first line is a summary
+	Requires []*Analyzer
+
+	// Run analyzes the module of a pass and returns a result for the
+	// analyzers that require this one
+	Run func(pass *Pass) (interface{}, error)
+}
+
+func (a *Analyzer) String() string {
+	return a.Name
+}
+
+// Module is a parsed H module and the modules it imports
+type Module struct {
+	Program *ast.Program
+	Source  string      // the source Program was parsed from
+	File    *lexer.File // the positions of Source
+	Imports []*Import   // everything Program imports, directly or not
+}
+
+// Text returns the source of a node read from the module
+func (m *Module) Text(node ast.Node) string {
+	return m.Source[m.File.Offset(node.Pos()):m.File.Offset(node.End())]
+}
+
+// Import is a module imported by the module being analyzed
+type Import struct {
+	Path    string
+	Program *ast.Program
+	Via     *ast.ImportStatement // the import of the analyzed module that brings it in, if known
+}
+
+// Pass is the run of one analyzer over a module
+type Pass struct {
+	Analyzer *Analyzer
+	Module   *Module
+	ResultOf map[*Analyzer]interface{} // the results of the required analyzers
+
+	report func(Diagnostic)
+}
+
+// Report records a diagnostic
+func (p *Pass) Report(d Diagnostic) {
+	p.report(d)
+}
+
+// Reportf records a diagnostic about a node with a formatted message
+func (p *Pass) Reportf(node ast.Node, format string, args ...interface{}) {
+	p.Report(Diagnostic{Pos: node.Pos(), End: node.End(), Message: fmt.Sprintf(format, args...)})
+}
+
+// Diagnostic is a problem an analyzer found
+type Diagnostic struct {
+	Pos      lexer.Pos
+	End      lexer.Pos // NoPos if the diagnostic is about a point
+	Category string    // the name of the analyzer, filled in by Run
+	Message  string
+	Fixes    []SuggestedFix
+}
+
+// SuggestedFix is a change to the source that resolves a diagnostic
+type SuggestedFix struct {
+	Message string
+	Edits   []TextEdit
+}
+
+// TextEdit replaces the source from Pos to End with NewText
+type TextEdit struct {
+	Pos     lexer.Pos
+	End     lexer.Pos
+	NewText string
+}
+
+// All is every check hlc vet runs
+var All = []*Analyzer{
+	UnusedVariable,
+	UnusedParameter,
+	UnusedImport,
+	Unreachable,
+	MissingReturn,
+	Shadow,
+	SelfAssign,
+}
+
+// Validate checks that the analyzers and those they require have names,
+// distinct ones, and Run functions, and that no analyzer requires itself
+func Validate(analyzers []*Analyzer) error {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[*Analyzer]int)
+	names := make(map[string]*Analyzer)
+	var visit func(a *Analyzer) error
+	visit = func(a *Analyzer) error {
+		switch state[a] {
+		case visiting:
+			return fmt.Errorf("analyzer %s requires itself", a.Name)
+		case done:
+			return nil
+		}
+		if a.Name == "" {
+			return fmt.Errorf("analyzer without a name")
+		}
+		if a.Run == nil {
+			return fmt.Errorf("analyzer %s has no Run function", a.Name)
+		}
+		if other, ok := names[a.Name]; ok && other != a {
+			return fmt.Errorf("two analyzers are named %s", a.Name)
+		}
+		names[a.Name] = a
+		state[a] = visiting
+		for _, req := range a.Requires {
+			if err := visit(req); err != nil {
+				return err
+			}
+		}
+		state[a] = done
+		return nil
+	}
+	for _, a := range analyzers {
+		if err := visit(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run runs the analyzers over a module, each after those it requires,
+// and returns the diagnostics they report, ordered by position. Each
+// analyzer runs once; the diagnostics of analyzers only run because
+// others require them are dropped.
+func Run(module *Module, analyzers []*Analyzer) ([]Diagnostic, error) {
+	if err := Validate(analyzers); err != nil {
+		return nil, err
+	}
+
+	requested := make(map[*Analyzer]bool)
+	for _, a := range analyzers {
+		requested[a] = true
+	}
+	results := make(map[*Analyzer]interface{})
+	var diagnostics []Diagnostic
+
+	var run func(a *Analyzer) error
+	run = func(a *Analyzer) error {
+		if _, ok := results[a]; ok {
+			return nil
+		}
+		pass := &Pass{Analyzer: a, Module: module, ResultOf: make(map[*Analyzer]interface{})}
+		for _, req := range a.Requires {
+			if err := run(req); err != nil {
+				return err
+			}
+			pass.ResultOf[req] = results[req]
+		}
+		pass.report = func(d Diagnostic) {
+			if requested[a] {
+				d.Category = a.Name
+				diagnostics = append(diagnostics, d)
+			}
+		}
+		result, err := a.Run(pass)
+		if err != nil {
+			return fmt.Errorf("%s: %w", a.Name, err)
+		}
+		results[a] = result
+		return nil
+	}
+	for _, a := range analyzers {
+		if err := run(a); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(diagnostics, func(i, j int) bool {
+		return diagnostics[i].Pos < diagnostics[j].Pos
+	})
+	return diagnostics, nil
+}
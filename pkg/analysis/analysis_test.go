@@ -0,0 +1,374 @@
+package analysis
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+	"github.com/Dr-H-PhD/h-lang/pkg/parser"
+)
+
+func parse(t *testing.T, source string) (*ast.Program, *lexer.File) {
+	t.Helper()
+	l := lexer.New(source)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	return program, l.File()
+}
+
+// newModule parses a module whose imports are the given sources, each
+// imported directly
+func newModule(t *testing.T, source string, imports map[string]string) *Module {
+	t.Helper()
+	program, file := parse(t, source)
+	m := &Module{Program: program, Source: source, File: file}
+	for _, stmt := range program.Statements {
+		if imp, ok := stmt.(*ast.ImportStatement); ok {
+			imported, _ := parse(t, imports[imp.Path])
+			m.Imports = append(m.Imports, &Import{Path: imp.Path, Program: imported, Via: imp})
+		}
+	}
+	return m
+}
+
+// check runs analyzers over a module and returns their diagnostics as
+// line:column: message
+func check(t *testing.T, m *Module, analyzers ...*Analyzer) []string {
+	t.Helper()
+	diagnostics, err := Run(m, analyzers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, d := range diagnostics {
+		out = append(out, fmt.Sprintf("%s: %s", m.File.Position(d.Pos), d.Message))
+	}
+	return out
+}
+
+func TestRun_Requires(t *testing.T) {
+	var order []string
+	base := &Analyzer{Name: "base", Run: func(pass *Pass) (interface{}, error) {
+		order = append(order, "base")
+		pass.Reportf(pass.Module.Program.Statements[0], "from base")
+		return 42, nil
+	}}
+	user := func(name string) *Analyzer {
+		return &Analyzer{Name: name, Requires: []*Analyzer{base}, Run: func(pass *Pass) (interface{}, error) {
+			order = append(order, name)
+			pass.Reportf(pass.Module.Program.Statements[0], "%s got %v", name, pass.ResultOf[base])
+			return nil, nil
+		}}
+	}
+
+	diagnostics, err := Run(newModule(t, "x := 1;", nil), []*Analyzer{user("a"), user("b")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(order, " "); got != "base a b" {
+		t.Errorf("ran %q, want %q", got, "base a b")
+	}
+	var got []string
+	for _, d := range diagnostics {
+		got = append(got, d.Category+": "+d.Message)
+	}
+	want := []string{"a: a got 42", "b: b got 42"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got diagnostics %q, want %q", got, want)
+	}
+}
+
+func TestRun_Error(t *testing.T) {
+	failing := &Analyzer{Name: "failing", Run: func(*Pass) (interface{}, error) {
+		return nil, errors.New("broken")
+	}}
+	_, err := Run(newModule(t, "", nil), []*Analyzer{failing})
+	if err == nil || err.Error() != "failing: broken" {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	run := func(*Pass) (interface{}, error) { return nil, nil }
+	a := &Analyzer{Name: "a", Run: run}
+	b := &Analyzer{Name: "b", Run: run, Requires: []*Analyzer{a}}
+	a.Requires = []*Analyzer{b}
+
+	tests := []struct {
+		analyzers []*Analyzer
+		expected  string
+	}{
+		{All, ""},
+		{[]*Analyzer{b}, "analyzer b requires itself"},
+		{[]*Analyzer{{Name: "x", Run: run}, {Name: "x", Run: run}}, "two analyzers are named x"},
+		{[]*Analyzer{{Name: "x"}}, "analyzer x has no Run function"},
+		{[]*Analyzer{{Run: run}}, "analyzer without a name"},
+	}
+	for _, tt := range tests {
+		err := Validate(tt.analyzers)
+		if got := fmt.Sprint(err); tt.expected == "" && err != nil || tt.expected != "" && got != tt.expected {
+			t.Errorf("%v: got %v, want %q", tt.analyzers, err, tt.expected)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	m := newModule(t, `import "lib.hl";
+var g int = 1;
+function f(x int) int {
+    y := x + g;
+    if y > 0 {
+        x := y;
+        return x;
+    }
+    return Color_Red + lib();
+}`, map[string]string{"lib.hl": "public function lib() int { return 0; }\npublic enum Color { Red }\nfunction hidden() {}"})
+	info := ResolveModule(m)
+
+	uses := map[string]string{}
+	for id, obj := range info.Uses {
+		pos := m.File.Position(id.Pos())
+		declared := "import"
+		if obj.Import == nil {
+			declared = m.File.Position(obj.Decl.Pos()).String()
+		}
+		uses[pos.String()] = fmt.Sprintf("%s %s %s", obj.Kind, obj.Name, declared)
+	}
+	want := map[string]string{
+		"4:10": "parameter x 3:12",
+		"4:14": "global g 2:5",
+		"5:8":  "variable y 4:5",
+		"6:14": "variable y 4:5",
+		"7:16": "variable x 6:9",
+		"9:12": "enum value Color_Red import",
+		"9:24": "function lib import",
+	}
+	if !reflect.DeepEqual(uses, want) {
+		t.Errorf("got uses %v, want %v", uses, want)
+	}
+	if info.Module.Lookup("hidden") != nil {
+		t.Errorf("the private function of the import is visible")
+	}
+}
+
+func TestAnalyzers(t *testing.T) {
+	tests := []struct {
+		analyzer *Analyzer
+		source   string
+		expected []string
+	}{
+		{UnusedVariable, `function f(n int) {
+    a := 1;
+    var b int;
+    b = 2;
+    c := 3;
+    c++;
+    d := 4;
+    print(d);
+    const e := 5;
+    for i := 0; i < n; i++ {}
+    for _, v := range args() {}
+}`, []string{
+			"2:5: a declared and not used",
+			"3:9: b declared and not used",
+			"5:5: c declared and not used",
+			"11:12: v declared and not used",
+		}},
+		{UnusedParameter, `function f(a int, b int, _ int) int { return a; }
+function g(a int) {}
+extern function h(a int);
+function (p *P) m(a int) {}
+function cb(a int) {}
+struct P { x int; }
+function main() { run(cb); f(1, 2, 3); g(1); }`, []string{
+			"1:19: parameter b of f is unused",
+			"2:12: parameter a of g is unused",
+			"4:19: parameter a of m is unused",
+		}},
+		{UnusedImport, `import "a.hl";
+import "b.hl";
+import "c.hl";
+import "d.hl";
+import "f.hl";
+import "g.hl";
+function main() { a(); var x *B; x = null; c := C{}; }`, []string{
+			`4:1: "d.hl" imported and not used`,
+		}},
+		{Unreachable, `function f(n int) int {
+    while n > 0 {
+        break;
+        n--;
+    }
+    if n > 0 {
+        return 1;
+    } else {
+        exit(1);
+    }
+    print(n);
+    print(n);
+}
+function g() {
+    for i := 0; true; i++ {
+        continue;
+    }
+    print(1);
+}
+test "t" { return; print(2); }`, []string{
+			"4:9: unreachable code",
+			"11:5: unreachable code",
+			"18:5: unreachable code",
+			"20:20: unreachable code",
+		}},
+		{MissingReturn, `function a(n int) int {
+    if n > 0 {
+        return 1;
+    }
+}
+function b(n int) int {
+    if n > 0 {
+        return 1;
+    } else {
+        return 2;
+    }
+}
+function c() int {
+    while true {
+        if x() { break; }
+    }
+}
+function d() int {
+    while true {
+        while true { break; }
+    }
+}
+function e() int { exit(1); }
+function f() { }`, []string{
+			"5:1: missing return at the end of a",
+			"17:1: missing return at the end of c",
+		}},
+		{Shadow, `var g int = 0;
+function f(p int) {
+    x := 1;
+    g := 2;
+    if x > 0 {
+        x := 3;
+        p := 4;
+        for _, x := range args() {}
+        print(x, p, g);
+    }
+    if true {
+        y := 5;
+        print(y);
+    }
+    y := 6;
+    print(y);
+}`, []string{
+			"6:9: declaration of x shadows the variable declared at 3:5",
+			"7:9: declaration of p shadows the parameter declared at 2:12",
+			"8:16: declaration of x shadows the variable declared at 6:9",
+		}},
+		{SelfAssign, `function f(p *P, a []int, i int) {
+    x := 1;
+    x = x;
+    x += x;
+    p.x = p.x;
+    p.x = p.y;
+    a[i] = a[i];
+    a[0] = a[1];
+    *p = *p;
+}`, []string{
+			"3:5: self-assignment of x to itself",
+			"5:5: self-assignment of p.x to itself",
+			"7:5: self-assignment of a[i] to itself",
+			"9:5: self-assignment of *p to itself",
+		}},
+	}
+
+	imports := map[string]string{
+		"a.hl": "public function a() {}",
+		"b.hl": "public struct B { x int; }",
+		"c.hl": `import "e.hl";`,
+		"d.hl": "public function d() {}",
+		"f.hl": "function init() {}",
+		"g.hl": `import "h.hl";`,
+	}
+	for _, tt := range tests {
+		m := newModule(t, tt.source, imports)
+		if tt.analyzer == UnusedImport {
+			// c.hl brings in e.hl, which declares C
+			e, _ := parse(t, "public struct C {}")
+			m.Imports = append(m.Imports, &Import{Path: "e.hl", Program: e, Via: m.Imports[2].Via})
+			// and g.hl brings in h.hl, whose init runs
+			h, _ := parse(t, "function init() {}")
+			m.Imports = append(m.Imports, &Import{Path: "h.hl", Program: h, Via: m.Imports[5].Via})
+		}
+		got := check(t, m, tt.analyzer)
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.analyzer, strings.Join(got, "\n"), strings.Join(tt.expected, "\n"))
+		}
+	}
+}
+
+func TestApplyFixes(t *testing.T) {
+	source := `import "a.hl";
+import "b.hl"; # keeps its comment
+function main() {
+    x := 1;
+    x = x; print(x);
+    x = x;
+    print(x);
+}
+`
+	m := newModule(t, source, map[string]string{"a.hl": "", "b.hl": ""})
+	diagnostics, err := Run(m, All)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixed, n, err := ApplyFixes(m, diagnostics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# keeps its comment
+function main() {
+    x := 1;
+    print(x);
+    print(x);
+}
+`
+	if fixed != want {
+		t.Errorf("got\n%s\nwant\n%s", fixed, want)
+	}
+	if n != 4 {
+		t.Errorf("applied %d fixes, want 4", n)
+	}
+}
+
+func TestApplyFixes_Conflicts(t *testing.T) {
+	m := newModule(t, "abcdef", nil)
+	edit := func(start, end int, text string) Diagnostic {
+		return Diagnostic{Fixes: []SuggestedFix{{Edits: []TextEdit{
+			{Pos: m.File.Pos(start), End: m.File.Pos(end), NewText: text},
+		}}}}
+	}
+	diagnostics := []Diagnostic{
+		edit(1, 3, "X"),
+		edit(1, 3, "X"), // the same edit again
+		edit(2, 4, "Y"), // overlaps the first
+		edit(4, 4, "Z"),
+		{Message: "without a fix"},
+	}
+	fixed, n, err := ApplyFixes(m, diagnostics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fixed != "aXdZef" || n != 3 {
+		t.Errorf("got %q with %d fixes, want %q with 3", fixed, n, "aXdZef")
+	}
+}
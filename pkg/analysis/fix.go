@@ -0,0 +1,93 @@
+package analysis
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+)
+
+// deleteStatement returns the edit removing a statement and its
+// semicolon, and the whole line if nothing else is on it
+func deleteStatement(module *Module, stmt ast.Statement) TextEdit {
+	file, source := module.File, module.Source
+	start, end := file.Offset(stmt.Pos()), file.Offset(stmt.End())
+	if rest := strings.TrimLeft(source[end:], " \t"); strings.HasPrefix(rest, ";") {
+		end = len(source) - len(strings.TrimLeft(rest[1:], " \t"))
+	}
+
+	line := file.Position(stmt.Pos()).Line
+	lineStart := file.Offset(file.LineStart(line))
+	lineEnd := len(source)
+	if i := strings.IndexByte(source[end:], '\n'); i >= 0 {
+		lineEnd = end + i + 1
+	}
+	if strings.TrimSpace(source[lineStart:start]) == "" && strings.TrimSpace(source[end:lineEnd]) == "" {
+		start, end = lineStart, lineEnd
+	}
+	return TextEdit{Pos: file.Pos(start), End: file.Pos(end)}
+}
+
+// ApplyFixes applies the first suggested fix of each diagnostic to the
+// source of a module and returns the result. Fixes are applied whole or
+// not at all: a fix with an edit overlapping one already applied is
+// skipped, and so are edits identical to an applied one. The number of
+// fixes applied is returned with the source.
+func ApplyFixes(module *Module, diagnostics []Diagnostic) (string, int, error) {
+	type edit struct {
+		start, end int
+		text       string
+	}
+	var applied []edit
+	overlaps := func(e edit) (bool, bool) {
+		for _, a := range applied {
+			if a == e {
+				return false, true
+			}
+			if e.start < a.end && a.start < e.end || e.start == e.end && e.start == a.start {
+				return true, false
+			}
+		}
+		return false, false
+	}
+
+	fixes := 0
+	for _, d := range diagnostics {
+		if len(d.Fixes) == 0 {
+			continue
+		}
+		var edits []edit
+		conflict := false
+		for _, te := range d.Fixes[0].Edits {
+			if te.End < te.Pos {
+				return "", 0, fmt.Errorf("%s: edit ends before it starts", d.Category)
+			}
+			e := edit{module.File.Offset(te.Pos), module.File.Offset(te.End), te.NewText}
+			overlap, duplicate := overlaps(e)
+			if overlap {
+				conflict = true
+				break
+			}
+			if !duplicate {
+				edits = append(edits, e)
+			}
+		}
+		if conflict {
+			continue
+		}
+		applied = append(applied, edits...)
+		fixes++
+	}
+
+	sort.Slice(applied, func(i, j int) bool { return applied[i].start < applied[j].start })
+	var out strings.Builder
+	last := 0
+	for _, e := range applied {
+		out.WriteString(module.Source[last:e.start])
+		out.WriteString(e.text)
+		last = e.end
+	}
+	out.WriteString(module.Source[last:])
+	return out.String(), fixes, nil
+}
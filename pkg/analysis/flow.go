@@ -0,0 +1,150 @@
+package analysis
+
+import (
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+)
+
+// Unreachable reports statements that can never run
+var Unreachable = &Analyzer{
+	Name: "unreachable",
+	Doc: `report statements that can never run
+
+A statement is unreachable if it follows a return, break or continue, a
+call to exit, an if whose branches all end so, or a loop whose condition
+is true and that has no break. Only the first unreachable statement of a
+block is reported.`,
+	Requires: []*Analyzer{Resolve},
+	Run: func(pass *Pass) (interface{}, error) {
+		info := pass.ResultOf[Resolve].(*Info)
+		var check func(stmts []ast.Statement)
+		check = func(stmts []ast.Statement) {
+			for i, stmt := range stmts {
+				ast.Inspect(stmt, func(n ast.Node) bool {
+					if b, ok := n.(*ast.BlockStatement); ok {
+						check(b.Statements)
+						return false
+					}
+					return true
+				})
+				if i+1 < len(stmts) && ends(info, stmt) {
+					pass.Reportf(stmts[i+1], "unreachable code")
+					return
+				}
+			}
+		}
+		for _, stmt := range pass.Module.Program.Statements {
+			switch s := stmt.(type) {
+			case *ast.FunctionStatement:
+				if s.Body != nil {
+					check(s.Body.Statements)
+				}
+			case *ast.TestStatement:
+				check(s.Body.Statements)
+			}
+		}
+		return nil, nil
+	},
+}
+
+// MissingReturn reports functions with a result whose end can be reached
+var MissingReturn = &Analyzer{
+	Name: "missingreturn",
+	Doc: `report functions with a result that can reach their end
+
+A function with a result must end in a statement that does not let control
+reach the closing brace: a return, a call to exit, an if whose branches all
+end so, or a loop whose condition is true and that has no break.`,
+	Requires: []*Analyzer{Resolve},
+	Run: func(pass *Pass) (interface{}, error) {
+		info := pass.ResultOf[Resolve].(*Info)
+		for _, stmt := range pass.Module.Program.Statements {
+			f, ok := stmt.(*ast.FunctionStatement)
+			if !ok || f.Body == nil || f.ReturnType == nil || terminatingList(info, f.Body.Statements) {
+				continue
+			}
+			pass.Report(Diagnostic{
+				Pos:     f.Body.Rbrace.Pos,
+				Message: "missing return at the end of " + f.Name.Value,
+			})
+		}
+		return nil, nil
+	},
+}
+
+// ends reports whether control never passes to the statement after stmt
+func ends(info *Info, stmt ast.Statement) bool {
+	switch stmt.(type) {
+	case *ast.BreakStatement, *ast.ContinueStatement:
+		return true
+	}
+	return terminating(info, stmt)
+}
+
+// terminating reports whether a statement never completes normally: it
+// returns, exits the program or loops forever
+func terminating(info *Info, stmt ast.Statement) bool {
+	switch s := stmt.(type) {
+	case *ast.ReturnStatement:
+		return true
+	case *ast.ExpressionStatement:
+		return isExit(info, s.Expression)
+	case *ast.BlockStatement:
+		return terminatingList(info, s.Statements)
+	case *ast.IfStatement:
+		return s.Alternative != nil &&
+			terminatingList(info, s.Consequence.Statements) &&
+			terminatingList(info, s.Alternative.Statements)
+	case *ast.ForStatement:
+		return forever(s.Condition) && !breaks(s.Body)
+	case *ast.WhileStatement:
+		return forever(s.Condition) && !breaks(s.Body)
+	}
+	return false
+}
+
+// forever reports whether a loop condition is missing or true
+func forever(cond ast.Expression) bool {
+	if cond == nil {
+		return true
+	}
+	b, ok := cond.(*ast.BooleanLiteral)
+	return ok && b.Value
+}
+
+func terminatingList(info *Info, stmts []ast.Statement) bool {
+	return len(stmts) > 0 && terminating(info, stmts[len(stmts)-1])
+}
+
+// isExit reports whether an expression calls the exit builtin or an
+// extern function named exit, the C library's
+func isExit(info *Info, expr ast.Expression) bool {
+	call, ok := expr.(*ast.CallExpression)
+	if !ok {
+		return false
+	}
+	id, ok := call.Function.(*ast.Identifier)
+	if !ok || id.Value != "exit" {
+		return false
+	}
+	obj := info.Uses[id]
+	if obj == nil {
+		return true
+	}
+	f, ok := obj.Node.(*ast.FunctionStatement)
+	return ok && f.Extern
+}
+
+// breaks reports whether a loop body breaks out of the loop
+func breaks(body *ast.BlockStatement) bool {
+	found := false
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch n.(type) {
+		case *ast.BreakStatement:
+			found = true
+		case *ast.ForStatement, *ast.WhileStatement, *ast.ForRangeStatement:
+			return false
+		}
+		return !found
+	})
+	return found
+}
@@ -0,0 +1,376 @@
+package analysis
+
+import (
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+)
+
+// ObjectKind classifies what a name declares
+type ObjectKind int
+
+const (
+	Var       ObjectKind = iota // a local variable
+	Param                       // a parameter or method receiver
+	Const                       // a local constant
+	Global                      // a module-level variable or constant
+	Func                        // a function
+	Type                        // a struct or enum
+	EnumValue                   // an enum value, named Enum_Value
+)
+
+var objectKindNames = map[ObjectKind]string{
+	Var:       "variable",
+	Param:     "parameter",
+	Const:     "constant",
+	Global:    "global",
+	Func:      "function",
+	Type:      "type",
+	EnumValue: "enum value",
+}
+
+func (k ObjectKind) String() string {
+	if name, ok := objectKindNames[k]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Object is something a name refers to
+type Object struct {
+	Name   string
+	Kind   ObjectKind
+	Decl   *ast.Identifier      // the declaring name
+	Node   ast.Node             // the declaring statement, parameter or enum value
+	Scope  *Scope               // the scope the object is declared in
+	Import *ast.ImportStatement // the import it comes from, if declared in an import and known
+}
+
+// Scope is the set of names declared in a module, function or block
+type Scope struct {
+	Parent  *Scope
+	Node    ast.Node // what opens the scope, nil for the module and its imports
+	Objects map[string]*Object
+}
+
+func newScope(parent *Scope, node ast.Node) *Scope {
+	return &Scope{Parent: parent, Node: node, Objects: make(map[string]*Object)}
+}
+
+// Lookup returns the object a name refers to in the scope, or nil
+func (s *Scope) Lookup(name string) *Object {
+	for ; s != nil; s = s.Parent {
+		if obj, ok := s.Objects[name]; ok {
+			return obj
+		}
+	}
+	return nil
+}
+
+// Info is the result of Resolve: what every name in the module refers to
+type Info struct {
+	Defs   map[*ast.Identifier]*Object     // declaring names
+	Uses   map[*ast.Identifier]*Object     // names referring to a declaration
+	Types  map[*ast.TypeAnnotation]*Object // type names referring to a struct or enum
+	Writes map[*ast.Identifier]bool        // uses that only store: x = v, x += v and x++
+	Scopes map[ast.Node]*Scope             // the scopes functions, blocks and loops open
+	Module *Scope                          // the module's declarations
+}
+
+// ObjectOf returns the object a name declares or refers to, or nil for
+// builtins such as print and names the module does not declare
+func (info *Info) ObjectOf(id *ast.Identifier) *Object {
+	if obj, ok := info.Defs[id]; ok {
+		return obj
+	}
+	return info.Uses[id]
+}
+
+// Resolve finds the declaration every name in the module refers to. It
+// reports nothing; its result is an *Info.
+var Resolve = &Analyzer{
+	Name: "resolve",
+	Doc:  "resolve the names of a module to their declarations",
+	Run: func(pass *Pass) (interface{}, error) {
+		return ResolveModule(pass.Module), nil
+	},
+}
+
+type resolver struct {
+	info  *Info
+	scope *Scope
+}
+
+// ResolveModule finds the declaration every name in a module refers to,
+// for passes that run outside Run
+func ResolveModule(module *Module) *Info {
+	r := &resolver{info: &Info{
+		Defs:   make(map[*ast.Identifier]*Object),
+		Uses:   make(map[*ast.Identifier]*Object),
+		Types:  make(map[*ast.TypeAnnotation]*Object),
+		Writes: make(map[*ast.Identifier]bool),
+		Scopes: make(map[ast.Node]*Scope),
+	}}
+
+	// The public declarations of imports are visible everywhere, but
+	// the module's own declarations hide them
+	r.scope = newScope(nil, nil)
+	for _, imp := range module.Imports {
+		r.declareModule(imp.Program, imp)
+	}
+	r.scope = newScope(r.scope, nil)
+	r.info.Module = r.scope
+	r.declareModule(module.Program, nil)
+
+	for _, stmt := range module.Program.Statements {
+		switch s := stmt.(type) {
+		case *ast.VarStatement:
+			r.typ(s.Type)
+			r.expr(s.Value)
+		case *ast.ConstStatement:
+			r.typ(s.Type)
+			r.expr(s.Value)
+		case *ast.StructStatement:
+			for _, f := range s.Fields {
+				r.typ(f.Type)
+			}
+		case *ast.EnumStatement:
+			for _, v := range s.Values {
+				r.expr(v.Value)
+			}
+		case *ast.FunctionStatement:
+			r.function(s)
+		case *ast.TestStatement:
+			r.block(s.Body)
+		case *ast.ExpressionStatement:
+			r.expr(s.Expression)
+		}
+	}
+	return r.info
+}
+
+// declareModule declares the module-level names of a program, only the
+// public ones of an import
+func (r *resolver) declareModule(program *ast.Program, imp *Import) {
+	var via *ast.ImportStatement
+	if imp != nil {
+		via = imp.Via
+	}
+	declare := func(name *ast.Identifier, kind ObjectKind, node ast.Node, public bool) {
+		if imp != nil && !public {
+			return
+		}
+		obj := &Object{Name: name.Value, Kind: kind, Decl: name, Node: node, Scope: r.scope, Import: via}
+		r.scope.Objects[name.Value] = obj
+		if imp == nil {
+			r.info.Defs[name] = obj
+		}
+	}
+	for _, stmt := range program.Statements {
+		switch s := stmt.(type) {
+		case *ast.VarStatement:
+			declare(s.Name, Global, s, s.Public)
+		case *ast.ConstStatement:
+			declare(s.Name, Global, s, s.Public)
+		case *ast.FunctionStatement:
+			if s.Receiver == nil && s.Name.Value != "init" {
+				declare(s.Name, Func, s, s.Public)
+			}
+		case *ast.StructStatement:
+			declare(s.Name, Type, s, s.Public)
+		case *ast.EnumStatement:
+			declare(s.Name, Type, s, s.Public)
+			if imp != nil && !s.Public {
+				continue
+			}
+			for _, v := range s.Values {
+				obj := &Object{Name: s.Name.Value + "_" + v.Name.Value, Kind: EnumValue,
+					Decl: v.Name, Node: v, Scope: r.scope, Import: via}
+				r.scope.Objects[obj.Name] = obj
+				if imp == nil {
+					r.info.Defs[v.Name] = obj
+				}
+			}
+		}
+	}
+}
+
+func (r *resolver) open(node ast.Node) {
+	r.scope = newScope(r.scope, node)
+	r.info.Scopes[node] = r.scope
+}
+
+func (r *resolver) close() {
+	r.scope = r.scope.Parent
+}
+
+// declare declares a local name in the current scope
+func (r *resolver) declare(name *ast.Identifier, kind ObjectKind, node ast.Node) {
+	if name == nil || name.Value == "_" {
+		return
+	}
+	obj := &Object{Name: name.Value, Kind: kind, Decl: name, Node: node, Scope: r.scope}
+	r.scope.Objects[name.Value] = obj
+	r.info.Defs[name] = obj
+}
+
+// function resolves a function. Its parameters and the outermost
+// statements of its body share one scope, as in C.
+func (r *resolver) function(f *ast.FunctionStatement) {
+	if f.Receiver != nil {
+		r.typ(f.Receiver.Type)
+	}
+	for _, p := range f.Parameters {
+		r.typ(p.Type)
+	}
+	r.typ(f.ReturnType)
+	if f.Body == nil {
+		return
+	}
+
+	r.open(f)
+	if f.Receiver != nil {
+		r.declare(f.Receiver.Name, Param, f.Receiver)
+	}
+	for _, p := range f.Parameters {
+		r.declare(p.Name, Param, p)
+	}
+	r.statements(f.Body.Statements)
+	r.close()
+}
+
+func (r *resolver) block(b *ast.BlockStatement) {
+	if b == nil {
+		return
+	}
+	r.open(b)
+	r.statements(b.Statements)
+	r.close()
+}
+
+func (r *resolver) statements(stmts []ast.Statement) {
+	for _, stmt := range stmts {
+		r.stmt(stmt)
+	}
+}
+
+func (r *resolver) stmt(stmt ast.Statement) {
+	switch s := stmt.(type) {
+	case *ast.VarStatement:
+		r.typ(s.Type)
+		r.expr(s.Value)
+		r.declare(s.Name, Var, s)
+	case *ast.ConstStatement:
+		r.typ(s.Type)
+		r.expr(s.Value)
+		r.declare(s.Name, Const, s)
+	case *ast.InferStatement:
+		r.expr(s.Value)
+		r.declare(s.Name, Var, s)
+	case *ast.ReturnStatement:
+		r.expr(s.Value)
+	case *ast.ExpressionStatement:
+		r.expr(s.Expression)
+	case *ast.BlockStatement:
+		r.block(s)
+	case *ast.IfStatement:
+		r.expr(s.Condition)
+		r.block(s.Consequence)
+		r.block(s.Alternative)
+	case *ast.ForStatement:
+		r.open(s)
+		if s.Init != nil {
+			r.stmt(s.Init)
+		}
+		r.expr(s.Condition)
+		if s.Post != nil {
+			r.stmt(s.Post)
+		}
+		r.block(s.Body)
+		r.close()
+	case *ast.WhileStatement:
+		r.expr(s.Condition)
+		r.block(s.Body)
+	case *ast.ForRangeStatement:
+		r.expr(s.Iterable)
+		r.open(s)
+		r.declare(s.Index, Var, s)
+		r.declare(s.Value, Var, s)
+		r.block(s.Body)
+		r.close()
+	case *ast.FreeStatement:
+		r.expr(s.Value)
+	case *ast.DeferStatement:
+		if s.Statement != nil {
+			r.stmt(s.Statement)
+		}
+	case *ast.DeleteStatement:
+		r.expr(s.Map)
+		r.expr(s.Key)
+	}
+}
+
+// expr resolves the names an expression uses. Expressions declare
+// nothing, so it only has to skip the names of members and fields.
+func (r *resolver) expr(expr ast.Expression) {
+	if expr == nil {
+		return
+	}
+	ast.Inspect(expr, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.Identifier:
+			r.use(n)
+		case *ast.TypeAnnotation:
+			r.typ(n)
+			return false
+		case *ast.MemberExpression:
+			r.expr(n.Object)
+			return false
+		case *ast.StructLiteralField:
+			r.expr(n.Value)
+			return false
+		case *ast.AssignExpression:
+			if id, ok := n.Left.(*ast.Identifier); ok {
+				r.use(id)
+				r.info.Writes[id] = true
+				r.expr(n.Value)
+				return false
+			}
+		case *ast.PostfixExpression:
+			if id, ok := n.Left.(*ast.Identifier); ok {
+				r.use(id)
+				r.info.Writes[id] = true
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func (r *resolver) use(id *ast.Identifier) {
+	if obj := r.scope.Lookup(id.Value); obj != nil {
+		r.info.Uses[id] = obj
+	}
+}
+
+// typ resolves the struct and enum names a type annotation uses
+func (r *resolver) typ(t *ast.TypeAnnotation) {
+	if t == nil {
+		return
+	}
+	ast.Inspect(t, func(n ast.Node) bool {
+		t, ok := n.(*ast.TypeAnnotation)
+		if !ok {
+			return true
+		}
+		// The length of an array is an expression
+		if t.Len != nil {
+			r.expr(t.Len)
+		}
+		// Pointers and arrays repeat the name of their element
+		if t.Elem == nil && t.Name != "" {
+			if obj := r.scope.Lookup(t.Name); obj != nil && obj.Kind == Type {
+				r.info.Types[t] = obj
+			}
+		}
+		return true
+	})
+}
@@ -0,0 +1,81 @@
+package analysis
+
+import (
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+)
+
+// SelfAssign reports assignments of a variable, field or element to itself
+var SelfAssign = &Analyzer{
+	Name: "selfassign",
+	Doc: `report assignments of a variable to itself
+
+An assignment such as x = x or p.x = p.x has no effect and is usually a
+mistake for an assignment to a field or parameter of the same name. The
+suggested fix removes it.`,
+	Requires: []*Analyzer{Resolve},
+	Run: func(pass *Pass) (interface{}, error) {
+		info := pass.ResultOf[Resolve].(*Info)
+		ast.Inspect(pass.Module.Program, func(n ast.Node) bool {
+			block, ok := n.(*ast.BlockStatement)
+			if !ok {
+				return true
+			}
+			for _, stmt := range block.Statements {
+				es, ok := stmt.(*ast.ExpressionStatement)
+				if !ok {
+					continue
+				}
+				assign, ok := es.Expression.(*ast.AssignExpression)
+				if !ok || assign.Operator != "=" || !same(info, assign.Left, assign.Value) {
+					continue
+				}
+				pass.Report(Diagnostic{
+					Pos:     assign.Pos(),
+					End:     assign.End(),
+					Message: "self-assignment of " + pass.Module.Text(assign.Left) + " to itself",
+					Fixes: []SuggestedFix{{
+						Message: "Remove the assignment",
+						Edits:   []TextEdit{deleteStatement(pass.Module, es)},
+					}},
+				})
+			}
+			return true
+		})
+		return nil, nil
+	},
+}
+
+// same reports whether two expressions denote the same variable, field or
+// element, without side effects
+func same(info *Info, a, b ast.Expression) bool {
+	switch a := a.(type) {
+	case *ast.Identifier:
+		b, ok := b.(*ast.Identifier)
+		return ok && a.Value == b.Value && info.Uses[a] == info.Uses[b]
+	case *ast.MemberExpression:
+		b, ok := b.(*ast.MemberExpression)
+		return ok && a.Member.Value == b.Member.Value && same(info, a.Object, b.Object)
+	case *ast.IndexExpression:
+		b, ok := b.(*ast.IndexExpression)
+		return ok && same(info, a.Left, b.Left) && (same(info, a.Index, b.Index) || sameLiteral(a.Index, b.Index))
+	case *ast.PrefixExpression:
+		b, ok := b.(*ast.PrefixExpression)
+		return ok && a.Operator == "*" && b.Operator == "*" && same(info, a.Right, b.Right)
+	}
+	return false
+}
+
+func sameLiteral(a, b ast.Expression) bool {
+	switch a := a.(type) {
+	case *ast.IntegerLiteral:
+		b, ok := b.(*ast.IntegerLiteral)
+		return ok && a.Value == b.Value
+	case *ast.StringLiteral:
+		b, ok := b.(*ast.StringLiteral)
+		return ok && a.Value == b.Value
+	case *ast.CharLiteral:
+		b, ok := b.(*ast.CharLiteral)
+		return ok && a.Value == b.Value
+	}
+	return false
+}
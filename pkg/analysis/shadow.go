@@ -0,0 +1,46 @@
+package analysis
+
+import (
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+)
+
+// Shadow reports local declarations that hide a variable of the same name
+var Shadow = &Analyzer{
+	Name: "shadow",
+	Doc: `report local declarations that hide another variable
+
+A variable, constant or loop variable declared in a block hides any
+variable or parameter of the same name declared before it in an enclosing
+block of the function. Globals may be hidden freely.`,
+	Requires: []*Analyzer{Resolve},
+	Run: func(pass *Pass) (interface{}, error) {
+		info := pass.ResultOf[Resolve].(*Info)
+		file := pass.Module.File
+		for _, obj := range definitions(info) {
+			if obj.Kind != Var && obj.Kind != Const {
+				continue
+			}
+			for s := obj.Scope.Parent; s != nil; s = s.Parent {
+				// An enclosing block may declare the name after this one
+				hidden, ok := s.Objects[obj.Name]
+				if !ok || hidden.Decl.Pos() > obj.Decl.Pos() {
+					continue
+				}
+				switch hidden.Kind {
+				case Var, Const, Param:
+					pass.Reportf(obj.Decl, "declaration of %s shadows the %s declared at %s",
+						obj.Name, hidden.Kind, position(file, hidden.Decl.Pos()))
+				}
+				break
+			}
+		}
+		return nil, nil
+	},
+}
+
+// position returns a position as line:column
+func position(file *lexer.File, p lexer.Pos) string {
+	pos := file.Position(p)
+	pos.Filename = ""
+	return pos.String()
+}
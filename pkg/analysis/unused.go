@@ -0,0 +1,149 @@
+package analysis
+
+import (
+	"sort"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+)
+
+// UnusedVariable reports local variables that are never read
+var UnusedVariable = &Analyzer{
+	Name: "unusedvar",
+	Doc: `report local variables that are never read
+
+A variable that is only assigned to is unused too. Name a loop variable
+you do not need _ instead.`,
+	Requires: []*Analyzer{Resolve},
+	Run: func(pass *Pass) (interface{}, error) {
+		info := pass.ResultOf[Resolve].(*Info)
+		read := reads(info)
+		for _, obj := range definitions(info) {
+			if obj.Kind == Var && !read[obj] {
+				pass.Reportf(obj.Decl, "%s declared and not used", obj.Name)
+			}
+		}
+		return nil, nil
+	},
+}
+
+// UnusedParameter reports parameters a function never reads
+var UnusedParameter = &Analyzer{
+	Name: "unusedparam",
+	Doc: `report parameters a function never reads
+
+Receivers, parameters named _ and the parameters of extern functions and of
+functions used as values, whose signature is fixed by their type, are not
+reported.`,
+	Requires: []*Analyzer{Resolve},
+	Run: func(pass *Pass) (interface{}, error) {
+		info := pass.ResultOf[Resolve].(*Info)
+		read := reads(info)
+
+		// Functions passed around must keep the parameters of their type
+		called := make(map[*ast.Identifier]bool)
+		ast.Inspect(pass.Module.Program, func(n ast.Node) bool {
+			if call, ok := n.(*ast.CallExpression); ok {
+				if id, ok := call.Function.(*ast.Identifier); ok {
+					called[id] = true
+				}
+			}
+			return true
+		})
+		values := make(map[ast.Node]bool)
+		for id, obj := range info.Uses {
+			if obj.Kind == Func && !called[id] {
+				values[obj.Node] = true
+			}
+		}
+
+		for _, stmt := range pass.Module.Program.Statements {
+			f, ok := stmt.(*ast.FunctionStatement)
+			if !ok || f.Body == nil || values[f] {
+				continue
+			}
+			for _, p := range f.Parameters {
+				if obj := info.Defs[p.Name]; obj != nil && !read[obj] {
+					pass.Reportf(p.Name, "parameter %s of %s is unused", obj.Name, f.Name.Value)
+				}
+			}
+		}
+		return nil, nil
+	},
+}
+
+// UnusedImport reports imports none of whose declarations are used
+var UnusedImport = &Analyzer{
+	Name: "unusedimport",
+	Doc: `report imports none of whose declarations are used
+
+An import counts as used if anything it brings in is used, including the
+declarations of the modules it imports itself. So does an import that
+brings in an init function, which runs whether or not anything else is
+used.`,
+	Requires: []*Analyzer{Resolve},
+	Run: func(pass *Pass) (interface{}, error) {
+		info := pass.ResultOf[Resolve].(*Info)
+		used := make(map[*ast.ImportStatement]bool)
+		for _, obj := range info.Uses {
+			used[obj.Import] = true
+		}
+		for _, obj := range info.Types {
+			used[obj.Import] = true
+		}
+		for _, imp := range pass.Module.Imports {
+			if hasInit(imp.Program) {
+				used[imp.Via] = true
+			}
+		}
+
+		for _, stmt := range pass.Module.Program.Statements {
+			imp, ok := stmt.(*ast.ImportStatement)
+			if !ok || used[imp] {
+				continue
+			}
+			pass.Report(Diagnostic{
+				Pos:     imp.Pos(),
+				End:     imp.End(),
+				Message: `"` + imp.Path + `" imported and not used`,
+				Fixes: []SuggestedFix{{
+					Message: "Remove the import",
+					Edits:   []TextEdit{deleteStatement(pass.Module, imp)},
+				}},
+			})
+		}
+		return nil, nil
+	},
+}
+
+// hasInit reports whether a program declares an init function
+func hasInit(program *ast.Program) bool {
+	for _, stmt := range program.Statements {
+		if f, ok := stmt.(*ast.FunctionStatement); ok && f.Receiver == nil && f.Name.Value == "init" {
+			return true
+		}
+	}
+	return false
+}
+
+// reads returns the objects that are read somewhere
+func reads(info *Info) map[*Object]bool {
+	read := make(map[*Object]bool)
+	for id, obj := range info.Uses {
+		if !info.Writes[id] {
+			read[obj] = true
+		}
+	}
+	return read
+}
+
+// definitions returns the objects the module declares in source order
+func definitions(info *Info) []*Object {
+	objects := make([]*Object, 0, len(info.Defs))
+	for _, obj := range info.Defs {
+		objects = append(objects, obj)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Decl.Pos() < objects[j].Decl.Pos()
+	})
+	return objects
+}
@@ -2,15 +2,23 @@ package ast
 
 import (
 	"bytes"
+	"strconv"
 	"strings"
 
 	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
 )
 
-// Node is the base interface for all AST nodes
+// Node is the base interface for all AST nodes. Pos and End are the
+// positions of a node's first byte and of the byte after its last one,
+// so that the source of a node is the text between them. Parentheses are
+// not nodes of their own: an expression's span includes the parentheses
+// written around it. The semicolons ending statements are not part of
+// them. Nodes made by hand have lexer.NoPos.
 type Node interface {
 	TokenLiteral() string
 	String() string
+	Pos() lexer.Pos
+	End() lexer.Pos
 }
 
 // Statement represents a statement node
@@ -23,13 +31,51 @@ type Statement interface {
 type Expression interface {
 	Node
 	expressionNode()
+	// Parenthesize records parentheses written around the expression.
+	// The parser calls it for each pair from the innermost out, so the
+	// outermost are kept.
+	Parenthesize(lparen, rparen lexer.Token)
+}
+
+// Parens are the outermost parentheses written around an expression, which
+// its span includes. They are zero when there are none.
+type Parens struct {
+	Open  lexer.Token
+	Close lexer.Token
+}
+
+func (p *Parens) Parenthesize(lparen, rparen lexer.Token) { p.Open, p.Close = lparen, rparen }
+
+// pos returns the position of the opening parenthesis, or the first byte
+// of the expression inside when there is none
+func (p *Parens) pos(inner lexer.Pos) lexer.Pos {
+	if p.Open.Pos.IsValid() {
+		return p.Open.Pos
+	}
+	return inner
+}
+
+// end returns the end of the closing parenthesis, or of the expression
+// inside when there is none
+func (p *Parens) end(inner lexer.Pos) lexer.Pos {
+	if p.Close.End.IsValid() {
+		return p.Close.End
+	}
+	return inner
 }
 
 // Program is the root node of the AST
 type Program struct {
 	Statements []Statement
+	Comments   []*Comment // every comment in the source, in order
+	File       string     // the path the source was read from, if known
 }
 
+// ImportResolver resolves an import path and returns the parsed AST of the
+// file it names. The basePath is the directory of the file containing the
+// import.
+type ImportResolver func(importPath, basePath string) (*Program, error)
+
 func (p *Program) TokenLiteral() string {
 	if len(p.Statements) > 0 {
 		return p.Statements[0].TokenLiteral()
@@ -37,6 +83,22 @@ func (p *Program) TokenLiteral() string {
 	return ""
 }
 
+// Pos returns the position of the first statement
+func (p *Program) Pos() lexer.Pos {
+	if len(p.Statements) > 0 {
+		return p.Statements[0].Pos()
+	}
+	return lexer.NoPos
+}
+
+// End returns the position after the last statement
+func (p *Program) End() lexer.Pos {
+	if n := len(p.Statements); n > 0 {
+		return p.Statements[n-1].End()
+	}
+	return lexer.NoPos
+}
+
 func (p *Program) String() string {
 	var out bytes.Buffer
 	for _, s := range p.Statements {
@@ -45,131 +107,285 @@ func (p *Program) String() string {
 	return out.String()
 }
 
+// modifierPos returns the position of a declaration, which starts at its
+// modifier if it has one
+func modifierPos(modifier, tok lexer.Token) lexer.Pos {
+	if modifier.Pos.IsValid() {
+		return modifier.Pos
+	}
+	return tok.Pos
+}
+
+// Comment is a comment in the source. Comments are not part of the tree;
+// tools that print source place them by position.
+type Comment struct {
+	Token    lexer.Token // Literal is the text without the comment markers
+	Trailing bool        // code precedes the comment on its line
+}
+
 // ImportStatement: import "path/to/file.hl";
 type ImportStatement struct {
-	Token lexer.Token
-	Path  string // the import path (e.g., "math.hl")
+	Token     lexer.Token
+	Path      string      // the import path (e.g., "math.hl")
+	PathToken lexer.Token // the path string
 }
 
 func (is *ImportStatement) statementNode()       {}
 func (is *ImportStatement) TokenLiteral() string { return is.Token.Literal }
+func (is *ImportStatement) Pos() lexer.Pos       { return is.Token.Pos }
+func (is *ImportStatement) End() lexer.Pos {
+	if is.PathToken.End.IsValid() {
+		return is.PathToken.End
+	}
+	return is.Token.End
+}
 func (is *ImportStatement) String() string {
 	return "import \"" + is.Path + "\";"
 }
 
+// CIncludeStatement: cinclude "math.h";
+// The header is included by the generated C. A path in angle brackets,
+// as in cinclude "<math.h>", is included as a system header.
+type CIncludeStatement struct {
+	Token     lexer.Token // the 'cinclude' identifier
+	Path      string
+	PathToken lexer.Token // the path string
+}
+
+func (cs *CIncludeStatement) statementNode()       {}
+func (cs *CIncludeStatement) TokenLiteral() string { return cs.Token.Literal }
+func (cs *CIncludeStatement) Pos() lexer.Pos       { return cs.Token.Pos }
+func (cs *CIncludeStatement) End() lexer.Pos {
+	if cs.PathToken.End.IsValid() {
+		return cs.PathToken.End
+	}
+	return cs.Token.End
+}
+func (cs *CIncludeStatement) String() string {
+	return "cinclude \"" + cs.Path + "\";"
+}
+
+// LinkStatement: link "m";
+// The program is linked against the C library, as with -lm.
+type LinkStatement struct {
+	Token        lexer.Token // the 'link' identifier
+	Library      string
+	LibraryToken lexer.Token // the library string
+}
+
+func (ls *LinkStatement) statementNode()       {}
+func (ls *LinkStatement) TokenLiteral() string { return ls.Token.Literal }
+func (ls *LinkStatement) Pos() lexer.Pos       { return ls.Token.Pos }
+func (ls *LinkStatement) End() lexer.Pos {
+	if ls.LibraryToken.End.IsValid() {
+		return ls.LibraryToken.End
+	}
+	return ls.Token.End
+}
+func (ls *LinkStatement) String() string {
+	return "link \"" + ls.Library + "\";"
+}
+
 // Identifier represents a variable name
 type Identifier struct {
 	Token lexer.Token
 	Value string
+	Parens
 }
 
 func (i *Identifier) expressionNode()      {}
 func (i *Identifier) TokenLiteral() string { return i.Token.Literal }
+func (i *Identifier) Pos() lexer.Pos       { return i.Parens.pos(i.Token.Pos) }
+func (i *Identifier) End() lexer.Pos       { return i.Parens.end(i.Token.End) }
 func (i *Identifier) String() string       { return i.Value }
 
 // IntegerLiteral represents an integer
 type IntegerLiteral struct {
 	Token lexer.Token
 	Value int64
+	Parens
 }
 
 func (il *IntegerLiteral) expressionNode()      {}
 func (il *IntegerLiteral) TokenLiteral() string { return il.Token.Literal }
+func (il *IntegerLiteral) Pos() lexer.Pos       { return il.Parens.pos(il.Token.Pos) }
+func (il *IntegerLiteral) End() lexer.Pos       { return il.Parens.end(il.Token.End) }
 func (il *IntegerLiteral) String() string       { return il.Token.Literal }
 
 // FloatLiteral represents a float
 type FloatLiteral struct {
 	Token lexer.Token
 	Value float64
+	Parens
 }
 
 func (fl *FloatLiteral) expressionNode()      {}
 func (fl *FloatLiteral) TokenLiteral() string { return fl.Token.Literal }
+func (fl *FloatLiteral) Pos() lexer.Pos       { return fl.Parens.pos(fl.Token.Pos) }
+func (fl *FloatLiteral) End() lexer.Pos       { return fl.Parens.end(fl.Token.End) }
 func (fl *FloatLiteral) String() string       { return fl.Token.Literal }
 
 // StringLiteral represents a string
 type StringLiteral struct {
 	Token lexer.Token
 	Value string
+	Parens
 }
 
 func (sl *StringLiteral) expressionNode()      {}
 func (sl *StringLiteral) TokenLiteral() string { return sl.Token.Literal }
+func (sl *StringLiteral) Pos() lexer.Pos       { return sl.Parens.pos(sl.Token.Pos) }
+func (sl *StringLiteral) End() lexer.Pos       { return sl.Parens.end(sl.Token.End) }
 func (sl *StringLiteral) String() string       { return "\"" + sl.Value + "\"" }
 
 // CharLiteral represents a character
 type CharLiteral struct {
 	Token lexer.Token
 	Value byte
+	Parens
 }
 
 func (cl *CharLiteral) expressionNode()      {}
 func (cl *CharLiteral) TokenLiteral() string { return cl.Token.Literal }
+func (cl *CharLiteral) Pos() lexer.Pos       { return cl.Parens.pos(cl.Token.Pos) }
+func (cl *CharLiteral) End() lexer.Pos       { return cl.Parens.end(cl.Token.End) }
 func (cl *CharLiteral) String() string       { return "'" + string(cl.Value) + "'" }
 
 // BooleanLiteral represents true/false
 type BooleanLiteral struct {
 	Token lexer.Token
 	Value bool
+	Parens
 }
 
 func (bl *BooleanLiteral) expressionNode()      {}
 func (bl *BooleanLiteral) TokenLiteral() string { return bl.Token.Literal }
+func (bl *BooleanLiteral) Pos() lexer.Pos       { return bl.Parens.pos(bl.Token.Pos) }
+func (bl *BooleanLiteral) End() lexer.Pos       { return bl.Parens.end(bl.Token.End) }
 func (bl *BooleanLiteral) String() string       { return bl.Token.Literal }
 
 // NullLiteral represents null
 type NullLiteral struct {
 	Token lexer.Token
+	Parens
 }
 
 func (nl *NullLiteral) expressionNode()      {}
 func (nl *NullLiteral) TokenLiteral() string { return nl.Token.Literal }
+func (nl *NullLiteral) Pos() lexer.Pos       { return nl.Parens.pos(nl.Token.Pos) }
+func (nl *NullLiteral) End() lexer.Pos       { return nl.Parens.end(nl.Token.End) }
 func (nl *NullLiteral) String() string       { return "null" }
 
-// TypeAnnotation represents a type
+// TypeAnnotation represents a type. Types nest: the flags describe the
+// outermost constructor and Elem, KeyType/ValueType or Params/ReturnType
+// hold its components, so [3]*User is an array whose Elem is a pointer
+// whose Elem is User. Name is always the innermost named type.
 type TypeAnnotation struct {
-	Token     lexer.Token
-	Name      string
-	IsPtr     bool // true if *Type
-	ArrayLen  int  // -1 for slice, 0 for non-array, >0 for fixed array
-	IsMap     bool // true if map[K]V
-	KeyType   *TypeAnnotation
-	ValueType *TypeAnnotation
+	Token      lexer.Token
+	Name       string
+	IsPtr      bool // true if *Elem
+	ArrayLen   int  // -1 for slice, 0 for non-array, >0 for fixed array
+	IsMap      bool // true if map[K]V
+	IsFunc     bool // true if function(Params) ReturnType
+	Elem       *TypeAnnotation
+	Len        Expression // the length of [N]Elem as a constant expression, until it is evaluated into ArrayLen
+	KeyType    *TypeAnnotation
+	ValueType  *TypeAnnotation
+	Params     []*TypeAnnotation
+	ReturnType *TypeAnnotation // nil for function types without a result
+	Rparen     lexer.Token     // closes the parameters of a function type
+}
+
+// Element returns the pointee of a pointer or the element type of an
+// array or slice. Annotations built without Elem (e.g. Name "int" with
+// IsPtr set) have the named type as their element.
+func (t *TypeAnnotation) Element() *TypeAnnotation {
+	if t.Elem != nil {
+		return t.Elem
+	}
+	return &TypeAnnotation{Token: t.Token, Name: t.Name}
 }
 
-func (t *TypeAnnotation) String() string {
-	var out bytes.Buffer
-	if t.IsPtr {
-		out.WriteString("*")
-	}
-	if t.IsMap {
-		out.WriteString("map[")
-		out.WriteString(t.KeyType.String())
-		out.WriteString("]")
-		out.WriteString(t.ValueType.String())
-		return out.String()
+// IsNamed reports whether t is a plain named type such as int or User
+func (t *TypeAnnotation) IsNamed() bool {
+	return !t.IsPtr && !t.IsMap && !t.IsFunc && t.ArrayLen == 0 && t.Len == nil
+}
+
+// IsArray reports whether t is a fixed-size array, whether or not its
+// length has been evaluated
+func (t *TypeAnnotation) IsArray() bool {
+	return t.ArrayLen > 0 || t.Len != nil
+}
+
+func (t *TypeAnnotation) TokenLiteral() string { return t.Token.Literal }
+func (t *TypeAnnotation) Pos() lexer.Pos       { return t.Token.Pos }
+func (t *TypeAnnotation) End() lexer.Pos {
+	switch {
+	case t.IsMap && t.ValueType != nil:
+		return t.ValueType.End()
+	case t.IsFunc && t.ReturnType != nil:
+		return t.ReturnType.End()
+	case t.IsFunc && t.Rparen.End.IsValid():
+		return t.Rparen.End
+	case t.Elem != nil:
+		return t.Elem.End()
 	}
-	if t.ArrayLen == -1 {
-		out.WriteString("[]")
-	} else if t.ArrayLen > 0 {
-		out.WriteString("[" + string(rune(t.ArrayLen)) + "]")
+	return t.Token.End
+}
+
+func (t *TypeAnnotation) String() string {
+	switch {
+	case t.IsPtr:
+		return "*" + t.Element().String()
+	case t.IsMap:
+		return "map[" + t.KeyType.String() + "]" + t.ValueType.String()
+	case t.IsFunc:
+		var params []string
+		for _, p := range t.Params {
+			params = append(params, p.String())
+		}
+		out := "function(" + strings.Join(params, ", ") + ")"
+		if t.ReturnType != nil {
+			out += " " + t.ReturnType.String()
+		}
+		return out
+	case t.ArrayLen == -1:
+		return "[]" + t.Element().String()
+	case t.ArrayLen > 0:
+		return "[" + strconv.Itoa(t.ArrayLen) + "]" + t.Element().String()
+	case t.Len != nil:
+		return "[" + t.Len.String() + "]" + t.Element().String()
 	}
-	out.WriteString(t.Name)
-	return out.String()
+	return t.Name
 }
 
 // VarStatement: var x int = 5;
 type VarStatement struct {
-	Token lexer.Token
-	Name  *Identifier
-	Type  *TypeAnnotation // optional, can be inferred
-	Value Expression
+	Token    lexer.Token
+	Modifier lexer.Token // the 'public' keyword, if any
+	Public   bool        // only meaningful at module level
+	Name     *Identifier
+	Type     *TypeAnnotation // optional, can be inferred
+	Value    Expression
 }
 
 func (vs *VarStatement) statementNode()       {}
 func (vs *VarStatement) TokenLiteral() string { return vs.Token.Literal }
+func (vs *VarStatement) Pos() lexer.Pos       { return modifierPos(vs.Modifier, vs.Token) }
+func (vs *VarStatement) End() lexer.Pos {
+	switch {
+	case vs.Value != nil:
+		return vs.Value.End()
+	case vs.Type != nil:
+		return vs.Type.End()
+	}
+	return vs.Name.End()
+}
 func (vs *VarStatement) String() string {
 	var out bytes.Buffer
+	if vs.Public {
+		out.WriteString("public ")
+	}
 	out.WriteString("var ")
 	out.WriteString(vs.Name.String())
 	if vs.Type != nil {
@@ -184,16 +400,31 @@ func (vs *VarStatement) String() string {
 
 // ConstStatement: const x := 5;
 type ConstStatement struct {
-	Token lexer.Token
-	Name  *Identifier
-	Type  *TypeAnnotation
-	Value Expression
+	Token    lexer.Token
+	Modifier lexer.Token // the 'public' keyword, if any
+	Public   bool        // only meaningful at module level
+	Name     *Identifier
+	Type     *TypeAnnotation
+	Value    Expression
 }
 
 func (cs *ConstStatement) statementNode()       {}
 func (cs *ConstStatement) TokenLiteral() string { return cs.Token.Literal }
+func (cs *ConstStatement) Pos() lexer.Pos       { return modifierPos(cs.Modifier, cs.Token) }
+func (cs *ConstStatement) End() lexer.Pos {
+	switch {
+	case cs.Value != nil:
+		return cs.Value.End()
+	case cs.Type != nil:
+		return cs.Type.End()
+	}
+	return cs.Name.End()
+}
 func (cs *ConstStatement) String() string {
 	var out bytes.Buffer
+	if cs.Public {
+		out.WriteString("public ")
+	}
 	out.WriteString("const ")
 	out.WriteString(cs.Name.String())
 	if cs.Type != nil {
@@ -212,6 +443,13 @@ type InferStatement struct {
 
 func (is *InferStatement) statementNode()       {}
 func (is *InferStatement) TokenLiteral() string { return is.Token.Literal }
+func (is *InferStatement) Pos() lexer.Pos       { return is.Token.Pos }
+func (is *InferStatement) End() lexer.Pos {
+	if is.Value != nil {
+		return is.Value.End()
+	}
+	return is.Token.End
+}
 func (is *InferStatement) String() string {
 	return is.Name.String() + " := " + is.Value.String() + ";"
 }
@@ -224,6 +462,13 @@ type ReturnStatement struct {
 
 func (rs *ReturnStatement) statementNode()       {}
 func (rs *ReturnStatement) TokenLiteral() string { return rs.Token.Literal }
+func (rs *ReturnStatement) Pos() lexer.Pos       { return rs.Token.Pos }
+func (rs *ReturnStatement) End() lexer.Pos {
+	if rs.Value != nil {
+		return rs.Value.End()
+	}
+	return rs.Token.End
+}
 func (rs *ReturnStatement) String() string {
 	var out bytes.Buffer
 	out.WriteString("return")
@@ -242,6 +487,13 @@ type ExpressionStatement struct {
 
 func (es *ExpressionStatement) statementNode()       {}
 func (es *ExpressionStatement) TokenLiteral() string { return es.Token.Literal }
+func (es *ExpressionStatement) Pos() lexer.Pos       { return es.Token.Pos }
+func (es *ExpressionStatement) End() lexer.Pos {
+	if es.Expression != nil {
+		return es.Expression.End()
+	}
+	return es.Token.End
+}
 func (es *ExpressionStatement) String() string {
 	if es.Expression != nil {
 		return es.Expression.String() + ";"
@@ -253,10 +505,18 @@ func (es *ExpressionStatement) String() string {
 type BlockStatement struct {
 	Token      lexer.Token
 	Statements []Statement
+	Rbrace     lexer.Token // the closing brace
 }
 
 func (bs *BlockStatement) statementNode()       {}
 func (bs *BlockStatement) TokenLiteral() string { return bs.Token.Literal }
+func (bs *BlockStatement) Pos() lexer.Pos       { return bs.Token.Pos }
+func (bs *BlockStatement) End() lexer.Pos {
+	if bs.Rbrace.End.IsValid() {
+		return bs.Rbrace.End
+	}
+	return bs.Token.End
+}
 func (bs *BlockStatement) String() string {
 	var out bytes.Buffer
 	out.WriteString("{\n")
@@ -273,29 +533,65 @@ type Parameter struct {
 	Type *TypeAnnotation
 }
 
+func (p *Parameter) TokenLiteral() string { return p.Name.TokenLiteral() }
+func (p *Parameter) Pos() lexer.Pos       { return p.Name.Pos() }
+func (p *Parameter) End() lexer.Pos {
+	if p.Type != nil {
+		return p.Type.End()
+	}
+	return p.Name.End()
+}
+func (p *Parameter) String() string { return p.Name.String() + " " + p.Type.String() }
+
 // FunctionStatement: function foo(x int) int { ... }
+// or, implemented in C, extern function foo(x int, ...) int;
+// or, run by the compiler, comptime function foo(x int) int { ... }
 type FunctionStatement struct {
 	Token      lexer.Token
+	Modifier   lexer.Token // 'public', 'extern' or 'comptime', whichever comes first
+	Doc        string      // the doc comment, without comment markers
 	Public     bool
+	Extern     bool       // declared here, implemented in C; Body is nil
+	Comptime   bool       // only called at compile time, and not compiled
 	Receiver   *Parameter // nil for regular functions
 	Name       *Identifier
 	Parameters []*Parameter
+	Variadic   bool        // the parameters end with ..., for extern functions
+	Rparen     lexer.Token // closes the parameters
 	ReturnType *TypeAnnotation
 	Body       *BlockStatement
 }
 
 func (fs *FunctionStatement) statementNode()       {}
 func (fs *FunctionStatement) TokenLiteral() string { return fs.Token.Literal }
+func (fs *FunctionStatement) Pos() lexer.Pos       { return modifierPos(fs.Modifier, fs.Token) }
+func (fs *FunctionStatement) End() lexer.Pos {
+	switch {
+	case fs.Body != nil:
+		return fs.Body.End()
+	case fs.ReturnType != nil:
+		return fs.ReturnType.End()
+	case fs.Rparen.End.IsValid():
+		return fs.Rparen.End
+	}
+	return fs.Name.End()
+}
 func (fs *FunctionStatement) String() string {
 	var out bytes.Buffer
 
 	if fs.Public {
 		out.WriteString("public ")
 	}
+	if fs.Extern {
+		out.WriteString("extern ")
+	}
+	if fs.Comptime {
+		out.WriteString("comptime ")
+	}
 	out.WriteString("function ")
 
 	if fs.Receiver != nil {
-		out.WriteString("(" + fs.Receiver.Name.String() + " " + fs.Receiver.Type.String() + ") ")
+		out.WriteString("(" + fs.Receiver.String() + ") ")
 	}
 
 	out.WriteString(fs.Name.String())
@@ -303,7 +599,10 @@ func (fs *FunctionStatement) String() string {
 
 	params := []string{}
 	for _, p := range fs.Parameters {
-		params = append(params, p.Name.String()+" "+p.Type.String())
+		params = append(params, p.String())
+	}
+	if fs.Variadic {
+		params = append(params, "...")
 	}
 	out.WriteString(strings.Join(params, ", "))
 	out.WriteString(")")
@@ -312,44 +611,100 @@ func (fs *FunctionStatement) String() string {
 		out.WriteString(" " + fs.ReturnType.String())
 	}
 
+	if fs.Body == nil {
+		out.WriteString(";")
+		return out.String()
+	}
 	out.WriteString(" " + fs.Body.String())
 	return out.String()
 }
 
+// TestStatement: test "name" { ... }
+// Test blocks are compiled only by hlc test.
+type TestStatement struct {
+	Token lexer.Token // the 'test' identifier
+	Name  string
+	Body  *BlockStatement
+}
+
+func (ts *TestStatement) statementNode()       {}
+func (ts *TestStatement) TokenLiteral() string { return ts.Token.Literal }
+func (ts *TestStatement) Pos() lexer.Pos       { return ts.Token.Pos }
+func (ts *TestStatement) End() lexer.Pos {
+	if ts.Body != nil {
+		return ts.Body.End()
+	}
+	return ts.Token.End
+}
+func (ts *TestStatement) String() string {
+	return "test \"" + ts.Name + "\" " + ts.Body.String()
+}
+
 // StructField represents a field in a struct
 type StructField struct {
-	Public bool
-	Name   *Identifier
-	Type   *TypeAnnotation
+	Doc      string // the doc comment, or a comment after the field
+	Public   bool
+	Modifier lexer.Token // the 'public' keyword, if any
+	Name     *Identifier
+	Type     *TypeAnnotation
+}
+
+func (sf *StructField) TokenLiteral() string { return sf.Name.TokenLiteral() }
+func (sf *StructField) Pos() lexer.Pos       { return modifierPos(sf.Modifier, sf.Name.Token) }
+func (sf *StructField) End() lexer.Pos {
+	if sf.Type != nil {
+		return sf.Type.End()
+	}
+	return sf.Name.End()
+}
+func (sf *StructField) String() string {
+	if sf.Public {
+		return "public " + sf.Name.String() + " " + sf.Type.String() + ";"
+	}
+	return sf.Name.String() + " " + sf.Type.String() + ";"
 }
 
 // StructStatement: struct Foo { ... }
+// or, defined in C, extern struct Foo; or extern struct Foo { ... }
 type StructStatement struct {
-	Token  lexer.Token
-	Public bool
-	Name   *Identifier
-	Fields []*StructField
+	Token    lexer.Token
+	Modifier lexer.Token // 'public' or 'extern', whichever comes first
+	Doc      string      // the doc comment, without comment markers
+	Public   bool
+	Extern   bool // a C struct; its fields may be a subset of the C ones
+	Name     *Identifier
+	Fields   []*StructField // nil for an opaque extern struct
+	Rbrace   lexer.Token    // the last token of an opaque extern struct
 }
 
 func (ss *StructStatement) statementNode()       {}
 func (ss *StructStatement) TokenLiteral() string { return ss.Token.Literal }
+func (ss *StructStatement) Pos() lexer.Pos       { return modifierPos(ss.Modifier, ss.Token) }
+func (ss *StructStatement) End() lexer.Pos {
+	if ss.Rbrace.End.IsValid() {
+		return ss.Rbrace.End
+	}
+	return ss.Name.End()
+}
 func (ss *StructStatement) String() string {
 	var out bytes.Buffer
 
 	if ss.Public {
 		out.WriteString("public ")
 	}
+	if ss.Extern {
+		out.WriteString("extern ")
+	}
 	out.WriteString("struct ")
 	out.WriteString(ss.Name.String())
+	if ss.Fields == nil {
+		out.WriteString(";")
+		return out.String()
+	}
 	out.WriteString(" {\n")
 
 	for _, f := range ss.Fields {
-		if f.Public {
-			out.WriteString("  public ")
-		} else {
-			out.WriteString("  ")
-		}
-		out.WriteString(f.Name.String() + " " + f.Type.String() + ";\n")
+		out.WriteString("  " + f.String() + "\n")
 	}
 
 	out.WriteString("}")
@@ -358,20 +713,46 @@ func (ss *StructStatement) String() string {
 
 // EnumValue represents a value in an enum
 type EnumValue struct {
+	Doc   string // the doc comment, or a comment after the value
 	Name  *Identifier
 	Value Expression // optional explicit value
 }
 
+func (ev *EnumValue) TokenLiteral() string { return ev.Name.TokenLiteral() }
+func (ev *EnumValue) Pos() lexer.Pos       { return ev.Name.Pos() }
+func (ev *EnumValue) End() lexer.Pos {
+	if ev.Value != nil {
+		return ev.Value.End()
+	}
+	return ev.Name.End()
+}
+func (ev *EnumValue) String() string {
+	if ev.Value != nil {
+		return ev.Name.String() + " = " + ev.Value.String()
+	}
+	return ev.Name.String()
+}
+
 // EnumStatement: enum Color { Red, Green, Blue }
 type EnumStatement struct {
-	Token  lexer.Token
-	Public bool
-	Name   *Identifier
-	Values []*EnumValue
+	Token    lexer.Token
+	Modifier lexer.Token // the 'public' keyword, if any
+	Doc      string      // the doc comment, without comment markers
+	Public   bool
+	Name     *Identifier
+	Values   []*EnumValue
+	Rbrace   lexer.Token
 }
 
 func (es *EnumStatement) statementNode()       {}
 func (es *EnumStatement) TokenLiteral() string { return es.Token.Literal }
+func (es *EnumStatement) Pos() lexer.Pos       { return modifierPos(es.Modifier, es.Token) }
+func (es *EnumStatement) End() lexer.Pos {
+	if es.Rbrace.End.IsValid() {
+		return es.Rbrace.End
+	}
+	return es.Name.End()
+}
 func (es *EnumStatement) String() string {
 	var out bytes.Buffer
 
@@ -383,12 +764,7 @@ func (es *EnumStatement) String() string {
 	out.WriteString(" {\n")
 
 	for i, v := range es.Values {
-		out.WriteString("  ")
-		out.WriteString(v.Name.String())
-		if v.Value != nil {
-			out.WriteString(" = ")
-			out.WriteString(v.Value.String())
-		}
+		out.WriteString("  " + v.String())
 		if i < len(es.Values)-1 {
 			out.WriteString(",")
 		}
@@ -409,6 +785,13 @@ type IfStatement struct {
 
 func (is *IfStatement) statementNode()       {}
 func (is *IfStatement) TokenLiteral() string { return is.Token.Literal }
+func (is *IfStatement) Pos() lexer.Pos       { return is.Token.Pos }
+func (is *IfStatement) End() lexer.Pos {
+	if is.Alternative != nil {
+		return is.Alternative.End()
+	}
+	return is.Consequence.End()
+}
 func (is *IfStatement) String() string {
 	var out bytes.Buffer
 	out.WriteString("if " + is.Condition.String() + " ")
@@ -430,6 +813,8 @@ type ForStatement struct {
 
 func (fs *ForStatement) statementNode()       {}
 func (fs *ForStatement) TokenLiteral() string { return fs.Token.Literal }
+func (fs *ForStatement) Pos() lexer.Pos       { return fs.Token.Pos }
+func (fs *ForStatement) End() lexer.Pos       { return fs.Body.End() }
 func (fs *ForStatement) String() string {
 	var out bytes.Buffer
 	out.WriteString("for ")
@@ -456,6 +841,8 @@ type WhileStatement struct {
 
 func (ws *WhileStatement) statementNode()       {}
 func (ws *WhileStatement) TokenLiteral() string { return ws.Token.Literal }
+func (ws *WhileStatement) Pos() lexer.Pos       { return ws.Token.Pos }
+func (ws *WhileStatement) End() lexer.Pos       { return ws.Body.End() }
 func (ws *WhileStatement) String() string {
 	return "while " + ws.Condition.String() + " " + ws.Body.String()
 }
@@ -471,6 +858,8 @@ type ForRangeStatement struct {
 
 func (frs *ForRangeStatement) statementNode()       {}
 func (frs *ForRangeStatement) TokenLiteral() string { return frs.Token.Literal }
+func (frs *ForRangeStatement) Pos() lexer.Pos       { return frs.Token.Pos }
+func (frs *ForRangeStatement) End() lexer.Pos       { return frs.Body.End() }
 func (frs *ForRangeStatement) String() string {
 	var out bytes.Buffer
 	out.WriteString("for ")
@@ -496,10 +885,13 @@ type PrefixExpression struct {
 	Token    lexer.Token
 	Operator string
 	Right    Expression
+	Parens
 }
 
 func (pe *PrefixExpression) expressionNode()      {}
 func (pe *PrefixExpression) TokenLiteral() string { return pe.Token.Literal }
+func (pe *PrefixExpression) Pos() lexer.Pos       { return pe.Parens.pos(pe.Token.Pos) }
+func (pe *PrefixExpression) End() lexer.Pos       { return pe.Parens.end(pe.Right.End()) }
 func (pe *PrefixExpression) String() string {
 	return "(" + pe.Operator + pe.Right.String() + ")"
 }
@@ -510,10 +902,13 @@ type InfixExpression struct {
 	Left     Expression
 	Operator string
 	Right    Expression
+	Parens
 }
 
 func (ie *InfixExpression) expressionNode()      {}
 func (ie *InfixExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *InfixExpression) Pos() lexer.Pos       { return ie.Parens.pos(ie.Left.Pos()) }
+func (ie *InfixExpression) End() lexer.Pos       { return ie.Parens.end(ie.Right.End()) }
 func (ie *InfixExpression) String() string {
 	return "(" + ie.Left.String() + " " + ie.Operator + " " + ie.Right.String() + ")"
 }
@@ -523,10 +918,13 @@ type PostfixExpression struct {
 	Token    lexer.Token
 	Left     Expression
 	Operator string
+	Parens
 }
 
 func (pe *PostfixExpression) expressionNode()      {}
 func (pe *PostfixExpression) TokenLiteral() string { return pe.Token.Literal }
+func (pe *PostfixExpression) Pos() lexer.Pos       { return pe.Parens.pos(pe.Left.Pos()) }
+func (pe *PostfixExpression) End() lexer.Pos       { return pe.Parens.end(pe.Token.End) }
 func (pe *PostfixExpression) String() string {
 	return "(" + pe.Left.String() + pe.Operator + ")"
 }
@@ -536,10 +934,25 @@ type CallExpression struct {
 	Token     lexer.Token
 	Function  Expression
 	Arguments []Expression
+	Rparen    lexer.Token
+	Parens
 }
 
 func (ce *CallExpression) expressionNode()      {}
 func (ce *CallExpression) TokenLiteral() string { return ce.Token.Literal }
+func (ce *CallExpression) Pos() lexer.Pos       { return ce.Parens.pos(ce.Function.Pos()) }
+func (ce *CallExpression) End() lexer.Pos {
+	if ce.Close.End.IsValid() {
+		return ce.Close.End
+	}
+	if ce.Rparen.End.IsValid() {
+		return ce.Rparen.End
+	}
+	if n := len(ce.Arguments); n > 0 {
+		return ce.Arguments[n-1].End()
+	}
+	return ce.Function.End()
+}
 func (ce *CallExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString(ce.Function.String())
@@ -556,13 +969,25 @@ func (ce *CallExpression) String() string {
 
 // IndexExpression: arr[0]
 type IndexExpression struct {
-	Token lexer.Token
-	Left  Expression
-	Index Expression
+	Token    lexer.Token
+	Left     Expression
+	Index    Expression
+	Rbracket lexer.Token
+	Parens
 }
 
 func (ie *IndexExpression) expressionNode()      {}
 func (ie *IndexExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *IndexExpression) Pos() lexer.Pos       { return ie.Parens.pos(ie.Left.Pos()) }
+func (ie *IndexExpression) End() lexer.Pos {
+	if ie.Close.End.IsValid() {
+		return ie.Close.End
+	}
+	if ie.Rbracket.End.IsValid() {
+		return ie.Rbracket.End
+	}
+	return ie.Index.End()
+}
 func (ie *IndexExpression) String() string {
 	return "(" + ie.Left.String() + "[" + ie.Index.String() + "])"
 }
@@ -572,10 +997,13 @@ type MemberExpression struct {
 	Token  lexer.Token
 	Object Expression
 	Member *Identifier
+	Parens
 }
 
 func (me *MemberExpression) expressionNode()      {}
 func (me *MemberExpression) TokenLiteral() string { return me.Token.Literal }
+func (me *MemberExpression) Pos() lexer.Pos       { return me.Parens.pos(me.Object.Pos()) }
+func (me *MemberExpression) End() lexer.Pos       { return me.Parens.end(me.Member.End()) }
 func (me *MemberExpression) String() string {
 	return "(" + me.Object.String() + "." + me.Member.String() + ")"
 }
@@ -586,47 +1014,151 @@ type AssignExpression struct {
 	Left     Expression
 	Operator string // =, +=, -=, *=, /=
 	Value    Expression
+	Parens
 }
 
 func (ae *AssignExpression) expressionNode()      {}
 func (ae *AssignExpression) TokenLiteral() string { return ae.Token.Literal }
+func (ae *AssignExpression) Pos() lexer.Pos       { return ae.Parens.pos(ae.Left.Pos()) }
+func (ae *AssignExpression) End() lexer.Pos       { return ae.Parens.end(ae.Value.End()) }
 func (ae *AssignExpression) String() string {
 	return "(" + ae.Left.String() + " " + ae.Operator + " " + ae.Value.String() + ")"
 }
 
+// ComptimeExpression: comptime f(8), evaluated by the compiler
+type ComptimeExpression struct {
+	Token lexer.Token // the 'comptime' word
+	Value Expression
+	Parens
+}
+
+func (ce *ComptimeExpression) expressionNode()      {}
+func (ce *ComptimeExpression) TokenLiteral() string { return ce.Token.Literal }
+func (ce *ComptimeExpression) Pos() lexer.Pos       { return ce.Parens.pos(ce.Token.Pos) }
+func (ce *ComptimeExpression) End() lexer.Pos       { return ce.Parens.end(ce.Value.End()) }
+func (ce *ComptimeExpression) String() string {
+	return "(comptime " + ce.Value.String() + ")"
+}
+
 // CastExpression: (int)x
 type CastExpression struct {
 	Token      lexer.Token
+	Lparen     lexer.Token // opens the target type
 	TargetType *TypeAnnotation
 	Value      Expression
+	Parens
 }
 
 func (ce *CastExpression) expressionNode()      {}
 func (ce *CastExpression) TokenLiteral() string { return ce.Token.Literal }
+func (ce *CastExpression) Pos() lexer.Pos {
+	if ce.Open.Pos.IsValid() {
+		return ce.Open.Pos
+	}
+	if ce.Lparen.Pos.IsValid() {
+		return ce.Lparen.Pos
+	}
+	return ce.TargetType.Pos()
+}
+func (ce *CastExpression) End() lexer.Pos { return ce.Parens.end(ce.Value.End()) }
 func (ce *CastExpression) String() string {
 	return "((" + ce.TargetType.String() + ")" + ce.Value.String() + ")"
 }
 
-// AllocExpression: alloc(User)
+// AllocExpression: alloc(User) or alloc(User{name: "a"})
 type AllocExpression struct {
-	Token lexer.Token
-	Type  *TypeAnnotation
+	Token  lexer.Token
+	Type   *TypeAnnotation
+	Init   *StructLiteral // optional initial value
+	Rparen lexer.Token
+	Parens
 }
 
 func (ae *AllocExpression) expressionNode()      {}
 func (ae *AllocExpression) TokenLiteral() string { return ae.Token.Literal }
+func (ae *AllocExpression) Pos() lexer.Pos       { return ae.Parens.pos(ae.Token.Pos) }
+func (ae *AllocExpression) End() lexer.Pos {
+	if ae.Close.End.IsValid() {
+		return ae.Close.End
+	}
+	if ae.Rparen.End.IsValid() {
+		return ae.Rparen.End
+	}
+	if ae.Init != nil {
+		return ae.Init.End()
+	}
+	return ae.Type.End()
+}
 func (ae *AllocExpression) String() string {
+	if ae.Init != nil {
+		return "alloc(" + ae.Init.String() + ")"
+	}
 	return "alloc(" + ae.Type.String() + ")"
 }
 
+// StructLiteralField is a name: value pair in a struct literal
+type StructLiteralField struct {
+	Name  *Identifier
+	Value Expression
+}
+
+func (sf *StructLiteralField) TokenLiteral() string { return sf.Name.TokenLiteral() }
+func (sf *StructLiteralField) Pos() lexer.Pos       { return sf.Name.Pos() }
+func (sf *StructLiteralField) End() lexer.Pos       { return sf.Value.End() }
+func (sf *StructLiteralField) String() string {
+	return sf.Name.String() + ": " + sf.Value.String()
+}
+
+// StructLiteral: User{name: "a", age: 30}
+type StructLiteral struct {
+	Token  lexer.Token
+	Name   *Identifier
+	Fields []*StructLiteralField
+	Rbrace lexer.Token
+	Parens
+}
+
+func (sl *StructLiteral) expressionNode()      {}
+func (sl *StructLiteral) TokenLiteral() string { return sl.Token.Literal }
+func (sl *StructLiteral) Pos() lexer.Pos       { return sl.Parens.pos(sl.Token.Pos) }
+func (sl *StructLiteral) End() lexer.Pos {
+	if sl.Close.End.IsValid() {
+		return sl.Close.End
+	}
+	if sl.Rbrace.End.IsValid() {
+		return sl.Rbrace.End
+	}
+	return sl.Name.End()
+}
+func (sl *StructLiteral) String() string {
+	var out bytes.Buffer
+	out.WriteString(sl.Name.String())
+	out.WriteString("{")
+	fields := []string{}
+	for _, f := range sl.Fields {
+		fields = append(fields, f.String())
+	}
+	out.WriteString(strings.Join(fields, ", "))
+	out.WriteString("}")
+	return out.String()
+}
+
 // FreeStatement: free(ptr);
 type FreeStatement struct {
-	Token lexer.Token
-	Value Expression
+	Token  lexer.Token
+	Value  Expression
+	Rparen lexer.Token
 }
 
 func (fs *FreeStatement) statementNode()       {}
 func (fs *FreeStatement) TokenLiteral() string { return fs.Token.Literal }
+func (fs *FreeStatement) Pos() lexer.Pos       { return fs.Token.Pos }
+func (fs *FreeStatement) End() lexer.Pos {
+	if fs.Rparen.End.IsValid() {
+		return fs.Rparen.End
+	}
+	return fs.Value.End()
+}
 func (fs *FreeStatement) String() string {
 	return "free(" + fs.Value.String() + ");"
 }
@@ -639,6 +1171,8 @@ type DeferStatement struct {
 
 func (ds *DeferStatement) statementNode()       {}
 func (ds *DeferStatement) TokenLiteral() string { return ds.Token.Literal }
+func (ds *DeferStatement) Pos() lexer.Pos       { return ds.Token.Pos }
+func (ds *DeferStatement) End() lexer.Pos       { return ds.Statement.End() }
 func (ds *DeferStatement) String() string {
 	return "defer " + ds.Statement.String()
 }
@@ -650,6 +1184,8 @@ type BreakStatement struct {
 
 func (bs *BreakStatement) statementNode()       {}
 func (bs *BreakStatement) TokenLiteral() string { return bs.Token.Literal }
+func (bs *BreakStatement) Pos() lexer.Pos       { return bs.Token.Pos }
+func (bs *BreakStatement) End() lexer.Pos       { return bs.Token.End }
 func (bs *BreakStatement) String() string       { return "break;" }
 
 // ContinueStatement: continue;
@@ -659,6 +1195,8 @@ type ContinueStatement struct {
 
 func (cs *ContinueStatement) statementNode()       {}
 func (cs *ContinueStatement) TokenLiteral() string { return cs.Token.Literal }
+func (cs *ContinueStatement) Pos() lexer.Pos       { return cs.Token.Pos }
+func (cs *ContinueStatement) End() lexer.Pos       { return cs.Token.End }
 func (cs *ContinueStatement) String() string       { return "continue;" }
 
 // ArrayLiteral: [1, 2, 3] or [5]int{1, 2, 3, 4, 5}
@@ -666,10 +1204,25 @@ type ArrayLiteral struct {
 	Token    lexer.Token
 	Type     *TypeAnnotation
 	Elements []Expression
+	Rbrace   lexer.Token // the closing brace, or bracket for [a, b]
+	Parens
 }
 
 func (al *ArrayLiteral) expressionNode()      {}
 func (al *ArrayLiteral) TokenLiteral() string { return al.Token.Literal }
+func (al *ArrayLiteral) Pos() lexer.Pos       { return al.Parens.pos(al.Token.Pos) }
+func (al *ArrayLiteral) End() lexer.Pos {
+	if al.Close.End.IsValid() {
+		return al.Close.End
+	}
+	switch {
+	case al.Rbrace.End.IsValid():
+		return al.Rbrace.End
+	case al.Type != nil:
+		return al.Type.End()
+	}
+	return al.Token.End
+}
 func (al *ArrayLiteral) String() string {
 	var out bytes.Buffer
 	if al.Type != nil {
@@ -691,15 +1244,32 @@ type MapPair struct {
 	Value Expression
 }
 
+func (mp *MapPair) TokenLiteral() string { return mp.Key.TokenLiteral() }
+func (mp *MapPair) Pos() lexer.Pos       { return mp.Key.Pos() }
+func (mp *MapPair) End() lexer.Pos       { return mp.Value.End() }
+func (mp *MapPair) String() string       { return mp.Key.String() + ": " + mp.Value.String() }
+
 // MapLiteral: map[string]int{"a": 1, "b": 2}
 type MapLiteral struct {
-	Token lexer.Token
-	Type  *TypeAnnotation
-	Pairs []*MapPair
+	Token  lexer.Token
+	Type   *TypeAnnotation
+	Pairs  []*MapPair
+	Rbrace lexer.Token
+	Parens
 }
 
 func (ml *MapLiteral) expressionNode()      {}
 func (ml *MapLiteral) TokenLiteral() string { return ml.Token.Literal }
+func (ml *MapLiteral) Pos() lexer.Pos       { return ml.Parens.pos(ml.Token.Pos) }
+func (ml *MapLiteral) End() lexer.Pos {
+	if ml.Close.End.IsValid() {
+		return ml.Close.End
+	}
+	if ml.Rbrace.End.IsValid() {
+		return ml.Rbrace.End
+	}
+	return ml.Type.End()
+}
 func (ml *MapLiteral) String() string {
 	var out bytes.Buffer
 	if ml.Type != nil {
@@ -708,7 +1278,7 @@ func (ml *MapLiteral) String() string {
 	out.WriteString("{")
 	pairs := []string{}
 	for _, p := range ml.Pairs {
-		pairs = append(pairs, p.Key.String()+": "+p.Value.String())
+		pairs = append(pairs, p.String())
 	}
 	out.WriteString(strings.Join(pairs, ", "))
 	out.WriteString("}")
@@ -717,13 +1287,21 @@ func (ml *MapLiteral) String() string {
 
 // DeleteStatement: delete(map, key);
 type DeleteStatement struct {
-	Token lexer.Token
-	Map   Expression
-	Key   Expression
+	Token  lexer.Token
+	Map    Expression
+	Key    Expression
+	Rparen lexer.Token
 }
 
 func (ds *DeleteStatement) statementNode()       {}
 func (ds *DeleteStatement) TokenLiteral() string { return ds.Token.Literal }
+func (ds *DeleteStatement) Pos() lexer.Pos       { return ds.Token.Pos }
+func (ds *DeleteStatement) End() lexer.Pos {
+	if ds.Rparen.End.IsValid() {
+		return ds.Rparen.End
+	}
+	return ds.Key.End()
+}
 func (ds *DeleteStatement) String() string {
 	return "delete(" + ds.Map.String() + ", " + ds.Key.String() + ");"
 }
@@ -734,10 +1312,22 @@ type MakeExpression struct {
 	Type     *TypeAnnotation
 	Length   Expression
 	Capacity Expression
+	Rparen   lexer.Token
+	Parens
 }
 
 func (me *MakeExpression) expressionNode()      {}
 func (me *MakeExpression) TokenLiteral() string { return me.Token.Literal }
+func (me *MakeExpression) Pos() lexer.Pos       { return me.Parens.pos(me.Token.Pos) }
+func (me *MakeExpression) End() lexer.Pos {
+	if me.Close.End.IsValid() {
+		return me.Close.End
+	}
+	if me.Rparen.End.IsValid() {
+		return me.Rparen.End
+	}
+	return me.Type.End()
+}
 func (me *MakeExpression) String() string {
 	var out bytes.Buffer
 	out.WriteString("make(")
@@ -753,3 +1343,13 @@ func (me *MakeExpression) String() string {
 	out.WriteString(")")
 	return out.String()
 }
+
+// ExpressionText returns the source form of an expression, without the
+// parentheses String adds around the outermost operator
+func ExpressionText(e Expression) string {
+	text := e.String()
+	if _, ok := e.(*InfixExpression); ok && strings.HasPrefix(text, "(") && strings.HasSuffix(text, ")") {
+		return text[1 : len(text)-1]
+	}
+	return text
+}
@@ -225,6 +225,21 @@ func TestMemberExpression_String(t *testing.T) {
 	}
 }
 
+func TestStructLiteral_String(t *testing.T) {
+	lit := &StructLiteral{
+		Name: &Identifier{Value: "User"},
+		Fields: []*StructLiteralField{
+			{Name: &Identifier{Value: "name"}, Value: &StringLiteral{Value: "a"}},
+			{Name: &Identifier{Value: "age"}, Value: &IntegerLiteral{Token: lexer.Token{Literal: "30"}, Value: 30}},
+		},
+	}
+
+	expected := `User{name: "a", age: 30}`
+	if lit.String() != expected {
+		t.Errorf("expected %q, got %q", expected, lit.String())
+	}
+}
+
 func TestTypeAnnotation_String(t *testing.T) {
 	// Test basic type
 	basic := &TypeAnnotation{Name: "int"}
@@ -245,4 +260,28 @@ func TestTypeAnnotation_String(t *testing.T) {
 	if result != "[]int" {
 		t.Errorf("expected '[]int', got %q", result)
 	}
+	// Test nested types
+	user := &TypeAnnotation{Name: "User"}
+	nested := &TypeAnnotation{Name: "User", ArrayLen: 12, Elem: &TypeAnnotation{Name: "User", IsPtr: true, Elem: user}}
+	if nested.String() != "[12]*User" {
+		t.Errorf("expected '[12]*User', got %q", nested.String())
+	}
+
+	fn := &TypeAnnotation{IsFunc: true, Params: []*TypeAnnotation{{Name: "int"}, slice}, ReturnType: &TypeAnnotation{Name: "bool"}}
+	if fn.String() != "function(int, []int) bool" {
+		t.Errorf("expected 'function(int, []int) bool', got %q", fn.String())
+	}
+}
+
+func TestTestStatement_String(t *testing.T) {
+	stmt := &TestStatement{
+		Token: lexer.Token{Literal: "test"},
+		Name:  "empty",
+		Body:  &BlockStatement{},
+	}
+
+	expected := "test \"empty\" {\n}"
+	if stmt.String() != expected {
+		t.Errorf("unexpected String(): %q", stmt.String())
+	}
 }
@@ -0,0 +1,60 @@
+package ast
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+)
+
+// Dump returns a node and its children as text, one node per line with
+// its position, in the terms of the JSON form: the kind, then the fields
+// that hold values as name=value, then the fields that hold nodes,
+// indented below it.
+func Dump(node Node) string {
+	var out strings.Builder
+	dumpObject(&out, encodeStruct(reflect.Indirect(reflect.ValueOf(node))), 0, "")
+	return out.String()
+}
+
+func dumpObject(out *strings.Builder, obj object, depth int, prefix string) {
+	indent := strings.Repeat("  ", depth)
+	out.WriteString(indent + prefix + obj[0].value.(string))
+	for _, m := range obj[1:] {
+		switch v := m.value.(type) {
+		case lexer.Token:
+			if m.key == "token" {
+				fmt.Fprintf(out, " %s", v.Position())
+			} else {
+				fmt.Fprintf(out, " %s=%s", m.key, v.Position())
+			}
+		case string:
+			fmt.Fprintf(out, " %s=%q", m.key, v)
+		case object, []any:
+		default:
+			fmt.Fprintf(out, " %s=%v", m.key, v)
+		}
+	}
+	out.WriteString("\n")
+
+	for _, m := range obj[1:] {
+		switch v := m.value.(type) {
+		case object:
+			dumpObject(out, v, depth+1, m.key+": ")
+		case []any:
+			if len(v) == 0 {
+				fmt.Fprintf(out, "%s  %s: []\n", indent, m.key)
+				continue
+			}
+			fmt.Fprintf(out, "%s  %s:\n", indent, m.key)
+			for _, item := range v {
+				if item, ok := item.(object); ok {
+					dumpObject(out, item, depth+2, "")
+				} else {
+					fmt.Fprintf(out, "%s    null\n", indent)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package ast
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+)
+
+// SchemaVersion is the version of the JSON form of syntax trees. It
+// changes whenever a node gains, loses or renames a field, so that tools
+// reading the JSON can tell which fields to expect.
+//
+// Every node is an object whose "kind" is the name of its Go type, such
+// as "VarStatement", followed by its fields in declaration order, named
+// in snake_case: ReturnType is "return_type". The Program object also
+// carries the "version". Tokens are objects with the type name, literal,
+// line and column, then "pos" and "end", the positions of their first
+// byte and of the byte after them (see lexer.Pos), so the tokens of a
+// node give its span. Fields holding their zero value (false, 0, "",
+// null) are left out, except that an empty list is written as [] to tell
+// it apart from a missing one, such as the fields of an opaque extern
+// struct. The parentheses around an expression are its "parens", a Parens
+// object.
+const SchemaVersion = 4
+
+// kinds maps the kind of every node and node part to its type
+var kinds = map[string]reflect.Type{}
+
+func init() {
+	for _, n := range []any{
+		&Program{}, &Comment{}, &ImportStatement{}, &CIncludeStatement{}, &LinkStatement{},
+		&Identifier{}, &IntegerLiteral{}, &FloatLiteral{}, &StringLiteral{}, &CharLiteral{},
+		&BooleanLiteral{}, &NullLiteral{}, &TypeAnnotation{}, &VarStatement{}, &ConstStatement{},
+		&InferStatement{}, &ReturnStatement{}, &ExpressionStatement{}, &BlockStatement{},
+		&Parameter{}, &FunctionStatement{}, &TestStatement{}, &StructField{}, &StructStatement{},
+		&EnumValue{}, &EnumStatement{}, &IfStatement{}, &ForStatement{}, &WhileStatement{},
+		&ForRangeStatement{}, &PrefixExpression{}, &InfixExpression{}, &PostfixExpression{},
+		&CallExpression{}, &IndexExpression{}, &MemberExpression{}, &AssignExpression{},
+		&ComptimeExpression{}, &CastExpression{}, &AllocExpression{}, &StructLiteralField{}, &StructLiteral{},
+		&FreeStatement{}, &DeferStatement{}, &BreakStatement{}, &ContinueStatement{},
+		&ArrayLiteral{}, &MapPair{}, &MapLiteral{}, &DeleteStatement{}, &MakeExpression{}, &Parens{},
+	} {
+		t := reflect.TypeOf(n).Elem()
+		kinds[t.Name()] = t
+	}
+}
+
+var tokenType = reflect.TypeOf(lexer.Token{})
+
+// MarshalJSON writes the program in the JSON form SchemaVersion describes
+func (p *Program) MarshalJSON() ([]byte, error) {
+	obj := encodeStruct(reflect.ValueOf(p).Elem())
+	obj = append(object{obj[0], {"version", SchemaVersion}}, obj[1:]...)
+	return json.Marshal(obj)
+}
+
+// UnmarshalJSON rebuilds a program from its JSON form
+func (p *Program) UnmarshalJSON(data []byte) error {
+	var header struct {
+		Kind    string `json:"kind"`
+		Version int    `json:"version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return err
+	}
+	if header.Kind != "Program" {
+		return fmt.Errorf("ast: expected a Program, got %q", header.Kind)
+	}
+	if header.Version != SchemaVersion {
+		return fmt.Errorf("ast: unsupported schema version %d, want %d", header.Version, SchemaVersion)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	delete(fields, "version")
+	program := Program{}
+	if err := decodeFields(fields, reflect.ValueOf(&program).Elem()); err != nil {
+		return fmt.Errorf("ast: %w", err)
+	}
+	*p = program
+	return nil
+}
+
+// object is a JSON object whose members keep their order
+type object []member
+
+type member struct {
+	key   string
+	value any
+}
+
+func (o object) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, m := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(m.key)
+		value, err := json.Marshal(m.value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// encodeStruct returns the JSON object of a node or node part
+func encodeStruct(v reflect.Value) object {
+	obj := object{{"kind", v.Type().Name()}}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if value, ok := encodeValue(v.Field(i)); ok {
+			obj = append(obj, member{fieldName(field.Name), value})
+		}
+	}
+	return obj
+}
+
+// encodeValue returns the JSON value of a field, or false if the field
+// holds its zero value and is left out
+func encodeValue(v reflect.Value) (any, bool) {
+	switch {
+	case v.Type() == tokenType:
+		return v.Interface(), !v.IsZero()
+	case v.Kind() == reflect.Slice:
+		if v.IsNil() {
+			return nil, false
+		}
+		list := make([]any, v.Len())
+		for i := range list {
+			list[i], _ = encodeValue(v.Index(i))
+		}
+		return list, true
+	case v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface:
+		if v.IsNil() {
+			return nil, false
+		}
+		return encodeStruct(reflect.Indirect(v.Elem())), true
+	case v.Kind() == reflect.Struct:
+		return encodeStruct(v), !v.IsZero()
+	}
+	return v.Interface(), !v.IsZero()
+}
+
+// decodeNode decodes the JSON object of a node or node part into a value
+// of type t: a pointer to a node type, or an interface such as Statement
+// that the object's kind must implement
+func decodeNode(data json.RawMessage, t reflect.Type) (reflect.Value, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return reflect.Value{}, err
+	}
+	var kind string
+	if err := json.Unmarshal(fields["kind"], &kind); err != nil {
+		return reflect.Value{}, fmt.Errorf("node without a kind: %s", data)
+	}
+	nodeType, ok := kinds[kind]
+	if !ok {
+		return reflect.Value{}, fmt.Errorf("unknown kind %q", kind)
+	}
+	ptr := reflect.New(nodeType)
+	if !ptr.Type().AssignableTo(t) {
+		want := t.Name()
+		if t.Kind() == reflect.Pointer {
+			want = t.Elem().Name()
+		}
+		return reflect.Value{}, fmt.Errorf("%s is not a %s", kind, want)
+	}
+	if err := decodeFields(fields, ptr.Elem()); err != nil {
+		return reflect.Value{}, err
+	}
+	return ptr, nil
+}
+
+// decodeFields sets the fields of a node from the members of its object
+func decodeFields(fields map[string]json.RawMessage, v reflect.Value) error {
+	known := map[string]bool{"kind": true}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := fieldName(field.Name)
+		known[name] = true
+		data, ok := fields[name]
+		if !ok {
+			continue
+		}
+		if err := decodeValue(data, v.Field(i)); err != nil {
+			return fmt.Errorf("%s.%s: %w", v.Type().Name(), name, err)
+		}
+	}
+	for name := range fields {
+		if !known[name] {
+			return fmt.Errorf("unknown field %q in %s", name, v.Type().Name())
+		}
+	}
+	return nil
+}
+
+// decodeValue decodes a JSON value into a field
+func decodeValue(data json.RawMessage, v reflect.Value) error {
+	if string(data) == "null" {
+		return nil
+	}
+	switch {
+	case v.Type() == tokenType:
+	case v.Kind() == reflect.Slice:
+		var list []json.RawMessage
+		if err := json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+		slice := reflect.MakeSlice(v.Type(), len(list), len(list))
+		for i, item := range list {
+			if err := decodeValue(item, slice.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+		return nil
+	case v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface:
+		node, err := decodeNode(data, v.Type())
+		if err != nil {
+			return err
+		}
+		v.Set(node)
+		return nil
+	case v.Kind() == reflect.Struct:
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return err
+		}
+		return decodeFields(fields, v)
+	}
+	return json.Unmarshal(data, v.Addr().Interface())
+}
+
+// fieldName spells a Go field name in snake_case: ReturnType is
+// return_type
+func fieldName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,214 @@
+package ast_test
+
+import (
+	"encoding/json"
+	goast "go/ast"
+	goparser "go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+	"github.com/Dr-H-PhD/h-lang/pkg/parser"
+)
+
+// everything uses every kind of node
+const everything = `import "lib.hl";
+cinclude "<math.h>"
+link "m"
+
+# A point
+public struct Point {
+    public x int;
+    y float;
+}
+
+extern struct FILE
+extern function printf(format *char, ...) int
+
+enum Color { Red, Green = 5 }
+
+const Limit := 10;
+public var count int = 0;
+var grid [Limit]int;
+
+comptime function square(x int) int {
+    return x * x;
+}
+
+function (p *Point) scale(k int) {
+    p.x *= k;
+}
+
+function main() int {
+    var s string = "hi";
+    c := 'c';
+    b := (true) && !false;
+    n := null;
+    f := 1.5;
+    p := alloc(Point{x: 1});
+    q := alloc(Point);
+    defer free(p);
+    free(q);
+    arr := [3]int{1, 2, 3};
+    sl := make([]int, 0, 4);
+    m := map[string]int{"a": 1};
+    delete(m, "a");
+    for i := 0; i < 3; i++ {
+        if arr[i] > 1 {
+            break;
+        } else {
+            continue;
+        }
+    }
+    for _, v := range arr {
+        count--;
+    }
+    while count < 0 {
+        count = (int)f;
+    }
+    var fn function(int) int;
+    k := comptime square(3);
+    return -len(sl);
+}
+
+test "adds" {
+    assert_eq(1 + 1, 2);
+}
+`
+
+func TestProgram_JSONRoundTrip(t *testing.T) {
+	sources := map[string]string{"everything": everything}
+	files, _ := filepath.Glob("../../examples/*.hl")
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources[file] = string(data)
+	}
+
+	for name, source := range sources {
+		p := parser.New(lexer.New(source))
+		program := p.ParseProgram()
+		if len(p.Errors()) > 0 {
+			t.Fatalf("%s: parser errors: %v", name, p.Errors())
+		}
+		program.File = name
+
+		data, err := json.Marshal(program)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var decoded ast.Program
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(program, &decoded) {
+			t.Errorf("%s: the decoded program differs\n\n%s\n\n%s", name, program, &decoded)
+		}
+	}
+}
+
+// TestProgram_JSONKinds checks that the round trip above covers every
+// type in ast.go, so a new node cannot be left out of the schema
+func TestProgram_JSONKinds(t *testing.T) {
+	data, err := json.Marshal(parser.New(lexer.New(everything)).ParseProgram())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range structTypes(t) {
+		if !strings.Contains(string(data), `"kind":"`+name+`"`) {
+			t.Errorf("the test program has no %s", name)
+		}
+	}
+}
+
+// structTypes returns the names of the struct types in ast.go
+func structTypes(t *testing.T) []string {
+	t.Helper()
+	file, err := goparser.ParseFile(token.NewFileSet(), "ast.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*goast.GenDecl)
+		if !ok {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			if ts, ok := spec.(*goast.TypeSpec); ok {
+				if _, ok := ts.Type.(*goast.StructType); ok {
+					names = append(names, ts.Name.Name)
+				}
+			}
+		}
+	}
+	return names
+}
+
+func TestProgram_MarshalJSON(t *testing.T) {
+	program := parser.New(lexer.New("x := -1;")).ParseProgram()
+	data, err := json.Marshal(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"kind":"Program","version":4,"statements":[{"kind":"InferStatement",` +
+		`"token":{"type":"IDENT","literal":"x","line":1,"column":1,"pos":1,"end":2},` +
+		`"name":{"kind":"Identifier","token":{"type":"IDENT","literal":"x","line":1,"column":1,"pos":1,"end":2},"value":"x"},` +
+		`"value":{"kind":"PrefixExpression","token":{"type":"-","literal":"-","line":1,"column":6,"pos":6,"end":7},"operator":"-",` +
+		`"right":{"kind":"IntegerLiteral","token":{"type":"INT","literal":"1","line":1,"column":7,"pos":7,"end":8},"value":1}}}]}`
+	if string(data) != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, data)
+	}
+}
+
+func TestProgram_UnmarshalJSONErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`{"kind":"Program","version":99}`, "unsupported schema version 99"},
+		{`{"kind":"Identifier","version":4}`, `expected a Program, got "Identifier"`},
+		{`{"kind":"Program","version":4,"statements":[{"kind":"Widget"}]}`, `unknown kind "Widget"`},
+		{`{"kind":"Program","version":4,"statements":[{"kind":"Identifier"}]}`, "Identifier is not a Statement"},
+		{`{"kind":"Program","version":4,"statements":[{"kind":"BreakStatement","label":"x"}]}`, `unknown field "label" in BreakStatement`},
+		{`{"kind":"Program","version":4,"statements":[{"kind":"ReturnStatement","token":{"type":"nope"}}]}`, `unknown token type "nope"`},
+	}
+	for _, tt := range tests {
+		var program ast.Program
+		err := json.Unmarshal([]byte(tt.input), &program)
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestDump(t *testing.T) {
+	program := parser.New(lexer.New(`function main() {
+    print(s[1]);
+}`)).ParseProgram()
+	expected := `Program
+  statements:
+    FunctionStatement 1:1 rparen=1:15
+      name: Identifier 1:10 value="main"
+      parameters: []
+      body: BlockStatement 1:17 rbrace=3:1
+        statements:
+          ExpressionStatement 2:5
+            expression: CallExpression 2:10 rparen=2:15
+              function: Identifier 2:5 value="print"
+              arguments:
+                IndexExpression 2:12 rbracket=2:14
+                  left: Identifier 2:11 value="s"
+                  index: IntegerLiteral 2:13 value=1
+`
+	if got := ast.Dump(program); got != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, got)
+	}
+}
@@ -0,0 +1,353 @@
+package ast
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Rewrite returns a syntax tree in which every node has been replaced by
+// f's result for it. Children are rewritten before their parents, so f
+// sees a node whose children are already rewritten, and it returns the
+// node itself to keep it, another node to replace it, or nil to remove
+// it from its list or clear the field that holds it.
+//
+// The tree passed in is never modified: a node whose children change is
+// copied, and nodes that keep all their children are shared between the
+// old tree and the new one. A replacement must fit where the node stood,
+// an Expression for an Expression and an *Identifier for an *Identifier;
+// Rewrite panics otherwise.
+func Rewrite(node Node, f func(Node) Node) Node {
+	if isNil(node) {
+		return node
+	}
+	r := &rewriter{f: f}
+	return f(r.children(node))
+}
+
+type rewriter struct {
+	f       func(Node) Node
+	changed bool
+}
+
+// children returns node, or a copy of it if any of its children changed
+func (r *rewriter) children(node Node) Node {
+	switch n := node.(type) {
+	case *Program:
+		c := *n
+		rewriteList(r, &c.Statements)
+		return r.result(n, &c)
+
+	case *ImportStatement, *CIncludeStatement, *LinkStatement, *Identifier,
+		*IntegerLiteral, *FloatLiteral, *StringLiteral, *CharLiteral,
+		*BooleanLiteral, *NullLiteral, *BreakStatement, *ContinueStatement:
+		return node
+
+	case *TypeAnnotation:
+		c := *n
+		rewriteField(r, &c.Len)
+		rewriteField(r, &c.Elem)
+		rewriteField(r, &c.KeyType)
+		rewriteField(r, &c.ValueType)
+		rewriteList(r, &c.Params)
+		rewriteField(r, &c.ReturnType)
+		return r.result(n, &c)
+
+	// Statements
+	case *VarStatement:
+		c := *n
+		rewriteField(r, &c.Name)
+		rewriteField(r, &c.Type)
+		rewriteField(r, &c.Value)
+		return r.result(n, &c)
+
+	case *ConstStatement:
+		c := *n
+		rewriteField(r, &c.Name)
+		rewriteField(r, &c.Type)
+		rewriteField(r, &c.Value)
+		return r.result(n, &c)
+
+	case *InferStatement:
+		c := *n
+		rewriteField(r, &c.Name)
+		rewriteField(r, &c.Value)
+		return r.result(n, &c)
+
+	case *ReturnStatement:
+		c := *n
+		rewriteField(r, &c.Value)
+		return r.result(n, &c)
+
+	case *ExpressionStatement:
+		c := *n
+		rewriteField(r, &c.Expression)
+		return r.result(n, &c)
+
+	case *BlockStatement:
+		c := *n
+		rewriteList(r, &c.Statements)
+		return r.result(n, &c)
+
+	case *Parameter:
+		c := *n
+		rewriteField(r, &c.Name)
+		rewriteField(r, &c.Type)
+		return r.result(n, &c)
+
+	case *FunctionStatement:
+		c := *n
+		rewriteField(r, &c.Receiver)
+		rewriteField(r, &c.Name)
+		rewriteList(r, &c.Parameters)
+		rewriteField(r, &c.ReturnType)
+		rewriteField(r, &c.Body)
+		return r.result(n, &c)
+
+	case *TestStatement:
+		c := *n
+		rewriteField(r, &c.Body)
+		return r.result(n, &c)
+
+	case *StructField:
+		c := *n
+		rewriteField(r, &c.Name)
+		rewriteField(r, &c.Type)
+		return r.result(n, &c)
+
+	case *StructStatement:
+		c := *n
+		rewriteField(r, &c.Name)
+		rewriteList(r, &c.Fields)
+		return r.result(n, &c)
+
+	case *EnumValue:
+		c := *n
+		rewriteField(r, &c.Name)
+		rewriteField(r, &c.Value)
+		return r.result(n, &c)
+
+	case *EnumStatement:
+		c := *n
+		rewriteField(r, &c.Name)
+		rewriteList(r, &c.Values)
+		return r.result(n, &c)
+
+	case *IfStatement:
+		c := *n
+		rewriteField(r, &c.Condition)
+		rewriteField(r, &c.Consequence)
+		rewriteField(r, &c.Alternative)
+		return r.result(n, &c)
+
+	case *ForStatement:
+		c := *n
+		rewriteField(r, &c.Init)
+		rewriteField(r, &c.Condition)
+		rewriteField(r, &c.Post)
+		rewriteField(r, &c.Body)
+		return r.result(n, &c)
+
+	case *WhileStatement:
+		c := *n
+		rewriteField(r, &c.Condition)
+		rewriteField(r, &c.Body)
+		return r.result(n, &c)
+
+	case *ForRangeStatement:
+		c := *n
+		rewriteField(r, &c.Index)
+		rewriteField(r, &c.Value)
+		rewriteField(r, &c.Iterable)
+		rewriteField(r, &c.Body)
+		return r.result(n, &c)
+
+	case *FreeStatement:
+		c := *n
+		rewriteField(r, &c.Value)
+		return r.result(n, &c)
+
+	case *DeferStatement:
+		c := *n
+		rewriteField(r, &c.Statement)
+		return r.result(n, &c)
+
+	case *DeleteStatement:
+		c := *n
+		rewriteField(r, &c.Map)
+		rewriteField(r, &c.Key)
+		return r.result(n, &c)
+
+	// Expressions
+	case *PrefixExpression:
+		c := *n
+		rewriteField(r, &c.Right)
+		return r.result(n, &c)
+
+	case *ComptimeExpression:
+		c := *n
+		rewriteField(r, &c.Value)
+		return r.result(n, &c)
+
+	case *InfixExpression:
+		c := *n
+		rewriteField(r, &c.Left)
+		rewriteField(r, &c.Right)
+		return r.result(n, &c)
+
+	case *PostfixExpression:
+		c := *n
+		rewriteField(r, &c.Left)
+		return r.result(n, &c)
+
+	case *CallExpression:
+		c := *n
+		rewriteField(r, &c.Function)
+		rewriteList(r, &c.Arguments)
+		return r.result(n, &c)
+
+	case *IndexExpression:
+		c := *n
+		rewriteField(r, &c.Left)
+		rewriteField(r, &c.Index)
+		return r.result(n, &c)
+
+	case *MemberExpression:
+		c := *n
+		rewriteField(r, &c.Object)
+		rewriteField(r, &c.Member)
+		return r.result(n, &c)
+
+	case *AssignExpression:
+		c := *n
+		rewriteField(r, &c.Left)
+		rewriteField(r, &c.Value)
+		return r.result(n, &c)
+
+	case *CastExpression:
+		c := *n
+		rewriteField(r, &c.TargetType)
+		rewriteField(r, &c.Value)
+		return r.result(n, &c)
+
+	case *AllocExpression:
+		c := *n
+		rewriteField(r, &c.Type)
+		rewriteField(r, &c.Init)
+		return r.result(n, &c)
+
+	case *StructLiteralField:
+		c := *n
+		rewriteField(r, &c.Name)
+		rewriteField(r, &c.Value)
+		return r.result(n, &c)
+
+	case *StructLiteral:
+		c := *n
+		rewriteField(r, &c.Name)
+		rewriteList(r, &c.Fields)
+		return r.result(n, &c)
+
+	case *ArrayLiteral:
+		c := *n
+		rewriteField(r, &c.Type)
+		rewriteList(r, &c.Elements)
+		return r.result(n, &c)
+
+	case *MapPair:
+		c := *n
+		rewriteField(r, &c.Key)
+		rewriteField(r, &c.Value)
+		return r.result(n, &c)
+
+	case *MapLiteral:
+		c := *n
+		rewriteField(r, &c.Type)
+		rewriteList(r, &c.Pairs)
+		return r.result(n, &c)
+
+	case *MakeExpression:
+		c := *n
+		rewriteField(r, &c.Type)
+		rewriteField(r, &c.Length)
+		rewriteField(r, &c.Capacity)
+		return r.result(n, &c)
+	}
+	panic(fmt.Sprintf("ast.Rewrite: unexpected node type %T", node))
+}
+
+// result returns the copy of a node if a child changed, and the node
+// otherwise, resetting the change for the node's parent
+func (r *rewriter) result(node, copied Node) Node {
+	if !r.changed {
+		return node
+	}
+	r.changed = false
+	return copied
+}
+
+// rewrite rewrites one child, recording whether it changed
+func rewrite[N Node](r *rewriter, node N) (N, bool) {
+	var zero N
+	changed := r.changed
+	r.changed = false
+	result := r.f(r.children(node))
+	r.changed = changed
+	if result == Node(node) {
+		return node, false
+	}
+	r.changed = true
+	if isNil(result) {
+		return zero, true
+	}
+	replacement, ok := result.(N)
+	if !ok {
+		panic(fmt.Sprintf("ast.Rewrite: cannot replace %T with %T", node, result))
+	}
+	return replacement, true
+}
+
+func rewriteField[N Node](r *rewriter, field *N) {
+	if isNil(*field) {
+		return
+	}
+	if node, changed := rewrite(r, *field); changed {
+		*field = node
+	}
+}
+
+// rewriteList rewrites the nodes of a list, which is copied if any of
+// them changes. A list whose nodes are all removed stays non-nil.
+func rewriteList[N Node](r *rewriter, list *[]N) {
+	var out []N
+	for i, item := range *list {
+		node, changed := item, false
+		if !isNil(item) {
+			node, changed = rewrite(r, item)
+		}
+		if !changed {
+			if out != nil {
+				out = append(out, node)
+			}
+			continue
+		}
+		if out == nil {
+			out = make([]N, i, len(*list))
+			copy(out, (*list)[:i])
+		}
+		if !isNil(node) {
+			out = append(out, node)
+		}
+	}
+	if out != nil {
+		*list = out
+	}
+}
+
+// isNil reports whether a node is nil or a nil pointer
+func isNil(node Node) bool {
+	if node == nil {
+		return true
+	}
+	v := reflect.ValueOf(node)
+	return v.Kind() == reflect.Pointer && v.IsNil()
+}
@@ -0,0 +1,137 @@
+package ast_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+	"github.com/Dr-H-PhD/h-lang/pkg/parser"
+)
+
+// TestNode_Spans checks that every node of the test programs has a span
+// and that it lies within the span of the node above it
+func TestNode_Spans(t *testing.T) {
+	sources := map[string]string{"everything": everything}
+	files, _ := filepath.Glob("../../examples/*.hl")
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources[file] = string(data)
+	}
+
+	for name, source := range sources {
+		l := lexer.New(source)
+		p := parser.New(l)
+		program := p.ParseProgram()
+		if len(p.Errors()) > 0 {
+			t.Fatalf("%s: parser errors: %v", name, p.Errors())
+		}
+		file := l.File()
+
+		var parents []ast.Node
+		ast.Inspect(program, func(n ast.Node) bool {
+			if n == nil {
+				parents = parents[:len(parents)-1]
+				return true
+			}
+			if !n.Pos().IsValid() || n.End() < n.Pos() {
+				t.Errorf("%s: %s %q has the span %d-%d", name, kind(n), n, n.Pos(), n.End())
+			} else if len(parents) > 0 {
+				parent := parents[len(parents)-1]
+				if n.Pos() < parent.Pos() || n.End() > parent.End() {
+					t.Errorf("%s: %s at %s lies outside its %s at %s", name,
+						kind(n), file.Position(n.Pos()), kind(parent), file.Position(parent.Pos()))
+				}
+			}
+			parents = append(parents, n)
+			return true
+		})
+	}
+}
+
+func TestNode_SpanText(t *testing.T) {
+	tests := []struct {
+		source   string
+		kind     string
+		expected string
+	}{
+		{`import "lib.hl";`, "ImportStatement", `import "lib.hl"`},
+		{`cinclude "<math.h>"`, "CIncludeStatement", `cinclude "<math.h>"`},
+		{`link "m"`, "LinkStatement", `link "m"`},
+		{"public var x int = 1 + 2;", "VarStatement", "public var x int = 1 + 2"},
+		{"const x := 1;", "ConstStatement", "const x := 1"},
+		{"# doc\npublic function f(a int) int {\n    return a;\n}", "FunctionStatement", "public function f(a int) int {\n    return a;\n}"},
+		{"public extern function puts(s *char, ...) int;", "FunctionStatement", "public extern function puts(s *char, ...) int"},
+		{"extern function exit(code int)\n", "FunctionStatement", "extern function exit(code int)"},
+		{"function f(a int) {}", "Parameter", "a int"},
+		{"var f function(int, string);", "TypeAnnotation", "function(int, string)"},
+		{"var m map[string][]*int;", "TypeAnnotation", "map[string][]*int"},
+		{"struct P {\n    public x int;\n}", "StructField", "public x int"},
+		{"extern struct FILE;", "StructStatement", "extern struct FILE;"},
+		{"public enum C { A, B = 2 }", "EnumStatement", "public enum C { A, B = 2 }"},
+		{"enum C { A, B = 2 }", "EnumValue", "A"},
+		{"x := f(a, g(b));", "CallExpression", "f(a, g(b))"},
+		{"x := len(s) + 1;", "InfixExpression", "len(s) + 1"},
+		{"x := a.b[i + 1];", "IndexExpression", "a.b[i + 1]"},
+		{"x := -a.b;", "PrefixExpression", "-a.b"},
+		{"i++;", "PostfixExpression", "i++"},
+		{"x += 2;", "AssignExpression", "x += 2"},
+		{"x := (int)y;", "CastExpression", "(int)y"},
+		{"p := alloc(P{x: 1});", "AllocExpression", "alloc(P{x: 1})"},
+		{"p := P{x: 1, y: f(2)};", "StructLiteral", "P{x: 1, y: f(2)}"},
+		{"p := P{x: 1};", "StructLiteralField", "x: 1"},
+		{"a := [2]int{1, 2};", "ArrayLiteral", "[2]int{1, 2}"},
+		{"a := [x, y];", "ArrayLiteral", "[x, y]"},
+		{`m := map[string]int{"a": 1};`, "MapLiteral", `map[string]int{"a": 1}`},
+		{`m := map[string]int{"a": 1};`, "MapPair", `"a": 1`},
+		{"s := make([]int, 0, 4);", "MakeExpression", "make([]int, 0, 4)"},
+		{"free(p);", "FreeStatement", "free(p)"},
+		{"delete(m, k);", "DeleteStatement", "delete(m, k)"},
+		{"defer free(p);", "DeferStatement", "defer free(p)"},
+		{"return;", "ReturnStatement", "return"},
+		{"if a { b(); } else { c(); }", "IfStatement", "if a { b(); } else { c(); }"},
+		{"for _, v := range a { f(v); }", "ForRangeStatement", "for _, v := range a { f(v); }"},
+		{`test "t" { assert(true); }`, "TestStatement", `test "t" { assert(true); }`},
+		{`s := "a\"b";`, "StringLiteral", `"a\"b"`},
+		{"c := '\\n';", "CharLiteral", `'\n'`},
+		{"x := (a + b) * 2;", "InfixExpression", "(a + b) * 2"},
+		{"x := 2 * (a + b);", "InfixExpression", "2 * (a + b)"},
+		{"x := ((a)) - (b);", "InfixExpression", "((a)) - (b)"},
+		{"y = (y);", "ExpressionStatement", "y = (y)"},
+		{"y = (y);", "AssignExpression", "y = (y)"},
+		{"x := (f)(1);", "CallExpression", "(f)(1)"},
+		{"x := (p).x;", "MemberExpression", "(p).x"},
+		{"x := -(a);", "PrefixExpression", "-(a)"},
+		{"x := (int)(y);", "CastExpression", "(int)(y)"},
+		{"return (a + b);", "ReturnStatement", "return (a + b)"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.source)
+		p := parser.New(l)
+		program := p.ParseProgram()
+		if len(p.Errors()) > 0 {
+			t.Fatalf("%q: parser errors: %v", tt.source, p.Errors())
+		}
+
+		var found ast.Node
+		ast.Inspect(program, func(n ast.Node) bool {
+			if found == nil && n != nil && kind(n) == tt.kind {
+				found = n
+			}
+			return found == nil
+		})
+		if found == nil {
+			t.Errorf("%q: no %s", tt.source, tt.kind)
+			continue
+		}
+		file := l.File()
+		if got := tt.source[file.Offset(found.Pos()):file.Offset(found.End())]; got != tt.expected {
+			t.Errorf("%q: expected the %s %q, got %q", tt.source, tt.kind, tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package ast
+
+import "fmt"
+
+// A Visitor's Visit method is called for each node Walk reaches. If the
+// visitor it returns is not nil, Walk visits the node's children with it
+// and then calls its Visit method with nil.
+type Visitor interface {
+	Visit(node Node) (w Visitor)
+}
+
+// Walk traverses a syntax tree depth-first, in source order. It starts
+// with v.Visit(node) and, unless that returns nil, walks each child of
+// node with the visitor returned. Every node is reached, including type
+// annotations, parameters, struct and enum fields, struct literal fields
+// and map pairs. Comments are not part of the tree.
+func Walk(v Visitor, node Node) {
+	if v = v.Visit(node); v == nil {
+		return
+	}
+
+	switch n := node.(type) {
+	case *Program:
+		walkList(v, n.Statements)
+
+	case *ImportStatement, *CIncludeStatement, *LinkStatement, *Identifier,
+		*IntegerLiteral, *FloatLiteral, *StringLiteral, *CharLiteral,
+		*BooleanLiteral, *NullLiteral, *BreakStatement, *ContinueStatement:
+		// no children
+
+	case *TypeAnnotation:
+		if n.Len != nil {
+			Walk(v, n.Len)
+		}
+		if n.Elem != nil {
+			Walk(v, n.Elem)
+		}
+		if n.KeyType != nil {
+			Walk(v, n.KeyType)
+		}
+		if n.ValueType != nil {
+			Walk(v, n.ValueType)
+		}
+		walkList(v, n.Params)
+		if n.ReturnType != nil {
+			Walk(v, n.ReturnType)
+		}
+
+	// Statements
+	case *VarStatement:
+		if n.Name != nil {
+			Walk(v, n.Name)
+		}
+		if n.Type != nil {
+			Walk(v, n.Type)
+		}
+		if n.Value != nil {
+			Walk(v, n.Value)
+		}
+
+	case *ConstStatement:
+		if n.Name != nil {
+			Walk(v, n.Name)
+		}
+		if n.Type != nil {
+			Walk(v, n.Type)
+		}
+		if n.Value != nil {
+			Walk(v, n.Value)
+		}
+
+	case *InferStatement:
+		if n.Name != nil {
+			Walk(v, n.Name)
+		}
+		if n.Value != nil {
+			Walk(v, n.Value)
+		}
+
+	case *ReturnStatement:
+		if n.Value != nil {
+			Walk(v, n.Value)
+		}
+
+	case *ExpressionStatement:
+		if n.Expression != nil {
+			Walk(v, n.Expression)
+		}
+
+	case *BlockStatement:
+		walkList(v, n.Statements)
+
+	case *Parameter:
+		if n.Name != nil {
+			Walk(v, n.Name)
+		}
+		if n.Type != nil {
+			Walk(v, n.Type)
+		}
+
+	case *FunctionStatement:
+		if n.Receiver != nil {
+			Walk(v, n.Receiver)
+		}
+		if n.Name != nil {
+			Walk(v, n.Name)
+		}
+		walkList(v, n.Parameters)
+		if n.ReturnType != nil {
+			Walk(v, n.ReturnType)
+		}
+		if n.Body != nil {
+			Walk(v, n.Body)
+		}
+
+	case *TestStatement:
+		if n.Body != nil {
+			Walk(v, n.Body)
+		}
+
+	case *StructField:
+		if n.Name != nil {
+			Walk(v, n.Name)
+		}
+		if n.Type != nil {
+			Walk(v, n.Type)
+		}
+
+	case *StructStatement:
+		if n.Name != nil {
+			Walk(v, n.Name)
+		}
+		walkList(v, n.Fields)
+
+	case *EnumValue:
+		if n.Name != nil {
+			Walk(v, n.Name)
+		}
+		if n.Value != nil {
+			Walk(v, n.Value)
+		}
+
+	case *EnumStatement:
+		if n.Name != nil {
+			Walk(v, n.Name)
+		}
+		walkList(v, n.Values)
+
+	case *IfStatement:
+		if n.Condition != nil {
+			Walk(v, n.Condition)
+		}
+		if n.Consequence != nil {
+			Walk(v, n.Consequence)
+		}
+		if n.Alternative != nil {
+			Walk(v, n.Alternative)
+		}
+
+	case *ForStatement:
+		if n.Init != nil {
+			Walk(v, n.Init)
+		}
+		if n.Condition != nil {
+			Walk(v, n.Condition)
+		}
+		if n.Post != nil {
+			Walk(v, n.Post)
+		}
+		if n.Body != nil {
+			Walk(v, n.Body)
+		}
+
+	case *WhileStatement:
+		if n.Condition != nil {
+			Walk(v, n.Condition)
+		}
+		if n.Body != nil {
+			Walk(v, n.Body)
+		}
+
+	case *ForRangeStatement:
+		if n.Index != nil {
+			Walk(v, n.Index)
+		}
+		if n.Value != nil {
+			Walk(v, n.Value)
+		}
+		if n.Iterable != nil {
+			Walk(v, n.Iterable)
+		}
+		if n.Body != nil {
+			Walk(v, n.Body)
+		}
+
+	case *FreeStatement:
+		if n.Value != nil {
+			Walk(v, n.Value)
+		}
+
+	case *DeferStatement:
+		if n.Statement != nil {
+			Walk(v, n.Statement)
+		}
+
+	case *DeleteStatement:
+		if n.Map != nil {
+			Walk(v, n.Map)
+		}
+		if n.Key != nil {
+			Walk(v, n.Key)
+		}
+
+	// Expressions
+	case *PrefixExpression:
+		if n.Right != nil {
+			Walk(v, n.Right)
+		}
+
+	case *ComptimeExpression:
+		if n.Value != nil {
+			Walk(v, n.Value)
+		}
+
+	case *InfixExpression:
+		if n.Left != nil {
+			Walk(v, n.Left)
+		}
+		if n.Right != nil {
+			Walk(v, n.Right)
+		}
+
+	case *PostfixExpression:
+		if n.Left != nil {
+			Walk(v, n.Left)
+		}
+
+	case *CallExpression:
+		if n.Function != nil {
+			Walk(v, n.Function)
+		}
+		walkList(v, n.Arguments)
+
+	case *IndexExpression:
+		if n.Left != nil {
+			Walk(v, n.Left)
+		}
+		if n.Index != nil {
+			Walk(v, n.Index)
+		}
+
+	case *MemberExpression:
+		if n.Object != nil {
+			Walk(v, n.Object)
+		}
+		if n.Member != nil {
+			Walk(v, n.Member)
+		}
+
+	case *AssignExpression:
+		if n.Left != nil {
+			Walk(v, n.Left)
+		}
+		if n.Value != nil {
+			Walk(v, n.Value)
+		}
+
+	case *CastExpression:
+		if n.TargetType != nil {
+			Walk(v, n.TargetType)
+		}
+		if n.Value != nil {
+			Walk(v, n.Value)
+		}
+
+	case *AllocExpression:
+		if n.Type != nil {
+			Walk(v, n.Type)
+		}
+		if n.Init != nil {
+			Walk(v, n.Init)
+		}
+
+	case *StructLiteralField:
+		if n.Name != nil {
+			Walk(v, n.Name)
+		}
+		if n.Value != nil {
+			Walk(v, n.Value)
+		}
+
+	case *StructLiteral:
+		if n.Name != nil {
+			Walk(v, n.Name)
+		}
+		walkList(v, n.Fields)
+
+	case *ArrayLiteral:
+		if n.Type != nil {
+			Walk(v, n.Type)
+		}
+		walkList(v, n.Elements)
+
+	case *MapPair:
+		if n.Key != nil {
+			Walk(v, n.Key)
+		}
+		if n.Value != nil {
+			Walk(v, n.Value)
+		}
+
+	case *MapLiteral:
+		if n.Type != nil {
+			Walk(v, n.Type)
+		}
+		walkList(v, n.Pairs)
+
+	case *MakeExpression:
+		if n.Type != nil {
+			Walk(v, n.Type)
+		}
+		if n.Length != nil {
+			Walk(v, n.Length)
+		}
+		if n.Capacity != nil {
+			Walk(v, n.Capacity)
+		}
+
+	default:
+		panic(fmt.Sprintf("ast.Walk: unexpected node type %T", n))
+	}
+
+	v.Visit(nil)
+}
+
+func walkList[N Node](v Visitor, list []N) {
+	for _, node := range list {
+		if !isNil(node) {
+			Walk(v, node)
+		}
+	}
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses a syntax tree depth-first, in source order: it calls
+// f(node) and, if that returns true, inspects each child of node, then
+// calls f(nil).
+func Inspect(node Node, f func(Node) bool) {
+	Walk(inspector(f), node)
+}
@@ -0,0 +1,212 @@
+package ast_test
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+	"github.com/Dr-H-PhD/h-lang/pkg/parser"
+)
+
+func parse(t *testing.T, source string) *ast.Program {
+	t.Helper()
+	p := parser.New(lexer.New(source))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	return program
+}
+
+func kind(node ast.Node) string {
+	return reflect.TypeOf(node).Elem().Name()
+}
+
+// TestInspect_Kinds checks that Inspect reaches every kind of node
+func TestInspect_Kinds(t *testing.T) {
+	seen := map[string]bool{}
+	ast.Inspect(parse(t, everything), func(n ast.Node) bool {
+		if n != nil {
+			seen[kind(n)] = true
+		}
+		return true
+	})
+	for _, name := range structTypes(t) {
+		if !seen[name] && name != "Comment" && name != "Parens" {
+			t.Errorf("Inspect did not reach a %s", name)
+		}
+	}
+}
+
+type recorder struct {
+	out   *[]string
+	depth int
+}
+
+func (r recorder) Visit(n ast.Node) ast.Visitor {
+	if n == nil {
+		*r.out = append(*r.out, strings.Repeat(" ", r.depth-1)+"end")
+		return nil
+	}
+	*r.out = append(*r.out, strings.Repeat(" ", r.depth)+kind(n))
+	return recorder{r.out, r.depth + 1}
+}
+
+func TestWalk_Order(t *testing.T) {
+	var out []string
+	ast.Walk(recorder{out: &out}, parse(t, "var x []int = f(a.b, 1);"))
+	want := []string{
+		"Program",
+		" VarStatement",
+		"  Identifier",
+		"  end",
+		"  TypeAnnotation",
+		"   TypeAnnotation",
+		"   end",
+		"  end",
+		"  CallExpression",
+		"   Identifier",
+		"   end",
+		"   MemberExpression",
+		"    Identifier",
+		"    end",
+		"    Identifier",
+		"    end",
+		"   end",
+		"   IntegerLiteral",
+		"   end",
+		"  end",
+		" end",
+		"end",
+	}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(out, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestInspect_Prune(t *testing.T) {
+	var idents []string
+	ast.Inspect(parse(t, "function f(a int) { b := a; } c := d;"), func(n ast.Node) bool {
+		if _, ok := n.(*ast.FunctionStatement); ok {
+			return false
+		}
+		if id, ok := n.(*ast.Identifier); ok {
+			idents = append(idents, id.Value)
+		}
+		return true
+	})
+	if got := strings.Join(idents, " "); got != "c d" {
+		t.Errorf("got identifiers %q, want %q", got, "c d")
+	}
+}
+
+// TestRewrite_Copies replaces every node with a copy of itself, which
+// must give an equal tree that shares no node with the original
+func TestRewrite_Copies(t *testing.T) {
+	program := parse(t, everything)
+	original := program.String()
+	rewritten := ast.Rewrite(program, func(n ast.Node) ast.Node {
+		c := reflect.New(reflect.TypeOf(n).Elem())
+		c.Elem().Set(reflect.ValueOf(n).Elem())
+		return c.Interface().(ast.Node)
+	})
+
+	if !reflect.DeepEqual(program, rewritten) {
+		t.Fatalf("the rewritten program differs\n\n%s\n\n%s", program, rewritten)
+	}
+	if program.String() != original {
+		t.Errorf("Rewrite modified the original program")
+	}
+	nodes := map[ast.Node]bool{}
+	ast.Inspect(program, func(n ast.Node) bool {
+		nodes[n] = true
+		return true
+	})
+	ast.Inspect(rewritten, func(n ast.Node) bool {
+		if n != nil && nodes[n] {
+			t.Errorf("the rewritten program shares a %s: %s", kind(n), n)
+		}
+		return true
+	})
+}
+
+func TestRewrite_Replace(t *testing.T) {
+	program := parse(t, "function f() int { return 1; } function g() int { return x + 2; }")
+	original := program.String()
+	rewritten := ast.Rewrite(program, func(n ast.Node) ast.Node {
+		if id, ok := n.(*ast.Identifier); ok && id.Value == "x" {
+			return &ast.IntegerLiteral{Token: id.Token, Value: 40}
+		}
+		return n
+	}).(*ast.Program)
+
+	if program.String() != original {
+		t.Errorf("Rewrite modified the original program")
+	}
+	if rewritten.Statements[0] != program.Statements[0] {
+		t.Errorf("the unchanged function was copied")
+	}
+	g := rewritten.Statements[1].(*ast.FunctionStatement)
+	if g == program.Statements[1] {
+		t.Fatalf("the changed function was not copied")
+	}
+	if g.Name != program.Statements[1].(*ast.FunctionStatement).Name {
+		t.Errorf("the unchanged name of the function was copied")
+	}
+	ret := g.Body.Statements[0].(*ast.ReturnStatement)
+	if lit, ok := ret.Value.(*ast.InfixExpression).Left.(*ast.IntegerLiteral); !ok || lit.Value != 40 {
+		t.Errorf("x was not replaced: %s", ret)
+	}
+}
+
+func TestRewrite_Remove(t *testing.T) {
+	program := parse(t, `function f() { trace(1); x := 1; trace(2); }
+function g() { trace(3); }
+struct S { a int; b int; }`)
+	rewritten := ast.Rewrite(program, func(n ast.Node) ast.Node {
+		switch n := n.(type) {
+		case *ast.ExpressionStatement:
+			if call, ok := n.Expression.(*ast.CallExpression); ok && call.Function.String() == "trace" {
+				return nil
+			}
+		case *ast.StructField:
+			if n.Name.Value == "a" {
+				return nil
+			}
+		}
+		return n
+	}).(*ast.Program)
+
+	f := rewritten.Statements[0].(*ast.FunctionStatement)
+	if got := len(f.Body.Statements); got != 1 {
+		t.Errorf("f has %d statements, want 1", got)
+	}
+	g := rewritten.Statements[1].(*ast.FunctionStatement)
+	if g.Body.Statements == nil || len(g.Body.Statements) != 0 {
+		t.Errorf("g has statements %#v, want an empty list", g.Body.Statements)
+	}
+	s := rewritten.Statements[2].(*ast.StructStatement)
+	if len(s.Fields) != 1 || s.Fields[0].Name.Value != "b" {
+		t.Errorf("S has fields %v, want b", s.Fields)
+	}
+	if got := len(program.Statements[0].(*ast.FunctionStatement).Body.Statements); got != 3 {
+		t.Errorf("the original f has %d statements, want 3", got)
+	}
+}
+
+func TestRewrite_WrongType(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "cannot replace *ast.Identifier with *ast.IntegerLiteral") {
+			t.Errorf("got panic %v", r)
+		}
+	}()
+	ast.Rewrite(parse(t, "x := 1;"), func(n ast.Node) ast.Node {
+		if id, ok := n.(*ast.Identifier); ok {
+			return &ast.IntegerLiteral{Token: id.Token, Value: 1}
+		}
+		return n
+	})
+}
@@ -0,0 +1,124 @@
+// Package cache is a content-addressed store for build results that
+// persists between hlc runs, so that unchanged modules are not
+// regenerated or recompiled.
+//
+// Entries are files named by a hex key under a two-level directory
+// tree. Keys are hashes of everything that determines an entry's
+// content, so entries never need to be invalidated: a change to any
+// input simply produces a different key.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Cache is an on-disk cache directory
+type Cache struct {
+	dir string
+}
+
+// DefaultDir returns the cache directory: $HLC_CACHE if set, otherwise
+// hlc under the user cache directory ($XDG_CACHE_HOME or ~/.cache on
+// Linux). It returns "" if caching is disabled with HLC_CACHE=off.
+func DefaultDir() (string, error) {
+	if dir := os.Getenv("HLC_CACHE"); dir != "" {
+		if dir == "off" {
+			return "", nil
+		}
+		return dir, nil
+	}
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("cannot locate a cache directory (set HLC_CACHE): %v", err)
+	}
+	return filepath.Join(base, "hlc"), nil
+}
+
+// Open opens the cache in dir, creating it if needed
+func Open(dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Cache{dir: dir}, nil
+}
+
+// Dir returns the cache directory
+func (c *Cache) Dir() string {
+	return c.dir
+}
+
+// Key hashes parts into a cache key. Each part is length-prefixed, so
+// ("ab", "c") and ("a", "bc") give different keys.
+func Key(parts ...string) string {
+	h := sha256.New()
+	var n [8]byte
+	for _, p := range parts {
+		binary.LittleEndian.PutUint64(n[:], uint64(len(p)))
+		h.Write(n[:])
+		h.Write([]byte(p))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Hash returns the hex SHA-256 of data
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Path returns the file that holds, or would hold, the entry for key
+func (c *Cache) Path(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+// Has reports whether an entry exists for key
+func (c *Cache) Has(key string) bool {
+	_, err := os.Stat(c.Path(key))
+	return err == nil
+}
+
+// Get returns the entry for key
+func (c *Cache) Get(key string) ([]byte, bool) {
+	data, err := os.ReadFile(c.Path(key))
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// Put stores data under key. The entry is written to a temporary file
+// and renamed into place, so concurrent builds never see partial data.
+func (c *Cache) Put(key string, data []byte) error {
+	path := c.Path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), key+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// Clean removes every entry
+func (c *Cache) Clean() error {
+	return os.RemoveAll(c.dir)
+}
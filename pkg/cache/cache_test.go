@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPutGet(t *testing.T) {
+	c, err := Open(filepath.Join(t.TempDir(), "hlc"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	key := Key("object", "int main(void) { return 0; }")
+	if _, ok := c.Get(key); ok || c.Has(key) {
+		t.Fatal("expected a miss in an empty cache")
+	}
+
+	if err := c.Put(key, []byte("data")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, ok := c.Get(key)
+	if !ok || string(data) != "data" || !c.Has(key) {
+		t.Fatalf("expected a hit with %q, got %q (%v)", "data", data, ok)
+	}
+
+	// Overwriting an entry replaces it
+	if err := c.Put(key, []byte("new")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if data, _ := c.Get(key); string(data) != "new" {
+		t.Errorf("expected %q, got %q", "new", data)
+	}
+
+	entries, _ := os.ReadDir(filepath.Dir(c.Path(key)))
+	if len(entries) != 1 {
+		t.Errorf("expected no temporary files to be left behind, got %d entries", len(entries))
+	}
+
+	if err := c.Clean(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.Has(key) {
+		t.Error("expected Clean to remove entries")
+	}
+}
+
+func TestKey(t *testing.T) {
+	if Key("ab", "c") == Key("a", "bc") {
+		t.Error("keys must not depend only on the concatenation of their parts")
+	}
+	if Key("a", "b") != Key("a", "b") {
+		t.Error("keys must be deterministic")
+	}
+	if Hash([]byte("x")) == Hash([]byte("y")) {
+		t.Error("different data must hash differently")
+	}
+}
+
+func TestDefaultDir(t *testing.T) {
+	t.Setenv("HLC_CACHE", "/tmp/custom-cache")
+	if dir, _ := DefaultDir(); dir != "/tmp/custom-cache" {
+		t.Errorf("expected HLC_CACHE to win, got %q", dir)
+	}
+
+	t.Setenv("HLC_CACHE", "off")
+	if dir, err := DefaultDir(); dir != "" || err != nil {
+		t.Errorf("expected caching to be disabled, got %q, %v", dir, err)
+	}
+
+	t.Setenv("HLC_CACHE", "")
+	t.Setenv("XDG_CACHE_HOME", "/tmp/xdg")
+	if dir, _ := DefaultDir(); dir != filepath.Join("/tmp/xdg", "hlc") {
+		t.Errorf("expected the XDG cache directory, got %q", dir)
+	}
+}
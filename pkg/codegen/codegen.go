@@ -2,15 +2,25 @@ package codegen
 
 import (
 	"bytes"
+	_ "embed"
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
 
+	"github.com/Dr-H-PhD/h-lang/pkg/analysis"
 	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+	"github.com/Dr-H-PhD/h-lang/pkg/interp"
+	"github.com/Dr-H-PhD/h-lang/pkg/optimize"
 )
 
+// gcRuntime is the conservative mark-and-sweep collector linked in -gc mode
+//
+//go:embed runtime/gc.c
+var gcRuntime string
+
 // ImportResolver is a function that resolves an import path and returns the parsed AST
-// The basePath is the directory of the file containing the import
-type ImportResolver func(importPath, basePath string) (*ast.Program, error)
+type ImportResolver = ast.ImportResolver
 
 // Generator generates C code from H-lang AST
 type Generator struct {
@@ -18,16 +28,40 @@ type Generator struct {
 	indent            int
 	structs           map[string]*ast.StructStatement
 	functions         map[string]*ast.FunctionStatement
+	methods           map[string]*ast.FunctionStatement // "Type.method" -> method
 	enums             map[string]*ast.EnumStatement
 	variables         map[string]string // variable name -> type (e.g., "User*", "int")
+	argsVars          map[string]bool   // variables holding args(), whose length is h_argc
 	deferredStmts     []ast.Statement   // Stack of deferred statements
 	usesMap           bool              // true if the program uses maps
+	usesTestRuntime   bool              // true if the program asserts or is a test binary
+	usesArgs          bool              // true if the program calls args()
 	importedFiles     map[string]bool   // tracks already imported files
 	importResolver    ImportResolver    // function to resolve imports
 	basePath          string            // directory of current source file
 	importedStructs   []*ast.StructStatement
 	importedFunctions []*ast.FunctionStatement
 	importedEnums     []*ast.EnumStatement
+	gc                bool // allocate through the garbage collector
+	units             bool // generating one translation unit per module
+	testMode          bool // building a test binary
+	sourceName        string
+	errors            []string
+	globals           map[string]*global            // the globals of the main program and the public ones of imports
+	private           map[string]map[string]*global // import path -> the private globals of that module
+	modules           []*module                     // imported modules in dependency order, then the main program
+	optimized         []*analysis.Import            // the optimized modules, with the comptime functions that modules importing them may call
+	module            string                        // import path of the module being generated, "" for the main program
+	funcModules       map[*ast.FunctionStatement]string
+	typeModules       map[ast.Statement]string          // struct or enum -> import path of its module
+	initNames         map[*ast.FunctionStatement]string // init function -> C name
+	fromHeader        map[ast.Statement]bool            // extern declarations that cinclude'd headers declare
+	lineDirectives    bool                              // map the C back to the H source with #line
+	cFile             string                            // name of the C file being generated
+	sourceMap         *SourceMap                        // maps the C file being generated to the H source
+	mapping           int                               // index of the open mapping, or -1
+	counted           int                               // offset in the output up to which lines are counted
+	lines             int                               // lines of the C file being generated before counted
 }
 
 // New creates a new code generator
@@ -35,9 +69,18 @@ func New() *Generator {
 	return &Generator{
 		structs:       make(map[string]*ast.StructStatement),
 		functions:     make(map[string]*ast.FunctionStatement),
+		methods:       make(map[string]*ast.FunctionStatement),
 		enums:         make(map[string]*ast.EnumStatement),
 		variables:     make(map[string]string),
+		argsVars:      make(map[string]bool),
 		importedFiles: make(map[string]bool),
+		globals:       make(map[string]*global),
+		private:       make(map[string]map[string]*global),
+		funcModules:   make(map[*ast.FunctionStatement]string),
+		typeModules:   make(map[ast.Statement]string),
+		initNames:     make(map[*ast.FunctionStatement]string),
+		fromHeader:    make(map[ast.Statement]bool),
+		mapping:       -1,
 	}
 }
 
@@ -47,55 +90,75 @@ func (g *Generator) SetImportResolver(resolver ImportResolver, basePath string)
 	g.basePath = basePath
 }
 
-// Generate produces C code from the AST
-func (g *Generator) Generate(program *ast.Program) string {
-	// Process imports first
-	g.processImports(program)
+// Errors returns the semantic errors found while generating code
+func (g *Generator) Errors() []string {
+	return g.errors
+}
 
-	// First pass: collect struct, enum and function declarations
-	for _, stmt := range program.Statements {
-		switch s := stmt.(type) {
-		case *ast.StructStatement:
-			g.structs[s.Name.Value] = s
-		case *ast.FunctionStatement:
-			g.functions[s.Name.Value] = s
-		case *ast.EnumStatement:
-			g.enums[s.Name.Value] = s
-		}
+func (g *Generator) errorf(line int, format string, args ...interface{}) {
+	g.errors = append(g.errors, fmt.Sprintf("line %d: ", line)+fmt.Sprintf(format, args...))
+}
+
+// registerFunction records a function or method declaration
+func (g *Generator) registerFunction(f *ast.FunctionStatement) {
+	if f.Receiver != nil {
+		g.methods[receiverTypeName(f)+"."+f.Name.Value] = f
+		return
 	}
+	g.functions[f.Name.Value] = f
+}
 
-	// Generate header
-	g.writeLine("#define _POSIX_C_SOURCE 200809L")
-	g.writeLine("#include <stdio.h>")
-	g.writeLine("#include <stdlib.h>")
-	g.writeLine("#include <string.h>")
-	g.writeLine("#include <stdbool.h>")
-	g.writeLine("#include <stdint.h>")
-	g.writeLine("")
+// receiverTypeName returns the struct name a method is declared on
+func receiverTypeName(f *ast.FunctionStatement) string {
+	return strings.TrimPrefix(f.Receiver.Type.Name, "*")
+}
 
-	// Generate type definitions for strings
-	g.writeLine("typedef char* h_string;")
-	g.writeLine("")
+// SetGC switches between manual memory management (the default) and the
+// garbage-collected mode, in which every allocation goes through the
+// collector and free() is only a hint
+func (g *Generator) SetGC(enabled bool) {
+	g.gc = enabled
+}
 
-	// Generate string concatenation helper
-	g.writeLine("h_string h_string_concat(h_string a, h_string b) {")
-	g.indent++
-	g.writeLine("size_t len_a = strlen(a);")
-	g.writeLine("size_t len_b = strlen(b);")
-	g.writeLine("h_string result = (h_string)malloc(len_a + len_b + 1);")
-	g.writeLine("memcpy(result, a, len_a);")
-	g.writeLine("memcpy(result + len_a, b, len_b + 1);")
-	g.writeLine("return result;")
-	g.indent--
-	g.writeLine("}")
-	g.writeLine("")
+// heapAlloc returns a C expression allocating size bytes on the heap
+func (g *Generator) heapAlloc(size string) string {
+	if g.gc {
+		return fmt.Sprintf("h_gc_alloc(%s)", size)
+	}
+	return fmt.Sprintf("malloc(%s)", size)
+}
+
+// Generate produces C code from the AST
+func (g *Generator) Generate(program *ast.Program) string {
+	mainModule := g.prepare(program)
+	program = mainModule.program
+	g.sourceMap = &SourceMap{File: g.cFileName()}
+
+	g.writePreamble()
+	g.writeIncludes(g.modules...)
+
+	// Link the collector runtime in garbage-collected mode
+	if g.gc {
+		g.write(gcRuntime)
+		g.writeLine("")
+	}
+
+	g.generateStringConcat()
+	if g.usesArgs {
+		g.writeArgs()
+	}
 
-	// Check if maps are used and generate map helpers
-	g.checkForMaps(program)
+	// Generate map helpers if maps are used
 	if g.usesMap {
 		g.generateMapHelpers()
 	}
 
+	if g.usesTestRuntime {
+		g.writeTestPrototypes()
+		g.write(testRuntime)
+		g.writeLine("")
+	}
+
 	// Generate imported enum definitions first
 	for _, s := range g.importedEnums {
 		g.generateEnum(s)
@@ -109,29 +172,43 @@ func (g *Generator) Generate(program *ast.Program) string {
 	}
 
 	// Generate struct forward declarations
-	for name := range g.structs {
-		g.writeLine(fmt.Sprintf("typedef struct %s %s;", name, name))
+	declared := 0
+	for name, s := range g.structs {
+		if g.declaresStruct(s) {
+			g.writeLine(fmt.Sprintf("typedef struct %s %s;", name, name))
+			declared++
+		}
 	}
-	if len(g.structs) > 0 {
+	if declared > 0 {
 		g.writeLine("")
 	}
 
-	// Generate imported struct definitions first
-	for _, s := range g.importedStructs {
-		g.generateStruct(s)
-	}
-
-	// Generate struct definitions from main program
+	// Generate struct definitions, imported ones first, ordered so that
+	// structs embedded by value are complete before they are used
+	structs := append([]*ast.StructStatement{}, g.importedStructs...)
 	for _, stmt := range program.Statements {
 		if s, ok := stmt.(*ast.StructStatement); ok {
-			g.generateStruct(s)
+			structs = append(structs, s)
 		}
 	}
+	structs = g.orderStructs(structs)
+	for _, s := range g.definedStructs(structs) {
+		g.generateStruct(s)
+	}
+	if structs = completeStructs(structs); len(structs) > 0 {
+		g.generateStringEquality()
+		g.generateStructHelpers(structs)
+	}
 
 	// Generate imported function forward declarations
 	for _, s := range g.importedFunctions {
 		g.generateFunctionDeclaration(s)
 	}
+	for _, mod := range g.modules {
+		if mod != mainModule && mod.init != nil {
+			g.generateFunctionDeclaration(mod.init)
+		}
+	}
 
 	// Generate function forward declarations from main program
 	for _, stmt := range program.Statements {
@@ -139,14 +216,24 @@ func (g *Generator) Generate(program *ast.Program) string {
 			g.generateFunctionDeclaration(s)
 		}
 	}
-	if len(g.functions) > 0 {
+	if len(g.functions) > 0 || len(g.initNames) > 0 {
 		g.writeLine("")
 	}
 
+	// Module-level variables and constants, then the code that
+	// initialises them before main
+	g.generateGlobals()
+	g.generateInit()
+
 	// Generate imported function implementations
 	for _, s := range g.importedFunctions {
 		g.generateFunction(s)
 	}
+	for _, mod := range g.modules {
+		if mod != mainModule && mod.init != nil {
+			g.generateFunction(mod.init)
+		}
+	}
 
 	// Generate function implementations from main program
 	for _, stmt := range program.Statements {
@@ -154,10 +241,69 @@ func (g *Generator) Generate(program *ast.Program) string {
 			g.generateFunction(s)
 		}
 	}
+	g.generateTests(mainModule)
 
 	return g.output.String()
 }
 
+// prepare resolves imports, optimizes every module and records their
+// declarations before any code is written. It returns the main program's
+// module, whose program is the optimized one.
+func (g *Generator) prepare(program *ast.Program) *module {
+	g.processImports(program)
+	program = g.optimize("", program)
+	mainModule := g.collectModule("", program)
+
+	// Collect struct, enum and function declarations of the main program
+	for _, stmt := range program.Statements {
+		switch s := stmt.(type) {
+		case *ast.StructStatement:
+			g.structs[s.Name.Value] = s
+		case *ast.FunctionStatement:
+			if !isInitFunction(s) {
+				g.registerFunction(s)
+			}
+		case *ast.EnumStatement:
+			g.enums[s.Name.Value] = s
+		}
+	}
+
+	g.checkForMaps()
+	g.usesTestRuntime = g.needsTestRuntime()
+	g.usesArgs = g.needsArgs()
+	return mainModule
+}
+
+// writePreamble emits the includes and typedefs every C file starts with
+func (g *Generator) writePreamble() {
+	g.writeLine("#define _POSIX_C_SOURCE 200809L")
+	g.writeLine("#include <stdio.h>")
+	g.writeLine("#include <stdlib.h>")
+	g.writeLine("#include <string.h>")
+	g.writeLine("#include <stdbool.h>")
+	g.writeLine("#include <stdint.h>")
+	g.writeLine("")
+
+	// Generate type definitions for strings
+	g.writeLine("typedef char* h_string;")
+	g.writeLine("")
+}
+
+// generateStringConcat emits the string concatenation helper
+func (g *Generator) generateStringConcat() {
+	g.writeLine("h_string h_string_concat(h_string a, h_string b) {")
+	g.indent++
+	g.writeLine("size_t len_a = strlen(a);")
+	g.writeLine("size_t len_b = strlen(b);")
+	g.writeLine(fmt.Sprintf("h_string result = (h_string)%s;", g.heapAlloc("len_a + len_b + 1")))
+	g.writeLine("memcpy(result, a, len_a);")
+	g.writeLine("memcpy(result + len_a, b, len_b + 1);")
+	g.writeLine("return result;")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("")
+}
+
 // processImports handles import statements recursively
 func (g *Generator) processImports(program *ast.Program) {
 	for _, stmt := range program.Statements {
@@ -185,12 +331,14 @@ func (g *Generator) processImport(imp *ast.ImportStatement) {
 	// Resolve the import
 	importedProgram, err := g.importResolver(imp.Path, g.basePath)
 	if err != nil {
-		// Error handling - for now just skip
+		g.errorf(imp.Token.Line, "%v", err)
 		return
 	}
 
 	// Process imports in the imported file (recursive)
 	g.processImports(importedProgram)
+	importedProgram = g.optimize(imp.Path, importedProgram)
+	g.collectModule(imp.Path, importedProgram)
 
 	// Collect public declarations from the imported file
 	for _, stmt := range importedProgram.Statements {
@@ -201,8 +349,8 @@ func (g *Generator) processImport(imp *ast.ImportStatement) {
 				g.importedStructs = append(g.importedStructs, s)
 			}
 		case *ast.FunctionStatement:
-			if s.Public {
-				g.functions[s.Name.Value] = s
+			if s.Public && !isInitFunction(s) {
+				g.registerFunction(s)
 				g.importedFunctions = append(g.importedFunctions, s)
 			}
 		case *ast.EnumStatement:
@@ -214,6 +362,28 @@ func (g *Generator) processImport(imp *ast.ImportStatement) {
 	}
 }
 
+// optimize folds the constants of a program, evaluates its comptime code
+// and removes its dead code. The modules optimized so far include
+// everything it imports. The program returned has no comptime functions,
+// which are only run by the compiler.
+func (g *Generator) optimize(path string, program *ast.Program) *ast.Program {
+	module := &analysis.Module{Program: program, Imports: g.optimized}
+	optimized, errs := optimize.Program(module, interp.NewComptime(module))
+	for _, err := range errs {
+		g.errors = append(g.errors, err.Error())
+	}
+	g.optimized = append(g.optimized, &analysis.Import{Path: path, Program: optimized})
+
+	compiled := *optimized
+	compiled.Statements = nil
+	for _, stmt := range optimized.Statements {
+		if f, ok := stmt.(*ast.FunctionStatement); !ok || !f.Comptime {
+			compiled.Statements = append(compiled.Statements, stmt)
+		}
+	}
+	return &compiled
+}
+
 func (g *Generator) write(s string) {
 	g.output.WriteString(s)
 }
@@ -225,20 +395,168 @@ func (g *Generator) writeLine(s string) {
 }
 
 func (g *Generator) generateStruct(s *ast.StructStatement) {
+	defer g.markType(s, s.Token)()
 	g.writeLine(fmt.Sprintf("struct %s {", s.Name.Value))
 	g.indent++
 
 	for _, field := range s.Fields {
-		cType := g.typeToC(field.Type)
-		g.writeLine(fmt.Sprintf("%s %s;", cType, field.Name.Value))
+		g.writeLine(g.declare(field.Type, field.Name.Value) + ";")
 	}
 
 	g.indent--
 	g.writeLine("};")
+	g.unmark()
 	g.writeLine("")
 }
 
+// orderStructs sorts struct definitions so that every struct with a
+// by-value field of another struct type comes after that struct
+func (g *Generator) orderStructs(structs []*ast.StructStatement) []*ast.StructStatement {
+	var ordered []*ast.StructStatement
+	state := make(map[string]int) // 0 = unvisited, 1 = visiting, 2 = done
+	byName := make(map[string]*ast.StructStatement)
+	for _, s := range structs {
+		byName[s.Name.Value] = s
+	}
+
+	var visit func(s *ast.StructStatement)
+	visit = func(s *ast.StructStatement) {
+		name := s.Name.Value
+		if state[name] != 0 {
+			if state[name] == 1 {
+				g.errorf(s.Token.Line, "struct %s contains itself by value", name)
+			}
+			return
+		}
+		state[name] = 1
+		for _, f := range s.Fields {
+			if dep, ok := byName[embeddedStruct(f.Type)]; ok {
+				visit(dep)
+			}
+		}
+		state[name] = 2
+		ordered = append(ordered, s)
+	}
+
+	for _, s := range structs {
+		visit(s)
+	}
+	return ordered
+}
+
+// embeddedStruct returns the name of the type stored inline by a field of
+// type t: the type itself or the element of a fixed array. Pointers,
+// slices and maps only refer to their elements, so they return "".
+func embeddedStruct(t *ast.TypeAnnotation) string {
+	for t != nil && t.ArrayLen > 0 {
+		t = t.Element()
+	}
+	if t == nil || !t.IsNamed() {
+		return ""
+	}
+	return t.Name
+}
+
+// helperLinkage is the storage class of the generated helper functions.
+// Separately compiled programs declare them in headers, where unused
+// ones must not cause warnings.
+func (g *Generator) helperLinkage() string {
+	if g.units {
+		return "static inline"
+	}
+	return "static"
+}
+
+// generateStringEquality emits h_str_eq, which struct equality uses to
+// compare string fields by content
+func (g *Generator) generateStringEquality() {
+	g.writeLine(g.helperLinkage() + " bool h_str_eq(h_string a, h_string b) {")
+	g.indent++
+	g.writeLine("if (a == b) return true;")
+	g.writeLine("if (!a || !b) return false;")
+	g.writeLine("return strcmp(a, b) == 0;")
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("")
+}
+
+// generateStructHelpers emits the heap constructor and equality function
+// for every struct: h_new_T copies a value onto the heap for &T{...} and
+// alloc(T{...}), and h_eq_T implements == on comparable structs
+func (g *Generator) generateStructHelpers(structs []*ast.StructStatement) {
+	for _, s := range structs {
+		name := s.Name.Value
+		g.writeLine(fmt.Sprintf("%s %s* h_new_%s(%s value) {", g.helperLinkage(), name, name, name))
+		g.indent++
+		g.writeLine(fmt.Sprintf("%s* p = (%s*)%s;", name, name, g.heapAlloc(fmt.Sprintf("sizeof(%s)", name))))
+		g.writeLine("*p = value;")
+		g.writeLine("return p;")
+		g.indent--
+		g.writeLine("}")
+		g.writeLine("")
+	}
+
+	for _, s := range structs {
+		if g.incomparableField(s.Name.Value, nil) != nil {
+			continue
+		}
+		name := s.Name.Value
+		var terms []string
+		for _, f := range s.Fields {
+			terms = append(terms, g.fieldEquality(f))
+		}
+		if len(terms) == 0 {
+			terms = append(terms, "true")
+		}
+		g.writeLine(fmt.Sprintf("%s bool h_eq_%s(%s a, %s b) {", g.helperLinkage(), name, name, name))
+		g.indent++
+		g.writeLine(fmt.Sprintf("return %s;", strings.Join(terms, " && ")))
+		g.indent--
+		g.writeLine("}")
+		g.writeLine("")
+	}
+}
+
+// fieldEquality returns the C condition comparing field f of a and b
+func (g *Generator) fieldEquality(f *ast.StructField) string {
+	a := "a." + f.Name.Value
+	b := "b." + f.Name.Value
+	switch cType := g.typeToC(f.Type); {
+	case cType == "h_string":
+		return fmt.Sprintf("h_str_eq(%s, %s)", a, b)
+	case g.structs[cType] != nil:
+		return fmt.Sprintf("h_eq_%s(%s, %s)", cType, a, b)
+	}
+	return fmt.Sprintf("%s == %s", a, b)
+}
+
+// incomparableField returns the first field that prevents == on the named
+// struct, or nil if every field can be compared
+func (g *Generator) incomparableField(name string, visiting map[string]bool) *ast.StructField {
+	s, ok := g.structs[name]
+	if !ok {
+		return nil
+	}
+	if visiting == nil {
+		visiting = make(map[string]bool)
+	}
+	if visiting[name] {
+		return nil
+	}
+	visiting[name] = true
+	for _, f := range s.Fields {
+		if f.Type == nil || f.Type.IsMap || f.Type.IsFunc || f.Type.ArrayLen != 0 {
+			return f
+		}
+		if f.Type.IsNamed() && g.structs[f.Type.Name] != nil && g.incomparableField(f.Type.Name, visiting) != nil {
+			return f
+		}
+	}
+	return nil
+}
+
 func (g *Generator) generateEnum(s *ast.EnumStatement) {
+	defer g.markType(s, s.Token)()
 	g.writeLine(fmt.Sprintf("typedef enum {"))
 	g.indent++
 
@@ -260,62 +578,57 @@ func (g *Generator) generateEnum(s *ast.EnumStatement) {
 
 	g.indent--
 	g.writeLine(fmt.Sprintf("} %s;", s.Name.Value))
+	g.unmark()
 	g.writeLine("")
 }
 
-func (g *Generator) checkForMaps(program *ast.Program) {
-	for _, stmt := range program.Statements {
-		if g.statementUsesMap(stmt) {
-			g.usesMap = true
-			return
+// checkForMaps records whether any module uses maps, in which case the
+// map helpers are emitted
+func (g *Generator) checkForMaps() {
+	g.usesMap = g.anyNode(func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.TypeAnnotation:
+			return n.IsMap
+		case *ast.MapLiteral, *ast.DeleteStatement:
+			return true
 		}
-	}
-}
-
-func (g *Generator) statementUsesMap(stmt ast.Statement) bool {
-	switch s := stmt.(type) {
-	case *ast.FunctionStatement:
-		return g.blockUsesMap(s.Body)
-	case *ast.DeleteStatement:
-		return true
-	}
-	return false
+		return false
+	})
 }
 
-func (g *Generator) blockUsesMap(block *ast.BlockStatement) bool {
-	if block == nil {
-		return false
-	}
-	for _, stmt := range block.Statements {
-		switch s := stmt.(type) {
-		case *ast.InferStatement:
-			if _, ok := s.Value.(*ast.MapLiteral); ok {
-				return true
-			}
-		case *ast.VarStatement:
-			if s.Type != nil && s.Type.IsMap {
-				return true
-			}
-		case *ast.DeleteStatement:
-			return true
-		case *ast.IfStatement:
-			if g.blockUsesMap(s.Consequence) || g.blockUsesMap(s.Alternative) {
-				return true
+// anyNode reports whether match holds for a node of any module
+func (g *Generator) anyNode(match func(ast.Node) bool) bool {
+	found := false
+	for _, mod := range g.modules {
+		ast.Inspect(mod.program, func(n ast.Node) bool {
+			if found || n == nil {
+				return false
 			}
-		case *ast.ForStatement:
-			if g.blockUsesMap(s.Body) {
-				return true
-			}
-		case *ast.WhileStatement:
-			if g.blockUsesMap(s.Body) {
-				return true
-			}
-		}
+			found = match(n)
+			return !found
+		})
 	}
-	return false
+	return found
 }
 
 func (g *Generator) generateMapHelpers() {
+	g.generateMapTypes()
+	g.generateMapFunctions()
+}
+
+// mapPrototypes declares the map helpers for separately compiled modules
+var mapPrototypes = []string{
+	"unsigned int h_map_hash(const char* key);",
+	"h_map* h_map_new();",
+	"void h_map_set(h_map* m, const char* key, void* value);",
+	"void* h_map_get(h_map* m, const char* key);",
+	"void h_map_delete(h_map* m, const char* key);",
+	"int h_map_len(h_map* m);",
+	"void h_map_free(h_map* m);",
+}
+
+// generateMapTypes emits the hash map structures
+func (g *Generator) generateMapTypes() {
 	// Simple hash map implementation for string keys
 	g.writeLine("// Hash map implementation")
 	g.writeLine("#define H_MAP_SIZE 256")
@@ -335,7 +648,10 @@ func (g *Generator) generateMapHelpers() {
 	g.indent--
 	g.writeLine("} h_map;")
 	g.writeLine("")
+}
 
+// generateMapFunctions emits the hash map operations
+func (g *Generator) generateMapFunctions() {
 	// Hash function
 	g.writeLine("unsigned int h_map_hash(const char* key) {")
 	g.indent++
@@ -349,7 +665,11 @@ func (g *Generator) generateMapHelpers() {
 	// Create map
 	g.writeLine("h_map* h_map_new() {")
 	g.indent++
-	g.writeLine("h_map* m = (h_map*)calloc(1, sizeof(h_map));")
+	if g.gc {
+		g.writeLine("h_map* m = (h_map*)h_gc_alloc(sizeof(h_map));")
+	} else {
+		g.writeLine("h_map* m = (h_map*)calloc(1, sizeof(h_map));")
+	}
 	g.writeLine("return m;")
 	g.indent--
 	g.writeLine("}")
@@ -366,8 +686,12 @@ func (g *Generator) generateMapHelpers() {
 	g.writeLine("entry = entry->next;")
 	g.indent--
 	g.writeLine("}")
-	g.writeLine("h_map_entry* new_entry = (h_map_entry*)malloc(sizeof(h_map_entry));")
-	g.writeLine("new_entry->key = strdup(key);")
+	g.writeLine(fmt.Sprintf("h_map_entry* new_entry = (h_map_entry*)%s;", g.heapAlloc("sizeof(h_map_entry)")))
+	if g.gc {
+		g.writeLine("new_entry->key = h_gc_strdup(key);")
+	} else {
+		g.writeLine("new_entry->key = strdup(key);")
+	}
 	g.writeLine("new_entry->value = value;")
 	g.writeLine("new_entry->next = m->buckets[idx];")
 	g.writeLine("m->buckets[idx] = new_entry;")
@@ -404,7 +728,11 @@ func (g *Generator) generateMapHelpers() {
 	g.indent++
 	g.writeLine("if (prev) prev->next = entry->next;")
 	g.writeLine("else m->buckets[idx] = entry->next;")
-	g.writeLine("free(entry->key); free(entry); m->size--;")
+	if g.gc {
+		g.writeLine("m->size--;")
+	} else {
+		g.writeLine("free(entry->key); free(entry); m->size--;")
+	}
 	g.writeLine("return;")
 	g.indent--
 	g.writeLine("}")
@@ -419,9 +747,16 @@ func (g *Generator) generateMapHelpers() {
 	g.writeLine("int h_map_len(h_map* m) { return m->size; }")
 	g.writeLine("")
 
-	// Free map
+	// Free map (left to the collector in -gc mode)
 	g.writeLine("void h_map_free(h_map* m) {")
 	g.indent++
+	if g.gc {
+		g.writeLine("(void)m;")
+		g.indent--
+		g.writeLine("}")
+		g.writeLine("")
+		return
+	}
 	g.writeLine("for (int i = 0; i < H_MAP_SIZE; i++) {")
 	g.indent++
 	g.writeLine("h_map_entry* entry = m->buckets[i];")
@@ -441,60 +776,76 @@ func (g *Generator) generateMapHelpers() {
 }
 
 func (g *Generator) generateFunctionDeclaration(f *ast.FunctionStatement) {
-	returnType := "void"
-	if f.ReturnType != nil {
-		returnType = g.typeToC(f.ReturnType)
+	// The headers a file includes declare its C functions
+	if g.fromHeader[f] {
+		return
 	}
+	if f.ReturnType != nil && f.ReturnType.ArrayLen > 0 {
+		g.errorf(f.Token.Line, "function %s cannot return the array type %s", f.Name.Value, f.ReturnType.String())
+	}
+	g.writeLine(g.functionSignature(f) + ";")
+}
 
-	funcName := f.Name.Value
-
-	// C standard requires int main()
-	if funcName == "main" && f.ReturnType == nil {
-		returnType = "int"
+// functionSignature returns the C prototype of a function or method,
+// without the trailing semicolon or body
+func (g *Generator) functionSignature(f *ast.FunctionStatement) string {
+	if name, ok := g.initNames[f]; ok {
+		return fmt.Sprintf("static void %s(void)", name)
 	}
 
+	funcName := f.Name.Value
+
 	if f.Receiver != nil {
 		// Method: StructName_methodName
-		typeName := f.Receiver.Type.Name
-		if f.Receiver.Type.IsPtr {
-			typeName = strings.TrimPrefix(typeName, "*")
-		}
-		funcName = fmt.Sprintf("%s_%s", typeName, f.Name.Value)
+		funcName = fmt.Sprintf("%s_%s", receiverTypeName(f), f.Name.Value)
+	}
+
+	// C standard requires int main()
+	isMain := f.Receiver == nil && funcName == "main"
+	if isMain && g.replacesMain(f) {
+		funcName = testedMainName
 	}
 
 	params := g.generateParams(f)
-	g.writeLine(fmt.Sprintf("%s %s(%s);", returnType, funcName, params))
+	if f.Variadic {
+		params += ", ..."
+	}
+	if isMain && !g.replacesMain(f) && g.usesArgs && params == "void" {
+		params = "int argc, char** argv"
+	}
+	declarator := fmt.Sprintf("%s(%s)", funcName, params)
+	if isMain && f.ReturnType == nil {
+		return "int " + declarator
+	}
+	signature := g.declare(f.ReturnType, declarator)
+	if g.units && !isMain && !f.Extern && g.isPrivate(f) {
+		return "static " + signature
+	}
+	return signature
 }
 
 func (g *Generator) generateFunction(f *ast.FunctionStatement) {
-	returnType := "void"
-	if f.ReturnType != nil {
-		returnType = g.typeToC(f.ReturnType)
-	}
-
-	funcName := f.Name.Value
-	isMain := funcName == "main"
-
-	// C standard requires int main()
-	if isMain && f.ReturnType == nil {
-		returnType = "int"
+	// C functions are implemented by the libraries the program links
+	if f.Extern {
+		return
 	}
+	isMain := f.Receiver == nil && f.Name.Value == "main"
+	g.module = g.funcModules[f]
+	defer func() { g.module = "" }()
 
-	if f.Receiver != nil {
-		typeName := f.Receiver.Type.Name
-		if f.Receiver.Type.IsPtr {
-			typeName = strings.TrimPrefix(typeName, "*")
-		}
-		funcName = fmt.Sprintf("%s_%s", typeName, f.Name.Value)
+	// main may return an exit status
+	if isMain && f.ReturnType != nil && g.typeToC(f.ReturnType) != "int" {
+		g.errorf(f.Token.Line, "main must return int or nothing, not %s", f.ReturnType.String())
 	}
 
-	params := g.generateParams(f)
-	g.writeLine(fmt.Sprintf("%s %s(%s) {", returnType, funcName, params))
+	g.mark(f, f.Token)
+	g.writeLine(g.functionSignature(f) + " {")
 	g.indent++
 
 	// Clear deferred statements and variable scope for this function
 	g.deferredStmts = nil
 	g.variables = make(map[string]string)
+	g.argsVars = make(map[string]bool)
 
 	// Record receiver in symbol table
 	if f.Receiver != nil {
@@ -508,6 +859,21 @@ func (g *Generator) generateFunction(f *ast.FunctionStatement) {
 		g.variables[p.Name.Value] = cType
 	}
 
+	// The collector scans the stack from main's frame downwards
+	entry := isMain && !g.replacesMain(f)
+	if entry && g.gc {
+		g.writeLine("h_gc_init(__builtin_frame_address(0));")
+	}
+	if entry && g.usesArgs {
+		g.writeLine("h_argc = argc;")
+		g.writeLine("h_argv = argv;")
+	}
+
+	// Globals and module init functions run before the body of main
+	if entry && g.needsInit() {
+		g.writeLine("h_init();")
+	}
+
 	g.generateBlock(f.Body)
 
 	// Emit any remaining deferred statements at function end
@@ -520,6 +886,7 @@ func (g *Generator) generateFunction(f *ast.FunctionStatement) {
 
 	g.indent--
 	g.writeLine("}")
+	g.unmark()
 	g.writeLine("")
 }
 
@@ -528,13 +895,11 @@ func (g *Generator) generateParams(f *ast.FunctionStatement) string {
 
 	// Add receiver as first parameter for methods
 	if f.Receiver != nil {
-		cType := g.typeToC(f.Receiver.Type)
-		params = append(params, fmt.Sprintf("%s %s", cType, f.Receiver.Name.Value))
+		params = append(params, g.declare(f.Receiver.Type, f.Receiver.Name.Value))
 	}
 
 	for _, p := range f.Parameters {
-		cType := g.typeToC(p.Type)
-		params = append(params, fmt.Sprintf("%s %s", cType, p.Name.Value))
+		params = append(params, g.declare(p.Type, p.Name.Value))
 	}
 
 	if len(params) == 0 {
@@ -545,6 +910,7 @@ func (g *Generator) generateParams(f *ast.FunctionStatement) string {
 
 func (g *Generator) generateBlock(block *ast.BlockStatement) {
 	for _, stmt := range block.Statements {
+		g.mark(stmt, statementToken(stmt))
 		g.generateStatement(stmt)
 	}
 }
@@ -552,6 +918,7 @@ func (g *Generator) generateBlock(block *ast.BlockStatement) {
 // emitDeferredStatements emits deferred statements in reverse order (LIFO)
 func (g *Generator) emitDeferredStatements() {
 	for i := len(g.deferredStmts) - 1; i >= 0; i-- {
+		g.mark(g.deferredStmts[i], statementToken(g.deferredStmts[i]))
 		g.generateStatementDirect(g.deferredStmts[i])
 	}
 }
@@ -562,7 +929,7 @@ func (g *Generator) generateStatementDirect(stmt ast.Statement) {
 	case *ast.ExpressionStatement:
 		g.writeLine(g.generateExpression(s.Expression) + ";")
 	case *ast.FreeStatement:
-		g.writeLine(fmt.Sprintf("free(%s);", g.generateExpression(s.Value)))
+		g.generateFreeStatement(s)
 	default:
 		// For other statements, use regular generation
 		g.generateStatement(stmt)
@@ -597,7 +964,25 @@ func (g *Generator) generateStatement(stmt ast.Statement) {
 		g.writeLine("continue;")
 	case *ast.DeleteStatement:
 		g.generateDeleteStatement(s)
+	case *ast.BlockStatement:
+		g.writeLine("{")
+		g.indent++
+		g.generateBlock(s)
+		g.indent--
+		g.writeLine("}")
+	case *ast.TestStatement:
+		g.errorf(s.Token.Line, "test blocks must be declared at the top level")
 	case *ast.ExpressionStatement:
+		// m = map[K]V{...} needs statements to add the pairs
+		if assign, ok := s.Expression.(*ast.AssignExpression); ok && assign.Operator == "=" {
+			if ml, ok := assign.Value.(*ast.MapLiteral); ok {
+				target := g.generateExpression(assign.Left)
+				g.checkAssignable(assign.Left)
+				g.writeLine(fmt.Sprintf("%s = h_map_new();", target))
+				g.generateMapPairs(target, ml)
+				return
+			}
+		}
 		g.writeLine(g.generateExpression(s.Expression) + ";")
 	}
 }
@@ -608,20 +993,39 @@ func (g *Generator) generateDeferStatement(s *ast.DeferStatement) {
 }
 
 func (g *Generator) generateVarStatement(s *ast.VarStatement) {
-	cType := g.typeToC(s.Type)
 	// Record variable type in symbol table
-	g.variables[s.Name.Value] = cType
+	g.variables[s.Name.Value] = g.typeToC(s.Type)
+	g.trackArgs(s.Name.Value, s.Value)
+	decl := g.declare(s.Type, s.Name.Value)
+	switch v := s.Value.(type) {
+	case *ast.MapLiteral:
+		g.writeLine(fmt.Sprintf("%s = h_map_new();", decl))
+		g.generateMapPairs(s.Name.Value, v)
+		return
+	case *ast.ArrayLiteral:
+		// A slice literal points to a compound literal of its elements,
+		// which lives as long as the enclosing block
+		if s.Type.ArrayLen == -1 && len(v.Elements) > 0 {
+			backing := &ast.TypeAnnotation{ArrayLen: len(v.Elements), Elem: s.Type.Element()}
+			g.writeLine(fmt.Sprintf("%s = (%s)%s;", decl, g.typeToC(backing), g.generateExpression(v)))
+			return
+		}
+		if s.Type.ArrayLen == -1 {
+			g.writeLine(decl + " = NULL;")
+			return
+		}
+	}
 	if s.Value != nil {
-		g.writeLine(fmt.Sprintf("%s %s = %s;", cType, s.Name.Value, g.generateExpression(s.Value)))
+		g.writeLine(fmt.Sprintf("%s = %s;", decl, g.generateExpression(s.Value)))
 	} else {
-		g.writeLine(fmt.Sprintf("%s %s;", cType, s.Name.Value))
+		g.writeLine(decl + ";")
 	}
 }
 
 func (g *Generator) generateConstStatement(s *ast.ConstStatement) {
 	// Infer type from value
 	cType := g.inferType(s.Value)
-	g.writeLine(fmt.Sprintf("const %s %s = %s;", cType, s.Name.Value, g.generateExpression(s.Value)))
+	g.writeLine(fmt.Sprintf("const %s = %s;", declareC(cType, s.Name.Value), g.generateExpression(s.Value)))
 }
 
 func (g *Generator) generateInferStatement(s *ast.InferStatement) {
@@ -629,32 +1033,27 @@ func (g *Generator) generateInferStatement(s *ast.InferStatement) {
 	if ml, ok := s.Value.(*ast.MapLiteral); ok {
 		g.variables[s.Name.Value] = "h_map*"
 		g.writeLine(fmt.Sprintf("h_map* %s = h_map_new();", s.Name.Value))
-		// Add each pair
-		for _, pair := range ml.Pairs {
-			keyExpr := g.generateExpression(pair.Key)
-			valueExpr := g.generateExpression(pair.Value)
-			// Cast value to void* (for integers, use intptr_t cast)
-			g.writeLine(fmt.Sprintf("h_map_set(%s, %s, (void*)(intptr_t)%s);", s.Name.Value, keyExpr, valueExpr))
-		}
+		g.generateMapPairs(s.Name.Value, ml)
 		return
 	}
 
 	// Special handling for array literals
 	if arr, ok := s.Value.(*ast.ArrayLiteral); ok && arr.Type != nil {
-		elemType := g.typeToC(&ast.TypeAnnotation{Name: arr.Type.Name})
+		elem := arr.Type.Element()
+		elemType := g.typeToC(elem)
 		if arr.Type.ArrayLen > 0 {
 			// Fixed array: int arr[5] = {1, 2, 3, 4, 5};
-			g.variables[s.Name.Value] = fmt.Sprintf("%s[%d]", elemType, arr.Type.ArrayLen)
-			g.writeLine(fmt.Sprintf("%s %s[%d] = %s;", elemType, s.Name.Value, arr.Type.ArrayLen, g.generateExpression(s.Value)))
+			g.variables[s.Name.Value] = g.typeToC(arr.Type)
+			g.writeLine(fmt.Sprintf("%s = %s;", g.declare(arr.Type, s.Name.Value), g.generateExpression(s.Value)))
 		} else {
 			// Slice (dynamic array): int* arr = (int*)malloc(...);
 			numElems := len(arr.Elements)
 			if numElems > 0 {
 				g.variables[s.Name.Value] = elemType + "[]"
-				g.writeLine(fmt.Sprintf("%s %s[] = %s;", elemType, s.Name.Value, g.generateExpression(s.Value)))
+				g.writeLine(fmt.Sprintf("%s = %s;", g.declare(elem, s.Name.Value+"[]"), g.generateExpression(s.Value)))
 			} else {
-				g.variables[s.Name.Value] = elemType + "*"
-				g.writeLine(fmt.Sprintf("%s* %s = NULL;", elemType, s.Name.Value))
+				g.variables[s.Name.Value] = g.typeToC(arr.Type)
+				g.writeLine(fmt.Sprintf("%s = NULL;", g.declare(arr.Type, s.Name.Value)))
 			}
 		}
 		return
@@ -668,34 +1067,55 @@ func (g *Generator) generateInferStatement(s *ast.InferStatement) {
 			g.writeLine(fmt.Sprintf("h_map* %s = h_map_new();", s.Name.Value))
 			return
 		}
-		elemType := g.typeToC(&ast.TypeAnnotation{Name: mk.Type.Name})
-		g.variables[s.Name.Value] = elemType + "*"
-		g.writeLine(fmt.Sprintf("%s* %s = %s;", elemType, s.Name.Value, g.generateExpression(s.Value)))
+		sliceType := &ast.TypeAnnotation{ArrayLen: -1, Elem: makeElement(mk.Type)}
+		g.variables[s.Name.Value] = g.typeToC(sliceType)
+		g.writeLine(fmt.Sprintf("%s = %s;", g.declare(sliceType, s.Name.Value), g.generateExpression(s.Value)))
 		return
 	}
 
 	cType := g.inferType(s.Value)
 	// Record variable type in symbol table
 	g.variables[s.Name.Value] = cType
-	g.writeLine(fmt.Sprintf("%s %s = %s;", cType, s.Name.Value, g.generateExpression(s.Value)))
+	g.trackArgs(s.Name.Value, s.Value)
+	g.writeLine(fmt.Sprintf("%s = %s;", declareC(cType, s.Name.Value), g.generateExpression(s.Value)))
+}
+
+// generateMapPairs adds the pairs of a map literal to the map in target
+func (g *Generator) generateMapPairs(target string, ml *ast.MapLiteral) {
+	for _, pair := range ml.Pairs {
+		keyExpr := g.generateExpression(pair.Key)
+		valueExpr := g.generateExpression(pair.Value)
+		// Cast value to void* (for integers, use intptr_t cast)
+		g.writeLine(fmt.Sprintf("h_map_set(%s, %s, (void*)(intptr_t)%s);", target, keyExpr, valueExpr))
+	}
 }
 
 func (g *Generator) generateReturnStatement(s *ast.ReturnStatement) {
 	// If there's a return value, save it to a temp variable first
 	if s.Value != nil && len(g.deferredStmts) > 0 {
 		retType := g.inferType(s.Value)
-		g.writeLine(fmt.Sprintf("%s __ret_val = %s;", retType, g.generateExpression(s.Value)))
-		g.emitDeferredStatements()
+		g.writeLine(fmt.Sprintf("%s = %s;", declareC(retType, "__ret_val"), g.generateExpression(s.Value)))
+		g.emitReturnDeferred(s)
 		g.writeLine("return __ret_val;")
 	} else if s.Value != nil {
-		g.emitDeferredStatements()
+		g.emitReturnDeferred(s)
 		g.writeLine(fmt.Sprintf("return %s;", g.generateExpression(s.Value)))
 	} else {
-		g.emitDeferredStatements()
+		g.emitReturnDeferred(s)
 		g.writeLine("return;")
 	}
 }
 
+// emitReturnDeferred emits the deferred statements a return runs, then
+// attributes the return itself to its own line again
+func (g *Generator) emitReturnDeferred(s *ast.ReturnStatement) {
+	if len(g.deferredStmts) == 0 {
+		return
+	}
+	g.emitDeferredStatements()
+	g.mark(s, s.Token)
+}
+
 func (g *Generator) generateIfStatement(s *ast.IfStatement) {
 	g.writeLine(fmt.Sprintf("if (%s) {", g.generateExpression(s.Condition)))
 	g.indent++
@@ -717,6 +1137,20 @@ func (g *Generator) generateForStatement(s *ast.ForStatement) {
 		init = g.generateStatementInline(s.Init)
 	}
 
+	// A variable declared by the init is only in scope in the loop
+	if decl, ok := s.Init.(*ast.InferStatement); ok {
+		name := decl.Name.Value
+		outer, shadowed := g.variables[name]
+		g.variables[name] = g.inferType(decl.Value)
+		defer func() {
+			if shadowed {
+				g.variables[name] = outer
+			} else {
+				delete(g.variables, name)
+			}
+		}()
+	}
+
 	cond := ""
 	if s.Condition != nil {
 		cond = g.generateExpression(s.Condition)
@@ -753,8 +1187,11 @@ func (g *Generator) generateForRangeStatement(s *ast.ForRangeStatement) {
 
 	// Generate the for loop header
 	// for (int i = 0; i < (int)(sizeof(arr)/sizeof(arr[0])); i++)
-	g.writeLine(fmt.Sprintf("for (int %s = 0; %s < (int)(sizeof(%s)/sizeof(%s[0])); %s++) {",
-		indexVar, indexVar, iterableExpr, iterableExpr, indexVar))
+	length := fmt.Sprintf("(int)(sizeof(%s)/sizeof(%s[0]))", iterableExpr, iterableExpr)
+	if g.isArgs(s.Iterable) {
+		length = "h_argc"
+	}
+	g.writeLine(fmt.Sprintf("for (int %s = 0; %s < %s; %s++) {", indexVar, indexVar, length, indexVar))
 	g.indent++
 
 	// Record index in symbol table
@@ -766,7 +1203,7 @@ func (g *Generator) generateForRangeStatement(s *ast.ForRangeStatement) {
 	if s.Value != nil {
 		// Infer element type from the iterable
 		elemType := g.inferElementType(s.Iterable)
-		g.writeLine(fmt.Sprintf("%s %s = %s[%s];", elemType, s.Value.Value, iterableExpr, indexVar))
+		g.writeLine(fmt.Sprintf("%s = %s[%s];", declareC(elemType, s.Value.Value), iterableExpr, indexVar))
 		g.variables[s.Value.Value] = elemType
 	}
 
@@ -778,26 +1215,38 @@ func (g *Generator) generateForRangeStatement(s *ast.ForRangeStatement) {
 func (g *Generator) inferElementType(expr ast.Expression) string {
 	// Try to get the array type from the variables map
 	if ident, ok := expr.(*ast.Identifier); ok {
-		if varType, exists := g.variables[ident.Value]; exists {
+		if varType, exists := g.lookupVar(ident.Value); exists {
 			// Handle array types like "int[5]" or "int[]" or "int*"
-			varType = strings.TrimSuffix(varType, "*")
-			if idx := strings.Index(varType, "["); idx != -1 {
-				return varType[:idx]
-			}
-			return varType
+			return elementType(varType)
 		}
 	}
 	// Default to int
 	return "int"
 }
 
+// elementType returns the C type of container[i] given the C type of the
+// container: the first dimension of an array ("int[2][3]" -> "int[3]") or
+// the pointee of a pointer ("int*" -> "int")
+func elementType(container string) string {
+	if i := strings.Index(container, "["); i != -1 {
+		if j := strings.Index(container[i:], "]"); j != -1 {
+			return container[:i] + container[i+j+1:]
+		}
+	}
+	return strings.TrimSuffix(container, "*")
+}
+
 func (g *Generator) generateFreeStatement(s *ast.FreeStatement) {
+	// In collected mode free is only a hint; the collector reclaims memory
+	if g.gc {
+		g.writeLine(fmt.Sprintf("h_gc_free(%s);", g.generateExpression(s.Value)))
+		return
+	}
+
 	// Check if freeing a map
-	if ident, ok := s.Value.(*ast.Identifier); ok {
-		if varType, exists := g.variables[ident.Value]; exists && varType == "h_map*" {
-			g.writeLine(fmt.Sprintf("h_map_free(%s);", ident.Value))
-			return
-		}
+	if g.isMapExpr(s.Value) {
+		g.writeLine(fmt.Sprintf("h_map_free(%s);", g.generateExpression(s.Value)))
+		return
 	}
 	g.writeLine(fmt.Sprintf("free(%s);", g.generateExpression(s.Value)))
 }
@@ -812,21 +1261,41 @@ func (g *Generator) generateStatementInline(stmt ast.Statement) string {
 	switch s := stmt.(type) {
 	case *ast.InferStatement:
 		cType := g.inferType(s.Value)
-		return fmt.Sprintf("%s %s = %s", cType, s.Name.Value, g.generateExpression(s.Value))
+		return fmt.Sprintf("%s = %s", declareC(cType, s.Name.Value), g.generateExpression(s.Value))
 	case *ast.ExpressionStatement:
 		return g.generateExpression(s.Expression)
 	}
 	return ""
 }
 
+// formatFloat spells a float literal in C: with six decimals, as printf
+// does, when they are exact, and with as many digits as it needs otherwise
+func formatFloat(f float64) string {
+	s := fmt.Sprintf("%f", f)
+	if v, err := strconv.ParseFloat(s, 64); err == nil && v == f {
+		return s
+	}
+	s = strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eE") {
+		s += ".0"
+	}
+	return s
+}
+
 func (g *Generator) generateExpression(expr ast.Expression) string {
 	switch e := expr.(type) {
 	case *ast.Identifier:
+		if gl := g.globalFor(e.Value); gl != nil {
+			if !gl.public && gl.module != g.module {
+				g.errorf(e.Token.Line, "%s is not public in %s", e.Value, gl.module)
+			}
+			return gl.cName
+		}
 		return e.Value
 	case *ast.IntegerLiteral:
 		return fmt.Sprintf("%d", e.Value)
 	case *ast.FloatLiteral:
-		return fmt.Sprintf("%f", e.Value)
+		return formatFloat(e.Value)
 	case *ast.StringLiteral:
 		return fmt.Sprintf("\"%s\"", e.Value)
 	case *ast.CharLiteral:
@@ -839,6 +1308,10 @@ func (g *Generator) generateExpression(expr ast.Expression) string {
 	case *ast.NullLiteral:
 		return "NULL"
 	case *ast.PrefixExpression:
+		// &T{...} copies the literal onto the heap
+		if lit, ok := e.Right.(*ast.StructLiteral); ok && e.Operator == "&" {
+			return fmt.Sprintf("h_new_%s(%s)", lit.Name.Value, g.generateExpression(lit))
+		}
 		return fmt.Sprintf("(%s%s)", e.Operator, g.generateExpression(e.Right))
 	case *ast.InfixExpression:
 		left := g.generateExpression(e.Left)
@@ -849,30 +1322,40 @@ func (g *Generator) generateExpression(expr ast.Expression) string {
 				return fmt.Sprintf("h_string_concat(%s, %s)", left, right)
 			}
 		}
+		// Struct values compare field by field
+		if e.Operator == "==" || e.Operator == "!=" {
+			cType := g.inferType(e.Left)
+			if g.isStructValue(cType) {
+				return g.generateStructEquality(e, cType, left, right)
+			}
+			// C would compare the arrays' addresses
+			if strings.Contains(cType, "[") {
+				g.errorf(e.Token.Line, "cannot compare arrays")
+			}
+		}
 		return fmt.Sprintf("(%s %s %s)", left, e.Operator, right)
 	case *ast.PostfixExpression:
+		g.checkAssignable(e.Left)
 		return fmt.Sprintf("(%s%s)", g.generateExpression(e.Left), e.Operator)
 	case *ast.AssignExpression:
+		g.checkAssignable(e.Left)
 		// Check if left side is a map index expression
-		if idx, ok := e.Left.(*ast.IndexExpression); ok {
-			if ident, ok := idx.Left.(*ast.Identifier); ok {
-				if varType, exists := g.variables[ident.Value]; exists && varType == "h_map*" {
-					// Map assignment: h_map_set(map, key, (void*)(intptr_t)value)
-					return fmt.Sprintf("h_map_set(%s, %s, (void*)(intptr_t)%s)",
-						ident.Value, g.generateExpression(idx.Index), g.generateExpression(e.Value))
-				}
-			}
+		if idx, ok := e.Left.(*ast.IndexExpression); ok && g.isMapExpr(idx.Left) {
+			// Map assignment: h_map_set(map, key, (void*)(intptr_t)value)
+			return fmt.Sprintf("h_map_set(%s, %s, (void*)(intptr_t)%s)",
+				g.generateExpression(idx.Left), g.generateExpression(idx.Index), g.generateExpression(e.Value))
+		}
+		if id, ok := e.Left.(*ast.Identifier); ok && e.Operator == "=" {
+			g.trackArgs(id.Value, e.Value)
 		}
 		return fmt.Sprintf("(%s %s %s)", g.generateExpression(e.Left), e.Operator, g.generateExpression(e.Value))
 	case *ast.CallExpression:
 		return g.generateCallExpression(e)
 	case *ast.IndexExpression:
 		// Check if left side is a map
-		if ident, ok := e.Left.(*ast.Identifier); ok {
-			if varType, exists := g.variables[ident.Value]; exists && varType == "h_map*" {
-				// Map access: cast from void* to int
-				return fmt.Sprintf("(int)(intptr_t)h_map_get(%s, %s)", ident.Value, g.generateExpression(e.Index))
-			}
+		if g.isMapExpr(e.Left) {
+			// Map access: cast from void* to int
+			return fmt.Sprintf("(int)(intptr_t)h_map_get(%s, %s)", g.generateExpression(e.Left), g.generateExpression(e.Index))
 		}
 		return fmt.Sprintf("%s[%s]", g.generateExpression(e.Left), g.generateExpression(e.Index))
 	case *ast.MemberExpression:
@@ -885,7 +1368,16 @@ func (g *Generator) generateExpression(expr ast.Expression) string {
 	case *ast.CastExpression:
 		return fmt.Sprintf("((%s)%s)", g.typeToC(e.TargetType), g.generateExpression(e.Value))
 	case *ast.AllocExpression:
-		return fmt.Sprintf("(%s*)malloc(sizeof(%s))", e.Type.Name, e.Type.Name)
+		if e.Init != nil {
+			return fmt.Sprintf("h_new_%s(%s)", e.Init.Name.Value, g.generateExpression(e.Init))
+		}
+		if g.isOpaque(g.typeToC(e.Type)) {
+			g.errorf(e.Token.Line, "cannot allocate %s: its C fields are not declared", e.Type.String())
+		}
+		ptrType := g.typeToC(&ast.TypeAnnotation{IsPtr: true, Elem: e.Type})
+		return fmt.Sprintf("(%s)%s", ptrType, g.heapAlloc(fmt.Sprintf("sizeof(%s)", g.typeToC(e.Type))))
+	case *ast.StructLiteral:
+		return g.generateStructLiteral(e)
 	case *ast.ArrayLiteral:
 		var elements []string
 		for _, el := range e.Elements {
@@ -900,21 +1392,93 @@ func (g *Generator) generateExpression(expr ast.Expression) string {
 	return ""
 }
 
+// checkAssignable reports assignments to module-level constants
+func (g *Generator) checkAssignable(target ast.Expression) {
+	if ident, ok := target.(*ast.Identifier); ok {
+		if gl := g.globalFor(ident.Value); gl != nil && gl.isConst {
+			g.errorf(ident.Token.Line, "cannot assign to constant %s", ident.Value)
+		}
+	}
+}
+
+// generateStructLiteral emits a C99 compound literal; omitted fields are
+// zero-initialised by C
+func (g *Generator) generateStructLiteral(e *ast.StructLiteral) string {
+	return fmt.Sprintf("(%s)%s", e.Name.Value, g.structInitializer(e, g.generateExpression))
+}
+
+// structInitializer renders the brace list of a struct literal, using
+// value to render each field
+func (g *Generator) structInitializer(e *ast.StructLiteral, value func(ast.Expression) string) string {
+	name := e.Name.Value
+	s, ok := g.structs[name]
+	if !ok {
+		g.errorf(e.Token.Line, "unknown struct type %s", name)
+		return "{0}"
+	}
+
+	var inits []string
+	for _, f := range e.Fields {
+		known := false
+		for _, sf := range s.Fields {
+			if sf.Name.Value == f.Name.Value {
+				known = true
+				break
+			}
+		}
+		if !known {
+			g.errorf(f.Name.Token.Line, "struct %s has no field %s", name, f.Name.Value)
+			continue
+		}
+		inits = append(inits, fmt.Sprintf(".%s = %s", f.Name.Value, value(f.Value)))
+	}
+	if len(inits) == 0 {
+		return "{0}"
+	}
+	return fmt.Sprintf("{%s}", strings.Join(inits, ", "))
+}
+
+// generateStructEquality emits == or != between two struct values
+func (g *Generator) generateStructEquality(e *ast.InfixExpression, structName, left, right string) string {
+	if f := g.incomparableField(structName, nil); f != nil {
+		g.errorf(e.Token.Line, "cannot compare %s values: field %s is not comparable", structName, f.Name.Value)
+	}
+	if e.Operator == "!=" {
+		return fmt.Sprintf("(!h_eq_%s(%s, %s))", structName, left, right)
+	}
+	return fmt.Sprintf("h_eq_%s(%s, %s)", structName, left, right)
+}
+
 func (g *Generator) generateMakeExpression(e *ast.MakeExpression) string {
 	// Check if it's a map type
 	if e.Type != nil && e.Type.IsMap {
 		return "h_map_new()"
 	}
-	elemType := g.typeToC(&ast.TypeAnnotation{Name: e.Type.Name})
+	elemType := g.typeToC(makeElement(e.Type))
 	if e.Length != nil {
 		length := g.generateExpression(e.Length)
 		// Allocate array on heap: (int*)calloc(length, sizeof(int))
+		if g.gc {
+			return fmt.Sprintf("(%s*)h_gc_alloc((%s) * sizeof(%s))", elemType, length, elemType)
+		}
 		return fmt.Sprintf("(%s*)calloc(%s, sizeof(%s))", elemType, length, elemType)
 	}
 	// Default to empty allocation
+	if g.gc {
+		return fmt.Sprintf("(%s*)h_gc_alloc(0)", elemType)
+	}
 	return fmt.Sprintf("(%s*)calloc(0, sizeof(%s))", elemType, elemType)
 }
 
+// makeElement returns the element type allocated by make([]T, n). The
+// flat form make(T, n) allocates elements of type T.
+func makeElement(t *ast.TypeAnnotation) *ast.TypeAnnotation {
+	if t.ArrayLen == -1 {
+		return t.Element()
+	}
+	return t
+}
+
 func (g *Generator) generateMapLiteral(e *ast.MapLiteral) string {
 	// Map literals are handled specially in generateInferStatement
 	// This just returns h_map_new() for use in expressions
@@ -938,21 +1502,21 @@ func (g *Generator) generateCallExpression(e *ast.CallExpression) string {
 				return fmt.Sprintf("printf(\"%%f\\n\", %s)", argStr)
 			case *ast.BooleanLiteral:
 				return fmt.Sprintf("printf(\"%%s\\n\", %s ? \"true\" : \"false\")", argStr)
-			case *ast.CallExpression:
-				// Check return type of called function
-				if g.getCallReturnType(a) == "h_string" {
+			default:
+				// Pick the format from the inferred type
+				switch g.inferType(a) {
+				case "h_string":
 					return fmt.Sprintf("printf(\"%%s\\n\", %s)", argStr)
+				case "double":
+					return fmt.Sprintf("printf(\"%%f\\n\", %s)", argStr)
+				case "char":
+					return fmt.Sprintf("printf(\"%%c\\n\", %s)", argStr)
+				case "bool":
+					return fmt.Sprintf("printf(\"%%s\\n\", %s ? \"true\" : \"false\")", argStr)
 				}
-				return fmt.Sprintf("printf(\"%%d\\n\", %s)", argStr)
-			case *ast.Identifier:
-				// Check variable type
-				if varType, ok := g.variables[a.Value]; ok {
-					if varType == "h_string" {
-						return fmt.Sprintf("printf(\"%%s\\n\", %s)", argStr)
-					}
+				if format, ok := integerFormats[g.inferType(a)]; ok {
+					return fmt.Sprintf("printf(\"%s\\n\", %s%s)", format[0], format[1], argStr)
 				}
-				return fmt.Sprintf("printf(\"%%d\\n\", %s)", argStr)
-			default:
 				// Default to %d for most expressions
 				return fmt.Sprintf("printf(\"%%d\\n\", %s)", argStr)
 			}
@@ -960,18 +1524,29 @@ func (g *Generator) generateCallExpression(e *ast.CallExpression) string {
 		return "printf(\"\\n\")"
 	}
 
+	if g.isAssert(e) {
+		return g.generateAssert(e, funcName)
+	}
+	if name, ok := g.processBuiltin(e); ok {
+		return g.generateProcessBuiltin(e, name)
+	}
+
 	// Handle len() for arrays, strings, and maps
 	if funcName == "len" {
 		if len(e.Arguments) > 0 {
 			arg := e.Arguments[0]
+			// args() is argv, whose length main recorded
+			if g.isArgs(arg) {
+				return "h_argc"
+			}
 			argStr := g.generateExpression(arg)
 			// For strings, use strlen; for arrays, use sizeof; for maps, use h_map_len
 			switch a := arg.(type) {
 			case *ast.StringLiteral:
 				return fmt.Sprintf("strlen(%s)", argStr)
-			case *ast.Identifier:
+			case *ast.Identifier, *ast.MemberExpression:
 				// Check if it's a map
-				if varType, ok := g.variables[a.Value]; ok && varType == "h_map*" {
+				if g.isMapExpr(a) {
 					return fmt.Sprintf("h_map_len(%s)", argStr)
 				}
 				// Assume array
@@ -983,12 +1558,24 @@ func (g *Generator) generateCallExpression(e *ast.CallExpression) string {
 		return "0"
 	}
 
-	// Check if it's a method call (obj.method())
-	if member, ok := e.Function.(*ast.MemberExpression); ok {
+	// Check if it's a method call (obj.method()); fields holding
+	// functions are called like any other function value
+	if member, ok := e.Function.(*ast.MemberExpression); ok && !g.isFunctionField(member) {
 		// Convert to StructName_method(obj, args)
 		obj := g.generateExpression(member.Object)
 		method := member.Member.Value
 
+		// Take the address of a value receiver for pointer methods and
+		// dereference pointers for value methods
+		if fn := g.methodFor(member); fn != nil {
+			isPtr := g.isPointerExpr(member.Object)
+			if fn.Receiver.Type.IsPtr && !isPtr {
+				obj = "(&" + obj + ")"
+			} else if !fn.Receiver.Type.IsPtr && isPtr {
+				obj = "(*" + obj + ")"
+			}
+		}
+
 		var args []string
 		args = append(args, obj)
 		for _, arg := range e.Arguments {
@@ -1000,6 +1587,18 @@ func (g *Generator) generateCallExpression(e *ast.CallExpression) string {
 		return fmt.Sprintf("%s_%s(%s)", typeName, method, strings.Join(args, ", "))
 	}
 
+	if funcName == "init" {
+		if _, ok := g.lookupVar(funcName); !ok {
+			g.errorf(e.Token.Line, "init cannot be called; it runs automatically before main")
+		}
+	}
+
+	if f, ok := g.functions[funcName]; ok && f.Extern {
+		if _, shadowed := g.lookupVar(funcName); !shadowed {
+			g.checkExternCall(e, f)
+		}
+	}
+
 	var args []string
 	for _, arg := range e.Arguments {
 		args = append(args, g.generateExpression(arg))
@@ -1007,41 +1606,121 @@ func (g *Generator) generateCallExpression(e *ast.CallExpression) string {
 	return fmt.Sprintf("%s(%s)", funcName, strings.Join(args, ", "))
 }
 
+// typeToC returns the C spelling of a type on its own, as used in casts,
+// sizeof and the variable table (e.g. "int[5]", "User*", "int (*)(int)")
 func (g *Generator) typeToC(t *ast.TypeAnnotation) string {
+	return g.declare(t, "")
+}
+
+// declare returns the C declaration of name with type t. C declarators
+// are written inside out, so the type is unwound from the outside while
+// the declarator grows around the name: an array of pointers is
+// "int* a[3]", a pointer to an array "int (*a)[3]" and a function value
+// "int (*f)(int)". A nil type declares void.
+func (g *Generator) declare(t *ast.TypeAnnotation, name string) string {
 	if t == nil {
-		return "void"
+		return joinDeclarator("void", name)
+	}
+
+	switch {
+	case t.IsPtr:
+		return g.declare(t.Element(), "*"+name)
+	case t.IsMap:
+		return joinDeclarator("h_map", "*"+name)
+	case t.IsFunc:
+		var params []string
+		for _, p := range t.Params {
+			params = append(params, g.typeToC(p))
+		}
+		if len(params) == 0 {
+			params = append(params, "void")
+		}
+		return g.declare(t.ReturnType, fmt.Sprintf("(*%s)(%s)", name, strings.Join(params, ", ")))
+	case t.ArrayLen == -1:
+		// Slices are pointers to their first element
+		return g.declare(t.Element(), "*"+name)
+	case t.ArrayLen > 0:
+		if strings.HasPrefix(name, "*") {
+			name = "(" + name + ")"
+		}
+		return g.declare(t.Element(), fmt.Sprintf("%s[%d]", name, t.ArrayLen))
 	}
 
-	var cType string
+	var base string
 	switch t.Name {
 	case "int":
-		cType = "int"
+		base = "int"
 	case "float":
-		cType = "double"
+		base = "double"
 	case "string":
-		cType = "h_string"
+		base = "h_string"
 	case "char":
-		cType = "char"
+		base = "char"
 	case "bool":
-		cType = "bool"
+		base = "bool"
 	case "void":
-		cType = "void"
+		base = "void"
 	default:
+		if c, ok := cIntegers[t.Name]; ok {
+			base = c
+			break
+		}
 		// User-defined type (struct)
-		cType = t.Name
+		base = t.Name
 	}
+	return joinDeclarator(base, name)
+}
 
-	if t.ArrayLen == -1 {
-		cType = cType + "*" // Slice becomes pointer
-	} else if t.ArrayLen > 0 {
-		cType = fmt.Sprintf("%s[%d]", cType, t.ArrayLen)
+// abstractName matches the spot where typeToC left out the declared name
+// inside parentheses, as in "int (*)(int)" or "int (*[2])(int)"
+var abstractName = regexp.MustCompile(`\(\*+[\[)]`)
+
+// declareC declares name with a C type as spelled by typeToC or
+// inferType, putting the name where the abstract type leaves it out:
+// "int (*)(int)" declares "int (*f)(int)" and "int[3]" declares "int a[3]"
+func declareC(cType, name string) string {
+	if loc := abstractName.FindStringIndex(cType); loc != nil {
+		at := loc[1] - 1
+		return cType[:at] + name + cType[at:]
+	}
+	if i := strings.Index(cType, "["); i != -1 {
+		return cType[:i] + " " + name + cType[i:]
 	}
+	return cType + " " + name
+}
 
-	if t.IsPtr {
-		cType = cType + "*"
+// callResultType returns the type produced by calling a function pointer
+// of the given C type by removing its innermost "(*)(params)", so
+// "int (*)(int)" gives "int". It returns "" for other types.
+func callResultType(cType string) string {
+	start := strings.Index(cType, "(*)(")
+	if start == -1 {
+		return ""
+	}
+	depth := 0
+	for i := start + len("(*)"); i < len(cType); i++ {
+		switch cType[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return strings.TrimSpace(cType[:start] + cType[i+1:])
+			}
+		}
 	}
+	return ""
+}
 
-	return cType
+// joinDeclarator puts a base type in front of a declarator, keeping
+// leading stars on the type side ("User* u") like hand-written C
+func joinDeclarator(base, declarator string) string {
+	rest := strings.TrimLeft(declarator, "*")
+	stars := declarator[:len(declarator)-len(rest)]
+	if rest == "" || strings.HasPrefix(rest, "[") {
+		return base + declarator
+	}
+	return base + stars + " " + rest
 }
 
 func (g *Generator) inferType(expr ast.Expression) string {
@@ -1058,8 +1737,15 @@ func (g *Generator) inferType(expr ast.Expression) string {
 		return "bool"
 	case *ast.NullLiteral:
 		return "void*"
+	case *ast.Identifier:
+		if varType, ok := g.lookupVar(e.Value); ok {
+			return varType
+		}
+		return "int"
 	case *ast.AllocExpression:
-		return e.Type.Name + "*"
+		return g.typeToC(&ast.TypeAnnotation{IsPtr: true, Elem: e.Type})
+	case *ast.StructLiteral:
+		return e.Name.Value
 	case *ast.PrefixExpression:
 		if e.Operator == "&" {
 			return g.inferType(e.Right) + "*"
@@ -1068,55 +1754,88 @@ func (g *Generator) inferType(expr ast.Expression) string {
 			inner := g.inferType(e.Right)
 			return strings.TrimSuffix(inner, "*")
 		}
+		if e.Operator == "!" {
+			return "bool"
+		}
 		return g.inferType(e.Right)
 	case *ast.InfixExpression:
-		return g.inferType(e.Left)
-	case *ast.CallExpression:
-		// Look up function return type
-		if ident, ok := e.Function.(*ast.Identifier); ok {
-			if fn, exists := g.functions[ident.Value]; exists && fn.ReturnType != nil {
-				return g.typeToC(fn.ReturnType)
+		switch e.Operator {
+		case "==", "!=", "<", ">", "<=", ">=", "&&", "||":
+			return "bool"
+		case "+":
+			if g.isStringExpr(e.Left) || g.isStringExpr(e.Right) {
+				return "h_string"
 			}
 		}
+		return g.inferType(e.Left)
+	case *ast.MemberExpression:
+		if field := g.fieldOf(e); field != nil {
+			return g.typeToC(field.Type)
+		}
 		return "int"
+	case *ast.IndexExpression:
+		container := g.inferType(e.Left)
+		switch {
+		case container == "h_map*":
+			return "int"
+		case container == "h_string":
+			return "char"
+		}
+		return elementType(container)
+	case *ast.CastExpression:
+		return g.typeToC(e.TargetType)
+	case *ast.CallExpression:
+		return g.getCallReturnType(e)
 	}
 	return "int"
 }
 
-func (g *Generator) isStringExpr(expr ast.Expression) bool {
-	_, ok := expr.(*ast.StringLiteral)
+// fieldOf resolves the struct field selected by a member expression
+func (g *Generator) fieldOf(e *ast.MemberExpression) *ast.StructField {
+	structName := strings.TrimSuffix(g.inferType(e.Object), "*")
+	s, ok := g.structs[structName]
+	if !ok {
+		return nil
+	}
+	for _, f := range s.Fields {
+		if f.Name.Value == e.Member.Value {
+			return f
+		}
+	}
+	return nil
+}
+
+// isStructValue reports whether a C type is a struct held by value
+func (g *Generator) isStructValue(cType string) bool {
+	_, ok := g.structs[cType]
 	return ok
 }
 
-func (g *Generator) isPointerExpr(expr ast.Expression) bool {
+func (g *Generator) isStringExpr(expr ast.Expression) bool {
 	switch e := expr.(type) {
-	case *ast.Identifier:
-		// Look up in symbol table
-		if varType, ok := g.variables[e.Value]; ok {
-			return strings.HasSuffix(varType, "*")
-		}
-		return false
-	case *ast.AllocExpression:
+	case *ast.StringLiteral:
 		return true
-	case *ast.PrefixExpression:
-		return e.Operator == "&"
-	case *ast.CallExpression:
-		// Check if function returns a pointer
-		if ident, ok := e.Function.(*ast.Identifier); ok {
-			if fn, exists := g.functions[ident.Value]; exists && fn.ReturnType != nil {
-				return fn.ReturnType.IsPtr
-			}
-		}
-		return false
+	case *ast.InfixExpression:
+		return e.Operator == "+" && (g.isStringExpr(e.Left) || g.isStringExpr(e.Right))
+	case *ast.Identifier, *ast.MemberExpression, *ast.CallExpression:
+		return g.inferType(e) == "h_string"
 	}
 	return false
 }
 
+func (g *Generator) isMapExpr(expr ast.Expression) bool {
+	return g.inferType(expr) == "h_map*"
+}
+
+func (g *Generator) isPointerExpr(expr ast.Expression) bool {
+	return strings.HasSuffix(g.inferType(expr), "*")
+}
+
 func (g *Generator) getExprType(expr ast.Expression) string {
 	switch e := expr.(type) {
 	case *ast.Identifier:
 		// Look up in symbol table and extract base type
-		if varType, ok := g.variables[e.Value]; ok {
+		if varType, ok := g.lookupVar(e.Value); ok {
 			// Remove pointer suffix to get base type
 			baseType := strings.TrimSuffix(varType, "*")
 			return baseType
@@ -1124,44 +1843,48 @@ func (g *Generator) getExprType(expr ast.Expression) string {
 		return "Unknown"
 	case *ast.AllocExpression:
 		return e.Type.Name
-	case *ast.CallExpression:
-		// Check if function returns a struct type
-		if ident, ok := e.Function.(*ast.Identifier); ok {
-			if fn, exists := g.functions[ident.Value]; exists && fn.ReturnType != nil {
-				return fn.ReturnType.Name
-			}
-		}
-		return "Unknown"
 	}
-	return "Unknown"
+	return strings.TrimSuffix(g.inferType(expr), "*")
 }
 
 func (g *Generator) getCallReturnType(e *ast.CallExpression) string {
 	// Check for method call (obj.method())
 	if member, ok := e.Function.(*ast.MemberExpression); ok {
-		methodName := member.Member.Value
-		// Get the struct type of the object
-		structName := g.getExprType(member.Object)
-
-		// Look for method with matching name and receiver type
-		for _, fn := range g.functions {
-			if fn.Name.Value == methodName && fn.Receiver != nil && fn.ReturnType != nil {
-				// Check if receiver type matches
-				receiverType := fn.Receiver.Type.Name
-				if fn.Receiver.Type.IsPtr {
-					receiverType = strings.TrimPrefix(receiverType, "*")
-				}
-				if receiverType == structName {
-					return g.typeToC(fn.ReturnType)
-				}
-			}
+		if fn := g.methodFor(member); fn != nil {
+			return g.typeToC(fn.ReturnType)
 		}
 	}
 	// Check for regular function call
 	if ident, ok := e.Function.(*ast.Identifier); ok {
-		if fn, exists := g.functions[ident.Value]; exists && fn.ReturnType != nil {
-			return g.typeToC(fn.ReturnType)
+		if fn, exists := g.functions[ident.Value]; exists {
+			if fn.ReturnType != nil {
+				return g.typeToC(fn.ReturnType)
+			}
+			return "int"
+		}
+		if name, ok := g.processBuiltin(e); ok {
+			return processBuiltins[name]
 		}
 	}
+	// Calls through function values
+	if result := callResultType(g.inferType(e.Function)); result != "" {
+		return result
+	}
 	return "int"
 }
+
+// isFunctionField reports whether obj.name selects a field of function
+// type rather than a method
+func (g *Generator) isFunctionField(member *ast.MemberExpression) bool {
+	if g.methodFor(member) != nil {
+		return false
+	}
+	field := g.fieldOf(member)
+	return field != nil && field.Type.IsFunc
+}
+
+// methodFor resolves the method called through obj.method
+func (g *Generator) methodFor(member *ast.MemberExpression) *ast.FunctionStatement {
+	structName := g.getExprType(member.Object)
+	return g.methods[structName+"."+member.Member.Value]
+}
@@ -1,9 +1,12 @@
 package codegen
 
 import (
+	"fmt"
+	"slices"
 	"strings"
 	"testing"
 
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
 	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
 	"github.com/Dr-H-PhD/h-lang/pkg/parser"
 )
@@ -242,36 +245,39 @@ func TestGenerate_CompoundAssignment(t *testing.T) {
 
 func TestGenerate_BooleanOperators(t *testing.T) {
 	input := `function main() {
-    x := true && false;
-    y := true || false;
-    z := !true;
+    p := true;
+    q := false;
+    x := p && q;
+    y := p || q;
+    z := !p;
 }`
 
 	code := compile(t, input)
 
-	assertContains(t, code, "(true && false)")
-	assertContains(t, code, "(true || false)")
-	assertContains(t, code, "(!true)")
+	assertContains(t, code, "(p && q)")
+	assertContains(t, code, "(p || q)")
+	assertContains(t, code, "(!p)")
 }
 
 func TestGenerate_ComparisonOperators(t *testing.T) {
 	input := `function main() {
-    a := 1 == 2;
-    b := 1 != 2;
-    c := 1 < 2;
-    d := 1 <= 2;
-    e := 1 > 2;
-    f := 1 >= 2;
+    x := 1;
+    a := x == 2;
+    b := x != 2;
+    c := x < 2;
+    d := x <= 2;
+    e := x > 2;
+    f := x >= 2;
 }`
 
 	code := compile(t, input)
 
-	assertContains(t, code, "(1 == 2)")
-	assertContains(t, code, "(1 != 2)")
-	assertContains(t, code, "(1 < 2)")
-	assertContains(t, code, "(1 <= 2)")
-	assertContains(t, code, "(1 > 2)")
-	assertContains(t, code, "(1 >= 2)")
+	assertContains(t, code, "(x == 2)")
+	assertContains(t, code, "(x != 2)")
+	assertContains(t, code, "(x < 2)")
+	assertContains(t, code, "(x <= 2)")
+	assertContains(t, code, "(x > 2)")
+	assertContains(t, code, "(x >= 2)")
 }
 
 func TestGenerate_NullCheck(t *testing.T) {
@@ -381,7 +387,8 @@ func TestGenerate_LenFunction(t *testing.T) {
 
 	code := compile(t, input)
 
-	assertContains(t, code, "sizeof(arr)/sizeof(arr[0])")
+	// The length of a fixed-size array is a constant
+	assertContains(t, code, "int size = 5;")
 }
 
 func TestGenerate_MakeSlice(t *testing.T) {
@@ -579,8 +586,662 @@ func TestGenerate_MapHelpers(t *testing.T) {
 	assertContains(t, code, "void h_map_free(h_map* m)")
 }
 
+func TestGenerate_MapHelpersNested(t *testing.T) {
+	// Maps used only deep inside a function still need the helpers
+	inputs := []string{
+		`function main() {
+    for _, v := range [2]int{1, 2} {
+        m := map[int]int{v: v};
+    }
+}`,
+		`function count(words []string) int {
+    return len(make(map[string]int, len(words)));
+}`,
+		`function main() {
+    if true {
+        print(len(map[string]int{"a": 1}));
+    }
+}`,
+	}
+	for _, input := range inputs {
+		assertContains(t, compile(t, input), "h_map* h_map_new()")
+	}
+}
+
 // Helper functions
 
+func TestGenerate_StructLiteral(t *testing.T) {
+	input := `struct User {
+    name string;
+    age int;
+}
+
+function main() {
+    u := User{name: "a", age: 30};
+    empty := User{};
+    p := &User{name: "b"};
+    q := alloc(User{age: 1});
+    print(u.name);
+    print(p.name);
+}`
+
+	code := compile(t, input)
+
+	assertContains(t, code, `User u = (User){.name = "a", .age = 30};`)
+	assertContains(t, code, "User empty = (User){0};")
+	assertContains(t, code, `User* p = h_new_User((User){.name = "b"});`)
+	assertContains(t, code, "User* q = h_new_User((User){.age = 1});")
+	assertContains(t, code, `printf("%s\n", u.name);`)
+	assertContains(t, code, `printf("%s\n", p->name);`)
+}
+
+func TestGenerate_MemberAccessFromTypes(t *testing.T) {
+	input := `struct Point {
+    x int;
+}
+
+struct Line {
+    a Point;
+    b *Point;
+}
+
+function (p *Point) shift() {
+    p.x = p.x + 1;
+}
+
+function main() {
+    l := Line{};
+    l.a.x = 1;
+    l.b.x = 2;
+    l.a.shift();
+    lp := &l;
+    lp.a.x = 3;
+}`
+
+	code := compile(t, input)
+
+	assertContains(t, code, "(l.a.x = 1)")
+	assertContains(t, code, "(l.b->x = 2)")
+	assertContains(t, code, "Point_shift((&l.a))")
+	assertContains(t, code, "(lp->a.x = 3)")
+}
+
+func TestGenerate_ForInitVariableType(t *testing.T) {
+	input := `struct Node {
+    val int;
+    next *Node;
+}
+
+function main() {
+    var head *Node = null;
+    for p := head; p != null; p = p.next {
+        print(p.val);
+    }
+    p := Node{val: 1};
+    print(p.val);
+}`
+
+	code := compile(t, input)
+
+	assertContains(t, code, "for (Node* p = head; (p != NULL); (p = p->next)) {")
+	assertContains(t, code, `printf("%d\n", p->val);`)
+	// The loop variable is out of scope after the loop
+	assertContains(t, code, `printf("%d\n", p.val);`)
+}
+
+func TestGenerate_StructByValue(t *testing.T) {
+	input := `struct Point {
+    x int;
+    y int;
+}
+
+function add(a Point, b Point) Point {
+    return Point{x: a.x + b.x, y: a.y + b.y};
+}`
+
+	code := compile(t, input)
+
+	assertContains(t, code, "Point add(Point a, Point b)")
+	assertContains(t, code, "return (Point){.x = (a.x + b.x), .y = (a.y + b.y)};")
+}
+
+func TestGenerate_StructEquality(t *testing.T) {
+	input := `struct Point {
+    x int;
+    name string;
+}
+
+function main() {
+    a := Point{x: 1};
+    b := a;
+    print(a == b);
+    print(a != b);
+}`
+
+	code := compile(t, input)
+
+	assertContains(t, code, "static bool h_eq_Point(Point a, Point b)")
+	assertContains(t, code, "return a.x == b.x && h_str_eq(a.name, b.name);")
+	assertContains(t, code, "Point b = a;")
+	assertContains(t, code, "h_eq_Point(a, b)")
+	assertContains(t, code, "(!h_eq_Point(a, b))")
+}
+
+func TestGenerate_IncomparableStructError(t *testing.T) {
+	input := `struct Bag {
+    items []int;
+}
+
+function main() {
+    a := Bag{};
+    b := Bag{};
+    print(a == b);
+}`
+
+	l := lexer.New(input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+
+	g := New()
+	g.Generate(program)
+
+	if len(g.Errors()) != 1 || !strings.Contains(g.Errors()[0], "field items is not comparable") {
+		t.Errorf("expected comparability error, got %v", g.Errors())
+	}
+}
+
+func TestGenerate_ArrayComparisonError(t *testing.T) {
+	input := `function main() {
+    a := [2]int{1, 2};
+    b := a;
+    print(a == b);
+}`
+
+	l := lexer.New(input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+
+	g := New()
+	g.Generate(program)
+
+	if len(g.Errors()) != 1 || g.Errors()[0] != "line 4: cannot compare arrays" {
+		t.Errorf("expected an array comparison error, got %v", g.Errors())
+	}
+}
+
+func TestGenerate_StructOrdering(t *testing.T) {
+	input := `struct Outer {
+    inner Inner;
+}
+
+struct Inner {
+    x int;
+}`
+
+	code := compile(t, input)
+
+	if strings.Index(code, "struct Inner {") > strings.Index(code, "struct Outer {") {
+		t.Errorf("Inner must be defined before Outer embeds it by value\n%s", code)
+	}
+}
+
+func TestGenerate_NestedTypeDeclarators(t *testing.T) {
+	input := `struct Point { x int; }
+
+struct Grid {
+    cells [2][3]int;
+    corners [4]Point;
+    refs []*Point;
+    next **Grid;
+    counts map[string]int;
+    op function(int, int) int;
+    ops [2]function(int);
+}
+
+function twice(x int) int {
+    return x * 2;
+}
+
+function pick(n int) function(int) int {
+    return twice;
+}
+
+function row(m *[3]int) int {
+    return 0;
+}
+
+function main() {
+    f := pick(1);
+    print(f(2));
+}`
+
+	code := compile(t, input)
+
+	assertContains(t, code, "int cells[2][3];")
+	assertContains(t, code, "Point corners[4];")
+	assertContains(t, code, "Point** refs;")
+	assertContains(t, code, "Grid** next;")
+	assertContains(t, code, "h_map* counts;")
+	assertContains(t, code, "int (*op)(int, int);")
+	assertContains(t, code, "void (*ops[2])(int);")
+	assertContains(t, code, "int (*pick(int n))(int) {")
+	assertContains(t, code, "int row(int (*m)[3]) {")
+	assertContains(t, code, "int (*f)(int) = pick(1);")
+	assertContains(t, code, `printf("%d\n", f(2));`)
+	// A map-typed field is enough to need the map runtime
+	assertContains(t, code, "typedef struct h_map_entry")
+}
+
+func TestGenerate_FunctionFieldCall(t *testing.T) {
+	input := `struct Op {
+    apply function(int) int;
+}
+
+function main() {
+    var o Op;
+    print(o.apply(1));
+}`
+
+	code := compile(t, input)
+
+	assertContains(t, code, "o.apply(1)")
+	if strings.Contains(code, "Op_apply") {
+		t.Errorf("function-typed field called as a method\n%s", code)
+	}
+}
+
+func TestGenerate_ArrayReturnError(t *testing.T) {
+	input := `function grid() [3]int {
+    return 0;
+}`
+
+	l := lexer.New(input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+
+	g := New()
+	g.Generate(program)
+
+	if len(g.Errors()) != 1 || !strings.Contains(g.Errors()[0], "cannot return the array type [3]int") {
+		t.Errorf("expected array return error, got %v", g.Errors())
+	}
+}
+
+func TestGenerate_GlobalStaticData(t *testing.T) {
+	input := `struct Point { x int; y int; }
+enum Color { Red, Green }
+
+const SIZE := 4 * 1024;
+const ORIGIN := Point{x: 1};
+const PRIMES := [4]int{2, 3, 5, 7};
+const DEFAULT := Color_Green;
+var count int = 0;
+var name string;
+
+function main() {
+    count = count + SIZE;
+    print(ORIGIN.x);
+}`
+
+	code := compile(t, input)
+
+	assertContains(t, code, "const int SIZE = 4096;")
+	assertContains(t, code, "const Point ORIGIN = {.x = 1};")
+	assertContains(t, code, "const int PRIMES[4] = {2, 3, 5, 7};")
+	assertContains(t, code, "const int DEFAULT = Color_Green;")
+	assertContains(t, code, "int count = 0;")
+	assertContains(t, code, "h_string name;")
+	assertContains(t, code, "(count = (count + 4096));")
+	if strings.Contains(code, "h_init") {
+		t.Errorf("static data needs no initialisation code\n%s", code)
+	}
+}
+
+func TestGenerate_SliceLiteralGlobals(t *testing.T) {
+	input := `function three() int { return 3; }
+
+var sl []int = []int{1, 2, 3};
+var computed []int = []int{three(), 4};
+var none []int = []int{};
+
+function main() {
+    var local []int = []int{4, 5};
+    var m map[string]int = map[string]int{"k": 7};
+    print(sl[0] + local[1] + computed[0] + m["k"]);
+}`
+
+	code := compile(t, input)
+
+	assertContains(t, code, "static int h_data_sl[3] = {1, 2, 3};")
+	assertContains(t, code, "int* sl = h_data_sl;")
+	assertContains(t, code, "static int h_data_computed[2];")
+	assertContains(t, code, "int* computed = h_data_computed;")
+	assertContains(t, code, "h_data_computed[0] = three();")
+	assertContains(t, code, "int* none = NULL;")
+	assertContains(t, code, "int* local = (int[2]){4, 5};")
+	assertContains(t, code, `h_map_set(m, "k", (void*)(intptr_t)7);`)
+}
+
+func TestGenerate_ConstantFolding(t *testing.T) {
+	files := map[string]string{
+		"lib.hl": `public const K := 3 * 7;
+public enum Level { Low, Mid = K, High }`,
+	}
+	input := `import "lib.hl";
+
+const VERBOSE := false;
+const PI := 3.14159265358979;
+
+function main() {
+    print(Level_High + K);
+    print(PI / 2.0);
+    if VERBOSE {
+        print("verbose");
+    } else {
+        n := 1;
+        print(n);
+    }
+    return;
+    print("unreachable");
+}`
+
+	g, code := generateWithImports(t, input, files)
+	if len(g.Errors()) > 0 {
+		t.Fatalf("unexpected errors: %v", g.Errors())
+	}
+
+	assertContains(t, code, "const int K = 21;")
+	assertContains(t, code, "Mid = 21")
+	assertContains(t, code, `printf("%d\n", 43);`)
+	assertContains(t, code, "const double PI = 3.14159265358979;")
+	assertContains(t, code, "1.570796326794895")
+	assertContains(t, code, "    {\n        int n = 1;")
+	if strings.Contains(code, "verbose") || strings.Contains(code, "unreachable") {
+		t.Errorf("dead code was generated\n%s", code)
+	}
+}
+
+func TestGenerate_ConstantErrors(t *testing.T) {
+	g, _ := generateWithImports(t, `const SIZE := 4 * 1024 * 1024 * 1024;
+
+function main() {
+    print(SIZE / (SIZE - SIZE));
+}`, nil)
+
+	errs := g.Errors()
+	if len(errs) != 1 || errs[0] != "line 1: constant 4294967296 overflows int" {
+		t.Errorf("expected an overflow error, got %v", errs)
+	}
+
+	g, _ = generateWithImports(t, `function main() {
+    x := 1;
+    print(x + 10 % (3 - 3));
+}`, nil)
+	errs = g.Errors()
+	if len(errs) != 1 || errs[0] != "line 3: division by zero" {
+		t.Errorf("expected a division by zero error, got %v", errs)
+	}
+}
+
+func TestGenerate_Comptime(t *testing.T) {
+	files := map[string]string{
+		"lib.hl": `comptime function double(n int) int {
+    return n * 2;
+}
+
+public comptime function quadruple(n int) int {
+    return double(double(n));
+}`,
+	}
+	input := `import "lib.hl";
+
+comptime function primes(n int) [8]int {
+    var out [8]int;
+    found := 0;
+    for c := 2; found < n; c++ {
+        prime := true;
+        for d := 2; d * d <= c; d++ {
+            if c % d == 0 {
+                prime = false;
+                break;
+            }
+        }
+        if prime {
+            out[found] = c;
+            found++;
+        }
+    }
+    return out;
+}
+
+const SIZE := quadruple(4);
+const PRIMES := primes(8);
+var buffer [SIZE]int;
+
+static_assert(SIZE == 16, "the buffer holds 16 ints");
+
+function main() {
+    print(PRIMES[7] + len(buffer));
+}`
+
+	g, code := generateWithImports(t, input, files)
+	if len(g.Errors()) > 0 {
+		t.Fatalf("unexpected errors: %v", g.Errors())
+	}
+	assertContains(t, code, "const int SIZE = 16;")
+	assertContains(t, code, "const int PRIMES[8] = {2, 3, 5, 7, 11, 13, 17, 19};")
+	assertContains(t, code, "int buffer[16];")
+	assertContains(t, code, "(PRIMES[7] + 16)")
+	for _, name := range []string{"primes", "double", "quadruple", "static_assert"} {
+		if strings.Contains(code, name) {
+			t.Errorf("%s was generated\n%s", name, code)
+		}
+	}
+}
+
+func TestGenerate_ComptimeErrors(t *testing.T) {
+	g, _ := generateWithImports(t, `comptime function f(n int) int {
+    return 10 / n;
+}
+
+var table [f(0)]int;
+
+function main() {
+    static_assert(len(table) == 1, "one entry");
+}`, nil)
+
+	expected := []string{
+		"line 2: integer divide by zero",
+		"line 5: array length f(0) is not a constant int",
+		"line 8: static_assert condition (len(table) == 1) is not a constant",
+	}
+	if strings.Join(g.Errors(), "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected errors %q, got %q", expected, g.Errors())
+	}
+}
+
+func TestGenerate_GlobalInitOrder(t *testing.T) {
+	files := map[string]string{
+		"lib.hl": `public var base int = 10;
+public var scores map[string]int;
+
+function init() {
+    scores = map[string]int{"a": 1};
+}`,
+	}
+	input := `import "lib.hl";
+
+var table []int = make([]int, 4);
+const LABEL := "n=" + prefix();
+
+function prefix() string {
+    return "4";
+}
+
+function init() {
+    table[0] = base;
+}
+
+function main() {
+    print(table[0]);
+}`
+
+	g, code := generateWithImports(t, input, files)
+	if len(g.Errors()) > 0 {
+		t.Fatalf("unexpected errors: %v", g.Errors())
+	}
+
+	assertContains(t, code, "int* table;")
+	assertContains(t, code, "h_string LABEL;")
+	assertContains(t, code, "static void h_init_0(void) {")
+	assertContains(t, code, "h_map_set(scores, \"a\", (void*)(intptr_t)1);")
+	assertContains(t, code, "h_init();")
+
+	// Imported modules initialise first, each module's globals before its init
+	order := []string{"h_init_0();", "table = (int*)calloc(4, sizeof(int));", "LABEL = h_string_concat", "h_init_1();"}
+	body := code[strings.Index(code, "static void h_init(void) {"):]
+	last := -1
+	for _, want := range order {
+		idx := strings.Index(body, want)
+		if idx < last {
+			t.Errorf("%q is out of order in h_init\n%s", want, body)
+		}
+		last = idx
+	}
+}
+
+func TestGenerate_GlobalErrors(t *testing.T) {
+	files := map[string]string{
+		"lib.hl": `var hidden int = 1;
+public const LIMIT := 3;`,
+	}
+	input := `import "lib.hl";
+
+function main() {
+    LIMIT = 4;
+    print(hidden);
+    init();
+    x := LIMIT;
+    x = 5;
+}`
+
+	g, _ := generateWithImports(t, input, files)
+
+	expected := []string{
+		"line 4: cannot assign to constant LIMIT",
+		"line 5: hidden is not public in lib.hl",
+		"line 6: init cannot be called",
+	}
+	if len(g.Errors()) != len(expected) {
+		t.Fatalf("expected %d errors, got %v", len(expected), g.Errors())
+	}
+	for i, want := range expected {
+		if !strings.Contains(g.Errors()[i], want) {
+			t.Errorf("error %d: expected %q, got %q", i, want, g.Errors()[i])
+		}
+	}
+}
+
+func TestGenerate_PrivateGlobalsPerModule(t *testing.T) {
+	files := map[string]string{
+		"a.hl": `var secret int = 1;
+public function a() int { return secret; }`,
+		"b.hl": `var secret int = 2;
+public function b() int { secret++; return secret; }`,
+	}
+	input := `import "a.hl";
+import "b.hl";
+
+var secret int = 3;
+
+function main() {
+    print(secret + a() + b());
+}`
+
+	g, code := generateWithImports(t, input, files)
+	if len(g.Errors()) > 0 {
+		t.Fatalf("unexpected errors: %v", g.Errors())
+	}
+	assertContains(t, code, "int h_0_secret = 1;")
+	assertContains(t, code, "int h_1_secret = 2;")
+	assertContains(t, code, "int secret = 3;")
+	assertContains(t, code, "return h_0_secret;")
+	assertContains(t, code, "(h_1_secret++);")
+	assertContains(t, code, "(secret + a())")
+}
+
+func TestGenerate_GCModeRegistersGlobals(t *testing.T) {
+	input := `const N := 3;
+var head *int;
+
+function main() {}`
+
+	l := lexer.New(input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+
+	g := New()
+	g.SetGC(true)
+	code := g.Generate(program)
+
+	assertContains(t, code, "h_gc_add_root(&head, sizeof(head));")
+	if strings.Contains(code, "h_gc_add_root(&N") {
+		t.Errorf("constant data should not be a collector root\n%s", code)
+	}
+}
+
+func TestGenerate_GCMode(t *testing.T) {
+	input := `public struct User {
+    public name string;
+}
+
+function main() {
+    user := alloc(User);
+    nums := make([]int, 10);
+    free(user);
+}`
+
+	l := lexer.New(input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+
+	g := New()
+	g.SetGC(true)
+	code := g.Generate(program)
+
+	assertContains(t, code, "void* h_gc_alloc(size_t size)")
+	assertContains(t, code, "h_gc_init(__builtin_frame_address(0));")
+	assertContains(t, code, "(User*)h_gc_alloc(sizeof(User))")
+	assertContains(t, code, "(int*)h_gc_alloc((10) * sizeof(int))")
+	assertContains(t, code, "h_gc_free(user);")
+	assertContains(t, code, "(h_string)h_gc_alloc(len_a + len_b + 1)")
+}
+
+func TestGenerate_ManualModeHasNoCollector(t *testing.T) {
+	input := `function main() {
+    p := alloc(int);
+    free(p);
+}`
+
+	code := compile(t, input)
+
+	if strings.Contains(code, "h_gc_") {
+		t.Errorf("manual mode should not reference the collector\n%s", code)
+	}
+}
+
 func compile(t *testing.T, input string) string {
 	t.Helper()
 
@@ -596,9 +1257,728 @@ func compile(t *testing.T, input string) string {
 	return g.Generate(program)
 }
 
+// generateWithImports generates code for input, resolving imports from
+// the given in-memory files
+func generateWithImports(t *testing.T, input string, files map[string]string) (*Generator, string) {
+	t.Helper()
+
+	l := lexer.New(input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+
+	g := New()
+	g.SetImportResolver(func(path, basePath string) (*ast.Program, error) {
+		src, ok := files[path]
+		if !ok {
+			return nil, fmt.Errorf("no such file: %s", path)
+		}
+		ip := parser.New(lexer.New(src))
+		prog := ip.ParseProgram()
+		if len(ip.Errors()) > 0 {
+			t.Fatalf("parser errors in %s: %v", path, ip.Errors())
+		}
+		return prog, nil
+	}, "")
+	return g, g.Generate(program)
+}
+
 func assertContains(t *testing.T, code, substr string) {
 	t.Helper()
 	if !strings.Contains(code, substr) {
 		t.Errorf("expected code to contain %q\n\nGenerated code:\n%s", substr, code)
 	}
 }
+
+func TestGenerate_UnresolvedImport(t *testing.T) {
+	g, _ := generateWithImports(t, `import "missing.hl";
+function main() {}`, nil)
+
+	errs := g.Errors()
+	if len(errs) != 1 || !strings.Contains(errs[0], "line 1: no such file: missing.hl") {
+		t.Errorf("expected an unresolved import error, got %v", errs)
+	}
+}
+
+func TestGenerateUnits(t *testing.T) {
+	files := map[string]string{
+		"lib/shapes.hl": `public struct Box {
+    public w int;
+}
+
+var created int = 0;
+public var unit Box = Box{w: 1};
+
+function helper(n int) int { return n + 1; }
+
+public function grow(b Box) Box {
+    created++;
+    return Box{w: helper(b.w)};
+}
+
+function init() { created = 0; }
+`,
+	}
+	input := `import "lib/shapes.hl";
+
+function main() {
+    print(grow(unit).w);
+}`
+
+	l := lexer.New(input)
+	p := parser.New(l)
+	g := New()
+	g.SetImportResolver(func(path, basePath string) (*ast.Program, error) {
+		return parser.New(lexer.New(files[path])).ParseProgram(), nil
+	}, "")
+	units := g.GenerateUnits(p.ParseProgram())
+	if len(g.Errors()) > 0 {
+		t.Fatalf("unexpected errors: %v", g.Errors())
+	}
+
+	var names []string
+	byName := make(map[string]*Unit)
+	for _, u := range units {
+		names = append(names, u.Name)
+		byName[u.Name] = u
+	}
+	if strings.Join(names, " ") != "h_runtime lib_shapes main" {
+		t.Fatalf("unexpected units %v", names)
+	}
+
+	runtime := byName["h_runtime"]
+	assertContains(t, runtime.Header, "h_string h_string_concat(h_string a, h_string b);")
+	assertContains(t, runtime.Source, "h_string h_string_concat(h_string a, h_string b) {")
+
+	lib := byName["lib_shapes"]
+	assertContains(t, lib.Header, "#ifndef H_LIB_SHAPES_H")
+	assertContains(t, lib.Header, "struct Box {")
+	assertContains(t, lib.Header, "static inline bool h_eq_Box(Box a, Box b)")
+	assertContains(t, lib.Header, "extern Box unit;")
+	assertContains(t, lib.Header, "Box grow(Box b);")
+	assertContains(t, lib.Header, "void h_init_module_0(void);")
+	if strings.Contains(lib.Header, "helper") || strings.Contains(lib.Header, "created") {
+		t.Errorf("private declarations leaked into the header\n%s", lib.Header)
+	}
+	assertContains(t, lib.Source, `#include "lib_shapes.h"`)
+	assertContains(t, lib.Source, "static int helper(int n);")
+	assertContains(t, lib.Source, "static int h_0_created = 0;")
+	assertContains(t, lib.Source, "Box unit = {.w = 1};")
+	assertContains(t, lib.Source, "void h_init_module_0(void) {")
+
+	main := byName["main"]
+	assertContains(t, main.Header, `#include "lib_shapes.h"`)
+	assertContains(t, main.Source, "h_init_module_0();")
+	assertContains(t, main.Source, "int main(void) {")
+	if strings.Contains(main.Source, "Box grow(") || strings.Contains(main.Source, "struct Box {") {
+		t.Errorf("imported code should not be repeated in the main unit\n%s", main.Source)
+	}
+}
+
+func TestGenerate_Assertions(t *testing.T) {
+	input := `struct Point {
+    x int;
+    y int;
+}
+
+function main() {
+    n := 2;
+    s := "a";
+    assert(n > 1);
+    assert_eq(n + 1, 3);
+    assert_eq(s, "a");
+    assert_eq(1.5, 1.5);
+    assert_eq(Point{x: 1, y: 2}, Point{x: 1, y: 2});
+}
+
+test "never generated" {
+    assert(false);
+}`
+
+	l := lexer.New(input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+
+	g := New()
+	g.SetSourceName("point.hl")
+	code := g.Generate(program)
+	if len(g.Errors()) > 0 {
+		t.Fatalf("unexpected errors: %v", g.Errors())
+	}
+
+	assertContains(t, code, "void h_assert(bool ok, const char* pos, const char* expr) {")
+	assertContains(t, code, `h_assert((n > 1), "point.hl:9:5", "n > 1");`)
+	assertContains(t, code, `h_assert_eq_int((long long)((n + 1)), (long long)(3), "point.hl:10:5", "n + 1", "3");`)
+	assertContains(t, code, `h_assert_eq_str(s, "a", "point.hl:11:5", "s", "\"a\"");`)
+	assertContains(t, code, `h_assert_eq_float(`)
+	assertContains(t, code, `h_assert(h_eq_Point(`)
+	if strings.Contains(code, "h_test_0") || strings.Contains(code, "h_test_main(h_tests") {
+		t.Errorf("test blocks should only be generated in test mode\n%s", code)
+	}
+
+	// Programs without assertions do not carry the runtime
+	g = New()
+	code = g.Generate(parser.New(lexer.New(`function main() { print(1); }`)).ParseProgram())
+	if strings.Contains(code, "h_assert") {
+		t.Errorf("unexpected assertion runtime\n%s", code)
+	}
+}
+
+func TestGenerate_TestMode(t *testing.T) {
+	input := `function add(a int, b int) int { return a + b; }
+
+function main() {
+    print(add(1, 2));
+}
+
+test "adds" {
+    assert_eq(add(1, 2), 3);
+}
+
+test "adds again" {
+    assert(add(2, 2) == 4);
+}`
+
+	l := lexer.New(input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+
+	g := New()
+	g.SetTestMode(true)
+	code := g.Generate(program)
+	if len(g.Errors()) > 0 {
+		t.Fatalf("unexpected errors: %v", g.Errors())
+	}
+
+	assertContains(t, code, "void h_test_0(void) {")
+	assertContains(t, code, "void h_test_1(void) {")
+	assertContains(t, code, `{"adds", h_test_0},`)
+	assertContains(t, code, `{"adds again", h_test_1},`)
+	assertContains(t, code, "return h_test_main(h_tests, 2, argc, argv);")
+	assertContains(t, code, "int h_program_main(void) {")
+	if strings.Contains(code, "int main(void)") {
+		t.Errorf("the program's main should be replaced by the test runner\n%s", code)
+	}
+}
+
+func TestGenerate_TestErrors(t *testing.T) {
+	input := `test "a" {}
+test "a" {}
+
+function main() {
+    test "nested" {}
+    assert(1, 2);
+    assert_eq(1);
+}`
+
+	l := lexer.New(input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+
+	g := New()
+	g.SetTestMode(true)
+	g.Generate(program)
+
+	expected := []string{
+		`line 2: test "a" is declared more than once`,
+		"line 5: test blocks must be declared at the top level",
+		"line 6: assert takes 1 argument, got 2",
+		"line 7: assert_eq takes 2 arguments, got 1",
+	}
+	if len(g.Errors()) != len(expected) {
+		t.Fatalf("expected %d errors, got %v", len(expected), g.Errors())
+	}
+	for i, want := range expected {
+		if !strings.Contains(g.Errors()[i], want) {
+			t.Errorf("error %d: expected %q, got %q", i, want, g.Errors()[i])
+		}
+	}
+}
+
+func TestGenerate_ProcessBuiltins(t *testing.T) {
+	input := `function main() int {
+    a := args();
+    print(a[len(args()) - 1]);
+    print(getenv("HOME"));
+    exit(2);
+    return 0;
+}`
+
+	code := compile(t, input)
+
+	assertContains(t, code, "h_string* h_argv = NULL;")
+	assertContains(t, code, "int main(int argc, char** argv) {")
+	assertContains(t, code, "h_argv = argv;")
+	assertContains(t, code, "h_string* a = h_argv;")
+	assertContains(t, code, `printf("%s\n", a[(h_argc - 1)]);`)
+	assertContains(t, code, `printf("%s\n", getenv("HOME"));`)
+	assertContains(t, code, "exit(2);")
+}
+
+func TestGenerate_StoredArgsLength(t *testing.T) {
+	input := `function main() {
+    a := args();
+    print(len(a));
+    for _, s := range a {
+        print(s);
+    }
+    a = make([]string, 2);
+    print(len(a));
+}`
+
+	code := compile(t, input)
+
+	assertContains(t, code, `printf("%d\n", h_argc);`)
+	assertContains(t, code, "for (int _ = 0; _ < h_argc; _++) {")
+	// Once reassigned, the variable no longer holds args()
+	assertContains(t, code, `printf("%d\n", (sizeof(a)/sizeof(a[0])));`)
+}
+
+func TestGenerate_ProcessBuiltinErrors(t *testing.T) {
+	input := `function main() string {
+    args(1);
+    getenv();
+    exit(1, 2);
+    return "";
+}`
+
+	l := lexer.New(input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+
+	g := New()
+	g.Generate(program)
+
+	expected := []string{
+		"line 1: main must return int or nothing, not string",
+		"line 2: args takes no arguments, got 1",
+		"line 3: getenv takes 1 argument, got 0",
+		"line 4: exit takes 1 argument, got 2",
+	}
+	if len(g.Errors()) != len(expected) {
+		t.Fatalf("expected %d errors, got %v", len(expected), g.Errors())
+	}
+	for i, want := range expected {
+		if !strings.Contains(g.Errors()[i], want) {
+			t.Errorf("error %d: expected %q, got %q", i, want, g.Errors()[i])
+		}
+	}
+}
+
+func TestTypeOf(t *testing.T) {
+	input := `struct Point { x int; }
+function area(w int, h int) int { return w * h; }
+function log(msg string) {}
+function main() {
+    n := 2;
+    f := 1.5;
+    s := "hi";
+    p := alloc(Point);
+    a := [3]int{1, 2, 3};
+    area(n, 3);
+    log(s);
+    f * 2.0;
+    s;
+    p;
+    p.x;
+    area;
+    n > 1;
+    a;
+}`
+
+	l := lexer.New(input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	g := New()
+	g.Generate(program)
+
+	main := program.Statements[len(program.Statements)-1].(*ast.FunctionStatement)
+	body := main.Body.Statements
+	expected := []string{"int", "void", "float", "string", "*Point", "int", "function(int, int) int", "bool", "[3]int"}
+	for i, want := range expected {
+		expr := body[len(body)-len(expected)+i].(*ast.ExpressionStatement).Expression
+		if got := g.TypeOf(expr); got != want {
+			t.Errorf("TypeOf(%s): expected %q, got %q", expr.String(), want, got)
+		}
+	}
+
+	area := body[len(body)-len(expected)].(*ast.ExpressionStatement).Expression
+	if got := g.ExpressionC(area); got != "area(n, 3)" {
+		t.Errorf("ExpressionC: expected %q, got %q", "area(n, 3)", got)
+	}
+}
+
+func TestGenerate_Extern(t *testing.T) {
+	files := map[string]string{
+		"lib/c.hl": `link "greet"
+link "m"
+
+extern function helper(n int) int
+public extern function report(format string, ...) int
+public function twice(n int) int { return helper(n) * 2; }
+`,
+	}
+	input := `import "lib/c.hl";
+link "m"
+
+extern struct Handle
+extern struct Pair { public a int32; public b uint8; }
+extern function open_handle(name *char) *Handle
+extern function pair_sum(p Pair) int64
+
+function main() {
+    var h *Handle = open_handle("x");
+    report("%d\n", twice(2));
+    var n int64 = pair_sum(Pair{a: 1, b: 2});
+    print(n);
+    var size usize = 3;
+    print(size);
+}`
+
+	g, code := generateWithImports(t, input, files)
+	if len(g.Errors()) > 0 {
+		t.Fatalf("unexpected errors: %v", g.Errors())
+	}
+
+	assertContains(t, code, "typedef struct Handle Handle;")
+	assertContains(t, code, "struct Pair {\n    int32_t a;\n    uint8_t b;\n};")
+	assertContains(t, code, "Handle* open_handle(char* name);")
+	assertContains(t, code, "int64_t pair_sum(Pair p);")
+	assertContains(t, code, "int report(h_string format, ...);")
+	assertContains(t, code, `printf("%lld\n", (long long)n)`)
+	assertContains(t, code, `printf("%zu\n", size)`)
+	if strings.Contains(code, "struct Handle {") || strings.Contains(code, "h_new_Handle") {
+		t.Errorf("expected no definition or helpers for the opaque struct Handle\n\n%s", code)
+	}
+	if strings.Contains(code, "open_handle(char* name) {") {
+		t.Errorf("expected no body for an extern function\n\n%s", code)
+	}
+
+	if libs := strings.Join(g.Libraries(), " "); libs != "greet m" {
+		t.Errorf("expected the libraries greet m, got %q", libs)
+	}
+}
+
+func TestGenerate_ExternFromHeaders(t *testing.T) {
+	input := `cinclude "<math.h>"
+cinclude "vec.h"
+
+extern function sqrt(x float) float
+extern struct Vec { public x int; public y int; }
+
+function main() {
+    v := Vec{x: 3, y: 4};
+    print(sqrt(v.x * v.x + v.y * v.y));
+}`
+
+	code := compile(t, input)
+	assertContains(t, code, "#include <math.h>\n#include \"vec.h\"")
+	for _, absent := range []string{"double sqrt(", "struct Vec {", "typedef struct Vec Vec;"} {
+		if strings.Contains(code, absent) {
+			t.Errorf("expected the headers to declare %q\n\n%s", absent, code)
+		}
+	}
+	assertContains(t, code, "static Vec* h_new_Vec(Vec value)")
+}
+
+func TestGenerate_ExternUnits(t *testing.T) {
+	files := map[string]string{
+		"lib/c.hl": `cinclude "<ctype.h>"
+extern function toupper(c int) int
+extern function shout(s string)
+public function upper(c char) char { return toupper(c); }
+`,
+	}
+	l := lexer.New(`import "lib/c.hl";
+function main() { print(upper('a')); }`)
+	g := New()
+	g.SetImportResolver(func(path, basePath string) (*ast.Program, error) {
+		return parser.New(lexer.New(files[path])).ParseProgram(), nil
+	}, "")
+	units := g.GenerateUnits(parser.New(l).ParseProgram())
+	if len(g.Errors()) > 0 {
+		t.Fatalf("unexpected errors: %v", g.Errors())
+	}
+
+	lib := units[1]
+	assertContains(t, lib.Header, "#include <ctype.h>")
+	// Private C functions keep external linkage, so they link
+	if strings.Contains(lib.Source, "static void shout") {
+		t.Errorf("expected shout not to be static\n\n%s", lib.Source)
+	}
+}
+
+func TestGenerate_ExternErrors(t *testing.T) {
+	input := `extern struct Handle
+extern function take(h *Handle, n int32) int
+extern function scale(x float) float
+extern function logln(format string, ...)
+extern function fill(p *void, n usize)
+
+function main() {
+    h := alloc(Handle);
+    var i int = 1;
+    take(h, 1.5);
+    take(&i, 2);
+    take(null, "3");
+    scale(2);
+    scale();
+    logln();
+    logln("%d %s", 1, "a");
+    var buf [8]char;
+    fill(buf, len(buf));
+    fill(i, 1);
+}`
+
+	l := lexer.New(input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	g := New()
+	g.Generate(program)
+
+	expected := []string{
+		"line 8: cannot allocate Handle: its C fields are not declared",
+		"line 10: cannot use float as int32 in argument 2 to take",
+		"line 11: cannot use *int as *Handle in argument 1 to take",
+		"line 12: cannot use string as int32 in argument 2 to take",
+		"line 14: scale takes 1 argument, got 0",
+		"line 15: logln takes at least 1 argument, got 0",
+		"line 19: cannot use int as *void in argument 1 to fill",
+	}
+	if len(g.Errors()) != len(expected) {
+		t.Fatalf("expected %d errors, got %v", len(expected), g.Errors())
+	}
+	for i, want := range expected {
+		if !strings.Contains(g.Errors()[i], want) {
+			t.Errorf("error %d: expected %q, got %q", i, want, g.Errors()[i])
+		}
+	}
+}
+
+func TestGenerate_LineDirectives(t *testing.T) {
+	input := `import "lib/m.hl";
+
+function f(n int) int {
+    defer print("done");
+    if n > 1 {
+        return twice(n);
+    }
+    return n;
+}
+
+function main() {
+    print(f(2));
+}`
+	files := map[string]string{
+		"lib/m.hl": `public function twice(n int) int {
+    return n * 2;
+}`,
+	}
+
+	program := parser.New(lexer.New(input)).ParseProgram()
+	g := New()
+	g.SetSourceName("dir/prog.hl")
+	g.SetLineDirectives(true)
+	g.SetImportResolver(func(path, basePath string) (*ast.Program, error) {
+		prog := parser.New(lexer.New(files[path])).ParseProgram()
+		prog.File = "dir/" + path
+		return prog, nil
+	}, "dir")
+	code := g.Generate(program)
+	if len(g.Errors()) > 0 {
+		t.Fatalf("unexpected errors: %v", g.Errors())
+	}
+
+	assertContains(t, code, "#line 1 \"dir/lib/m.hl\"\nint twice(int n) {\n#line 2 \"dir/lib/m.hl\"\n")
+	assertContains(t, code, "#line 3 \"dir/prog.hl\"\nint f(int n) {\n#line 5 \"dir/prog.hl\"\n    if ((n > 1)) {")
+	// Deferred code belongs to its defer, and the return to its own line
+	assertContains(t, code, "#line 4 \"dir/prog.hl\"\n        printf(\"%s\\n\", \"done\");\n#line 6 \"dir/prog.hl\"\n        return __ret_val;")
+	assertContains(t, code, "#line 12 \"dir/prog.hl\"\n    printf(\"%d\\n\", f(2));")
+
+	// After each function the C file takes over again, at its own lines
+	lines := strings.Split(code, "\n")
+	resets := 0
+	for i, line := range lines {
+		var n int
+		if _, err := fmt.Sscanf(line, "#line %d \"prog.c\"", &n); err == nil {
+			resets++
+			if n != i+2 {
+				t.Errorf("directive on line %d resets to line %d, want %d", i+1, n, i+2)
+			}
+		}
+	}
+	if resets != 3 {
+		t.Errorf("expected 3 directives back to prog.c, got %d\n\n%s", resets, code)
+	}
+
+	if code := compile(t, input[strings.Index(input, "function main"):]); strings.Contains(code, "#line") {
+		t.Errorf("expected no line directives by default\n\n%s", code)
+	}
+}
+
+func TestGenerateUnits_LineDirectives(t *testing.T) {
+	program := parser.New(lexer.New(`function main() {
+    print(1);
+}`)).ParseProgram()
+	g := New()
+	g.SetSourceName("prog.hl")
+	g.SetLineDirectives(true)
+	units := g.GenerateUnits(program)
+
+	main := units[len(units)-1]
+	assertContains(t, main.Source, "#line 1 \"prog.hl\"\nint main(void) {\n#line 2 \"prog.hl\"\n")
+	lines := strings.Split(main.Source, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "#line") && strings.HasSuffix(line, "\"main.c\"") {
+			if want := fmt.Sprintf("#line %d \"main.c\"", i+2); line != want {
+				t.Errorf("expected %q, got %q", want, line)
+			}
+			return
+		}
+	}
+	t.Errorf("expected a directive back to main.c\n\n%s", main.Source)
+}
+
+func TestGenerate_SourceMap(t *testing.T) {
+	input := `function main() {
+    var n int = 2;
+    if n > 1 {
+        print(n);
+    }
+}`
+	program := parser.New(lexer.New(input)).ParseProgram()
+	g := New()
+	g.SetSourceName("prog.hl")
+	code := g.Generate(program)
+	m := g.SourceMap()
+	if m.File != "prog.c" {
+		t.Errorf("expected the map of prog.c, got %q", m.File)
+	}
+
+	lines := strings.Split(code, "\n")
+	tests := []struct {
+		code   string
+		line   int
+		column int
+		node   string
+	}{
+		{"int main(void) {", 1, 1, "FunctionStatement"},
+		{"    int n = 2;", 2, 5, "VarStatement"},
+		{"    if ((n > 1)) {", 3, 5, "IfStatement"},
+		{`        printf("%d\n", n);`, 4, 9, "ExpressionStatement"},
+	}
+	for _, tt := range tests {
+		i := slices.Index(lines, tt.code)
+		if i < 0 {
+			t.Fatalf("expected the code to contain the line %q\n\n%s", tt.code, code)
+		}
+		got := m.Lookup(i + 1)
+		if got == nil {
+			t.Errorf("expected a mapping for %q", tt.code)
+			continue
+		}
+		if got.Source != "prog.hl" || got.Line != tt.line || got.Column != tt.column || got.Node != tt.node {
+			t.Errorf("%q: expected prog.hl:%d:%d %s, got %s:%d:%d %s", tt.code,
+				tt.line, tt.column, tt.node, got.Source, got.Line, got.Column, got.Node)
+		}
+	}
+	// The preamble is the generator's own
+	if got := m.Lookup(1); got != nil {
+		t.Errorf("expected no mapping for the preamble, got %+v", got)
+	}
+}
+
+func TestGenerate_SourceMapDeclarations(t *testing.T) {
+	files := map[string]string{
+		"lib/geo.hl": `public struct Point {
+    x int;
+}`,
+	}
+	program := parser.New(lexer.New(`import "lib/geo.hl";
+enum Color { Red, Green }
+var origin Point = Point{x: 1};
+var n int = twice(3);
+function twice(a int) int { return a * 2; }
+function main() {
+    print(origin.x + n);
+}`)).ParseProgram()
+	g := New()
+	g.SetSourceName("prog.hl")
+	g.SetImportResolver(func(path, basePath string) (*ast.Program, error) {
+		return parser.New(lexer.New(files[path])).ParseProgram(), nil
+	}, "")
+	code := g.Generate(program)
+	m := g.SourceMap()
+
+	lines := strings.Split(code, "\n")
+	tests := []struct {
+		code   string
+		source string
+		line   int
+		node   string
+	}{
+		{"struct Point {", "lib/geo.hl", 1, "StructStatement"},
+		{"    int x;", "lib/geo.hl", 1, "StructStatement"},
+		{"} Color;", "prog.hl", 2, "EnumStatement"},
+		{"Point origin = {.x = 1};", "prog.hl", 3, "VarStatement"},
+		{"int n;", "prog.hl", 4, "VarStatement"},
+		{"    n = twice(3);", "prog.hl", 4, "VarStatement"},
+	}
+	for _, tt := range tests {
+		i := slices.Index(lines, tt.code)
+		if i < 0 {
+			t.Fatalf("expected the code to contain the line %q\n\n%s", tt.code, code)
+		}
+		got := m.Lookup(i + 1)
+		if got == nil {
+			t.Errorf("expected a mapping for %q", tt.code)
+			continue
+		}
+		if got.Source != tt.source || got.Line != tt.line || got.Node != tt.node {
+			t.Errorf("%q: expected %s:%d %s, got %s:%d %s", tt.code,
+				tt.source, tt.line, tt.node, got.Source, got.Line, got.Node)
+		}
+	}
+	// The struct helpers are the generator's own
+	if i := slices.Index(lines, "static Point* h_new_Point(Point value) {"); i < 0 || m.Lookup(i+1) != nil {
+		t.Errorf("expected no mapping for the struct helpers")
+	}
+}
+
+func TestGenerateUnits_SourceMap(t *testing.T) {
+	files := map[string]string{
+		"lib/m.hl": `public function twice(n int) int {
+    return n * 2;
+}`,
+	}
+	program := parser.New(lexer.New(`import "lib/m.hl";
+function main() {
+    print(twice(2));
+}`)).ParseProgram()
+	g := New()
+	g.SetSourceName("prog.hl")
+	g.SetImportResolver(func(path, basePath string) (*ast.Program, error) {
+		return parser.New(lexer.New(files[path])).ParseProgram(), nil
+	}, "")
+	units := g.GenerateUnits(program)
+
+	if units[0].Map != nil {
+		t.Errorf("expected no map for the runtime unit")
+	}
+	lib := units[1]
+	if lib.Map == nil || lib.Map.File != "lib_m.c" {
+		t.Fatalf("expected the map of lib_m.c, got %+v", lib.Map)
+	}
+	i := slices.Index(strings.Split(lib.Source, "\n"), "    return (n * 2);")
+	if got := lib.Map.Lookup(i + 1); got == nil || got.Source != "lib/m.hl" || got.Line != 2 {
+		t.Errorf("expected the return to map to lib/m.hl:2, got %+v", got)
+	}
+}
@@ -0,0 +1,252 @@
+package codegen
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+)
+
+// cIntegers maps the H names of the C integer types to their C spelling
+var cIntegers = map[string]string{
+	"int8":   "int8_t",
+	"int16":  "int16_t",
+	"int32":  "int32_t",
+	"int64":  "int64_t",
+	"uint8":  "uint8_t",
+	"uint16": "uint16_t",
+	"uint32": "uint32_t",
+	"uint64": "uint64_t",
+	"uint":   "unsigned int",
+	"long":   "long",
+	"ulong":  "unsigned long",
+	"usize":  "size_t",
+}
+
+// integerFormats gives the printf conversion print uses for each C
+// integer type, and the cast that makes the value match it
+var integerFormats = map[string][2]string{
+	"int8_t":        {"%d", "(int)"},
+	"int16_t":       {"%d", "(int)"},
+	"int32_t":       {"%d", "(int)"},
+	"int64_t":       {"%lld", "(long long)"},
+	"uint8_t":       {"%u", "(unsigned int)"},
+	"uint16_t":      {"%u", "(unsigned int)"},
+	"uint32_t":      {"%u", "(unsigned int)"},
+	"uint64_t":      {"%llu", "(unsigned long long)"},
+	"unsigned int":  {"%u", ""},
+	"long":          {"%ld", ""},
+	"unsigned long": {"%lu", ""},
+	"size_t":        {"%zu", ""},
+}
+
+// hIntegerName returns the H name of a C integer type, or ""
+func hIntegerName(cType string) string {
+	for name, c := range cIntegers {
+		if c == cType {
+			return name
+		}
+	}
+	return ""
+}
+
+// collectExtern records the C headers and libraries a module asks for.
+// The extern declarations of a file that includes headers are declared
+// by those headers, so the generator leaves them out.
+func (g *Generator) collectExtern(mod *module) {
+	for _, stmt := range mod.program.Statements {
+		switch s := stmt.(type) {
+		case *ast.CIncludeStatement:
+			mod.includes = append(mod.includes, s.Path)
+		case *ast.LinkStatement:
+			mod.links = append(mod.links, s.Library)
+		}
+	}
+	if len(mod.includes) == 0 {
+		return
+	}
+	for _, stmt := range mod.program.Statements {
+		switch s := stmt.(type) {
+		case *ast.FunctionStatement:
+			if s.Extern {
+				g.fromHeader[s] = true
+			}
+		case *ast.StructStatement:
+			if s.Extern {
+				g.fromHeader[s] = true
+			}
+		}
+	}
+}
+
+// Libraries returns the C libraries the program links against, from the
+// link directives of every module, without duplicates
+func (g *Generator) Libraries() []string {
+	var libs []string
+	seen := make(map[string]bool)
+	for _, mod := range g.modules {
+		for _, lib := range mod.links {
+			if !seen[lib] {
+				seen[lib] = true
+				libs = append(libs, lib)
+			}
+		}
+	}
+	return libs
+}
+
+// writeIncludes emits the cinclude directives of modules, each header
+// once. Paths in angle brackets are system headers.
+func (g *Generator) writeIncludes(mods ...*module) {
+	seen := make(map[string]bool)
+	for _, mod := range mods {
+		for _, path := range mod.includes {
+			if seen[path] {
+				continue
+			}
+			seen[path] = true
+			if strings.HasPrefix(path, "<") {
+				g.writeLine("#include " + path)
+			} else {
+				g.writeLine(fmt.Sprintf("#include \"%s\"", path))
+			}
+		}
+	}
+	if len(seen) > 0 {
+		g.writeLine("")
+	}
+}
+
+// declaresStruct reports whether the generator names a struct type with
+// a typedef: every struct except the extern ones that headers declare
+func (g *Generator) declaresStruct(s *ast.StructStatement) bool {
+	return !g.fromHeader[s]
+}
+
+// definedStructs filters out the structs the generator does not define:
+// opaque extern structs and those that headers declare
+func (g *Generator) definedStructs(structs []*ast.StructStatement) []*ast.StructStatement {
+	var defined []*ast.StructStatement
+	for _, s := range structs {
+		if !s.Extern || (s.Fields != nil && !g.fromHeader[s]) {
+			defined = append(defined, s)
+		}
+	}
+	return defined
+}
+
+// completeStructs filters out opaque extern structs, whose size is
+// unknown, for the helpers that copy and compare struct values
+func completeStructs(structs []*ast.StructStatement) []*ast.StructStatement {
+	var complete []*ast.StructStatement
+	for _, s := range structs {
+		if s.Fields != nil {
+			complete = append(complete, s)
+		}
+	}
+	return complete
+}
+
+// isOpaque reports whether a C type names an extern struct without fields
+func (g *Generator) isOpaque(cType string) bool {
+	s, ok := g.structs[cType]
+	return ok && s.Extern && s.Fields == nil
+}
+
+// checkExternCall checks the arguments of a call to a C function against
+// its declaration, since the C compiler converts most mismatches silently
+func (g *Generator) checkExternCall(e *ast.CallExpression, f *ast.FunctionStatement) {
+	name := f.Name.Value
+	params := len(f.Parameters)
+	switch {
+	case f.Variadic && len(e.Arguments) < params:
+		g.errorf(e.Token.Line, "%s takes at least %s, got %d", name, arguments(params), len(e.Arguments))
+		return
+	case !f.Variadic && len(e.Arguments) != params:
+		g.errorf(e.Token.Line, "%s takes %s, got %d", name, arguments(params), len(e.Arguments))
+		return
+	}
+	for i, param := range f.Parameters {
+		want := g.typeToC(param.Type)
+		got := g.inferType(e.Arguments[i])
+		if !g.convertsTo(got, want) {
+			g.errorf(e.Token.Line, "cannot use %s as %s in argument %d to %s",
+				hType(got), param.Type.String(), i+1, name)
+		}
+	}
+}
+
+// arguments spells out a number of arguments
+func arguments(n int) string {
+	switch n {
+	case 0:
+		return "no arguments"
+	case 1:
+		return "1 argument"
+	}
+	return fmt.Sprintf("%d arguments", n)
+}
+
+// convertsTo reports whether a value of C type got may be passed where C
+// expects want. Integers of every size convert to each other and to
+// floating point; pointers only convert to pointers to the same type,
+// except through void pointers and null.
+func (g *Generator) convertsTo(got, want string) bool {
+	switch {
+	case got == want:
+		return true
+	case g.isInteger(want):
+		return g.isInteger(got)
+	case want == "double" || want == "float":
+		return g.isInteger(got) || got == "double" || got == "float"
+	case isCPointer(want):
+		if got == "void*" {
+			return true
+		}
+		target := pointerTarget(got)
+		return target != "" && (want == "void*" || target == pointerTarget(want))
+	case g.isStructValue(want):
+		return false
+	}
+	// Function pointers and anything else are left to the C compiler
+	return true
+}
+
+// isInteger reports whether a C type is an integer type, enums and
+// characters included
+func (g *Generator) isInteger(cType string) bool {
+	switch cType {
+	case "int", "char", "bool":
+		return true
+	}
+	if _, ok := integerFormats[cType]; ok {
+		return true
+	}
+	_, ok := g.enums[cType]
+	return ok
+}
+
+// isCPointer reports whether a C type is a data pointer; strings are
+// char pointers
+func isCPointer(cType string) bool {
+	return cType == "h_string" || (strings.HasSuffix(cType, "*") && !strings.Contains(cType, "("))
+}
+
+// pointerTarget returns the type a pointer-like value points to: the
+// target of a pointer, the element of an array or "char" for strings.
+// It returns "" for other values.
+func pointerTarget(cType string) string {
+	switch {
+	case cType == "h_string":
+		return "char"
+	case cType == "h_map*":
+		return "h_map"
+	case strings.Contains(cType, "("):
+		return ""
+	case strings.HasSuffix(cType, "*"):
+		return strings.TrimSuffix(cType, "*")
+	case strings.HasSuffix(cType, "]"):
+		return elementType(cType)
+	}
+	return ""
+}
@@ -0,0 +1,456 @@
+package codegen
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+)
+
+// global is a module-level variable or constant
+type global struct {
+	cName   string // the name of its C variable
+	cType   string
+	module  string // import path of the declaring module, "" for the main program
+	public  bool
+	isConst bool
+	static  bool   // emitted as const data, so it never points into the heap
+	decl    string // C declaration without initialiser, for extern declarations
+	data    string // the static array a slice literal's elements are stored in
+}
+
+// module is one source file's module-level state: its globals in source
+// order and its optional init function
+type module struct {
+	path     string
+	index    int // position in dependency order
+	program  *ast.Program
+	imports  []string        // paths of the modules it imports directly
+	globals  []ast.Statement // *ast.VarStatement or *ast.ConstStatement
+	init     *ast.FunctionStatement
+	runtime  []ast.Statement // globals that need code to initialise
+	tests    []*ast.TestStatement
+	includes []string // C headers named by cinclude directives
+	links    []string // C libraries named by link directives
+}
+
+// isInitFunction reports whether f is a module initialiser
+func isInitFunction(f *ast.FunctionStatement) bool {
+	return f.Receiver == nil && f.Name.Value == "init"
+}
+
+// collectModule records the globals and init function of a module
+func (g *Generator) collectModule(path string, program *ast.Program) *module {
+	mod := &module{path: path, index: len(g.modules), program: program}
+	for _, stmt := range program.Statements {
+		switch s := stmt.(type) {
+		case *ast.ImportStatement:
+			mod.imports = append(mod.imports, s.Path)
+		case *ast.VarStatement, *ast.ConstStatement:
+			mod.globals = append(mod.globals, s)
+		case *ast.StructStatement, *ast.EnumStatement:
+			g.typeModules[s] = path
+		case *ast.TestStatement:
+			g.collectTest(mod, s)
+		case *ast.FunctionStatement:
+			g.funcModules[s] = path
+			if !isInitFunction(s) {
+				continue
+			}
+			if mod.init != nil {
+				g.errorf(s.Token.Line, "init is declared more than once")
+				continue
+			}
+			if len(s.Parameters) > 0 || s.ReturnType != nil {
+				g.errorf(s.Token.Line, "init must take no parameters and return nothing")
+			}
+			mod.init = s
+			g.initNames[s] = fmt.Sprintf("h_init_%d", mod.index)
+		}
+	}
+	g.collectExtern(mod)
+	g.modules = append(g.modules, mod)
+	return mod
+}
+
+// lookupVar returns the C type of a local variable or, failing that, of
+// a global
+func (g *Generator) lookupVar(name string) (string, bool) {
+	if cType, ok := g.variables[name]; ok {
+		return cType, true
+	}
+	if gl := g.global(name); gl != nil {
+		return gl.cType, true
+	}
+	return "", false
+}
+
+// globalFor returns the global an identifier refers to in the current
+// function, or nil if it names a local or something else
+func (g *Generator) globalFor(name string) *global {
+	if _, local := g.variables[name]; local {
+		return nil
+	}
+	return g.global(name)
+}
+
+// global returns the global a name refers to in the module being
+// generated: one of its own private globals, or one the main program or
+// a public declaration makes visible. Failing those, it returns another
+// module's private global, so that the use is reported as not public.
+func (g *Generator) global(name string) *global {
+	if gl := g.moduleGlobal(g.module, name); gl != nil {
+		return gl
+	}
+	for _, mod := range g.modules {
+		if gl := g.private[mod.path][name]; gl != nil {
+			return gl
+		}
+	}
+	return nil
+}
+
+// moduleGlobal returns the global a name refers to in a module, or nil
+func (g *Generator) moduleGlobal(path, name string) *global {
+	if gl := g.private[path][name]; gl != nil {
+		return gl
+	}
+	return g.globals[name]
+}
+
+// privateName names the C variable of a private global of an imported
+// module, so that modules can use the same names for their own
+func privateName(mod *module, name string) string {
+	return fmt.Sprintf("h_%d_%s", mod.index, name)
+}
+
+// generateGlobals emits the storage for every module's globals, imported
+// modules first. Globals with constant initialisers become static data;
+// the rest are zeroed here and assigned in h_init.
+func (g *Generator) generateGlobals() {
+	emitted := false
+	for _, mod := range g.modules {
+		g.module = mod.path
+		for _, stmt := range mod.globals {
+			g.mark(stmt, statementToken(stmt))
+			g.generateGlobal(mod, stmt)
+			emitted = true
+		}
+	}
+	if emitted {
+		g.unmark()
+	}
+	g.module = ""
+	if emitted {
+		g.writeLine("")
+	}
+}
+
+func (g *Generator) generateGlobal(mod *module, stmt ast.Statement) {
+	var name *ast.Identifier
+	var typ *ast.TypeAnnotation
+	var value ast.Expression
+	var public, isConst bool
+	switch s := stmt.(type) {
+	case *ast.VarStatement:
+		name, typ, value, public = s.Name, s.Type, s.Value, s.Public
+	case *ast.ConstStatement:
+		name, typ, value, public, isConst = s.Name, s.Type, s.Value, s.Public, true
+	}
+
+	// Imported modules keep their private globals to themselves
+	scope, cName := g.globals, name.Value
+	if mod.path != "" && !public {
+		if g.private[mod.path] == nil {
+			g.private[mod.path] = make(map[string]*global)
+		}
+		scope, cName = g.private[mod.path], privateName(mod, name.Value)
+	}
+	if _, exists := scope[name.Value]; exists {
+		g.errorf(name.Token.Line, "%s is already declared at module level", name.Value)
+		return
+	}
+	if _, exists := g.functions[name.Value]; exists {
+		g.errorf(name.Token.Line, "%s is already declared as a function", name.Value)
+		return
+	}
+
+	var cType, decl string
+	if typ == nil {
+		switch v := value.(type) {
+		case *ast.ArrayLiteral:
+			if v.Type != nil && v.Type.ArrayLen == -1 && len(v.Elements) > 0 {
+				// A slice literal at module level is a fixed array of its elements
+				typ = &ast.TypeAnnotation{ArrayLen: len(v.Elements), Elem: v.Type.Element()}
+			} else {
+				typ = v.Type
+			}
+		case *ast.MapLiteral:
+			typ = v.Type
+		case *ast.MakeExpression:
+			if v.Type.IsMap {
+				typ = v.Type
+			} else {
+				typ = &ast.TypeAnnotation{ArrayLen: -1, Elem: makeElement(v.Type)}
+			}
+		}
+	}
+	if typ != nil {
+		cType = g.typeToC(typ)
+		decl = g.declare(typ, cName)
+	} else {
+		cType = g.inferType(value)
+		decl = declareC(cType, cName)
+	}
+
+	// Separately compiled modules keep everything but their exports private
+	storage := ""
+	if g.units && mod.path != "" && !public {
+		storage = "static "
+	}
+
+	static, data := false, ""
+	lit, isSlice := value.(*ast.ArrayLiteral)
+	isSlice = isSlice && typ != nil && typ.ArrayLen == -1
+	if isSlice && len(lit.Elements) == 0 {
+		g.writeLine(storage + decl + " = NULL;")
+	} else if isSlice {
+		// The elements of a slice literal are stored in a static array
+		// the slice points to
+		data = sliceData(cName)
+		backing := g.declare(&ast.TypeAnnotation{ArrayLen: len(lit.Elements), Elem: typ.Element()}, data)
+		if isConst {
+			decl = "const " + decl
+		}
+		if g.isConstantExpr(lit) {
+			if isConst {
+				backing = "const " + backing
+			}
+			g.writeLine(fmt.Sprintf("static %s = %s;", backing, g.staticInitializer(lit)))
+		} else {
+			g.writeLine(fmt.Sprintf("static %s;", backing))
+			mod.runtime = append(mod.runtime, stmt)
+		}
+		g.writeLine(fmt.Sprintf("%s%s = %s;", storage, decl, data))
+	} else if value == nil {
+		g.writeLine(storage + decl + ";")
+	} else if g.isConstantExpr(value) {
+		static = isConst
+		if isConst {
+			decl = "const " + decl
+		}
+		g.writeLine(fmt.Sprintf("%s%s = %s;", storage, decl, g.staticInitializer(value)))
+	} else {
+		// Assigned before main runs, so it cannot be const in C; the
+		// generator rejects assignments to it instead
+		g.writeLine(storage + decl + ";")
+		mod.runtime = append(mod.runtime, stmt)
+	}
+
+	scope[name.Value] = &global{cName: cName, cType: cType, module: mod.path, public: public, isConst: isConst, static: static, decl: decl, data: data}
+}
+
+// sliceData names the static array holding the elements of a global
+// slice literal
+func sliceData(name string) string {
+	return "h_data_" + name
+}
+
+// generateInit emits h_init, which runs before main: it registers the
+// globals with the collector, then for each module in import order
+// assigns its computed globals and calls its init function
+func (g *Generator) generateInit() {
+	if !g.needsInit() {
+		return
+	}
+
+	g.writeLine("static void h_init(void) {")
+	g.indent++
+	g.variables = make(map[string]string)
+	g.argsVars = make(map[string]bool)
+
+	if g.gc {
+		for _, name := range g.gcRoots() {
+			g.writeLine(fmt.Sprintf("h_gc_add_root(&%s, sizeof(%s));", name, name))
+		}
+	}
+
+	for _, mod := range g.modules {
+		g.module = mod.path
+		g.generateModuleInit(mod)
+	}
+	g.module = ""
+
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("")
+}
+
+// generateModuleInit assigns a module's computed globals, then calls its
+// init function
+func (g *Generator) generateModuleInit(mod *module) {
+	for _, stmt := range mod.runtime {
+		gl := g.moduleGlobal(mod.path, globalName(stmt))
+		g.mark(stmt, statementToken(stmt))
+		if lit, ok := globalValue(stmt).(*ast.ArrayLiteral); ok && gl.data != "" {
+			// Fill the static array the slice points to
+			for i, el := range lit.Elements {
+				g.writeLine(fmt.Sprintf("%s[%d] = %s;", gl.data, i, g.generateExpression(el)))
+			}
+			continue
+		}
+		g.generateGlobalInit(gl.cName, gl.cType, globalValue(stmt))
+	}
+	if len(mod.runtime) > 0 {
+		g.unmark()
+	}
+	if mod.init != nil {
+		g.writeLine(g.initNames[mod.init] + "();")
+	}
+}
+
+// gcRoots returns the globals the collector must scan
+func (g *Generator) gcRoots() []string {
+	var roots []string
+	for _, mod := range g.modules {
+		roots = append(roots, g.moduleRoots(mod)...)
+	}
+	return roots
+}
+
+// moduleRoots returns the globals of one module the collector must scan
+func (g *Generator) moduleRoots(mod *module) []string {
+	var roots []string
+	for _, stmt := range mod.globals {
+		if gl := g.moduleGlobal(mod.path, globalName(stmt)); gl != nil && !gl.static {
+			roots = append(roots, gl.cName)
+		}
+	}
+	return roots
+}
+
+// needsInit reports whether the program has anything for h_init to do
+func (g *Generator) needsInit() bool {
+	for _, mod := range g.modules {
+		if g.moduleNeedsInit(mod) {
+			return true
+		}
+	}
+	return false
+}
+
+// moduleNeedsInit reports whether a module has globals to register or
+// assign, or an init function, before main runs
+func (g *Generator) moduleNeedsInit(mod *module) bool {
+	if g.gc && len(g.moduleRoots(mod)) > 0 {
+		return true
+	}
+	return len(mod.runtime) > 0 || mod.init != nil
+}
+
+// generateGlobalInit assigns a global whose initialiser is computed at
+// startup
+func (g *Generator) generateGlobalInit(name, cType string, value ast.Expression) {
+	switch v := value.(type) {
+	case *ast.MapLiteral:
+		g.writeLine(fmt.Sprintf("%s = h_map_new();", name))
+		g.generateMapPairs(name, v)
+		return
+	case *ast.ArrayLiteral:
+		// Arrays cannot be assigned in C; copy from a compound literal
+		g.writeLine(fmt.Sprintf("memcpy(%s, (%s)%s, sizeof(%s));", name, cType, g.generateExpression(v), name))
+		return
+	}
+	g.writeLine(fmt.Sprintf("%s = %s;", name, g.generateExpression(value)))
+}
+
+func globalName(stmt ast.Statement) string {
+	switch s := stmt.(type) {
+	case *ast.VarStatement:
+		return s.Name.Value
+	case *ast.ConstStatement:
+		return s.Name.Value
+	}
+	return ""
+}
+
+func globalValue(stmt ast.Statement) ast.Expression {
+	switch s := stmt.(type) {
+	case *ast.VarStatement:
+		return s.Value
+	case *ast.ConstStatement:
+		return s.Value
+	}
+	return nil
+}
+
+// isConstantExpr reports whether expr is a C constant expression that
+// static storage can be initialised with
+func (g *Generator) isConstantExpr(expr ast.Expression) bool {
+	switch e := expr.(type) {
+	case *ast.IntegerLiteral, *ast.FloatLiteral, *ast.StringLiteral,
+		*ast.CharLiteral, *ast.BooleanLiteral, *ast.NullLiteral:
+		return true
+	case *ast.Identifier:
+		// Enum values are C constants and function names are addresses
+		_, isFunc := g.functions[e.Value]
+		return isFunc || g.isEnumValue(e.Value)
+	case *ast.PrefixExpression:
+		return e.Operator != "&" && e.Operator != "*" && g.isConstantExpr(e.Right)
+	case *ast.InfixExpression:
+		if g.isStringExpr(e) || g.isStructValue(g.inferType(e.Left)) {
+			return false
+		}
+		return g.isConstantExpr(e.Left) && g.isConstantExpr(e.Right)
+	case *ast.CastExpression:
+		return g.isConstantExpr(e.Value)
+	case *ast.ArrayLiteral:
+		for _, el := range e.Elements {
+			if !g.isConstantExpr(el) {
+				return false
+			}
+		}
+		return true
+	case *ast.StructLiteral:
+		for _, f := range e.Fields {
+			if !g.isConstantExpr(f.Value) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// isEnumValue reports whether name is a generated enum constant such as
+// Color_Red
+func (g *Generator) isEnumValue(name string) bool {
+	for enumName, s := range g.enums {
+		if !strings.HasPrefix(name, enumName+"_") {
+			continue
+		}
+		for _, v := range s.Values {
+			if enumName+"_"+v.Name.Value == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// staticInitializer renders a constant expression as a C initialiser.
+// Struct and array literals become plain brace lists, which unlike
+// compound literals are valid for static storage.
+func (g *Generator) staticInitializer(expr ast.Expression) string {
+	switch e := expr.(type) {
+	case *ast.StructLiteral:
+		return g.structInitializer(e, g.staticInitializer)
+	case *ast.ArrayLiteral:
+		var elements []string
+		for _, el := range e.Elements {
+			elements = append(elements, g.staticInitializer(el))
+		}
+		return fmt.Sprintf("{%s}", strings.Join(elements, ", "))
+	}
+	return g.generateExpression(expr)
+}
@@ -0,0 +1,135 @@
+package codegen
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+)
+
+// SetLineDirectives makes the generator emit #line directives before
+// every function and statement, so that C compiler diagnostics, __LINE__
+// and debuggers refer to the H source instead of the generated C. The
+// code the generator adds itself keeps pointing into the C file.
+func (g *Generator) SetLineDirectives(enabled bool) {
+	g.lineDirectives = enabled
+}
+
+// SetCFileName sets the name of the C file Generate's output is written
+// to, which line directives point back to after each function. It
+// defaults to the source name with a .c extension.
+func (g *Generator) SetCFileName(name string) {
+	g.cFile = name
+}
+
+// sourceFile returns the name of the H file the module being generated
+// was read from: the path its resolver found for an import, or its
+// import path, and the source name for the main program
+func (g *Generator) sourceFile() string {
+	if mod := g.moduleByPath(g.module); mod != nil && mod.program.File != "" {
+		return mod.program.File
+	}
+	if g.module != "" {
+		return g.module
+	}
+	return g.sourceName
+}
+
+// cFileName returns the name of the C file being generated
+func (g *Generator) cFileName() string {
+	if g.cFile != "" {
+		return g.cFile
+	}
+	if g.sourceName == "" {
+		return ""
+	}
+	return strings.TrimSuffix(filepath.Base(g.sourceName), ".hl") + ".c"
+}
+
+// mark starts the C code of a declaration or statement: it opens the
+// node's mapping in the source map and, with line directives,
+// attributes the lines that follow to the node's line
+func (g *Generator) mark(node ast.Node, tok lexer.Token) {
+	file := g.sourceFile()
+	if tok.Line <= 0 || file == "" {
+		return
+	}
+	g.closeMapping()
+	if g.lineDirectives {
+		g.write(fmt.Sprintf("#line %d %s\n", tok.Line, cQuote(file)))
+	}
+	g.openMapping(Mapping{Source: file, Line: tok.Line, Column: tok.Column, Node: nodeKind(node)})
+}
+
+// markType starts the C code of a struct or enum, attributing it to the
+// module that declares it. The function it returns restores the module
+// being generated.
+func (g *Generator) markType(node ast.Node, tok lexer.Token) func() {
+	module := g.module
+	g.module = g.typeModules[node.(ast.Statement)]
+	g.mark(node, tok)
+	return func() { g.module = module }
+}
+
+// unmark ends the C code of a function, which the code after it does
+// not belong to
+func (g *Generator) unmark() {
+	g.closeMapping()
+	file := g.cFileName()
+	if !g.lineDirectives || file == "" {
+		return
+	}
+	// The directive gives the number of the line after it
+	g.write(fmt.Sprintf("#line %d %s\n", g.cLine()+1, cQuote(file)))
+}
+
+// cLine returns the number of the C line about to be written, counting
+// the newlines written since the last call
+func (g *Generator) cLine() int {
+	out := g.output.Bytes()
+	g.lines += bytes.Count(out[g.counted:], []byte("\n"))
+	g.counted = len(out)
+	return g.lines + 1
+}
+
+// statementToken returns the token a statement starts with. A defer
+// emits nothing where it stands, so it has no token; the statement it
+// defers is attributed to itself.
+func statementToken(stmt ast.Statement) lexer.Token {
+	switch s := stmt.(type) {
+	case *ast.VarStatement:
+		return s.Token
+	case *ast.ConstStatement:
+		return s.Token
+	case *ast.InferStatement:
+		return s.Name.Token
+	case *ast.ReturnStatement:
+		return s.Token
+	case *ast.ExpressionStatement:
+		return s.Token
+	case *ast.BlockStatement:
+		return s.Token
+	case *ast.IfStatement:
+		return s.Token
+	case *ast.ForStatement:
+		return s.Token
+	case *ast.WhileStatement:
+		return s.Token
+	case *ast.ForRangeStatement:
+		return s.Token
+	case *ast.FreeStatement:
+		return s.Token
+	case *ast.BreakStatement:
+		return s.Token
+	case *ast.ContinueStatement:
+		return s.Token
+	case *ast.DeleteStatement:
+		return s.Token
+	case *ast.TestStatement:
+		return s.Token
+	}
+	return lexer.Token{}
+}
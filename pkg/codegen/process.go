@@ -0,0 +1,104 @@
+package codegen
+
+import (
+	"fmt"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+)
+
+// processBuiltins maps the builtins that talk to the process to the C type
+// of their result
+var processBuiltins = map[string]string{
+	"args":   "h_string*",
+	"getenv": "h_string",
+	"exit":   "void",
+}
+
+// argsPrototypes declares the program's command-line arguments, which
+// main stores for args()
+var argsPrototypes = []string{
+	"extern int h_argc;",
+	"extern h_string* h_argv;",
+}
+
+// processBuiltin returns the name of the process builtin a call invokes.
+// A function of the same name shadows the builtin.
+func (g *Generator) processBuiltin(call *ast.CallExpression) (string, bool) {
+	ident, ok := call.Function.(*ast.Identifier)
+	if !ok {
+		return "", false
+	}
+	if _, builtin := processBuiltins[ident.Value]; !builtin {
+		return "", false
+	}
+	if _, declared := g.functions[ident.Value]; declared {
+		return "", false
+	}
+	return ident.Value, true
+}
+
+// generateProcessBuiltin emits args(), getenv(name) or exit(code)
+func (g *Generator) generateProcessBuiltin(e *ast.CallExpression, name string) string {
+	if name == "args" && len(e.Arguments) != 0 {
+		g.errorf(e.Token.Line, "args takes no arguments, got %d", len(e.Arguments))
+		return "h_argv"
+	}
+	if name != "args" && len(e.Arguments) != 1 {
+		g.errorf(e.Token.Line, "%s takes 1 argument, got %d", name, len(e.Arguments))
+		return "0"
+	}
+
+	switch name {
+	case "args":
+		// argv is null-terminated, so the slice is too
+		return "h_argv"
+	case "getenv":
+		return fmt.Sprintf("getenv(%s)", g.generateExpression(e.Arguments[0]))
+	}
+	return fmt.Sprintf("exit(%s)", g.generateExpression(e.Arguments[0]))
+}
+
+// isArgsCall reports whether an expression is a call to args()
+func (g *Generator) isArgsCall(e ast.Expression) bool {
+	call, ok := e.(*ast.CallExpression)
+	if !ok {
+		return false
+	}
+	name, ok := g.processBuiltin(call)
+	return ok && name == "args"
+}
+
+// isArgs reports whether an expression is args() or a local variable
+// holding it, whose length is known
+func (g *Generator) isArgs(e ast.Expression) bool {
+	if id, ok := e.(*ast.Identifier); ok {
+		return g.argsVars[id.Value]
+	}
+	return g.isArgsCall(e)
+}
+
+// trackArgs records whether a local variable is assigned args() or
+// something else
+func (g *Generator) trackArgs(name string, value ast.Expression) {
+	if value != nil && g.isArgs(value) {
+		g.argsVars[name] = true
+	} else {
+		delete(g.argsVars, name)
+	}
+}
+
+// writeArgs emits the variables holding the command-line arguments
+func (g *Generator) writeArgs() {
+	g.writeLine("int h_argc = 0;")
+	g.writeLine("h_string* h_argv = NULL;")
+	g.writeLine("")
+}
+
+// needsArgs reports whether any module calls args(), in which case main
+// takes the command line and stores it
+func (g *Generator) needsArgs() bool {
+	return g.anyNode(func(n ast.Node) bool {
+		e, ok := n.(ast.Expression)
+		return ok && g.isArgsCall(e)
+	})
+}
@@ -0,0 +1,98 @@
+package codegen
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+)
+
+// TypeOf returns the type of an expression, spelled in H, as the
+// generator infers it in the scope of the function it generated last.
+// Calls to functions without a result have type void.
+func (g *Generator) TypeOf(expr ast.Expression) string {
+	switch e := expr.(type) {
+	case *ast.Identifier:
+		if _, ok := g.lookupVar(e.Value); !ok {
+			if fn, ok := g.functions[e.Value]; ok {
+				return functionType(fn).String()
+			}
+		}
+	case *ast.CallExpression:
+		if g.isVoidCall(e) {
+			return "void"
+		}
+	case *ast.ArrayLiteral:
+		if e.Type != nil {
+			return e.Type.String()
+		}
+	}
+	return hType(g.inferType(expr))
+}
+
+// ExpressionC returns the C translation of an expression in the scope of
+// the function the generator generated last
+func (g *Generator) ExpressionC(expr ast.Expression) string {
+	return g.generateExpression(expr)
+}
+
+// isVoidCall reports whether a call has no result
+func (g *Generator) isVoidCall(e *ast.CallExpression) bool {
+	if g.isAssert(e) {
+		return true
+	}
+	if name, ok := g.processBuiltin(e); ok {
+		return processBuiltins[name] == "void"
+	}
+	switch fn := e.Function.(type) {
+	case *ast.Identifier:
+		if f, ok := g.functions[fn.Value]; ok {
+			return f.ReturnType == nil
+		}
+		_, isVar := g.lookupVar(fn.Value)
+		return fn.Value == "print" && !isVar
+	case *ast.MemberExpression:
+		if m := g.methodFor(fn); m != nil {
+			return m.ReturnType == nil
+		}
+	}
+	return false
+}
+
+// functionType returns the type of a function used as a value
+func functionType(f *ast.FunctionStatement) *ast.TypeAnnotation {
+	t := &ast.TypeAnnotation{IsFunc: true, ReturnType: f.ReturnType}
+	for _, p := range f.Parameters {
+		t.Params = append(t.Params, p.Type)
+	}
+	return t
+}
+
+// cArray matches a C array suffix such as "[3]" or "[]"
+var cArray = regexp.MustCompile(`\[(\d*)\]$`)
+
+// hType spells a C type as inferred by the generator in H. Slices are
+// plain pointers in C, so they read back as pointers.
+func hType(cType string) string {
+	cType = strings.TrimSpace(cType)
+	switch cType {
+	case "double":
+		return "float"
+	case "h_string":
+		return "string"
+	case "h_map*":
+		return "map"
+	case "void*":
+		return "null"
+	}
+	if name := hIntegerName(cType); name != "" {
+		return name
+	}
+	if m := cArray.FindStringSubmatch(cType); m != nil {
+		return "[" + m[1] + "]" + hType(strings.TrimSuffix(cType, m[0]))
+	}
+	if strings.HasSuffix(cType, "*") && !strings.Contains(cType, "(") {
+		return "*" + hType(strings.TrimSuffix(cType, "*"))
+	}
+	return cType
+}
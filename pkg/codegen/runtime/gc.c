@@ -0,0 +1,182 @@
+// H-lang conservative mark-and-sweep garbage collector
+//
+// Linked into programs compiled with `hlc -gc`. Every heap object is
+// tracked in an address-sorted table of (start, size) pairs. Collection scans
+// the C stack, saved registers and any registered root ranges word by word;
+// anything that looks like a pointer into a tracked object keeps it alive.
+
+#include <setjmp.h>
+
+typedef struct h_gc_object {
+    char* start;
+    size_t size;
+    int marked;
+} h_gc_object;
+
+typedef struct {
+    void* start;
+    size_t size;
+} h_gc_root;
+
+static h_gc_object* h_gc_objects = NULL;
+static size_t h_gc_count = 0;
+static size_t h_gc_capacity = 0;
+static int h_gc_sorted = 1;
+
+static h_gc_root* h_gc_roots = NULL;
+static size_t h_gc_root_count = 0;
+
+static char* h_gc_stack_bottom = NULL;
+static size_t h_gc_allocated = 0;
+static size_t h_gc_threshold = 1 << 20;
+
+static void h_gc_oom(void) {
+    fprintf(stderr, "fatal: out of memory\n");
+    exit(1);
+}
+
+void h_gc_init(void* stack_bottom) {
+    h_gc_stack_bottom = (char*)stack_bottom;
+}
+
+void h_gc_add_root(void* start, size_t size) {
+    h_gc_roots = (h_gc_root*)realloc(h_gc_roots, (h_gc_root_count + 1) * sizeof(h_gc_root));
+    if (!h_gc_roots) h_gc_oom();
+    h_gc_roots[h_gc_root_count].start = start;
+    h_gc_roots[h_gc_root_count].size = size;
+    h_gc_root_count++;
+}
+
+static int h_gc_compare(const void* a, const void* b) {
+    const char* x = ((const h_gc_object*)a)->start;
+    const char* y = ((const h_gc_object*)b)->start;
+    return (x > y) - (x < y);
+}
+
+static h_gc_object* h_gc_find(char* p) {
+    size_t lo = 0, hi = h_gc_count;
+    while (lo < hi) {
+        size_t mid = lo + (hi - lo) / 2;
+        h_gc_object* obj = &h_gc_objects[mid];
+        if (p < obj->start) {
+            hi = mid;
+        } else if (p >= obj->start + (obj->size ? obj->size : 1)) {
+            lo = mid + 1;
+        } else {
+            return obj;
+        }
+    }
+    return NULL;
+}
+
+static h_gc_object** h_gc_mark_stack = NULL;
+static size_t h_gc_mark_top = 0;
+static size_t h_gc_mark_cap = 0;
+
+static void h_gc_scan(char* start, char* end) {
+    uintptr_t align = sizeof(void*) - 1;
+    char* p = (char*)(((uintptr_t)start + align) & ~align);
+    for (; p + sizeof(void*) <= end; p += sizeof(void*)) {
+        h_gc_object* obj = h_gc_find(*(char**)p);
+        if (obj && !obj->marked) {
+            obj->marked = 1;
+            if (h_gc_mark_top == h_gc_mark_cap) {
+                h_gc_mark_cap = h_gc_mark_cap ? h_gc_mark_cap * 2 : 64;
+                h_gc_mark_stack = (h_gc_object**)realloc(h_gc_mark_stack, h_gc_mark_cap * sizeof(h_gc_object*));
+                if (!h_gc_mark_stack) h_gc_oom();
+            }
+            h_gc_mark_stack[h_gc_mark_top++] = obj;
+        }
+    }
+}
+
+static void __attribute__((noinline)) h_gc_mark_roots(void) {
+    jmp_buf regs;
+    setjmp(regs);
+    char* sp = (char*)&regs;
+
+    // Registers spilled by setjmp, then the live part of the stack
+    h_gc_scan((char*)&regs, (char*)&regs + sizeof(regs));
+    if (h_gc_stack_bottom) {
+        if (sp < h_gc_stack_bottom) {
+            h_gc_scan(sp, h_gc_stack_bottom);
+        } else {
+            h_gc_scan(h_gc_stack_bottom, sp);
+        }
+    }
+    for (size_t i = 0; i < h_gc_root_count; i++) {
+        char* start = (char*)h_gc_roots[i].start;
+        h_gc_scan(start, start + h_gc_roots[i].size);
+    }
+}
+
+void h_gc_collect(void) {
+    if (!h_gc_sorted) {
+        qsort(h_gc_objects, h_gc_count, sizeof(h_gc_object), h_gc_compare);
+        h_gc_sorted = 1;
+    }
+
+    // Mark everything reachable from the roots
+    h_gc_mark_roots();
+    while (h_gc_mark_top > 0) {
+        h_gc_object* obj = h_gc_mark_stack[--h_gc_mark_top];
+        h_gc_scan(obj->start, obj->start + obj->size);
+    }
+
+    // Sweep unmarked objects and compact the table
+    size_t live = 0;
+    size_t live_bytes = 0;
+    for (size_t i = 0; i < h_gc_count; i++) {
+        if (h_gc_objects[i].marked) {
+            h_gc_objects[i].marked = 0;
+            live_bytes += h_gc_objects[i].size;
+            h_gc_objects[live++] = h_gc_objects[i];
+        } else {
+            free(h_gc_objects[i].start);
+        }
+    }
+    h_gc_count = live;
+    h_gc_allocated = 0;
+    if (live_bytes * 2 > h_gc_threshold) {
+        h_gc_threshold = live_bytes * 2;
+    }
+}
+
+void* h_gc_alloc(size_t size) {
+    if (h_gc_allocated + size > h_gc_threshold) {
+        h_gc_collect();
+    }
+    char* mem = (char*)calloc(1, size ? size : 1);
+    if (!mem) {
+        h_gc_collect();
+        mem = (char*)calloc(1, size ? size : 1);
+        if (!mem) h_gc_oom();
+    }
+    if (h_gc_count == h_gc_capacity) {
+        h_gc_capacity = h_gc_capacity ? h_gc_capacity * 2 : 256;
+        h_gc_objects = (h_gc_object*)realloc(h_gc_objects, h_gc_capacity * sizeof(h_gc_object));
+        if (!h_gc_objects) h_gc_oom();
+    }
+    if (h_gc_count > 0 && mem < h_gc_objects[h_gc_count - 1].start) {
+        h_gc_sorted = 0;
+    }
+    h_gc_objects[h_gc_count].start = mem;
+    h_gc_objects[h_gc_count].size = size;
+    h_gc_objects[h_gc_count].marked = 0;
+    h_gc_count++;
+    h_gc_allocated += size;
+    return mem;
+}
+
+char* h_gc_strdup(const char* s) {
+    size_t len = strlen(s);
+    char* copy = (char*)h_gc_alloc(len + 1);
+    memcpy(copy, s, len + 1);
+    return copy;
+}
+
+// h_gc_free is the collected-mode replacement for free(). Memory is only
+// ever released by the collector, so an explicit free is just a hint.
+void h_gc_free(void* p) {
+    (void)p;
+}
@@ -0,0 +1,161 @@
+// H-lang assertions and test runner
+//
+// Linked into programs that call assert or assert_eq, and into the test
+// binaries built by `hlc test`. A failed assertion reports the expression,
+// its values and its position. Inside a test it ends that test and the
+// runner moves on to the next one; anywhere else it exits the program.
+
+#include <regex.h>
+#include <setjmp.h>
+
+static jmp_buf* h_test_jmp = NULL;
+
+static FILE* h_assert_out(void) {
+    return h_test_jmp != NULL ? stdout : stderr;
+}
+
+static void h_assert_fail(void) {
+    if (h_test_jmp != NULL) {
+        longjmp(*h_test_jmp, 1);
+    }
+    exit(1);
+}
+
+void h_assert(bool ok, const char* pos, const char* expr) {
+    if (ok) {
+        return;
+    }
+    fprintf(h_assert_out(), "%s: assertion failed: %s\n", pos, expr);
+    h_assert_fail();
+}
+
+static void h_assert_eq_failed(const char* pos, const char* ea, const char* eb) {
+    fprintf(h_assert_out(), "%s: assert_eq(%s, %s) failed\n", pos, ea, eb);
+}
+
+void h_assert_eq_int(long long a, long long b, const char* pos, const char* ea, const char* eb) {
+    if (a == b) {
+        return;
+    }
+    h_assert_eq_failed(pos, ea, eb);
+    fprintf(h_assert_out(), "    left:  %lld\n    right: %lld\n", a, b);
+    h_assert_fail();
+}
+
+void h_assert_eq_float(double a, double b, const char* pos, const char* ea, const char* eb) {
+    if (a == b) {
+        return;
+    }
+    h_assert_eq_failed(pos, ea, eb);
+    fprintf(h_assert_out(), "    left:  %g\n    right: %g\n", a, b);
+    h_assert_fail();
+}
+
+void h_assert_eq_bool(bool a, bool b, const char* pos, const char* ea, const char* eb) {
+    if (a == b) {
+        return;
+    }
+    h_assert_eq_failed(pos, ea, eb);
+    fprintf(h_assert_out(), "    left:  %s\n    right: %s\n", a ? "true" : "false", b ? "true" : "false");
+    h_assert_fail();
+}
+
+static void h_assert_str_value(const char* label, const char* s) {
+    if (s != NULL) {
+        fprintf(h_assert_out(), "    %s \"%s\"\n", label, s);
+    } else {
+        fprintf(h_assert_out(), "    %s null\n", label);
+    }
+}
+
+void h_assert_eq_str(const char* a, const char* b, const char* pos, const char* ea, const char* eb) {
+    if (a == b || (a != NULL && b != NULL && strcmp(a, b) == 0)) {
+        return;
+    }
+    h_assert_eq_failed(pos, ea, eb);
+    h_assert_str_value("left: ", a);
+    h_assert_str_value("right:", b);
+    h_assert_fail();
+}
+
+void h_assert_eq_ptr(const void* a, const void* b, const char* pos, const char* ea, const char* eb) {
+    if (a == b) {
+        return;
+    }
+    h_assert_eq_failed(pos, ea, eb);
+    fprintf(h_assert_out(), "    left:  %p\n    right: %p\n", a, b);
+    h_assert_fail();
+}
+
+// h_test_run runs one test and reports whether it passed
+static int h_test_run(const h_test_case* test) {
+    jmp_buf env;
+    h_test_jmp = &env;
+    int ok = 0;
+    if (setjmp(env) == 0) {
+        test->fn();
+        ok = 1;
+    }
+    h_test_jmp = NULL;
+    return ok;
+}
+
+// h_test_main runs the tests whose names match the -run pattern, or all of
+// them, and returns the process exit status. -v reports every test.
+int h_test_main(const h_test_case* tests, int count, int argc, char** argv) {
+    int verbose = 0;
+    const char* pattern = NULL;
+    for (int i = 1; i < argc; i++) {
+        if (strcmp(argv[i], "-v") == 0) {
+            verbose = 1;
+        } else if (strcmp(argv[i], "-run") == 0 && i + 1 < argc) {
+            pattern = argv[++i];
+        } else {
+            fprintf(stderr, "usage: %s [-v] [-run pattern]\n", argv[0]);
+            return 2;
+        }
+    }
+
+    regex_t re;
+    if (pattern != NULL && regcomp(&re, pattern, REG_EXTENDED | REG_NOSUB) != 0) {
+        fprintf(stderr, "invalid -run pattern: %s\n", pattern);
+        return 2;
+    }
+
+    int passed = 0;
+    int failed = 0;
+    for (int i = 0; i < count; i++) {
+        if (pattern != NULL && regexec(&re, tests[i].name, 0, NULL, 0) != 0) {
+            continue;
+        }
+        if (verbose) {
+            printf("=== RUN   %s\n", tests[i].name);
+        }
+        fflush(stdout);
+
+        if (h_test_run(&tests[i])) {
+            passed++;
+            if (verbose) {
+                printf("--- PASS: %s\n", tests[i].name);
+            }
+        } else {
+            failed++;
+            printf("--- FAIL: %s\n", tests[i].name);
+        }
+        fflush(stdout);
+    }
+    if (pattern != NULL) {
+        regfree(&re);
+    }
+
+    if (failed > 0) {
+        printf("FAIL: %d passed, %d failed\n", passed, failed);
+        return 1;
+    }
+    if (passed == 0) {
+        printf("no tests to run\n");
+        return 0;
+    }
+    printf("PASS: %d passed\n", passed);
+    return 0;
+}
@@ -0,0 +1,77 @@
+package codegen
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+)
+
+// SourceMap maps ranges of lines of a generated C file to the H source
+// they were generated from, so that the C compiler's diagnostics can be
+// reported against the H program
+type SourceMap struct {
+	File     string    `json:"file"` // the C file
+	Mappings []Mapping `json:"mappings"`
+}
+
+// Mapping attributes the C lines Start to End, inclusive, to the declaration
+// or statement at Line and Column of Source. Code the generator adds
+// itself, such as the runtime and struct helpers, has no mapping.
+type Mapping struct {
+	Start  int    `json:"start"`
+	End    int    `json:"end"`
+	Source string `json:"source"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+	Node   string `json:"node"` // the kind of AST node, such as "ReturnStatement"
+}
+
+// Lookup returns the mapping of a C line, or nil if the generator added
+// the line itself
+func (m *SourceMap) Lookup(line int) *Mapping {
+	if m == nil {
+		return nil
+	}
+	i := sort.Search(len(m.Mappings), func(i int) bool { return m.Mappings[i].End >= line })
+	if i < len(m.Mappings) && m.Mappings[i].Start <= line {
+		return &m.Mappings[i]
+	}
+	return nil
+}
+
+// SourceMap returns the source map of the C code Generate produced.
+// GenerateUnits gives each unit its own.
+func (g *Generator) SourceMap() *SourceMap {
+	return g.sourceMap
+}
+
+// openMapping starts a mapping at the next C line
+func (g *Generator) openMapping(m Mapping) {
+	if g.sourceMap == nil {
+		return
+	}
+	m.Start = g.cLine()
+	g.sourceMap.Mappings = append(g.sourceMap.Mappings, m)
+	g.mapping = len(g.sourceMap.Mappings) - 1
+}
+
+// closeMapping ends the open mapping at the last C line written. A node
+// that wrote nothing has no mapping.
+func (g *Generator) closeMapping() {
+	if g.sourceMap == nil || g.mapping < 0 {
+		return
+	}
+	m := &g.sourceMap.Mappings[g.mapping]
+	m.End = g.cLine() - 1
+	if m.End < m.Start {
+		g.sourceMap.Mappings = g.sourceMap.Mappings[:g.mapping]
+	}
+	g.mapping = -1
+}
+
+// nodeKind names the type of an AST node
+func nodeKind(node ast.Node) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", node), "*ast.")
+}
@@ -0,0 +1,225 @@
+package codegen
+
+import (
+	_ "embed"
+	"fmt"
+	"strings"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+)
+
+// testRuntime holds the assertion helpers and the test runner
+//
+//go:embed runtime/test.c
+var testRuntime string
+
+// testPrototypes declares the assertion helpers and the test runner
+var testPrototypes = []string{
+	"typedef struct {",
+	"    const char* name;",
+	"    void (*fn)(void);",
+	"} h_test_case;",
+	"void h_assert(bool ok, const char* pos, const char* expr);",
+	"void h_assert_eq_int(long long a, long long b, const char* pos, const char* ea, const char* eb);",
+	"void h_assert_eq_float(double a, double b, const char* pos, const char* ea, const char* eb);",
+	"void h_assert_eq_bool(bool a, bool b, const char* pos, const char* ea, const char* eb);",
+	"void h_assert_eq_str(const char* a, const char* b, const char* pos, const char* ea, const char* eb);",
+	"void h_assert_eq_ptr(const void* a, const void* b, const char* pos, const char* ea, const char* eb);",
+	"int h_test_main(const h_test_case* tests, int count, int argc, char** argv);",
+}
+
+// SetTestMode makes the generator build a test binary: the main
+// program's test blocks become test functions and main is replaced by a
+// runner that executes them
+func (g *Generator) SetTestMode(enabled bool) {
+	g.testMode = enabled
+}
+
+// SetSourceName sets the file name failed assertions report for the main
+// program. Imported modules report their import path.
+func (g *Generator) SetSourceName(name string) {
+	g.sourceName = name
+}
+
+// needsTestRuntime reports whether the assertion helpers must be linked
+func (g *Generator) needsTestRuntime() bool {
+	if g.testMode {
+		return true
+	}
+	return g.anyNode(func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpression)
+		return ok && g.isAssert(call)
+	})
+}
+
+// isAssert reports whether a call is to the assert or assert_eq builtin,
+// which a function of the same name shadows
+func (g *Generator) isAssert(call *ast.CallExpression) bool {
+	ident, ok := call.Function.(*ast.Identifier)
+	if !ok || (ident.Value != "assert" && ident.Value != "assert_eq") {
+		return false
+	}
+	_, declared := g.functions[ident.Value]
+	return !declared
+}
+
+// generateAssert emits assert(cond) or assert_eq(a, b). Each call passes
+// its source position and the text of its arguments, so that a failure
+// can be reported without debug information.
+func (g *Generator) generateAssert(e *ast.CallExpression, name string) string {
+	pos := cQuote(g.position(e.Function.(*ast.Identifier).Token))
+
+	if name == "assert" {
+		if len(e.Arguments) != 1 {
+			g.errorf(e.Token.Line, "assert takes 1 argument, got %d", len(e.Arguments))
+			return "((void)0)"
+		}
+		arg := e.Arguments[0]
+		return fmt.Sprintf("h_assert(%s, %s, %s)", g.generateExpression(arg), pos, cQuote(ast.ExpressionText(arg)))
+	}
+
+	if len(e.Arguments) != 2 {
+		g.errorf(e.Token.Line, "assert_eq takes 2 arguments, got %d", len(e.Arguments))
+		return "((void)0)"
+	}
+	a, b := e.Arguments[0], e.Arguments[1]
+	left, right := g.generateExpression(a), g.generateExpression(b)
+	ea, eb := ast.ExpressionText(a), ast.ExpressionText(b)
+
+	// An untyped null takes the type of the other side
+	cType := g.inferType(a)
+	if _, ok := a.(*ast.NullLiteral); ok {
+		cType = g.inferType(b)
+	}
+
+	switch {
+	case cType == "h_string":
+		return fmt.Sprintf("h_assert_eq_str(%s, %s, %s, %s, %s)", left, right, pos, cQuote(ea), cQuote(eb))
+	case cType == "double" || cType == "float":
+		return fmt.Sprintf("h_assert_eq_float(%s, %s, %s, %s, %s)", left, right, pos, cQuote(ea), cQuote(eb))
+	case cType == "bool":
+		return fmt.Sprintf("h_assert_eq_bool(%s, %s, %s, %s, %s)", left, right, pos, cQuote(ea), cQuote(eb))
+	case strings.HasSuffix(cType, "*"):
+		return fmt.Sprintf("h_assert_eq_ptr(%s, %s, %s, %s, %s)", left, right, pos, cQuote(ea), cQuote(eb))
+	case strings.Contains(cType, "["):
+		g.errorf(e.Token.Line, "assert_eq cannot compare arrays")
+		return "((void)0)"
+	case g.isStructValue(cType):
+		if f := g.incomparableField(cType, nil); f != nil {
+			g.errorf(e.Token.Line, "cannot compare %s values: field %s is not comparable", cType, f.Name.Value)
+		}
+		text := fmt.Sprintf("assert_eq(%s, %s)", ea, eb)
+		return fmt.Sprintf("h_assert(h_eq_%s(%s, %s), %s, %s)", cType, left, right, pos, cQuote(text))
+	}
+	return fmt.Sprintf("h_assert_eq_int((long long)(%s), (long long)(%s), %s, %s, %s)", left, right, pos, cQuote(ea), cQuote(eb))
+}
+
+// position formats the source position of a token as file:line:column
+func (g *Generator) position(tok lexer.Token) string {
+	file := g.sourceName
+	if g.module != "" {
+		file = g.module
+	}
+	return lexer.Position{Filename: file, Line: tok.Line, Column: tok.Column}.String()
+}
+
+// cQuote returns s as a C string literal
+func cQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' || c == '"':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c < 0x20 || c == 0x7f || c == '?':
+			// Octal escapes also rule out trigraphs
+			fmt.Fprintf(&b, "\\%03o", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// collectTest records a test block of the main program
+func (g *Generator) collectTest(mod *module, t *ast.TestStatement) {
+	for _, other := range mod.tests {
+		if other.Name == t.Name {
+			g.errorf(t.Token.Line, "test %q is declared more than once", t.Name)
+			return
+		}
+	}
+	mod.tests = append(mod.tests, t)
+}
+
+// testedMainName is the C name of the program's main in a test binary
+const testedMainName = "h_program_main"
+
+// replacesMain reports whether the test runner takes the place of main
+// f. The program's main is still compiled, under another name, so that
+// its errors are reported.
+func (g *Generator) replacesMain(f *ast.FunctionStatement) bool {
+	return g.testMode && g.funcModules[f] == ""
+}
+
+// writeTestPrototypes declares the assertion helpers and the test runner
+func (g *Generator) writeTestPrototypes() {
+	for _, p := range testPrototypes {
+		g.writeLine(p)
+	}
+	g.writeLine("")
+}
+
+// generateTests emits a function per test block of the main program, the
+// table of tests and the runner's main
+func (g *Generator) generateTests(mod *module) {
+	if !g.testMode {
+		return
+	}
+
+	for i, t := range mod.tests {
+		g.generateFunction(&ast.FunctionStatement{
+			Token: t.Token,
+			Name:  &ast.Identifier{Token: t.Token, Value: testFunctionName(i)},
+			Body:  t.Body,
+		})
+	}
+
+	// A trailing entry keeps the table valid when there are no tests
+	g.writeLine("static const h_test_case h_tests[] = {")
+	g.indent++
+	for i, t := range mod.tests {
+		g.writeLine(fmt.Sprintf("{\"%s\", %s},", t.Name, testFunctionName(i)))
+	}
+	g.writeLine("{NULL, NULL},")
+	g.indent--
+	g.writeLine("};")
+	g.writeLine("")
+
+	g.writeLine("int main(int argc, char** argv) {")
+	g.indent++
+	if g.gc {
+		g.writeLine("h_gc_init(__builtin_frame_address(0));")
+	}
+	if g.usesArgs {
+		g.writeLine("h_argc = argc;")
+		g.writeLine("h_argv = argv;")
+	}
+	if g.needsInit() {
+		g.writeLine("h_init();")
+	}
+	g.writeLine(fmt.Sprintf("return h_test_main(h_tests, %d, argc, argv);", len(mod.tests)))
+	g.indent--
+	g.writeLine("}")
+}
+
+func testFunctionName(i int) string {
+	return fmt.Sprintf("h_test_%d", i)
+}
@@ -0,0 +1,392 @@
+package codegen
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"strings"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+)
+
+// Unit is one C translation unit of a separately compiled program: the
+// source implementing a module and the header declaring its public API
+type Unit struct {
+	Name   string // file name stem shared by the .c and .h files
+	Header string
+	Source string
+	Map    *SourceMap // maps the lines of Source to the module's H source
+}
+
+// RuntimeUnit is the name of the unit holding the string, map and
+// collector helpers shared by every module
+const RuntimeUnit = "h_runtime"
+
+// gcPrototypes declares the collector entry points used by generated code
+var gcPrototypes = []string{
+	"void h_gc_init(void* stack_bottom);",
+	"void h_gc_add_root(void* start, size_t size);",
+	"void h_gc_collect(void);",
+	"void* h_gc_alloc(size_t size);",
+	"char* h_gc_strdup(const char* s);",
+	"void h_gc_free(void* p);",
+}
+
+// GenerateUnits produces C code for separate compilation: the runtime
+// unit, then one unit per module in dependency order, the main program
+// last. Each unit can be compiled to an object file on its own: imported
+// modules export their public declarations through their headers and
+// keep their private functions and globals static.
+func (g *Generator) GenerateUnits(program *ast.Program) []*Unit {
+	g.units = true
+	mainModule := g.prepare(program)
+
+	names := g.unitNames()
+	units := []*Unit{g.generateRuntimeUnit()}
+	for _, mod := range g.modules {
+		units = append(units, g.generateModuleUnit(mod, names, mod == mainModule))
+	}
+	return units
+}
+
+var unitNameChars = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+// unitNames derives a unique file name stem for each module from its
+// import path: lib/math.hl becomes lib_math
+func (g *Generator) unitNames() map[*module]string {
+	names := make(map[*module]string)
+	used := map[string]bool{RuntimeUnit: true}
+	for _, mod := range g.modules {
+		name := "main"
+		if mod.path != "" {
+			name = strings.Trim(unitNameChars.ReplaceAllString(strings.TrimSuffix(mod.path, ".hl"), "_"), "_")
+		}
+		if name == "" {
+			name = "module"
+		}
+		base := name
+		for i := 2; used[name]; i++ {
+			name = fmt.Sprintf("%s_%d", base, i)
+		}
+		used[name] = true
+		names[mod] = name
+	}
+	return names
+}
+
+// isExported reports whether a function is part of its module's public
+// API. Nothing imports the main program, so it exports nothing.
+func (g *Generator) isExported(f *ast.FunctionStatement) bool {
+	return f.Public && !isInitFunction(f) && g.funcModules[f] != ""
+}
+
+// isPrivate reports whether a function is hidden inside an imported
+// module. The main program's functions keep external linkage, as in a
+// single C file, so they cannot clash with static C library declarations.
+func (g *Generator) isPrivate(f *ast.FunctionStatement) bool {
+	return g.funcModules[f] != "" && !g.isExported(f)
+}
+
+// moduleInitName is the C name of the function that initialises a
+// separately compiled module
+func moduleInitName(mod *module) string {
+	return fmt.Sprintf("h_init_module_%d", mod.index)
+}
+
+// capture returns what fn writes instead of adding it to the output
+func (g *Generator) capture(fn func()) string {
+	start := g.output.Len()
+	counted, lines := g.counted, g.lines
+	g.counted, g.lines = start, 0
+	fn()
+	g.counted, g.lines = counted, lines
+	s := g.output.String()[start:]
+	g.output.Truncate(start)
+	return s
+}
+
+// generateRuntimeUnit emits the helpers every module links against
+func (g *Generator) generateRuntimeUnit() *Unit {
+	header := g.capture(func() {
+		g.writeGuard(RuntimeUnit)
+		g.writePreamble()
+		g.writeLine("h_string h_string_concat(h_string a, h_string b);")
+		if g.gc {
+			for _, p := range gcPrototypes {
+				g.writeLine(p)
+			}
+		}
+		if g.usesArgs {
+			for _, p := range argsPrototypes {
+				g.writeLine(p)
+			}
+		}
+		g.writeLine("")
+		if g.usesTestRuntime {
+			g.writeTestPrototypes()
+		}
+		if g.usesMap {
+			g.generateMapTypes()
+			for _, p := range mapPrototypes {
+				g.writeLine(p)
+			}
+			g.writeLine("")
+		}
+		g.generateStringEquality()
+		g.writeLine("#endif")
+	})
+
+	source := g.capture(func() {
+		g.writeLine(fmt.Sprintf("#include \"%s.h\"", RuntimeUnit))
+		g.writeLine("")
+		if g.gc {
+			g.write(gcRuntime)
+			g.writeLine("")
+		}
+		g.generateStringConcat()
+		if g.usesArgs {
+			g.writeArgs()
+		}
+		if g.usesMap {
+			g.generateMapFunctions()
+		}
+		if g.usesTestRuntime {
+			g.write(testRuntime)
+		}
+	})
+
+	return &Unit{Name: RuntimeUnit, Header: header, Source: source}
+}
+
+// generateModuleUnit emits one module. Its header carries the public
+// enums, structs, globals and functions; the source carries everything
+// else and the function bodies.
+func (g *Generator) generateModuleUnit(mod *module, names map[*module]string, isMain bool) *Unit {
+	if !isMain {
+		defer g.scopeModule(mod)()
+	}
+	name := names[mod]
+
+	var enums, publicEnums []*ast.EnumStatement
+	var structs, publicStructs []*ast.StructStatement
+	var functions []*ast.FunctionStatement
+	for _, stmt := range mod.program.Statements {
+		switch s := stmt.(type) {
+		case *ast.EnumStatement:
+			if s.Public && !isMain {
+				publicEnums = append(publicEnums, s)
+			} else {
+				enums = append(enums, s)
+			}
+		case *ast.StructStatement:
+			if s.Public && !isMain {
+				publicStructs = append(publicStructs, s)
+			} else {
+				structs = append(structs, s)
+			}
+		case *ast.FunctionStatement:
+			functions = append(functions, s)
+		}
+	}
+
+	// The source comes first: generating it records the module's globals
+	cFile := g.cFile
+	g.cFile = name + ".c"
+	g.sourceMap = &SourceMap{File: g.cFile}
+	defer func() { g.cFile, g.sourceMap = cFile, nil }()
+
+	source := g.capture(func() {
+		g.module = mod.path
+		g.writeLine(fmt.Sprintf("#include \"%s.h\"", name))
+		g.writeLine("")
+
+		g.generateTypes(enums, structs)
+
+		for _, f := range functions {
+			if !g.isExported(f) {
+				g.generateFunctionDeclaration(f)
+			}
+		}
+		if len(functions) > 0 {
+			g.writeLine("")
+		}
+
+		for _, stmt := range mod.globals {
+			g.mark(stmt, statementToken(stmt))
+			g.generateGlobal(mod, stmt)
+		}
+		if len(mod.globals) > 0 {
+			g.unmark()
+			g.writeLine("")
+		}
+
+		g.generateModuleInitFunction(mod)
+		if isMain {
+			g.generateUnitsInit()
+		}
+
+		for _, f := range functions {
+			g.generateFunction(f)
+		}
+		g.module = ""
+		if isMain {
+			g.generateTests(mod)
+		}
+	})
+
+	// Only the source is mapped; the types a header exports keep
+	// pointing into the header
+	sourceMap, directives := g.sourceMap, g.lineDirectives
+	g.lineDirectives, g.sourceMap = false, nil
+	defer func() { g.lineDirectives = directives }()
+	header := g.capture(func() {
+		g.module = mod.path
+		g.writeGuard(name)
+		g.writeLine(fmt.Sprintf("#include \"%s.h\"", RuntimeUnit))
+		for _, path := range mod.imports {
+			if dep := g.moduleByPath(path); dep != nil {
+				g.writeLine(fmt.Sprintf("#include \"%s.h\"", names[dep]))
+			}
+		}
+		g.writeLine("")
+		g.writeIncludes(mod)
+
+		g.generateTypes(publicEnums, publicStructs)
+
+		exported := false
+		for _, stmt := range mod.globals {
+			if gl := g.moduleGlobal(mod.path, globalName(stmt)); gl != nil && gl.public && !isMain {
+				g.writeLine(fmt.Sprintf("extern %s;", gl.decl))
+				exported = true
+			}
+		}
+		for _, f := range functions {
+			if g.isExported(f) {
+				g.generateFunctionDeclaration(f)
+				exported = true
+			}
+		}
+		if g.moduleNeedsInit(mod) {
+			g.writeLine(fmt.Sprintf("void %s(void);", moduleInitName(mod)))
+			exported = true
+		}
+		if exported {
+			g.writeLine("")
+		}
+		g.writeLine("#endif")
+		g.module = ""
+	})
+
+	return &Unit{Name: name, Header: header, Source: source, Map: sourceMap}
+}
+
+// writeGuard opens the include guard of a header
+func (g *Generator) writeGuard(name string) {
+	guard := "H_" + strings.ToUpper(name) + "_H"
+	g.writeLine("#ifndef " + guard)
+	g.writeLine("#define " + guard)
+	g.writeLine("")
+}
+
+// generateTypes emits enum and struct definitions and the struct helpers
+func (g *Generator) generateTypes(enums []*ast.EnumStatement, structs []*ast.StructStatement) {
+	for _, s := range enums {
+		g.generateEnum(s)
+	}
+	if len(structs) == 0 {
+		return
+	}
+	declared := false
+	for _, s := range structs {
+		if g.declaresStruct(s) {
+			g.writeLine(fmt.Sprintf("typedef struct %s %s;", s.Name.Value, s.Name.Value))
+			declared = true
+		}
+	}
+	if declared {
+		g.writeLine("")
+	}
+	structs = g.orderStructs(structs)
+	for _, s := range g.definedStructs(structs) {
+		g.generateStruct(s)
+	}
+	g.generateStructHelpers(completeStructs(structs))
+}
+
+// generateModuleInitFunction emits the function that registers a
+// module's globals with the collector, assigns its computed globals and
+// runs its init function
+func (g *Generator) generateModuleInitFunction(mod *module) {
+	if !g.moduleNeedsInit(mod) {
+		return
+	}
+
+	g.writeLine(fmt.Sprintf("void %s(void) {", moduleInitName(mod)))
+	g.indent++
+	g.variables = make(map[string]string)
+	g.argsVars = make(map[string]bool)
+	if g.gc {
+		for _, name := range g.moduleRoots(mod) {
+			g.writeLine(fmt.Sprintf("h_gc_add_root(&%s, sizeof(%s));", name, name))
+		}
+	}
+	g.generateModuleInit(mod)
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("")
+}
+
+// generateUnitsInit emits h_init for the main program, calling each
+// module's init function in dependency order. The imported ones are
+// declared in the module headers.
+func (g *Generator) generateUnitsInit() {
+	if !g.needsInit() {
+		return
+	}
+
+	g.writeLine("static void h_init(void) {")
+	g.indent++
+	for _, mod := range g.modules {
+		if g.moduleNeedsInit(mod) {
+			g.writeLine(moduleInitName(mod) + "();")
+		}
+	}
+	g.indent--
+	g.writeLine("}")
+	g.writeLine("")
+}
+
+// moduleByPath returns the imported module with the given path
+func (g *Generator) moduleByPath(path string) *module {
+	for _, mod := range g.modules {
+		if mod.path == path {
+			return mod
+		}
+	}
+	return nil
+}
+
+// scopeModule makes the private declarations of an imported module
+// visible while its unit is generated and returns a function that hides
+// them again
+func (g *Generator) scopeModule(mod *module) func() {
+	structs, functions := maps.Clone(g.structs), maps.Clone(g.functions)
+	methods, enums := maps.Clone(g.methods), maps.Clone(g.enums)
+
+	for _, stmt := range mod.program.Statements {
+		switch s := stmt.(type) {
+		case *ast.StructStatement:
+			g.structs[s.Name.Value] = s
+		case *ast.FunctionStatement:
+			if !isInitFunction(s) {
+				g.registerFunction(s)
+			}
+		case *ast.EnumStatement:
+			g.enums[s.Name.Value] = s
+		}
+	}
+
+	return func() {
+		g.structs, g.functions, g.methods, g.enums = structs, functions, methods, enums
+	}
+}
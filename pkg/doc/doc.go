@@ -0,0 +1,211 @@
+// Package doc extracts the documentation of the public declarations of
+// H-lang source files, from the doc comments the parser attaches to
+// them, and renders it as text, Markdown or HTML.
+package doc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+)
+
+// File is the documentation of one source file
+type File struct {
+	Path  string
+	Doc   string  // the comment that opens the file
+	Types []*Type // public structs and enums, in source order
+	Funcs []*Func // public functions, and methods of types not listed
+}
+
+// Type is a documented struct or enum
+type Type struct {
+	Name    string
+	Doc     string
+	Struct  *ast.StructStatement // nil for enums
+	Enum    *ast.EnumStatement   // nil for structs
+	Methods []*Func
+}
+
+// Func is a documented function or method
+type Func struct {
+	Name string // "Point.move" for methods
+	Doc  string
+	Decl *ast.FunctionStatement
+}
+
+// Warning is a public declaration without a doc comment
+type Warning struct {
+	Path    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s", w.Path, w.Line, w.Column, w.Message)
+}
+
+// New collects the documentation of a parsed file
+func New(path string, program *ast.Program) *File {
+	f := &File{Path: path, Doc: fileComment(program)}
+	types := map[string]*Type{}
+	for _, stmt := range program.Statements {
+		switch s := stmt.(type) {
+		case *ast.StructStatement:
+			if s.Public {
+				t := &Type{Name: s.Name.Value, Doc: s.Doc, Struct: s}
+				types[t.Name] = t
+				f.Types = append(f.Types, t)
+			}
+		case *ast.EnumStatement:
+			if s.Public {
+				t := &Type{Name: s.Name.Value, Doc: s.Doc, Enum: s}
+				types[t.Name] = t
+				f.Types = append(f.Types, t)
+			}
+		}
+	}
+
+	for _, stmt := range program.Statements {
+		s, ok := stmt.(*ast.FunctionStatement)
+		if !ok || !s.Public {
+			continue
+		}
+		fn := &Func{Name: s.Name.Value, Doc: s.Doc, Decl: s}
+		if s.Receiver != nil {
+			recv := s.Receiver.Type.Element().Name
+			fn.Name = recv + "." + fn.Name
+			if t := types[recv]; t != nil {
+				t.Methods = append(t.Methods, fn)
+				continue
+			}
+		}
+		f.Funcs = append(f.Funcs, fn)
+	}
+	return f
+}
+
+// Warnings returns a warning for each public declaration of a file, and
+// each public field of its structs, without a doc comment
+func (f *File) Warnings() []Warning {
+	var warnings []Warning
+	warn := func(kind, name string, decl ast.Node) {
+		line, column := position(decl)
+		warnings = append(warnings, Warning{
+			Path:    f.Path,
+			Line:    line,
+			Column:  column,
+			Message: fmt.Sprintf("public %s %s has no doc comment", kind, name),
+		})
+	}
+	for _, t := range f.Types {
+		if t.Doc == "" {
+			if t.Struct != nil {
+				warn("struct", t.Name, t.Struct)
+			} else {
+				warn("enum", t.Name, t.Enum)
+			}
+		}
+		if t.Struct != nil {
+			for _, field := range t.Struct.Fields {
+				if field.Public && field.Doc == "" {
+					warn("field", t.Name+"."+field.Name.Value, field)
+				}
+			}
+		}
+		for _, m := range t.Methods {
+			if m.Doc == "" {
+				warn("method", m.Name, m.Decl)
+			}
+		}
+	}
+	for _, fn := range f.Funcs {
+		if fn.Doc == "" {
+			kind := "function"
+			if fn.Decl.Receiver != nil {
+				kind = "method"
+			}
+			warn(kind, fn.Name, fn.Decl)
+		}
+	}
+	return warnings
+}
+
+// position returns where the name of a declaration or field is
+func position(node ast.Node) (int, int) {
+	switch s := node.(type) {
+	case *ast.StructField:
+		return s.Name.Token.Line, s.Name.Token.Column
+	case *ast.FunctionStatement:
+		return s.Name.Token.Line, s.Name.Token.Column
+	case *ast.StructStatement:
+		return s.Name.Token.Line, s.Name.Token.Column
+	case *ast.EnumStatement:
+		return s.Name.Token.Line, s.Name.Token.Column
+	}
+	return 0, 0
+}
+
+// fileComment returns the comment that opens a file: the first run of
+// comments before any code, unless it is the doc comment of the first
+// declaration
+func fileComment(program *ast.Program) string {
+	if len(program.Comments) == 0 {
+		return ""
+	}
+	first := program.Comments[0]
+	if first.Trailing {
+		return ""
+	}
+	var lines []string
+	next := first.Token.Line
+	for _, c := range program.Comments {
+		if c.Trailing || c.Token.Line != next {
+			break
+		}
+		lines = append(lines, commentText(c.Token.Literal))
+		next = c.Token.Line + strings.Count(c.Token.Literal, "\n") + 1
+	}
+
+	if len(program.Statements) > 0 {
+		line := startLine(program.Statements[0])
+		// A run that ends right above the first statement documents it
+		if line != 0 && (first.Token.Line > line || next == line) {
+			return ""
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// startLine returns the line a top-level statement starts on, or 0
+func startLine(stmt ast.Statement) int {
+	if line, _ := position(stmt); line != 0 {
+		return line
+	}
+	switch s := stmt.(type) {
+	case *ast.ImportStatement:
+		return s.Token.Line
+	case *ast.VarStatement:
+		return s.Token.Line
+	case *ast.ConstStatement:
+		return s.Token.Line
+	case *ast.TestStatement:
+		return s.Token.Line
+	}
+	return 0
+}
+
+// commentText strips the space after a comment marker and the margin of
+// a block comment
+func commentText(text string) string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "*") {
+			line = strings.TrimSpace(line[1:])
+		}
+		lines = append(lines, line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
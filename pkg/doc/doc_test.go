@@ -0,0 +1,169 @@
+package doc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+	"github.com/Dr-H-PhD/h-lang/pkg/parser"
+)
+
+const source = `# Shapes on a plane.
+
+# Point is a place.
+public struct Point {
+    public x int; # Across
+    public y int;
+    secret int;
+}
+
+# move shifts p.
+public function (p *Point) move(dx int, dy int) {}
+
+public enum Kind { Circle, Square = 4 }
+
+# center returns the middle of a & b.
+public function center(a *Point, b *Point) Point { return *a; }
+
+public function undocumented() {}
+
+function private() {}
+`
+
+func parse(t *testing.T, path, input string) *File {
+	t.Helper()
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	return New(path, program)
+}
+
+func TestNew(t *testing.T) {
+	f := parse(t, "shapes.hl", source)
+
+	if f.Doc != "Shapes on a plane." {
+		t.Errorf("unexpected file doc %q", f.Doc)
+	}
+	if len(f.Types) != 2 || f.Types[0].Name != "Point" || f.Types[1].Name != "Kind" {
+		t.Fatalf("expected the types Point and Kind, got %+v", f.Types)
+	}
+	point := f.Types[0]
+	if point.Doc != "Point is a place." || len(point.Methods) != 1 || point.Methods[0].Name != "Point.move" {
+		t.Errorf("unexpected Point %+v", point)
+	}
+
+	var funcs []string
+	for _, fn := range f.Funcs {
+		funcs = append(funcs, fn.Name)
+	}
+	if strings.Join(funcs, " ") != "center undocumented" {
+		t.Errorf("expected the public functions, got %v", funcs)
+	}
+}
+
+func TestFileComment(t *testing.T) {
+	// A comment right above the first declaration is its doc only
+	f := parse(t, "a.hl", "# abs returns |x|.\npublic function abs(x int) int { return x; }\n")
+	if f.Doc != "" || f.Funcs[0].Doc != "abs returns |x|." {
+		t.Errorf("expected only a function doc, got file %q, function %q", f.Doc, f.Funcs[0].Doc)
+	}
+
+	f = parse(t, "b.hl", "/*\n * Package b.\n * Two lines.\n */\n\nimport \"a.hl\";\n")
+	if f.Doc != "Package b.\nTwo lines." {
+		t.Errorf("unexpected file doc %q", f.Doc)
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	f := parse(t, "shapes.hl", source)
+	var got []string
+	for _, w := range f.Warnings() {
+		got = append(got, w.String())
+	}
+	expected := []string{
+		"shapes.hl:6:12: public field Point.y has no doc comment",
+		"shapes.hl:13:13: public enum Kind has no doc comment",
+		"shapes.hl:18:17: public function undocumented has no doc comment",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected warnings:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestText(t *testing.T) {
+	out := Text([]*File{parse(t, "shapes.hl", source)})
+	expected := `shapes.hl
+
+    Shapes on a plane.
+
+function center(a *Point, b *Point) Point
+    center returns the middle of a & b.
+
+function undocumented()
+
+struct Point {
+    x int # Across
+    y int
+    # contains private fields
+}
+    Point is a place.
+
+function (p *Point) move(dx int, dy int)
+    move shifts p.
+
+enum Kind {
+    Circle,
+    Square = 4,
+}
+`
+	if out != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out)
+	}
+}
+
+func TestHTMLLinksTypes(t *testing.T) {
+	files := []*File{
+		parse(t, "shapes.hl", source),
+		parse(t, "use.hl", "# grow resizes k.\npublic function grow(k Kind) []*Point { return null; }\n"),
+	}
+	out := HTML("Shapes", files)
+	for _, want := range []string{
+		`<h3 id="Point">struct Point</h3>`,
+		`<h3 id="Point-move">method Point.move</h3>`,
+		`function grow(k <a href="#Kind">Kind</a>) []*<a href="#Point">Point</a>`,
+		`<li><a href="#grow"><code>function grow(k Kind) []*Point</code></a></li>`,
+		`<p>center returns the middle of a &amp; b.</p>`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected the page to contain %q\n\n%s", want, out)
+		}
+	}
+
+	md := Markdown("Shapes", files)
+	for _, want := range []string{
+		"# Shapes\n",
+		"## use.hl\n",
+		`### <a id="grow"></a>function grow`,
+		`<pre>function (p *<a href="#Point">Point</a>) move(dx int, dy int)</pre>`,
+	} {
+		if !strings.Contains(md, want) {
+			t.Errorf("expected the Markdown to contain %q\n\n%s", want, md)
+		}
+	}
+}
+
+func TestMarkdownEscapes(t *testing.T) {
+	f := parse(t, "cmp.hl", "# less reports a < b && b > 0, as `a < b && b > 0` or ``a <`b``.\n# ```\n# x := a & b;\n# ```\npublic function less(a int, b int) bool { return a < b; }\n")
+	md := Markdown("<cmp> & co", []*File{f})
+	for _, want := range []string{
+		"# &lt;cmp&gt; &amp; co\n",
+		"less reports a &lt; b &amp;&amp; b &gt; 0, as `a < b && b > 0` or ``a <`b``.\n",
+		"```\nx := a & b;\n```\n",
+	} {
+		if !strings.Contains(md, want) {
+			t.Errorf("expected the Markdown to contain %q\n\n%s", want, md)
+		}
+	}
+}
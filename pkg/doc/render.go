@@ -0,0 +1,390 @@
+package doc
+
+import (
+	"html"
+	"strconv"
+	"strings"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+)
+
+// printer writes declarations as source. In HTML mode text is escaped
+// and the names of documented types link to them.
+type printer struct {
+	html    bool
+	anchors map[string]bool // documented types
+}
+
+func newPrinter(files []*File, html bool) *printer {
+	p := &printer{html: html, anchors: map[string]bool{}}
+	for _, f := range files {
+		for _, t := range f.Types {
+			p.anchors[t.Name] = true
+		}
+	}
+	return p
+}
+
+func (p *printer) text(s string) string {
+	if p.html {
+		return html.EscapeString(s)
+	}
+	return s
+}
+
+// typ writes a type annotation, linking named types that are documented
+func (p *printer) typ(t *ast.TypeAnnotation) string {
+	switch {
+	case t == nil:
+		return ""
+	case t.IsPtr:
+		return "*" + p.typ(t.Element())
+	case t.IsMap:
+		return "map[" + p.typ(t.KeyType) + "]" + p.typ(t.ValueType)
+	case t.IsFunc:
+		var params []string
+		for _, param := range t.Params {
+			params = append(params, p.typ(param))
+		}
+		out := "function(" + strings.Join(params, ", ") + ")"
+		if t.ReturnType != nil {
+			out += " " + p.typ(t.ReturnType)
+		}
+		return out
+	case t.ArrayLen == -1:
+		return "[]" + p.typ(t.Element())
+	case t.ArrayLen > 0:
+		return "[" + strconv.Itoa(t.ArrayLen) + "]" + p.typ(t.Element())
+	case t.Len != nil:
+		return "[" + p.text(t.Len.String()) + "]" + p.typ(t.Element())
+	}
+	if p.html && p.anchors[t.Name] {
+		return `<a href="#` + anchor(t.Name) + `">` + html.EscapeString(t.Name) + "</a>"
+	}
+	return p.text(t.Name)
+}
+
+// signature writes the header of a function
+func (p *printer) signature(fn *ast.FunctionStatement) string {
+	var out strings.Builder
+	if fn.Extern {
+		out.WriteString("extern ")
+	}
+	if fn.Comptime {
+		out.WriteString("comptime ")
+	}
+	out.WriteString("function ")
+	if fn.Receiver != nil {
+		out.WriteString("(" + p.text(fn.Receiver.Name.Value) + " " + p.typ(fn.Receiver.Type) + ") ")
+	}
+	out.WriteString(p.text(fn.Name.Value) + "(")
+	for i, param := range fn.Parameters {
+		if i > 0 {
+			out.WriteString(", ")
+		}
+		out.WriteString(p.text(param.Name.Value) + " " + p.typ(param.Type))
+	}
+	if fn.Variadic {
+		if len(fn.Parameters) > 0 {
+			out.WriteString(", ")
+		}
+		out.WriteString("...")
+	}
+	out.WriteString(")")
+	if fn.ReturnType != nil {
+		out.WriteString(" " + p.typ(fn.ReturnType))
+	}
+	return out.String()
+}
+
+// declaration writes a struct with its public fields, or an enum with
+// its values. Field docs are written as comments.
+func (p *printer) declaration(t *Type) string {
+	var out strings.Builder
+	member := func(code, doc string) {
+		lines := strings.Split(doc, "\n")
+		if doc != "" && len(lines) > 1 {
+			for _, line := range lines {
+				out.WriteString(p.text(strings.TrimRight("    # "+line, " ")) + "\n")
+			}
+			doc = ""
+		}
+		out.WriteString("    " + code)
+		if doc != "" {
+			out.WriteString(p.text(" # " + doc))
+		}
+		out.WriteString("\n")
+	}
+
+	if t.Struct != nil {
+		if t.Struct.Extern {
+			out.WriteString("extern ")
+		}
+		if t.Struct.Fields == nil {
+			out.WriteString("struct " + p.text(t.Name))
+			return out.String()
+		}
+		out.WriteString("struct " + p.text(t.Name) + " {\n")
+		private := false
+		for _, field := range t.Struct.Fields {
+			if !field.Public {
+				private = true
+				continue
+			}
+			member(p.text(field.Name.Value)+" "+p.typ(field.Type), field.Doc)
+		}
+		if private {
+			out.WriteString(p.text("    # contains private fields") + "\n")
+		}
+	} else {
+		out.WriteString("enum " + p.text(t.Name) + " {\n")
+		for _, value := range t.Enum.Values {
+			code := value.Name.Value
+			if value.Value != nil {
+				code += " = " + value.Value.String()
+			}
+			member(p.text(code+","), value.Doc)
+		}
+	}
+	out.WriteString("}")
+	return out.String()
+}
+
+// anchor returns the fragment identifying a declaration in HTML and
+// Markdown
+func anchor(name string) string {
+	return strings.ReplaceAll(name, ".", "-")
+}
+
+// Text renders documentation for a terminal: each declaration as source
+// followed by its doc, indented
+func Text(files []*File) string {
+	p := newPrinter(files, false)
+	var out strings.Builder
+	doc := func(text string) {
+		if text != "" {
+			out.WriteString(indent(text, "    ") + "\n")
+		}
+		out.WriteString("\n")
+	}
+	for i, f := range files {
+		if i > 0 {
+			out.WriteString("\n")
+		}
+		out.WriteString(f.Path + "\n")
+		if f.Doc != "" {
+			out.WriteString("\n" + indent(f.Doc, "    ") + "\n")
+		}
+		out.WriteString("\n")
+		for _, fn := range f.Funcs {
+			out.WriteString(p.signature(fn.Decl) + "\n")
+			doc(fn.Doc)
+		}
+		for _, t := range f.Types {
+			out.WriteString(p.declaration(t) + "\n")
+			doc(t.Doc)
+			for _, m := range t.Methods {
+				out.WriteString(p.signature(m.Decl) + "\n")
+				doc(m.Doc)
+			}
+		}
+	}
+	return strings.TrimRight(out.String(), "\n") + "\n"
+}
+
+// Markdown renders documentation as a Markdown reference. Declarations
+// are HTML blocks so that the types in them can link to each other.
+func Markdown(title string, files []*File) string {
+	p := newPrinter(files, true)
+	var out strings.Builder
+	out.WriteString("# " + markdownEscaper.Replace(title) + "\n")
+	section := func(id, heading, code, doc string) {
+		out.WriteString("\n### <a id=\"" + anchor(id) + "\"></a>" + heading + "\n\n")
+		out.WriteString("<pre>" + code + "</pre>\n")
+		if doc != "" {
+			out.WriteString("\n" + markdown(doc) + "\n")
+		}
+	}
+	for _, f := range files {
+		out.WriteString("\n## " + f.Path + "\n")
+		if f.Doc != "" {
+			out.WriteString("\n" + markdown(f.Doc) + "\n")
+		}
+		for _, fn := range f.Funcs {
+			section(fn.Name, "function "+fn.Name, p.signature(fn.Decl), fn.Doc)
+		}
+		for _, t := range f.Types {
+			section(t.Name, kind(t)+" "+t.Name, p.declaration(t), t.Doc)
+			for _, m := range t.Methods {
+				section(m.Name, "method "+m.Name, p.signature(m.Decl), m.Doc)
+			}
+		}
+	}
+	return out.String()
+}
+
+// markdownEscaper escapes the characters Markdown passes through as HTML
+var markdownEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// markdown escapes doc text for Markdown, so that <, > and & show as
+// they are rather than as HTML. Code spans and fenced code blocks
+// already show them as they are and are left alone.
+func markdown(doc string) string {
+	var out, prose strings.Builder
+	fenced := false
+	for _, line := range strings.Split(doc, "\n") {
+		trimmed := strings.TrimSpace(line)
+		fence := strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~")
+		if !fence && !fenced {
+			prose.WriteString(line + "\n")
+			continue
+		}
+		out.WriteString(escapeProse(prose.String()) + line + "\n")
+		prose.Reset()
+		if fence {
+			fenced = !fenced
+		}
+	}
+	out.WriteString(escapeProse(prose.String()))
+	return strings.TrimSuffix(out.String(), "\n")
+}
+
+// escapeProse escapes text for Markdown outside its code spans
+func escapeProse(text string) string {
+	var out strings.Builder
+	for text != "" {
+		i := strings.IndexByte(text, '`')
+		if i < 0 {
+			out.WriteString(markdownEscaper.Replace(text))
+			break
+		}
+		out.WriteString(markdownEscaper.Replace(text[:i]))
+		n := i
+		for n < len(text) && text[n] == '`' {
+			n++
+		}
+		// A span closes at the next run of as many backticks
+		end := codeSpanEnd(text[n:], n-i)
+		if end < 0 {
+			out.WriteString(text[i:n])
+			text = text[n:]
+			continue
+		}
+		out.WriteString(text[i : n+end])
+		text = text[n+end:]
+	}
+	return out.String()
+}
+
+// codeSpanEnd returns the index in text just past the first run of
+// exactly n backticks, or -1 if there is none
+func codeSpanEnd(text string, n int) int {
+	for i := 0; i < len(text); {
+		if text[i] != '`' {
+			i++
+			continue
+		}
+		j := i
+		for j < len(text) && text[j] == '`' {
+			j++
+		}
+		if j-i == n {
+			return j
+		}
+		i = j
+	}
+	return -1
+}
+
+// HTML renders documentation as a standalone page with an index
+func HTML(title string, files []*File) string {
+	p := newPrinter(files, true)
+	var out strings.Builder
+	out.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n")
+	out.WriteString("<title>" + html.EscapeString(title) + "</title>\n")
+	out.WriteString("<style>\n" +
+		"body { font-family: sans-serif; max-width: 52em; margin: 2em auto; padding: 0 1em; }\n" +
+		"pre { background: #f4f4f4; padding: 0.75em; overflow-x: auto; }\n" +
+		"h3 { margin-top: 2em; }\n" +
+		"</style>\n</head>\n<body>\n")
+	out.WriteString("<h1>" + html.EscapeString(title) + "</h1>\n")
+
+	// Index, in plain text since links cannot nest
+	plain := newPrinter(files, false)
+	out.WriteString("<ul>\n")
+	for _, f := range files {
+		out.WriteString("<li><a href=\"#" + html.EscapeString(fileAnchor(f.Path)) + "\">" + html.EscapeString(f.Path) + "</a>\n<ul>\n")
+		for _, fn := range f.Funcs {
+			out.WriteString(indexEntry(fn.Name, plain.signature(fn.Decl)))
+		}
+		for _, t := range f.Types {
+			out.WriteString(indexEntry(t.Name, kind(t)+" "+t.Name))
+			for _, m := range t.Methods {
+				out.WriteString(indexEntry(m.Name, plain.signature(m.Decl)))
+			}
+		}
+		out.WriteString("</ul></li>\n")
+	}
+	out.WriteString("</ul>\n")
+
+	section := func(id, heading, code, doc string) {
+		out.WriteString("<h3 id=\"" + html.EscapeString(anchor(id)) + "\">" + html.EscapeString(heading) + "</h3>\n")
+		out.WriteString("<pre>" + code + "</pre>\n")
+		out.WriteString(paragraphs(doc))
+	}
+	for _, f := range files {
+		out.WriteString("<h2 id=\"" + html.EscapeString(fileAnchor(f.Path)) + "\">" + html.EscapeString(f.Path) + "</h2>\n")
+		out.WriteString(paragraphs(f.Doc))
+		for _, fn := range f.Funcs {
+			section(fn.Name, "function "+fn.Name, p.signature(fn.Decl), fn.Doc)
+		}
+		for _, t := range f.Types {
+			section(t.Name, kind(t)+" "+t.Name, p.declaration(t), t.Doc)
+			for _, m := range t.Methods {
+				section(m.Name, "method "+m.Name, p.signature(m.Decl), m.Doc)
+			}
+		}
+	}
+	out.WriteString("</body>\n</html>\n")
+	return out.String()
+}
+
+func kind(t *Type) string {
+	if t.Struct != nil {
+		return "struct"
+	}
+	return "enum"
+}
+
+func fileAnchor(path string) string {
+	return "file-" + strings.NewReplacer("/", "-", ".", "-").Replace(path)
+}
+
+// indexEntry links to a declaration from the index
+func indexEntry(name, text string) string {
+	return "<li><a href=\"#" + html.EscapeString(anchor(name)) + "\"><code>" + html.EscapeString(text) + "</code></a></li>\n"
+}
+
+// paragraphs writes doc text as HTML paragraphs, split at blank lines
+func paragraphs(doc string) string {
+	if doc == "" {
+		return ""
+	}
+	var out strings.Builder
+	for _, para := range strings.Split(doc, "\n\n") {
+		if para = strings.TrimSpace(para); para != "" {
+			out.WriteString("<p>" + html.EscapeString(para) + "</p>\n")
+		}
+	}
+	return out.String()
+}
+
+func indent(text, prefix string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = prefix + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
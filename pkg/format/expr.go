@@ -0,0 +1,331 @@
+package format
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+)
+
+// Binding strengths, from loosest to tightest, following the parser's
+// precedence levels
+const (
+	precLowest = iota
+	precAssign
+	precOr
+	precAnd
+	precEquals
+	precCompare
+	precSum
+	precProduct
+	precPrefix  // -x, !x, &x, *x and casts
+	precPostfix // x++, calls, indexing and member access
+	precPrimary
+)
+
+var infixPrecedences = map[string]int{
+	"||": precOr,
+	"&&": precAnd,
+	"==": precEquals,
+	"!=": precEquals,
+	"<":  precCompare,
+	">":  precCompare,
+	"<=": precCompare,
+	">=": precCompare,
+	"+":  precSum,
+	"-":  precSum,
+	"*":  precProduct,
+	"/":  precProduct,
+	"%":  precProduct,
+}
+
+// precedence returns how tightly an expression binds
+func precedence(e ast.Expression) int {
+	switch e := e.(type) {
+	case *ast.AssignExpression:
+		return precAssign
+	case *ast.InfixExpression:
+		return infixPrecedences[e.Operator]
+	case *ast.PrefixExpression, *ast.CastExpression, *ast.ComptimeExpression:
+		return precPrefix
+	case *ast.PostfixExpression, *ast.CallExpression, *ast.IndexExpression, *ast.MemberExpression:
+		return precPostfix
+	}
+	return precPrimary
+}
+
+// startToken returns the first token of an expression
+func startToken(e ast.Expression) lexer.Token {
+	switch e := e.(type) {
+	case *ast.InfixExpression:
+		return startToken(e.Left)
+	case *ast.PostfixExpression:
+		return startToken(e.Left)
+	case *ast.CallExpression:
+		return startToken(e.Function)
+	case *ast.IndexExpression:
+		return startToken(e.Left)
+	case *ast.MemberExpression:
+		return startToken(e.Object)
+	case *ast.AssignExpression:
+		return startToken(e.Left)
+	case *ast.CastExpression:
+		// The cast's own token is the last of its operand; the type
+		// follows the opening parenthesis
+		tok := e.TargetType.Token
+		tok.Column--
+		return tok
+	case *ast.Identifier:
+		return e.Token
+	case *ast.IntegerLiteral:
+		return e.Token
+	case *ast.FloatLiteral:
+		return e.Token
+	case *ast.StringLiteral:
+		return e.Token
+	case *ast.CharLiteral:
+		return e.Token
+	case *ast.BooleanLiteral:
+		return e.Token
+	case *ast.NullLiteral:
+		return e.Token
+	case *ast.PrefixExpression:
+		return e.Token
+	case *ast.ComptimeExpression:
+		return e.Token
+	case *ast.AllocExpression:
+		return e.Token
+	case *ast.MakeExpression:
+		return e.Token
+	case *ast.StructLiteral:
+		return e.Token
+	case *ast.ArrayLiteral:
+		return e.Token
+	case *ast.MapLiteral:
+		return e.Token
+	}
+	return lexer.Token{}
+}
+
+// expr prints an expression. header is set inside if, while and for
+// headers, where a struct literal must be parenthesised so that its brace
+// is not taken for the body's.
+func (p *printer) expr(e ast.Expression, header bool) {
+	switch e := e.(type) {
+	case *ast.Identifier:
+		p.write(e.Value)
+	case *ast.IntegerLiteral:
+		p.write(e.Token.Literal)
+	case *ast.FloatLiteral:
+		p.write(e.Token.Literal)
+	case *ast.StringLiteral:
+		p.write(`"` + e.Token.Literal + `"`)
+	case *ast.CharLiteral:
+		p.write("'" + e.Token.Literal + "'")
+	case *ast.BooleanLiteral:
+		if e.Value {
+			p.write("true")
+		} else {
+			p.write("false")
+		}
+	case *ast.NullLiteral:
+		p.write("null")
+
+	case *ast.PrefixExpression:
+		p.write(e.Operator)
+		// -(-x) and &(&x) would otherwise read as -- and &&
+		inner, ok := e.Right.(*ast.PrefixExpression)
+		doubled := ok && inner.Operator == e.Operator && (e.Operator == "-" || e.Operator == "&")
+		p.operand(e.Right, doubled || precedence(e.Right) < precPrefix, header)
+	case *ast.ComptimeExpression:
+		p.write("comptime ")
+		p.operand(e.Value, precedence(e.Value) < precPrefix, header)
+	case *ast.CastExpression:
+		p.write("(" + typ(e.TargetType) + ")")
+		p.operand(e.Value, precedence(e.Value) < precPrefix, header)
+	case *ast.InfixExpression:
+		prec := precedence(e)
+		p.operand(e.Left, precedence(e.Left) < prec, header)
+		p.write(" " + e.Operator + " ")
+		p.operand(e.Right, precedence(e.Right) <= prec, header)
+	case *ast.AssignExpression:
+		p.operand(e.Left, precedence(e.Left) <= precAssign, header)
+		p.write(" " + e.Operator + " ")
+		p.expr(e.Value, header)
+	case *ast.PostfixExpression:
+		p.operand(e.Left, precedence(e.Left) < precPostfix, header)
+		p.write(e.Operator)
+	case *ast.CallExpression:
+		p.operand(e.Function, precedence(e.Function) < precPostfix, header)
+		p.write("(")
+		p.list(e.Arguments, false)
+		p.write(")")
+	case *ast.IndexExpression:
+		p.operand(e.Left, precedence(e.Left) < precPostfix, header)
+		p.write("[")
+		p.expr(e.Index, header)
+		p.write("]")
+	case *ast.MemberExpression:
+		p.operand(e.Object, precedence(e.Object) < precPostfix, header)
+		p.write("." + e.Member.Value)
+
+	case *ast.AllocExpression:
+		p.write("alloc(")
+		if e.Init != nil {
+			p.structLiteral(e.Init)
+		} else {
+			p.write(typ(e.Type))
+		}
+		p.write(")")
+	case *ast.MakeExpression:
+		p.write("make(" + typ(e.Type))
+		if e.Length != nil {
+			p.write(", ")
+			p.expr(e.Length, header)
+		}
+		if e.Capacity != nil {
+			p.write(", ")
+			p.expr(e.Capacity, header)
+		}
+		p.write(")")
+	case *ast.StructLiteral:
+		if header {
+			p.write("(")
+			p.structLiteral(e)
+			p.write(")")
+		} else {
+			p.structLiteral(e)
+		}
+	case *ast.ArrayLiteral:
+		p.arrayLiteral(e, header)
+	case *ast.MapLiteral:
+		p.write(typ(e.Type))
+		var starts []lexer.Token
+		for _, pair := range e.Pairs {
+			starts = append(starts, startToken(pair.Key))
+		}
+		p.elements(e.Token, "{", "}", starts, func(i int) {
+			p.expr(e.Pairs[i].Key, header)
+			p.write(": ")
+			p.expr(e.Pairs[i].Value, header)
+		})
+	}
+}
+
+// typ prints a type, with the lengths of its arrays printed as
+// expressions
+func typ(t *ast.TypeAnnotation) string {
+	switch {
+	case t.Len != nil:
+		var p printer
+		p.expr(t.Len, false)
+		return "[" + p.out.String() + "]" + typ(t.Element())
+	case t.IsPtr:
+		return "*" + typ(t.Element())
+	case t.IsMap:
+		return "map[" + typ(t.KeyType) + "]" + typ(t.ValueType)
+	case t.IsFunc:
+		var params []string
+		for _, param := range t.Params {
+			params = append(params, typ(param))
+		}
+		out := "function(" + strings.Join(params, ", ") + ")"
+		if t.ReturnType != nil {
+			out += " " + typ(t.ReturnType)
+		}
+		return out
+	case t.ArrayLen == -1:
+		return "[]" + typ(t.Element())
+	case t.ArrayLen > 0:
+		return "[" + strconv.Itoa(t.ArrayLen) + "]" + typ(t.Element())
+	}
+	return t.String()
+}
+
+// operand prints a subexpression, in parentheses if parens is set.
+// Parentheses end a header, so struct literals are fine inside them.
+func (p *printer) operand(e ast.Expression, parens, header bool) {
+	if parens {
+		p.write("(")
+		p.expr(e, false)
+		p.write(")")
+		return
+	}
+	p.expr(e, header)
+}
+
+// list prints comma-separated expressions on one line
+func (p *printer) list(list []ast.Expression, header bool) {
+	for i, e := range list {
+		if i > 0 {
+			p.write(", ")
+		}
+		p.expr(e, header)
+	}
+}
+
+func (p *printer) structLiteral(lit *ast.StructLiteral) {
+	p.write(lit.Name.Value)
+	var starts []lexer.Token
+	for _, f := range lit.Fields {
+		starts = append(starts, f.Name.Token)
+	}
+	p.elements(lit.Token, "{", "}", starts, func(i int) {
+		p.write(lit.Fields[i].Name.Value + ": ")
+		p.expr(lit.Fields[i].Value, false)
+	})
+}
+
+func (p *printer) arrayLiteral(lit *ast.ArrayLiteral, header bool) {
+	var starts []lexer.Token
+	for _, e := range lit.Elements {
+		starts = append(starts, startToken(e))
+	}
+	element := func(i int) { p.expr(lit.Elements[i], header) }
+
+	switch {
+	case lit.Type != nil:
+		p.write(typ(lit.Type))
+		p.elements(lit.Token, "{", "}", starts, element)
+	case lit.Token.Type == lexer.LBRACE:
+		// A nested list whose type comes from the enclosing literal
+		p.elements(lit.Token, "{", "}", starts, element)
+	default:
+		p.elements(lit.Token, "[", "]", starts, element)
+	}
+}
+
+// elements prints the elements of a literal between open and close. A
+// literal whose first element was on a later line than its start is
+// printed with one element per line; any other on one line.
+func (p *printer) elements(start lexer.Token, open, close string, starts []lexer.Token, element func(int)) {
+	p.write(open)
+	if len(starts) == 0 || starts[0].Line == start.Line {
+		for i := range starts {
+			if i > 0 {
+				p.write(", ")
+			}
+			element(i)
+		}
+		p.write(close)
+		return
+	}
+
+	p.indent++
+	p.literals++
+	for i, tok := range starts {
+		if i > 0 {
+			p.write(",")
+		}
+		p.flushComments(tok.Line, tok.Column)
+		p.startLine(tok.Line)
+		element(i)
+	}
+	// Comments after the last element on its line stay with it
+	p.flushComments(starts[len(starts)-1].Line, 1<<31-1)
+	p.literals--
+	p.indent--
+	p.newline()
+	p.write(close)
+}
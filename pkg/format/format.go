@@ -0,0 +1,552 @@
+// Package format prints H-lang source in its canonical style.
+//
+// The style is fixed: four-space indentation, one statement per line,
+// single spaces around binary operators and only the parentheses that
+// precedence requires. Blank lines from the source are kept, at most one
+// in a row, and top-level declarations are separated by one. Every
+// comment is kept and written as a // line comment: comments on lines of
+// their own stay before the code that follows them, and comments after
+// code on a line are moved to the end of the line the code is printed on.
+package format
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+	"github.com/Dr-H-PhD/h-lang/pkg/parser"
+)
+
+const indentation = "    "
+
+// Source formats H-lang source. Source with syntax errors is not
+// formatted; the error lists the parser's messages.
+func Source(src []byte) ([]byte, error) {
+	p := parser.New(lexer.New(string(src)))
+	program := p.ParseProgram()
+	if errs := p.Errors(); len(errs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	return Program(program, src), nil
+}
+
+// Program prints a parsed program. src is the source it was parsed from;
+// it is consulted only for the blank lines between statements.
+func Program(program *ast.Program, src []byte) []byte {
+	p := &printer{
+		lines:    strings.Split(strings.ReplaceAll(string(src), "\r\n", "\n"), "\n"),
+		comments: program.Comments,
+	}
+
+	var prev ast.Statement
+	for _, stmt := range program.Statements {
+		tok := statementToken(stmt)
+		// The blank line goes before any comments on the declaration
+		if prev != nil && (isDeclaration(prev) || isDeclaration(stmt)) {
+			p.blank = true
+		}
+		p.flushComments(tok.Line, tok.Column)
+		p.startLine(tok.Line)
+		p.statement(stmt)
+		prev = stmt
+	}
+	p.flushComments(1<<31-1, 0)
+
+	if p.out.Len() == 0 {
+		return nil
+	}
+	p.out.WriteString("\n")
+	return []byte(p.out.String())
+}
+
+// printer writes the formatted program. Output is line by line: a new
+// line is started, with its indentation, only when something is written
+// on it, so that trailing comments can still be appended to the line
+// before.
+type printer struct {
+	out       strings.Builder
+	indent    int
+	lines     []string // the source, for blank lines
+	comments  []*ast.Comment
+	next      int  // index of the first comment not yet printed
+	blank     bool // a blank line is due before the next line
+	started   bool // the current block has printed a line
+	commented bool // the current line ends in a comment
+	literals  int  // depth of multi-line literals, which keep no blank lines
+}
+
+// isDeclaration reports whether a top-level statement is set apart from
+// its neighbours by a blank line. One-line extern declarations group
+// like imports.
+func isDeclaration(stmt ast.Statement) bool {
+	switch s := stmt.(type) {
+	case *ast.FunctionStatement:
+		return !s.Extern
+	case *ast.StructStatement:
+		return s.Fields != nil
+	case *ast.EnumStatement, *ast.TestStatement:
+		return true
+	}
+	return false
+}
+
+// blankBefore reports whether the source line before line is empty
+func (p *printer) blankBefore(line int) bool {
+	return line >= 2 && line-2 < len(p.lines) && strings.TrimSpace(p.lines[line-2]) == ""
+}
+
+// startLine begins a new output line for code or a comment that starts
+// on source line line, keeping a blank line from the source
+func (p *printer) startLine(line int) {
+	if p.started && p.literals == 0 && p.blankBefore(line) {
+		p.blank = true
+	}
+	if p.out.Len() > 0 {
+		p.out.WriteString("\n")
+		if p.blank && p.started {
+			p.out.WriteString("\n")
+		}
+	}
+	p.blank = false
+	p.started = true
+	p.commented = false
+	p.out.WriteString(strings.Repeat(indentation, p.indent))
+}
+
+// newline continues on a new line without a blank line before it
+func (p *printer) newline() {
+	p.commented = false
+	p.out.WriteString("\n" + strings.Repeat(indentation, p.indent))
+}
+
+// openBlock and closeBlock bracket the lines inside braces. An empty
+// block stays on the line it opened on.
+func (p *printer) openBlock() bool {
+	started := p.started
+	p.indent++
+	p.started = false
+	return started
+}
+
+func (p *printer) closeBlock(started bool, rbrace lexer.Token) {
+	p.flushComments(rbrace.Line, rbrace.Column)
+	p.indent--
+	if p.started || p.commented {
+		p.newline()
+	}
+	p.write("}")
+	p.started = started
+}
+
+// flushComments prints the comments that come before the given source
+// position. Comments that follow code on their line are appended to the
+// current output line; the others get lines of their own.
+func (p *printer) flushComments(line, column int) {
+	for p.next < len(p.comments) {
+		c := p.comments[p.next]
+		if c.Token.Line > line || (c.Token.Line == line && c.Token.Column >= column) {
+			return
+		}
+		p.next++
+
+		text := commentLines(c.Token.Literal)
+		if c.Token.Line == 1 && strings.HasPrefix(p.lines[0], "#!") {
+			// An interpreter line must keep its form
+			text = []string{"#" + c.Token.Literal}
+		}
+		first := 0
+		if c.Trailing && p.out.Len() > 0 {
+			p.write(" " + text[0])
+			first = 1
+		}
+		for i, t := range text[first:] {
+			if i == 0 {
+				p.startLine(c.Token.Line)
+			} else {
+				p.newline()
+			}
+			p.write(t)
+		}
+		p.commented = true
+	}
+}
+
+// commentLines converts the text of a #, // or /* */ comment to //
+// lines. The lines of a block comment lose a leading * decoration and
+// their common indentation.
+func commentLines(text string) []string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	lines := strings.Split(text, "\n")
+	for i := range lines {
+		lines[i] = strings.TrimRight(lines[i], " \t")
+	}
+
+	if len(lines) > 1 {
+		lines[0] = strings.TrimLeft(lines[0], " \t")
+		rest := lines[1:]
+
+		decorated := true
+		for _, l := range rest {
+			if t := strings.TrimLeft(l, " \t"); t != "" && !strings.HasPrefix(t, "*") {
+				decorated = false
+			}
+		}
+		if decorated {
+			for i, l := range rest {
+				rest[i] = strings.TrimPrefix(strings.TrimLeft(l, " \t"), "*")
+			}
+		}
+		dedent(rest)
+
+		for len(lines) > 0 && lines[0] == "" {
+			lines = lines[1:]
+		}
+		for len(lines) > 0 && lines[len(lines)-1] == "" {
+			lines = lines[:len(lines)-1]
+		}
+		if len(lines) == 0 {
+			lines = []string{""}
+		}
+		for i, l := range lines {
+			if l != "" {
+				lines[i] = " " + l
+			}
+		}
+	}
+
+	for i, l := range lines {
+		switch {
+		case l == "":
+			lines[i] = "//"
+		case l[0] == ' ' || l[0] == '\t':
+			lines[i] = "//" + l
+		default:
+			lines[i] = "// " + l
+		}
+	}
+	return lines
+}
+
+// dedent removes the indentation common to all non-empty lines
+func dedent(lines []string) {
+	common := -1
+	for _, l := range lines {
+		if l == "" {
+			continue
+		}
+		n := len(l) - len(strings.TrimLeft(l, " \t"))
+		if common < 0 || n < common {
+			common = n
+		}
+	}
+	for i, l := range lines {
+		if len(l) >= common && common > 0 {
+			lines[i] = l[common:]
+		}
+	}
+}
+
+// statementToken returns the first token of a statement
+func statementToken(stmt ast.Statement) lexer.Token {
+	switch s := stmt.(type) {
+	case *ast.ExpressionStatement:
+		return startToken(s.Expression)
+	case *ast.InferStatement:
+		return s.Name.Token
+	}
+	return tokenOf(stmt)
+}
+
+// tokenOf returns the Token field of a node
+func tokenOf(n ast.Node) lexer.Token {
+	switch n := n.(type) {
+	case *ast.ImportStatement:
+		return n.Token
+	case *ast.CIncludeStatement:
+		return n.Token
+	case *ast.LinkStatement:
+		return n.Token
+	case *ast.VarStatement:
+		return n.Token
+	case *ast.ConstStatement:
+		return n.Token
+	case *ast.ReturnStatement:
+		return n.Token
+	case *ast.FunctionStatement:
+		return n.Token
+	case *ast.TestStatement:
+		return n.Token
+	case *ast.StructStatement:
+		return n.Token
+	case *ast.EnumStatement:
+		return n.Token
+	case *ast.IfStatement:
+		return n.Token
+	case *ast.ForStatement:
+		return n.Token
+	case *ast.ForRangeStatement:
+		return n.Token
+	case *ast.WhileStatement:
+		return n.Token
+	case *ast.FreeStatement:
+		return n.Token
+	case *ast.DeferStatement:
+		return n.Token
+	case *ast.BreakStatement:
+		return n.Token
+	case *ast.ContinueStatement:
+		return n.Token
+	case *ast.DeleteStatement:
+		return n.Token
+	case *ast.BlockStatement:
+		return n.Token
+	}
+	return lexer.Token{}
+}
+
+// statement prints a statement on the current line
+func (p *printer) statement(stmt ast.Statement) {
+	switch s := stmt.(type) {
+	case *ast.ImportStatement:
+		p.write(`import "` + s.Path + `";`)
+	case *ast.CIncludeStatement:
+		p.write(`cinclude "` + s.Path + `";`)
+	case *ast.LinkStatement:
+		p.write(`link "` + s.Library + `";`)
+	case *ast.VarStatement:
+		p.write(public(s.Public) + "var " + s.Name.Value + " " + typ(s.Type))
+		if s.Value != nil {
+			p.write(" = ")
+			p.expr(s.Value, false)
+		}
+		p.write(";")
+	case *ast.ConstStatement:
+		p.write(public(s.Public) + "const " + s.Name.Value + " := ")
+		p.expr(s.Value, false)
+		p.write(";")
+	case *ast.FunctionStatement:
+		p.function(s)
+	case *ast.TestStatement:
+		p.write(`test "` + s.Name + `" `)
+		p.block(s.Body)
+	case *ast.StructStatement:
+		p.structDecl(s)
+	case *ast.EnumStatement:
+		p.enumDecl(s)
+	case *ast.IfStatement:
+		p.write("if ")
+		p.expr(s.Condition, true)
+		p.write(" ")
+		p.block(s.Consequence)
+		if s.Alternative != nil {
+			p.write(" else ")
+			p.block(s.Alternative)
+		}
+	case *ast.ForStatement:
+		p.write("for ")
+		if s.Init != nil {
+			p.simpleStatement(s.Init, true)
+		}
+		p.write("; ")
+		if s.Condition != nil {
+			p.expr(s.Condition, true)
+		}
+		p.write(";")
+		if s.Post != nil {
+			p.write(" ")
+			p.simpleStatement(s.Post, true)
+		}
+		p.write(" ")
+		p.block(s.Body)
+	case *ast.ForRangeStatement:
+		p.write("for ")
+		switch {
+		case s.Index != nil && s.Value != nil:
+			p.write(s.Index.Value + ", " + s.Value.Value)
+		case s.Index != nil:
+			p.write(s.Index.Value)
+		default:
+			p.write("_, " + s.Value.Value)
+		}
+		p.write(" := range ")
+		p.expr(s.Iterable, true)
+		p.write(" ")
+		p.block(s.Body)
+	case *ast.WhileStatement:
+		p.write("while ")
+		p.expr(s.Condition, true)
+		p.write(" ")
+		p.block(s.Body)
+	case *ast.ReturnStatement:
+		p.write("return")
+		if s.Value != nil {
+			p.write(" ")
+			p.expr(s.Value, false)
+		}
+		p.write(";")
+	case *ast.FreeStatement:
+		p.write("free(")
+		p.expr(s.Value, false)
+		p.write(");")
+	case *ast.DeleteStatement:
+		p.write("delete(")
+		p.expr(s.Map, false)
+		p.write(", ")
+		p.expr(s.Key, false)
+		p.write(");")
+	case *ast.DeferStatement:
+		p.write("defer ")
+		p.statement(s.Statement)
+	case *ast.BreakStatement:
+		p.write("break;")
+	case *ast.ContinueStatement:
+		p.write("continue;")
+	case *ast.BlockStatement:
+		p.block(s)
+	case *ast.InferStatement, *ast.ExpressionStatement:
+		p.simpleStatement(s, false)
+		p.write(";")
+	}
+}
+
+// simpleStatement prints an assignment, declaration or expression
+// without its semicolon, as in the header of a for loop
+func (p *printer) simpleStatement(stmt ast.Statement, header bool) {
+	switch s := stmt.(type) {
+	case *ast.InferStatement:
+		p.write(s.Name.Value + " := ")
+		p.expr(s.Value, header)
+	case *ast.ExpressionStatement:
+		p.expr(s.Expression, header)
+	default:
+		p.statement(stmt)
+	}
+}
+
+func public(public bool) string {
+	if public {
+		return "public "
+	}
+	return ""
+}
+
+func (p *printer) write(s string) {
+	p.out.WriteString(s)
+}
+
+// block prints { statements } starting on the current line
+func (p *printer) block(b *ast.BlockStatement) {
+	p.write("{")
+	started := p.openBlock()
+	for _, stmt := range b.Statements {
+		tok := statementToken(stmt)
+		p.flushComments(tok.Line, tok.Column)
+		p.startLine(tok.Line)
+		p.statement(stmt)
+	}
+	p.closeBlock(started, b.Rbrace)
+}
+
+func (p *printer) function(f *ast.FunctionStatement) {
+	p.write(public(f.Public) + extern(f.Extern) + comptime(f.Comptime) + "function ")
+	if f.Receiver != nil {
+		p.write("(" + f.Receiver.Name.Value + " " + typ(f.Receiver.Type) + ") ")
+	}
+	params := make([]string, len(f.Parameters))
+	for i, param := range f.Parameters {
+		params[i] = param.Name.Value + " " + typ(param.Type)
+	}
+	if f.Variadic {
+		params = append(params, "...")
+	}
+	p.write(f.Name.Value + "(" + strings.Join(params, ", ") + ")")
+	if f.ReturnType != nil {
+		p.write(" " + typ(f.ReturnType))
+	}
+	if f.Body == nil {
+		p.write(";")
+		return
+	}
+	p.write(" ")
+	p.block(f.Body)
+}
+
+func extern(extern bool) string {
+	if extern {
+		return "extern "
+	}
+	return ""
+}
+
+func comptime(comptime bool) string {
+	if comptime {
+		return "comptime "
+	}
+	return ""
+}
+
+func (p *printer) structDecl(s *ast.StructStatement) {
+	p.write(public(s.Public) + extern(s.Extern) + "struct " + s.Name.Value)
+	if s.Fields == nil {
+		p.write(";")
+		return
+	}
+	p.write(" {")
+	started := p.openBlock()
+	for _, f := range s.Fields {
+		p.flushComments(f.Name.Token.Line, f.Name.Token.Column)
+		p.startLine(f.Name.Token.Line)
+		p.write(public(f.Public) + f.Name.Value + " " + typ(f.Type) + ";")
+	}
+	p.closeBlock(started, s.Rbrace)
+}
+
+// enumDecl prints an enum on one line if it was written on one line,
+// and otherwise one value per line
+func (p *printer) enumDecl(s *ast.EnumStatement) {
+	p.write(public(s.Public) + "enum " + s.Name.Value + " {")
+
+	oneLine := s.Rbrace.Line == s.Name.Token.Line && !p.commentsBefore(s.Rbrace)
+	if oneLine {
+		for i, v := range s.Values {
+			if i > 0 {
+				p.write(",")
+			}
+			p.write(" ")
+			p.enumValue(v)
+		}
+		if len(s.Values) > 0 {
+			p.write(" ")
+		}
+		p.write("}")
+		return
+	}
+
+	started := p.openBlock()
+	for _, v := range s.Values {
+		p.flushComments(v.Name.Token.Line, v.Name.Token.Column)
+		p.startLine(v.Name.Token.Line)
+		p.enumValue(v)
+		p.write(",")
+	}
+	p.closeBlock(started, s.Rbrace)
+}
+
+func (p *printer) enumValue(v *ast.EnumValue) {
+	p.write(v.Name.Value)
+	if v.Value != nil {
+		p.write(" = ")
+		p.expr(v.Value, false)
+	}
+}
+
+// commentsBefore reports whether a comment not yet printed comes before
+// the token
+func (p *printer) commentsBefore(tok lexer.Token) bool {
+	if p.next >= len(p.comments) {
+		return false
+	}
+	c := p.comments[p.next].Token
+	return c.Line < tok.Line || (c.Line == tok.Line && c.Column < tok.Column)
+}
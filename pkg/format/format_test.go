@@ -0,0 +1,175 @@
+package format
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+)
+
+func TestSource(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		expect string
+	}{
+		{
+			"spacing and indentation",
+			"function add(a int,b int) int{\nreturn a+b ;}\n",
+			"function add(a int, b int) int {\n    return a + b;\n}\n",
+		},
+		{
+			"declarations",
+			"public var  g int=3;\nconst N:=10;\nstruct Point { x int; public y int; }\n",
+			"public var g int = 3;\nconst N := 10;\n\nstruct Point {\n    x int;\n    public y int;\n}\n",
+		},
+		{
+			"blank lines",
+			"function main() {\n\n    x := 1;\n\n\n\n    y := 2;\n\n}\nfunction f() {}\n",
+			"function main() {\n    x := 1;\n\n    y := 2;\n}\n\nfunction f() {}\n",
+		},
+		{
+			"parentheses",
+			"function main() {\n    x := ((a + b) * c) - (d - e) - -f;\n    y := -(-x);\n    z := (a = 1) + (((int)b));\n}\n",
+			"function main() {\n    x := (a + b) * c - (d - e) - -f;\n    y := -(-x);\n    z := (a = 1) + (int)b;\n}\n",
+		},
+		{
+			"struct literal in a header",
+			"function main() {\n    if (P{x: 1}).x == 1 { print(1); } else { print(2); }\n}\n",
+			"function main() {\n    if (P{x: 1}).x == 1 {\n        print(1);\n    } else {\n        print(2);\n    }\n}\n",
+		},
+		{
+			"loops",
+			"function main() {\n    for i:=0;i<3;i++ { print(i); }\n    for _, v := range xs {}\n    while x<3 { x+=1; }\n}\n",
+			"function main() {\n    for i := 0; i < 3; i++ {\n        print(i);\n    }\n    for _, v := range xs {}\n    while x < 3 {\n        x += 1;\n    }\n}\n",
+		},
+		{
+			"literals",
+			"function main() {\n    a := [2][2]int{{1,2},{3,4}};\n    m := map[string]int{\"a\":1};\n    c := 'x';\n    p := alloc(P{x: 1});\n}\n",
+			"function main() {\n    a := [2][2]int{{1, 2}, {3, 4}};\n    m := map[string]int{\"a\": 1};\n    c := 'x';\n    p := alloc(P{x: 1});\n}\n",
+		},
+		{
+			"multi-line literals",
+			"function main() {\n    p := P{\n        x: 1, # one\n\n        y: 2 # two\n    };\n}\n",
+			"function main() {\n    p := P{\n        x: 1, // one\n        y: 2 // two\n    };\n}\n",
+		},
+		{
+			"comptime",
+			"comptime  function sq(x int) int { return x*x; }\nvar g [N*(2+1)]int;\nfunction main() {\n    a := comptime   sq(N+1)*2;\n    b := [N]int{1,2};\n}\n",
+			"comptime function sq(x int) int {\n    return x * x;\n}\n\nvar g [N * (2 + 1)]int;\n\nfunction main() {\n    a := comptime sq(N + 1) * 2;\n    b := [N]int{1, 2};\n}\n",
+		},
+		{
+			"enums",
+			"enum A { X, Y = 2 }\nenum B {\n    X,\n    Y\n}\n",
+			"enum A { X, Y = 2 }\n\nenum B {\n    X,\n    Y,\n}\n",
+		},
+		{
+			"comment styles",
+			"# hash\n/* block */\nfunction main() {\n    x := 1;  #trailing\n    /*\n     * decorated\n     *   indented\n     */\n}\n",
+			"// hash\n// block\nfunction main() {\n    x := 1; // trailing\n    // decorated\n    //   indented\n}\n",
+		},
+		{
+			"comments in empty blocks",
+			"function f() { # todo\n}\nfunction g() {\n    // nothing\n}\n",
+			"function f() { // todo\n}\n\nfunction g() {\n    // nothing\n}\n",
+		},
+		{
+			"blank line before a commented declaration",
+			"x := 1;\n// f does nothing\nfunction f() {}\n# end\n",
+			"x := 1;\n\n// f does nothing\nfunction f() {}\n// end\n",
+		},
+		{
+			"interpreter line",
+			"#!/usr/bin/env hlc\nfunction main() {}\n",
+			"#!/usr/bin/env hlc\nfunction main() {}\n",
+		},
+		{
+			"test blocks",
+			"test \"adds\" { assert_eq(add(1,2),3); }\n",
+			"test \"adds\" {\n    assert_eq(add(1, 2), 3);\n}\n",
+		},
+		{
+			"extern declarations",
+			"cinclude \"<math.h>\"\nlink \"m\"\nextern function sqrt(x float) float\npublic extern function printf(f string,...) int;\nextern struct FILE\nextern struct tm { public tm_sec int }\n",
+			"cinclude \"<math.h>\";\nlink \"m\";\nextern function sqrt(x float) float;\npublic extern function printf(f string, ...) int;\nextern struct FILE;\n\nextern struct tm {\n    public tm_sec int;\n}\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := Source([]byte(tt.input))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(out) != tt.expect {
+				t.Errorf("expected:\n%s\ngot:\n%s", tt.expect, out)
+			}
+			again, err := Source(out)
+			if err != nil {
+				t.Fatalf("formatted source does not parse: %v", err)
+			}
+			if string(again) != string(out) {
+				t.Errorf("formatting is not idempotent:\n%s\nbecame:\n%s", out, again)
+			}
+		})
+	}
+}
+
+func TestSource_Errors(t *testing.T) {
+	_, err := Source([]byte("function main() {\n    x := ;\n}\n"))
+	if err == nil {
+		t.Fatal("expected a parse error")
+	}
+	if !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected the error to name line 2, got %v", err)
+	}
+}
+
+// TestSource_Examples checks that every example keeps its comments and
+// formats to a fixed point
+func TestSource_Examples(t *testing.T) {
+	files, _ := filepath.Glob("../../examples/*.hl")
+	lib, _ := filepath.Glob("../../lib/*.hl")
+	files = append(files, lib...)
+	if len(files) == 0 {
+		t.Skip("no examples found")
+	}
+
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := Source(src)
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		again, err := Source(out)
+		if err != nil {
+			t.Errorf("%s: formatted source does not parse: %v", file, err)
+			continue
+		}
+		if string(again) != string(out) {
+			t.Errorf("%s: formatting is not idempotent", file)
+		}
+
+		// Block comments may become several line comments
+		if want, got := countComments(src), countComments(out); got < want {
+			t.Errorf("%s: expected at least %d comments, got %d", file, want, got)
+		}
+	}
+}
+
+func countComments(src []byte) int {
+	l := lexer.New(string(src))
+	n := 0
+	for tok := l.NextToken(); tok.Type != lexer.EOF; tok = l.NextToken() {
+		if tok.Type == lexer.COMMENT {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,362 @@
+package interp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/analysis"
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+)
+
+func (in *Interpreter) callExpression(x *ast.CallExpression) (Value, error) {
+	switch f := x.Function.(type) {
+	case *ast.Identifier:
+		obj := in.frame.mod.info.Uses[f]
+		switch {
+		case obj == nil && f.Value == "static_assert":
+			return Value{}, in.staticAssert(x)
+		case obj == nil && in.comptime != nil && f.Value != "len":
+			return Value{}, in.errorf("%s cannot be evaluated at compile time", x.String())
+		case obj == nil:
+			return in.builtin(f, x.Arguments)
+		}
+		if obj.Kind == analysis.Func {
+			return in.callWith(obj.Node.(*ast.FunctionStatement), nil, x.Arguments)
+		}
+	case *ast.MemberExpression:
+		if v, ok, err := in.methodCall(f, x.Arguments); ok || err != nil {
+			return v, err
+		}
+	}
+
+	// Anything else is a function value
+	fn, err := in.eval(x.Function)
+	if err != nil {
+		return Value{}, err
+	}
+	if fn.Kind != Func {
+		return Value{}, in.errorf("cannot call a %s", fn.Kind)
+	}
+	if fn.fn == nil {
+		return Value{}, in.errorf("call of a null function")
+	}
+	return in.callWith(fn.fn, nil, x.Arguments)
+}
+
+// methodCall calls obj.method(args). The receiver is passed by address to
+// pointer methods and copied to value methods, whether obj is a struct or
+// a pointer to one. It reports false if obj has no such method, for
+// fields that hold functions.
+func (in *Interpreter) methodCall(m *ast.MemberExpression, args []ast.Expression) (Value, bool, error) {
+	at, err := in.ref(m.Object)
+	if err != nil {
+		return Value{}, false, err
+	}
+	recv := at.cells[at.i]
+	ptr := recv.Kind == Pointer
+	if ptr {
+		cell, err := in.cell(recv, 0)
+		if err != nil {
+			return Value{}, false, err
+		}
+		at = recv.at
+		recv = *cell
+	}
+	if recv.Kind != Struct {
+		return Value{}, false, nil
+	}
+	decl := in.methods[recv.Type+"."+m.Member.Value]
+	if decl == nil {
+		return Value{}, false, nil
+	}
+
+	if decl.Receiver.Type.IsPtr {
+		// A temporary receiver still needs an address
+		if at.b == nil {
+			at = location{b: variable(recv), cells: []Value{recv}}
+		}
+		recv = pointerTo(at)
+	} else {
+		recv = recv.copy()
+	}
+	v, err := in.callWith(decl, &recv, args)
+	return v, true, err
+}
+
+// callWith evaluates the arguments of a call, then makes it
+func (in *Interpreter) callWith(decl *ast.FunctionStatement, recv *Value, exprs []ast.Expression) (Value, error) {
+	args := make([]Value, len(exprs))
+	for i, x := range exprs {
+		v, err := in.eval(x)
+		if err != nil {
+			return Value{}, err
+		}
+		if i < len(decl.Parameters) {
+			zero, err := in.zero(decl.Parameters[i].Type)
+			if err != nil {
+				return Value{}, err
+			}
+			v = in.decay(zero, x, v)
+		}
+		args[i] = v
+	}
+	return in.call(decl, recv, args)
+}
+
+// call runs a function with its receiver, if it is a method, and its
+// arguments, and returns its result
+func (in *Interpreter) call(decl *ast.FunctionStatement, recv *Value, args []Value) (Value, error) {
+	name := decl.Name.Value
+	if len(args) != len(decl.Parameters) {
+		return Value{}, in.errorf("%s takes %d arguments, got %d", name, len(decl.Parameters), len(args))
+	}
+	for i, p := range decl.Parameters {
+		zero, err := in.zero(p.Type)
+		if err != nil {
+			return Value{}, err
+		}
+		args[i] = convert(zero, args[i])
+	}
+	switch {
+	case in.comptime != nil && decl.Body == nil:
+		return Value{}, in.errorf("%s cannot be called at compile time", name)
+	case in.comptime != nil && in.depth >= comptimeDepth:
+		return Value{}, in.errorf("compile-time calls nested more than %d deep", comptimeDepth)
+	case decl.Extern:
+		return in.extern(decl, args)
+	case decl.Body == nil:
+		return Value{}, in.errorf("%s has no body", name)
+	case in.depth >= maxDepth:
+		return Value{}, in.errorf("stack overflow in %s", name)
+	}
+
+	caller := in.frame
+	f := &frame{
+		mod:  in.owners[decl],
+		fn:   in.function(decl),
+		vars: make(map[*analysis.Object]*block),
+		line: decl.Token.Line,
+	}
+	if f.mod == nil {
+		f.mod = caller.mod
+	}
+	if recv != nil {
+		if obj := f.mod.info.Defs[decl.Receiver.Name]; obj != nil {
+			f.vars[obj] = variable(*recv)
+		}
+	}
+	for i, p := range decl.Parameters {
+		if obj := f.mod.info.Defs[p.Name]; obj != nil {
+			f.vars[obj] = variable(args[i])
+		}
+	}
+
+	in.frame = f
+	in.depth++
+	defer func() {
+		in.frame = caller
+		in.depth--
+	}()
+
+	fl, err := in.block(decl.Body.Statements)
+	var failed *Error
+	if in.comptime != nil && f.mod != caller.mod && errors.As(err, &failed) {
+		// The lines of another module mean nothing to the optimizer
+		in.frame = caller
+		return Value{}, in.errorf("%s: %s", name, failed.Message)
+	}
+	if err != nil {
+		return Value{}, err
+	}
+	if fl != returning && in.comptime != nil && decl.ReturnType != nil {
+		in.frame = caller
+		return Value{}, in.errorf("%s ended without returning a value", name)
+	}
+	if fl != returning {
+		if err := in.runDefers(len(f.fn.defers)); err != nil {
+			return Value{}, err
+		}
+		return in.zero(decl.ReturnType)
+	}
+	return f.result, nil
+}
+
+// extern calls the Go function defined for an extern function
+func (in *Interpreter) extern(decl *ast.FunctionStatement, args []Value) (Value, error) {
+	name := decl.Name.Value
+	fn, ok := in.externs[name]
+	if !ok {
+		return Value{}, in.errorf("extern function %s is not defined in the interpreter", name)
+	}
+	v, err := fn(args)
+	if err != nil {
+		if _, ok := err.(*ExitError); ok {
+			return Value{}, err
+		}
+		if _, ok := err.(*Error); ok {
+			return Value{}, err
+		}
+		return Value{}, in.errorf("%s: %v", name, err)
+	}
+	zero, err := in.zero(decl.ReturnType)
+	return convert(zero, v), err
+}
+
+// builtin calls a builtin function, which any declaration of the same
+// name shadows
+func (in *Interpreter) builtin(id *ast.Identifier, exprs []ast.Expression) (Value, error) {
+	name := id.Value
+	switch name {
+	case "init":
+		return Value{}, in.errorf("init cannot be called; it runs automatically before main")
+	case "assert", "assert_eq":
+		return Value{}, in.assert(id, exprs)
+	case "args":
+		if len(exprs) != 0 {
+			return Value{}, in.errorf("args takes no arguments, got %d", len(exprs))
+		}
+		cells := make([]Value, len(in.Args))
+		for i, arg := range in.Args {
+			cells[i] = StringValue(arg)
+		}
+		return allocate(cells), nil
+	case "print":
+		if len(exprs) == 0 {
+			_, err := io.WriteString(in.Stdout, "\n")
+			return Value{}, err
+		}
+	case "len", "getenv", "exit":
+		if len(exprs) != 1 {
+			return Value{}, in.errorf("%s takes 1 argument, got %d", name, len(exprs))
+		}
+	default:
+		return Value{}, in.errorf("undefined: %s", name)
+	}
+
+	// Like the C backend, print shows only its first argument
+	arg, err := in.eval(exprs[0])
+	if err != nil {
+		return Value{}, err
+	}
+	switch name {
+	case "print":
+		switch arg.Kind {
+		case Int, Float, Bool, Char, String:
+		default:
+			return Value{}, in.errorf("print cannot show a %s", arg.Kind)
+		}
+		_, err := io.WriteString(in.Stdout, arg.String()+"\n")
+		return Value{}, err
+	case "len":
+		return in.len(arg)
+	case "getenv":
+		if arg.Kind != String || arg.null {
+			return Value{}, in.errorf("the name given to getenv is not a string")
+		}
+		if v, ok := in.Getenv(cString(arg.Str)); ok {
+			return StringValue(v), nil
+		}
+		return zeroOf(String), nil
+	}
+	if arg.Kind != Int && arg.Kind != Char {
+		return Value{}, in.errorf("the status given to exit is a %s, not an int", arg.Kind)
+	}
+	return Value{}, &ExitError{Status: int(arg.Int)}
+}
+
+// len returns the length of a string, array, slice or map
+func (in *Interpreter) len(v Value) (Value, error) {
+	switch v.Kind {
+	case String:
+		if v.null {
+			return Value{}, in.errorf("use of a null string")
+		}
+		return IntValue(int64(len(cString(v.Str)))), nil
+	case Array:
+		return IntValue(int64(len(v.elems))), nil
+	case Map:
+		entries, err := in.mapOf(v)
+		return IntValue(int64(len(entries))), err
+	case Pointer:
+		n, err := in.length(v)
+		return IntValue(int64(n)), err
+	}
+	return Value{}, in.errorf("a %s has no length", v.Kind)
+}
+
+// assert checks assert(cond) or assert_eq(a, b). A failure is reported
+// as the C runtime reports it and exits with status 1.
+func (in *Interpreter) assert(id *ast.Identifier, exprs []ast.Expression) error {
+	pos := in.position(id.Token)
+	if id.Value == "assert" {
+		if len(exprs) != 1 {
+			return in.errorf("assert takes 1 argument, got %d", len(exprs))
+		}
+		ok, err := in.condition(exprs[0])
+		if err != nil || ok {
+			return err
+		}
+		fmt.Fprintf(in.Stderr, "%s: assertion failed: %s\n", pos, ast.ExpressionText(exprs[0]))
+		return &ExitError{Status: 1}
+	}
+
+	if len(exprs) != 2 {
+		return in.errorf("assert_eq takes 2 arguments, got %d", len(exprs))
+	}
+	a, err := in.eval(exprs[0])
+	if err != nil {
+		return err
+	}
+	b, err := in.eval(exprs[1])
+	if err != nil {
+		return err
+	}
+	if a.Kind == Array || b.Kind == Array {
+		return in.errorf("assert_eq cannot compare arrays")
+	}
+	eq, err := in.equal(a, b)
+	if err != nil || eq {
+		return err
+	}
+
+	ea, eb := ast.ExpressionText(exprs[0]), ast.ExpressionText(exprs[1])
+	if a.Kind == Struct {
+		fmt.Fprintf(in.Stderr, "%s: assertion failed: assert_eq(%s, %s)\n", pos, ea, eb)
+		return &ExitError{Status: 1}
+	}
+	fmt.Fprintf(in.Stderr, "%s: assert_eq(%s, %s) failed\n", pos, ea, eb)
+	fmt.Fprintf(in.Stderr, "    left:  %s\n    right: %s\n", assertValue(a), assertValue(b))
+	return &ExitError{Status: 1}
+}
+
+// assertValue formats a value as a failed assert_eq shows it
+func assertValue(v Value) string {
+	switch v.Kind {
+	case Float:
+		return fmt.Sprintf("%g", v.Float)
+	case String:
+		if v.null {
+			return "null"
+		}
+		return `"` + cString(v.Str) + `"`
+	case Char:
+		return fmt.Sprint(v.Int)
+	case Pointer, Map, Func:
+		if v.IsNull() {
+			return "(nil)"
+		}
+		return fmt.Sprintf("%s %p", v.Kind, v.at.b)
+	}
+	return v.String()
+}
+
+// position formats the source position of a token as file:line:column
+func (in *Interpreter) position(tok lexer.Token) string {
+	file := in.sourceName
+	if in.frame.mod.path != "" {
+		file = in.frame.mod.path
+	}
+	return lexer.Position{Filename: file, Line: tok.Line, Column: tok.Column}.String()
+}
@@ -0,0 +1,258 @@
+package interp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/analysis"
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+	"github.com/Dr-H-PhD/h-lang/pkg/optimize"
+)
+
+// Limits on one compile-time evaluation, so that code that never returns
+// stops the compiler with an error instead of hanging it
+const (
+	comptimeSteps = 10000000 // statements run and array elements made
+	comptimeDepth = 1000     // calls in progress at once
+)
+
+// Comptime evaluates the comptime expressions of a module for the
+// optimizer, by running the code they call as written. What is only known
+// once the program runs is refused: output, the environment, extern
+// functions and global variables. Constants and enum values are evaluated
+// when they are first needed.
+type Comptime struct {
+	module *analysis.Module
+	in     *Interpreter // made when the first expression is evaluated
+}
+
+// comptime is what an interpreter knows while it runs comptime code
+type comptime struct {
+	owners  map[ast.Node]*module // the modules constants and enum values are declared in
+	enums   map[*ast.EnumValue]*ast.EnumStatement
+	pending map[ast.Node]bool // the constants and enums being evaluated
+}
+
+// NewComptime returns the Comptime of a module, whose imports must be
+// optimized already
+func NewComptime(module *analysis.Module) *Comptime {
+	return &Comptime{module: module}
+}
+
+// Eval implements optimize.Comptime. The expression runs in a frame of
+// its own with no line, so that its errors are given the expression's.
+func (c *Comptime) Eval(x ast.Expression) (optimize.Value, error) {
+	if c.in == nil {
+		c.load()
+	}
+	in := c.in
+	in.steps, in.depth = 0, 0
+	in.frame = &frame{mod: in.main, vars: make(map[*analysis.Object]*block)}
+	defer func() { in.frame = nil }()
+
+	v, err := in.eval(x)
+	if err != nil {
+		var failed *Error
+		if errors.As(err, &failed) {
+			return optimize.Value{}, &optimize.Error{Line: failed.Line, Message: failed.Message}
+		}
+		return optimize.Value{}, &optimize.Error{Message: err.Error()}
+	}
+	result, err := constant(v)
+	if err != nil {
+		return optimize.Value{}, &optimize.Error{Message: err.Error()}
+	}
+	return result, nil
+}
+
+// load records the declarations of the module and its imports. Imports
+// see the public declarations of the other imports.
+func (c *Comptime) load() {
+	in := New()
+	in.MaxSteps = comptimeSteps
+	in.comptime = &comptime{
+		owners:  make(map[ast.Node]*module),
+		enums:   make(map[*ast.EnumValue]*ast.EnumStatement),
+		pending: make(map[ast.Node]bool),
+	}
+	for _, imp := range c.module.Imports {
+		m := &analysis.Module{Program: imp.Program}
+		for _, other := range c.module.Imports {
+			if other != imp {
+				m.Imports = append(m.Imports, other)
+			}
+		}
+		in.addComptimeModule(&module{path: imp.Path, program: imp.Program, info: analysis.ResolveModule(m)})
+	}
+	in.main = &module{program: c.module.Program, info: analysis.ResolveModule(c.module)}
+	in.addComptimeModule(in.main)
+	c.in = in
+}
+
+func (in *Interpreter) addComptimeModule(mod *module) {
+	in.register(mod)
+	for _, stmt := range mod.program.Statements {
+		switch s := stmt.(type) {
+		case *ast.ConstStatement:
+			in.comptime.owners[s] = mod
+		case *ast.EnumStatement:
+			for _, v := range s.Values {
+				in.comptime.owners[v] = mod
+				in.comptime.enums[v] = s
+			}
+		}
+	}
+}
+
+// within evaluates a declaration in a frame of the module it belongs to
+func (in *Interpreter) within(mod *module, line int, eval func() (Value, error)) (Value, error) {
+	caller := in.frame
+	in.frame = &frame{mod: mod, vars: make(map[*analysis.Object]*block), line: line}
+	defer func() { in.frame = caller }()
+	return eval()
+}
+
+// comptimeGlobal returns the storage of a constant, evaluated the first
+// time it is used. A constant that cannot be evaluated reports its own
+// error where it is declared.
+func (in *Interpreter) comptimeGlobal(id *ast.Identifier, stmt ast.Statement) (*block, error) {
+	c, ok := stmt.(*ast.ConstStatement)
+	if !ok || in.comptime.owners[c] == nil || in.comptime.pending[c] {
+		return nil, in.errorf("%s is not known at compile time", id.Value)
+	}
+	in.comptime.pending[c] = true
+	defer delete(in.comptime.pending, c)
+	v, err := in.within(in.comptime.owners[c], c.Token.Line, func() (Value, error) {
+		zero, err := in.zero(c.Type)
+		if err != nil {
+			return Value{}, err
+		}
+		v, err := in.eval(c.Value)
+		return convert(zero, v), err
+	})
+	if err != nil {
+		return nil, in.errorf("%s is not known at compile time", id.Value)
+	}
+	b := variable(v)
+	in.globals[c] = b
+	return b, nil
+}
+
+// comptimeEnumValue returns the value of an enum value, numbering the
+// values of its enum up to it the first time one is used
+func (in *Interpreter) comptimeEnumValue(id *ast.Identifier, ev *ast.EnumValue) (Value, error) {
+	if n, ok := in.values[ev]; ok {
+		return IntValue(n), nil
+	}
+	s := in.comptime.enums[ev]
+	if s == nil || in.comptime.pending[s] {
+		return Value{}, in.errorf("%s is not known at compile time", id.Value)
+	}
+	in.comptime.pending[s] = true
+	defer delete(in.comptime.pending, s)
+	next := int64(0)
+	for _, v := range s.Values {
+		if v.Value != nil {
+			x, err := in.within(in.comptime.owners[v], v.Name.Token.Line, func() (Value, error) {
+				return in.eval(v.Value)
+			})
+			if err != nil || x.Kind != Int {
+				return Value{}, in.errorf("%s is not known at compile time", id.Value)
+			}
+			next = x.Int
+		}
+		in.values[v] = next
+		if v == ev {
+			break
+		}
+		next++
+	}
+	return IntValue(in.values[ev]), nil
+}
+
+// staticAssert checks a static assertion when it runs at compile time.
+// The others were checked when the program was compiled.
+func (in *Interpreter) staticAssert(call *ast.CallExpression) error {
+	if in.comptime == nil {
+		return nil
+	}
+	err := optimize.StaticAssert(call, func(cond ast.Expression) (optimize.Value, error) {
+		v, err := in.eval(cond)
+		if err != nil {
+			return optimize.Value{}, err
+		}
+		c, err := constant(v)
+		if err != nil {
+			return optimize.Value{}, in.errorf("%s", err)
+		}
+		return c, nil
+	})
+	var failed *optimize.Error
+	if errors.As(err, &failed) {
+		return in.errorf("%s", failed.Message)
+	}
+	return err
+}
+
+// constant returns a value computed at compile time as the optimizer
+// writes it into the program
+func constant(v Value) (optimize.Value, error) {
+	switch v.Kind {
+	case Int:
+		if v.Int != int64(int32(v.Int)) {
+			return optimize.Value{}, fmt.Errorf("constant %s overflows int", v)
+		}
+		return optimize.Value{Kind: optimize.Int, Int: v.Int}, nil
+	case Float:
+		return optimize.Value{Kind: optimize.Float, Float: v.Float}, nil
+	case Bool:
+		return optimize.Value{Kind: optimize.Bool, Bool: v.Bool}, nil
+	case String:
+		if v.null {
+			return optimize.Value{}, errors.New("null strings cannot be computed at compile time")
+		}
+		return optimize.Value{Kind: optimize.String, Str: quote(v.Str)}, nil
+	case Array:
+		if len(v.elems) == 0 {
+			return optimize.Value{}, errors.New("empty arrays cannot be computed at compile time")
+		}
+		arr := optimize.Value{Kind: optimize.Array, Elems: make([]optimize.Value, len(v.elems))}
+		for i, elem := range v.elems {
+			c, err := constant(elem)
+			if err != nil {
+				return optimize.Value{}, err
+			}
+			arr.Elems[i] = c
+		}
+		arr.Elem = typeOf(arr.Elems[0])
+		return arr, nil
+	}
+	return optimize.Value{}, fmt.Errorf("%s values cannot be computed at compile time", v.Kind)
+}
+
+// typeOf returns the type of a computed value, with array lengths as
+// numbers
+func typeOf(v optimize.Value) *ast.TypeAnnotation {
+	switch v.Kind {
+	case optimize.Float:
+		return &ast.TypeAnnotation{Name: "float"}
+	case optimize.Bool:
+		return &ast.TypeAnnotation{Name: "bool"}
+	case optimize.String:
+		return &ast.TypeAnnotation{Name: "string"}
+	case optimize.Array:
+		return &ast.TypeAnnotation{Name: v.Elem.Name, ArrayLen: len(v.Elems), Elem: v.Elem}
+	}
+	return &ast.TypeAnnotation{Name: "int"}
+}
+
+// escapes are the escape sequences unquote replaces, but for \0, which
+// ends a C string
+var escapes = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`, "\r", `\r`,
+	"\a", `\a`, "\b", `\b`, "\f", `\f`, "\v", `\v`)
+
+// quote writes a string as the text of a string literal
+func quote(s string) string {
+	return escapes.Replace(cString(s))
+}
@@ -0,0 +1,931 @@
+package interp
+
+import (
+	"strings"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/analysis"
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+)
+
+func (in *Interpreter) eval(expr ast.Expression) (Value, error) {
+	switch x := expr.(type) {
+	case *ast.IntegerLiteral:
+		// Literals too large for an int are longs, as in C
+		if x.Value != int64(int32(x.Value)) {
+			return Value{Kind: Int, Int: x.Value, Type: "long"}, nil
+		}
+		return IntValue(x.Value), nil
+	case *ast.FloatLiteral:
+		return FloatValue(x.Value), nil
+	case *ast.StringLiteral:
+		return StringValue(in.literal(x)), nil
+	case *ast.CharLiteral:
+		return Value{Kind: Char, Int: wrap(int64(charOf(x)), "int8")}, nil
+	case *ast.BooleanLiteral:
+		return BoolValue(x.Value), nil
+	case *ast.NullLiteral:
+		return Value{Kind: Pointer}, nil
+	case *ast.Identifier:
+		return in.lookup(x)
+	case *ast.ComptimeExpression:
+		// At run time, only comptime expressions the compiler could not
+		// evaluate are left, and it reports them
+		return in.eval(x.Value)
+	case *ast.PrefixExpression:
+		return in.prefix(x)
+	case *ast.InfixExpression:
+		return in.infix(x)
+	case *ast.AssignExpression:
+		return in.assign(x)
+	case *ast.PostfixExpression:
+		at, err := in.target(x.Left)
+		if err != nil {
+			return Value{}, err
+		}
+		old := at.cells[at.i]
+		v, err := in.binary(x.Operator[:1], old, IntValue(1))
+		if err != nil {
+			return Value{}, err
+		}
+		store(&at.cells[at.i], v)
+		return old, nil
+	case *ast.IndexExpression:
+		return in.index(x)
+	case *ast.MemberExpression:
+		at, err := in.ref(x)
+		if err != nil {
+			return Value{}, err
+		}
+		return at.cells[at.i], nil
+	case *ast.CastExpression:
+		return in.cast(x)
+	case *ast.AllocExpression:
+		if x.Init != nil {
+			v, err := in.eval(x.Init)
+			if err != nil {
+				return Value{}, err
+			}
+			return allocate([]Value{v}), nil
+		}
+		v, err := in.zero(x.Type)
+		if err != nil {
+			return Value{}, err
+		}
+		return allocate([]Value{v}), nil
+	case *ast.StructLiteral:
+		return in.structLiteral(x)
+	case *ast.ArrayLiteral:
+		return in.arrayLiteral(x)
+	case *ast.MapLiteral:
+		return in.mapLiteral(x)
+	case *ast.MakeExpression:
+		return in.make(x)
+	case *ast.CallExpression:
+		return in.callExpression(x)
+	}
+	return Value{}, in.errorf("%s cannot be evaluated", expr.String())
+}
+
+// literal returns the value of a string literal, with its escapes replaced
+func (in *Interpreter) literal(x *ast.StringLiteral) string {
+	s, ok := in.literals[x]
+	if !ok {
+		s = unquote(x.Value)
+		in.literals[x] = s
+	}
+	return s
+}
+
+// charOf returns the value of a char literal, which may be an escape
+func charOf(x *ast.CharLiteral) byte {
+	if s := unquote(x.Token.Literal); s != "" {
+		return s[0]
+	}
+	return x.Value
+}
+
+// lookup returns the value a name refers to
+func (in *Interpreter) lookup(id *ast.Identifier) (Value, error) {
+	obj := in.frame.mod.info.Uses[id]
+	if obj == nil {
+		return Value{}, in.errorf("undefined: %s", id.Value)
+	}
+	switch obj.Kind {
+	case analysis.Func:
+		return Value{Kind: Func, fn: obj.Node.(*ast.FunctionStatement)}, nil
+	case analysis.EnumValue:
+		if in.comptime != nil {
+			return in.comptimeEnumValue(id, obj.Node.(*ast.EnumValue))
+		}
+		return IntValue(in.values[obj.Node.(*ast.EnumValue)]), nil
+	case analysis.Type:
+		return Value{}, in.errorf("%s is a type, not a value", id.Value)
+	}
+	b, err := in.variable(id, obj)
+	if err != nil {
+		return Value{}, err
+	}
+	return b.cells[0], nil
+}
+
+// variable returns the storage of a variable, constant or parameter
+func (in *Interpreter) variable(id *ast.Identifier, obj *analysis.Object) (*block, error) {
+	if obj.Kind == analysis.Global {
+		if b, ok := in.globals[obj.Node.(ast.Statement)]; ok {
+			return b, nil
+		}
+		if in.comptime != nil {
+			return in.comptimeGlobal(id, obj.Node.(ast.Statement))
+		}
+	} else if b, ok := in.frame.vars[obj]; ok {
+		return b, nil
+	} else if in.comptime != nil {
+		// Such as the parameters of the function a comptime call is in
+		return nil, in.errorf("%s is not known at compile time", id.Value)
+	}
+	return nil, in.errorf("%s is used before it is declared", id.Value)
+}
+
+// ref returns the location an expression denotes. Expressions that are
+// not stored anywhere, such as calls, are given a temporary location with
+// no block.
+func (in *Interpreter) ref(expr ast.Expression) (location, error) {
+	switch x := expr.(type) {
+	case *ast.Identifier:
+		obj := in.frame.mod.info.Uses[x]
+		if obj != nil && obj.Kind != analysis.Func && obj.Kind != analysis.EnumValue && obj.Kind != analysis.Type {
+			b, err := in.variable(x, obj)
+			if err != nil {
+				return location{}, err
+			}
+			return location{b: b, cells: b.cells}, nil
+		}
+	case *ast.PrefixExpression:
+		if x.Operator == "*" {
+			p, err := in.eval(x.Right)
+			if err != nil {
+				return location{}, err
+			}
+			if p.Kind != Pointer {
+				return location{}, in.errorf("cannot dereference a %s", p.Kind)
+			}
+			if _, err := in.cell(p, 0); err != nil {
+				return location{}, err
+			}
+			return p.at, nil
+		}
+	case *ast.IndexExpression:
+		c, err := in.ref(x.Left)
+		if err != nil {
+			return location{}, err
+		}
+		return in.element(c, x.Index)
+	case *ast.MemberExpression:
+		c, err := in.ref(x.Object)
+		if err != nil {
+			return location{}, err
+		}
+		return in.field(c, x)
+	}
+	v, err := in.eval(expr)
+	if err != nil {
+		return location{}, err
+	}
+	return location{cells: []Value{v}}, nil
+}
+
+// decay turns an array stored in a variable or field into a pointer to
+// its first element when it is stored in a slice, as C arrays decay
+func (in *Interpreter) decay(old Value, x ast.Expression, v Value) Value {
+	if old.Kind != Pointer || v.Kind != Array {
+		return v
+	}
+	switch x.(type) {
+	case *ast.Identifier, *ast.MemberExpression:
+		if at, err := in.ref(x); err == nil && at.b != nil && at.cells[at.i].Kind == Array {
+			return pointerTo(location{b: at.b, cells: at.cells[at.i].elems})
+		}
+	}
+	return v
+}
+
+// target returns the location an assignment stores to
+func (in *Interpreter) target(expr ast.Expression) (location, error) {
+	at, err := in.ref(expr)
+	if err == nil && at.b == nil {
+		return location{}, in.errorf("cannot assign to %s", expr.String())
+	}
+	return at, err
+}
+
+// element returns the location of an element of the array or slice at c
+func (in *Interpreter) element(c location, index ast.Expression) (location, error) {
+	container := c.cells[c.i]
+	i, err := in.eval(index)
+	if err != nil {
+		return location{}, err
+	}
+	if i.Kind != Int && i.Kind != Char {
+		return location{}, in.errorf("index %s is not an int", index.String())
+	}
+	switch container.Kind {
+	case Array:
+		if i.Int < 0 || i.Int >= int64(len(container.elems)) {
+			return location{}, in.errorf("index %d out of range for %d elements", i.Int, len(container.elems))
+		}
+		return location{b: c.b, cells: container.elems, i: int(i.Int)}, nil
+	case Pointer:
+		if _, err := in.cell(container, i.Int); err != nil {
+			return location{}, err
+		}
+		at := container.at
+		at.i += int(i.Int)
+		return at, nil
+	case String:
+		return location{}, in.errorf("strings cannot be modified")
+	case Map:
+		return location{}, in.errorf("map entries cannot be addressed")
+	}
+	return location{}, in.errorf("cannot index a %s", container.Kind)
+}
+
+// field returns the location of a field of the struct at c, or of the
+// struct a pointer at c points to
+func (in *Interpreter) field(c location, x *ast.MemberExpression) (location, error) {
+	s := c.cells[c.i]
+	b := c.b
+	if s.Kind == Pointer {
+		cell, err := in.cell(s, 0)
+		if err != nil {
+			return location{}, err
+		}
+		s, b = *cell, s.at.b
+	}
+	if s.Kind != Struct {
+		return location{}, in.errorf("%s has no field %s", s.Kind, x.Member.Value)
+	}
+	if def := in.structs[s.Type]; def != nil {
+		for i, f := range def.Fields {
+			if f.Name.Value == x.Member.Value {
+				return location{b: b, cells: s.elems, i: i}, nil
+			}
+		}
+	}
+	return location{}, in.errorf("struct %s has no field %s", s.Type, x.Member.Value)
+}
+
+// store assigns a value to a cell. Structs and arrays are copied into the
+// storage they have, so that pointers to their fields and elements still
+// see them.
+func store(cell *Value, v Value) {
+	if (cell.Kind == Struct || cell.Kind == Array) && v.Kind == cell.Kind && len(v.elems) == len(cell.elems) {
+		v = v.copy()
+		for i := range cell.elems {
+			store(&cell.elems[i], v.elems[i])
+		}
+		return
+	}
+	*cell = convert(*cell, v)
+}
+
+func (in *Interpreter) assign(x *ast.AssignExpression) (Value, error) {
+	v, err := in.eval(x.Value)
+	if err != nil {
+		return Value{}, err
+	}
+	op := strings.TrimSuffix(x.Operator, "=")
+
+	var at location
+	if idx, ok := x.Left.(*ast.IndexExpression); ok {
+		// Map entries are not stored in cells
+		c, err := in.ref(idx.Left)
+		if err != nil {
+			return Value{}, err
+		}
+		if m := c.cells[c.i]; m.Kind == Map {
+			return in.setEntry(m, idx.Index, op, v)
+		}
+		if at, err = in.element(c, idx.Index); err == nil && at.b == nil {
+			err = in.errorf("cannot assign to %s", x.Left.String())
+		}
+		if err != nil {
+			return Value{}, err
+		}
+	} else if at, err = in.target(x.Left); err != nil {
+		return Value{}, err
+	}
+
+	cell := &at.cells[at.i]
+	if op != "" {
+		if v, err = in.binary(op, *cell, v); err != nil {
+			return Value{}, err
+		}
+	} else {
+		v = in.decay(*cell, x.Value, v)
+	}
+	store(cell, v)
+	return *cell, nil
+}
+
+// setEntry stores a value in a map, or updates it with op
+func (in *Interpreter) setEntry(m Value, index ast.Expression, op string, v Value) (Value, error) {
+	key, err := in.eval(index)
+	if err != nil {
+		return Value{}, err
+	}
+	entries, err := in.mapOf(m)
+	if err != nil {
+		return Value{}, err
+	}
+	if op != "" {
+		old, ok := entries[mapKey(key)]
+		if !ok {
+			old = m.m.zero
+		}
+		if v, err = in.binary(op, old, v); err != nil {
+			return Value{}, err
+		}
+	}
+	v = convert(m.m.zero, v)
+	entries[mapKey(key)] = v
+	return v, nil
+}
+
+// index reads an element of an array, slice, string or map. Missing map
+// keys read as zero, as in C.
+func (in *Interpreter) index(x *ast.IndexExpression) (Value, error) {
+	c, err := in.ref(x.Left)
+	if err != nil {
+		return Value{}, err
+	}
+	switch container := c.cells[c.i]; container.Kind {
+	case Map:
+		key, err := in.eval(x.Index)
+		if err != nil {
+			return Value{}, err
+		}
+		entries, err := in.mapOf(container)
+		if err != nil {
+			return Value{}, err
+		}
+		if v, ok := entries[mapKey(key)]; ok {
+			return v, nil
+		}
+		return container.m.zero.copy(), nil
+	case String:
+		i, err := in.eval(x.Index)
+		if err != nil {
+			return Value{}, err
+		}
+		if container.null {
+			return Value{}, in.errorf("use of a null string")
+		}
+		// The terminating NUL can be read
+		s := cString(container.Str)
+		if i.Int < 0 || i.Int > int64(len(s)) {
+			return Value{}, in.errorf("index %d out of range for a string of length %d", i.Int, len(s))
+		}
+		if i.Int == int64(len(s)) {
+			return Value{Kind: Char}, nil
+		}
+		return Value{Kind: Char, Int: wrap(int64(s[i.Int]), "int8")}, nil
+	}
+	at, err := in.element(c, x.Index)
+	if err != nil {
+		return Value{}, err
+	}
+	return at.cells[at.i], nil
+}
+
+// container returns where the elements a for range loop visits are, so
+// that they can be read as the loop goes
+func (in *Interpreter) container(x ast.Expression) (location, error) {
+	c, err := in.ref(x)
+	if err != nil {
+		return location{}, err
+	}
+	switch v := c.cells[c.i]; v.Kind {
+	case Array, Pointer, String:
+		return c, nil
+	default:
+		return location{}, in.errorf("cannot range over a %s", v.Kind)
+	}
+}
+
+// count returns the number of elements a for range loop visits
+func (in *Interpreter) count(c location) (int, error) {
+	switch v := c.cells[c.i]; v.Kind {
+	case Array:
+		return len(v.elems), nil
+	case String:
+		if v.null {
+			return 0, in.errorf("use of a null string")
+		}
+		return len(cString(v.Str)), nil
+	default:
+		return in.length(v)
+	}
+}
+
+// elementAt returns the i-th element a for range loop visits
+func (in *Interpreter) elementAt(c location, i int64) (Value, error) {
+	switch v := c.cells[c.i]; v.Kind {
+	case Array:
+		return v.elems[i], nil
+	case String:
+		return Value{Kind: Char, Int: wrap(int64(cString(v.Str)[i]), "int8")}, nil
+	default:
+		cell, err := in.cell(v, i)
+		if err != nil {
+			return Value{}, err
+		}
+		return *cell, nil
+	}
+}
+
+func (in *Interpreter) prefix(x *ast.PrefixExpression) (Value, error) {
+	switch x.Operator {
+	case "&":
+		// &T{...} copies the literal onto the heap
+		if lit, ok := x.Right.(*ast.StructLiteral); ok {
+			v, err := in.eval(lit)
+			if err != nil {
+				return Value{}, err
+			}
+			return allocate([]Value{v}), nil
+		}
+		at, err := in.ref(x.Right)
+		if err != nil {
+			return Value{}, err
+		}
+		if at.b == nil {
+			return Value{}, in.errorf("cannot take the address of %s", x.Right.String())
+		}
+		return pointerTo(at), nil
+	case "*":
+		at, err := in.ref(x)
+		if err != nil {
+			return Value{}, err
+		}
+		return at.cells[at.i], nil
+	}
+
+	v, err := in.eval(x.Right)
+	if err != nil {
+		return Value{}, err
+	}
+	switch {
+	case x.Operator == "!":
+		t, err := in.truth(v)
+		return BoolValue(!t), err
+	case x.Operator == "-" && v.Kind == Float:
+		return FloatValue(-v.Float), nil
+	case x.Operator == "-" && (v.Kind == Int || v.Kind == Char):
+		return in.integer(-v.Int, promote(v.intType()))
+	}
+	return Value{}, in.errorf("invalid operation: %s%s", x.Operator, v.Kind)
+}
+
+func (in *Interpreter) infix(x *ast.InfixExpression) (Value, error) {
+	l, err := in.eval(x.Left)
+	if err != nil {
+		return Value{}, err
+	}
+	if x.Operator == "&&" || x.Operator == "||" {
+		t, err := in.truth(l)
+		if err != nil || t == (x.Operator == "||") {
+			return BoolValue(t), err
+		}
+		r, err := in.eval(x.Right)
+		if err != nil {
+			return Value{}, err
+		}
+		t, err = in.truth(r)
+		return BoolValue(t), err
+	}
+	r, err := in.eval(x.Right)
+	if err != nil {
+		return Value{}, err
+	}
+	return in.binary(x.Operator, l, r)
+}
+
+// binary applies an arithmetic or comparison operator
+func (in *Interpreter) binary(op string, l, r Value) (Value, error) {
+	switch {
+	case l.numeric() && r.numeric():
+		return in.arithmetic(op, l, r)
+	case l.Kind == String || r.Kind == String:
+		return in.stringOp(op, l, r)
+	case op == "==" || op == "!=":
+		eq, err := in.equal(l, r)
+		return BoolValue(eq == (op == "==")), err
+	}
+	return Value{}, in.errorf("invalid operation: %s %s %s", l.Kind, op, r.Kind)
+}
+
+// arithmetic applies an operator to numbers, in float if either is one
+// and otherwise in their common integer type. The result of arithmetic on
+// a char is a char, since the C backend gives it the type of its left
+// operand.
+func (in *Interpreter) arithmetic(op string, l, r Value) (Value, error) {
+	if l.Kind == Float || r.Kind == Float {
+		a, b := l.float(), r.float()
+		switch op {
+		case "+":
+			return FloatValue(a + b), nil
+		case "-":
+			return FloatValue(a - b), nil
+		case "*":
+			return FloatValue(a * b), nil
+		case "/":
+			return FloatValue(a / b), nil
+		}
+		return compare(op, a < b, a == b)
+	}
+
+	typ := common(l.intType(), r.intType())
+	a, b := wrap(l.Int, typ), wrap(r.Int, typ)
+	unsigned := !intTypes[typ].signed
+	var n int64
+	switch op {
+	case "+":
+		n = a + b
+	case "-":
+		n = a - b
+	case "*":
+		n = a * b
+	case "/", "%":
+		if b == 0 {
+			return Value{}, in.errorf("integer divide by zero")
+		}
+		switch {
+		case unsigned && op == "/":
+			n = int64(uint64(a) / uint64(b))
+		case unsigned:
+			n = int64(uint64(a) % uint64(b))
+		case op == "/":
+			n = a / b
+		default:
+			n = a % b
+		}
+	default:
+		if unsigned {
+			return compare(op, uint64(a) < uint64(b), a == b)
+		}
+		return compare(op, a < b, a == b)
+	}
+	if l.Kind == Char {
+		return Value{Kind: Char, Int: wrap(n, "int8")}, nil
+	}
+	return in.integer(n, typ)
+}
+
+// integer returns the result of integer arithmetic, wrapped to its type
+// as in C. At compile time a signed result that does not fit is an error,
+// as it is in a constant expression.
+func (in *Interpreter) integer(n int64, typ string) (Value, error) {
+	if in.comptime != nil && intTypes[typ].signed && wrap(n, typ) != n {
+		return Value{}, in.errorf("constant %d overflows %s", n, typ)
+	}
+	return Value{Kind: Int, Int: wrap(n, typ), Type: typ}, nil
+}
+
+// compare returns the result of a comparison given whether the left
+// operand is less than and equal to the right
+func compare(op string, less, equal bool) (Value, error) {
+	switch op {
+	case "==":
+		return BoolValue(equal), nil
+	case "!=":
+		return BoolValue(!equal), nil
+	case "<":
+		return BoolValue(less), nil
+	case "<=":
+		return BoolValue(less || equal), nil
+	case ">":
+		return BoolValue(!less && !equal), nil
+	case ">=":
+		return BoolValue(!less), nil
+	}
+	return Value{}, nil
+}
+
+// stringOp concatenates or compares strings. Strings compare by content;
+// + makes a new string, which is never freed, as in the C backend.
+func (in *Interpreter) stringOp(op string, l, r Value) (Value, error) {
+	if op == "==" || op == "!=" {
+		eq, err := in.equal(l, r)
+		return BoolValue(eq == (op == "==")), err
+	}
+	if l.Kind != String || r.Kind != String {
+		return Value{}, in.errorf("invalid operation: %s %s %s", l.Kind, op, r.Kind)
+	}
+	if l.null || r.null {
+		return Value{}, in.errorf("use of a null string")
+	}
+	a, b := cString(l.Str), cString(r.Str)
+	if op == "+" {
+		return StringValue(a + b), nil
+	}
+	if v, _ := compare(op, a < b, a == b); v.Kind == Bool {
+		return v, nil
+	}
+	return Value{}, in.errorf("invalid operation: string %s string", op)
+}
+
+// equal reports whether two values are equal: structs field by field,
+// strings by content and the rest by identity. As in the C backend,
+// arrays and structs with a field == cannot compare are refused.
+func (in *Interpreter) equal(l, r Value) (bool, error) {
+	// Null is a pointer until it meets something else that can be null
+	if l.Kind != r.Kind && l.Kind == Pointer && l.IsNull() {
+		return r.IsNull(), nil
+	}
+	if l.Kind != r.Kind && r.Kind == Pointer && r.IsNull() {
+		return l.IsNull(), nil
+	}
+	if l.Kind != r.Kind {
+		if l.numeric() && r.numeric() {
+			v, err := in.arithmetic("==", l, r)
+			return v.Bool, err
+		}
+		return false, in.errorf("invalid operation: %s == %s", l.Kind, r.Kind)
+	}
+	switch l.Kind {
+	case Bool:
+		return l.Bool == r.Bool, nil
+	case String:
+		if l.null || r.null {
+			return l.null && r.null, nil
+		}
+		return cString(l.Str) == cString(r.Str), nil
+	case Pointer:
+		return samePlace(l.at, r.at), nil
+	case Map:
+		return l.m == r.m, nil
+	case Func:
+		return l.fn == r.fn, nil
+	case Array:
+		return false, in.errorf("cannot compare arrays")
+	case Struct:
+		if f := in.incomparableField(l.Type, nil); f != nil {
+			return false, in.errorf("cannot compare %s values: field %s is not comparable", l.Type, f.Name.Value)
+		}
+		if l.Type != r.Type || len(l.elems) != len(r.elems) {
+			return false, nil
+		}
+		for i := range l.elems {
+			if eq, err := in.equal(l.elems[i], r.elems[i]); err != nil || !eq {
+				return false, err
+			}
+		}
+		return true, nil
+	case Int, Float, Char:
+		v, err := in.arithmetic("==", l, r)
+		return v.Bool, err
+	}
+	return false, in.errorf("%s values cannot be compared", l.Kind)
+}
+
+// cast converts between numeric types, as C does, and between pointers
+func (in *Interpreter) cast(x *ast.CastExpression) (Value, error) {
+	v, err := in.eval(x.Value)
+	if err != nil {
+		return Value{}, err
+	}
+	t := x.TargetType
+	switch {
+	case (t.IsPtr || t.ArrayLen == -1) && v.Kind == Pointer:
+		return v, nil
+	case !t.IsNamed():
+	case t.Name == "string" && v.Kind == String:
+		return v, nil
+	case t.Name == "bool":
+		b, err := in.truth(v)
+		return BoolValue(b), err
+	case !v.numeric() && v.Kind != Bool:
+	case t.Name == "float":
+		if v.Kind == Bool {
+			return FloatValue(float64(boolInt(v.Bool))), nil
+		}
+		return FloatValue(v.float()), nil
+	case t.Name == "char":
+		return convert(Value{Kind: Char}, convert(IntValue(0), v)), nil
+	case intTypes[t.Name].bits > 0:
+		return convert(Value{Kind: Int, Type: t.Name}, v), nil
+	case in.enums[t.Name] != nil:
+		return convert(IntValue(0), v), nil
+	}
+	return Value{}, in.errorf("cannot convert %s to %s", v.Kind, t.String())
+}
+
+// zero returns the zero value of a type. Like C globals, pointers, maps
+// and strings start out null. The lengths of arrays are only expressions
+// in code that runs at compile time, and are evaluated then.
+func (in *Interpreter) zero(t *ast.TypeAnnotation) (Value, error) {
+	switch {
+	case t == nil:
+		return Value{}, nil
+	case t.IsPtr || t.ArrayLen == -1:
+		return Value{Kind: Pointer}, nil
+	case t.IsMap:
+		return Value{Kind: Map}, nil
+	case t.IsFunc:
+		return Value{Kind: Func}, nil
+	case t.IsArray():
+		n, err := in.arrayLen(t)
+		if err != nil {
+			return Value{}, err
+		}
+		elem, err := in.zero(t.Element())
+		if err != nil {
+			return Value{}, err
+		}
+		elems := make([]Value, n)
+		for i := range elems {
+			elems[i] = elem.copy()
+		}
+		return Value{Kind: Array, elems: elems}, nil
+	}
+	switch t.Name {
+	case "float":
+		return Value{Kind: Float}, nil
+	case "bool":
+		return Value{Kind: Bool}, nil
+	case "char":
+		return Value{Kind: Char}, nil
+	case "string":
+		return zeroOf(String), nil
+	}
+	if _, ok := intTypes[t.Name]; ok {
+		return Value{Kind: Int, Type: t.Name}, nil
+	}
+	if s, ok := in.structs[t.Name]; ok {
+		v := Value{Kind: Struct, Type: s.Name.Value, elems: make([]Value, len(s.Fields))}
+		for i, f := range s.Fields {
+			fv, err := in.zero(f.Type)
+			if err != nil {
+				return Value{}, err
+			}
+			v.elems[i] = fv
+		}
+		return v, nil
+	}
+	if _, ok := in.enums[t.Name]; ok {
+		return IntValue(0), nil
+	}
+	return Value{}, nil
+}
+
+// arrayLen returns the length of a fixed-size array type
+func (in *Interpreter) arrayLen(t *ast.TypeAnnotation) (int, error) {
+	if t.Len == nil {
+		return t.ArrayLen, nil
+	}
+	v, err := in.eval(t.Len)
+	if err != nil {
+		return 0, err
+	}
+	if v.Kind != Int || v.Int <= 0 {
+		return 0, in.errorf("array length %s is not a positive int", v)
+	}
+	// Every element counts, so that arrays too large to hold are refused
+	in.steps += int(v.Int) - 1
+	return int(v.Int), in.step()
+}
+
+func (in *Interpreter) structLiteral(x *ast.StructLiteral) (Value, error) {
+	s, ok := in.structs[x.Name.Value]
+	if !ok {
+		return Value{}, in.errorf("unknown struct type %s", x.Name.Value)
+	}
+	v, err := in.zero(&ast.TypeAnnotation{Name: s.Name.Value})
+	if err != nil {
+		return Value{}, err
+	}
+	for _, f := range x.Fields {
+		at, err := in.field(location{cells: []Value{v}}, &ast.MemberExpression{Member: f.Name})
+		if err != nil {
+			return Value{}, err
+		}
+		fv, err := in.eval(f.Value)
+		if err != nil {
+			return Value{}, err
+		}
+		at.cells[at.i] = convert(at.cells[at.i], fv)
+	}
+	return v, nil
+}
+
+// arrayLiteral makes a fixed-size array. Slice literals are arrays of
+// their elements, as the C backend declares them.
+func (in *Interpreter) arrayLiteral(x *ast.ArrayLiteral) (Value, error) {
+	var arr Value
+	var err error
+	switch {
+	case x.Type != nil && x.Type.IsArray():
+		if arr, err = in.zero(x.Type); err != nil {
+			return Value{}, err
+		}
+	default:
+		var elem Value
+		if x.Type != nil {
+			if elem, err = in.zero(x.Type.Element()); err != nil {
+				return Value{}, err
+			}
+		}
+		arr = Value{Kind: Array, elems: make([]Value, len(x.Elements))}
+		for i := range arr.elems {
+			arr.elems[i] = elem.copy()
+		}
+	}
+	return arr, in.fill(arr, x)
+}
+
+// fill stores the elements of an array literal in an array
+func (in *Interpreter) fill(arr Value, lit *ast.ArrayLiteral) error {
+	if len(lit.Elements) > len(arr.elems) {
+		return in.errorf("%d elements do not fit an array of %d", len(lit.Elements), len(arr.elems))
+	}
+	for i, elem := range lit.Elements {
+		// The elements of nested arrays take their type from the outer one
+		if nested, ok := elem.(*ast.ArrayLiteral); ok && nested.Type == nil && arr.elems[i].Kind == Array {
+			if err := in.fill(arr.elems[i], nested); err != nil {
+				return err
+			}
+			continue
+		}
+		v, err := in.eval(elem)
+		if err != nil {
+			return err
+		}
+		arr.elems[i] = convert(arr.elems[i], v)
+	}
+	return nil
+}
+
+func (in *Interpreter) newMap(t *ast.TypeAnnotation) (Value, error) {
+	m := &hashMap{entries: make(map[string]Value)}
+	if t != nil {
+		zero, err := in.zero(t.ValueType)
+		if err != nil {
+			return Value{}, err
+		}
+		m.zero = zero
+	}
+	return Value{Kind: Map, m: m}, nil
+}
+
+func (in *Interpreter) mapLiteral(x *ast.MapLiteral) (Value, error) {
+	m, err := in.newMap(x.Type)
+	if err != nil {
+		return Value{}, err
+	}
+	for _, pair := range x.Pairs {
+		key, err := in.eval(pair.Key)
+		if err != nil {
+			return Value{}, err
+		}
+		v, err := in.eval(pair.Value)
+		if err != nil {
+			return Value{}, err
+		}
+		m.m.entries[mapKey(key)] = convert(m.m.zero, v)
+	}
+	return m, nil
+}
+
+// make allocates a map, or a slice of zero elements on the heap
+func (in *Interpreter) make(x *ast.MakeExpression) (Value, error) {
+	if x.Type.IsMap {
+		return in.newMap(x.Type)
+	}
+	elem := x.Type
+	if elem.ArrayLen == -1 {
+		elem = elem.Element()
+	}
+	n := int64(0)
+	if x.Length != nil {
+		v, err := in.eval(x.Length)
+		if err != nil {
+			return Value{}, err
+		}
+		if v.Kind != Int && v.Kind != Char {
+			return Value{}, in.errorf("the length of make is a %s, not an int", v.Kind)
+		}
+		if v.Int < 0 {
+			return Value{}, in.errorf("negative length %d", v.Int)
+		}
+		n = v.Int
+	}
+	zero, err := in.zero(elem)
+	if err != nil {
+		return Value{}, err
+	}
+	cells := make([]Value, n)
+	for i := range cells {
+		cells[i] = zero.copy()
+	}
+	return allocate(cells), nil
+}
@@ -0,0 +1,356 @@
+package interp
+
+import (
+	"fmt"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/analysis"
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+)
+
+// frame is the state of one function call
+type frame struct {
+	mod    *module
+	fn     *function
+	vars   map[*analysis.Object]*block
+	line   int   // the line of the statement being run
+	result Value // the value returned
+}
+
+// function is what the interpreter knows about a function's body
+type function struct {
+	decl    *ast.FunctionStatement
+	defers  []*ast.DeferStatement        // in the order they appear
+	returns map[*ast.ReturnStatement]int // the number of defers before each return
+}
+
+// flow is how a statement hands on control
+type flow int
+
+const (
+	next flow = iota
+	breaking
+	continuing
+	returning
+)
+
+// function returns the defers and returns of a function's body. Defers
+// are not run when they are reached, but when the function returns, as
+// the C backend does: a return runs every defer before it in the body,
+// and the end of the body all of them, last first.
+func (in *Interpreter) function(decl *ast.FunctionStatement) *function {
+	if fn, ok := in.functions[decl]; ok {
+		return fn
+	}
+	fn := &function{decl: decl, returns: make(map[*ast.ReturnStatement]int)}
+	ast.Inspect(decl.Body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.DeferStatement:
+			if n.Statement != nil {
+				fn.defers = append(fn.defers, n)
+			}
+		case *ast.ReturnStatement:
+			fn.returns[n] = len(fn.defers)
+		}
+		return true
+	})
+	in.functions[decl] = fn
+	return fn
+}
+
+// runDefers runs the first n defers of the running function, last first
+func (in *Interpreter) runDefers(n int) error {
+	f := in.frame
+	for i := n - 1; i >= 0; i-- {
+		d := f.fn.defers[i]
+		f.line = d.Token.Line
+		if _, err := in.stmt(d.Statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (in *Interpreter) step() error {
+	in.steps++
+	if in.MaxSteps > 0 && in.steps > in.MaxSteps {
+		if in.comptime != nil {
+			// No one statement is to blame but the comptime expression
+			return &Error{Message: fmt.Sprintf("compile-time evaluation did not finish in %d steps", in.MaxSteps)}
+		}
+		return in.errorf("the program did not finish in %d steps", in.MaxSteps)
+	}
+	return nil
+}
+
+func (in *Interpreter) block(stmts []ast.Statement) (flow, error) {
+	for _, stmt := range stmts {
+		if fl, err := in.stmt(stmt); err != nil || fl != next {
+			return fl, err
+		}
+	}
+	return next, nil
+}
+
+func (in *Interpreter) stmt(stmt ast.Statement) (flow, error) {
+	if err := in.step(); err != nil {
+		return next, err
+	}
+	if tok := statementToken(stmt); tok.Line > 0 {
+		in.frame.line = tok.Line
+	}
+	switch s := stmt.(type) {
+	case *ast.VarStatement:
+		return next, in.declare(s.Name, s.Type, s.Value)
+	case *ast.ConstStatement:
+		return next, in.declare(s.Name, s.Type, s.Value)
+	case *ast.InferStatement:
+		return next, in.declare(s.Name, nil, s.Value)
+	case *ast.ExpressionStatement:
+		_, err := in.eval(s.Expression)
+		return next, err
+	case *ast.ReturnStatement:
+		return returning, in.ret(s)
+	case *ast.BreakStatement:
+		return breaking, nil
+	case *ast.ContinueStatement:
+		return continuing, nil
+	case *ast.BlockStatement:
+		return in.block(s.Statements)
+	case *ast.IfStatement:
+		cond, err := in.condition(s.Condition)
+		if err != nil {
+			return next, err
+		}
+		if cond {
+			return in.block(s.Consequence.Statements)
+		}
+		if s.Alternative != nil {
+			return in.block(s.Alternative.Statements)
+		}
+		return next, nil
+	case *ast.WhileStatement:
+		return in.loop(s.Condition, nil, s.Body)
+	case *ast.ForStatement:
+		if s.Init != nil {
+			if _, err := in.stmt(s.Init); err != nil {
+				return next, err
+			}
+		}
+		return in.loop(s.Condition, s.Post, s.Body)
+	case *ast.ForRangeStatement:
+		return in.forRange(s)
+	case *ast.FreeStatement:
+		v, err := in.eval(s.Value)
+		if err != nil {
+			return next, err
+		}
+		return next, in.free(v)
+	case *ast.DeleteStatement:
+		m, err := in.eval(s.Map)
+		if err != nil {
+			return next, err
+		}
+		key, err := in.eval(s.Key)
+		if err != nil {
+			return next, err
+		}
+		entries, err := in.mapOf(m)
+		if err != nil {
+			return next, err
+		}
+		delete(entries, mapKey(key))
+		return next, nil
+	case *ast.DeferStatement, *ast.TestStatement:
+		// Defers run when the function returns; tests only in test binaries
+		return next, nil
+	}
+	return next, in.errorf("%s cannot be run here", stmt.TokenLiteral())
+}
+
+// declare gives a new variable or constant its value, converted to its
+// type, or the zero value of the type
+func (in *Interpreter) declare(name *ast.Identifier, typ *ast.TypeAnnotation, value ast.Expression) error {
+	v, err := in.zero(typ)
+	if err != nil {
+		return err
+	}
+	if typ == nil && startsWithInt(value) {
+		// The C backend declares it an int, which a long literal or a
+		// float result is converted to
+		v = IntValue(0)
+	}
+	if value != nil {
+		x, err := in.eval(value)
+		if err != nil {
+			return err
+		}
+		v = convert(v, in.decay(v, value, x))
+	}
+	if obj := in.frame.mod.info.Defs[name]; obj != nil {
+		in.frame.vars[obj] = variable(v)
+	}
+	return nil
+}
+
+// startsWithInt reports whether an expression's leftmost operand is an
+// integer literal and its result is not a condition, from which the C
+// backend infers an int, as for x := 3000000000 or x := 1 + f
+func startsWithInt(x ast.Expression) bool {
+	switch x := x.(type) {
+	case *ast.IntegerLiteral:
+		return true
+	case *ast.PrefixExpression:
+		return x.Operator == "-" && startsWithInt(x.Right)
+	case *ast.InfixExpression:
+		switch x.Operator {
+		case "==", "!=", "<", ">", "<=", ">=", "&&", "||":
+			return false
+		}
+		return startsWithInt(x.Left)
+	}
+	return false
+}
+
+// ret returns from the running function: the value is computed first,
+// then the defers before the return run
+func (in *Interpreter) ret(s *ast.ReturnStatement) error {
+	f := in.frame
+	if s.Value != nil {
+		v, err := in.eval(s.Value)
+		if err != nil {
+			return err
+		}
+		zero, err := in.zero(f.fn.decl.ReturnType)
+		if err != nil {
+			return err
+		}
+		f.result = convert(zero, v)
+	}
+	return in.runDefers(f.fn.returns[s])
+}
+
+func (in *Interpreter) condition(x ast.Expression) (bool, error) {
+	v, err := in.eval(x)
+	if err != nil {
+		return false, err
+	}
+	return in.truth(v)
+}
+
+// truth returns whether a value used as a condition holds, as in C: a
+// number is true unless it is zero and a pointer unless it is null
+func (in *Interpreter) truth(v Value) (bool, error) {
+	switch v.Kind {
+	case Bool:
+		return v.Bool, nil
+	case Int, Char:
+		return v.Int != 0, nil
+	case Float:
+		return v.Float != 0, nil
+	case Pointer, Map, Func, String:
+		return !v.IsNull(), nil
+	}
+	return false, in.errorf("a %s cannot be used as a condition", v.Kind)
+}
+
+// loop runs a while loop, or a for loop after its initialisation
+func (in *Interpreter) loop(cond ast.Expression, post ast.Statement, body *ast.BlockStatement) (flow, error) {
+	for {
+		if cond != nil {
+			ok, err := in.condition(cond)
+			if err != nil || !ok {
+				return next, err
+			}
+		}
+		fl, err := in.block(body.Statements)
+		if err != nil || fl == returning {
+			return fl, err
+		}
+		if fl == breaking {
+			return next, nil
+		}
+		if post != nil {
+			if _, err := in.stmt(post); err != nil {
+				return next, err
+			}
+		}
+		if err := in.step(); err != nil {
+			return next, err
+		}
+	}
+}
+
+// forRange runs a loop over the elements of an array, a slice or the
+// chars of a string. Each iteration reads the element afresh, so the body
+// sees its own assignments to later elements.
+func (in *Interpreter) forRange(s *ast.ForRangeStatement) (flow, error) {
+	container, err := in.container(s.Iterable)
+	if err != nil {
+		return next, err
+	}
+	index := variable(IntValue(0))
+	if obj := in.frame.mod.info.Defs[s.Index]; s.Index != nil && obj != nil {
+		in.frame.vars[obj] = index
+	}
+	for i := 0; ; i++ {
+		n, err := in.count(container)
+		if err != nil {
+			return next, err
+		}
+		if i >= n {
+			return next, nil
+		}
+		index.cells[0] = IntValue(int64(i))
+		if obj := in.frame.mod.info.Defs[s.Value]; s.Value != nil && obj != nil {
+			elem, err := in.elementAt(container, int64(i))
+			if err != nil {
+				return next, err
+			}
+			in.frame.vars[obj] = variable(elem.copy())
+		}
+		fl, err := in.block(s.Body.Statements)
+		if err != nil || fl == returning {
+			return fl, err
+		}
+		if fl == breaking {
+			return next, nil
+		}
+		if err := in.step(); err != nil {
+			return next, err
+		}
+	}
+}
+
+// statementToken returns the token a statement starts with
+func statementToken(stmt ast.Statement) lexer.Token {
+	switch s := stmt.(type) {
+	case *ast.VarStatement:
+		return s.Token
+	case *ast.ConstStatement:
+		return s.Token
+	case *ast.InferStatement:
+		return s.Name.Token
+	case *ast.ReturnStatement:
+		return s.Token
+	case *ast.ExpressionStatement:
+		return s.Token
+	case *ast.IfStatement:
+		return s.Token
+	case *ast.ForStatement:
+		return s.Token
+	case *ast.WhileStatement:
+		return s.Token
+	case *ast.ForRangeStatement:
+		return s.Token
+	case *ast.FreeStatement:
+		return s.Token
+	case *ast.DeleteStatement:
+		return s.Token
+	case *ast.BreakStatement:
+		return s.Token
+	case *ast.ContinueStatement:
+		return s.Token
+	}
+	return lexer.Token{}
+}
@@ -0,0 +1,132 @@
+package interp
+
+// block is a piece of memory: a variable, or an allocation on the
+// simulated heap. Freed blocks keep their cells, so that using them can
+// be reported instead of reading whatever the memory holds next.
+type block struct {
+	cells []Value
+	heap  bool // allocated by alloc, make or &T{...}, and freed by free
+	freed bool
+}
+
+// location is where a pointer points: a cell of a block, or of a struct
+// or array stored in one. b is the block, whose cells or one of their
+// fields or elements are cells.
+type location struct {
+	b     *block
+	cells []Value
+	i     int
+}
+
+// hashMap is a map. Like the C backend's, its keys are strings; missing
+// keys read as zero.
+type hashMap struct {
+	entries map[string]Value
+	zero    Value // the zero value of the map's values
+	freed   bool
+}
+
+// variable returns a new block holding one value
+func variable(v Value) *block {
+	return &block{cells: []Value{v}}
+}
+
+// allocate returns a pointer to a new heap block holding cells
+func allocate(cells []Value) Value {
+	b := &block{cells: cells, heap: true}
+	return Value{Kind: Pointer, at: location{b: b, cells: b.cells}}
+}
+
+// pointerTo returns a pointer to a location
+func pointerTo(at location) Value {
+	return Value{Kind: Pointer, at: at}
+}
+
+// cell returns the cell a pointer points to, offset by n cells, checking
+// that the memory can be used
+func (in *Interpreter) cell(p Value, n int64) (*Value, error) {
+	if p.at.b == nil {
+		return nil, in.errorf("null pointer dereference")
+	}
+	if p.at.b.freed {
+		return nil, in.errorf("use of freed memory")
+	}
+	i := int64(p.at.i) + n
+	if i < 0 || i >= int64(len(p.at.cells)) {
+		return nil, in.errorf("index %d out of range for %d elements", i-int64(p.at.i), int64(len(p.at.cells)-p.at.i))
+	}
+	return &p.at.cells[i], nil
+}
+
+// length returns the number of elements a slice can reach
+func (in *Interpreter) length(p Value) (int, error) {
+	if p.at.b == nil {
+		return 0, nil
+	}
+	if p.at.b.freed {
+		return 0, in.errorf("use of freed memory")
+	}
+	return len(p.at.cells) - p.at.i, nil
+}
+
+// free releases what a pointer, slice or map refers to. In garbage-
+// collected mode free is a hint, which the interpreter ignores.
+func (in *Interpreter) free(v Value) error {
+	if in.GC || v.IsNull() {
+		return nil
+	}
+	switch v.Kind {
+	case Pointer:
+		b := v.at.b
+		switch {
+		case b.freed:
+			return in.errorf("double free")
+		case !b.heap:
+			return in.errorf("free of memory that was not allocated")
+		case v.at.i != 0 || len(v.at.cells) > 0 && &v.at.cells[0] != &b.cells[0]:
+			return in.errorf("free of a pointer into the middle of an allocation")
+		}
+		b.freed = true
+		return nil
+	case Map:
+		if v.m.freed {
+			return in.errorf("double free")
+		}
+		v.m.freed = true
+		return nil
+	case String:
+		// Strings made by + are never tracked, like string literals
+		return nil
+	}
+	return in.errorf("cannot free a %s", v.Kind)
+}
+
+// mapOf returns the entries of a map, checking that it can be used
+func (in *Interpreter) mapOf(v Value) (map[string]Value, error) {
+	if v.Kind != Map {
+		return nil, in.errorf("%s is not a map", v.Kind)
+	}
+	if v.m == nil {
+		return nil, in.errorf("use of a null map")
+	}
+	if v.m.freed {
+		return nil, in.errorf("use of freed memory")
+	}
+	return v.m.entries, nil
+}
+
+// mapKey returns the key a value is stored under
+func mapKey(v Value) string {
+	if v.Kind == String {
+		return cString(v.Str)
+	}
+	return v.String()
+}
+
+// samePlace reports whether two pointers point to the same cell
+func samePlace(a, b location) bool {
+	if a.b != b.b || a.i != b.i || len(a.cells) != len(b.cells) {
+		return false
+	}
+	return len(a.cells) == 0 || &a.cells[0] == &b.cells[0]
+}
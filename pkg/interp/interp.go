@@ -0,0 +1,449 @@
+// Package interp runs H programs without a C compiler by walking their
+// syntax trees. It follows the semantics of the C backend: ints are 32
+// bits and wrap, structs and arrays are copied by value, maps have string
+// keys, imported modules and their globals are initialised before main,
+// and a return runs the defers that precede it in the function. Memory is
+// simulated, so that what C leaves undefined is reported instead: using
+// freed memory, freeing twice, dereferencing null and indexing out of
+// range stop the program with an *Error.
+//
+// A program is loaded once and can then be run, or its functions called
+// from Go:
+//
+//	in := interp.New()
+//	in.Define("now", func(args []interp.Value) (interp.Value, error) { ... })
+//	if err := in.Load(program); err != nil { ... }
+//	result, err := in.Call("score", interp.IntValue(3))
+//
+// The compiler runs comptime code on the interpreter too, through the
+// Comptime of each module it optimizes.
+package interp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/analysis"
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+	"github.com/Dr-H-PhD/h-lang/pkg/optimize"
+)
+
+// maxDepth limits the calls in progress at once, so that runaway
+// recursion is reported as a stack overflow as it would be in C
+const maxDepth = 10000
+
+// Extern is a Go function that implements an extern function. It receives
+// the arguments of the call and returns the result, which is converted to
+// the declared return type.
+type Extern func(args []Value) (Value, error)
+
+// Interpreter runs one H program
+type Interpreter struct {
+	Stdout   io.Writer                        // where print writes, os.Stdout by default
+	Stderr   io.Writer                        // where failed assertions are reported, os.Stderr by default
+	Args     []string                         // the command line args() returns, starting with the program name
+	Getenv   func(name string) (string, bool) // looks up environment variables, os.LookupEnv by default
+	GC       bool                             // free is only a hint, as in garbage-collected mode
+	MaxSteps int                              // statements one run or call may execute, 0 for no limit
+
+	resolver   ast.ImportResolver
+	basePath   string
+	sourceName string
+	externs    map[string]Extern
+	loaded     bool
+	errs       []error
+
+	modules   []*module
+	main      *module
+	imported  map[string]bool
+	optimized []*analysis.Import
+	structs   map[string]*ast.StructStatement
+	enums     map[string]*ast.EnumStatement
+	methods   map[string]*ast.FunctionStatement // "Type.method" -> method
+	owners    map[*ast.FunctionStatement]*module
+	functions map[*ast.FunctionStatement]*function
+	globals   map[ast.Statement]*block
+	values    map[*ast.EnumValue]int64
+	literals  map[*ast.StringLiteral]string
+
+	frame    *frame // the running function
+	steps    int
+	depth    int
+	comptime *comptime // set while evaluating comptime code for the optimizer
+}
+
+// module is one source file: the main program or an import
+type module struct {
+	path    string // the import path, "" for the main program
+	program *ast.Program
+	info    *analysis.Info
+	init    *ast.FunctionStatement
+}
+
+// Error is a runtime error, or a problem found while loading a program
+type Error struct {
+	Module  string // the import path of the module, "" for the main program
+	Line    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Module != "" {
+		return fmt.Sprintf("%s: line %d: %s", e.Module, e.Line, e.Message)
+	}
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// ExitError is returned by Call when the program calls exit or fails an
+// assertion
+type ExitError struct {
+	Status int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Status)
+}
+
+// New creates an interpreter
+func New() *Interpreter {
+	return &Interpreter{
+		Stdout:    os.Stdout,
+		Stderr:    os.Stderr,
+		Getenv:    os.LookupEnv,
+		externs:   make(map[string]Extern),
+		imported:  make(map[string]bool),
+		structs:   make(map[string]*ast.StructStatement),
+		enums:     make(map[string]*ast.EnumStatement),
+		methods:   make(map[string]*ast.FunctionStatement),
+		owners:    make(map[*ast.FunctionStatement]*module),
+		functions: make(map[*ast.FunctionStatement]*function),
+		globals:   make(map[ast.Statement]*block),
+		values:    make(map[*ast.EnumValue]int64),
+		literals:  make(map[*ast.StringLiteral]string),
+	}
+}
+
+// SetImportResolver sets the function used to resolve imports
+func (in *Interpreter) SetImportResolver(resolver ast.ImportResolver, basePath string) {
+	in.resolver = resolver
+	in.basePath = basePath
+}
+
+// SetSourceName sets the file name failed assertions report for the main
+// program. Imported modules report their import path.
+func (in *Interpreter) SetSourceName(name string) {
+	in.sourceName = name
+}
+
+// Define implements the extern function name with a Go function
+func (in *Interpreter) Define(name string, fn Extern) {
+	in.externs[name] = fn
+}
+
+// Load prepares a program to run: it resolves the imports, evaluates the
+// comptime code, initialises the globals of every module and runs their
+// init functions. It returns the problems found, or the runtime error or
+// exit of initialisation.
+func (in *Interpreter) Load(program *ast.Program) error {
+	if in.loaded {
+		return errors.New("a program is already loaded")
+	}
+	in.loaded = true
+
+	in.processImports(program)
+	in.main = in.addModule("", program)
+	in.checkStructs()
+	if len(in.errs) > 0 {
+		return errors.Join(in.errs...)
+	}
+
+	in.steps = 0
+	for _, mod := range in.modules {
+		for _, stmt := range mod.program.Statements {
+			var typ *ast.TypeAnnotation
+			switch s := stmt.(type) {
+			case *ast.VarStatement:
+				typ = s.Type
+			case *ast.ConstStatement:
+				typ = s.Type
+			default:
+				continue
+			}
+			zero, err := in.zero(typ)
+			if err != nil {
+				return err
+			}
+			in.globals[stmt] = variable(zero)
+		}
+	}
+	for _, mod := range in.modules {
+		if err := in.initModule(mod); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run loads a program and runs its main function, returning the exit
+// status. A runtime error stops the program and is returned.
+func (in *Interpreter) Run(program *ast.Program) (int, error) {
+	if err := in.Load(program); err != nil {
+		var exit *ExitError
+		if errors.As(err, &exit) {
+			return exit.Status, nil
+		}
+		return 1, err
+	}
+	return in.Main()
+}
+
+// Main runs the main function of the loaded program and returns the exit
+// status: the value main returns, the code given to exit, or 1 after a
+// failed assertion.
+func (in *Interpreter) Main() (int, error) {
+	obj := in.main.info.Module.Objects["main"]
+	if obj == nil || obj.Kind != analysis.Func {
+		return 1, errors.New("the program has no main function")
+	}
+	v, err := in.Call("main")
+	if err != nil {
+		var exit *ExitError
+		if errors.As(err, &exit) {
+			return exit.Status, nil
+		}
+		return 1, err
+	}
+	if v.Kind == Int {
+		return int(v.Int), nil
+	}
+	return 0, nil
+}
+
+// Call calls a function of the loaded program, or one it imports, with
+// arguments converted to the types of its parameters
+func (in *Interpreter) Call(name string, args ...Value) (Value, error) {
+	if in.main == nil {
+		return Value{}, errors.New("no program is loaded")
+	}
+	obj := in.main.info.Module.Lookup(name)
+	if obj == nil || obj.Kind != analysis.Func {
+		return Value{}, fmt.Errorf("%s is not a function", name)
+	}
+	decl := obj.Node.(*ast.FunctionStatement)
+	// Extern functions may call back into the program
+	caller := in.frame
+	if caller == nil {
+		in.steps = 0
+		in.frame = &frame{mod: in.owners[decl], line: decl.Token.Line}
+	}
+	defer func() { in.frame = caller }()
+	return in.call(decl, nil, args)
+}
+
+// processImports loads the modules a program imports, theirs first
+func (in *Interpreter) processImports(program *ast.Program) {
+	for _, stmt := range program.Statements {
+		imp, ok := stmt.(*ast.ImportStatement)
+		if !ok || in.resolver == nil || in.imported[imp.Path] {
+			continue
+		}
+		// Marked before it is read, for circular imports
+		in.imported[imp.Path] = true
+
+		imported, err := in.resolver(imp.Path, in.basePath)
+		if err != nil {
+			in.errs = append(in.errs, fmt.Errorf("line %d: %v", imp.Token.Line, err))
+			continue
+		}
+		in.processImports(imported)
+		in.addModule(imp.Path, imported)
+	}
+}
+
+// addModule optimizes a program, as the compiler does, and records its
+// declarations. The modules added before it are the imports it sees.
+func (in *Interpreter) addModule(path string, program *ast.Program) *module {
+	m := &analysis.Module{Program: program, Imports: in.optimized}
+	optimized, errs := optimize.Program(m, NewComptime(m))
+	for _, err := range errs {
+		in.errs = append(in.errs, in.moduleError(path, err))
+	}
+	mod := &module{path: path, program: optimized}
+	mod.info = analysis.ResolveModule(&analysis.Module{Program: optimized, Imports: in.optimized})
+	in.optimized = append(in.optimized, &analysis.Import{Path: path, Program: optimized})
+	in.register(mod)
+	return mod
+}
+
+// register records the declarations of a module. Enum values are numbered
+// here unless they are evaluated at compile time, when they may still be
+// expressions.
+func (in *Interpreter) register(mod *module) {
+	path := mod.path
+	in.modules = append(in.modules, mod)
+	for _, stmt := range mod.program.Statements {
+		switch s := stmt.(type) {
+		case *ast.StructStatement:
+			in.structs[s.Name.Value] = s
+		case *ast.EnumStatement:
+			in.enums[s.Name.Value] = s
+			if in.comptime == nil {
+				in.enumValues(mod, s)
+			}
+		case *ast.FunctionStatement:
+			in.owners[s] = mod
+			switch {
+			case s.Receiver != nil:
+				in.methods[receiverTypeName(s)+"."+s.Name.Value] = s
+			case s.Name.Value != "init":
+			case mod.init != nil:
+				in.errs = append(in.errs, in.moduleError(path, fmt.Errorf("line %d: init is declared more than once", s.Token.Line)))
+			case len(s.Parameters) > 0 || s.ReturnType != nil:
+				in.errs = append(in.errs, in.moduleError(path, fmt.Errorf("line %d: init must take no parameters and return nothing", s.Token.Line)))
+			default:
+				mod.init = s
+			}
+		}
+	}
+}
+
+// moduleError names the module a load error is in, if it is an import
+func (in *Interpreter) moduleError(path string, err error) error {
+	if path == "" {
+		return err
+	}
+	return fmt.Errorf("%s: %v", path, err)
+}
+
+// receiverTypeName returns the struct name a method is declared on
+func receiverTypeName(f *ast.FunctionStatement) string {
+	return strings.TrimPrefix(f.Receiver.Type.Name, "*")
+}
+
+// enumValues numbers the values of an enum as C does: from the previous
+// value, or from an explicit one, which the optimizer has made a literal
+func (in *Interpreter) enumValues(mod *module, s *ast.EnumStatement) {
+	next := int64(0)
+	for _, v := range s.Values {
+		if v.Value != nil {
+			lit, ok := v.Value.(*ast.IntegerLiteral)
+			if !ok {
+				in.errs = append(in.errs, in.moduleError(mod.path, fmt.Errorf("line %d: the value of %s_%s is not a constant int", v.Name.Token.Line, s.Name.Value, v.Name.Value)))
+				continue
+			}
+			next = lit.Value
+		}
+		in.values[v] = next
+		next++
+	}
+}
+
+// checkStructs reports structs that contain themselves by value, which
+// have no zero value
+func (in *Interpreter) checkStructs() {
+	state := make(map[string]int) // 0 = unvisited, 1 = visiting, 2 = done
+	var visit func(s *ast.StructStatement)
+	visit = func(s *ast.StructStatement) {
+		name := s.Name.Value
+		if state[name] != 0 {
+			if state[name] == 1 {
+				in.errs = append(in.errs, fmt.Errorf("line %d: struct %s contains itself by value", s.Token.Line, name))
+			}
+			return
+		}
+		state[name] = 1
+		for _, f := range s.Fields {
+			t := f.Type
+			for t != nil && t.ArrayLen > 0 {
+				t = t.Element()
+			}
+			if t != nil && t.IsNamed() && in.structs[t.Name] != nil {
+				visit(in.structs[t.Name])
+			}
+		}
+		state[name] = 2
+	}
+	for _, mod := range in.modules {
+		for _, stmt := range mod.program.Statements {
+			if s, ok := stmt.(*ast.StructStatement); ok {
+				visit(s)
+			}
+		}
+	}
+}
+
+// incomparableField returns the first field of a struct that == cannot
+// compare, as the C backend decides: a map, function or array, or a
+// struct with such a field
+func (in *Interpreter) incomparableField(name string, visiting map[string]bool) *ast.StructField {
+	s, ok := in.structs[name]
+	if !ok {
+		return nil
+	}
+	if visiting == nil {
+		visiting = make(map[string]bool)
+	}
+	if visiting[name] {
+		return nil
+	}
+	visiting[name] = true
+	for _, f := range s.Fields {
+		if f.Type == nil || f.Type.IsMap || f.Type.IsFunc || f.Type.ArrayLen != 0 {
+			return f
+		}
+		if f.Type.IsNamed() && in.structs[f.Type.Name] != nil && in.incomparableField(f.Type.Name, visiting) != nil {
+			return f
+		}
+	}
+	return nil
+}
+
+// initModule assigns the globals of a module in order, then runs its
+// init function
+func (in *Interpreter) initModule(mod *module) error {
+	in.frame = &frame{mod: mod, vars: make(map[*analysis.Object]*block)}
+	defer func() { in.frame = nil }()
+	for _, stmt := range mod.program.Statements {
+		var value ast.Expression
+		switch s := stmt.(type) {
+		case *ast.VarStatement:
+			in.frame.line = s.Token.Line
+			value = s.Value
+		case *ast.ConstStatement:
+			in.frame.line = s.Token.Line
+			value = s.Value
+		default:
+			continue
+		}
+		if value == nil {
+			continue
+		}
+		v, err := in.eval(value)
+		if err != nil {
+			return err
+		}
+		slot := &in.globals[stmt].cells[0]
+		*slot = convert(*slot, v)
+	}
+	if mod.init != nil {
+		if _, err := in.call(mod.init, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errorf returns a runtime error at the line being run
+func (in *Interpreter) errorf(format string, args ...interface{}) *Error {
+	err := &Error{Message: fmt.Sprintf(format, args...)}
+	if in.frame != nil {
+		err.Line = in.frame.line
+		if in.frame.mod != nil {
+			err.Module = in.frame.mod.path
+		}
+	}
+	return err
+}
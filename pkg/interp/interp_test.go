@@ -0,0 +1,508 @@
+package interp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+	"github.com/Dr-H-PhD/h-lang/pkg/parser"
+)
+
+func parse(t *testing.T, source string) *ast.Program {
+	t.Helper()
+	p := parser.New(lexer.New(source))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	return program
+}
+
+// result is what running a program did
+type result struct {
+	stdout, stderr string
+	status         int
+	err            error
+}
+
+// run runs a program whose imports are the given sources
+func run(t *testing.T, source string, imports map[string]string, setup func(in *Interpreter)) result {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	in := New()
+	in.Stdout, in.Stderr = &stdout, &stderr
+	in.Getenv = func(string) (string, bool) { return "", false }
+	in.MaxSteps = 100000
+	in.SetImportResolver(func(path, basePath string) (*ast.Program, error) {
+		source, ok := imports[path]
+		if !ok {
+			return nil, fmt.Errorf("cannot import %q", path)
+		}
+		return parse(t, source), nil
+	}, ".")
+	if setup != nil {
+		setup(in)
+	}
+	status, err := in.Run(parse(t, source))
+	return result{stdout.String(), stderr.String(), status, err}
+}
+
+// output runs a program that must succeed and returns what it printed
+func output(t *testing.T, source string) string {
+	t.Helper()
+	r := run(t, source, nil, nil)
+	if r.err != nil || r.status != 0 {
+		t.Fatalf("status %d, error %v, stderr %q", r.status, r.err, r.stderr)
+	}
+	return r.stdout
+}
+
+func TestRun_Print(t *testing.T) {
+	tests := []struct {
+		stmts string
+		want  string
+	}{
+		{`print(42);`, "42\n"},
+		{`print(3.5);`, "3.500000\n"},
+		{`print(1 < 2);`, "true\n"},
+		{`print('x');`, "x\n"},
+		{`print("a\tb");`, "a\tb\n"},
+		{`print();`, "\n"},
+		{`print(1, 2);`, "1\n"},
+		{`x := 7; print(x / 2); print(x % 4); print(-x / 2);`, "3\n3\n-3\n"},
+		{`x := 7.0; print(x / 2.0);`, "3.500000\n"},
+		{`var n int = 2147483647; n = n + 1; print(n);`, "-2147483648\n"},
+		{`var u uint8 = 250; u = u + 10; print(u);`, "4\n"},
+		{`var far long = 5000000000; print(far * 2);`, "10000000000\n"},
+		{`n := 2000000000; z := n + n; print(z); f := 2.5; h := 1 + f; print(h); b := 1 < 2; print(b);`, "-294967296\n3\ntrue\n"},
+		{`c := 'a'; c = c + 2; print(c);`, "c\n"},
+		{`f := 3.7; print((int)f); n := 300; print((char)n); print((float)n / 8.0);`, "3\n,\n37.500000\n"},
+		{`s := "ab" + "cd"; print(s); print(len(s)); print(s[1]);`, "abcd\n4\nb\n"},
+		{`x := 0; while x < 5 { x++; if x == 2 { continue; } if x == 4 { break; } print(x); }`, "1\n3\n"},
+		{`for i := 0; i < 3; i++ { print(i * i); }`, "0\n1\n4\n"},
+		{`arr := [3]int{4, 5, 6}; for i, v := range arr { print(i + v); }`, "4\n6\n8\n"},
+		{`arr := [4]int{1, 2}; print(arr[1]); print(arr[3]); print(len(arr));`, "2\n0\n4\n"},
+		{`var g [2][2]int; g[1][0] = 3; print(g[1][0]);`, "3\n"},
+	}
+	for _, tt := range tests {
+		got := output(t, "function main() {\n"+tt.stmts+"\n}\n")
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.stmts, got, tt.want)
+		}
+	}
+}
+
+func TestRun_StructsAndMethods(t *testing.T) {
+	source := `
+struct Point {
+    x int;
+    y int;
+}
+
+struct Line {
+    from Point;
+    to *Point;
+}
+
+function (p *Point) move(dx int) {
+    p.x = p.x + dx;
+}
+
+function (p Point) sum() int {
+    p.x = 100;
+    return p.x + p.y;
+}
+
+function main() {
+    p := Point{x: 1, y: 2};
+    p.move(3);
+    print(p.x);
+    print(p.sum());
+    print(p.x);
+
+    q := &p;
+    q.move(1);
+    print(p.x);
+
+    copy := p;
+    copy.x = 0;
+    print(p.x);
+
+    l := Line{from: p, to: &p};
+    l.to.y = 9;
+    l.from.move(10);
+    print(p.y);
+    print(l.from.x);
+    print(p == *l.to);
+    print(l.from == p);
+}
+`
+	want := "4\n102\n4\n5\n5\n9\n15\ntrue\nfalse\n"
+	if got := output(t, source); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRun_Heap(t *testing.T) {
+	source := `
+struct Node {
+    value int;
+    next *Node;
+}
+
+function push(head *Node, value int) *Node {
+    n := alloc(Node);
+    n.value = value;
+    n.next = head;
+    return n;
+}
+
+function main() {
+    var head *Node = null;
+    for i := 1; i <= 3; i++ {
+        head = push(head, i);
+    }
+    for n := head; n != null; n = n.next {
+        print(n.value);
+    }
+
+    buf := make([]int, 4);
+    buf[3] = 7;
+    print(buf[3]);
+    print(len(buf));
+    free(buf);
+
+    p := &Node{value: 8};
+    print(p.value);
+    free(p);
+
+    x := 1;
+    px := &x;
+    *px = 2;
+    print(x);
+}
+`
+	want := "3\n2\n1\n7\n4\n8\n2\n"
+	if got := output(t, source); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRun_RuntimeErrors(t *testing.T) {
+	tests := []struct {
+		stmts string
+		want  string
+	}{
+		{`p := alloc(int); free(p); print(*p);`, "line 3: use of freed memory"},
+		{`p := alloc(int); free(p); free(p);`, "line 3: double free"},
+		{`x := 1; free(&x);`, "line 3: free of memory that was not allocated"},
+		{`p := make([]int, 2); free(&p[1]);`, "line 3: free of a pointer into the middle of an allocation"},
+		{`var p *int; print(*p);`, "line 3: null pointer dereference"},
+		{`p := make([]int, 2); p[2] = 1;`, "line 3: index 2 out of range for 2 elements"},
+		{`a := [3]int{1, 2, 3}; i := 3; print(a[i]);`, "line 3: index 3 out of range for 3 elements"},
+		{`z := 0; print(1 / z);`, "line 3: integer divide by zero"},
+		{`m := map[string]int{}; free(m); print(m["a"]);`, "line 3: use of freed memory"},
+		{`print(down(0));`, "line 1: stack overflow in down"},
+		{`while true { }`, "line 3: the program did not finish in 100000 steps"},
+		{`a := [2]int{1, 2}; b := a; print(a == b);`, "line 3: cannot compare arrays"},
+		{`a := V{}; b := a; print(a != b);`, "line 3: cannot compare V values: field vals is not comparable"},
+	}
+	for _, tt := range tests {
+		source := "struct V { vals [3]int; } function down(n int) int { return down(n + 1); }\nfunction main() {\n" + tt.stmts + "\n}\n"
+		r := run(t, source, nil, nil)
+		var rerr *Error
+		if !errors.As(r.err, &rerr) || r.status != 1 {
+			t.Errorf("%s: status %d, error %v, want a runtime error", tt.stmts, r.status, r.err)
+			continue
+		}
+		if r.err.Error() != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.stmts, r.err.Error(), tt.want)
+		}
+	}
+}
+
+func TestRun_GC(t *testing.T) {
+	source := `
+function main() {
+    p := alloc(int);
+    *p = 4;
+    free(p);
+    free(p);
+    print(*p);
+}
+`
+	r := run(t, source, nil, func(in *Interpreter) { in.GC = true })
+	if r.err != nil || r.stdout != "4\n" {
+		t.Errorf("got %q, error %v; want free to be a hint", r.stdout, r.err)
+	}
+}
+
+func TestRun_Defer(t *testing.T) {
+	source := `
+function early(x int) int {
+    defer print("first");
+    if x > 3 {
+        defer print("inner");
+        return x;
+    }
+    defer print("last");
+    return 0;
+}
+
+function counts() int {
+    n := 1;
+    defer print(n);
+    n = 2;
+    return n;
+}
+
+function main() {
+    print(early(5));
+    print(early(1));
+    print(counts());
+}
+`
+	// Defers run when the function returns, each return running those
+	// before it in the body, as the C backend emits them
+	want := "inner\nfirst\n5\nlast\ninner\nfirst\n0\n2\n2\n"
+	if got := output(t, source); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRun_MapsAndEnums(t *testing.T) {
+	source := `
+enum Color { Red, Green = 5, Blue }
+
+function main() {
+    ages := map[string]int{"alice": 30};
+    ages["bob"] = 25;
+    ages["bob"] += 1;
+    print(ages["alice"]);
+    print(ages["bob"]);
+    print(ages["carol"]);
+    print(len(ages));
+    delete(ages, "alice");
+    print(len(ages));
+    free(ages);
+
+    print(Color_Red);
+    print(Color_Blue);
+    c := Color_Green;
+    if c == Color_Green {
+        print("green");
+    }
+}
+`
+	want := "30\n26\n0\n2\n1\n0\n6\ngreen\n"
+	if got := output(t, source); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRun_FunctionValues(t *testing.T) {
+	source := `
+struct Op {
+    apply function(int) int;
+}
+
+function twice(n int) int {
+    return n * 2;
+}
+
+function call(f function(int) int, n int) int {
+    return f(n);
+}
+
+function main() {
+    f := twice;
+    print(call(f, 3));
+    op := Op{apply: twice};
+    print(op.apply(5));
+    print(f == twice);
+}
+`
+	want := "6\n10\ntrue\n"
+	if got := output(t, source); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRun_ImportsAndInit(t *testing.T) {
+	imports := map[string]string{
+		"lib.hl": `
+public var counter int = 0;
+var step int = 2;
+
+function init() {
+    print("lib init");
+    counter = step * 50;
+}
+
+public function bump() int {
+    counter = counter + step;
+    return counter;
+}
+`,
+	}
+	source := `
+import "lib.hl";
+
+var squares [3]int;
+
+function init() {
+    print("main init");
+    squares[2] = 4;
+}
+
+function main() {
+    print(bump());
+    print(squares[2]);
+}
+`
+	r := run(t, source, imports, nil)
+	want := "lib init\nmain init\n102\n4\n"
+	if r.err != nil || r.stdout != want {
+		t.Errorf("got %q, error %v; want %q", r.stdout, r.err, want)
+	}
+}
+
+func TestRun_Process(t *testing.T) {
+	source := `
+function main() int {
+    a := args();
+    print(len(a));
+    print(a[1]);
+    print(getenv("HOME"));
+    print(getenv("MISSING") == null);
+    if len(a) > 1 {
+        exit(7);
+    }
+    return 3;
+}
+`
+	r := run(t, source, nil, func(in *Interpreter) {
+		in.Args = []string{"prog", "x"}
+		in.Getenv = func(name string) (string, bool) {
+			return "/home/h", name == "HOME"
+		}
+	})
+	if r.err != nil || r.status != 7 {
+		t.Errorf("status %d, error %v; want exit status 7", r.status, r.err)
+	}
+	if want := "2\nx\n/home/h\ntrue\n"; r.stdout != want {
+		t.Errorf("got %q, want %q", r.stdout, want)
+	}
+
+	r = run(t, "function main() int { return 3; }", nil, nil)
+	if r.err != nil || r.status != 3 {
+		t.Errorf("status %d, error %v; want main's result 3", r.status, r.err)
+	}
+}
+
+func TestRun_Assert(t *testing.T) {
+	tests := []struct {
+		stmts string
+		want  string
+	}{
+		{`x := 2; assert(x == 3);`, "main.hl:3:9: assertion failed: x == 3\n"},
+		{`x := 2; assert_eq(x + 1, 4);`, "main.hl:3:9: assert_eq(x + 1, 4) failed\n    left:  3\n    right: 4\n"},
+		{`s := "a"; assert_eq(s, "b");`, "main.hl:3:11: assert_eq(s, \"b\") failed\n    left:  \"a\"\n    right: \"b\"\n"},
+		{`f := 0.5; assert_eq(f, 1.5);`, "main.hl:3:11: assert_eq(f, 1.5) failed\n    left:  0.5\n    right: 1.5\n"},
+	}
+	for _, tt := range tests {
+		r := run(t, "function main() {\n\n"+tt.stmts+"\n    print(\"unreachable\");\n}\n", nil, func(in *Interpreter) {
+			in.SetSourceName("main.hl")
+		})
+		if r.err != nil || r.status != 1 || r.stdout != "" {
+			t.Errorf("%s: status %d, error %v, stdout %q", tt.stmts, r.status, r.err, r.stdout)
+		}
+		if r.stderr != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.stmts, r.stderr, tt.want)
+		}
+	}
+}
+
+func TestRun_LoadErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{`import "missing.hl"; function main() {}`, `line 1: cannot import "missing.hl"`},
+		{"function init(x int) {}\nfunction main() {}", "line 1: init must take no parameters and return nothing"},
+		{"struct A { a A; }\nfunction main() {}", "line 1: struct A contains itself by value"},
+		{"function main() { init(); }\nfunction init() {}", "line 1: init cannot be called; it runs automatically before main"},
+	}
+	for _, tt := range tests {
+		r := run(t, tt.source, nil, nil)
+		if r.err == nil || !strings.Contains(r.err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want %q", tt.source, r.err, tt.want)
+		}
+	}
+}
+
+func TestCall(t *testing.T) {
+	source := `
+extern function now() int;
+
+var total int = 0;
+
+function add(n int) int {
+    total = total + n + now();
+    return total;
+}
+
+function greet(name string) string {
+    return "hello " + name;
+}
+
+function main() {}
+`
+	in := New()
+	in.Define("now", func(args []Value) (Value, error) {
+		return IntValue(1000), nil
+	})
+	if err := in.Load(parse(t, source)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct{ n, want int64 }{{5, 1005}, {7, 2012}} {
+		v, err := in.Call("add", IntValue(tt.n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Kind != Int || v.Int != tt.want {
+			t.Errorf("add(%d): got %v, want %d", tt.n, v, tt.want)
+		}
+	}
+
+	v, err := in.Call("greet", StringValue("go"))
+	if err != nil || v.String() != "hello go" {
+		t.Errorf("greet: got %v, error %v", v, err)
+	}
+
+	if _, err := in.Call("add"); err == nil || err.Error() != "line 6: add takes 1 arguments, got 0" {
+		t.Errorf("got error %v, want an argument count error", err)
+	}
+	if _, err := in.Call("missing"); err == nil {
+		t.Error("calling an undefined function succeeded")
+	}
+}
+
+func TestCall_UndefinedExtern(t *testing.T) {
+	source := `
+extern function now() int;
+
+function main() {
+    print(now());
+}
+`
+	r := run(t, source, nil, nil)
+	if r.err == nil || r.err.Error() != "line 5: extern function now is not defined in the interpreter" {
+		t.Errorf("got error %v", r.err)
+	}
+}
@@ -0,0 +1,353 @@
+package interp
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+)
+
+// Kind is the type of a value
+type Kind int
+
+const (
+	Void    Kind = iota // no value, the result of functions that return nothing
+	Int                 // any of the integer types, named by Type
+	Float               // a float, which is a C double
+	Bool                // a bool
+	Char                // a char
+	String              // a string, which may be null
+	Pointer             // a pointer or slice, or null
+	Struct              // a struct, named by Type
+	Array               // a fixed-size array
+	Map                 // a map, or null
+	Func                // a function value, or null
+)
+
+var kindNames = map[Kind]string{
+	Void:    "void",
+	Int:     "int",
+	Float:   "float",
+	Bool:    "bool",
+	Char:    "char",
+	String:  "string",
+	Pointer: "pointer",
+	Struct:  "struct",
+	Array:   "array",
+	Map:     "map",
+	Func:    "function",
+}
+
+func (k Kind) String() string {
+	if name, ok := kindNames[k]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Value is an H value. Scalars are held in the exported fields; structs,
+// arrays, pointers, maps and functions refer to the interpreter's memory
+// and are only made by running H code.
+type Value struct {
+	Kind  Kind
+	Int   int64 // an Int, wrapped to its type, or the byte of a Char
+	Float float64
+	Bool  bool
+	Str   string
+	Type  string // the integer type of an Int, the name of a Struct
+
+	null  bool                   // a null String
+	elems []Value                // the fields of a Struct, the elements of an Array
+	at    location               // where a Pointer points, nowhere for null
+	m     *hashMap               // a Map, nil for null
+	fn    *ast.FunctionStatement // a Func, nil for null
+}
+
+// IntValue returns an int
+func IntValue(n int64) Value {
+	return Value{Kind: Int, Int: wrap(n, "int"), Type: "int"}
+}
+
+// FloatValue returns a float
+func FloatValue(f float64) Value {
+	return Value{Kind: Float, Float: f}
+}
+
+// BoolValue returns a bool
+func BoolValue(b bool) Value {
+	return Value{Kind: Bool, Bool: b}
+}
+
+// StringValue returns a string
+func StringValue(s string) Value {
+	return Value{Kind: String, Str: s}
+}
+
+// IsNull reports whether a pointer, slice, map, function or string is null
+func (v Value) IsNull() bool {
+	switch v.Kind {
+	case Pointer:
+		return v.at.b == nil
+	case Map:
+		return v.m == nil
+	case Func:
+		return v.fn == nil
+	case String:
+		return v.null
+	}
+	return false
+}
+
+// String formats a value as print shows it. Values print cannot show are
+// described instead.
+func (v Value) String() string {
+	switch v.Kind {
+	case Int:
+		if intTypes[v.Type].signed {
+			return strconv.FormatInt(v.Int, 10)
+		}
+		return strconv.FormatUint(uint64(v.Int), 10)
+	case Float:
+		return formatFloat(v.Float)
+	case Bool:
+		return strconv.FormatBool(v.Bool)
+	case Char:
+		return string([]byte{byte(v.Int)})
+	case String:
+		if v.null {
+			return "(null)"
+		}
+		return v.Str
+	case Struct:
+		var fields []string
+		for _, f := range v.elems {
+			fields = append(fields, f.String())
+		}
+		return v.Type + "{" + strings.Join(fields, ", ") + "}"
+	case Array:
+		var elems []string
+		for _, e := range v.elems {
+			elems = append(elems, e.String())
+		}
+		return "[" + strings.Join(elems, ", ") + "]"
+	}
+	if v.IsNull() {
+		return "null"
+	}
+	return v.Kind.String()
+}
+
+// formatFloat formats a float as printf's %f does
+func formatFloat(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "nan"
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	return fmt.Sprintf("%f", f)
+}
+
+// intType is the size and signedness of an integer type
+type intType struct {
+	bits   uint
+	signed bool
+}
+
+// intTypes are the integer types, with the sizes they have in C on the
+// 64-bit platforms hlc targets
+var intTypes = map[string]intType{
+	"int":    {32, true},
+	"int8":   {8, true},
+	"int16":  {16, true},
+	"int32":  {32, true},
+	"int64":  {64, true},
+	"uint8":  {8, false},
+	"uint16": {16, false},
+	"uint32": {32, false},
+	"uint64": {64, false},
+	"uint":   {32, false},
+	"long":   {64, true},
+	"ulong":  {64, false},
+	"usize":  {64, false},
+}
+
+// wrap truncates n to an integer type, as C does when it converts. The
+// 64-bit unsigned types keep their bits in the int64.
+func wrap(n int64, typ string) int64 {
+	t := intTypes[typ]
+	if t.bits == 64 {
+		return n
+	}
+	shift := 64 - t.bits
+	if t.signed {
+		return n << shift >> shift
+	}
+	return int64(uint64(n) << shift >> shift)
+}
+
+// promote returns the type an integer operand of arithmetic has: smaller
+// types become int
+func promote(typ string) string {
+	if intTypes[typ].bits < 32 {
+		return "int"
+	}
+	return typ
+}
+
+// common returns the type of arithmetic between integers: the larger of
+// the promoted types, or the unsigned one of two the same size
+func common(a, b string) string {
+	a, b = promote(a), promote(b)
+	ta, tb := intTypes[a], intTypes[b]
+	switch {
+	case ta.bits > tb.bits:
+		return a
+	case tb.bits > ta.bits:
+		return b
+	case !tb.signed:
+		return b
+	}
+	return a
+}
+
+func (v Value) float() float64 {
+	if v.Kind == Float {
+		return v.Float
+	}
+	if v.Kind == Int && !intTypes[v.Type].signed {
+		return float64(uint64(v.Int))
+	}
+	return float64(v.Int)
+}
+
+// intType returns the integer type of an Int or Char operand
+func (v Value) intType() string {
+	if v.Kind == Char {
+		return "int8"
+	}
+	return v.Type
+}
+
+func (v Value) numeric() bool {
+	return v.Kind == Int || v.Kind == Float || v.Kind == Char
+}
+
+// copy returns a value that shares no struct or array storage with v
+func (v Value) copy() Value {
+	if v.Kind == Struct || v.Kind == Array {
+		elems := make([]Value, len(v.elems))
+		for i, e := range v.elems {
+			elems[i] = e.copy()
+		}
+		v.elems = elems
+	}
+	return v
+}
+
+// convert converts a value to the type of old, which it replaces: numbers
+// are converted and wrapped as in C and null takes the kind of old
+func convert(old, v Value) Value {
+	switch old.Kind {
+	case Int:
+		switch v.Kind {
+		case Int, Char:
+			return Value{Kind: Int, Int: wrap(v.Int, old.Type), Type: old.Type}
+		case Float:
+			return Value{Kind: Int, Int: wrap(int64(v.Float), old.Type), Type: old.Type}
+		case Bool:
+			return Value{Kind: Int, Int: wrap(boolInt(v.Bool), old.Type), Type: old.Type}
+		}
+	case Float:
+		if v.Kind == Int || v.Kind == Char {
+			return Value{Kind: Float, Float: v.float()}
+		}
+	case Char:
+		if v.Kind == Int {
+			return Value{Kind: Char, Int: wrap(v.Int, "int8")}
+		}
+	case Bool:
+		if v.Kind == Int || v.Kind == Char {
+			return Value{Kind: Bool, Bool: v.Int != 0}
+		}
+	case String, Map, Func:
+		if v.Kind == Pointer && v.IsNull() {
+			return zeroOf(old.Kind)
+		}
+	case Pointer:
+		// A slice literal stored in a slice is an array the slice points
+		// to, and an empty one is null
+		if v.Kind == Array && len(v.elems) == 0 {
+			return Value{Kind: Pointer}
+		}
+		if v.Kind == Array {
+			b := variable(Value{})
+			b.cells = v.copy().elems
+			return pointerTo(location{b: b, cells: b.cells})
+		}
+	}
+	return v.copy()
+}
+
+// zeroOf returns the null value of a kind
+func zeroOf(k Kind) Value {
+	if k == String {
+		return Value{Kind: String, null: true}
+	}
+	return Value{Kind: k}
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// unquote replaces the C escape sequences of a string or char literal
+func unquote(s string) string {
+	if !strings.ContainsRune(s, '\\') {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case '0':
+			b.WriteByte(0)
+		case 'a':
+			b.WriteByte('\a')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'v':
+			b.WriteByte('\v')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// cString returns a string up to its first NUL, as C functions see it
+func cString(s string) string {
+	if i := strings.IndexByte(s, 0); i != -1 {
+		return s[:i]
+	}
+	return s
+}
@@ -1,23 +1,37 @@
 package lexer
 
 import (
+	"fmt"
+	"strings"
 	"unicode"
 )
 
 // Lexer tokenizes H-lang source code
 type Lexer struct {
 	input   string
-	pos     int  // current position in input
-	readPos int  // next reading position
-	ch      byte // current character
+	file    *File // where token positions are
+	pos     int   // current position in input
+	readPos int   // next reading position
+	ch      byte  // current character
 	line    int
 	column  int
 }
 
-// New creates a new Lexer
+// New creates a new Lexer for a source of its own, as the only file of a
+// new FileSet
 func New(input string) *Lexer {
+	return NewFile(NewFileSet().AddFile("", input), input)
+}
+
+// NewFile creates a Lexer for the source of a file added to a FileSet,
+// whose tokens have positions in that set
+func NewFile(file *File, input string) *Lexer {
+	if file.Size() != len(input) {
+		panic(fmt.Sprintf("lexer: the source is %d bytes, but %s has %d", len(input), file.describe(), file.Size()))
+	}
 	l := &Lexer{
 		input:  input,
+		file:   file,
 		line:   1,
 		column: 0,
 	}
@@ -25,7 +39,18 @@ func New(input string) *Lexer {
 	return l
 }
 
+// File returns the file the lexer reads
+func (l *Lexer) File() *File {
+	return l.file
+}
+
 func (l *Lexer) readChar() {
+	// A newline is the last character of its line
+	if l.ch == '\n' {
+		l.line++
+		l.column = 0
+	}
+
 	if l.readPos >= len(l.input) {
 		l.ch = 0 // EOF
 	} else {
@@ -34,11 +59,6 @@ func (l *Lexer) readChar() {
 	l.pos = l.readPos
 	l.readPos++
 	l.column++
-
-	if l.ch == '\n' {
-		l.line++
-		l.column = 0
-	}
 }
 
 func (l *Lexer) peekChar() byte {
@@ -50,9 +70,17 @@ func (l *Lexer) peekChar() byte {
 
 // NextToken returns the next token
 func (l *Lexer) NextToken() Token {
-	var tok Token
-
 	l.skipWhitespace()
+	start := l.pos
+	tok := l.next()
+	tok.Pos = l.file.Pos(min(start, len(l.input)))
+	tok.End = l.file.Pos(min(l.pos, len(l.input)))
+	return tok
+}
+
+// next reads the token that starts at the current character
+func (l *Lexer) next() Token {
+	var tok Token
 
 	tok.Line = l.line
 	tok.Column = l.column
@@ -166,7 +194,13 @@ func (l *Lexer) NextToken() Token {
 	case ';':
 		tok = l.newToken(SEMICOLON, l.ch)
 	case '.':
-		tok = l.newToken(DOT, l.ch)
+		if strings.HasPrefix(l.input[l.pos:], "...") {
+			l.readChar()
+			l.readChar()
+			tok = Token{Type: ELLIPSIS, Literal: "...", Line: tok.Line, Column: tok.Column}
+		} else {
+			tok = l.newToken(DOT, l.ch)
+		}
 	case '(':
 		tok = l.newToken(LPAREN, l.ch)
 	case ')':
@@ -1,6 +1,9 @@
 package lexer
 
-import "testing"
+import (
+	"encoding/json"
+	"testing"
+)
 
 func TestNextToken_SingleCharacters(t *testing.T) {
 	input := `=+-*/%!<>,;:.(){}[]&`
@@ -47,7 +50,7 @@ func TestNextToken_SingleCharacters(t *testing.T) {
 }
 
 func TestNextToken_TwoCharOperators(t *testing.T) {
-	input := `:= == != <= >= && || ++ -- += -= *= /= =>`
+	input := `:= == != <= >= && || ++ -- += -= *= /= => ...`
 
 	tests := []struct {
 		expectedType    TokenType
@@ -67,6 +70,7 @@ func TestNextToken_TwoCharOperators(t *testing.T) {
 		{MUL_ASSIGN, "*="},
 		{DIV_ASSIGN, "/="},
 		{ARROW, "=>"},
+		{ELLIPSIS, "..."},
 		{EOF, ""},
 	}
 
@@ -319,6 +323,84 @@ z`
 	}
 }
 
+func TestNextToken_Positions(t *testing.T) {
+	input := "x := \"a b\"; // note\n\tf(1.5)\r\n/* a\nb */ y\n"
+	l := New(input)
+	file := l.File()
+
+	tests := []struct {
+		text         string
+		line, column int
+	}{
+		{"x", 1, 1},
+		{":=", 1, 3},
+		{"\"a b\"", 1, 6},
+		{";", 1, 11},
+		{"// note", 1, 13},
+		{"f", 2, 2},
+		{"(", 2, 3},
+		{"1.5", 2, 4},
+		{")", 2, 7},
+		{"/* a\nb */", 3, 1},
+		{"y", 4, 6},
+		{"", 5, 1},
+	}
+	for _, tt := range tests {
+		tok := l.NextToken()
+		if got := input[file.Offset(tok.Pos):file.Offset(tok.End)]; got != tt.text {
+			t.Errorf("%s: expected the text %q, got %q", tok.Position(), tt.text, got)
+		}
+		if tok.Line != tt.line || tok.Column != tt.column {
+			t.Errorf("%q: expected %d:%d, got %s", tt.text, tt.line, tt.column, tok.Position())
+		}
+		if pos := file.Position(tok.Pos); pos.Line != tok.Line || pos.Column != tok.Column {
+			t.Errorf("%q: the file places %s at %s", tt.text, tok.Position(), pos)
+		}
+	}
+}
+
+func TestFileSet(t *testing.T) {
+	fset := NewFileSet()
+	a := fset.AddFile("a.hl", "x := 1;\ny := 2;\n")
+	b := fset.AddFile("b.hl", "z")
+
+	if a.LineCount() != 3 || b.LineCount() != 1 {
+		t.Errorf("expected 3 and 1 lines, got %d and %d", a.LineCount(), b.LineCount())
+	}
+	if a.Pos(a.Size()) >= b.Pos(0) {
+		t.Errorf("the end of a.hl at %d overlaps b.hl at %d", a.Pos(a.Size()), b.Pos(0))
+	}
+
+	tests := []struct {
+		pos      Pos
+		expected string
+	}{
+		{a.Pos(0), "a.hl:1:1"},
+		{a.Pos(7), "a.hl:1:8"}, // the newline ends line 1
+		{a.Pos(8), "a.hl:2:1"},
+		{a.LineStart(2) + 5, "a.hl:2:6"},
+		{a.Pos(a.Size()), "a.hl:3:1"},
+		{b.Pos(0), "b.hl:1:1"},
+		{b.Pos(1), "b.hl:1:2"},
+		{NoPos, "-"},
+		{b.Pos(1) + 1, "-"},
+	}
+	for _, tt := range tests {
+		if got := fset.Position(tt.pos).String(); got != tt.expected {
+			t.Errorf("position %d: expected %s, got %s", tt.pos, tt.expected, got)
+		}
+	}
+	if fset.File(b.Pos(0)) != b || fset.File(a.Pos(3)) != a {
+		t.Errorf("positions found in the wrong file")
+	}
+
+	// Tokens lexed in a set have its positions
+	l := NewFile(b, "z")
+	if tok := l.NextToken(); tok.Pos != b.Pos(0) || tok.End != b.Pos(1) {
+		t.Errorf("expected z at %d-%d, got %d-%d", b.Pos(0), b.Pos(1), tok.Pos, tok.End)
+	}
+}
+
 func TestNextToken_FullProgram(t *testing.T) {
 	input := `function main() {
     x := 42;
@@ -362,3 +444,34 @@ func TestLookupIdent(t *testing.T) {
 		}
 	}
 }
+
+func TestToken_JSON(t *testing.T) {
+	l := New("x := \"a\\n\"; // note")
+	for {
+		tok := l.NextToken()
+		data, err := json.Marshal(tok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded Token
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("%s: %v", data, err)
+		}
+		if decoded != tok {
+			t.Errorf("%s: decoded as %+v, want %+v", data, decoded, tok)
+		}
+		if tok.Type == EOF {
+			break
+		}
+	}
+
+	data, _ := json.Marshal(Token{Type: WALRUS, Literal: ":=", Line: 1, Column: 3})
+	if expected := `{"type":":=","literal":":=","line":1,"column":3}`; string(data) != expected {
+		t.Errorf("expected %s, got %s", expected, data)
+	}
+
+	var tok Token
+	if err := json.Unmarshal([]byte(`{"type":"WIDGET"}`), &tok); err == nil {
+		t.Errorf("expected an error for an unknown token type")
+	}
+}
@@ -0,0 +1,180 @@
+package lexer
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Pos is a position in a FileSet: the base of a file plus the byte offset
+// of the position in it. Files get disjoint ranges of positions, so a Pos
+// identifies the file as well as the place in it. The zero Pos, NoPos, is
+// no position at all.
+type Pos int
+
+// NoPos is the Pos of nodes and tokens that were not read from a source
+const NoPos Pos = 0
+
+// IsValid reports whether p is a position
+func (p Pos) IsValid() bool {
+	return p != NoPos
+}
+
+// Position is a Pos spelt out
+type Position struct {
+	Filename string // empty if the file has no name
+	Offset   int    // byte offset, from 0
+	Line     int    // line number, from 1
+	Column   int    // byte column, from 1
+}
+
+// IsValid reports whether the position is known
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+// String returns file:line:column, line:column for a file without a name
+// or - for an unknown position
+func (p Position) String() string {
+	if !p.IsValid() {
+		if p.Filename != "" {
+			return p.Filename
+		}
+		return "-"
+	}
+	if p.Filename == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Column)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.Filename, p.Line, p.Column)
+}
+
+// File is a source file of a FileSet
+type File struct {
+	name  string
+	base  int
+	size  int
+	lines []int // the offset of the first byte of each line
+}
+
+// Name returns the name the file was added with
+func (f *File) Name() string { return f.name }
+
+// Base returns the Pos of the file's first byte
+func (f *File) Base() int { return f.base }
+
+// Size returns the length of the file's source in bytes
+func (f *File) Size() int { return f.size }
+
+// LineCount returns the number of lines in the file
+func (f *File) LineCount() int { return len(f.lines) }
+
+// Pos returns the position of a byte offset in the file, which may be
+// the size of the file for the position after its last byte
+func (f *File) Pos(offset int) Pos {
+	if offset < 0 || offset > f.size {
+		panic(fmt.Sprintf("lexer: offset %d outside %s of size %d", offset, f.describe(), f.size))
+	}
+	return Pos(f.base + offset)
+}
+
+// Offset returns the byte offset of a position in the file
+func (f *File) Offset(p Pos) int {
+	offset := int(p) - f.base
+	if offset < 0 || offset > f.size {
+		panic(fmt.Sprintf("lexer: position %d outside %s", p, f.describe()))
+	}
+	return offset
+}
+
+// LineStart returns the position of the first byte of a line
+func (f *File) LineStart(line int) Pos {
+	if line < 1 || line > len(f.lines) {
+		panic(fmt.Sprintf("lexer: line %d outside %s of %d lines", line, f.describe(), len(f.lines)))
+	}
+	return Pos(f.base + f.lines[line-1])
+}
+
+// Position returns the line and column of a position in the file. A
+// newline belongs to the line it ends.
+func (f *File) Position(p Pos) Position {
+	if !p.IsValid() {
+		return Position{}
+	}
+	offset := f.Offset(p)
+	line := sort.Search(len(f.lines), func(i int) bool { return f.lines[i] > offset })
+	return Position{
+		Filename: f.name,
+		Offset:   offset,
+		Line:     line,
+		Column:   offset - f.lines[line-1] + 1,
+	}
+}
+
+func (f *File) describe() string {
+	if f.name == "" {
+		return "the file"
+	}
+	return f.name
+}
+
+// FileSet is a set of source files whose positions are Pos values. It is
+// safe for concurrent use.
+type FileSet struct {
+	mu    sync.RWMutex
+	base  int // the base of the next file
+	files []*File
+}
+
+// NewFileSet returns an empty FileSet
+func NewFileSet() *FileSet {
+	return &FileSet{base: 1}
+}
+
+// AddFile adds a file with the given name and source to the set and
+// returns it. Its positions follow those of the files added before it,
+// and one more after its last byte marks its end.
+func (s *FileSet) AddFile(name, source string) *File {
+	f := &File{name: name, size: len(source), lines: []int{0}}
+	for i := 0; i < len(source); i++ {
+		if source[i] == '\n' {
+			f.lines = append(f.lines, i+1)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f.base = s.base
+	s.base += f.size + 1
+	s.files = append(s.files, f)
+	return f
+}
+
+// File returns the file a position belongs to, or nil
+func (s *FileSet) File(p Pos) *File {
+	if !p.IsValid() {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := sort.Search(len(s.files), func(i int) bool { return s.files[i].base > int(p) }) - 1
+	if i < 0 || int(p) > s.files[i].base+s.files[i].size {
+		return nil
+	}
+	return s.files[i]
+}
+
+// Position returns a position spelt out, or the zero Position if it is
+// not in the set
+func (s *FileSet) Position(p Pos) Position {
+	if f := s.File(p); f != nil {
+		return f.Position(p)
+	}
+	return Position{}
+}
+
+// Files returns the files of the set in the order they were added
+func (s *FileSet) Files() []*File {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*File(nil), s.files...)
+}
@@ -1,6 +1,9 @@
 package lexer
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+)
 
 // TokenType represents the type of a token
 type TokenType int
@@ -53,6 +56,7 @@ const (
 	COLON     // :
 	DOT       // .
 	ARROW     // =>
+	ELLIPSIS  // ...
 
 	LPAREN   // (
 	RPAREN   // )
@@ -134,6 +138,7 @@ var tokenNames = map[TokenType]string{
 	COLON:        ":",
 	DOT:          ".",
 	ARROW:        "=>",
+	ELLIPSIS:     "...",
 	LPAREN:       "(",
 	RPAREN:       ")",
 	LBRACE:       "{",
@@ -222,15 +227,57 @@ func LookupIdent(ident string) TokenType {
 	return IDENT
 }
 
-// Token represents a lexical token
+// Token represents a lexical token. Line and Column are where it starts;
+// Pos and End are the positions of its first byte and of the byte after
+// it, in the FileSet of the lexer that read it.
 type Token struct {
 	Type    TokenType
 	Literal string
 	Line    int
 	Column  int
+	Pos     Pos
+	End     Pos
 }
 
 // Position returns formatted position
 func (t Token) Position() string {
 	return fmt.Sprintf("%d:%d", t.Line, t.Column)
 }
+
+// LookupTokenType returns the token type String names
+func LookupTokenType(name string) (TokenType, bool) {
+	for t, n := range tokenNames {
+		if n == name {
+			return t, true
+		}
+	}
+	return ILLEGAL, false
+}
+
+// tokenJSON is the JSON form of a token. The type is its name, as
+// String spells it.
+type tokenJSON struct {
+	Type    string `json:"type"`
+	Literal string `json:"literal"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Pos     Pos    `json:"pos,omitempty"`
+	End     Pos    `json:"end,omitempty"`
+}
+
+func (t Token) MarshalJSON() ([]byte, error) {
+	return json.Marshal(tokenJSON{t.Type.String(), t.Literal, t.Line, t.Column, t.Pos, t.End})
+}
+
+func (t *Token) UnmarshalJSON(data []byte) error {
+	var j tokenJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	typ, ok := LookupTokenType(j.Type)
+	if !ok {
+		return fmt.Errorf("unknown token type %q", j.Type)
+	}
+	*t = Token{Type: typ, Literal: j.Literal, Line: j.Line, Column: j.Column, Pos: j.Pos, End: j.End}
+	return nil
+}
@@ -0,0 +1,229 @@
+package lsp
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+	"github.com/Dr-H-PhD/h-lang/pkg/parser"
+)
+
+// document is an open text document. The tokens always reflect the
+// current text; the program is the last version that parsed, so that
+// features keep working while the user is typing.
+type document struct {
+	uri     string
+	path    string
+	text    string
+	lines   []int         // byte offset of the start of each line
+	tokens  []lexer.Token // including comments, without EOF
+	program *ast.Program  // nil until the text first parses
+	errors  []string      // parse errors of the current text
+}
+
+func newDocument(uri, text string) *document {
+	d := &document{uri: uri, path: uriToPath(uri)}
+	d.update(text)
+	return d
+}
+
+// update replaces the text, re-lexing and re-parsing it
+func (d *document) update(text string) {
+	d.text = text
+	d.lines = []int{0}
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\n' {
+			d.lines = append(d.lines, i+1)
+		}
+	}
+
+	d.tokens = d.tokens[:0]
+	l := lexer.New(text)
+	for tok := l.NextToken(); tok.Type != lexer.EOF; tok = l.NextToken() {
+		d.tokens = append(d.tokens, tok)
+	}
+
+	program, errors := parse(text)
+	d.errors = errors
+	if len(errors) == 0 {
+		d.program = program
+	}
+}
+
+// parse parses source, turning a parser panic on malformed input into an
+// error
+func parse(source string) (program *ast.Program, errors []string) {
+	defer func() {
+		if r := recover(); r != nil {
+			program, errors = nil, []string{fmt.Sprintf("line 1: cannot parse: %v", r)}
+		}
+	}()
+	p := parser.New(lexer.New(source))
+	program = p.ParseProgram()
+	return program, p.Errors()
+}
+
+// lineText returns the text of a one-based line without its newline
+func (d *document) lineText(line int) string {
+	if line < 1 || line > len(d.lines) {
+		return ""
+	}
+	start := d.lines[line-1]
+	end := len(d.text)
+	if line < len(d.lines) {
+		end = d.lines[line]
+	}
+	return strings.TrimRight(d.text[start:end], "\r\n")
+}
+
+// offset returns the byte offset of a one-based line and byte column
+func (d *document) offset(line, column int) int {
+	if line < 1 {
+		return 0
+	}
+	if line > len(d.lines) {
+		return len(d.text)
+	}
+	off := d.lines[line-1] + column - 1
+	if off > len(d.text) {
+		return len(d.text)
+	}
+	return off
+}
+
+// position converts a byte offset to a protocol position
+func (d *document) position(offset int) Position {
+	line := 0
+	for line+1 < len(d.lines) && d.lines[line+1] <= offset {
+		line++
+	}
+	prefix := d.text[d.lines[line]:offset]
+	return Position{Line: line, Character: len(utf16.Encode([]rune(prefix)))}
+}
+
+// tokenPosition converts a protocol position to a one-based line and byte
+// column
+func (d *document) tokenPosition(pos Position) (int, int) {
+	text := d.lineText(pos.Line + 1)
+	units, column := 0, 1
+	for _, r := range text {
+		if units >= pos.Character {
+			break
+		}
+		units += len(utf16.Encode([]rune{r}))
+		column += utf8.RuneLen(r)
+	}
+	return pos.Line + 1, column
+}
+
+// tokenEnd returns the byte offset just past a token. String, character
+// and comment literals do not include their delimiters.
+func (d *document) tokenEnd(tok lexer.Token) int {
+	start := d.offset(tok.Line, tok.Column)
+	switch tok.Type {
+	case lexer.STRING, lexer.CHAR:
+		return min(start+len(tok.Literal)+2, len(d.text))
+	case lexer.COMMENT:
+		if strings.HasPrefix(d.text[start:], "/*") {
+			if end := strings.Index(d.text[start+2:], "*/"); end >= 0 {
+				return start + 2 + end + 2
+			}
+			return len(d.text)
+		}
+		if end := strings.IndexByte(d.text[start:], '\n'); end >= 0 {
+			return start + len(strings.TrimRight(d.text[start:start+end], "\r"))
+		}
+		return len(d.text)
+	case lexer.ILLEGAL:
+		return min(start+1, len(d.text))
+	}
+	return min(start+len(tok.Literal), len(d.text))
+}
+
+// tokenRange returns the range a token covers
+func (d *document) tokenRange(tok lexer.Token) Range {
+	return Range{
+		Start: d.position(d.offset(tok.Line, tok.Column)),
+		End:   d.position(d.tokenEnd(tok)),
+	}
+}
+
+// lineRange returns the range of a one-based line without its
+// indentation
+func (d *document) lineRange(line int) Range {
+	if line < 1 || line > len(d.lines) {
+		line = 1
+	}
+	text := d.lineText(line)
+	start := d.lines[line-1] + len(text) - len(strings.TrimLeft(text, " \t"))
+	return Range{Start: d.position(start), End: d.position(d.lines[line-1] + len(text))}
+}
+
+// tokenAt returns the index of the token under a protocol position, or
+// -1. A cursor just past an identifier is on that identifier.
+func (d *document) tokenAt(pos Position) int {
+	line, column := d.tokenPosition(pos)
+	off := d.offset(line, column)
+	found := -1
+	for i, tok := range d.tokens {
+		start := d.offset(tok.Line, tok.Column)
+		if start > off {
+			break
+		}
+		if off > d.tokenEnd(tok) || tok.Type == lexer.COMMENT {
+			continue
+		}
+		if found < 0 || tok.Type == lexer.IDENT || d.tokens[found].Type != lexer.IDENT {
+			found = i
+		}
+	}
+	return found
+}
+
+// tokenBefore returns the index of the last token that starts before a
+// protocol position, or -1
+func (d *document) tokenBefore(pos Position) int {
+	line, column := d.tokenPosition(pos)
+	off := d.offset(line, column)
+	last := -1
+	for i, tok := range d.tokens {
+		if d.offset(tok.Line, tok.Column) >= off {
+			break
+		}
+		last = i
+	}
+	return last
+}
+
+// uriToPath returns the file path of a file URI, or the URI itself
+func uriToPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+	return filepath.FromSlash(u.Path)
+}
+
+// pathToURI returns the file URI of a path
+func pathToURI(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+// wordAt returns the token starting at a one-based line and byte column,
+// or a one-character token there if none does
+func (d *document) wordAt(line, column int) lexer.Token {
+	for _, tok := range d.tokens {
+		if tok.Line == line && tok.Column == column {
+			return tok
+		}
+	}
+	return lexer.Token{Type: lexer.ILLEGAL, Line: line, Column: column}
+}
@@ -0,0 +1,575 @@
+package lsp
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+)
+
+// keywords and builtins offered by completion
+var (
+	completionKeywords = []string{
+		"alloc", "bool", "break", "char", "cinclude", "comptime", "const", "continue", "defer", "delete",
+		"else", "enum", "extern", "false", "float", "for", "free", "function", "if", "import",
+		"int", "len", "link", "make", "map", "null", "public", "range", "return", "string",
+		"struct", "test", "true", "var", "void", "while",
+	}
+	completionBuiltins = map[string]string{
+		"print":         "function print(value)",
+		"args":          "function args() []string",
+		"getenv":        "function getenv(name string) string",
+		"exit":          "function exit(code int)",
+		"assert":        "function assert(cond bool)",
+		"assert_eq":     "function assert_eq(got, want)",
+		"static_assert": "function static_assert(cond bool, message string)",
+	}
+)
+
+// semanticTypes is the legend of semantic token types, in the order
+// their indices are sent
+var semanticTypes = []string{
+	"keyword", "type", "struct", "enum", "enumMember", "function", "method",
+	"parameter", "variable", "property", "string", "number", "comment",
+}
+
+const (
+	tokKeyword = iota
+	tokType
+	tokStruct
+	tokEnum
+	tokEnumMember
+	tokFunction
+	tokMethod
+	tokParameter
+	tokVariable
+	tokProperty
+	tokString
+	tokNumber
+	tokComment
+)
+
+// semanticModifiers is the legend of semantic token modifiers
+var semanticModifiers = []string{"declaration"}
+
+const modDeclaration = 1
+
+// target is what the identifier under the cursor refers to
+type target struct {
+	token lexer.Token // the identifier
+	decl  *decl
+}
+
+// resolve finds the declaration the identifier at a position refers to
+func (s *Server) resolve(d *document, pos Position) *target {
+	i := d.tokenAt(pos)
+	if i < 0 || d.tokens[i].Type != lexer.IDENT {
+		return nil
+	}
+	tok := d.tokens[i]
+	sc := s.scope(d)
+	e := &env{scope: sc, locals: localsAt(d.uri, d.program, sc, tok.Line, tok.Column)}
+
+	// A member access: work out the type of the operand before the dot
+	if i > 0 && d.tokens[i-1].Type == lexer.DOT {
+		object := d.operand(i - 2)
+		if object == nil {
+			return nil
+		}
+		if m := e.member(e.typeOf(object), tok.Literal); m != nil {
+			return &target{token: tok, decl: m}
+		}
+		return nil
+	}
+
+	// A field name in a struct literal
+	if i+1 < len(d.tokens) && d.tokens[i+1].Type == lexer.COLON {
+		if f := fieldInLiteral(d.program, sc, tok); f != nil {
+			return &target{token: tok, decl: f}
+		}
+	}
+
+	if decl := e.lookup(tok.Literal); decl != nil {
+		return &target{token: tok, decl: decl}
+	}
+	return nil
+}
+
+// fieldInLiteral returns the field a name in a struct literal sets
+func fieldInLiteral(program *ast.Program, sc *scope, tok lexer.Token) *decl {
+	if program == nil {
+		return nil
+	}
+	var found *decl
+	ast.Inspect(program, func(n ast.Node) bool {
+		lit, ok := n.(*ast.StructLiteral)
+		if !ok || found != nil {
+			return found == nil
+		}
+		for _, f := range lit.Fields {
+			if f.Name.Token.Line == tok.Line && f.Name.Token.Column == tok.Column {
+				found = sc.field(lit.Name.Value, f.Name.Value)
+			}
+		}
+		return true
+	})
+	return found
+}
+
+// operand parses the operand that ends at token end, or returns nil
+func (d *document) operand(end int) ast.Expression {
+	start := d.operandStart(end)
+	if start < 0 {
+		return nil
+	}
+	text := d.text[d.offset(d.tokens[start].Line, d.tokens[start].Column):d.tokenEnd(d.tokens[end])]
+	program, errors := parse(text + ";")
+	if len(errors) > 0 || program == nil || len(program.Statements) != 1 {
+		return nil
+	}
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok {
+		return nil
+	}
+	return stmt.Expression
+}
+
+// operandStart follows member accesses, calls and indexing backwards
+// from token end and returns the index of the operand's first token, or
+// -1
+func (d *document) operandStart(end int) int {
+	i := end
+	for i >= 0 {
+		switch d.tokens[i].Type {
+		case lexer.RBRACKET:
+			i = d.matching(i) - 1
+		case lexer.RPAREN:
+			open := d.matching(i)
+			if open <= 0 {
+				return open
+			}
+			// Parentheses after an operand are a call; otherwise they
+			// group an expression and start the operand
+			switch d.tokens[open-1].Type {
+			case lexer.IDENT, lexer.RPAREN, lexer.RBRACKET:
+				i = open - 1
+			default:
+				return open
+			}
+		case lexer.IDENT:
+			if i < 2 || d.tokens[i-1].Type != lexer.DOT {
+				return i
+			}
+			i -= 2
+		default:
+			return -1
+		}
+	}
+	return -1
+}
+
+// matching returns the index of the bracket that opens the one at close
+func (d *document) matching(close int) int {
+	depth := 0
+	for i := close; i >= 0; i-- {
+		switch d.tokens[i].Type {
+		case lexer.RPAREN, lexer.RBRACKET:
+			depth++
+		case lexer.LPAREN, lexer.LBRACKET:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// definition returns the location of the declaration under the cursor
+func (s *Server) definition(d *document, pos Position) *Location {
+	t := s.resolve(d, pos)
+	if t == nil {
+		return nil
+	}
+	target := s.lookupDocument(t.decl.uri)
+	if target == nil {
+		return nil
+	}
+	return &Location{URI: t.decl.uri, Range: target.tokenRange(t.decl.name)}
+}
+
+// hover describes the declaration under the cursor
+func (s *Server) hover(d *document, pos Position) *Hover {
+	t := s.resolve(d, pos)
+	if t == nil {
+		return nil
+	}
+	r := d.tokenRange(t.token)
+	value := "```h\n" + t.decl.detail + "\n```"
+	if t.decl.doc != "" {
+		value += "\n\n" + t.decl.doc
+	}
+	return &Hover{
+		Contents: markupContent{Kind: "markdown", Value: value},
+		Range:    &r,
+	}
+}
+
+// completion lists the names that can be written at the cursor: the
+// members of a value after a dot, and everything in scope otherwise
+func (s *Server) completion(d *document, pos Position) []CompletionItem {
+	items := []CompletionItem{}
+	sc := s.scope(d)
+	line, column := d.tokenPosition(pos)
+	e := &env{scope: sc, locals: localsAt(d.uri, d.program, sc, line, column)}
+
+	// The token before the cursor is the dot, or a partial name after it
+	i := d.tokenBefore(pos)
+	if i >= 0 && d.tokens[i].Type == lexer.IDENT && i > 0 && d.tokens[i-1].Type == lexer.DOT {
+		i--
+	}
+	if i >= 1 && d.tokens[i].Type == lexer.DOT {
+		structName := structOf(e.typeOf(d.operand(i - 1)))
+		if st := sc.structs[structName]; st != nil {
+			for _, f := range st.node.(*ast.StructStatement).Fields {
+				items = append(items, CompletionItem{Label: f.Name.Value, Kind: CompletionField, Detail: f.Type.String()})
+			}
+		}
+		for name, m := range sc.methods[structName] {
+			items = append(items, CompletionItem{Label: name, Kind: CompletionMethod, Detail: m.detail})
+		}
+		return sortItems(items)
+	}
+
+	for name, l := range e.locals {
+		items = append(items, CompletionItem{Label: name, Kind: CompletionVariable, Detail: l.detail})
+	}
+	for name, g := range sc.globals {
+		if _, shadowed := e.locals[name]; shadowed {
+			continue
+		}
+		kind := CompletionVariable
+		if g.kind == SymbolConstant {
+			kind = CompletionConstant
+		}
+		items = append(items, CompletionItem{Label: name, Kind: kind, Detail: g.detail})
+	}
+	for name, f := range sc.functions {
+		items = append(items, CompletionItem{Label: name, Kind: CompletionFunction, Detail: f.detail})
+	}
+	for name := range sc.structs {
+		items = append(items, CompletionItem{Label: name, Kind: CompletionStruct, Detail: "struct " + name})
+	}
+	for name, en := range sc.enums {
+		items = append(items, CompletionItem{Label: name, Kind: CompletionEnum, Detail: en.detail})
+	}
+	for name, v := range sc.values {
+		items = append(items, CompletionItem{Label: name, Kind: CompletionEnumMember, Detail: v.detail})
+	}
+	for name, detail := range completionBuiltins {
+		if _, declared := sc.functions[name]; !declared {
+			items = append(items, CompletionItem{Label: name, Kind: CompletionFunction, Detail: detail})
+		}
+	}
+	for _, kw := range completionKeywords {
+		items = append(items, CompletionItem{Label: kw, Kind: CompletionKeyword})
+	}
+	return sortItems(items)
+}
+
+func sortItems(items []CompletionItem) []CompletionItem {
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Label != items[j].Label {
+			return items[i].Label < items[j].Label
+		}
+		return items[i].Kind < items[j].Kind
+	})
+	return items
+}
+
+// symbols returns the outline of a document
+func (s *Server) symbols(d *document) []DocumentSymbol {
+	symbols := []DocumentSymbol{}
+	if d.program == nil {
+		return symbols
+	}
+	for _, stmt := range d.program.Statements {
+		switch st := stmt.(type) {
+		case *ast.FunctionStatement:
+			end := st.Name.Token // extern functions end at their signature
+			if st.Body != nil {
+				end = st.Body.Rbrace
+			}
+			sym := DocumentSymbol{
+				Name:           st.Name.Value,
+				Detail:         functionSignature(st),
+				Kind:           SymbolFunction,
+				Range:          d.span(st.Token, end),
+				SelectionRange: d.tokenRange(st.Name.Token),
+			}
+			if st.Receiver != nil {
+				sym.Name = "(" + st.Receiver.Type.String() + ")." + st.Name.Value
+				sym.Kind = SymbolMethod
+			}
+			symbols = append(symbols, sym)
+		case *ast.TestStatement:
+			symbols = append(symbols, DocumentSymbol{
+				Name:           "test \"" + st.Name + "\"",
+				Kind:           SymbolFunction,
+				Range:          d.span(st.Token, st.Body.Rbrace),
+				SelectionRange: d.tokenRange(st.Token),
+			})
+		case *ast.StructStatement:
+			sym := DocumentSymbol{
+				Name:           st.Name.Value,
+				Kind:           SymbolStruct,
+				Range:          d.span(st.Token, st.Rbrace),
+				SelectionRange: d.tokenRange(st.Name.Token),
+			}
+			for _, f := range st.Fields {
+				sym.Children = append(sym.Children, DocumentSymbol{
+					Name:           f.Name.Value,
+					Detail:         f.Type.String(),
+					Kind:           SymbolField,
+					Range:          d.tokenRange(f.Name.Token),
+					SelectionRange: d.tokenRange(f.Name.Token),
+				})
+			}
+			symbols = append(symbols, sym)
+		case *ast.EnumStatement:
+			sym := DocumentSymbol{
+				Name:           st.Name.Value,
+				Kind:           SymbolEnum,
+				Range:          d.span(st.Token, st.Rbrace),
+				SelectionRange: d.tokenRange(st.Name.Token),
+			}
+			for _, v := range st.Values {
+				sym.Children = append(sym.Children, DocumentSymbol{
+					Name:           v.Name.Value,
+					Kind:           SymbolEnumMember,
+					Range:          d.tokenRange(v.Name.Token),
+					SelectionRange: d.tokenRange(v.Name.Token),
+				})
+			}
+			symbols = append(symbols, sym)
+		case *ast.VarStatement:
+			symbols = append(symbols, d.globalSymbol(st.Name, st.Type, SymbolVariable))
+		case *ast.ConstStatement:
+			symbols = append(symbols, d.globalSymbol(st.Name, st.Type, SymbolConstant))
+		}
+	}
+	return symbols
+}
+
+func (d *document) globalSymbol(name *ast.Identifier, t *ast.TypeAnnotation, kind int) DocumentSymbol {
+	sym := DocumentSymbol{
+		Name:           name.Value,
+		Kind:           kind,
+		Range:          d.tokenRange(name.Token),
+		SelectionRange: d.tokenRange(name.Token),
+	}
+	if t != nil {
+		sym.Detail = t.String()
+	}
+	return sym
+}
+
+// span returns the range from the start of one token to the end of
+// another
+func (d *document) span(from, to lexer.Token) Range {
+	return Range{Start: d.tokenRange(from).Start, End: d.tokenRange(to).End}
+}
+
+// semanticTokens classifies every token of a document, encoded as the
+// protocol's relative five-integer groups
+func (s *Server) semanticTokens(d *document) []int {
+	sc := s.scope(d)
+	known := declaredTokens(d.program)
+
+	data := []int{}
+	prevLine, prevChar := 0, 0
+	emit := func(start, end, class, mods int) {
+		// Tokens cannot span lines, so a block comment is sent line by
+		// line
+		for start < end {
+			p := d.position(start)
+			lineEnd := len(d.text)
+			if p.Line+1 < len(d.lines) {
+				lineEnd = d.lines[p.Line+1] - 1
+			}
+			stop := min(end, lineEnd)
+			if stop > start && d.text[stop-1] == '\r' {
+				stop--
+			}
+			length := len(utf16.Encode([]rune(d.text[start:stop])))
+			if length > 0 {
+				deltaChar := p.Character
+				if p.Line == prevLine {
+					deltaChar -= prevChar
+				}
+				data = append(data, p.Line-prevLine, deltaChar, length, class, mods)
+				prevLine, prevChar = p.Line, p.Character
+			}
+			start = lineEnd + 1
+			for start < end && (d.text[start] == ' ' || d.text[start] == '\t') {
+				start++
+			}
+		}
+	}
+
+	for i, tok := range d.tokens {
+		class, mods := -1, 0
+		switch {
+		case tok.Type == lexer.COMMENT:
+			class = tokComment
+		case tok.Type == lexer.STRING || tok.Type == lexer.CHAR:
+			class = tokString
+		case tok.Type == lexer.INT || tok.Type == lexer.FLOAT:
+			class = tokNumber
+		case tok.Type >= lexer.TYPE_INT:
+			class = tokType
+		case tok.Type >= lexer.FUNCTION:
+			class = tokKeyword
+		case tok.Type == lexer.IDENT:
+			class, mods = d.classify(i, sc, known)
+		}
+		if class >= 0 {
+			emit(d.offset(tok.Line, tok.Column), d.tokenEnd(tok), class, mods)
+		}
+	}
+	return data
+}
+
+// classification is the semantic class of a name token
+type classification struct {
+	class, mods int
+}
+
+// declaredTokens classifies the names of a program's declarations and the
+// uses of function parameters, keyed by line and column
+func declaredTokens(program *ast.Program) map[[2]int]classification {
+	known := map[[2]int]classification{}
+	if program == nil {
+		return known
+	}
+	key := func(tok lexer.Token) [2]int { return [2]int{tok.Line, tok.Column} }
+	declare := func(tok lexer.Token, class int) {
+		known[key(tok)] = classification{class, modDeclaration}
+	}
+
+	for _, stmt := range program.Statements {
+		switch st := stmt.(type) {
+		case *ast.FunctionStatement:
+			params := map[string]bool{}
+			all := st.Parameters
+			if st.Receiver != nil {
+				all = append([]*ast.Parameter{st.Receiver}, all...)
+				declare(st.Name.Token, tokMethod)
+			} else {
+				declare(st.Name.Token, tokFunction)
+			}
+			for _, p := range all {
+				declare(p.Name.Token, tokParameter)
+				params[p.Name.Value] = true
+			}
+			if st.Body == nil {
+				continue
+			}
+			// Members and struct literal fields are not the parameters
+			// they share a name with
+			fields := map[*ast.Identifier]bool{}
+			ast.Inspect(st.Body, func(n ast.Node) bool {
+				switch x := n.(type) {
+				case *ast.MemberExpression:
+					fields[x.Member] = true
+				case *ast.StructLiteralField:
+					fields[x.Name] = true
+				case *ast.Identifier:
+					if params[x.Value] && !fields[x] {
+						known[key(x.Token)] = classification{tokParameter, 0}
+					}
+				}
+				return true
+			})
+			declareLocals(st.Body, declare)
+		case *ast.TestStatement:
+			declareLocals(st.Body, declare)
+		case *ast.StructStatement:
+			declare(st.Name.Token, tokStruct)
+			for _, f := range st.Fields {
+				declare(f.Name.Token, tokProperty)
+			}
+		case *ast.EnumStatement:
+			declare(st.Name.Token, tokEnum)
+			for _, v := range st.Values {
+				declare(v.Name.Token, tokEnumMember)
+			}
+		case *ast.VarStatement:
+			declare(st.Name.Token, tokVariable)
+		case *ast.ConstStatement:
+			declare(st.Name.Token, tokVariable)
+		}
+	}
+	return known
+}
+
+// declareLocals marks the variables declared in a function body
+func declareLocals(body *ast.BlockStatement, declare func(lexer.Token, int)) {
+	ast.Inspect(body, func(n ast.Node) bool {
+		switch x := n.(type) {
+		case *ast.VarStatement:
+			declare(x.Name.Token, tokVariable)
+		case *ast.ConstStatement:
+			declare(x.Name.Token, tokVariable)
+		case *ast.InferStatement:
+			declare(x.Name.Token, tokVariable)
+		case *ast.ForRangeStatement:
+			for _, id := range []*ast.Identifier{x.Index, x.Value} {
+				if id != nil && id.Value != "_" {
+					declare(id.Token, tokVariable)
+				}
+			}
+		}
+		return true
+	})
+}
+
+// classify returns the semantic class of the identifier at token i. The
+// declarations of the last program that parsed come first; names the
+// program does not know are classified by what they look like.
+func (d *document) classify(i int, sc *scope, known map[[2]int]classification) (int, int) {
+	tok := d.tokens[i]
+	if c, ok := known[[2]int{tok.Line, tok.Column}]; ok && strings.HasPrefix(d.text[d.offset(tok.Line, tok.Column):], tok.Literal) {
+		return c.class, c.mods
+	}
+
+	next := lexer.ILLEGAL
+	if i+1 < len(d.tokens) {
+		next = d.tokens[i+1].Type
+	}
+	if i > 0 && d.tokens[i-1].Type == lexer.DOT {
+		if next == lexer.LPAREN {
+			return tokMethod, 0
+		}
+		return tokProperty, 0
+	}
+	// test "name" { ... } at the top level
+	if tok.Literal == "test" && next == lexer.STRING && tok.Column == 1 {
+		return tokKeyword, 0
+	}
+	switch {
+	case sc.structs[tok.Literal] != nil:
+		return tokStruct, 0
+	case sc.enums[tok.Literal] != nil:
+		return tokEnum, 0
+	case sc.values[tok.Literal] != nil:
+		return tokEnumMember, 0
+	case next == lexer.LPAREN:
+		return tokFunction, 0
+	case next == lexer.COLON:
+		return tokProperty, 0
+	}
+	return tokVariable, 0
+}
@@ -0,0 +1,544 @@
+package lsp
+
+import (
+	"strings"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+)
+
+// decl is a declaration the server can jump to, describe and complete
+type decl struct {
+	uri    string
+	name   lexer.Token // the declared name
+	kind   int         // a Symbol kind
+	detail string      // the declaration as source, for hover
+	doc    string      // the doc comment, for hover
+	typ    *ast.TypeAnnotation
+	node   ast.Node // the declaring statement, if any
+}
+
+// scope holds the module-level declarations visible in a document: its
+// own and the public ones of everything it imports
+type scope struct {
+	functions map[string]*decl
+	methods   map[string]map[string]*decl // by receiver type name
+	structs   map[string]*decl
+	enums     map[string]*decl
+	values    map[string]*decl // enum values, as Enum_Value
+	globals   map[string]*decl
+}
+
+func newScope() *scope {
+	return &scope{
+		functions: map[string]*decl{},
+		methods:   map[string]map[string]*decl{},
+		structs:   map[string]*decl{},
+		enums:     map[string]*decl{},
+		values:    map[string]*decl{},
+		globals:   map[string]*decl{},
+	}
+}
+
+// add records the declarations of a module, only the public ones if it
+// is imported
+func (s *scope) add(uri string, program *ast.Program, imported bool) {
+	for _, stmt := range program.Statements {
+		switch st := stmt.(type) {
+		case *ast.FunctionStatement:
+			if imported && !st.Public {
+				continue
+			}
+			d := &decl{uri: uri, name: st.Name.Token, kind: SymbolFunction,
+				detail: functionSignature(st), doc: st.Doc, typ: st.ReturnType, node: st}
+			if st.Receiver == nil {
+				s.functions[st.Name.Value] = d
+				continue
+			}
+			d.kind = SymbolMethod
+			recv := receiverName(st)
+			if s.methods[recv] == nil {
+				s.methods[recv] = map[string]*decl{}
+			}
+			s.methods[recv][st.Name.Value] = d
+		case *ast.StructStatement:
+			if imported && !st.Public {
+				continue
+			}
+			s.structs[st.Name.Value] = &decl{uri: uri, name: st.Name.Token, kind: SymbolStruct,
+				detail: structSignature(st), doc: st.Doc, node: st}
+		case *ast.EnumStatement:
+			if imported && !st.Public {
+				continue
+			}
+			s.enums[st.Name.Value] = &decl{uri: uri, name: st.Name.Token, kind: SymbolEnum,
+				detail: enumSignature(st), doc: st.Doc, node: st}
+			for _, v := range st.Values {
+				name := st.Name.Value + "_" + v.Name.Value
+				s.values[name] = &decl{uri: uri, name: v.Name.Token, kind: SymbolEnumMember,
+					detail: name + " " + st.Name.Value, doc: v.Doc, typ: namedType(st.Name.Value), node: st}
+			}
+		case *ast.VarStatement:
+			if imported && !st.Public {
+				continue
+			}
+			s.globals[st.Name.Value] = variable(uri, st, st.Name, st.Type, st.Value, s, nil)
+		case *ast.ConstStatement:
+			if imported && !st.Public {
+				continue
+			}
+			s.globals[st.Name.Value] = variable(uri, st, st.Name, st.Type, st.Value, s, nil)
+		}
+	}
+}
+
+// field returns the declaration of a field of a struct
+func (s *scope) field(structName, name string) *decl {
+	d := s.structs[structName]
+	if d == nil {
+		return nil
+	}
+	for _, f := range d.node.(*ast.StructStatement).Fields {
+		if f.Name.Value == name {
+			return fieldDecl(d.uri, f)
+		}
+	}
+	return nil
+}
+
+func fieldDecl(uri string, f *ast.StructField) *decl {
+	return &decl{uri: uri, name: f.Name.Token, kind: SymbolField,
+		detail: "field " + f.Name.Value + " " + f.Type.String(), doc: f.Doc, typ: f.Type}
+}
+
+// variable makes the declaration of a variable or constant, inferring its
+// type from the value when it has none
+func variable(uri string, node ast.Node, name *ast.Identifier, typ *ast.TypeAnnotation, value ast.Expression, s *scope, locals map[string]*decl) *decl {
+	if typ == nil && value != nil {
+		typ = (&env{scope: s, locals: locals}).typeOf(value)
+	}
+	detail := "var " + name.Value
+	kind := SymbolVariable
+	if _, ok := node.(*ast.ConstStatement); ok {
+		detail = "const " + name.Value
+		kind = SymbolConstant
+	}
+	if typ != nil {
+		detail += " " + typ.String()
+	}
+	return &decl{uri: uri, name: name.Token, kind: kind, detail: detail, typ: typ, node: node}
+}
+
+// receiverName returns the name of the type a method is declared on
+func receiverName(f *ast.FunctionStatement) string {
+	return f.Receiver.Type.Name
+}
+
+func namedType(name string) *ast.TypeAnnotation {
+	return &ast.TypeAnnotation{Name: name}
+}
+
+func functionSignature(f *ast.FunctionStatement) string {
+	var out strings.Builder
+	if f.Public {
+		out.WriteString("public ")
+	}
+	if f.Extern {
+		out.WriteString("extern ")
+	}
+	out.WriteString("function ")
+	if f.Receiver != nil {
+		out.WriteString("(" + f.Receiver.Name.Value + " " + f.Receiver.Type.String() + ") ")
+	}
+	out.WriteString(f.Name.Value + "(")
+	for i, p := range f.Parameters {
+		if i > 0 {
+			out.WriteString(", ")
+		}
+		out.WriteString(p.Name.Value + " " + p.Type.String())
+	}
+	if f.Variadic {
+		if len(f.Parameters) > 0 {
+			out.WriteString(", ")
+		}
+		out.WriteString("...")
+	}
+	out.WriteString(")")
+	if f.ReturnType != nil {
+		out.WriteString(" " + f.ReturnType.String())
+	}
+	return out.String()
+}
+
+func structSignature(s *ast.StructStatement) string {
+	var out strings.Builder
+	if s.Public {
+		out.WriteString("public ")
+	}
+	if s.Extern {
+		out.WriteString("extern ")
+	}
+	if s.Fields == nil {
+		out.WriteString("struct " + s.Name.Value)
+		return out.String()
+	}
+	out.WriteString("struct " + s.Name.Value + " {\n")
+	for _, f := range s.Fields {
+		out.WriteString("    ")
+		if f.Public {
+			out.WriteString("public ")
+		}
+		out.WriteString(f.Name.Value + " " + f.Type.String() + ";\n")
+	}
+	out.WriteString("}")
+	return out.String()
+}
+
+func enumSignature(e *ast.EnumStatement) string {
+	var values []string
+	for _, v := range e.Values {
+		if v.Value != nil {
+			values = append(values, v.Name.Value+" = "+v.Value.String())
+		} else {
+			values = append(values, v.Name.Value)
+		}
+	}
+	prefix := ""
+	if e.Public {
+		prefix = "public "
+	}
+	return prefix + "enum " + e.Name.Value + " { " + strings.Join(values, ", ") + " }"
+}
+
+// env resolves names and types at one point of a document
+type env struct {
+	scope  *scope
+	locals map[string]*decl
+}
+
+// lookup returns the declaration a name refers to
+func (e *env) lookup(name string) *decl {
+	if d, ok := e.locals[name]; ok {
+		return d
+	}
+	for _, m := range []map[string]*decl{e.scope.globals, e.scope.functions, e.scope.values, e.scope.structs, e.scope.enums} {
+		if d, ok := m[name]; ok {
+			return d
+		}
+	}
+	return nil
+}
+
+// member returns the field or method named by a member access on a value
+// of type t
+func (e *env) member(t *ast.TypeAnnotation, name string) *decl {
+	structName := structOf(t)
+	if structName == "" {
+		return nil
+	}
+	if d := e.scope.field(structName, name); d != nil {
+		return d
+	}
+	return e.scope.methods[structName][name]
+}
+
+// structOf returns the name of the struct a value of type t, or the
+// pointer t, has members of
+func structOf(t *ast.TypeAnnotation) string {
+	if t == nil {
+		return ""
+	}
+	if t.IsPtr {
+		t = t.Element()
+	}
+	if !t.IsNamed() {
+		return ""
+	}
+	return t.Name
+}
+
+// typeOf infers the type of an expression, or returns nil
+func (e *env) typeOf(expr ast.Expression) *ast.TypeAnnotation {
+	switch x := expr.(type) {
+	case *ast.IntegerLiteral:
+		return namedType("int")
+	case *ast.FloatLiteral:
+		return namedType("float")
+	case *ast.StringLiteral:
+		return namedType("string")
+	case *ast.CharLiteral:
+		return namedType("char")
+	case *ast.BooleanLiteral:
+		return namedType("bool")
+	case *ast.StructLiteral:
+		return namedType(x.Name.Value)
+	case *ast.ArrayLiteral:
+		return x.Type
+	case *ast.MapLiteral:
+		return x.Type
+	case *ast.MakeExpression:
+		return x.Type
+	case *ast.CastExpression:
+		return x.TargetType
+	case *ast.AllocExpression:
+		t := x.Type
+		if x.Init != nil {
+			t = namedType(x.Init.Name.Value)
+		}
+		if t == nil {
+			return nil
+		}
+		return &ast.TypeAnnotation{Name: t.Name, IsPtr: true, Elem: t}
+	case *ast.Identifier:
+		if d := e.lookup(x.Value); d != nil && d.kind != SymbolFunction {
+			return d.typ
+		}
+	case *ast.MemberExpression:
+		if d := e.member(e.typeOf(x.Object), x.Member.Value); d != nil && d.kind == SymbolField {
+			return d.typ
+		}
+	case *ast.IndexExpression:
+		t := e.typeOf(x.Left)
+		switch {
+		case t == nil:
+		case t.IsMap:
+			return t.ValueType
+		case t.ArrayLen == -1 || t.IsArray() || t.IsPtr:
+			return t.Element()
+		case t.Name == "string":
+			return namedType("char")
+		}
+	case *ast.CallExpression:
+		return e.callType(x)
+	case *ast.PrefixExpression:
+		t := e.typeOf(x.Right)
+		switch x.Operator {
+		case "!":
+			return namedType("bool")
+		case "&":
+			if t != nil {
+				return &ast.TypeAnnotation{Name: t.Name, IsPtr: true, Elem: t}
+			}
+		case "*":
+			if t != nil && t.IsPtr {
+				return t.Element()
+			}
+		default:
+			return t
+		}
+	case *ast.InfixExpression:
+		switch x.Operator {
+		case "==", "!=", "<", ">", "<=", ">=", "&&", "||":
+			return namedType("bool")
+		}
+		return e.typeOf(x.Left)
+	case *ast.PostfixExpression:
+		return e.typeOf(x.Left)
+	case *ast.AssignExpression:
+		return e.typeOf(x.Left)
+	}
+	return nil
+}
+
+// callType returns the result type of a call
+func (e *env) callType(call *ast.CallExpression) *ast.TypeAnnotation {
+	switch fn := call.Function.(type) {
+	case *ast.Identifier:
+		d := e.lookup(fn.Value)
+		if d == nil {
+			switch fn.Value {
+			case "len":
+				return namedType("int")
+			case "args":
+				return &ast.TypeAnnotation{Name: "string", ArrayLen: -1, Elem: namedType("string")}
+			case "getenv":
+				return namedType("string")
+			}
+			return nil
+		}
+		if d.kind == SymbolFunction {
+			return d.typ
+		}
+		if d.typ != nil && d.typ.IsFunc {
+			return d.typ.ReturnType
+		}
+	case *ast.MemberExpression:
+		if d := e.member(e.typeOf(fn.Object), fn.Member.Value); d != nil {
+			if d.kind == SymbolMethod {
+				return d.typ
+			}
+			if d.typ != nil && d.typ.IsFunc {
+				return d.typ.ReturnType
+			}
+		}
+	}
+	return nil
+}
+
+// before reports whether a token starts at or before a line and column
+func before(tok lexer.Token, line, column int) bool {
+	return tok.Line < line || tok.Line == line && tok.Column <= column
+}
+
+// inBlock reports whether a line and column fall inside a block's braces
+func inBlock(b *ast.BlockStatement, line, column int) bool {
+	return b != nil && before(b.Token, line, column) && before(lexer.Token{Line: line, Column: column}, b.Rbrace.Line, b.Rbrace.Column)
+}
+
+// enclosing returns the function or test body containing a line and
+// column, with the function if it is one
+func enclosing(program *ast.Program, line, column int) (*ast.FunctionStatement, *ast.BlockStatement) {
+	if program == nil {
+		return nil, nil
+	}
+	for _, stmt := range program.Statements {
+		switch st := stmt.(type) {
+		case *ast.FunctionStatement:
+			// Extern functions have no body
+			if st.Body == nil {
+				continue
+			}
+			if inBlock(st.Body, line, column) || before(st.Token, line, column) && before(lexer.Token{Line: line, Column: column}, st.Body.Token.Line, st.Body.Token.Column) {
+				return st, st.Body
+			}
+		case *ast.TestStatement:
+			if inBlock(st.Body, line, column) {
+				return nil, st.Body
+			}
+		}
+	}
+	return nil, nil
+}
+
+// localsAt returns the local variables visible at a line and column of a
+// document: parameters and the declarations of every enclosing block
+// that precede it
+func localsAt(uri string, program *ast.Program, s *scope, line, column int) map[string]*decl {
+	locals := map[string]*decl{}
+	fn, body := enclosing(program, line, column)
+	if fn != nil {
+		params := fn.Parameters
+		if fn.Receiver != nil {
+			params = append([]*ast.Parameter{fn.Receiver}, params...)
+		}
+		for _, p := range params {
+			locals[p.Name.Value] = &decl{uri: uri, name: p.Name.Token, kind: SymbolVariable,
+				detail: "var " + p.Name.Value + " " + p.Type.String(), typ: p.Type}
+		}
+	}
+	if body != nil {
+		collectLocals(uri, body, s, locals, line, column)
+	}
+	return locals
+}
+
+func collectLocals(uri string, b *ast.BlockStatement, s *scope, locals map[string]*decl, line, column int) {
+	for _, stmt := range b.Statements {
+		if !before(statementToken(stmt), line, column) {
+			return
+		}
+		declare(uri, stmt, s, locals)
+
+		switch st := stmt.(type) {
+		case *ast.BlockStatement:
+			if inBlock(st, line, column) {
+				collectLocals(uri, st, s, locals, line, column)
+			}
+		case *ast.IfStatement:
+			for _, inner := range []*ast.BlockStatement{st.Consequence, st.Alternative} {
+				if inBlock(inner, line, column) {
+					collectLocals(uri, inner, s, locals, line, column)
+				}
+			}
+		case *ast.WhileStatement:
+			if inBlock(st.Body, line, column) {
+				collectLocals(uri, st.Body, s, locals, line, column)
+			}
+		case *ast.ForStatement:
+			if inBlock(st.Body, line, column) {
+				if st.Init != nil {
+					declare(uri, st.Init, s, locals)
+				}
+				collectLocals(uri, st.Body, s, locals, line, column)
+			}
+		case *ast.ForRangeStatement:
+			if inBlock(st.Body, line, column) {
+				declareRange(uri, st, s, locals)
+				collectLocals(uri, st.Body, s, locals, line, column)
+			}
+		}
+	}
+}
+
+// declare records the variable a statement declares, if any
+func declare(uri string, stmt ast.Statement, s *scope, locals map[string]*decl) {
+	switch st := stmt.(type) {
+	case *ast.VarStatement:
+		locals[st.Name.Value] = variable(uri, st, st.Name, st.Type, st.Value, s, locals)
+	case *ast.ConstStatement:
+		locals[st.Name.Value] = variable(uri, st, st.Name, st.Type, st.Value, s, locals)
+	case *ast.InferStatement:
+		locals[st.Name.Value] = variable(uri, st, st.Name, nil, st.Value, s, locals)
+	}
+}
+
+// declareRange records the index and value variables of a range loop
+func declareRange(uri string, st *ast.ForRangeStatement, s *scope, locals map[string]*decl) {
+	t := (&env{scope: s, locals: locals}).typeOf(st.Iterable)
+	var index, value *ast.TypeAnnotation
+	switch {
+	case t == nil:
+	case t.IsMap:
+		index, value = t.KeyType, t.ValueType
+	case t.ArrayLen == -1 || t.IsArray():
+		index, value = namedType("int"), t.Element()
+	case t.Name == "string":
+		index, value = namedType("int"), namedType("char")
+	}
+	for _, v := range []struct {
+		name *ast.Identifier
+		typ  *ast.TypeAnnotation
+	}{{st.Index, index}, {st.Value, value}} {
+		if v.name == nil || v.name.Value == "_" {
+			continue
+		}
+		locals[v.name.Value] = variable(uri, st, v.name, v.typ, nil, s, locals)
+	}
+}
+
+// statementToken returns the token a statement starts at
+func statementToken(stmt ast.Statement) lexer.Token {
+	switch st := stmt.(type) {
+	case *ast.VarStatement:
+		return st.Token
+	case *ast.ConstStatement:
+		return st.Token
+	case *ast.InferStatement:
+		return st.Token
+	case *ast.ReturnStatement:
+		return st.Token
+	case *ast.ExpressionStatement:
+		return st.Token
+	case *ast.BlockStatement:
+		return st.Token
+	case *ast.IfStatement:
+		return st.Token
+	case *ast.ForStatement:
+		return st.Token
+	case *ast.ForRangeStatement:
+		return st.Token
+	case *ast.WhileStatement:
+		return st.Token
+	case *ast.FreeStatement:
+		return st.Token
+	case *ast.DeferStatement:
+		return st.Token
+	case *ast.DeleteStatement:
+		return st.Token
+	case *ast.BreakStatement:
+		return st.Token
+	case *ast.ContinueStatement:
+		return st.Token
+	}
+	return lexer.Token{}
+}
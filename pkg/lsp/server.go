@@ -0,0 +1,374 @@
+// Package lsp implements a Language Server Protocol server for H-lang.
+// It speaks JSON-RPC over a pair of streams, normally the standard input
+// and output of "hlc lsp", and answers from the lexer, parser, code
+// generator and memory checker.
+package lsp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+	"github.com/Dr-H-PhD/h-lang/pkg/codegen"
+	"github.com/Dr-H-PhD/h-lang/pkg/manifest"
+	"github.com/Dr-H-PhD/h-lang/pkg/memcheck"
+	"github.com/Dr-H-PhD/h-lang/pkg/version"
+)
+
+// Server is a language server for one client
+type Server struct {
+	conn        *conn
+	docs        map[string]*document // open documents by URI
+	initialized bool
+	shutdown    bool
+}
+
+// Run serves the client on in and out until it sends exit or closes the
+// stream
+func Run(in io.Reader, out io.Writer) error {
+	s := &Server{conn: newConn(in, out), docs: map[string]*document{}}
+	for {
+		body, err := s.conn.read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var req request
+		if err := json.Unmarshal(body, &req); err != nil {
+			if err := s.conn.replyError(nil, codeParseError, err.Error()); err != nil {
+				return err
+			}
+			continue
+		}
+		if req.Method == "exit" {
+			return nil
+		}
+		if err := s.handle(&req); err != nil {
+			return err
+		}
+	}
+}
+
+// handle answers one request or acts on one notification
+func (s *Server) handle(req *request) error {
+	if !s.initialized && req.Method != "initialize" {
+		if req.ID == nil {
+			return nil
+		}
+		return s.conn.replyError(req.ID, codeNotInitialized, "server not initialized")
+	}
+	if s.shutdown && req.ID != nil {
+		return s.conn.replyError(req.ID, codeInvalidRequest, "server is shutting down")
+	}
+
+	switch req.Method {
+	case "initialize":
+		s.initialized = true
+		return s.conn.reply(req.ID, map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":       1, // the full text on every change
+				"definitionProvider":     true,
+				"hoverProvider":          true,
+				"completionProvider":     map[string]interface{}{"triggerCharacters": []string{"."}},
+				"documentSymbolProvider": true,
+				"semanticTokensProvider": map[string]interface{}{
+					"legend": map[string]interface{}{
+						"tokenTypes":     semanticTypes,
+						"tokenModifiers": semanticModifiers,
+					},
+					"full": true,
+				},
+			},
+			"serverInfo": map[string]string{"name": "hlc", "version": version.String()},
+		})
+	case "initialized":
+		return nil
+	case "shutdown":
+		s.shutdown = true
+		return s.conn.reply(req.ID, nil)
+
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil
+		}
+		s.docs[params.TextDocument.URI] = newDocument(params.TextDocument.URI, params.TextDocument.Text)
+		return s.publishAll()
+	case "textDocument/didChange":
+		var params didChangeParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil
+		}
+		d := s.docs[params.TextDocument.URI]
+		if d == nil || len(params.ContentChanges) == 0 {
+			return nil
+		}
+		d.update(params.ContentChanges[len(params.ContentChanges)-1].Text)
+		return s.publishAll()
+	case "textDocument/didClose":
+		var params didCloseParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil
+		}
+		delete(s.docs, params.TextDocument.URI)
+		if err := s.conn.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{
+			URI:         params.TextDocument.URI,
+			Diagnostics: []Diagnostic{},
+		}); err != nil {
+			return err
+		}
+		return s.publishAll()
+
+	case "textDocument/definition", "textDocument/hover", "textDocument/completion":
+		var params textDocumentPositionParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return s.conn.replyError(req.ID, codeInvalidParams, err.Error())
+		}
+		d := s.docs[params.TextDocument.URI]
+		if d == nil {
+			return s.conn.replyError(req.ID, codeInvalidParams, "document is not open: "+params.TextDocument.URI)
+		}
+		switch req.Method {
+		case "textDocument/definition":
+			return s.conn.reply(req.ID, s.definition(d, params.Position))
+		case "textDocument/hover":
+			return s.conn.reply(req.ID, s.hover(d, params.Position))
+		}
+		return s.conn.reply(req.ID, s.completion(d, params.Position))
+
+	case "textDocument/documentSymbol", "textDocument/semanticTokens/full":
+		var params documentParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return s.conn.replyError(req.ID, codeInvalidParams, err.Error())
+		}
+		d := s.docs[params.TextDocument.URI]
+		if d == nil {
+			return s.conn.replyError(req.ID, codeInvalidParams, "document is not open: "+params.TextDocument.URI)
+		}
+		if req.Method == "textDocument/documentSymbol" {
+			return s.conn.reply(req.ID, s.symbols(d))
+		}
+		return s.conn.reply(req.ID, semanticTokens{Data: s.semanticTokens(d)})
+	}
+
+	// Notifications the server does not know are ignored
+	if req.ID == nil {
+		return nil
+	}
+	return s.conn.replyError(req.ID, codeMethodNotFound, "method not supported: "+req.Method)
+}
+
+// publishAll sends the diagnostics of every open document. Documents are
+// re-checked together because a change to one may break those importing
+// it.
+func (s *Server) publishAll() error {
+	uris := make([]string, 0, len(s.docs))
+	for uri := range s.docs {
+		uris = append(uris, uri)
+	}
+	sort.Strings(uris)
+	for _, uri := range uris {
+		if err := s.conn.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{
+			URI:         uri,
+			Diagnostics: s.diagnostics(s.docs[uri]),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errorLine matches the "line N: " prefix of parser and code generator
+// errors
+var errorLine = regexp.MustCompile(`^line (\d+): `)
+
+// diagnostics parses and checks a document as the compiler would: parse
+// errors, then code generation errors and memory warnings
+func (s *Server) diagnostics(d *document) []Diagnostic {
+	diags := []Diagnostic{}
+	lineError := func(msg string) {
+		line := 1
+		if m := errorLine.FindStringSubmatch(msg); m != nil {
+			line, _ = strconv.Atoi(m[1])
+			msg = msg[len(m[0]):]
+		}
+		diags = append(diags, Diagnostic{Range: d.lineRange(line), Severity: SeverityError, Source: "hlc", Message: msg})
+	}
+
+	if len(d.errors) > 0 {
+		for _, msg := range d.errors {
+			lineError(msg)
+		}
+		return diags
+	}
+
+	for _, msg := range s.generate(d, false) {
+		lineError(msg)
+	}
+	if hasTests(d.program) {
+		for _, msg := range s.generate(d, true) {
+			lineError(msg)
+		}
+	}
+
+	if m := s.manifest(d.path); m == nil || !m.Build.GC {
+		for _, w := range memcheck.Check(d.program) {
+			tok := d.wordAt(w.Line, w.Column)
+			diags = append(diags, Diagnostic{
+				Range:    d.tokenRange(tok),
+				Severity: SeverityWarning,
+				Source:   "hlc",
+				Message:  fmt.Sprintf("%s (in %s)", w.Message, w.Function),
+			})
+		}
+	}
+	return dedupe(diags)
+}
+
+// generate runs the code generator over a document and returns its
+// errors. Test blocks are only checked in test mode.
+func (s *Server) generate(d *document, tests bool) (errors []string) {
+	defer func() {
+		if r := recover(); r != nil {
+			errors = append(errors, fmt.Sprintf("internal compiler error: %v", r))
+		}
+	}()
+	g := codegen.New()
+	g.SetTestMode(tests)
+	g.SetSourceName(d.path)
+	g.SetImportResolver(s.importResolver(), filepath.Dir(d.path))
+	g.Generate(d.program)
+	return g.Errors()
+}
+
+func hasTests(program *ast.Program) bool {
+	for _, stmt := range program.Statements {
+		if _, ok := stmt.(*ast.TestStatement); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// dedupe drops repeated diagnostics, which checking in both modes
+// produces
+func dedupe(diags []Diagnostic) []Diagnostic {
+	seen := map[Diagnostic]bool{}
+	out := diags[:0]
+	for _, d := range diags {
+		if !seen[d] {
+			seen[d] = true
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// importResolver resolves imports like the compiler, preferring the text
+// of open documents to the files on disk
+func (s *Server) importResolver() codegen.ImportResolver {
+	return func(importPath, basePath string) (*ast.Program, error) {
+		path := s.findImport(importPath, basePath)
+		d := s.lookupDocument(pathToURI(path))
+		if d == nil {
+			return nil, fmt.Errorf("cannot import %q: no such file", importPath)
+		}
+		if len(d.errors) > 0 {
+			return nil, fmt.Errorf("errors in imported file %q: %v", importPath, d.errors)
+		}
+		return d.program, nil
+	}
+}
+
+// findImport returns the path of an imported file: next to the importing
+// file, or under the import roots of its project
+func (s *Server) findImport(importPath, basePath string) string {
+	path := filepath.Join(basePath, importPath)
+	if filepath.IsAbs(importPath) || s.exists(path) {
+		return path
+	}
+	if m := s.manifest(filepath.Join(basePath, "x.hl")); m != nil {
+		for _, root := range m.ImportRoots() {
+			if candidate := filepath.Join(root, importPath); s.exists(candidate) {
+				return candidate
+			}
+		}
+	}
+	return path
+}
+
+// exists reports whether a file is open or on disk
+func (s *Server) exists(path string) bool {
+	if _, ok := s.docs[pathToURI(path)]; ok {
+		return true
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// manifest returns the manifest of the project a file belongs to, or nil
+func (s *Server) manifest(path string) *manifest.Manifest {
+	found, err := manifest.Find(filepath.Dir(path))
+	if err != nil {
+		return nil
+	}
+	m, err := manifest.Load(found)
+	if err != nil {
+		return nil
+	}
+	return m
+}
+
+// lookupDocument returns an open document, or reads a closed one from
+// disk
+func (s *Server) lookupDocument(uri string) *document {
+	if d, ok := s.docs[uri]; ok {
+		return d
+	}
+	text, err := os.ReadFile(uriToPath(uri))
+	if err != nil {
+		return nil
+	}
+	return newDocument(uri, string(text))
+}
+
+// scope collects the declarations visible in a document, following its
+// imports as the compiler does
+func (s *Server) scope(d *document) *scope {
+	sc := newScope()
+	if d.program == nil {
+		return sc
+	}
+	seen := map[string]bool{d.uri: true}
+	var follow func(program *ast.Program, dir string)
+	follow = func(program *ast.Program, dir string) {
+		for _, stmt := range program.Statements {
+			imp, ok := stmt.(*ast.ImportStatement)
+			if !ok {
+				continue
+			}
+			path := s.findImport(imp.Path, dir)
+			uri := pathToURI(path)
+			if seen[uri] {
+				continue
+			}
+			seen[uri] = true
+			if imported := s.lookupDocument(uri); imported != nil && imported.program != nil {
+				follow(imported.program, filepath.Dir(path))
+				sc.add(uri, imported.program, true)
+			}
+		}
+	}
+	follow(d.program, filepath.Dir(d.path))
+	sc.add(d.uri, d.program, false)
+	return sc
+}
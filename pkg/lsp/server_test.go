@@ -0,0 +1,461 @@
+package lsp
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// client drives a server over pipes. Messages from the server are read
+// by a goroutine so that the server never blocks on its notifications.
+type client struct {
+	t           *testing.T
+	conn        *conn
+	id          int
+	messages    chan map[string]json.RawMessage
+	diagnostics map[string][]Diagnostic
+}
+
+func newClient(t *testing.T) *client {
+	serverIn, clientOut := io.Pipe()
+	clientIn, serverOut := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(serverIn, serverOut)
+		serverOut.Close()
+	}()
+
+	c := &client{
+		t:           t,
+		conn:        newConn(clientIn, clientOut),
+		messages:    make(chan map[string]json.RawMessage, 100),
+		diagnostics: map[string][]Diagnostic{},
+	}
+	go func() {
+		defer close(c.messages)
+		for {
+			body, err := c.conn.read()
+			if err != nil {
+				return
+			}
+			var msg map[string]json.RawMessage
+			if err := json.Unmarshal(body, &msg); err != nil {
+				t.Errorf("server sent invalid JSON: %s", body)
+				return
+			}
+			c.messages <- msg
+		}
+	}()
+	t.Cleanup(func() {
+		c.conn.notify("exit", nil)
+		if err := <-done; err != nil {
+			t.Errorf("server failed: %v", err)
+		}
+		clientOut.Close()
+	})
+	return c
+}
+
+// call sends a request and decodes its result, recording the diagnostics
+// published before the response
+func (c *client) call(method string, params, result interface{}) *responseError {
+	c.t.Helper()
+	c.id++
+	id := json.RawMessage(strings.TrimSpace(string(mustJSON(c.t, c.id))))
+	if err := c.conn.write(map[string]interface{}{"jsonrpc": "2.0", "id": &id, "method": method, "params": params}); err != nil {
+		c.t.Fatalf("cannot send %s: %v", method, err)
+	}
+	for msg := range c.messages {
+		if string(msg["method"]) == `"textDocument/publishDiagnostics"` {
+			var p publishDiagnosticsParams
+			if err := json.Unmarshal(msg["params"], &p); err != nil {
+				c.t.Fatal(err)
+			}
+			c.diagnostics[p.URI] = p.Diagnostics
+			continue
+		}
+		if string(msg["id"]) != string(id) {
+			continue
+		}
+		if raw, ok := msg["error"]; ok {
+			var e responseError
+			json.Unmarshal(raw, &e)
+			return &e
+		}
+		if result != nil {
+			if err := json.Unmarshal(msg["result"], result); err != nil {
+				c.t.Fatalf("%s: cannot decode %s: %v", method, msg["result"], err)
+			}
+		}
+		return nil
+	}
+	c.t.Fatalf("%s: server closed the connection", method)
+	return nil
+}
+
+func (c *client) notify(method string, params interface{}) {
+	c.t.Helper()
+	if err := c.conn.notify(method, params); err != nil {
+		c.t.Fatalf("cannot send %s: %v", method, err)
+	}
+}
+
+func (c *client) open(uri, text string) {
+	c.notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri, "languageId": "h", "version": 1, "text": text},
+	})
+}
+
+func (c *client) change(uri, text string) {
+	c.notify("textDocument/didChange", map[string]interface{}{
+		"textDocument":   map[string]interface{}{"uri": uri, "version": 2},
+		"contentChanges": []map[string]string{{"text": text}},
+	})
+}
+
+func mustJSON(t *testing.T, v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func at(uri string, line, character int) map[string]interface{} {
+	return map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri},
+		"position":     Position{Line: line, Character: character},
+	}
+}
+
+func doc(uri string) map[string]interface{} {
+	return map[string]interface{}{"textDocument": map[string]string{"uri": uri}}
+}
+
+const shapesSource = `public struct Point {
+    public x int; # across
+    public y int;
+}
+
+public function (p *Point) move(dx int, dy int) {
+    p.x = p.x + dx;
+}
+
+public function origin() *Point {
+    return alloc(Point);
+}
+
+public enum Color { Red, Green }
+`
+
+const mainSource = `import "shapes.hl";
+
+/* entry
+   point */
+function main() {
+    p := origin();
+    p.move(1, 2);
+    print(p.x);
+    c := Color_Red;
+    free(p);
+}
+`
+
+// setup writes shapes.hl to a directory, starts a server and opens
+// main.hl beside it
+func setup(t *testing.T) (*client, string, string) {
+	dir := t.TempDir()
+	shapes := filepath.Join(dir, "shapes.hl")
+	if err := os.WriteFile(shapes, []byte(shapesSource), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newClient(t)
+	if err := c.call("initialize", map[string]interface{}{}, nil); err != nil {
+		t.Fatalf("initialize failed: %v", err.Message)
+	}
+	c.notify("initialized", map[string]interface{}{})
+
+	uri := pathToURI(filepath.Join(dir, "main.hl"))
+	c.open(uri, mainSource)
+	return c, uri, pathToURI(shapes)
+}
+
+func TestInitialize(t *testing.T) {
+	c := newClient(t)
+	if err := c.call("textDocument/hover", at("file:///x.hl", 0, 0), nil); err == nil || err.Code != codeNotInitialized {
+		t.Errorf("expected requests before initialize to fail, got %v", err)
+	}
+
+	var result struct {
+		Capabilities struct {
+			TextDocumentSync       int  `json:"textDocumentSync"`
+			DefinitionProvider     bool `json:"definitionProvider"`
+			SemanticTokensProvider struct {
+				Legend struct {
+					TokenTypes []string `json:"tokenTypes"`
+				} `json:"legend"`
+			} `json:"semanticTokensProvider"`
+		} `json:"capabilities"`
+	}
+	if err := c.call("initialize", map[string]interface{}{}, &result); err != nil {
+		t.Fatalf("initialize failed: %v", err.Message)
+	}
+	if result.Capabilities.TextDocumentSync != 1 || !result.Capabilities.DefinitionProvider {
+		t.Errorf("unexpected capabilities: %+v", result.Capabilities)
+	}
+	if len(result.Capabilities.SemanticTokensProvider.Legend.TokenTypes) != len(semanticTypes) {
+		t.Errorf("expected the semantic token legend, got %+v", result.Capabilities.SemanticTokensProvider)
+	}
+
+	if err := c.call("workspace/symbol", map[string]interface{}{}, nil); err == nil || err.Code != codeMethodNotFound {
+		t.Errorf("expected an unknown method to fail, got %v", err)
+	}
+	if err := c.call("shutdown", nil, nil); err != nil {
+		t.Errorf("shutdown failed: %v", err.Message)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	c, uri, _ := setup(t)
+	c.call("textDocument/documentSymbol", doc(uri), nil)
+	if diags := c.diagnostics[uri]; len(diags) != 0 {
+		t.Errorf("expected no diagnostics, got %+v", diags)
+	}
+
+	// A parse error covers its line
+	c.change(uri, strings.Replace(mainSource, "print(p.x);", "print(p.x;", 1))
+	c.call("textDocument/documentSymbol", doc(uri), nil)
+	diags := c.diagnostics[uri]
+	if len(diags) == 0 || diags[0].Severity != SeverityError || diags[0].Range.Start.Line != 7 {
+		t.Fatalf("expected a parse error on line 7, got %+v", diags)
+	}
+	if diags[0].Range.Start.Character != 4 || strings.HasPrefix(diags[0].Message, "line") {
+		t.Errorf("expected the range to skip indentation and the message its line, got %+v", diags[0])
+	}
+
+	// Code generation errors and memory warnings
+	c.change(uri, "function main() string {\n    return \"x\";\n}\n\nfunction f() {\n    p := alloc(Point);\n}\n\nstruct Point { x int; }\n")
+	c.call("textDocument/documentSymbol", doc(uri), nil)
+	diags = c.diagnostics[uri]
+	var sawError, sawWarning bool
+	for _, d := range diags {
+		if d.Severity == SeverityError && d.Range.Start.Line == 0 && strings.Contains(d.Message, "main must return int") {
+			sawError = true
+		}
+		if d.Severity == SeverityWarning && d.Range.Start.Line == 5 && d.Range.Start.Character == 9 {
+			sawWarning = true
+		}
+	}
+	if !sawError || !sawWarning {
+		t.Errorf("expected a code generation error and a leak warning, got %+v", diags)
+	}
+}
+
+func TestDefinition(t *testing.T) {
+	c, uri, shapes := setup(t)
+	tests := []struct {
+		name      string
+		line, chr int
+		uri       string
+		expect    Position
+	}{
+		{"imported function", 5, 10, shapes, Position{Line: 9, Character: 16}},
+		{"method", 6, 7, shapes, Position{Line: 5, Character: 27}},
+		{"field", 7, 12, shapes, Position{Line: 1, Character: 11}},
+		{"enum value", 8, 12, shapes, Position{Line: 13, Character: 20}},
+		{"local", 9, 9, uri, Position{Line: 5, Character: 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var loc *Location
+			if err := c.call("textDocument/definition", at(uri, tt.line, tt.chr), &loc); err != nil {
+				t.Fatalf("definition failed: %v", err.Message)
+			}
+			if loc == nil || loc.URI != tt.uri || loc.Range.Start != tt.expect {
+				t.Errorf("expected %s at %+v, got %+v", tt.uri, tt.expect, loc)
+			}
+		})
+	}
+
+	var loc *Location
+	c.call("textDocument/definition", at(uri, 7, 6), &loc)
+	if loc != nil {
+		t.Errorf("expected no definition for a builtin, got %+v", loc)
+	}
+}
+
+func TestHover(t *testing.T) {
+	c, uri, _ := setup(t)
+	tests := []struct {
+		line, chr int
+		expect    string
+		doc       string
+	}{
+		{5, 4, "var p *Point", ""},
+		{5, 12, "public function origin() *Point", ""},
+		{6, 6, "public function (p *Point) move(dx int, dy int)", ""},
+		{7, 13, "field x int", "across"},
+		{8, 4, "var c Color", ""},
+	}
+	for _, tt := range tests {
+		var h *Hover
+		if err := c.call("textDocument/hover", at(uri, tt.line, tt.chr), &h); err != nil {
+			t.Fatalf("hover failed: %v", err.Message)
+		}
+		expect := "```h\n" + tt.expect + "\n```"
+		if tt.doc != "" {
+			expect += "\n\n" + tt.doc
+		}
+		if h == nil || h.Contents.Value != expect {
+			t.Errorf("%d:%d: expected %q, got %+v", tt.line, tt.chr, tt.expect, h)
+		}
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	c, uri, _ := setup(t)
+
+	labels := func(line, chr int) map[string]int {
+		var items []CompletionItem
+		if err := c.call("textDocument/completion", at(uri, line, chr), &items); err != nil {
+			t.Fatalf("completion failed: %v", err.Message)
+		}
+		found := map[string]int{}
+		for _, it := range items {
+			found[it.Label] = it.Kind
+		}
+		return found
+	}
+
+	// Members, while the line being typed does not parse
+	c.change(uri, strings.Replace(mainSource, "print(p.x);", "print(p.);", 1))
+	members := labels(7, 12)
+	if members["x"] != CompletionField || members["y"] != CompletionField || members["move"] != CompletionMethod {
+		t.Errorf("expected the fields and methods of Point, got %v", members)
+	}
+	if _, ok := members["main"]; ok {
+		t.Errorf("expected only members after a dot, got %v", members)
+	}
+
+	// Everything in scope
+	c.change(uri, mainSource)
+	all := labels(9, 4)
+	for label, kind := range map[string]int{
+		"p":         CompletionVariable,
+		"c":         CompletionVariable,
+		"origin":    CompletionFunction,
+		"main":      CompletionFunction,
+		"Point":     CompletionStruct,
+		"Color_Red": CompletionEnumMember,
+		"print":     CompletionFunction,
+		"while":     CompletionKeyword,
+	} {
+		if all[label] != kind {
+			t.Errorf("expected %s with kind %d, got %d", label, kind, all[label])
+		}
+	}
+	if _, ok := labels(5, 4)["c"]; ok {
+		t.Error("expected locals declared later to be out of scope")
+	}
+}
+
+func TestDocumentSymbols(t *testing.T) {
+	c, uri, _ := setup(t)
+	c.change(uri, shapesSource+"\nvar count int = 0;\n")
+
+	var symbols []DocumentSymbol
+	if err := c.call("textDocument/documentSymbol", doc(uri), &symbols); err != nil {
+		t.Fatalf("documentSymbol failed: %v", err.Message)
+	}
+	var names []string
+	for _, s := range symbols {
+		names = append(names, s.Name)
+	}
+	if got := strings.Join(names, " "); got != "Point (*Point).move origin Color count" {
+		t.Fatalf("unexpected symbols %q", got)
+	}
+	if len(symbols[0].Children) != 2 || symbols[0].Children[1].Name != "y" || symbols[0].Kind != SymbolStruct {
+		t.Errorf("expected Point with its fields, got %+v", symbols[0])
+	}
+	if symbols[0].Range.End != (Position{Line: 3, Character: 1}) {
+		t.Errorf("expected Point to end at its brace, got %+v", symbols[0].Range)
+	}
+	if len(symbols[3].Children) != 2 || symbols[3].Kind != SymbolEnum {
+		t.Errorf("expected Color with its values, got %+v", symbols[3])
+	}
+}
+
+func TestSemanticTokens(t *testing.T) {
+	c, uri, _ := setup(t)
+
+	var result semanticTokens
+	if err := c.call("textDocument/semanticTokens/full", doc(uri), &result); err != nil {
+		t.Fatalf("semanticTokens failed: %v", err.Message)
+	}
+	if len(result.Data)%5 != 0 {
+		t.Fatalf("expected groups of five integers, got %d", len(result.Data))
+	}
+
+	// Decode the relative positions
+	type token struct{ line, char, length, class, mods int }
+	found := map[[2]int]token{}
+	line, char := 0, 0
+	for i := 0; i < len(result.Data); i += 5 {
+		if result.Data[i] > 0 {
+			char = 0
+		}
+		line += result.Data[i]
+		char += result.Data[i+1]
+		found[[2]int{line, char}] = token{line, char, result.Data[i+2], result.Data[i+3], result.Data[i+4]}
+	}
+
+	tests := []struct {
+		line, char, length, class, mods int
+	}{
+		{0, 0, 6, tokKeyword, 0},
+		{0, 7, 11, tokString, 0},
+		{2, 0, 8, tokComment, 0},
+		{3, 3, 8, tokComment, 0},
+		{4, 9, 4, tokFunction, modDeclaration},
+		{5, 4, 1, tokVariable, modDeclaration},
+		{5, 9, 6, tokFunction, 0},
+		{6, 6, 4, tokMethod, 0},
+		{6, 11, 1, tokNumber, 0},
+		{7, 12, 1, tokProperty, 0},
+		{8, 9, 9, tokEnumMember, 0},
+	}
+	for _, tt := range tests {
+		got, ok := found[[2]int{tt.line, tt.char}]
+		if !ok {
+			t.Errorf("%d:%d: expected a token", tt.line, tt.char)
+			continue
+		}
+		if got.length != tt.length || got.class != tt.class || got.mods != tt.mods {
+			t.Errorf("%d:%d: expected length %d class %s mods %d, got length %d class %s mods %d",
+				tt.line, tt.char, tt.length, semanticTypes[tt.class], tt.mods,
+				got.length, semanticTypes[got.class], got.mods)
+		}
+	}
+}
+
+func TestPositions(t *testing.T) {
+	d := newDocument("file:///x.hl", "x := \"é😀\"; y := 1;\n")
+	// The string is 2 + 2 + 4 bytes but 2 + 1 + 2 UTF-16 units
+	var y int
+	for i, tok := range d.tokens {
+		if tok.Literal == "y" {
+			y = i
+		}
+	}
+	r := d.tokenRange(d.tokens[y])
+	if r.Start != (Position{Line: 0, Character: 12}) {
+		t.Errorf("expected y at character 12, got %+v", r.Start)
+	}
+	if line, column := d.tokenPosition(r.Start); line != 1 || column != 16 {
+		t.Errorf("expected line 1 column 16, got %d:%d", line, column)
+	}
+}
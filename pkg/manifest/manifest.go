@@ -0,0 +1,312 @@
+// Package manifest reads hl.toml project manifests.
+//
+// A manifest names the binaries a project builds and how to build them:
+//
+//	[project]
+//	name = "hello"
+//	version = "0.1.0"
+//
+//	[build]
+//	output = "build"            # artefact directory, relative to hl.toml
+//	import_paths = ["lib"]      # extra roots searched by import
+//	cflags = ["-O2"]
+//	libs = ["m"]                # passed to the C compiler as -lm
+//	gc = false
+//
+//	[[bin]]
+//	name = "hello"
+//	main = "src/main.hl"
+//	cflags = []                 # added to [build] cflags
+//	libs = []                   # added to [build] libs
+//
+// Only the subset of TOML used above is supported: tables, arrays of
+// tables, and string, boolean and string-array values.
+package manifest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileName is the name of the manifest file at the root of a project
+const FileName = "hl.toml"
+
+// Manifest is a parsed hl.toml
+type Manifest struct {
+	Dir     string // directory containing the manifest
+	Project Project
+	Build   Build
+	Bins    []*Binary
+}
+
+// Project holds the [project] table
+type Project struct {
+	Name    string
+	Version string
+}
+
+// Build holds the [build] table, shared by every binary
+type Build struct {
+	Output      string
+	ImportPaths []string
+	CFlags      []string
+	Libs        []string
+	GC          bool
+}
+
+// Binary is one [[bin]] target
+type Binary struct {
+	Name   string
+	Main   string
+	CFlags []string
+	Libs   []string
+}
+
+// Load reads and parses the manifest at path
+func Load(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	m, err := Parse(string(data), dir)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+}
+
+// Find returns the path of the nearest hl.toml in dir or its parents
+func Find(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		path := filepath.Join(dir, FileName)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("no %s found in this directory or any parent", FileName)
+		}
+		dir = parent
+	}
+}
+
+// Parse parses manifest source. Relative paths in the manifest are
+// resolved against dir.
+func Parse(source, dir string) (*Manifest, error) {
+	m := &Manifest{Dir: dir, Build: Build{Output: "build"}}
+	p := &tomlParser{lines: strings.Split(source, "\n")}
+
+	table := ""
+	var bin *Binary
+	for p.next() {
+		line := p.line
+		if strings.HasPrefix(line, "[[") {
+			if !strings.HasSuffix(line, "]]") {
+				return nil, p.errorf("malformed table header %s", line)
+			}
+			table = strings.TrimSpace(line[2 : len(line)-2])
+			if table != "bin" {
+				return nil, p.errorf("unknown table array [[%s]]", table)
+			}
+			bin = &Binary{}
+			m.Bins = append(m.Bins, bin)
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, p.errorf("malformed table header %s", line)
+			}
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			if table != "project" && table != "build" {
+				return nil, p.errorf("unknown table [%s]", table)
+			}
+			continue
+		}
+
+		key, value, err := p.keyValue()
+		if err != nil {
+			return nil, err
+		}
+		switch table {
+		case "project":
+			err = m.setProject(key, value)
+		case "build":
+			err = m.setBuild(key, value)
+		case "bin":
+			err = bin.set(key, value)
+		default:
+			err = fmt.Errorf("key %s outside of a table", key)
+		}
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+	}
+
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Manifest) setProject(key string, value interface{}) error {
+	switch key {
+	case "name":
+		return setString(&m.Project.Name, key, value)
+	case "version":
+		return setString(&m.Project.Version, key, value)
+	}
+	return fmt.Errorf("unknown key project.%s", key)
+}
+
+func (m *Manifest) setBuild(key string, value interface{}) error {
+	switch key {
+	case "output":
+		return setString(&m.Build.Output, key, value)
+	case "import_paths":
+		return setStrings(&m.Build.ImportPaths, key, value)
+	case "cflags":
+		return setStrings(&m.Build.CFlags, key, value)
+	case "libs":
+		return setStrings(&m.Build.Libs, key, value)
+	case "gc":
+		b, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("%s must be a boolean", key)
+		}
+		m.Build.GC = b
+		return nil
+	}
+	return fmt.Errorf("unknown key build.%s", key)
+}
+
+func (b *Binary) set(key string, value interface{}) error {
+	switch key {
+	case "name":
+		return setString(&b.Name, key, value)
+	case "main":
+		return setString(&b.Main, key, value)
+	case "cflags":
+		return setStrings(&b.CFlags, key, value)
+	case "libs":
+		return setStrings(&b.Libs, key, value)
+	}
+	return fmt.Errorf("unknown key bin.%s", key)
+}
+
+func (m *Manifest) validate() error {
+	if m.Project.Name == "" {
+		return fmt.Errorf("project.name is required")
+	}
+	if len(m.Bins) == 0 {
+		return fmt.Errorf("at least one [[bin]] target is required")
+	}
+	seen := make(map[string]bool)
+	for _, b := range m.Bins {
+		if b.Name == "" || b.Main == "" {
+			return fmt.Errorf("every [[bin]] needs a name and a main file")
+		}
+		if strings.ContainsAny(b.Name, `/\`) {
+			return fmt.Errorf("bin name %q must not contain a path separator", b.Name)
+		}
+		if seen[b.Name] {
+			return fmt.Errorf("bin %q is declared more than once", b.Name)
+		}
+		seen[b.Name] = true
+	}
+	// hlc clean removes the output directory, so keep it inside the project
+	out := filepath.Clean(m.Build.Output)
+	if out == "." || filepath.IsAbs(out) || out == ".." || strings.HasPrefix(out, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("build.output must name a subdirectory of the project")
+	}
+	return nil
+}
+
+// OutputDir returns the absolute artefact directory
+func (m *Manifest) OutputDir() string {
+	return filepath.Join(m.Dir, m.Build.Output)
+}
+
+// MainPath returns the absolute path of a binary's entry file
+func (m *Manifest) MainPath(b *Binary) string {
+	return m.path(b.Main)
+}
+
+// ImportRoots returns the absolute import search roots
+func (m *Manifest) ImportRoots() []string {
+	var roots []string
+	for _, p := range m.Build.ImportPaths {
+		roots = append(roots, m.path(p))
+	}
+	return roots
+}
+
+// CFlags returns the C compiler flags for a binary
+func (m *Manifest) CFlags(b *Binary) []string {
+	return append(append([]string{}, m.Build.CFlags...), b.CFlags...)
+}
+
+// Libs returns the libraries a binary links against
+func (m *Manifest) Libs(b *Binary) []string {
+	return append(append([]string{}, m.Build.Libs...), b.Libs...)
+}
+
+// Bin returns the target with the given name, or nil
+func (m *Manifest) Bin(name string) *Binary {
+	for _, b := range m.Bins {
+		if b.Name == name {
+			return b
+		}
+	}
+	return nil
+}
+
+func (m *Manifest) path(p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(m.Dir, p)
+}
+
+// Template returns the manifest written by hlc init for a new project
+func Template(name string) string {
+	return fmt.Sprintf(`[project]
+name = %q
+version = "0.1.0"
+
+[build]
+output = "build"
+import_paths = ["lib"]
+
+[[bin]]
+name = %q
+main = "src/main.hl"
+`, name, name)
+}
+
+func setString(dst *string, key string, value interface{}) error {
+	s, ok := value.(string)
+	if !ok {
+		return fmt.Errorf("%s must be a string", key)
+	}
+	*dst = s
+	return nil
+}
+
+func setStrings(dst *[]string, key string, value interface{}) error {
+	list, ok := value.([]string)
+	if !ok {
+		return fmt.Errorf("%s must be an array of strings", key)
+	}
+	*dst = list
+	return nil
+}
@@ -0,0 +1,135 @@
+package manifest
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	source := `# Project manifest
+[project]
+name = "tools"
+version = "1.0.0"
+
+[build]
+output = "out"
+import_paths = ["lib", "vendor/h"]   # searched in order
+cflags = [
+    "-O2",
+    "-Wall",
+]
+libs = ["m"]
+gc = true
+
+[[bin]]
+name = "server"
+main = "cmd/server.hl"
+libs = ["pthread"]
+
+[[bin]]
+name = "cli"
+main = "cmd/cli.hl"
+cflags = ["-DNAME=\"cli # tool\""]
+`
+
+	m, err := Parse(source, "/work/tools")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if m.Project.Name != "tools" || m.Project.Version != "1.0.0" {
+		t.Errorf("unexpected project: %+v", m.Project)
+	}
+	if !m.Build.GC {
+		t.Error("expected gc = true")
+	}
+	if m.OutputDir() != filepath.Join("/work/tools", "out") {
+		t.Errorf("unexpected output dir %s", m.OutputDir())
+	}
+	roots := []string{filepath.Join("/work/tools", "lib"), filepath.Join("/work/tools", "vendor/h")}
+	if !reflect.DeepEqual(m.ImportRoots(), roots) {
+		t.Errorf("expected roots %v, got %v", roots, m.ImportRoots())
+	}
+
+	if len(m.Bins) != 2 {
+		t.Fatalf("expected 2 binaries, got %d", len(m.Bins))
+	}
+	server := m.Bin("server")
+	if server == nil || m.MainPath(server) != filepath.Join("/work/tools", "cmd/server.hl") {
+		t.Fatalf("unexpected server target %+v", server)
+	}
+	if !reflect.DeepEqual(m.Libs(server), []string{"m", "pthread"}) {
+		t.Errorf("unexpected libs %v", m.Libs(server))
+	}
+	cli := m.Bin("cli")
+	if !reflect.DeepEqual(m.CFlags(cli), []string{"-O2", "-Wall", `-DNAME="cli # tool"`}) {
+		t.Errorf("unexpected cflags %v", m.CFlags(cli))
+	}
+}
+
+func TestParse_Defaults(t *testing.T) {
+	m, err := Parse(Template("hello"), "/p")
+	if err != nil {
+		t.Fatalf("template does not parse: %v", err)
+	}
+	if m.Build.Output != "build" || m.Bins[0].Name != "hello" || m.Bins[0].Main != "src/main.hl" {
+		t.Errorf("unexpected template manifest %+v %+v", m.Build, m.Bins[0])
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	tests := []struct {
+		source string
+		substr string
+	}{
+		{"[project]\nnam = \"x\"", "line 2: unknown key project.nam"},
+		{"[package]", "line 1: unknown table [package]"},
+		{"name = \"x\"", "outside of a table"},
+		{"[project]\nname = x", "expected a string"},
+		{"[project]\nname = \"x", "unterminated string"},
+		{"[build]\ncflags = [\"-O2\"", "unterminated array"},
+		{"[build]\ngc = \"yes\"", "gc must be a boolean"},
+		{"[project]\nname = \"x\"", "at least one [[bin]]"},
+		{"[project]\nname = \"x\"\n[[bin]]\nname = \"a\"", "needs a name and a main file"},
+		{"[project]\nname = \"x\"\n[[bin]]\nname = \"a\"\nmain = \"a.hl\"\n[[bin]]\nname = \"a\"\nmain = \"b.hl\"", "declared more than once"},
+		{"[project]\nname = \"x\"\n[build]\noutput = \".\"\n[[bin]]\nname = \"a\"\nmain = \"a.hl\"", "build.output must name a subdirectory"},
+		{"[project]\nname = \"x\"\n[build]\noutput = \"../out\"\n[[bin]]\nname = \"a\"\nmain = \"a.hl\"", "build.output must name a subdirectory"},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse(tt.source, "/p")
+		if err == nil || !strings.Contains(err.Error(), tt.substr) {
+			t.Errorf("expected error containing %q for:\n%s\ngot: %v", tt.substr, tt.source, err)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	root := t.TempDir()
+	nested := filepath.Join(root, "src", "deep")
+	if err := os.MkdirAll(nested, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, FileName), []byte(Template("x")), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	path, err := Find(nested)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if path != filepath.Join(root, FileName) {
+		t.Errorf("expected %s, got %s", filepath.Join(root, FileName), path)
+	}
+
+	m, err := Load(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.Dir != root {
+		t.Errorf("expected dir %s, got %s", root, m.Dir)
+	}
+}
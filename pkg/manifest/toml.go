@@ -0,0 +1,158 @@
+package manifest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// tomlParser walks manifest source line by line. Values are strings,
+// booleans or arrays of strings; arrays may span several lines.
+type tomlParser struct {
+	lines  []string
+	lineNo int    // 1-based number of the current line
+	line   string // current line without its comment, trimmed
+}
+
+// next advances to the next non-empty line
+func (p *tomlParser) next() bool {
+	for p.lineNo < len(p.lines) {
+		p.lineNo++
+		p.line = strings.TrimSpace(stripComment(p.lines[p.lineNo-1]))
+		if p.line != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *tomlParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", p.lineNo, fmt.Sprintf(format, args...))
+}
+
+// keyValue parses "key = value" on the current line, consuming further
+// lines for a multi-line array
+func (p *tomlParser) keyValue() (string, interface{}, error) {
+	eq := strings.Index(p.line, "=")
+	if eq == -1 {
+		return "", nil, p.errorf("expected key = value, got %s", p.line)
+	}
+	key := strings.TrimSpace(p.line[:eq])
+	if key == "" || strings.ContainsAny(key, " \t\"") {
+		return "", nil, p.errorf("invalid key %q", key)
+	}
+	raw := strings.TrimSpace(p.line[eq+1:])
+
+	if strings.HasPrefix(raw, "[") {
+		for !arrayClosed(raw) {
+			if !p.next() {
+				return "", nil, p.errorf("unterminated array for %s", key)
+			}
+			raw += " " + p.line
+		}
+		list, err := parseArray(raw)
+		if err != nil {
+			return "", nil, p.errorf("%s: %v", key, err)
+		}
+		return key, list, nil
+	}
+
+	switch raw {
+	case "true":
+		return key, true, nil
+	case "false":
+		return key, false, nil
+	}
+	s, rest, err := parseString(raw)
+	if err != nil {
+		return "", nil, p.errorf("%s: %v", key, err)
+	}
+	if strings.TrimSpace(rest) != "" {
+		return "", nil, p.errorf("%s: unexpected %q after value", key, rest)
+	}
+	return key, s, nil
+}
+
+// parseArray parses ["a", "b", ] into its strings
+func parseArray(raw string) ([]string, error) {
+	list := []string{}
+	rest := strings.TrimSpace(raw[1:])
+	for {
+		if strings.HasPrefix(rest, "]") {
+			if strings.TrimSpace(rest[1:]) != "" {
+				return nil, fmt.Errorf("unexpected %q after array", rest[1:])
+			}
+			return list, nil
+		}
+		s, after, err := parseString(rest)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+		rest = strings.TrimSpace(after)
+		if strings.HasPrefix(rest, ",") {
+			rest = strings.TrimSpace(rest[1:])
+		} else if !strings.HasPrefix(rest, "]") {
+			return nil, fmt.Errorf("expected , or ] in array")
+		}
+	}
+}
+
+// parseString parses a leading basic string and returns the remainder
+func parseString(raw string) (string, string, error) {
+	if !strings.HasPrefix(raw, `"`) {
+		return "", "", fmt.Errorf("expected a string, boolean or array, got %s", raw)
+	}
+	escaped := false
+	for i := 1; i < len(raw); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case raw[i] == '\\':
+			escaped = true
+		case raw[i] == '"':
+			s, err := strconv.Unquote(raw[:i+1])
+			if err != nil {
+				return "", "", fmt.Errorf("invalid string %s", raw[:i+1])
+			}
+			return s, raw[i+1:], nil
+		}
+	}
+	return "", "", fmt.Errorf("unterminated string")
+}
+
+// stripComment removes a # comment that is not inside a string
+func stripComment(line string) string {
+	inString, escaped := false, false
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case c == '#' && !inString:
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// arrayClosed reports whether an array value has its closing bracket
+func arrayClosed(raw string) bool {
+	inString, escaped := false, false
+	for i := 0; i < len(raw); i++ {
+		switch c := raw[i]; {
+		case escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case c == ']' && !inString:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,613 @@
+package memcheck
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+)
+
+// Kind identifies the class of memory error a warning reports
+type Kind int
+
+const (
+	UseAfterFree Kind = iota
+	DoubleFree
+	Leak
+)
+
+var kindNames = map[Kind]string{
+	UseAfterFree: "use-after-free",
+	DoubleFree:   "double-free",
+	Leak:         "leak",
+}
+
+func (k Kind) String() string {
+	if name, ok := kindNames[k]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Warning is a memory error found in a function body
+type Warning struct {
+	Kind     Kind
+	Line     int
+	Column   int
+	Function string
+	Message  string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%d:%d: %s (in %s)", w.Line, w.Column, w.Message, w.Function)
+}
+
+// state is the set of states an allocation may be in at a program point
+type state uint8
+
+const (
+	allocated state = 1 << iota // owned heap memory, not yet freed
+	freed                       // memory has been released
+)
+
+// object tracks a heap allocation held by a local variable
+type object struct {
+	states   state
+	alloc    lexer.Token // where the memory was allocated
+	freedAt  lexer.Token // where it was last freed
+	deferred *lexer.Token
+	escaped  bool // ownership left the function (returned, stored or passed on)
+}
+
+func (o *object) clone() *object {
+	c := *o
+	return &c
+}
+
+// env maps local variable names to the allocation they hold
+type env map[string]*object
+
+func (e env) clone() env {
+	c := make(env, len(e))
+	for name, obj := range e {
+		c[name] = obj.clone()
+	}
+	return c
+}
+
+func (e env) equal(other env) bool {
+	if len(e) != len(other) {
+		return false
+	}
+	for name, obj := range e {
+		o, ok := other[name]
+		if !ok || o.states != obj.states || o.escaped != obj.escaped || (o.deferred == nil) != (obj.deferred == nil) {
+			return false
+		}
+	}
+	return true
+}
+
+// merge joins the states of two control-flow paths
+func merge(a, b env) env {
+	out := a.clone()
+	for name, obj := range b {
+		existing, ok := out[name]
+		if !ok {
+			out[name] = obj.clone()
+			continue
+		}
+		existing.states |= obj.states
+		existing.escaped = existing.escaped || obj.escaped
+		if existing.deferred == nil || obj.deferred == nil {
+			existing.deferred = nil
+		}
+		if existing.freedAt.Line == 0 {
+			existing.freedAt = obj.freedAt
+		}
+	}
+	return out
+}
+
+// loopCtx collects the states reaching break and continue statements
+type loopCtx struct {
+	breaks    []env
+	continues []env
+}
+
+// checker analyses one function body
+type checker struct {
+	function string
+	warnings []Warning
+	seen     map[string]bool
+	loops    []*loopCtx
+	globals  map[string]bool // module-level variables
+}
+
+// Check analyses every function in the program and returns the memory
+// errors found, ordered by source position
+func Check(program *ast.Program) []Warning {
+	globals := make(map[string]bool)
+	for _, stmt := range program.Statements {
+		switch s := stmt.(type) {
+		case *ast.VarStatement:
+			globals[s.Name.Value] = true
+		case *ast.ConstStatement:
+			globals[s.Name.Value] = true
+		}
+	}
+
+	var warnings []Warning
+	for _, stmt := range program.Statements {
+		fn, ok := stmt.(*ast.FunctionStatement)
+		if !ok || fn == nil || fn.Body == nil {
+			continue
+		}
+		warnings = append(warnings, checkFunction(fn, globals)...)
+	}
+	sort.SliceStable(warnings, func(i, j int) bool {
+		if warnings[i].Line != warnings[j].Line {
+			return warnings[i].Line < warnings[j].Line
+		}
+		return warnings[i].Column < warnings[j].Column
+	})
+	return warnings
+}
+
+// CheckFunction analyses a single function body
+func CheckFunction(fn *ast.FunctionStatement) []Warning {
+	return checkFunction(fn, nil)
+}
+
+func checkFunction(fn *ast.FunctionStatement, globals map[string]bool) []Warning {
+	c := &checker{function: fn.Name.Value, seen: make(map[string]bool), globals: globals}
+	e := make(env)
+	out, terminated := c.block(fn.Body, e, false)
+	if !terminated {
+		// Falling off the end of the function behaves like a bare return
+		c.checkLeaks(out, fn.Body.Token, true)
+	}
+	return c.warnings
+}
+
+func (c *checker) warn(kind Kind, tok lexer.Token, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	key := fmt.Sprintf("%d:%d:%d:%s", kind, tok.Line, tok.Column, msg)
+	if c.seen[key] {
+		return
+	}
+	c.seen[key] = true
+	c.warnings = append(c.warnings, Warning{
+		Kind:     kind,
+		Line:     tok.Line,
+		Column:   tok.Column,
+		Function: c.function,
+		Message:  msg,
+	})
+}
+
+// block analyses a block and, when scoped, reports allocations lost as
+// its variables go out of scope. The function body itself is unscoped:
+// its locals are checked by the implicit return at the end. It returns
+// the state at the end of the block and whether every path through it
+// returned.
+func (c *checker) block(b *ast.BlockStatement, in env, scoped bool) (env, bool) {
+	if b == nil {
+		return in, false
+	}
+	e := in
+	shadowed := make(map[string]*object)
+	declared := []string{}
+	declare := func(name string) {
+		if _, done := shadowed[name]; !done {
+			shadowed[name] = in[name]
+			declared = append(declared, name)
+		}
+	}
+
+	for _, stmt := range b.Statements {
+		if name := declaredName(stmt); name != "" {
+			declare(name)
+		}
+		var terminated bool
+		e, terminated = c.statement(stmt, e)
+		if terminated {
+			return e, true
+		}
+	}
+
+	if !scoped {
+		return e, false
+	}
+
+	// Allocations held only by variables of this block are unreachable now
+	for _, name := range declared {
+		if obj, ok := e[name]; ok && obj.states&allocated != 0 && obj.deferred == nil && !obj.escaped {
+			c.warn(Leak, obj.alloc, "allocation assigned to %s is never freed before it goes out of scope", name)
+		}
+		if prev := shadowed[name]; prev != nil {
+			e[name] = prev
+		} else {
+			delete(e, name)
+		}
+	}
+	return e, false
+}
+
+func declaredName(stmt ast.Statement) string {
+	switch s := stmt.(type) {
+	case *ast.InferStatement:
+		return s.Name.Value
+	case *ast.VarStatement:
+		return s.Name.Value
+	case *ast.ConstStatement:
+		return s.Name.Value
+	}
+	return ""
+}
+
+// statement analyses a single statement, returning the outgoing state and
+// whether control never reaches the following statement
+func (c *checker) statement(stmt ast.Statement, e env) (env, bool) {
+	switch s := stmt.(type) {
+	case *ast.InferStatement:
+		c.assign(s.Name, s.Value, e, true)
+	case *ast.VarStatement:
+		if s.Value != nil {
+			c.assign(s.Name, s.Value, e, true)
+		} else {
+			delete(e, s.Name.Value)
+		}
+	case *ast.ConstStatement:
+		c.uses(s.Value, e)
+		delete(e, s.Name.Value)
+	case *ast.ExpressionStatement:
+		c.expression(s.Expression, e)
+	case *ast.FreeStatement:
+		c.free(s, e)
+	case *ast.DeferStatement:
+		c.deferStmt(s, e)
+	case *ast.DeleteStatement:
+		c.uses(s.Map, e)
+		c.uses(s.Key, e)
+	case *ast.ReturnStatement:
+		if s.Value != nil {
+			c.uses(s.Value, e)
+			c.escape(s.Value, e)
+		}
+		c.checkLeaks(e, s.Token, false)
+		return e, true
+	case *ast.BreakStatement:
+		if n := len(c.loops); n > 0 {
+			c.loops[n-1].breaks = append(c.loops[n-1].breaks, e.clone())
+		}
+		return e, true
+	case *ast.ContinueStatement:
+		if n := len(c.loops); n > 0 {
+			c.loops[n-1].continues = append(c.loops[n-1].continues, e.clone())
+		}
+		return e, true
+	case *ast.BlockStatement:
+		return c.block(s, e, true)
+	case *ast.IfStatement:
+		return c.ifStmt(s, e)
+	case *ast.WhileStatement:
+		c.uses(s.Condition, e)
+		return c.loop(s.Condition, nil, s.Body, e), false
+	case *ast.ForStatement:
+		if s.Init != nil {
+			e, _ = c.statement(s.Init, e)
+		}
+		if s.Condition != nil {
+			c.uses(s.Condition, e)
+		}
+		out := c.loop(s.Condition, s.Post, s.Body, e)
+		if s.Init != nil {
+			if name := declaredName(s.Init); name != "" {
+				delete(out, name)
+			}
+		}
+		return out, false
+	case *ast.ForRangeStatement:
+		c.uses(s.Iterable, e)
+		out := c.loop(nil, nil, s.Body, e)
+		if s.Index != nil {
+			delete(out, s.Index.Value)
+		}
+		if s.Value != nil {
+			delete(out, s.Value.Value)
+		}
+		return out, false
+	}
+	return e, false
+}
+
+func (c *checker) ifStmt(s *ast.IfStatement, e env) (env, bool) {
+	c.uses(s.Condition, e)
+
+	thenEnv, thenDone := c.block(s.Consequence, e.clone(), true)
+	elseEnv, elseDone := e, false
+	if s.Alternative != nil {
+		elseEnv, elseDone = c.block(s.Alternative, e.clone(), true)
+	}
+
+	switch {
+	case thenDone && elseDone:
+		return e, true
+	case thenDone:
+		return elseEnv, false
+	case elseDone:
+		return thenEnv, false
+	}
+	return merge(thenEnv, elseEnv), false
+}
+
+// loop iterates the body until the state at the loop head stops changing
+func (c *checker) loop(cond ast.Expression, post ast.Statement, body *ast.BlockStatement, entry env) env {
+	head := entry.clone()
+	ctx := &loopCtx{}
+	c.loops = append(c.loops, ctx)
+	defer func() { c.loops = c.loops[:len(c.loops)-1] }()
+
+	for i := 0; i < 8; i++ {
+		ctx.breaks, ctx.continues = nil, nil
+		out, terminated := c.block(body, head.clone(), true)
+		next := head
+		if !terminated {
+			next = merge(next, out)
+		}
+		for _, cont := range ctx.continues {
+			next = merge(next, cont)
+		}
+		if post != nil {
+			next, _ = c.statement(post, next)
+		}
+		if cond != nil {
+			c.uses(cond, next)
+		}
+		if next.equal(head) {
+			break
+		}
+		head = next
+	}
+
+	exit := head
+	for _, brk := range ctx.breaks {
+		exit = merge(exit, brk)
+	}
+	return exit
+}
+
+// assign records the result of name := value or name = value
+func (c *checker) assign(name *ast.Identifier, value ast.Expression, e env, declaring bool) {
+	c.uses(value, e)
+
+	if !declaring {
+		if old, ok := e[name.Value]; ok && old.states == allocated && old.deferred == nil && !old.escaped {
+			c.warn(Leak, name.Token, "assignment to %s leaks the allocation made at line %d", name.Value, old.alloc.Line)
+		}
+	}
+
+	// Storing into a module-level variable keeps the memory reachable
+	if _, local := e[name.Value]; !declaring && !local && c.globals[name.Value] {
+		c.escape(value, e)
+		return
+	}
+
+	if tok, ok := allocation(value); ok {
+		e[name.Value] = &object{states: allocated, alloc: tok}
+		return
+	}
+
+	// Aliasing hands ownership to the new name, which we do not follow
+	c.escape(value, e)
+	delete(e, name.Value)
+}
+
+// allocation reports whether expr yields freshly allocated heap memory
+func allocation(expr ast.Expression) (lexer.Token, bool) {
+	switch v := expr.(type) {
+	case *ast.AllocExpression:
+		return v.Token, true
+	case *ast.MakeExpression:
+		return v.Token, true
+	case *ast.MapLiteral:
+		return v.Token, true
+	case *ast.PrefixExpression:
+		// &T{...} copies the literal onto the heap
+		if _, ok := v.Right.(*ast.StructLiteral); ok && v.Operator == "&" {
+			return v.Token, true
+		}
+	}
+	return lexer.Token{}, false
+}
+
+// escape marks tracked variables in expr as no longer owned by this function
+func (c *checker) escape(expr ast.Expression, e env) {
+	if ident, ok := expr.(*ast.Identifier); ok {
+		if obj, ok := e[ident.Value]; ok {
+			obj.escaped = true
+		}
+	}
+}
+
+func (c *checker) free(s *ast.FreeStatement, e env) {
+	ident, ok := s.Value.(*ast.Identifier)
+	if !ok {
+		c.uses(s.Value, e)
+		return
+	}
+	obj, ok := e[ident.Value]
+	if !ok {
+		return
+	}
+	switch {
+	case obj.states == freed:
+		c.warn(DoubleFree, s.Token, "double free of %s (already freed at line %d)", ident.Value, obj.freedAt.Line)
+	case obj.states&freed != 0:
+		c.warn(DoubleFree, s.Token, "%s may already have been freed (at line %d)", ident.Value, obj.freedAt.Line)
+	case obj.deferred != nil:
+		c.warn(DoubleFree, s.Token, "%s is freed here and again by the defer at line %d", ident.Value, obj.deferred.Line)
+	}
+	obj.states = freed
+	obj.freedAt = s.Token
+}
+
+func (c *checker) deferStmt(s *ast.DeferStatement, e env) {
+	fs, ok := s.Statement.(*ast.FreeStatement)
+	if !ok {
+		// Deferred calls run at exit; their operands are checked then
+		return
+	}
+	ident, ok := fs.Value.(*ast.Identifier)
+	if !ok {
+		return
+	}
+	obj, ok := e[ident.Value]
+	if !ok {
+		return
+	}
+	if obj.states&freed != 0 {
+		c.warn(DoubleFree, s.Token, "deferred free of %s which was already freed at line %d", ident.Value, obj.freedAt.Line)
+	} else if obj.deferred != nil {
+		c.warn(DoubleFree, s.Token, "%s is already freed by the defer at line %d", ident.Value, obj.deferred.Line)
+	}
+	tok := s.Token
+	obj.deferred = &tok
+}
+
+// checkLeaks reports allocations still owned when the function returns
+func (c *checker) checkLeaks(e env, at lexer.Token, implicit bool) {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		obj := e[name]
+		if obj.states&allocated == 0 || obj.deferred != nil || obj.escaped {
+			continue
+		}
+		where := fmt.Sprintf("return at line %d", at.Line)
+		if implicit {
+			where = "the end of the function"
+		}
+		if obj.states == allocated {
+			c.warn(Leak, obj.alloc, "allocation assigned to %s is not freed before %s", name, where)
+		} else {
+			c.warn(Leak, obj.alloc, "allocation assigned to %s may not be freed before %s", name, where)
+		}
+	}
+}
+
+// expression analyses an expression evaluated for its side effects
+func (c *checker) expression(expr ast.Expression, e env) {
+	if assign, ok := expr.(*ast.AssignExpression); ok {
+		if ident, ok := assign.Left.(*ast.Identifier); ok && assign.Operator == "=" {
+			c.assign(ident, assign.Value, e, false)
+			return
+		}
+		// Storing into a field, element or through a pointer gives the
+		// value a new owner
+		c.uses(assign.Left, e)
+		c.uses(assign.Value, e)
+		c.escape(assign.Value, e)
+		return
+	}
+	c.uses(expr, e)
+}
+
+// uses reports reads of freed variables within expr and marks variables
+// handed to other functions as escaped
+func (c *checker) uses(expr ast.Expression, e env) {
+	switch v := expr.(type) {
+	case nil:
+		return
+	case *ast.Identifier:
+		c.use(v, e)
+	case *ast.PrefixExpression:
+		c.uses(v.Right, e)
+	case *ast.InfixExpression:
+		// Comparing a dangling pointer against null is harmless
+		if isNull(v.Left) || isNull(v.Right) {
+			if _, ok := v.Left.(*ast.Identifier); ok {
+				return
+			}
+			if _, ok := v.Right.(*ast.Identifier); ok {
+				return
+			}
+		}
+		c.uses(v.Left, e)
+		c.uses(v.Right, e)
+	case *ast.PostfixExpression:
+		c.uses(v.Left, e)
+	case *ast.AssignExpression:
+		c.expression(v, e)
+	case *ast.CallExpression:
+		c.call(v, e)
+	case *ast.IndexExpression:
+		c.uses(v.Left, e)
+		c.uses(v.Index, e)
+	case *ast.MemberExpression:
+		c.uses(v.Object, e)
+	case *ast.CastExpression:
+		c.uses(v.Value, e)
+	case *ast.ArrayLiteral:
+		for _, el := range v.Elements {
+			c.uses(el, e)
+			c.escape(el, e)
+		}
+	case *ast.MapLiteral:
+		for _, pair := range v.Pairs {
+			c.uses(pair.Key, e)
+			c.uses(pair.Value, e)
+			c.escape(pair.Value, e)
+		}
+	case *ast.MakeExpression:
+		c.uses(v.Length, e)
+		c.uses(v.Capacity, e)
+	case *ast.StructLiteral:
+		for _, f := range v.Fields {
+			c.uses(f.Value, e)
+			c.escape(f.Value, e)
+		}
+	case *ast.AllocExpression:
+		if v.Init != nil {
+			c.uses(v.Init, e)
+		}
+	}
+}
+
+func (c *checker) call(call *ast.CallExpression, e env) {
+	builtin := false
+	if ident, ok := call.Function.(*ast.Identifier); ok {
+		builtin = ident.Value == "print" || ident.Value == "len"
+	} else {
+		c.uses(call.Function, e)
+	}
+	for _, arg := range call.Arguments {
+		c.uses(arg, e)
+		if !builtin {
+			c.escape(arg, e)
+		}
+	}
+}
+
+func (c *checker) use(ident *ast.Identifier, e env) {
+	obj, ok := e[ident.Value]
+	if !ok || obj.states&freed == 0 {
+		return
+	}
+	if obj.states == freed {
+		c.warn(UseAfterFree, ident.Token, "use of %s after it was freed at line %d", ident.Value, obj.freedAt.Line)
+	} else {
+		c.warn(UseAfterFree, ident.Token, "%s may be used after being freed at line %d", ident.Value, obj.freedAt.Line)
+	}
+}
+
+func isNull(expr ast.Expression) bool {
+	_, ok := expr.(*ast.NullLiteral)
+	return ok
+}
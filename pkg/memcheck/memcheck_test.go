@@ -0,0 +1,204 @@
+package memcheck
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+	"github.com/Dr-H-PhD/h-lang/pkg/parser"
+)
+
+func TestCheck_UseAfterFree(t *testing.T) {
+	input := `struct User { name string; }
+function main() {
+    u := alloc(User);
+    free(u);
+    print(u.name);
+}`
+
+	warnings := check(t, input)
+
+	assertWarning(t, warnings, UseAfterFree, 5, 11, "use of u after it was freed at line 4")
+}
+
+func TestCheck_DoubleFree(t *testing.T) {
+	input := `function main() {
+    p := alloc(int);
+    free(p);
+    free(p);
+}`
+
+	warnings := check(t, input)
+
+	assertWarning(t, warnings, DoubleFree, 4, 5, "double free of p")
+}
+
+func TestCheck_DoubleFreeOnOnePath(t *testing.T) {
+	input := `function main(c bool) {
+    p := alloc(int);
+    if c {
+        free(p);
+    }
+    free(p);
+}`
+
+	warnings := check(t, input)
+
+	assertWarning(t, warnings, DoubleFree, 6, 5, "p may already have been freed")
+}
+
+func TestCheck_FreeAndDefer(t *testing.T) {
+	input := `function main() {
+    p := alloc(int);
+    defer free(p);
+    free(p);
+}`
+
+	warnings := check(t, input)
+
+	assertWarning(t, warnings, DoubleFree, 4, 5, "freed here and again by the defer at line 3")
+}
+
+func TestCheck_LeakOnEarlyReturn(t *testing.T) {
+	input := `function work(c bool) int {
+    p := alloc(int);
+    if c {
+        return 1;
+    }
+    free(p);
+    return 0;
+}`
+
+	warnings := check(t, input)
+
+	assertWarning(t, warnings, Leak, 2, 10, "not freed before return at line 4")
+	if len(warnings) != 1 {
+		t.Errorf("expected 1 warning, got %d: %v", len(warnings), warnings)
+	}
+}
+
+func TestCheck_LeakAtFunctionEnd(t *testing.T) {
+	input := `function main() {
+    m := make([]int, 10);
+}`
+
+	warnings := check(t, input)
+
+	assertWarning(t, warnings, Leak, 2, 10, "not freed before the end of the function")
+}
+
+func TestCheck_HeapStructLiteral(t *testing.T) {
+	input := `struct Point { x int; }
+function main() {
+    p := &Point{x: 1};
+    q := alloc(Point{x: 2});
+    free(q);
+}`
+
+	warnings := check(t, input)
+
+	assertWarning(t, warnings, Leak, 3, 10, "allocation assigned to p")
+	if len(warnings) != 1 {
+		t.Errorf("expected 1 warning, got %d: %v", len(warnings), warnings)
+	}
+}
+
+func TestCheck_LeakInLoopBody(t *testing.T) {
+	input := `function main() {
+    for i := 0; i < 3; i++ {
+        p := alloc(int);
+    }
+}`
+
+	warnings := check(t, input)
+
+	assertWarning(t, warnings, Leak, 3, 14, "goes out of scope")
+}
+
+func TestCheck_LeakOnReassignment(t *testing.T) {
+	input := `function main() {
+    p := alloc(int);
+    p = alloc(int);
+    free(p);
+}`
+
+	warnings := check(t, input)
+
+	assertWarning(t, warnings, Leak, 3, 5, "leaks the allocation made at line 2")
+}
+
+func TestCheck_CleanPrograms(t *testing.T) {
+	inputs := []string{
+		`function main() {
+    p := alloc(int);
+    defer free(p);
+    *p = 1;
+    print(*p);
+}`,
+		`struct Node { value int; }
+function make_node() *Node {
+    n := alloc(Node);
+    return n;
+}`,
+		`function main() {
+    ages := map[string]int{"a": 1};
+    print(len(ages));
+    free(ages);
+}`,
+		`function main(c bool) {
+    p := alloc(int);
+    if c {
+        free(p);
+        return;
+    }
+    free(p);
+}`,
+		`function store(p *int) {}
+function main() {
+    p := alloc(int);
+    store(p);
+}`,
+		`function main() {
+    p := alloc(int);
+    free(p);
+    if p != null {
+        p = null;
+    }
+}`,
+		`var cache *int;
+function init() {
+    cache = alloc(int);
+}`,
+	}
+
+	for _, input := range inputs {
+		warnings := check(t, input)
+		if len(warnings) != 0 {
+			t.Errorf("expected no warnings for:\n%s\ngot: %v", input, warnings)
+		}
+	}
+}
+
+func check(t *testing.T, input string) []Warning {
+	t.Helper()
+
+	l := lexer.New(input)
+	p := parser.New(l)
+	program := p.ParseProgram()
+
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+
+	return Check(program)
+}
+
+func assertWarning(t *testing.T, warnings []Warning, kind Kind, line, column int, substr string) {
+	t.Helper()
+	for _, w := range warnings {
+		if w.Kind == kind && w.Line == line && w.Column == column && strings.Contains(w.Message, substr) {
+			return
+		}
+	}
+	t.Errorf("expected %s warning at %d:%d containing %q, got: %v", kind, line, column, substr, warnings)
+}
@@ -0,0 +1,105 @@
+package optimize
+
+import (
+	"fmt"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/analysis"
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+)
+
+// Comptime evaluates comptime expressions by running the code they call.
+// Package interp provides one for a module.
+type Comptime interface {
+	// Eval returns the value of an expression of the module's program.
+	// A problem is returned as an *Error; one without a line is in the
+	// expression itself rather than in the code it runs.
+	Eval(x ast.Expression) (Value, error)
+}
+
+// run evaluates a comptime expression of the module, once. An expression
+// that fails is not constant; its error is recorded, by whichever
+// evaluation needs its value first.
+func (e *evaluator) run(x ast.Expression) (Value, bool) {
+	if r, ok := e.values[x]; ok {
+		return r.value, r.ok
+	}
+	e.values[x] = &result{}
+	v, err := e.comptime.Eval(x)
+	if err != nil {
+		failed, ok := err.(*Error)
+		if !ok {
+			failed = &Error{Message: err.Error()}
+		}
+		if failed.Line == 0 {
+			failed = &Error{Line: tokenOf(x).Line, Message: failed.Message}
+		}
+		e.errs = append(e.errs, failed)
+		return Value{}, false
+	}
+	e.values[x] = &result{value: v, ok: true}
+	return v, true
+}
+
+// comptimeFunction returns the comptime function a callee names, or nil
+func (e *evaluator) comptimeFunction(callee ast.Expression) *ast.FunctionStatement {
+	id, ok := callee.(*ast.Identifier)
+	if !ok {
+		return nil
+	}
+	if obj := e.info.Uses[id]; obj != nil && obj.Kind == analysis.Func {
+		if fn := obj.Node.(*ast.FunctionStatement); fn.Comptime {
+			return fn
+		}
+	}
+	return nil
+}
+
+func errorf(x ast.Expression, format string, args ...interface{}) *Error {
+	return &Error{Line: tokenOf(x).Line, Message: fmt.Sprintf(format, args...)}
+}
+
+// staticAssertCall returns the call of a statement that is a call of the
+// static_assert builtin, or nil
+func staticAssertCall(info *analysis.Info, stmt ast.Statement) *ast.CallExpression {
+	s, ok := stmt.(*ast.ExpressionStatement)
+	if !ok {
+		return nil
+	}
+	call, ok := s.Expression.(*ast.CallExpression)
+	if !ok {
+		return nil
+	}
+	if id, ok := call.Function.(*ast.Identifier); ok && id.Value == "static_assert" && info.Uses[id] == nil {
+		return call
+	}
+	return nil
+}
+
+// StaticAssert checks a call of static_assert: that it has a condition
+// and an optional message, then the value of the condition, which eval
+// computes. A failed assertion is an *Error.
+func StaticAssert(call *ast.CallExpression, eval func(cond ast.Expression) (Value, error)) error {
+	switch len(call.Arguments) {
+	case 1:
+	case 2:
+		if _, ok := call.Arguments[1].(*ast.StringLiteral); !ok {
+			return errorf(call, "the message of static_assert must be a string literal")
+		}
+	default:
+		return errorf(call, "static_assert takes a condition and an optional message")
+	}
+	cond, err := eval(call.Arguments[0])
+	if err != nil {
+		return err
+	}
+	if cond.Kind != Bool {
+		return errorf(call, "static_assert condition %s is not a bool", call.Arguments[0].String())
+	}
+	if cond.Bool {
+		return nil
+	}
+	if len(call.Arguments) == 2 {
+		return errorf(call, "static assertion failed: %s", call.Arguments[1].(*ast.StringLiteral).Value)
+	}
+	return errorf(call, "static assertion failed: %s", call.Arguments[0].String())
+}
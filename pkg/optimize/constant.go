@@ -0,0 +1,538 @@
+package optimize
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/analysis"
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+)
+
+// Kind is the type of a constant
+type Kind int
+
+const (
+	Int Kind = iota
+	Float
+	Bool
+	String
+	Array // a fixed-size array, only computed at compile time
+)
+
+// Value is the value of a constant expression. Integers are C ints, so
+// they hold 32-bit values, but for those computed from literals too large
+// for an int, which are longs as in C; strings hold the source text
+// between the quotes, with escape sequences as written. Arrays share
+// their elements when copied, as they do when passed in C.
+type Value struct {
+	Kind  Kind
+	Int   int64
+	Long  bool // an integer of type long
+	Float float64
+	Bool  bool
+	Str   string
+	Elems []Value
+	Elem  *ast.TypeAnnotation // the element type of an array
+}
+
+func (v Value) String() string {
+	switch v.Kind {
+	case Int:
+		return strconv.FormatInt(v.Int, 10)
+	case Float:
+		return formatFloat(v.Float)
+	case Bool:
+		return strconv.FormatBool(v.Bool)
+	case Array:
+		elems := make([]string, len(v.Elems))
+		for i, elem := range v.Elems {
+			elems[i] = elem.String()
+		}
+		return "[" + strconv.Itoa(len(v.Elems)) + "]" + v.Elem.String() + "{" + strings.Join(elems, ", ") + "}"
+	}
+	return strconv.Quote(v.Str)
+}
+
+// formatFloat writes a float the way the lexer reads one back: always
+// with a decimal point
+func formatFloat(f float64) string {
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eEnN") {
+		s += ".0"
+	}
+	return s
+}
+
+func (v Value) float() float64 {
+	if v.Kind == Int {
+		return float64(v.Int)
+	}
+	return v.Float
+}
+
+// literal returns the expression for a value, spanning the source of the
+// expression it replaces
+func (v Value) literal(tok lexer.Token, node ast.Node) ast.Expression {
+	tok.Pos, tok.End = node.Pos(), node.End()
+	tok.Literal = v.String()
+	switch v.Kind {
+	case Int:
+		tok.Type = lexer.INT
+		return &ast.IntegerLiteral{Token: tok, Value: v.Int}
+	case Float:
+		tok.Type = lexer.FLOAT
+		return &ast.FloatLiteral{Token: tok, Value: v.Float}
+	case Bool:
+		if v.Bool {
+			tok.Type = lexer.TRUE
+		} else {
+			tok.Type = lexer.FALSE
+		}
+		return &ast.BooleanLiteral{Token: tok, Value: v.Bool}
+	case Array:
+		// [n]T{...}, spanning the replaced expression from its brackets to
+		// its closing brace
+		open, close := tok, tok
+		open.Type, open.Literal, open.End = lexer.LBRACKET, "[", tok.Pos+1
+		close.Type, close.Literal, close.Pos = lexer.RBRACE, "}", tok.End-1
+		lit := &ast.ArrayLiteral{
+			Token:  open,
+			Type:   &ast.TypeAnnotation{Token: open, Name: v.Elem.Name, ArrayLen: len(v.Elems), Elem: v.Elem},
+			Rbrace: close,
+		}
+		for _, elem := range v.Elems {
+			lit.Elements = append(lit.Elements, elem.literal(tok, node))
+		}
+		return lit
+	}
+	tok.Type = lexer.STRING
+	tok.Literal = v.Str
+	return &ast.StringLiteral{Token: tok, Value: v.Str}
+}
+
+// Error is a constant expression that cannot be evaluated, such as a
+// division by zero
+type Error struct {
+	Line    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// evaluator computes the values of constant expressions in one module
+type evaluator struct {
+	module *analysis.Module
+	info   *analysis.Info
+	enums  map[*ast.EnumValue]*ast.EnumStatement
+	values map[ast.Node]*result // constants, enum values and comptime expressions evaluated so far
+
+	comptime Comptime // runs comptime expressions
+	errs     []*Error // the errors of comptime expressions
+}
+
+type result struct {
+	value Value
+	ok    bool
+}
+
+// eval returns the value of an expression and whether it is constant. An
+// expression that would be constant but for a division by zero or an
+// overflow is not, and err says why; the error of an operand is returned
+// for the operand only, so each is reported once. The errors of comptime
+// expressions are recorded by run instead.
+func (e *evaluator) eval(expr ast.Expression) (Value, bool, *Error) {
+	switch x := expr.(type) {
+	case *ast.IntegerLiteral:
+		long := x.Value < math.MinInt32 || x.Value > math.MaxInt32
+		return Value{Kind: Int, Int: x.Value, Long: long}, true, nil
+	case *ast.FloatLiteral:
+		return Value{Kind: Float, Float: x.Value}, true, nil
+	case *ast.BooleanLiteral:
+		return Value{Kind: Bool, Bool: x.Value}, true, nil
+	case *ast.StringLiteral:
+		return Value{Kind: String, Str: x.Value}, true, nil
+	case *ast.Identifier:
+		v, ok := e.object(e.info.Uses[x])
+		return v, ok, nil
+	case *ast.PrefixExpression:
+		return e.prefix(x)
+	case *ast.InfixExpression:
+		return e.infix(x)
+	case *ast.CallExpression:
+		if e.comptimeFunction(x.Function) != nil {
+			v, ok := e.run(x)
+			return v, ok, nil
+		}
+		v, ok := e.len(x)
+		return v, ok, nil
+	case *ast.ComptimeExpression:
+		v, ok := e.run(x.Value)
+		return v, ok, nil
+	}
+	return Value{}, false, nil
+}
+
+// object returns the value of a constant or enum value a name refers to
+func (e *evaluator) object(obj *analysis.Object) (Value, bool) {
+	if obj == nil {
+		return Value{}, false
+	}
+	switch obj.Kind {
+	case analysis.Const, analysis.Global:
+		if c, ok := obj.Node.(*ast.ConstStatement); ok && untyped(c) {
+			// A value too large for the constant is reported where the
+			// constant is declared
+			return e.memo(c, func() (Value, bool) {
+				v, ok, _ := e.eval(c.Value)
+				return v, ok && fits(v, typeName(c.Type))
+			})
+		}
+	case analysis.EnumValue:
+		ev := obj.Node.(*ast.EnumValue)
+		if enum := e.enums[ev]; enum != nil {
+			return e.enumValue(enum, ev)
+		}
+	}
+	return Value{}, false
+}
+
+// untyped reports whether a constant's value has the type it is declared
+// with: it has no type or one the literal would be given anyway
+func untyped(c *ast.ConstStatement) bool {
+	if c.Type == nil {
+		return true
+	}
+	if !c.Type.IsNamed() {
+		return false
+	}
+	switch c.Type.Name {
+	case "int", "float", "bool", "string":
+		return true
+	}
+	return false
+}
+
+// enumValue returns the value of an enum value: its explicit value, or
+// one more than the value before it, as in C
+func (e *evaluator) enumValue(enum *ast.EnumStatement, ev *ast.EnumValue) (Value, bool) {
+	return e.memo(ev, func() (Value, bool) {
+		if ev.Value != nil {
+			v, ok, _ := e.eval(ev.Value)
+			return v, ok && v.Kind == Int
+		}
+		for i, other := range enum.Values {
+			if other != ev {
+				continue
+			}
+			if i == 0 {
+				return Value{Kind: Int}, true
+			}
+			prev, ok := e.enumValue(enum, enum.Values[i-1])
+			if !ok || prev.Int == math.MaxInt32 {
+				return Value{}, false
+			}
+			return Value{Kind: Int, Int: prev.Int + 1}, true
+		}
+		return Value{}, false
+	})
+}
+
+// memo evaluates the value of a declaration once. A declaration whose
+// value refers to itself is not constant.
+func (e *evaluator) memo(node ast.Node, f func() (Value, bool)) (Value, bool) {
+	if r, ok := e.values[node]; ok {
+		return r.value, r.ok
+	}
+	e.values[node] = &result{}
+	v, ok := f()
+	e.values[node] = &result{value: v, ok: ok}
+	return v, ok
+}
+
+// len returns the length of a fixed-size array
+func (e *evaluator) len(call *ast.CallExpression) (Value, bool) {
+	id, ok := call.Function.(*ast.Identifier)
+	if !ok || id.Value != "len" || e.info.Uses[id] != nil || len(call.Arguments) != 1 {
+		return Value{}, false
+	}
+	var typ *ast.TypeAnnotation
+	switch arg := call.Arguments[0].(type) {
+	case *ast.ArrayLiteral:
+		typ = arg.Type
+	case *ast.Identifier:
+		if obj := e.info.Uses[arg]; obj != nil {
+			typ = declaredType(obj)
+		}
+	}
+	if typ == nil || !typ.IsArray() {
+		return Value{}, false
+	}
+	if typ.Len != nil {
+		v, ok, _ := e.eval(typ.Len)
+		return v, ok && v.Kind == Int && v.Int > 0
+	}
+	return Value{Kind: Int, Int: int64(typ.ArrayLen)}, true
+}
+
+// declaredType returns the type a variable is declared with, or the type
+// of the array literal it is initialised with
+func declaredType(obj *analysis.Object) *ast.TypeAnnotation {
+	switch n := obj.Node.(type) {
+	case *ast.VarStatement:
+		if n.Type != nil {
+			return n.Type
+		}
+		if al, ok := n.Value.(*ast.ArrayLiteral); ok {
+			return al.Type
+		}
+	case *ast.InferStatement:
+		if al, ok := n.Value.(*ast.ArrayLiteral); ok {
+			return al.Type
+		}
+	case *ast.Parameter:
+		return n.Type
+	}
+	return nil
+}
+
+func (e *evaluator) prefix(x *ast.PrefixExpression) (Value, bool, *Error) {
+	v, ok, _ := e.eval(x.Right)
+	if !ok {
+		return Value{}, false, nil
+	}
+	return unary(x, v)
+}
+
+// unary applies the operator of a prefix expression to its operand's value
+func unary(x *ast.PrefixExpression, v Value) (Value, bool, *Error) {
+	switch {
+	case x.Operator == "-" && v.Kind == Int:
+		return integer(x, big.NewInt(0).Neg(big.NewInt(v.Int)), v.Long)
+	case x.Operator == "-" && v.Kind == Float:
+		return Value{Kind: Float, Float: -v.Float}, true, nil
+	case x.Operator == "!" && v.Kind == Bool:
+		return Value{Kind: Bool, Bool: !v.Bool}, true, nil
+	}
+	return Value{}, false, nil
+}
+
+func (e *evaluator) infix(x *ast.InfixExpression) (Value, bool, *Error) {
+	l, lok, _ := e.eval(x.Left)
+
+	// The right operand of && and || is not evaluated when the left one
+	// decides the result, so it need not be constant
+	if lok && l.Kind == Bool && (x.Operator == "&&" && !l.Bool || x.Operator == "||" && l.Bool) {
+		return l, true, nil
+	}
+
+	r, rok, _ := e.eval(x.Right)
+	if !lok || !rok {
+		return Value{}, false, nil
+	}
+	return binary(x, x.Operator, l, r)
+}
+
+// binary applies an operator to the values of its operands. x is the
+// expression it comes from, for errors.
+func binary(x ast.Expression, op string, l, r Value) (Value, bool, *Error) {
+	switch {
+	case l.Kind == Int && r.Kind == Int:
+		return intOp(x, op, l, r)
+	case (l.Kind == Int || l.Kind == Float) && (r.Kind == Int || r.Kind == Float):
+		return floatOp(x, op, l.float(), r.float())
+	case l.Kind == Bool && r.Kind == Bool:
+		switch op {
+		case "&&":
+			return Value{Kind: Bool, Bool: l.Bool && r.Bool}, true, nil
+		case "||":
+			return Value{Kind: Bool, Bool: l.Bool || r.Bool}, true, nil
+		case "==":
+			return Value{Kind: Bool, Bool: l.Bool == r.Bool}, true, nil
+		case "!=":
+			return Value{Kind: Bool, Bool: l.Bool != r.Bool}, true, nil
+		}
+	case l.Kind == String && r.Kind == String:
+		return stringOp(op, l.Str, r.Str)
+	}
+	return Value{}, false, nil
+}
+
+// intOp applies an arithmetic operator to ints, or to longs if either
+// operand is one, as C does, and compares them otherwise
+func intOp(x ast.Expression, op string, l, r Value) (Value, bool, *Error) {
+	a, b, n := big.NewInt(l.Int), big.NewInt(r.Int), new(big.Int)
+	long := l.Long || r.Long
+	switch op {
+	case "+":
+		return integer(x, n.Add(a, b), long)
+	case "-":
+		return integer(x, n.Sub(a, b), long)
+	case "*":
+		return integer(x, n.Mul(a, b), long)
+	case "/", "%":
+		if r.Int == 0 {
+			return Value{}, false, &Error{Line: tokenOf(x).Line, Message: "division by zero"}
+		}
+		if op == "/" {
+			return integer(x, n.Quo(a, b), long)
+		}
+		return integer(x, n.Rem(a, b), long)
+	}
+	return compare(op, float64(a.Cmp(b)), 0)
+}
+
+func floatOp(x ast.Expression, op string, a, b float64) (Value, bool, *Error) {
+	var f float64
+	switch op {
+	case "+":
+		f = a + b
+	case "-":
+		f = a - b
+	case "*":
+		f = a * b
+	case "/":
+		if b == 0 {
+			return Value{}, false, &Error{Line: tokenOf(x).Line, Message: "division by zero"}
+		}
+		f = a / b
+	default:
+		return compare(op, a, b)
+	}
+	if math.IsInf(f, 0) {
+		return Value{}, false, &Error{Line: tokenOf(x).Line, Message: fmt.Sprintf("constant %s overflows float", x.String())}
+	}
+	return Value{Kind: Float, Float: f}, true, nil
+}
+
+// integer checks that the result of an integer operation fits a C int,
+// or a long if it is one
+func integer(x ast.Expression, n *big.Int, long bool) (Value, bool, *Error) {
+	typ := "int"
+	if long {
+		typ = "long"
+	}
+	if !n.IsInt64() || !fits(Value{Kind: Int, Int: n.Int64()}, typ) {
+		return Value{}, false, &Error{Line: tokenOf(x).Line, Message: fmt.Sprintf("constant %s overflows %s", n, typ)}
+	}
+	return Value{Kind: Int, Int: n.Int64(), Long: long}, true, nil
+}
+
+// intRanges are the values each integer type holds, as far as an int64
+// does
+var intRanges = map[string][2]int64{
+	"int":    {math.MinInt32, math.MaxInt32},
+	"int8":   {math.MinInt8, math.MaxInt8},
+	"int16":  {math.MinInt16, math.MaxInt16},
+	"int32":  {math.MinInt32, math.MaxInt32},
+	"int64":  {math.MinInt64, math.MaxInt64},
+	"long":   {math.MinInt64, math.MaxInt64},
+	"uint8":  {0, math.MaxUint8},
+	"uint16": {0, math.MaxUint16},
+	"uint32": {0, math.MaxUint32},
+	"uint":   {0, math.MaxUint32},
+	"uint64": {0, math.MaxInt64},
+	"ulong":  {0, math.MaxInt64},
+	"usize":  {0, math.MaxInt64},
+}
+
+// fits reports whether an int constant fits the type it is used as; other
+// constants and types, such as float, are not checked
+func fits(v Value, typ string) bool {
+	r, ok := intRanges[typ]
+	return v.Kind != Int || !ok || r[0] <= v.Int && v.Int <= r[1]
+}
+
+// typeName returns the name of the type a constant is used as: its
+// declared type, or int if it has none
+func typeName(t *ast.TypeAnnotation) string {
+	switch {
+	case t == nil:
+		return "int"
+	case !t.IsNamed():
+		return ""
+	}
+	return t.Name
+}
+
+func compare(op string, a, b float64) (Value, bool, *Error) {
+	var r bool
+	switch op {
+	case "==":
+		r = a == b
+	case "!=":
+		r = a != b
+	case "<":
+		r = a < b
+	case ">":
+		r = a > b
+	case "<=":
+		r = a <= b
+	case ">=":
+		r = a >= b
+	default:
+		return Value{}, false, nil
+	}
+	return Value{Kind: Bool, Bool: r}, true, nil
+}
+
+// stringOp concatenates and compares strings. Escape sequences are kept as
+// written, so strings with escapes are only concatenated: "\x41" and "A"
+// differ as text but are equal.
+func stringOp(op, a, b string) (Value, bool, *Error) {
+	switch op {
+	case "+":
+		return Value{Kind: String, Str: a + b}, true, nil
+	case "==", "!=":
+		if strings.ContainsRune(a, '\\') || strings.ContainsRune(b, '\\') {
+			return Value{}, false, nil
+		}
+		return Value{Kind: Bool, Bool: (a == b) == (op == "==")}, true, nil
+	}
+	return Value{}, false, nil
+}
+
+// tokenOf returns the token an expression's source starts with, to give a
+// folded expression the line of the code it replaces
+func tokenOf(expr ast.Expression) lexer.Token {
+	switch x := expr.(type) {
+	case *ast.Identifier:
+		return x.Token
+	case *ast.IntegerLiteral:
+		return x.Token
+	case *ast.FloatLiteral:
+		return x.Token
+	case *ast.StringLiteral:
+		return x.Token
+	case *ast.BooleanLiteral:
+		return x.Token
+	case *ast.PrefixExpression:
+		return x.Token
+	case *ast.CharLiteral:
+		return x.Token
+	case *ast.ComptimeExpression:
+		return x.Token
+	case *ast.CastExpression:
+		return x.Lparen
+	case *ast.ArrayLiteral:
+		return x.Token
+	case *ast.InfixExpression:
+		return tokenOf(x.Left)
+	case *ast.CallExpression:
+		return tokenOf(x.Function)
+	case *ast.IndexExpression:
+		return tokenOf(x.Left)
+	case *ast.AssignExpression:
+		return tokenOf(x.Left)
+	case *ast.PostfixExpression:
+		return tokenOf(x.Left)
+	case *ast.MemberExpression:
+		return tokenOf(x.Object)
+	}
+	return lexer.Token{}
+}
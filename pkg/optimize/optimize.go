@@ -0,0 +1,327 @@
+// Package optimize simplifies H modules before code generation. It folds
+// constant expressions, including references to constants and enum values
+// and the lengths of fixed-size arrays, into literals, and removes code
+// that can never run: the branches of if statements and loops whose
+// conditions are constant, and statements after a return, break or
+// continue. Comptime expressions, which may call functions, are evaluated
+// by a Comptime, which runs the functions' code.
+package optimize
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/analysis"
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+)
+
+// Program returns the optimized program of a module, which must import the
+// already optimized programs of its imports. The module's program is not
+// modified. Comptime expressions and calls of comptime functions are
+// evaluated, static assertions checked and removed, and array lengths
+// given as expressions computed. Constant expressions that divide by zero
+// or overflow are returned as errors and left as they are, as are
+// comptime expressions that cannot be evaluated. Comptime functions are
+// kept as written, for the modules that import this one to call; they
+// are not meant to be compiled. The comptime code runs on comptime, which
+// must evaluate the module's expressions.
+func Program(module *analysis.Module, comptime Comptime) (*ast.Program, []error) {
+	info := analysis.ResolveModule(module)
+	e := &evaluator{
+		module:   module,
+		info:     info,
+		comptime: comptime,
+		enums:    make(map[*ast.EnumValue]*ast.EnumStatement),
+		values:   make(map[ast.Node]*result),
+	}
+	programs := []*ast.Program{module.Program}
+	for _, imp := range module.Imports {
+		programs = append(programs, imp.Program)
+	}
+	for _, p := range programs {
+		for _, stmt := range p.Statements {
+			if s, ok := stmt.(*ast.EnumStatement); ok {
+				for _, v := range s.Values {
+					e.enums[v] = s
+				}
+			}
+		}
+	}
+
+	var errs []*Error
+	// Names that are assigned to or have their address taken stay names.
+	// Static assertions are checked as written, outside comptime
+	// functions, which check theirs when they run.
+	keep := make(map[*ast.Identifier]bool)
+	for id := range info.Writes {
+		keep[id] = true
+	}
+	called := make(map[*ast.Identifier]bool)
+	ast.Inspect(module.Program, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FunctionStatement:
+			return !n.Comptime
+		case *ast.ExpressionStatement:
+			if call := staticAssertCall(info, n); call != nil {
+				e.staticAssert(call, &errs)
+			}
+		case *ast.PrefixExpression:
+			if id, ok := n.Right.(*ast.Identifier); ok && n.Operator == "&" {
+				keep[id] = true
+			}
+		case *ast.CallExpression:
+			if id, ok := n.Function.(*ast.Identifier); ok {
+				called[id] = true
+			}
+		case *ast.Identifier:
+			if e.comptimeFunction(n) != nil && !called[n] {
+				errs = append(errs, &Error{Line: n.Token.Line, Message: fmt.Sprintf("comptime function %s can only be called", n.Value)})
+			}
+		}
+		return true
+	})
+
+	rewrite := func(n ast.Node) ast.Node {
+		switch n := n.(type) {
+		case *ast.Identifier:
+			// Enum values keep their names, which give them their type;
+			// they are only folded as operands. Arrays are only written
+			// out where they are computed.
+			if obj := info.Uses[n]; obj == nil || obj.Kind == analysis.EnumValue || keep[n] {
+				return n
+			}
+			if v, ok, _ := e.eval(n); ok && v.Kind == Array {
+				return n
+			}
+			return e.fold(n, &errs)
+		case *ast.PrefixExpression, *ast.InfixExpression, *ast.CallExpression:
+			return e.fold(n.(ast.Expression), &errs)
+		case *ast.ComptimeExpression:
+			// The error is reported; the expression is compiled as if
+			// it were not comptime
+			if folded := e.fold(n, &errs); folded != n {
+				return folded
+			}
+			return n.Value
+		case *ast.TypeAnnotation:
+			if n.Len != nil {
+				return e.arrayLen(n, &errs)
+			}
+		case *ast.ExpressionStatement:
+			if staticAssertCall(info, n) != nil {
+				return nil
+			}
+		case *ast.BlockStatement:
+			return truncate(n)
+		case *ast.IfStatement:
+			return pruneIf(n)
+		case *ast.WhileStatement:
+			if isFalse(n.Condition) {
+				return nil
+			}
+		case *ast.ForStatement:
+			if isFalse(n.Condition) {
+				if n.Init == nil {
+					return nil
+				}
+				// The loop's initialisation still runs, in its own scope
+				return &ast.BlockStatement{Token: n.Token, Statements: []ast.Statement{n.Init}, Rbrace: n.Body.Rbrace}
+			}
+		case *ast.DeferStatement:
+			if n.Statement == nil {
+				return nil
+			}
+		}
+		return n
+	}
+
+	program := *module.Program
+	program.Statements = make([]ast.Statement, 0, len(module.Program.Statements))
+	for _, stmt := range module.Program.Statements {
+		// Comptime functions run as they are written, with their
+		// parameters known
+		if f, ok := stmt.(*ast.FunctionStatement); ok && f.Comptime {
+			program.Statements = append(program.Statements, stmt)
+			continue
+		}
+		if s := ast.Rewrite(stmt, rewrite); s != nil {
+			program.Statements = append(program.Statements, s.(ast.Statement))
+		}
+	}
+	// Each int constant, taken whole, must fit the type it is used as.
+	// They are folded by now, so a constant is mostly a literal. Array
+	// lengths were checked as they were computed.
+	types := e.usedAs(&program)
+	ast.Inspect(&program, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FunctionStatement:
+			return !n.Comptime
+		case *ast.TypeAnnotation:
+			return false
+		}
+		x, ok := n.(ast.Expression)
+		if !ok {
+			return true
+		}
+		v, ok, _ := e.eval(x)
+		if !ok {
+			return true
+		}
+		typ, known := types[x]
+		if !known {
+			typ = "int"
+		}
+		if !fits(v, typ) {
+			errs = append(errs, errorf(x, "constant %d overflows %s", v.Int, typ))
+		}
+		return false
+	})
+
+	// Errors are found in three passes, and by comptime whenever a
+	// comptime expression is first needed
+	errs = append(errs, e.errs...)
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].Line < errs[j].Line
+	})
+	var result []error
+	for _, err := range errs {
+		result = append(result, err)
+	}
+	return &program, result
+}
+
+// usedAs returns the types that the expressions of a program are used as,
+// where they are not int: the declared types of the variables and
+// constants they initialise or are assigned to, of the parameters they
+// are passed to and of the results they return, and the types they are
+// cast to. Each expression within one is used as the same type, as far as
+// this goes.
+func (e *evaluator) usedAs(program *ast.Program) map[ast.Expression]string {
+	types := make(map[ast.Expression]string)
+	use := func(x ast.Expression, t *ast.TypeAnnotation) {
+		if x == nil || t == nil {
+			return
+		}
+		ast.Inspect(x, func(n ast.Node) bool {
+			if x, ok := n.(ast.Expression); ok {
+				types[x] = typeName(t)
+			}
+			return true
+		})
+	}
+	ast.Inspect(program, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FunctionStatement:
+			if n.Body != nil {
+				ast.Inspect(n.Body, func(m ast.Node) bool {
+					if r, ok := m.(*ast.ReturnStatement); ok {
+						use(r.Value, n.ReturnType)
+					}
+					return true
+				})
+			}
+		case *ast.VarStatement:
+			use(n.Value, n.Type)
+		case *ast.ConstStatement:
+			use(n.Value, n.Type)
+		case *ast.AssignExpression:
+			if id, ok := n.Left.(*ast.Identifier); ok && e.info.Uses[id] != nil {
+				use(n.Value, declaredType(e.info.Uses[id]))
+			}
+		case *ast.CallExpression:
+			if id, ok := n.Function.(*ast.Identifier); ok && e.info.Uses[id] != nil && e.info.Uses[id].Kind == analysis.Func {
+				params := e.info.Uses[id].Node.(*ast.FunctionStatement).Parameters
+				for i, arg := range n.Arguments {
+					if i < len(params) {
+						use(arg, params[i].Type)
+					}
+				}
+			}
+		case *ast.CastExpression:
+			use(n.Value, n.TargetType)
+		}
+		return true
+	})
+	return types
+}
+
+// fold replaces a constant expression with its value
+func (e *evaluator) fold(expr ast.Expression, errs *[]*Error) ast.Node {
+	v, ok, err := e.eval(expr)
+	if err != nil {
+		*errs = append(*errs, err)
+	}
+	if !ok {
+		return expr
+	}
+	return v.literal(tokenOf(expr), expr)
+}
+
+// arrayLen replaces the length expression of an array type with its value
+func (e *evaluator) arrayLen(t *ast.TypeAnnotation, errs *[]*Error) ast.Node {
+	v, ok, _ := e.eval(t.Len)
+	ok = ok && fits(v, "int")
+	switch {
+	case !ok || v.Kind != Int:
+		*errs = append(*errs, &Error{Line: tokenOf(t.Len).Line, Message: fmt.Sprintf("array length %s is not a constant int", t.Len.String())})
+		return t
+	case v.Int <= 0:
+		*errs = append(*errs, &Error{Line: tokenOf(t.Len).Line, Message: fmt.Sprintf("array length %d is not positive", v.Int)})
+		return t
+	}
+	c := *t
+	c.ArrayLen, c.Len = int(v.Int), nil
+	return &c
+}
+
+// staticAssert checks a static assertion, whose condition must be constant
+func (e *evaluator) staticAssert(call *ast.CallExpression, errs *[]*Error) {
+	err := StaticAssert(call, func(cond ast.Expression) (Value, error) {
+		v, ok, _ := e.eval(cond)
+		if !ok {
+			return Value{}, errorf(call, "static_assert condition %s is not a constant", cond.String())
+		}
+		return v, nil
+	})
+	if err != nil {
+		*errs = append(*errs, err.(*Error))
+	}
+}
+
+// pruneIf replaces an if statement whose condition is constant with the
+// branch that runs, as a block so that its declarations keep their scope
+func pruneIf(s *ast.IfStatement) ast.Node {
+	b, ok := s.Condition.(*ast.BooleanLiteral)
+	if !ok {
+		return s
+	}
+	if b.Value {
+		return s.Consequence
+	}
+	if s.Alternative == nil {
+		return nil
+	}
+	return s.Alternative
+}
+
+func isFalse(cond ast.Expression) bool {
+	b, ok := cond.(*ast.BooleanLiteral)
+	return ok && !b.Value
+}
+
+// truncate removes the statements of a block that follow a return, break
+// or continue
+func truncate(b *ast.BlockStatement) *ast.BlockStatement {
+	for i, stmt := range b.Statements {
+		switch stmt.(type) {
+		case *ast.ReturnStatement, *ast.BreakStatement, *ast.ContinueStatement:
+			if i+1 < len(b.Statements) {
+				c := *b
+				c.Statements = b.Statements[: i+1 : i+1]
+				return &c
+			}
+			return b
+		}
+	}
+	return b
+}
@@ -0,0 +1,570 @@
+package optimize_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/analysis"
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+	"github.com/Dr-H-PhD/h-lang/pkg/interp"
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+	"github.com/Dr-H-PhD/h-lang/pkg/optimize"
+	"github.com/Dr-H-PhD/h-lang/pkg/parser"
+)
+
+func parse(t *testing.T, source string) *ast.Program {
+	t.Helper()
+	p := parser.New(lexer.New(source))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	return program
+}
+
+// optimizeSource optimizes a module whose imports are the given sources,
+// themselves optimized first
+func optimizeSource(t *testing.T, source string, imports map[string]string) (*ast.Program, []error) {
+	t.Helper()
+	module := &analysis.Module{Program: parse(t, source)}
+	for _, stmt := range module.Program.Statements {
+		if imp, ok := stmt.(*ast.ImportStatement); ok {
+			lib := &analysis.Module{Program: parse(t, imports[imp.Path])}
+			imported, errs := optimize.Program(lib, interp.NewComptime(lib))
+			if len(errs) > 0 {
+				t.Fatalf("%s: %v", imp.Path, errs)
+			}
+			module.Imports = append(module.Imports, &analysis.Import{Path: imp.Path, Program: imported, Via: imp})
+		}
+	}
+	return optimize.Program(module, interp.NewComptime(module))
+}
+
+// function returns the optimized function of a program
+func function(t *testing.T, program *ast.Program, name string) *ast.FunctionStatement {
+	t.Helper()
+	for _, stmt := range program.Statements {
+		if f, ok := stmt.(*ast.FunctionStatement); ok && f.Name.Value == name {
+			return f
+		}
+	}
+	t.Fatalf("no function %s", name)
+	return nil
+}
+
+// global returns the optimized value of a global of a program
+func global(t *testing.T, program *ast.Program, name string) string {
+	t.Helper()
+	for _, stmt := range program.Statements {
+		switch s := stmt.(type) {
+		case *ast.VarStatement:
+			if s.Name.Value == name {
+				return s.Value.String()
+			}
+		case *ast.ConstStatement:
+			if s.Name.Value == name {
+				return s.Value.String()
+			}
+		}
+	}
+	t.Fatalf("no global %s", name)
+	return ""
+}
+
+func TestProgram_Fold(t *testing.T) {
+	decls := `
+const SIZE := 4 * 1024;
+const HALF := SIZE / 2;
+const NAME := "h";
+const PI := 3.5;
+const DEBUG := false;
+enum Level { Low, Mid = 5, High }
+var counter int = 1;
+`
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"1 + 2 * 3", "7"},
+		{"(1 + 2) * 3", "9"},
+		{"7 / 2", "3"},
+		{"-7 / 2", "-3"},
+		{"-7 % 3", "-1"},
+		{"SIZE", "4096"},
+		{"HALF - 1", "2047"},
+		{"1 < 2 && 3 >= 3", "true"},
+		{"!DEBUG", "true"},
+		{"DEBUG && counter > 0", "false"},
+		{"!DEBUG || counter > 0", "true"},
+		{"counter > 0 && DEBUG", "((counter > 0) && false)"},
+		{"1 + 0.5", "1.5"},
+		{"PI * 2.0", "7.0"},
+		{"1.0 / 4.0", "0.25"},
+		{"NAME + \"-lang\"", "\"h-lang\""},
+		{"\"a\\n\" + \"b\"", "\"a\\nb\""},
+		{"NAME == \"h\"", "true"},
+		{"\"\\x41\" == \"A\"", "(\"\\x41\" == \"A\")"},
+		{"Level_High", "Level_High"},
+		{"Level_High + 1", "7"},
+		{"Level_Low == Level_Mid", "false"},
+		{"counter + SIZE", "(counter + 4096)"},
+		{"2147483647", "2147483647"},
+		{"len(\"abc\")", "len(\"abc\")"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			program, errs := optimizeSource(t, decls+"function main() {\n    x := "+tt.expr+";\n}\n", nil)
+			if len(errs) > 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			got := function(t, program, "main").Body.Statements[0].(*ast.InferStatement).Value.String()
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProgram_Len(t *testing.T) {
+	input := `var table [16]int;
+
+function sum(values [4]int, rest []int) int {
+    var local [3]int;
+    lit := [5]int{1, 2, 3, 4, 5};
+    return len(table) + len(values) + len(local) + len(lit) + len(rest);
+}`
+	program, errs := optimizeSource(t, input, nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	body := function(t, program, "sum").Body
+	got := body.Statements[len(body.Statements)-1].String()
+	if want := "return (28 + len(rest));"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestProgram_DeadCode(t *testing.T) {
+	input := `const DEBUG := false;
+
+function f(n int) int {
+    if DEBUG {
+        print("debug");
+    }
+    if !DEBUG {
+        print("release");
+    } else {
+        print("debug");
+    }
+    if n > 0 {
+        return 1;
+        print("after return");
+    }
+    while DEBUG {
+        print("loop");
+    }
+    for i := 0; false; i++ {
+        print(i);
+    }
+    while n > 0 {
+        n--;
+        continue;
+        n++;
+    }
+    return n;
+    print("after return");
+}`
+	program, errs := optimizeSource(t, input, nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	want := []string{
+		"{\n  print(\"release\");\n}",
+		"if (n > 0) {\n  return 1;\n}",
+		"{\n  i := 0;\n}",
+		"while (n > 0) {\n  (n--);\n  continue;\n}",
+		"return n;",
+	}
+	var got []string
+	for _, stmt := range function(t, program, "f").Body.Statements {
+		got = append(got, stmt.String())
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestProgram_Writes(t *testing.T) {
+	input := `const N := 3;
+
+function main() {
+    N = 4;
+    p := &N;
+}`
+	program, _ := optimizeSource(t, input, nil)
+	body := function(t, program, "main").Body
+	if got := body.Statements[0].String(); got != "(N = 4);" {
+		t.Errorf("assigned constant was replaced: %s", got)
+	}
+	if got := body.Statements[1].String(); got != "p := (&N);" {
+		t.Errorf("constant whose address is taken was replaced: %s", got)
+	}
+}
+
+func TestProgram_Imports(t *testing.T) {
+	imports := map[string]string{
+		"lib.hl": `public const K := 3 * 7;
+const HIDDEN := 1;
+public enum Level { Low, Mid = K, High }`,
+	}
+	input := `import "lib.hl";
+
+function main() {
+    a := K + 1;
+    b := Level_High * 2;
+    c := HIDDEN;
+}`
+	program, errs := optimizeSource(t, input, imports)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	var got []string
+	for _, stmt := range function(t, program, "main").Body.Statements {
+		got = append(got, stmt.String())
+	}
+	want := []string{"a := 22;", "b := 44;", "c := HIDDEN;"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestProgram_Errors(t *testing.T) {
+	input := `const BIG := 2147483647;
+
+function main() {
+    a := 10 / (5 - 5);
+    b := BIG + 1;
+    c := 1.5 % 0.0;
+    d := 7 % 0;
+    e := -(-2147483647 - 1);
+    f := 2.0 / 0.0;
+}`
+	_, errs := optimizeSource(t, input, nil)
+	var got []string
+	for _, err := range errs {
+		got = append(got, err.Error())
+	}
+	want := []string{
+		"line 4: division by zero",
+		"line 5: constant 2147483648 overflows int",
+		"line 7: division by zero",
+		"line 8: constant 2147483648 overflows int",
+		"line 9: division by zero",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// TestProgram_LongConstants checks that constants computed from literals
+// too large for an int are longs, which must fit the type they are used as
+func TestProgram_LongConstants(t *testing.T) {
+	input := `const BIG := 3000000000 * 4;
+const MIN := -2147483648;
+var far long = 3000000000 * 4;
+var small uint8 = 256;
+
+function twice(n int64) int64 {
+    return n * 2;
+}
+
+function main() int64 {
+    q := 3000000000 + 1;
+    far = 6000000000;
+    x := twice(7000000000) + BIG;
+    var f float = 3000000000;
+    q = (int)f + 3000000000 - 3000000000;
+    return 9223372036854775807 + 1;
+}`
+	program, errs := optimizeSource(t, input, nil)
+	var got []string
+	for _, err := range errs {
+		got = append(got, err.Error())
+	}
+	want := []string{
+		"line 1: constant 12000000000 overflows int",
+		"line 4: constant 256 overflows uint8",
+		"line 11: constant 3000000001 overflows int",
+		"line 15: constant 3000000000 overflows int",
+		"line 15: constant 3000000000 overflows int",
+		"line 16: constant 9223372036854775808 overflows long",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	for name, value := range map[string]string{"MIN": "-2147483648", "far": "12000000000"} {
+		if got := global(t, program, name); got != value {
+			t.Errorf("%s = %s, want %s", name, got, value)
+		}
+	}
+}
+
+func TestProgram_KeepsOriginal(t *testing.T) {
+	module := &analysis.Module{Program: parse(t, `function main() {
+    x := 1 + 2;
+    if false {
+        print(x);
+    }
+}`)}
+	before := module.Program.String()
+	program, _ := optimize.Program(module, interp.NewComptime(module))
+	if module.Program.String() != before {
+		t.Errorf("the original program was modified:\n%s", module.Program.String())
+	}
+	if program.String() == before {
+		t.Errorf("nothing was optimized")
+	}
+}
+
+func TestProgram_Comptime(t *testing.T) {
+	decls := `
+comptime function fib(n int) int {
+    if n < 2 {
+        return n;
+    }
+    return fib(n - 1) + fib(n - 2);
+}
+
+comptime function squares(n int) [4]int {
+    var out [4]int;
+    for i := 0; i < n; i++ {
+        out[i] = i * i;
+    }
+    return out;
+}
+
+function mean(values [4]int) float {
+    var sum float;
+    for _, v := range values {
+        sum += v;
+    }
+    return sum / (float)len(values);
+}
+
+function collatz(n int) int {
+    steps := 0;
+    while n != 1 {
+        if n % 2 == 0 {
+            n /= 2;
+        } else {
+            n = 3 * n + 1;
+        }
+        steps++;
+    }
+    return steps;
+}
+
+struct Box {
+    w int;
+    h int;
+}
+
+function area(n int) int {
+    b := alloc(Box);
+    b.w = n;
+    b.h = n + 1;
+    a := b.w * b.h;
+    free(b);
+    return a;
+}
+
+const N := fib(10);
+const TABLE := squares(3);
+const GRID := [2][2]int{{1, 2}, {3}};
+`
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"fib(7)", "13"},
+		{"N + 1", "56"},
+		{"comptime collatz(27)", "111"},
+		{"comptime mean([4]int{1, 2, 3, 5})", "2.75"},
+		{"comptime mean(TABLE)", "1.25"},
+		{"squares(2)", "[4]int{0, 1, 0, 0}"},
+		{"TABLE", "TABLE"},
+		{"comptime len(GRID)", "2"},
+		{"comptime (GRID[1][0] + GRID[1][1])", "3"},
+		{"comptime ((int)5.9 + (int)-2.5)", "3"},
+		{"comptime \"a\" + \"b\" == \"ab\"", "true"},
+		{"comptime area(3)", "12"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			program, errs := optimizeSource(t, decls+"function main() {\n    x := "+tt.expr+";\n}\n", nil)
+			if len(errs) > 0 {
+				t.Fatalf("unexpected errors: %v", errs)
+			}
+			got := function(t, program, "main").Body.Statements[0].(*ast.InferStatement).Value.String()
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProgram_ComptimeImports(t *testing.T) {
+	imports := map[string]string{
+		"lib.hl": `comptime function double(n int) int {
+    return n * 2;
+}
+
+public comptime function quadruple(n int) int {
+    return double(double(n));
+}
+
+public comptime function broken() int {
+    return 1 / 0;
+}`,
+	}
+	input := `import "lib.hl";
+
+const Q := quadruple(5);
+
+function main() {
+    a := Q;
+    b := comptime broken();
+}`
+	program, errs := optimizeSource(t, input, imports)
+	if got := function(t, program, "main").Body.Statements[0].String(); got != "a := 20;" {
+		t.Errorf("got %s, want a := 20;", got)
+	}
+	// The lines of the import are not reported
+	if len(errs) != 1 || errs[0].Error() != "line 7: broken: integer divide by zero" {
+		t.Errorf("unexpected errors %v", errs)
+	}
+}
+
+func TestProgram_ArrayLength(t *testing.T) {
+	input := `const N := 4;
+
+var grid [N * 2][N]int;
+
+function f(values [N]int) int {
+    local := [N]int{1, 2, 3, 4};
+    return len(values) + len(local);
+}`
+	program, errs := optimizeSource(t, input, nil)
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if got := program.Statements[1].String(); got != "var grid [8][4]int;" {
+		t.Errorf("got %s", got)
+	}
+	f := function(t, program, "f")
+	if got := f.Parameters[0].Type; got.ArrayLen != 4 || got.Len != nil {
+		t.Errorf("the parameter's length was not evaluated: %+v", got)
+	}
+	if got := f.Body.Statements[1].String(); got != "return 8;" {
+		t.Errorf("got %s, want return 8;", got)
+	}
+}
+
+func TestProgram_StaticAssert(t *testing.T) {
+	input := `const N := 4;
+
+comptime function check(n int) int {
+    static_assert(n > 0, "n must be positive");
+    return n;
+}
+
+static_assert(N == 4);
+static_assert(N > 4, "N is too small");
+static_assert(N == 5);
+
+function main(n int) {
+    static_assert(check(N) == N);
+    static_assert(n > 0);
+    x := check(-1);
+}`
+	program, errs := optimizeSource(t, input, nil)
+	var got []string
+	for _, err := range errs {
+		got = append(got, err.Error())
+	}
+	want := []string{
+		"line 4: static assertion failed: n must be positive",
+		"line 9: static assertion failed: N is too small",
+		"line 10: static assertion failed: (N == 5)",
+		"line 14: static_assert condition (n > 0) is not a constant",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	for _, stmt := range program.Statements {
+		if strings.Contains(stmt.String(), "static_assert") && !strings.Contains(stmt.String(), "comptime") {
+			t.Errorf("static assertion left in %s", stmt)
+		}
+	}
+}
+
+func TestProgram_ComptimeErrors(t *testing.T) {
+	input := `var counter int = 0;
+
+comptime function forever() int {
+    while true {
+    }
+    return 0;
+}
+
+comptime function down(n int) int {
+    return down(n - 1);
+}
+
+comptime function get(i int) int {
+    var a [3]int;
+    return a[i];
+}
+
+comptime function nothing(n int) int {
+    if n > 0 {
+        return n;
+    }
+}
+
+comptime function uses() int {
+    return counter;
+}
+
+var sizes [get(0)]int;
+
+function main(n int) {
+    a := comptime forever();
+    b := comptime down(0);
+    c := get(3);
+    d := nothing(0);
+    e := uses();
+    f := get;
+    g := get(n);
+    h := comptime print(1);
+}`
+	_, errs := optimizeSource(t, input, nil)
+	var got []string
+	for _, err := range errs {
+		got = append(got, err.Error())
+	}
+	want := []string{
+		"line 10: compile-time calls nested more than 1000 deep",
+		"line 15: index 3 out of range for 3 elements",
+		"line 25: counter is not known at compile time",
+		"line 28: array length 0 is not positive",
+		"line 31: compile-time evaluation did not finish in 10000000 steps",
+		"line 34: nothing ended without returning a value",
+		"line 36: comptime function get can only be called",
+		"line 37: n is not known at compile time",
+		"line 38: print(1) cannot be evaluated at compile time",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -3,6 +3,7 @@ package parser
 import (
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/Dr-H-PhD/h-lang/pkg/ast"
 	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
@@ -59,6 +60,11 @@ type Parser struct {
 
 	curToken  lexer.Token
 	peekToken lexer.Token
+	comments  []*ast.Comment
+
+	// noStructLiteral is set while parsing if/for/while headers, where
+	// `ident {` starts the body rather than a struct literal
+	noStructLiteral bool
 
 	prefixParseFns map[lexer.TokenType]prefixParseFn
 	infixParseFns  map[lexer.TokenType]infixParseFn
@@ -138,8 +144,13 @@ func (p *Parser) nextToken() {
 	p.curToken = p.peekToken
 	p.peekToken = p.l.NextToken()
 
-	// Skip comments
+	// Comments are collected rather than parsed; the current token is
+	// the one before the comment
 	for p.peekToken.Type == lexer.COMMENT {
+		p.comments = append(p.comments, &ast.Comment{
+			Token:    p.peekToken,
+			Trailing: p.curToken.Line == p.peekToken.Line,
+		})
 		p.peekToken = p.l.NextToken()
 	}
 }
@@ -198,6 +209,7 @@ func (p *Parser) ParseProgram() *ast.Program {
 		p.nextToken()
 	}
 
+	program.Comments = p.comments
 	return program
 }
 
@@ -211,15 +223,18 @@ func (p *Parser) parseStatement() ast.Statement {
 	case lexer.IMPORT:
 		return p.parseImportStatement()
 	case lexer.PUBLIC:
-		return p.parsePublicStatement()
+		doc := p.docComment(p.curToken.Line)
+		return documented(p.parsePublicStatement(), doc)
 	case lexer.FUNCTION:
-		return p.parseFunctionStatement(false)
+		doc := p.docComment(p.curToken.Line)
+		return documented(p.parseFunctionStatement(false), doc)
 	case lexer.STRUCT:
-		return p.parseStructStatement(false)
+		doc := p.docComment(p.curToken.Line)
+		return documented(p.parseStructStatement(false), doc)
 	case lexer.VAR:
-		return p.parseVarStatement()
+		return p.parseVarStatement(false)
 	case lexer.CONST:
-		return p.parseConstStatement()
+		return p.parseConstStatement(false)
 	case lexer.RETURN:
 		return p.parseReturnStatement()
 	case lexer.IF:
@@ -237,19 +252,151 @@ func (p *Parser) parseStatement() ast.Statement {
 	case lexer.CONTINUE:
 		return p.parseContinueStatement()
 	case lexer.ENUM:
-		return p.parseEnumStatement(false)
+		doc := p.docComment(p.curToken.Line)
+		return documented(p.parseEnumStatement(false), doc)
 	case lexer.DELETE:
 		return p.parseDeleteStatement()
 	case lexer.IDENT:
 		if p.peekTokenIs(lexer.WALRUS) {
 			return p.parseInferStatement()
 		}
+		// test is not a keyword, so that it stays usable as a name
+		if p.curToken.Literal == "test" && p.peekTokenIs(lexer.STRING) {
+			return p.parseTestStatement()
+		}
+		// Neither are the words of the C interface
+		if p.curToken.Literal == "extern" && (p.peekTokenIs(lexer.FUNCTION) || p.peekTokenIs(lexer.STRUCT)) {
+			doc := p.docComment(p.curToken.Line)
+			return documented(p.parseExternStatement(false), doc)
+		}
+		// Nor is comptime
+		if p.curToken.Literal == "comptime" && p.peekTokenIs(lexer.FUNCTION) {
+			doc := p.docComment(p.curToken.Line)
+			return documented(p.parseComptimeFunction(false), doc)
+		}
+		if p.curToken.Literal == "cinclude" && p.peekTokenIs(lexer.STRING) {
+			return p.parseCIncludeStatement()
+		}
+		if p.curToken.Literal == "link" && p.peekTokenIs(lexer.STRING) {
+			return p.parseLinkStatement()
+		}
 		return p.parseExpressionStatement()
 	default:
 		return p.parseExpressionStatement()
 	}
 }
 
+// docComment returns the doc comment of a declaration starting on line:
+// the run of comments on their own lines that ends on the line above it
+func (p *Parser) docComment(line int) string {
+	var lines []string
+	next := line
+	for i := len(p.comments) - 1; i >= 0; i-- {
+		c := p.comments[i]
+		if c.Token.Line >= line {
+			// Collected ahead of the declaration's first token
+			continue
+		}
+		end := c.Token.Line + strings.Count(c.Token.Literal, "\n")
+		if c.Trailing || end != next-1 {
+			break
+		}
+		lines = append(commentLines(c.Token.Literal), lines...)
+		next = c.Token.Line
+	}
+	return strings.Join(lines, "\n")
+}
+
+// lineComment returns the text of a comment after code on line, if any
+func (p *Parser) lineComment(line int) string {
+	for i := len(p.comments) - 1; i >= 0 && p.comments[i].Token.Line >= line; i-- {
+		if c := p.comments[i]; c.Trailing && c.Token.Line == line {
+			return strings.Join(commentLines(c.Token.Literal), "\n")
+		}
+	}
+	return ""
+}
+
+// commentLines returns the lines of a comment's text, dropping the space
+// after a line comment's marker and the margin of a block comment
+func commentLines(text string) []string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "*") && !strings.HasPrefix(line, "*/") {
+			line = strings.TrimSpace(line[1:])
+		}
+		lines = append(lines, line)
+	}
+	for len(lines) > 0 && lines[0] == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// documented sets the doc comment of a declaration
+func documented(stmt ast.Statement, doc string) ast.Statement {
+	switch s := stmt.(type) {
+	case *ast.FunctionStatement:
+		if s != nil {
+			s.Doc = doc
+		}
+	case *ast.StructStatement:
+		if s != nil {
+			s.Doc = doc
+		}
+	case *ast.EnumStatement:
+		if s != nil {
+			s.Doc = doc
+		}
+	}
+	return stmt
+}
+
+// modified records the first modifier of a declaration, such as public,
+// where the declaration starts
+func modified(stmt ast.Statement, modifier lexer.Token) ast.Statement {
+	switch s := stmt.(type) {
+	case *ast.FunctionStatement:
+		if s != nil {
+			s.Modifier = modifier
+		}
+	case *ast.StructStatement:
+		if s != nil {
+			s.Modifier = modifier
+		}
+	case *ast.EnumStatement:
+		if s != nil {
+			s.Modifier = modifier
+		}
+	case *ast.VarStatement:
+		if s != nil {
+			s.Modifier = modifier
+		}
+	case *ast.ConstStatement:
+		if s != nil {
+			s.Modifier = modifier
+		}
+	}
+	return stmt
+}
+
+// parseTestStatement parses test "name" { ... }
+func (p *Parser) parseTestStatement() *ast.TestStatement {
+	stmt := &ast.TestStatement{Token: p.curToken}
+	p.nextToken()
+	stmt.Name = p.curToken.Literal
+
+	if !p.expectPeek(lexer.LBRACE) {
+		return nil
+	}
+	stmt.Body = p.parseBlockStatement()
+	return stmt
+}
+
 func (p *Parser) parseImportStatement() *ast.ImportStatement {
 	stmt := &ast.ImportStatement{Token: p.curToken}
 
@@ -258,6 +405,7 @@ func (p *Parser) parseImportStatement() *ast.ImportStatement {
 	}
 
 	stmt.Path = p.curToken.Literal
+	stmt.PathToken = p.curToken
 
 	if p.peekTokenIs(lexer.SEMICOLON) {
 		p.nextToken()
@@ -267,15 +415,28 @@ func (p *Parser) parseImportStatement() *ast.ImportStatement {
 }
 
 func (p *Parser) parsePublicStatement() ast.Statement {
+	public := p.curToken
 	p.nextToken() // consume 'public'
 
 	switch p.curToken.Type {
 	case lexer.FUNCTION:
-		return p.parseFunctionStatement(true)
+		return modified(p.parseFunctionStatement(true), public)
 	case lexer.STRUCT:
-		return p.parseStructStatement(true)
+		return modified(p.parseStructStatement(true), public)
 	case lexer.ENUM:
-		return p.parseEnumStatement(true)
+		return modified(p.parseEnumStatement(true), public)
+	case lexer.VAR:
+		return modified(p.parseVarStatement(true), public)
+	case lexer.CONST:
+		return modified(p.parseConstStatement(true), public)
+	case lexer.IDENT:
+		if p.curToken.Literal == "extern" && (p.peekTokenIs(lexer.FUNCTION) || p.peekTokenIs(lexer.STRUCT)) {
+			return modified(p.parseExternStatement(true), public)
+		}
+		if p.curToken.Literal == "comptime" && p.peekTokenIs(lexer.FUNCTION) {
+			return modified(p.parseComptimeFunction(true), public)
+		}
+		fallthrough
 	default:
 		p.errors = append(p.errors, fmt.Sprintf("line %d: unexpected token after 'public': %s",
 			p.curToken.Line, p.curToken.Type))
@@ -318,7 +479,11 @@ func (p *Parser) parseFunctionStatement(public bool) *ast.FunctionStatement {
 	if !p.expectPeek(lexer.LPAREN) {
 		return nil
 	}
-	stmt.Parameters = p.parseFunctionParameters()
+	stmt.Parameters, stmt.Variadic = p.parseFunctionParameters()
+	stmt.Rparen = p.curToken
+	if stmt.Variadic {
+		p.errors = append(p.errors, fmt.Sprintf("line %d: only extern functions can take ...", stmt.Token.Line))
+	}
 
 	// Return type (optional)
 	if !p.peekTokenIs(lexer.LBRACE) {
@@ -335,15 +500,116 @@ func (p *Parser) parseFunctionStatement(public bool) *ast.FunctionStatement {
 	return stmt
 }
 
-func (p *Parser) parseFunctionParameters() []*ast.Parameter {
+// parseExternStatement parses the declaration of a C function or struct:
+// extern function name(params) result; or extern struct Name; or
+// extern struct Name { fields }
+func (p *Parser) parseExternStatement(public bool) ast.Statement {
+	extern := p.curToken
+	p.nextToken() // consume 'extern'
+
+	if p.curTokenIs(lexer.STRUCT) {
+		stmt := &ast.StructStatement{Token: p.curToken, Modifier: extern, Public: public, Extern: true}
+		if !p.expectPeek(lexer.IDENT) {
+			return nil
+		}
+		stmt.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+		if p.peekTokenIs(lexer.LBRACE) {
+			p.nextToken()
+			stmt.Fields = p.parseStructFields()
+		} else if p.peekTokenIs(lexer.SEMICOLON) {
+			p.nextToken()
+		}
+		stmt.Rbrace = p.curToken
+		return stmt
+	}
+
+	stmt := &ast.FunctionStatement{Token: p.curToken, Modifier: extern, Public: public, Extern: true}
+	if !p.expectPeek(lexer.IDENT) {
+		return nil
+	}
+	stmt.Name = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	if !p.expectPeek(lexer.LPAREN) {
+		return nil
+	}
+	stmt.Parameters, stmt.Variadic = p.parseFunctionParameters()
+	stmt.Rparen = p.curToken
+
+	// The result type, if any, is on the same line
+	if p.peekStartsType() && p.peekToken.Line == p.curToken.Line {
+		p.nextToken()
+		stmt.ReturnType = p.parseTypeAnnotation()
+	}
+	if p.peekTokenIs(lexer.LBRACE) {
+		p.errors = append(p.errors, fmt.Sprintf("line %d: extern function %s cannot have a body",
+			p.peekToken.Line, stmt.Name.Value))
+		p.nextToken()
+		p.parseBlockStatement()
+		return nil
+	}
+	if p.peekTokenIs(lexer.SEMICOLON) {
+		p.nextToken()
+	}
+	return stmt
+}
+
+// parseComptimeFunction parses comptime function name(params) result { },
+// a function the compiler runs
+func (p *Parser) parseComptimeFunction(public bool) ast.Statement {
+	comptime := p.curToken
+	p.nextToken() // consume 'comptime'
+
+	stmt := p.parseFunctionStatement(public)
+	if stmt == nil {
+		return nil
+	}
+	if stmt.Receiver != nil {
+		p.errors = append(p.errors, fmt.Sprintf("line %d: method %s cannot be comptime",
+			stmt.Token.Line, stmt.Name.Value))
+		return nil
+	}
+	stmt.Modifier = comptime
+	stmt.Comptime = true
+	return stmt
+}
+
+// parseCIncludeStatement parses cinclude "header.h";
+func (p *Parser) parseCIncludeStatement() *ast.CIncludeStatement {
+	stmt := &ast.CIncludeStatement{Token: p.curToken}
+	p.nextToken()
+	stmt.Path = p.curToken.Literal
+	stmt.PathToken = p.curToken
+	if p.peekTokenIs(lexer.SEMICOLON) {
+		p.nextToken()
+	}
+	return stmt
+}
+
+// parseLinkStatement parses link "library";
+func (p *Parser) parseLinkStatement() *ast.LinkStatement {
+	stmt := &ast.LinkStatement{Token: p.curToken}
+	p.nextToken()
+	stmt.Library = p.curToken.Literal
+	stmt.LibraryToken = p.curToken
+	if p.peekTokenIs(lexer.SEMICOLON) {
+		p.nextToken()
+	}
+	return stmt
+}
+
+// parseFunctionParameters parses a parameter list and reports whether it
+// ends with ...
+func (p *Parser) parseFunctionParameters() ([]*ast.Parameter, bool) {
 	params := []*ast.Parameter{}
 
 	if p.peekTokenIs(lexer.RPAREN) {
 		p.nextToken()
-		return params
+		return params, false
 	}
 
 	p.nextToken()
+	if p.curTokenIs(lexer.ELLIPSIS) {
+		return params, p.expectPeek(lexer.RPAREN)
+	}
 
 	param := &ast.Parameter{
 		Name: &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal},
@@ -356,6 +622,11 @@ func (p *Parser) parseFunctionParameters() []*ast.Parameter {
 		p.nextToken() // comma
 		p.nextToken() // param name
 
+		// ... ends the list
+		if p.curTokenIs(lexer.ELLIPSIS) {
+			return params, p.expectPeek(lexer.RPAREN)
+		}
+
 		param := &ast.Parameter{
 			Name: &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal},
 		}
@@ -365,23 +636,24 @@ func (p *Parser) parseFunctionParameters() []*ast.Parameter {
 	}
 
 	if !p.expectPeek(lexer.RPAREN) {
-		return nil
+		return nil, false
 	}
 
-	return params
+	return params, false
 }
 
 func (p *Parser) parseTypeAnnotation() *ast.TypeAnnotation {
 	typeAnn := &ast.TypeAnnotation{Token: p.curToken}
 
-	// Check for pointer
-	if p.curTokenIs(lexer.ASTERISK) {
+	switch p.curToken.Type {
+	case lexer.ASTERISK:
+		// Pointer: *Elem
 		typeAnn.IsPtr = true
 		p.nextToken()
-	}
+		typeAnn.Elem = p.parseTypeAnnotation()
 
-	// Check for map type: map[KeyType]ValueType
-	if p.curTokenIs(lexer.MAP) {
+	case lexer.MAP:
+		// Map type: map[KeyType]ValueType
 		typeAnn.IsMap = true
 		if !p.expectPeek(lexer.LBRACKET) {
 			return nil
@@ -393,26 +665,132 @@ func (p *Parser) parseTypeAnnotation() *ast.TypeAnnotation {
 		}
 		p.nextToken() // move to value type
 		typeAnn.ValueType = p.parseTypeAnnotation()
+		if typeAnn.KeyType == nil || typeAnn.ValueType == nil {
+			return nil
+		}
 		return typeAnn
-	}
 
-	// Check for array/slice
-	if p.curTokenIs(lexer.LBRACKET) {
+	case lexer.LBRACKET:
+		// Array or slice: [N]Elem or []Elem
 		p.nextToken()
 		if p.curTokenIs(lexer.RBRACKET) {
 			typeAnn.ArrayLen = -1 // slice
-		} else if p.curTokenIs(lexer.INT) {
+		} else if p.curTokenIs(lexer.INT) && p.peekTokenIs(lexer.RBRACKET) {
 			len, _ := strconv.Atoi(p.curToken.Literal)
 			typeAnn.ArrayLen = len
-			p.nextToken() // consume number
+			p.nextToken()
+		} else if p.prefixParseFns[p.curToken.Type] != nil {
+			// A constant expression, evaluated by the compiler
+			typeAnn.Len = p.parseExpression(LOWEST)
+			if typeAnn.Len == nil || !p.expectPeek(lexer.RBRACKET) {
+				return nil
+			}
+		} else {
+			p.errors = append(p.errors, fmt.Sprintf("line %d: expected array length, got %s",
+				p.curToken.Line, p.curToken.Literal))
+			return nil
+		}
+		p.nextToken() // move to element type
+		typeAnn.Elem = p.parseTypeAnnotation()
+
+	case lexer.FUNCTION:
+		// Function type: function(int, string) bool
+		typeAnn.IsFunc = true
+		if !p.expectPeek(lexer.LPAREN) {
+			return nil
+		}
+		typeAnn.Params = p.parseFunctionTypeParameters()
+		if typeAnn.Params == nil {
+			return nil
+		}
+		typeAnn.Rparen = p.curToken
+		if p.peekStartsType() {
+			p.nextToken()
+			typeAnn.ReturnType = p.parseTypeAnnotation()
+			if typeAnn.ReturnType == nil {
+				return nil
+			}
 		}
-		p.nextToken() // consume ]
+		return typeAnn
+
+	default:
+		typeAnn.Name = p.curToken.Literal
+		return typeAnn
 	}
 
-	typeAnn.Name = p.curToken.Literal
+	if typeAnn.Elem == nil {
+		return nil
+	}
+	typeAnn.Name = typeAnn.Elem.Name
 	return typeAnn
 }
 
+// parseFunctionTypeParameters parses the parenthesised parameter types of
+// a function type; the current token is the opening parenthesis
+func (p *Parser) parseFunctionTypeParameters() []*ast.TypeAnnotation {
+	params := []*ast.TypeAnnotation{}
+
+	if p.peekTokenIs(lexer.RPAREN) {
+		p.nextToken()
+		return params
+	}
+
+	p.nextToken()
+	param := p.parseTypeAnnotation()
+	if param == nil {
+		return nil
+	}
+	params = append(params, param)
+
+	for p.peekTokenIs(lexer.COMMA) {
+		p.nextToken() // comma
+		p.nextToken() // next type
+		param := p.parseTypeAnnotation()
+		if param == nil {
+			return nil
+		}
+		params = append(params, param)
+	}
+
+	if !p.expectPeek(lexer.RPAREN) {
+		return nil
+	}
+
+	return params
+}
+
+// peekStartsOperand reports whether the next token begins an operand that
+// comptime applies to. Only a parenthesis could also follow a name, so a
+// function named comptime cannot be called.
+func (p *Parser) peekStartsOperand() bool {
+	switch p.peekToken.Type {
+	case lexer.IDENT, lexer.INT, lexer.FLOAT, lexer.STRING, lexer.CHAR,
+		lexer.TRUE, lexer.FALSE, lexer.LEN, lexer.BANG, lexer.LPAREN:
+		return true
+	}
+	return false
+}
+
+// curStartsType reports whether the current token can begin a type
+func (p *Parser) curStartsType() bool {
+	return startsType(p.curToken.Type)
+}
+
+// peekStartsType reports whether the next token can begin a type
+func (p *Parser) peekStartsType() bool {
+	return startsType(p.peekToken.Type)
+}
+
+func startsType(t lexer.TokenType) bool {
+	switch t {
+	case lexer.IDENT, lexer.TYPE_INT, lexer.TYPE_FLOAT, lexer.TYPE_STRING,
+		lexer.TYPE_CHAR, lexer.TYPE_BOOL, lexer.TYPE_VOID,
+		lexer.ASTERISK, lexer.LBRACKET, lexer.MAP, lexer.FUNCTION:
+		return true
+	}
+	return false
+}
+
 func (p *Parser) parseStructStatement(public bool) *ast.StructStatement {
 	stmt := &ast.StructStatement{Token: p.curToken, Public: public}
 
@@ -426,6 +804,7 @@ func (p *Parser) parseStructStatement(public bool) *ast.StructStatement {
 	}
 
 	stmt.Fields = p.parseStructFields()
+	stmt.Rbrace = p.curToken
 
 	return stmt
 }
@@ -434,12 +813,17 @@ func (p *Parser) parseStructFields() []*ast.StructField {
 	fields := []*ast.StructField{}
 
 	for !p.peekTokenIs(lexer.RBRACE) && !p.peekTokenIs(lexer.EOF) {
+		prev := p.curToken
 		p.nextToken()
 
 		field := &ast.StructField{}
+		if p.curToken.Line > prev.Line {
+			field.Doc = p.docComment(p.curToken.Line)
+		}
 
 		if p.curTokenIs(lexer.PUBLIC) {
 			field.Public = true
+			field.Modifier = p.curToken
 			p.nextToken()
 		}
 
@@ -451,6 +835,9 @@ func (p *Parser) parseStructFields() []*ast.StructField {
 		if p.peekTokenIs(lexer.SEMICOLON) {
 			p.nextToken()
 		}
+		if field.Doc == "" {
+			field.Doc = p.lineComment(field.Name.Token.Line)
+		}
 
 		fields = append(fields, field)
 	}
@@ -472,6 +859,7 @@ func (p *Parser) parseEnumStatement(public bool) *ast.EnumStatement {
 	}
 
 	stmt.Values = p.parseEnumValues()
+	stmt.Rbrace = p.curToken
 
 	return stmt
 }
@@ -480,11 +868,15 @@ func (p *Parser) parseEnumValues() []*ast.EnumValue {
 	values := []*ast.EnumValue{}
 
 	for !p.peekTokenIs(lexer.RBRACE) && !p.peekTokenIs(lexer.EOF) {
+		prev := p.curToken
 		p.nextToken()
 
 		value := &ast.EnumValue{
 			Name: &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal},
 		}
+		if p.curToken.Line > prev.Line {
+			value.Doc = p.docComment(p.curToken.Line)
+		}
 
 		// Check for explicit value: Red = 1
 		if p.peekTokenIs(lexer.ASSIGN) {
@@ -499,6 +891,9 @@ func (p *Parser) parseEnumValues() []*ast.EnumValue {
 		if p.peekTokenIs(lexer.COMMA) {
 			p.nextToken()
 		}
+		if value.Doc == "" {
+			value.Doc = p.lineComment(value.Name.Token.Line)
+		}
 	}
 
 	p.nextToken() // consume }
@@ -509,6 +904,10 @@ func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 	block := &ast.BlockStatement{Token: p.curToken}
 	block.Statements = []ast.Statement{}
 
+	prev := p.noStructLiteral
+	p.noStructLiteral = false
+	defer func() { p.noStructLiteral = prev }()
+
 	p.nextToken()
 
 	for !p.curTokenIs(lexer.RBRACE) && !p.curTokenIs(lexer.EOF) {
@@ -518,12 +917,13 @@ func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 		}
 		p.nextToken()
 	}
+	block.Rbrace = p.curToken
 
 	return block
 }
 
-func (p *Parser) parseVarStatement() *ast.VarStatement {
-	stmt := &ast.VarStatement{Token: p.curToken}
+func (p *Parser) parseVarStatement(public bool) *ast.VarStatement {
+	stmt := &ast.VarStatement{Token: p.curToken, Public: public}
 
 	if !p.expectPeek(lexer.IDENT) {
 		return nil
@@ -548,8 +948,8 @@ func (p *Parser) parseVarStatement() *ast.VarStatement {
 	return stmt
 }
 
-func (p *Parser) parseConstStatement() *ast.ConstStatement {
-	stmt := &ast.ConstStatement{Token: p.curToken}
+func (p *Parser) parseConstStatement(public bool) *ast.ConstStatement {
+	stmt := &ast.ConstStatement{Token: p.curToken, Public: public}
 
 	if !p.expectPeek(lexer.IDENT) {
 		return nil
@@ -604,11 +1004,21 @@ func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 	return stmt
 }
 
+// parseHeaderExpression parses a control-flow condition, in which a
+// following `{` always opens the body
+func (p *Parser) parseHeaderExpression() ast.Expression {
+	prev := p.noStructLiteral
+	p.noStructLiteral = true
+	exp := p.parseExpression(LOWEST)
+	p.noStructLiteral = prev
+	return exp
+}
+
 func (p *Parser) parseIfStatement() *ast.IfStatement {
 	stmt := &ast.IfStatement{Token: p.curToken}
 
 	p.nextToken()
-	stmt.Condition = p.parseExpression(LOWEST)
+	stmt.Condition = p.parseHeaderExpression()
 
 	if !p.expectPeek(lexer.LBRACE) {
 		return nil
@@ -628,6 +1038,11 @@ func (p *Parser) parseIfStatement() *ast.IfStatement {
 }
 
 func (p *Parser) parseForStatement() ast.Statement {
+	// Struct literals are not allowed anywhere in the loop header
+	prev := p.noStructLiteral
+	p.noStructLiteral = true
+	defer func() { p.noStructLiteral = prev }()
+
 	forToken := p.curToken
 	p.nextToken()
 
@@ -795,7 +1210,7 @@ func (p *Parser) parseWhileStatement() *ast.WhileStatement {
 	stmt := &ast.WhileStatement{Token: p.curToken}
 
 	p.nextToken()
-	stmt.Condition = p.parseExpression(LOWEST)
+	stmt.Condition = p.parseHeaderExpression()
 
 	if !p.expectPeek(lexer.LBRACE) {
 		return nil
@@ -818,6 +1233,7 @@ func (p *Parser) parseFreeStatement() *ast.FreeStatement {
 	if !p.expectPeek(lexer.RPAREN) {
 		return nil
 	}
+	stmt.Rparen = p.curToken
 
 	if p.peekTokenIs(lexer.SEMICOLON) {
 		p.nextToken()
@@ -891,7 +1307,61 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 }
 
 func (p *Parser) parseIdentifier() ast.Expression {
-	return &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	// comptime is only a keyword before an operand
+	if p.curToken.Literal == "comptime" && p.peekStartsOperand() {
+		exp := &ast.ComptimeExpression{Token: p.curToken}
+		p.nextToken()
+		exp.Value = p.parseExpression(PREFIX)
+		if exp.Value == nil {
+			return nil
+		}
+		return exp
+	}
+
+	ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+	if p.peekTokenIs(lexer.LBRACE) && !p.noStructLiteral {
+		p.nextToken()
+		return p.parseStructLiteral(ident)
+	}
+	return ident
+}
+
+// parseStructLiteral parses the body of Name{field: value, ...} with the
+// current token on the opening brace
+func (p *Parser) parseStructLiteral(name *ast.Identifier) *ast.StructLiteral {
+	lit := &ast.StructLiteral{Token: name.Token, Name: name}
+	lit.Fields = []*ast.StructLiteralField{}
+
+	prev := p.noStructLiteral
+	p.noStructLiteral = false
+	defer func() { p.noStructLiteral = prev }()
+
+	for !p.peekTokenIs(lexer.RBRACE) {
+		if !p.expectPeek(lexer.IDENT) {
+			return nil
+		}
+		field := &ast.StructLiteralField{
+			Name: &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal},
+		}
+		if !p.expectPeek(lexer.COLON) {
+			return nil
+		}
+		p.nextToken()
+		field.Value = p.parseExpression(LOWEST)
+		lit.Fields = append(lit.Fields, field)
+
+		if !p.peekTokenIs(lexer.COMMA) {
+			break
+		}
+		p.nextToken()
+	}
+
+	if !p.expectPeek(lexer.RBRACE) {
+		return nil
+	}
+	lit.Rbrace = p.curToken
+
+	return lit
 }
 
 func (p *Parser) parseIntegerLiteral() ast.Expression {
@@ -991,6 +1461,7 @@ func (p *Parser) parseAssignExpression(left ast.Expression) ast.Expression {
 
 func (p *Parser) parseGroupedOrCast() ast.Expression {
 	// Could be (expr) or (type)expr
+	lparen := p.curToken
 	p.nextToken()
 
 	// Check if it's a type cast
@@ -1003,17 +1474,25 @@ func (p *Parser) parseGroupedOrCast() ast.Expression {
 		value := p.parseExpression(PREFIX)
 		return &ast.CastExpression{
 			Token:      p.curToken,
+			Lparen:     lparen,
 			TargetType: typeAnn,
 			Value:      value,
 		}
 	}
 
-	// It's a grouped expression
+	// It's a grouped expression; parentheses make struct literals
+	// unambiguous again
+	prev := p.noStructLiteral
+	p.noStructLiteral = false
 	exp := p.parseExpression(LOWEST)
+	p.noStructLiteral = prev
 
 	if !p.expectPeek(lexer.RPAREN) {
 		return nil
 	}
+	if exp != nil {
+		exp.Parenthesize(lparen, p.curToken)
+	}
 
 	return exp
 }
@@ -1031,12 +1510,17 @@ func (p *Parser) isType() bool {
 func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
 	exp := &ast.CallExpression{Token: p.curToken, Function: function}
 	exp.Arguments = p.parseExpressionList(lexer.RPAREN)
+	exp.Rparen = p.curToken
 	return exp
 }
 
 func (p *Parser) parseExpressionList(end lexer.TokenType) []ast.Expression {
 	list := []ast.Expression{}
 
+	prev := p.noStructLiteral
+	p.noStructLiteral = false
+	defer func() { p.noStructLiteral = prev }()
+
 	if p.peekTokenIs(end) {
 		p.nextToken()
 		return list
@@ -1067,6 +1551,7 @@ func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
 	if !p.expectPeek(lexer.RBRACKET) {
 		return nil
 	}
+	exp.Rbracket = p.curToken
 
 	return exp
 }
@@ -1089,15 +1574,21 @@ func (p *Parser) parseArrayOrSliceLiteral() ast.Expression {
 	if p.curTokenIs(lexer.RBRACKET) {
 		// Slice type: []type{...}
 		p.nextToken() // move past ]
-		if p.curTokenIs(lexer.IDENT) || p.isType() {
+		if p.curStartsType() {
+			elem := p.parseTypeAnnotation()
+			if elem == nil {
+				return nil
+			}
 			array.Type = &ast.TypeAnnotation{
-				Token:    p.curToken,
-				Name:     p.curToken.Literal,
+				Token:    array.Token,
+				Name:     elem.Name,
 				ArrayLen: -1, // slice
+				Elem:     elem,
 			}
 			p.nextToken() // move past type
 			if p.curTokenIs(lexer.LBRACE) {
 				array.Elements = p.parseExpressionListBrace()
+				array.Rbrace = p.curToken
 			}
 			return array
 		}
@@ -1111,24 +1602,24 @@ func (p *Parser) parseArrayOrSliceLiteral() ast.Expression {
 			return nil
 		}
 		p.nextToken() // move past ]
-		if p.curTokenIs(lexer.IDENT) || p.isType() {
-			array.Type = &ast.TypeAnnotation{
-				Token:    p.curToken,
-				Name:     p.curToken.Literal,
-				ArrayLen: length,
-			}
-			p.nextToken() // move past type
-			if p.curTokenIs(lexer.LBRACE) {
-				array.Elements = p.parseExpressionListBrace()
-			}
+		return p.parseFixedArrayLiteral(array, &ast.TypeAnnotation{Token: array.Token, ArrayLen: length})
+	} else if p.curTokenIs(lexer.IDENT) && p.peekTokenIs(lexer.RBRACKET) {
+		// Fixed array with a constant length, [N]type{...}, or [x]
+		name := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+		p.nextToken() // move to ]
+		if !p.peekStartsType() {
+			array.Elements = []ast.Expression{name}
+			array.Rbrace = p.curToken
 			return array
 		}
-		return nil
+		p.nextToken() // move past ]
+		return p.parseFixedArrayLiteral(array, &ast.TypeAnnotation{Token: array.Token, Len: name})
 	}
 
 	// Regular array literal without type: [1, 2, 3]
 	// We already moved past [, so parse elements until ]
 	if p.curTokenIs(lexer.RBRACKET) {
+		array.Rbrace = p.curToken
 		return array
 	}
 
@@ -1143,7 +1634,28 @@ func (p *Parser) parseArrayOrSliceLiteral() ast.Expression {
 	if !p.expectPeek(lexer.RBRACKET) {
 		return nil
 	}
+	array.Rbrace = p.curToken
+
+	return array
+}
 
+// parseFixedArrayLiteral parses the element type and elements of a fixed
+// array literal, with the current token on the element type
+func (p *Parser) parseFixedArrayLiteral(array *ast.ArrayLiteral, typ *ast.TypeAnnotation) ast.Expression {
+	if !p.curStartsType() {
+		return nil
+	}
+	elem := p.parseTypeAnnotation()
+	if elem == nil {
+		return nil
+	}
+	typ.Name, typ.Elem = elem.Name, elem
+	array.Type = typ
+	p.nextToken() // move past type
+	if p.curTokenIs(lexer.LBRACE) {
+		array.Elements = p.parseExpressionListBrace()
+		array.Rbrace = p.curToken
+	}
 	return array
 }
 
@@ -1160,12 +1672,15 @@ func (p *Parser) parseExpressionListBrace() []ast.Expression {
 	}
 
 	p.nextToken()
-	list = append(list, p.parseExpression(LOWEST))
+	list = append(list, p.parseBraceElement())
 
 	for p.peekTokenIs(lexer.COMMA) {
 		p.nextToken()
+		if p.peekTokenIs(lexer.RBRACE) {
+			break // trailing comma
+		}
 		p.nextToken()
-		list = append(list, p.parseExpression(LOWEST))
+		list = append(list, p.parseBraceElement())
 	}
 
 	if !p.expectPeek(lexer.RBRACE) {
@@ -1175,6 +1690,19 @@ func (p *Parser) parseExpressionListBrace() []ast.Expression {
 	return list
 }
 
+// parseBraceElement parses one element of a braced initialiser list. A
+// nested {...} takes its type from the enclosing literal, as in
+// [2][3]int{{1, 2, 3}, {4, 5, 6}}.
+func (p *Parser) parseBraceElement() ast.Expression {
+	if p.curTokenIs(lexer.LBRACE) {
+		lit := &ast.ArrayLiteral{Token: p.curToken}
+		lit.Elements = p.parseExpressionListBrace()
+		lit.Rbrace = p.curToken
+		return lit
+	}
+	return p.parseExpression(LOWEST)
+}
+
 func (p *Parser) parseLenExpression() ast.Expression {
 	exp := &ast.CallExpression{
 		Token:    p.curToken,
@@ -1185,6 +1713,7 @@ func (p *Parser) parseLenExpression() ast.Expression {
 		return nil
 	}
 	exp.Arguments = p.parseExpressionList(lexer.RPAREN)
+	exp.Rparen = p.curToken
 
 	return exp
 }
@@ -1216,6 +1745,7 @@ func (p *Parser) parseMakeExpression() ast.Expression {
 	if !p.expectPeek(lexer.RPAREN) {
 		return nil
 	}
+	exp.Rparen = p.curToken
 
 	return exp
 }
@@ -1230,9 +1760,17 @@ func (p *Parser) parseAllocExpression() ast.Expression {
 
 	exp.Type = p.parseTypeAnnotation()
 
+	// alloc(User{...}) allocates and initialises in one step
+	if p.curTokenIs(lexer.IDENT) && p.peekTokenIs(lexer.LBRACE) {
+		name := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+		p.nextToken()
+		exp.Init = p.parseStructLiteral(name)
+	}
+
 	if !p.expectPeek(lexer.RPAREN) {
 		return nil
 	}
+	exp.Rparen = p.curToken
 
 	return exp
 }
@@ -1261,6 +1799,7 @@ func (p *Parser) parseMapLiteral() ast.Expression {
 	}
 
 	ml.Pairs = p.parseMapPairs()
+	ml.Rbrace = p.curToken
 
 	return ml
 }
@@ -1329,6 +1868,7 @@ func (p *Parser) parseDeleteStatement() *ast.DeleteStatement {
 	if !p.expectPeek(lexer.RPAREN) {
 		return nil
 	}
+	stmt.Rparen = p.curToken
 
 	if p.peekTokenIs(lexer.SEMICOLON) {
 		p.nextToken()
@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/Dr-H-PhD/h-lang/pkg/ast"
@@ -457,6 +458,100 @@ func TestAllocExpression(t *testing.T) {
 	}
 }
 
+func TestAllocWithStructLiteral(t *testing.T) {
+	input := `alloc(User{name: "a"});`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	exp := stmt.Expression.(*ast.AllocExpression)
+
+	if exp.Type.Name != "User" {
+		t.Errorf("type: expected 'User', got %q", exp.Type.Name)
+	}
+	if exp.Init == nil || len(exp.Init.Fields) != 1 {
+		t.Fatalf("expected initialiser with 1 field, got %v", exp.Init)
+	}
+}
+
+func TestStructLiteral(t *testing.T) {
+	input := `u := User{name: "a", age: 30, home: &Point{x: 1},};`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.InferStatement)
+	lit, ok := stmt.Value.(*ast.StructLiteral)
+	if !ok {
+		t.Fatalf("expected StructLiteral, got %T", stmt.Value)
+	}
+
+	if lit.Name.Value != "User" {
+		t.Errorf("name: expected 'User', got %q", lit.Name.Value)
+	}
+	if len(lit.Fields) != 3 {
+		t.Fatalf("expected 3 fields, got %d", len(lit.Fields))
+	}
+	if lit.Fields[1].Name.Value != "age" {
+		t.Errorf("field: expected 'age', got %q", lit.Fields[1].Name.Value)
+	}
+
+	addr, ok := lit.Fields[2].Value.(*ast.PrefixExpression)
+	if !ok || addr.Operator != "&" {
+		t.Fatalf("expected &Point{...}, got %v", lit.Fields[2].Value)
+	}
+	if _, ok := addr.Right.(*ast.StructLiteral); !ok {
+		t.Errorf("expected nested StructLiteral, got %T", addr.Right)
+	}
+}
+
+func TestStructLiteralInControlHeaders(t *testing.T) {
+	input := `function main() {
+    if p == q {
+        x := Point{x: 1};
+    }
+    while done {
+        break;
+    }
+    for _, v := range items {
+        print(v);
+    }
+    if (p == Point{}) {
+        print(1);
+    }
+}`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	fn := program.Statements[0].(*ast.FunctionStatement)
+	if len(fn.Body.Statements) != 4 {
+		t.Fatalf("expected 4 statements, got %d", len(fn.Body.Statements))
+	}
+
+	ifStmt := fn.Body.Statements[0].(*ast.IfStatement)
+	if _, ok := ifStmt.Condition.(*ast.InfixExpression); !ok {
+		t.Errorf("expected infix condition, got %T", ifStmt.Condition)
+	}
+	inner := ifStmt.Consequence.Statements[0].(*ast.InferStatement)
+	if _, ok := inner.Value.(*ast.StructLiteral); !ok {
+		t.Errorf("expected struct literal inside if body, got %T", inner.Value)
+	}
+
+	paren := fn.Body.Statements[3].(*ast.IfStatement)
+	cond := paren.Condition.(*ast.InfixExpression)
+	if _, ok := cond.Right.(*ast.StructLiteral); !ok {
+		t.Errorf("expected parenthesised struct literal, got %T", cond.Right)
+	}
+}
+
 func TestCastExpression(t *testing.T) {
 	input := `(int)x;`
 
@@ -1000,6 +1095,125 @@ func TestMapTypeAnnotation(t *testing.T) {
 	}
 }
 
+func TestNestedTypeAnnotations(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`var a [2][3]int;`, "[2][3]int"},
+		{`var b []*User;`, "[]*User"},
+		{`var c **int;`, "**int"},
+		{`var d *[4]int;`, "*[4]int"},
+		{`var e map[string][]int;`, "map[string][]int"},
+		{`var f function(int, string) bool;`, "function(int, string) bool"},
+		{`var g [2]function(int);`, "[2]function(int)"},
+		{`var h function() function(int) int;`, "function() function(int) int"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.VarStatement)
+		if stmt.Type.String() != tt.expected {
+			t.Errorf("expected %q, got %q", tt.expected, stmt.Type.String())
+		}
+	}
+}
+
+func TestNestedTypeStructure(t *testing.T) {
+	input := `var grid [2]*[3]User;`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	typ := program.Statements[0].(*ast.VarStatement).Type
+	if typ.ArrayLen != 2 || typ.Name != "User" {
+		t.Fatalf("expected [2] of User, got ArrayLen %d Name %q", typ.ArrayLen, typ.Name)
+	}
+	ptr := typ.Elem
+	if ptr == nil || !ptr.IsPtr {
+		t.Fatalf("expected pointer element, got %v", ptr)
+	}
+	arr := ptr.Elem
+	if arr == nil || arr.ArrayLen != 3 || arr.Elem == nil || !arr.Elem.IsNamed() || arr.Elem.Name != "User" {
+		t.Fatalf("expected [3]User pointee, got %v", arr)
+	}
+}
+
+func TestFunctionReturningFunctionType(t *testing.T) {
+	input := `function pick(n int) function(int) int {
+    return twice;
+}`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	fn := program.Statements[0].(*ast.FunctionStatement)
+	if !fn.ReturnType.IsFunc || len(fn.ReturnType.Params) != 1 || fn.ReturnType.ReturnType.Name != "int" {
+		t.Errorf("unexpected return type %s", fn.ReturnType)
+	}
+	if len(fn.Body.Statements) != 1 {
+		t.Errorf("expected body with 1 statement, got %d", len(fn.Body.Statements))
+	}
+}
+
+func TestNestedArrayLiteral(t *testing.T) {
+	input := `m := [2][3]int{{1, 2, 3}, {4, 5, 6},};`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	arr := program.Statements[0].(*ast.InferStatement).Value.(*ast.ArrayLiteral)
+	if arr.Type.String() != "[2][3]int" {
+		t.Errorf("expected type [2][3]int, got %s", arr.Type)
+	}
+	if len(arr.Elements) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(arr.Elements))
+	}
+	row, ok := arr.Elements[1].(*ast.ArrayLiteral)
+	if !ok || len(row.Elements) != 3 {
+		t.Fatalf("expected nested row of 3, got %v", arr.Elements[1])
+	}
+}
+
+func TestPublicGlobals(t *testing.T) {
+	input := `public var count int = 0;
+public const LIMIT := 10;
+const secret := 1;`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 3 {
+		t.Fatalf("expected 3 statements, got %d", len(program.Statements))
+	}
+	v, ok := program.Statements[0].(*ast.VarStatement)
+	if !ok || !v.Public || v.Name.Value != "count" {
+		t.Errorf("expected public var count, got %v", program.Statements[0])
+	}
+	c, ok := program.Statements[1].(*ast.ConstStatement)
+	if !ok || !c.Public || c.Name.Value != "LIMIT" {
+		t.Errorf("expected public const LIMIT, got %v", program.Statements[1])
+	}
+	if c := program.Statements[2].(*ast.ConstStatement); c.Public {
+		t.Error("expected secret to be private")
+	}
+	if v.String() != "public var count int = 0;" {
+		t.Errorf("unexpected String(): %q", v.String())
+	}
+}
+
 func TestImportStatement(t *testing.T) {
 	input := `import "math.hl";`
 
@@ -1062,3 +1276,287 @@ func checkParserErrors(t *testing.T, p *Parser) {
 	}
 	t.FailNow()
 }
+
+func TestTestStatement(t *testing.T) {
+	input := `test "adds numbers" {
+    assert_eq(add(1, 2), 3);
+}
+
+function main() {
+    test := 1;
+    print(test);
+}`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 2 {
+		t.Fatalf("expected 2 statements, got %d", len(program.Statements))
+	}
+	stmt, ok := program.Statements[0].(*ast.TestStatement)
+	if !ok {
+		t.Fatalf("expected TestStatement, got %T", program.Statements[0])
+	}
+	if stmt.Name != "adds numbers" {
+		t.Errorf("name: expected %q, got %q", "adds numbers", stmt.Name)
+	}
+	if len(stmt.Body.Statements) != 1 {
+		t.Errorf("expected 1 statement in the body, got %d", len(stmt.Body.Statements))
+	}
+
+	// test is still an ordinary name
+	fn := program.Statements[1].(*ast.FunctionStatement)
+	if _, ok := fn.Body.Statements[0].(*ast.InferStatement); !ok {
+		t.Errorf("expected test := 1 to declare a variable, got %T", fn.Body.Statements[0])
+	}
+}
+
+func TestExternStatements(t *testing.T) {
+	input := `cinclude "<math.h>"
+link "m";
+
+# sqrt is the C one.
+extern function sqrt(x float) float
+public extern function printf(format *char, ...) int;
+extern function abort()
+extern struct FILE;
+public extern struct div_t { public quot int; public rem int; }
+
+function main() {
+    extern := 1;
+    link := extern;
+}`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 8 {
+		t.Fatalf("expected 8 statements, got %d", len(program.Statements))
+	}
+	if inc, ok := program.Statements[0].(*ast.CIncludeStatement); !ok || inc.Path != "<math.h>" {
+		t.Errorf("expected cinclude <math.h>, got %s", program.Statements[0])
+	}
+	if link, ok := program.Statements[1].(*ast.LinkStatement); !ok || link.Library != "m" {
+		t.Errorf("expected link m, got %s", program.Statements[1])
+	}
+
+	sqrt := program.Statements[2].(*ast.FunctionStatement)
+	if !sqrt.Extern || sqrt.Body != nil || sqrt.ReturnType.String() != "float" || sqrt.Doc != "sqrt is the C one." {
+		t.Errorf("unexpected sqrt %+v", sqrt)
+	}
+	printf := program.Statements[3].(*ast.FunctionStatement)
+	if !printf.Public || !printf.Variadic || len(printf.Parameters) != 1 {
+		t.Errorf("unexpected printf %+v", printf)
+	}
+	// A result type starts on the line of the signature
+	if abort := program.Statements[4].(*ast.FunctionStatement); abort.ReturnType != nil {
+		t.Errorf("expected abort to return nothing, got %s", abort.ReturnType)
+	}
+
+	file := program.Statements[5].(*ast.StructStatement)
+	if !file.Extern || file.Fields != nil {
+		t.Errorf("expected an opaque struct, got %s", file)
+	}
+	div := program.Statements[6].(*ast.StructStatement)
+	if !div.Extern || !div.Public || len(div.Fields) != 2 {
+		t.Errorf("unexpected div_t %s", div)
+	}
+	expected := "public extern function printf(format *char, ...) int;"
+	if printf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, printf.String())
+	}
+
+	// extern and link are still ordinary names
+	fn := program.Statements[7].(*ast.FunctionStatement)
+	if len(fn.Body.Statements) != 2 {
+		t.Errorf("expected 2 statements in main, got %d", len(fn.Body.Statements))
+	}
+}
+
+func TestExternErrors(t *testing.T) {
+	input := `function f(a int, ...) {}
+extern function g() { return; }
+function main() {}`
+
+	p := New(lexer.New(input))
+	p.ParseProgram()
+	expected := []string{
+		"line 1: only extern functions can take ...",
+		"line 2: extern function g cannot have a body",
+	}
+	if strings.Join(p.Errors(), "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected errors %q, got %q", expected, p.Errors())
+	}
+}
+
+func TestComptime(t *testing.T) {
+	input := `comptime function square(x int) int { return x * x; }
+public comptime function cube(x int) int { return x * x * x; }
+var grid [N * 2]int;
+
+function main() {
+    a := comptime square(3);
+    b := [N]int{1, 2};
+    c := [n];
+    comptime := 1;
+    d := comptime + comptime;
+    var e [len(xs)][2]int;
+}`
+
+	p := New(lexer.New(input))
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	square := program.Statements[0].(*ast.FunctionStatement)
+	if !square.Comptime || square.Public || square.Modifier.Literal != "comptime" {
+		t.Errorf("unexpected square %s", square)
+	}
+	cube := program.Statements[1].(*ast.FunctionStatement)
+	if !cube.Comptime || !cube.Public {
+		t.Errorf("unexpected cube %s", cube)
+	}
+	if got := cube.String(); !strings.HasPrefix(got, "public comptime function cube(") {
+		t.Errorf("unexpected String %q", got)
+	}
+	grid := program.Statements[2].(*ast.VarStatement)
+	if grid.Type.ArrayLen != 0 || grid.Type.Len.String() != "(N * 2)" || !grid.Type.IsArray() {
+		t.Errorf("unexpected grid type %+v", grid.Type)
+	}
+
+	body := program.Statements[3].(*ast.FunctionStatement).Body.Statements
+	expected := []string{
+		"a := (comptime square(3));",
+		"b := [N]int{1, 2};",
+		"c := {n};",
+		"comptime := 1;",
+		"d := (comptime + comptime);",
+		"var e [len(xs)][2]int;",
+	}
+	for i, want := range expected {
+		if got := body[i].String(); got != want {
+			t.Errorf("statement %d: expected %q, got %q", i, want, got)
+		}
+	}
+	if lit := body[1].(*ast.InferStatement).Value.(*ast.ArrayLiteral); lit.Type.Len == nil || lit.Type.Elem.Name != "int" {
+		t.Errorf("unexpected array literal type %+v", lit.Type)
+	}
+}
+
+func TestComptimeErrors(t *testing.T) {
+	p := New(lexer.New(`comptime function (p *Point) f() {}
+var a [+]int;`))
+	p.ParseProgram()
+	errs := strings.Join(p.Errors(), "\n")
+	if !strings.Contains(errs, "line 1: method f cannot be comptime") {
+		t.Errorf("expected a comptime method error, got %q", errs)
+	}
+	if !strings.Contains(errs, "line 2:") {
+		t.Errorf("expected an array length error, got %q", errs)
+	}
+}
+
+func TestComments(t *testing.T) {
+	input := `# header
+function main() { // opens
+    x := 1; /* one */
+    /* block
+       comment */
+}`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	expected := []struct {
+		text     string
+		line     int
+		trailing bool
+	}{
+		{" header", 1, false},
+		{" opens", 2, true},
+		{" one ", 3, true},
+		{" block\n       comment ", 4, false},
+	}
+	if len(program.Comments) != len(expected) {
+		t.Fatalf("expected %d comments, got %d", len(expected), len(program.Comments))
+	}
+	for i, e := range expected {
+		c := program.Comments[i]
+		if c.Token.Literal != e.text || c.Token.Line != e.line || c.Trailing != e.trailing {
+			t.Errorf("comment %d: expected %q on line %d (trailing %v), got %q on line %d (trailing %v)",
+				i, e.text, e.line, e.trailing, c.Token.Literal, c.Token.Line, c.Trailing)
+		}
+	}
+
+	fn := program.Statements[0].(*ast.FunctionStatement)
+	if fn.Body.Rbrace.Line != 6 {
+		t.Errorf("expected the closing brace on line 6, got %d", fn.Body.Rbrace.Line)
+	}
+}
+
+func TestDocComments(t *testing.T) {
+	input := `# File comment
+
+# Point is a place
+# on the plane.
+public struct Point {
+    # Across
+    public x int;
+    public y int; # Up
+}
+
+x := 1; # not a doc comment
+/*
+ * Color is a color.
+ */
+enum Color {
+    Red, # The first
+    Green,
+}
+
+# Flat is on one line.
+enum Flat { A, B }
+
+// area multiplies.
+public function area(w int, h int) int { return w * h; }
+
+function undocumented() {}`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	point := program.Statements[0].(*ast.StructStatement)
+	if point.Doc != "Point is a place\non the plane." {
+		t.Errorf("unexpected struct doc %q", point.Doc)
+	}
+	if point.Fields[0].Doc != "Across" || point.Fields[1].Doc != "Up" {
+		t.Errorf("unexpected field docs %q, %q", point.Fields[0].Doc, point.Fields[1].Doc)
+	}
+
+	color := program.Statements[2].(*ast.EnumStatement)
+	if color.Doc != "Color is a color." {
+		t.Errorf("unexpected enum doc %q", color.Doc)
+	}
+	if color.Values[0].Doc != "The first" || color.Values[1].Doc != "" {
+		t.Errorf("unexpected value docs %q, %q", color.Values[0].Doc, color.Values[1].Doc)
+	}
+
+	if flat := program.Statements[3].(*ast.EnumStatement); flat.Values[0].Doc != "" {
+		t.Errorf("a value on the enum's line took the doc %q", flat.Values[0].Doc)
+	}
+
+	area := program.Statements[4].(*ast.FunctionStatement)
+	if area.Doc != "area multiplies." {
+		t.Errorf("unexpected function doc %q", area.Doc)
+	}
+	if fn := program.Statements[5].(*ast.FunctionStatement); fn.Doc != "" {
+		t.Errorf("expected no doc, got %q", fn.Doc)
+	}
+}
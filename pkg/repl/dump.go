@@ -0,0 +1,73 @@
+package repl
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+)
+
+var (
+	nodeType       = reflect.TypeOf((*ast.Node)(nil)).Elem()
+	typeAnnotation = reflect.TypeOf(&ast.TypeAnnotation{})
+)
+
+// dump writes a node and its children, indented by depth. Each line
+// names the node type and its operator, name or value; type annotations
+// are written as source.
+func dump(out *strings.Builder, node ast.Node, depth int) {
+	v := reflect.ValueOf(node)
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		return
+	}
+	elem := v.Elem()
+	fmt.Fprintf(out, "%s%s%s\n", strings.Repeat("  ", depth), elem.Type().Name(), label(elem))
+
+	for i := 0; i < elem.NumField(); i++ {
+		field := elem.Type().Field(i)
+		f := elem.Field(i)
+		switch {
+		case f.Type() == typeAnnotation:
+			if !f.IsNil() {
+				fmt.Fprintf(out, "%s%s: %s\n", strings.Repeat("  ", depth+1), field.Name, f.Interface().(*ast.TypeAnnotation))
+			}
+		case f.Type().Implements(nodeType) && field.Name != "Name":
+			if !f.IsNil() {
+				dump(out, f.Interface().(ast.Node), depth+1)
+			}
+		case f.Kind() == reflect.Slice:
+			for j := 0; j < f.Len(); j++ {
+				if item := f.Index(j); item.Type().Implements(nodeType) && !item.IsNil() {
+					dump(out, item.Interface().(ast.Node), depth+1)
+				}
+			}
+		}
+	}
+}
+
+// label returns what identifies a node besides its type
+func label(v reflect.Value) string {
+	for _, name := range []string{"Operator", "Name", "Value", "Path"} {
+		f := v.FieldByName(name)
+		if !f.IsValid() {
+			continue
+		}
+		switch x := f.Interface().(type) {
+		case string:
+			if name == "Value" && v.Type() != reflect.TypeOf(ast.Identifier{}) {
+				return fmt.Sprintf(" %q", x)
+			}
+			return " " + x
+		case *ast.Identifier:
+			if x != nil {
+				return " " + x.Value
+			}
+		case int64, float64, bool:
+			return fmt.Sprintf(" %v", x)
+		case byte:
+			return fmt.Sprintf(" %q", rune(x))
+		}
+	}
+	return ""
+}
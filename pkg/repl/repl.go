@@ -0,0 +1,593 @@
+// Package repl implements the state behind "hlc repl". A session keeps
+// the declarations and statements entered so far; every input is compiled
+// together with them into a program whose main replays the statements,
+// and only the output of the new input is shown. A statement declaring a
+// variable declared before opens a scope, so that the name is bound anew.
+package repl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
+	"github.com/Dr-H-PhD/h-lang/pkg/codegen"
+	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
+	"github.com/Dr-H-PhD/h-lang/pkg/parser"
+)
+
+// Session is an interactive session
+type Session struct {
+	Compiler  string                 // the C compiler
+	Flags     []string               // flags of the C compiler command, before the program
+	LinkFlags []string               // flags after the program, such as libraries
+	Strict    bool                   // treat C compiler warnings as errors
+	Log       io.Writer              // where the C compiler commands are printed, if not nil
+	Timeout   time.Duration          // how long an input may run, 0 for no limit
+	GC        bool                   // use the garbage collector
+	Resolver  codegen.ImportResolver // resolves imports, relative to BaseDir
+	BaseDir   string                 // where imports and cinclude headers are found
+
+	decls []declaration
+	stmts []statement // statements of main, in the order entered
+	dir   string      // scratch directory for C files and binaries
+	mark  string      // printed between replayed and new statements
+	runs  int
+}
+
+// declaration is one input of top-level declarations
+type declaration struct {
+	names  []string
+	source string
+}
+
+// statement is one input of statements of main
+type statement struct {
+	source string
+	names  []string // the variables it declares
+	scope  bool     // it opens a scope to declare a name again
+}
+
+// sourceName is the file name of a session's program
+const sourceName = "repl"
+
+// printable are the types print can show
+var printable = map[string]bool{"int": true, "float": true, "string": true, "char": true, "bool": true}
+
+// DefaultTimeout is how long an input of a new session may run
+const DefaultTimeout = 10 * time.Second
+
+// New returns an empty session that compiles with the given C compiler
+func New(compiler string) (*Session, error) {
+	dir, err := os.MkdirTemp("", "hlc-repl-*")
+	if err != nil {
+		return nil, err
+	}
+	return &Session{Compiler: compiler, Timeout: DefaultTimeout, BaseDir: ".", dir: dir, mark: filepath.Base(dir)}, nil
+}
+
+// Close removes the session's scratch files
+func (s *Session) Close() error {
+	return os.RemoveAll(s.dir)
+}
+
+// Reset forgets everything entered so far
+func (s *Session) Reset() {
+	s.decls, s.stmts = nil, nil
+}
+
+// Eval compiles and runs an input and returns the output it produced. An
+// expression's value is printed; an input that fails to compile or exits
+// with an error or runs out of time is not kept. The statements kept
+// earlier run again first, side effects included, with their output
+// hidden.
+func (s *Session) Eval(input string) (string, error) {
+	input = terminate(input)
+	program, err := parse(input)
+	if err != nil {
+		return "", err
+	}
+	if len(program.Statements) == 0 {
+		return "", nil
+	}
+
+	decls, stmts := 0, 0
+	var names []string
+	for _, stmt := range program.Statements {
+		if name, ok := declared(stmt); ok {
+			if name == "main" {
+				return "", fmt.Errorf("main is the session's own; use another name")
+			}
+			names = append(names, name)
+			decls++
+		} else {
+			stmts++
+		}
+	}
+	if decls > 0 && stmts > 0 {
+		return "", fmt.Errorf("enter declarations and statements separately")
+	}
+
+	if decls > 0 {
+		return s.commit(s.replace(names, input), s.stmts, statement{}, statement{})
+	}
+	stmt := s.statement(input)
+
+	// A lone expression with a value is printed
+	if expr := loneExpression(program); expr != nil {
+		t, err := s.typeOf(input)
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case printable[t]:
+			// Replays evaluate the expression without printing it again
+			show := stmt
+			show.source = "print(" + strings.TrimSuffix(input, ";") + ");"
+			return s.commit(s.decls, s.stmts, show, stmt)
+		case t != "void":
+			// An array literal is only C in an initializer
+			if _, ok := expr.(*ast.ArrayLiteral); ok {
+				return "<" + t + ">\n", nil
+			}
+			out, err := s.commit(s.decls, s.stmts, stmt, stmt)
+			return out + "<" + t + ">\n", err
+		}
+	}
+	return s.commit(s.decls, s.stmts, stmt, stmt)
+}
+
+// statement returns an input of statements as kept. Declaring a
+// variable an earlier statement declared opens a scope, and the value is
+// stored in a temporary first: in C, a variable is in scope in its own
+// initializer, so "x := x + 1" would read the new x.
+func (s *Session) statement(input string) statement {
+	l := lexer.New(input)
+	program := parser.New(l).ParseProgram()
+	file := l.File()
+	declared := make(map[string]bool)
+	for _, old := range s.stmts {
+		for _, name := range old.names {
+			declared[name] = true
+		}
+	}
+
+	stmt := statement{}
+	var source strings.Builder
+	last := 0
+	for _, st := range program.Statements {
+		var name *ast.Identifier
+		var value ast.Expression
+		switch st := st.(type) {
+		case *ast.InferStatement:
+			name, value = st.Name, st.Value
+		case *ast.VarStatement:
+			name, value = st.Name, st.Value
+		case *ast.ConstStatement:
+			name, value = st.Name, st.Value
+		default:
+			continue
+		}
+		stmt.names = append(stmt.names, name.Value)
+		if !declared[name.Value] {
+			continue
+		}
+		stmt.scope = true
+		if value == nil {
+			continue
+		}
+		// "var x int = v" becomes "var tmp int = v; var x int = tmp"
+		start, end := file.Offset(st.Pos()), file.Offset(st.End())
+		prefix := input[start:file.Offset(name.Pos())]
+		middle := input[file.Offset(name.End()):file.Offset(value.Pos())]
+		tmp := fmt.Sprintf("repl%d_%s", len(s.stmts), name.Value)
+		source.WriteString(input[last:start])
+		source.WriteString(prefix + tmp + middle + input[file.Offset(value.Pos()):end] + "; ")
+		source.WriteString(prefix + name.Value + middle + tmp)
+		last = end
+	}
+	source.WriteString(input[last:])
+	stmt.source = source.String()
+	return stmt
+}
+
+// TypeOf returns the type of an expression in the session
+func (s *Session) TypeOf(input string) (string, error) {
+	return s.typeOf(terminate(input))
+}
+
+func (s *Session) typeOf(input string) (string, error) {
+	expr, g, err := s.expression(input)
+	if err != nil {
+		return "", err
+	}
+	return g.TypeOf(expr), nil
+}
+
+// C returns the C translation of an expression in the session
+func (s *Session) C(input string) (string, error) {
+	expr, g, err := s.expression(terminate(input))
+	if err != nil {
+		return "", err
+	}
+	return g.ExpressionC(expr), nil
+}
+
+// AST returns the parse tree of an expression, one node per line
+func AST(input string) (string, error) {
+	program, err := parse(terminate(input))
+	if err != nil {
+		return "", err
+	}
+	expr := loneExpression(program)
+	if expr == nil {
+		if len(program.Statements) == 0 {
+			return "", fmt.Errorf("expected an expression")
+		}
+		var out strings.Builder
+		for _, stmt := range program.Statements {
+			dump(&out, stmt, 0)
+		}
+		return out.String(), nil
+	}
+	var out strings.Builder
+	dump(&out, expr, 0)
+	return out.String(), nil
+}
+
+// expression generates the session's program with an expression as the
+// last statement of main, and returns the expression as parsed there with
+// the generator that translated it
+func (s *Session) expression(input string) (ast.Expression, *codegen.Generator, error) {
+	program, err := parse(input)
+	if err != nil {
+		return nil, nil, err
+	}
+	if loneExpression(program) == nil {
+		return nil, nil, fmt.Errorf("expected an expression")
+	}
+
+	source, start := s.source(s.decls, s.stmts, statement{source: input})
+	full, err := parse(source)
+	if err != nil {
+		return nil, nil, err
+	}
+	g := s.generator()
+	g.Generate(full)
+	if len(g.Errors()) > 0 {
+		return nil, nil, s.programError(g.Errors(), input, start)
+	}
+
+	main := full.Statements[len(full.Statements)-1].(*ast.FunctionStatement)
+	return lastExpression(main.Body), g, nil
+}
+
+// commit compiles and runs the program made of decls, stmts and a new
+// statement, and returns what the new statement printed. On success they
+// become the session's state, with the new statement replayed as kept.
+// Without a new statement, the new input is the last declaration.
+func (s *Session) commit(decls []declaration, stmts []statement, stmt, kept statement) (string, error) {
+	source, start := s.source(decls, stmts, stmt)
+	input := stmt.source
+	if input == "" {
+		input = decls[len(decls)-1].source
+	}
+	program, err := parse(source)
+	if err != nil {
+		return "", err
+	}
+	g := s.generator()
+	cCode := g.Generate(program)
+	if len(g.Errors()) > 0 {
+		return "", s.programError(g.Errors(), input, start)
+	}
+
+	stdout, stderr, err := s.run(cCode, g, input, start)
+	// Only the output after the mark is the new statement's
+	out := string(stdout)
+	if i := strings.LastIndex(out, s.mark+"\n"); i >= 0 {
+		out = out[i+len(s.mark)+1:]
+	} else {
+		out = ""
+	}
+	if err != nil {
+		return out + string(stderr), err
+	}
+
+	s.decls = decls
+	s.stmts = stmts
+	if kept.source != "" {
+		s.stmts = append(stmts[:len(stmts):len(stmts)], kept)
+	}
+	return out, nil
+}
+
+// run compiles the C code of a program and runs the binary, stopping it
+// after the session's timeout. The C compiler's messages about the
+// program are reported as messages about the input.
+func (s *Session) run(cCode string, g *codegen.Generator, input string, start int) ([]byte, []byte, error) {
+	s.runs++
+	cFile := filepath.Join(s.dir, fmt.Sprintf("repl%d.c", s.runs))
+	binary := filepath.Join(s.dir, fmt.Sprintf("repl%d", s.runs))
+	defer os.Remove(cFile)
+	defer os.Remove(binary)
+
+	if err := os.WriteFile(cFile, []byte(cCode), 0644); err != nil {
+		return nil, nil, err
+	}
+	args := append([]string{}, s.Flags...)
+	if dir, err := filepath.Abs(s.BaseDir); err == nil {
+		// cinclude headers sit beside the session's imports
+		args = append(args, "-I"+dir)
+	}
+	args = append(args, "-o", binary, cFile)
+	args = append(args, s.LinkFlags...)
+	for _, lib := range g.Libraries() {
+		args = append(args, "-l"+lib)
+	}
+	if s.Log != nil {
+		fmt.Fprintln(s.Log, strings.Join(append([]string{s.Compiler}, args...), " "))
+	}
+	output, err := exec.Command(s.Compiler, args...).CombinedOutput()
+	if err != nil {
+		if msgs := s.diagnostics(output, g.SourceMap(), cFile, input, start); len(msgs) > 0 {
+			return nil, nil, compileError(msgs)
+		}
+		return nil, nil, fmt.Errorf("C compilation failed: %v\n%s", err, output)
+	}
+	if s.Strict && len(output) > 0 {
+		msgs := s.diagnostics(output, g.SourceMap(), cFile, input, start)
+		return nil, nil, fmt.Errorf("the C compiler reported warnings:\n%s", strings.Join(msgs, "\n"))
+	}
+
+	ctx := context.Background()
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, binary)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return stdout.Bytes(), stderr.Bytes(), fmt.Errorf("stopped after running for %v", s.Timeout)
+		}
+		return stdout.Bytes(), stderr.Bytes(), fmt.Errorf("program failed: %v", err)
+	}
+	return stdout.Bytes(), stderr.Bytes(), nil
+}
+
+// cDiagnostic matches an error or warning of the C compiler about a line
+// of a file
+var cDiagnostic = regexp.MustCompile(`^(.+?):(\d+):(?:\d+:)? (?:fatal )?(error|warning): (.*)$`)
+
+// diagnostics rewrites the C compiler's errors and warnings about the
+// generated C as messages about the input, through the source map. The
+// lines placing them in C functions, notes and excerpts of the C are
+// dropped; the rest, such as the linker's messages, pass through.
+func (s *Session) diagnostics(output []byte, m *codegen.SourceMap, cFile, input string, start int) []string {
+	var msgs []string
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		match := cDiagnostic.FindStringSubmatch(line)
+		switch {
+		case match != nil && match[1] == cFile:
+			msg := match[4]
+			if match[3] == "warning" {
+				msg = "warning: " + msg
+			}
+			n, _ := strconv.Atoi(match[2])
+			if mapping := m.Lookup(n); mapping != nil && mapping.Source == sourceName {
+				msg = locate(mapping.Line, input, start) + msg
+			}
+			msgs = append(msgs, msg)
+		case strings.HasPrefix(line, cFile+":"), strings.HasPrefix(line, " "), line == "":
+		default:
+			msgs = append(msgs, line)
+		}
+	}
+	return msgs
+}
+
+func (s *Session) generator() *codegen.Generator {
+	g := codegen.New()
+	g.SetGC(s.GC)
+	// Gives the program's C a source map
+	g.SetSourceName(sourceName)
+	if s.Resolver != nil {
+		g.SetImportResolver(s.Resolver, s.BaseDir)
+	}
+	return g
+}
+
+// source writes the program for a session state: the declarations, then
+// a main that runs the statements, prints the mark and runs a new one.
+// Statements that declare a name again open a scope, closed at the end
+// of main. It also returns the line the new input starts on: the new
+// statement, or without one the last declaration.
+func (s *Session) source(decls []declaration, stmts []statement, stmt statement) (string, int) {
+	var out strings.Builder
+	lines, start := 1, 0
+	write := func(text string) {
+		out.WriteString(text + "\n")
+		lines += strings.Count(text, "\n") + 1
+	}
+	for _, d := range decls {
+		start = lines
+		write(d.source)
+	}
+	write("function main() {")
+	scopes := 0
+	for _, old := range stmts {
+		if old.scope {
+			write("if true {")
+			scopes++
+		}
+		write(old.source)
+	}
+	write("print(\"" + s.mark + "\");")
+	if stmt.source != "" {
+		if stmt.scope {
+			write("if true {")
+			scopes++
+		}
+		start = lines
+		write(stmt.source)
+	}
+	write(strings.Repeat("}\n", scopes) + "}")
+	return out.String(), start
+}
+
+// replace returns the declarations with an input added, dropping earlier
+// inputs that declared any of the same names
+func (s *Session) replace(names []string, input string) []declaration {
+	redeclared := map[string]bool{}
+	for _, name := range names {
+		redeclared[name] = true
+	}
+	var decls []declaration
+	for _, d := range s.decls {
+		keep := true
+		for _, name := range d.names {
+			if redeclared[name] {
+				keep = false
+			}
+		}
+		if keep {
+			decls = append(decls, d)
+		}
+	}
+	return append(decls, declaration{names: names, source: input})
+}
+
+// declared returns the name a top-level declaration declares. Imports,
+// cinclude and link are declarations named by their path or library.
+func declared(stmt ast.Statement) (string, bool) {
+	switch s := stmt.(type) {
+	case *ast.ImportStatement:
+		return "import " + s.Path, true
+	case *ast.CIncludeStatement:
+		return "cinclude " + s.Path, true
+	case *ast.LinkStatement:
+		return "link " + s.Library, true
+	case *ast.FunctionStatement:
+		if s.Receiver != nil {
+			return s.Receiver.Type.Name + "." + s.Name.Value, true
+		}
+		return s.Name.Value, true
+	case *ast.StructStatement:
+		return s.Name.Value, true
+	case *ast.EnumStatement:
+		return s.Name.Value, true
+	case *ast.VarStatement:
+		return s.Name.Value, s.Public
+	case *ast.ConstStatement:
+		return s.Name.Value, s.Public
+	}
+	return "", false
+}
+
+// loneExpression returns the expression of an input that is a single
+// expression statement other than an assignment or increment
+func loneExpression(program *ast.Program) ast.Expression {
+	if len(program.Statements) != 1 {
+		return nil
+	}
+	stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+	if !ok || stmt.Expression == nil {
+		return nil
+	}
+	switch stmt.Expression.(type) {
+	case *ast.AssignExpression, *ast.PostfixExpression:
+		return nil
+	}
+	return stmt.Expression
+}
+
+// lastExpression returns the expression of the last statement of main,
+// inside the scopes statements opened
+func lastExpression(body *ast.BlockStatement) ast.Expression {
+	last := body.Statements[len(body.Statements)-1]
+	if scope, ok := last.(*ast.IfStatement); ok {
+		return lastExpression(scope.Consequence)
+	}
+	return last.(*ast.ExpressionStatement).Expression
+}
+
+// terminate adds the semicolon a statement typed without one needs
+func terminate(input string) string {
+	trimmed := strings.TrimSpace(input)
+	if trimmed == "" || strings.HasSuffix(trimmed, ";") || strings.HasSuffix(trimmed, "}") {
+		return trimmed
+	}
+	return trimmed + ";"
+}
+
+func parse(source string) (*ast.Program, error) {
+	p := parser.New(lexer.New(source))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		return nil, compileError(p.Errors())
+	}
+	return program, nil
+}
+
+// compileError joins compiler errors into one
+func compileError(errors []string) error {
+	return fmt.Errorf("%s", strings.Join(errors, "\n"))
+}
+
+var lineNumber = regexp.MustCompile(`^line (\d+): `)
+
+// programError joins the errors of a session's program. Their line
+// numbers are the program's, so they are translated to lines of the
+// input, which starts on line start, or dropped.
+func (s *Session) programError(errors []string, input string, start int) error {
+	var msgs []string
+	for _, e := range errors {
+		if m := lineNumber.FindStringSubmatch(e); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			e = locate(n, input, start) + e[len(m[0]):]
+		}
+		msgs = append(msgs, e)
+	}
+	return compileError(msgs)
+}
+
+// locate returns the prefix that places a message about a line of the
+// session's program in the input starting on line start: the line of the
+// input if it has several, and nothing if it has one or the message is
+// about an earlier input
+func locate(line int, input string, start int) string {
+	lines := strings.Count(input, "\n") + 1
+	if lines > 1 && line >= start && line < start+lines {
+		return fmt.Sprintf("line %d: ", line-start+1)
+	}
+	return ""
+}
+
+// Complete reports whether an input is complete or needs more lines:
+// brackets must be balanced and a string closed
+func Complete(input string) bool {
+	depth := 0
+	l := lexer.New(input)
+	for tok := l.NextToken(); tok.Type != lexer.EOF; tok = l.NextToken() {
+		switch tok.Type {
+		case lexer.LBRACE, lexer.LPAREN, lexer.LBRACKET:
+			depth++
+		case lexer.RBRACE, lexer.RPAREN, lexer.RBRACKET:
+			depth--
+		}
+	}
+	return depth <= 0
+}
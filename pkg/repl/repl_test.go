@@ -0,0 +1,257 @@
+package repl
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newSession(t *testing.T) *Session {
+	t.Helper()
+	var compiler string
+	for _, c := range []string{"gcc", "clang", "cc"} {
+		if path, err := exec.LookPath(c); err == nil {
+			compiler = path
+			break
+		}
+	}
+	if compiler == "" {
+		t.Skip("no C compiler found (gcc, clang)")
+	}
+	s, err := New(compiler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// eval runs inputs in order and returns the output of the last
+func eval(t *testing.T, s *Session, inputs ...string) string {
+	t.Helper()
+	var out string
+	for _, input := range inputs {
+		var err error
+		out, err = s.Eval(input)
+		if err != nil {
+			t.Fatalf("%q: %v", input, err)
+		}
+	}
+	return out
+}
+
+func TestEvalPrintsValues(t *testing.T) {
+	s := newSession(t)
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1 + 2", "3\n"},
+		{"7.0 / 2.0", "3.500000\n"},
+		{`"h" + "i"`, "hi\n"},
+		{"3 > 2", "true\n"},
+		{`print("x")`, "x\n"},
+		{"[2]int{1, 2}", "<[2]int>\n"},
+	}
+	for _, tt := range tests {
+		if out := eval(t, s, tt.input); out != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.input, tt.expected, out)
+		}
+	}
+}
+
+func TestEvalKeepsState(t *testing.T) {
+	s := newSession(t)
+	out := eval(t, s,
+		"x := 3",
+		"function sq(n int) int {\n    return n * n;\n}",
+		"struct Box { public v int; }",
+		"b := alloc(Box)",
+		"b.v = sq(x)",
+		"b.v + 1",
+	)
+	if out != "10\n" {
+		t.Errorf("expected 10, got %q", out)
+	}
+
+	// Statements replay silently on the next input
+	if out := eval(t, s, `print("later")`); out != "later\n" {
+		t.Errorf("expected only the new output, got %q", out)
+	}
+}
+
+func TestEvalRedefines(t *testing.T) {
+	s := newSession(t)
+	out := eval(t, s,
+		"function f() int { return 1; }",
+		"f()",
+		"function f() int { return 2; }",
+	)
+	if out != "" {
+		t.Errorf("a redefinition printed %q", out)
+	}
+	if out := eval(t, s, "f()"); out != "2\n" {
+		t.Errorf("expected 2, got %q", out)
+	}
+}
+
+func TestEvalRebinds(t *testing.T) {
+	s := newSession(t)
+	out := eval(t, s,
+		"x := 5",
+		"x := x + 1",
+		"x",
+	)
+	if out != "6\n" {
+		t.Errorf("expected 6, got %q", out)
+	}
+	if out := eval(t, s, `x := "six"`, "x"); out != "six\n" {
+		t.Errorf("expected six, got %q", out)
+	}
+}
+
+func TestEvalTimeout(t *testing.T) {
+	s := newSession(t)
+	s.Timeout = 200 * time.Millisecond
+	eval(t, s, "x := 1")
+	_, err := s.Eval("while true {}")
+	if err == nil || !strings.Contains(err.Error(), "stopped after running for 200ms") {
+		t.Fatalf("expected the input to be stopped, got %v", err)
+	}
+	if out := eval(t, s, "x"); out != "1\n" {
+		t.Errorf("expected the loop not to be kept, got %q", out)
+	}
+}
+
+func TestEvalErrorLines(t *testing.T) {
+	s := newSession(t)
+	eval(t, s, "x := 1")
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		// From the C compiler, through the source map
+		{"y := nope", "'nope' undeclared"},
+		{"function f() int {\n    a := 1;\n    return a + nope;\n}", "line 3: 'nope' undeclared"},
+		// From the compiler
+		{"if x > 0 {\n    y := 1 / 0;\n}", "line 2: division by zero"},
+		{"z := 1 / 0", "division by zero"},
+	}
+	for _, tt := range tests {
+		_, err := s.Eval(tt.input)
+		if err == nil || !strings.HasPrefix(err.Error(), tt.expected) {
+			t.Errorf("%q: expected an error starting %q, got %v", tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestEvalCInclude(t *testing.T) {
+	s := newSession(t)
+	s.BaseDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(s.BaseDir, "twice.h"), []byte("static int twice(int x) { return 2 * x; }\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out := eval(t, s,
+		`cinclude "twice.h"`,
+		"extern function twice(x int) int;",
+		"twice(21)",
+	)
+	if out != "42\n" {
+		t.Errorf("expected 42, got %q", out)
+	}
+}
+
+func TestEvalErrorsAreNotKept(t *testing.T) {
+	s := newSession(t)
+	eval(t, s, "x := 1")
+	if _, err := s.Eval("y := x +"); err == nil {
+		t.Error("expected a parse error")
+	}
+	if _, err := s.Eval("function main() {}"); err == nil {
+		t.Error("expected an error declaring main")
+	}
+	if _, err := s.Eval("z := 1 / 0"); err == nil {
+		t.Error("expected the program to fail")
+	}
+	if out := eval(t, s, "x"); out != "1\n" {
+		t.Errorf("expected 1, got %q", out)
+	}
+
+	s.Reset()
+	if _, err := s.Eval("x"); err == nil {
+		t.Error("expected x to be gone after Reset")
+	}
+}
+
+func TestTypeOfAndC(t *testing.T) {
+	s := newSession(t)
+	eval(t, s, "function half(n float) float { return n / 2.0; }", "s := \"a\"")
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"half(1.0)", "float"},
+		{"half", "function(float) float"},
+		{"s", "string"},
+		{"len(s)", "int"},
+	}
+	for _, tt := range tests {
+		got, err := s.TypeOf(tt.input)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.input, err)
+		}
+		if got != tt.expected {
+			t.Errorf("TypeOf(%q): expected %q, got %q", tt.input, tt.expected, got)
+		}
+	}
+
+	c, err := s.C("half(2.0) * 3.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != "(half(2.000000) * 3.000000)" {
+		t.Errorf("unexpected C %q", c)
+	}
+}
+
+func TestAST(t *testing.T) {
+	out, err := AST("-a + f(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `InfixExpression +
+  PrefixExpression -
+    Identifier a
+  CallExpression
+    Identifier f
+    IntegerLiteral 1
+`
+	if out != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out)
+	}
+}
+
+func TestComplete(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"x := 1", true},
+		{"function f() {", false},
+		{"function f() {\n}", true},
+		{"g(1,", false},
+		{`print("{")`, true},
+	}
+	for _, tt := range tests {
+		if got := Complete(tt.input); got != tt.expected {
+			t.Errorf("Complete(%q): expected %v, got %v", tt.input, tt.expected, got)
+		}
+	}
+	if !strings.HasSuffix(terminate("x := 1"), ";") {
+		t.Error("expected terminate to add a semicolon")
+	}
+}
@@ -1,13 +1,16 @@
 package test
 
 import (
+	"bytes"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/Dr-H-PhD/h-lang/pkg/ast"
 	"github.com/Dr-H-PhD/h-lang/pkg/codegen"
+	"github.com/Dr-H-PhD/h-lang/pkg/interp"
 	"github.com/Dr-H-PhD/h-lang/pkg/lexer"
 	"github.com/Dr-H-PhD/h-lang/pkg/parser"
 )
@@ -446,7 +449,742 @@ function main() {
 	}
 }
 
+func TestRun_StructValues(t *testing.T) {
+	source := `
+struct Point {
+    x int;
+    y int;
+}
+
+struct Line {
+    a Point;
+    b Point;
+    label string;
+}
+
+function (p Point) sum() int {
+    return p.x + p.y;
+}
+
+function (p *Point) shift(d int) {
+    p.x = p.x + d;
+}
+
+function mid(l Line) Point {
+    return Point{x: (l.a.x + l.b.x) / 2, y: (l.a.y + l.b.y) / 2};
+}
+
+function main() {
+    p := Point{x: 1, y: 2};
+    q := p;
+    q.x = 10;
+    print(p.x);
+    print(p == q);
+    l := Line{a: p, b: Point{x: 3, y: 4}, label: "L"};
+    print(mid(l).x);
+    print(l.label);
+    l.a.shift(5);
+    print(l.a.sum());
+    h := &Point{y: 9};
+    defer free(h);
+    print(h.x);
+    print(h.sum());
+    print(Point{x: 6} == Point{x: 6, y: 0});
+}
+`
+	output, err := compileAndRun(t, source)
+	if err != nil {
+		t.Fatalf("failed: %v\n%s", err, output)
+	}
+	expected := "1\nfalse\n2\nL\n8\n0\n9\ntrue\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestRun_ForWalksList(t *testing.T) {
+	source := `
+struct Node {
+    val int;
+    next *Node;
+}
+
+function main() {
+    var head *Node = null;
+    for i := 1; i <= 3; i++ {
+        head = &Node{val: i, next: head};
+    }
+    sum := 0;
+    for p := head; p != null; p = p.next {
+        print(p.val);
+        sum += p.val;
+    }
+    print(sum);
+    while head != null {
+        next := head.next;
+        free(head);
+        head = next;
+    }
+}
+`
+	output, err := compileAndRun(t, source)
+	if err != nil {
+		t.Fatalf("failed: %v\n%s", err, output)
+	}
+	expected := "3\n2\n1\n6\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestRun_NestedTypes(t *testing.T) {
+	source := `
+struct Point { x int; y int; }
+
+struct Grid {
+    cells [2][3]int;
+    corners [2]Point;
+    counts map[string]int;
+    op function(int, int) int;
+}
+
+function add(a int, b int) int {
+    return a + b;
+}
+
+function twice(x int) int {
+    return x * 2;
+}
+
+function pick() function(int) int {
+    return twice;
+}
+
+function total(row *[3]int) int {
+    sum := 0;
+    for i := 0; i < 3; i++ {
+        sum = sum + row[0][i];
+    }
+    return sum;
+}
+
+function main() {
+    m := [2][3]int{{1, 2, 3}, {4, 5, 6}};
+    print(m[1][2]);
+    print(total(&m[1]));
+
+    var g Grid;
+    g.cells[0][1] = 7;
+    g.corners[1] = Point{x: 3, y: 4};
+    g.counts = make(map[string]int);
+    g.counts["b"] = 2;
+    g.op = add;
+    print(g.cells[0][1]);
+    print(g.corners[1].y);
+    print(g.counts["b"]);
+    print(g.op(2, 3));
+    free(g.counts);
+
+    f := pick();
+    print(f(21));
+
+    ptrs := make([]*Point, 2);
+    ptrs[0] = &Point{x: 9};
+    print(ptrs[0].x);
+    free(ptrs[0]);
+    free(ptrs);
+
+    fs := [2]function(int) int{twice, twice};
+    print(fs[1](4));
+}
+`
+	output, err := compileAndRun(t, source)
+	if err != nil {
+		t.Fatalf("failed: %v\n%s", err, output)
+	}
+	expected := "6\n15\n7\n4\n2\n5\n42\n9\n8\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestRun_GlobalsAndInit(t *testing.T) {
+	dir := t.TempDir()
+	lib := `public const VERSION := "1.2";
+public var counter int = 0;
+var step int = 2;
+public var names map[string]int;
+
+function init() {
+    names = map[string]int{"a": 1, "b": 2};
+    counter = 100;
+    print("lib init");
+}
+
+public function bump() int {
+    counter = counter + step;
+    return counter;
+}
+`
+	if err := os.WriteFile(filepath.Join(dir, "lib.hl"), []byte(lib), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	source := `
+import "lib.hl";
+
+struct Point { x int; y int; }
+
+const ORIGIN := Point{x: 1, y: 2};
+const PRIMES := [4]int{2, 3, 5, 7};
+const GREETING := "v" + VERSION;
+var squares [3]int;
+
+function init() {
+    for i := 0; i < 3; i++ {
+        squares[i] = i * i;
+    }
+    print("main init");
+}
+
+function main() {
+    print(GREETING);
+    print(ORIGIN.y + PRIMES[3]);
+    print(squares[2]);
+    print(bump());
+    print(names["b"]);
+    free(names);
+}
+`
+	g := codegen.New()
+	g.SetImportResolver(func(path, basePath string) (*ast.Program, error) {
+		src, err := os.ReadFile(filepath.Join(basePath, path))
+		if err != nil {
+			return nil, err
+		}
+		return parser.New(lexer.New(string(src))).ParseProgram(), nil
+	}, dir)
+
+	output, err := compileAndRunWith(t, source, g)
+	if err != nil {
+		t.Fatalf("failed: %v\n%s", err, output)
+	}
+	expected := "lib init\nmain init\nv1.2\n9\n4\n102\n2\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestRun_SliceLiteralGlobals(t *testing.T) {
+	source := `
+function three() int {
+    return 3;
+}
+
+var sl []int = []int{1, 2, 3};
+var names []string = []string{"a", "b"};
+var computed []int = []int{three(), 4};
+var none []int = []int{};
+
+function main() {
+    var local []int = []int{4, 5};
+    var m map[string]int = map[string]int{"k": 7};
+    print(sl[0] + sl[2]);
+    print(names[1]);
+    print(computed[0]);
+    print(local[1]);
+    print(m["k"]);
+    print(none == null);
+    sl[1] = 9;
+    print(sl[1]);
+    free(m);
+}
+`
+	output, err := compileAndRun(t, source)
+	if err != nil {
+		t.Fatalf("failed: %v\n%s", err, output)
+	}
+	expected := "4\nb\n3\n5\n7\ntrue\n9\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestRun_Comptime(t *testing.T) {
+	dir := t.TempDir()
+	lib := `comptime function pow(base int, exp int) int {
+    result := 1;
+    for i := 0; i < exp; i++ {
+        result *= base;
+    }
+    return result;
+}
+
+public comptime function kilo(n int) int {
+    return n * pow(2, 10);
+}
+`
+	if err := os.WriteFile(filepath.Join(dir, "lib.hl"), []byte(lib), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	source := `
+import "lib.hl";
+
+comptime function fib(n int) int {
+    if n < 2 {
+        return n;
+    }
+    return fib(n - 1) + fib(n - 2);
+}
+
+comptime function triangle() [5]int {
+    var out [5]int;
+    for i := 1; i < len(out); i++ {
+        out[i] = out[i - 1] + i;
+    }
+    return out;
+}
+
+const FIB := fib(15);
+const TRIANGLE := triangle();
+const BUFFER := kilo(4);
+var scratch [BUFFER / 1024]int;
+
+enum Level { Low = comptime fib(4), High }
+
+static_assert(BUFFER == 4096, "a page");
+
+function main() {
+    print(FIB);
+    print(TRIANGLE[4]);
+    print(len(scratch));
+    print(Level_High);
+}
+`
+	g := codegen.New()
+	g.SetImportResolver(func(path, basePath string) (*ast.Program, error) {
+		src, err := os.ReadFile(filepath.Join(basePath, path))
+		if err != nil {
+			return nil, err
+		}
+		return parser.New(lexer.New(string(src))).ParseProgram(), nil
+	}, dir)
+
+	output, err := compileAndRunWith(t, source, g)
+	if err != nil {
+		t.Fatalf("failed: %v\n%s", err, output)
+	}
+	expected := "610\n10\n4\n4\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestRun_Extern(t *testing.T) {
+	dir := t.TempDir()
+	// No cinclude here, so hlc declares the C functions itself
+	lib := `extern function toupper(c int) int
+extern function labs(n long) long
+
+public function shout(c char) char {
+    return toupper(c);
+}
+
+public function distance(a long, b long) long {
+    return labs(a - b);
+}
+`
+	if err := os.WriteFile(filepath.Join(dir, "ctype.hl"), []byte(lib), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	source := `
+import "ctype.hl";
+
+cinclude "<stdlib.h>"
+extern function atoi(s *char) int
+extern struct div_t { public quot int; public rem int; }
+extern function div(a int, b int) div_t
+
+function main() {
+    print(shout('h'));
+    var far long = 5000000000;
+    print(distance(far, 1));
+    print(atoi("42") + 1);
+    d := div(17, 5);
+    print(d.quot);
+    print(d.rem);
+    var small uint8 = 200;
+    var big int64 = 9000000000;
+    print(small);
+    print(big);
+}
+`
+	g := codegen.New()
+	g.SetImportResolver(func(path, basePath string) (*ast.Program, error) {
+		src, err := os.ReadFile(filepath.Join(basePath, path))
+		if err != nil {
+			return nil, err
+		}
+		return parser.New(lexer.New(string(src))).ParseProgram(), nil
+	}, dir)
+
+	output, err := compileAndRunWith(t, source, g)
+	if err != nil {
+		t.Fatalf("failed: %v\n%s", err, output)
+	}
+	expected := "H\n4999999999\n43\n3\n2\n200\n9000000000\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestRun_GarbageCollectedMode(t *testing.T) {
+	source := `
+struct Node {
+    value int;
+    next *Node;
+}
+
+function main() {
+    head := alloc(Node);
+    head.value = 1;
+    total := 0;
+    for i := 0; i < 200000; i++ {
+        n := alloc(Node);
+        n.value = i;
+        n.next = head;
+        total = total + head.value;
+        label := "node" + "!";
+    }
+    print(head.value);
+    print(total);
+    free(head);
+}
+`
+	g := codegen.New()
+	g.SetGC(true)
+	output, err := compileAndRunWith(t, source, g)
+	if err != nil {
+		t.Fatalf("failed: %v\n%s", err, output)
+	}
+	if output != "1\n200000\n" {
+		t.Errorf("unexpected output: %q", output)
+	}
+}
+
+func TestRun_SeparateCompilation(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"geo.hl": `public struct Point {
+    public x int;
+    public y int;
+}
+
+var made int = 0;
+public const SCALE := 10;
+
+function helper(n int) int { return n * SCALE; }
+
+public function scaled(p Point) Point {
+    made++;
+    return Point{x: helper(p.x), y: helper(p.y)};
+}
+
+public function count() int { return made; }
+
+function init() { print("geo init"); }
+`,
+		"names.hl": `import "geo.hl";
+
+var table map[string]int;
+
+function helper(s string) string { return s + "!"; }
+
+public function shout(s string) string { return helper(s); }
+
+public function lookup(k string) int { return table[k]; }
+
+public function far(p Point) bool { return p.x > 5; }
+
+function init() {
+    table = map[string]int{"a": 1, "b": 2};
+    print("names init");
+}
+`,
+	}
+	for name, src := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	source := `
+import "names.hl";
+import "geo.hl";
+
+function helper() int { return 7; }
+
+function main() {
+    p := scaled(Point{x: 1, y: 2});
+    print(p.y);
+    print(count());
+    print(shout("hi"));
+    print(lookup("b"));
+    print(far(p));
+    print(p == Point{x: 10, y: 20});
+    print(helper());
+}
+`
+	for _, gc := range []bool{false, true} {
+		g := codegen.New()
+		g.SetGC(gc)
+		g.SetImportResolver(func(path, basePath string) (*ast.Program, error) {
+			src, err := os.ReadFile(filepath.Join(basePath, path))
+			if err != nil {
+				return nil, err
+			}
+			return parser.New(lexer.New(string(src))).ParseProgram(), nil
+		}, dir)
+
+		output, err := compileUnitsAndRun(t, source, g)
+		if err != nil {
+			t.Fatalf("gc=%v failed: %v\n%s", gc, err, output)
+		}
+		expected := "geo init\nnames init\n20\n1\nhi!\n2\ntrue\ntrue\n7\n"
+		if output != expected {
+			t.Errorf("gc=%v: expected %q, got %q", gc, expected, output)
+		}
+	}
+}
+
+func TestRun_TestBinary(t *testing.T) {
+	source := `
+struct Point {
+    x int;
+    y int;
+}
+
+var calls int = 0;
+
+function add(a int, b int) int {
+    calls++;
+    return a + b;
+}
+
+function main() {
+    print("not a test");
+}
+
+test "adds" {
+    assert_eq(add(1, 2), 3);
+    assert(add(2, 2) == 4);
+}
+
+test "strings and structs" {
+    assert_eq("ab" + "c", "abc");
+    assert_eq(Point{x: 1, y: 2}, Point{x: 1, y: 2});
+}
+
+test "fails" {
+    n := 5;
+    assert_eq(add(n, 1), 7);
+    print("not reached");
+}
+
+test "runs after a failure" {
+    assert(calls > 0);
+}
+`
+	for _, gc := range []bool{false, true} {
+		g := codegen.New()
+		g.SetGC(gc)
+		g.SetTestMode(true)
+		g.SetSourceName("add.hl")
+
+		output, err := compileUnitsAndRun(t, source, g)
+		if _, ok := err.(*compileError); ok {
+			t.Fatalf("gc=%v: %v", gc, err)
+		}
+		if err == nil {
+			t.Errorf("gc=%v: expected a failing test binary to exit non-zero\n%s", gc, output)
+		}
+		expected := "add.hl:30:5: assert_eq(add(n, 1), 7) failed\n" +
+			"    left:  6\n" +
+			"    right: 7\n" +
+			"--- FAIL: fails\n" +
+			"FAIL: 3 passed, 1 failed\n"
+		if output != expected {
+			t.Errorf("gc=%v: expected %q, got %q", gc, expected, output)
+		}
+	}
+}
+
+func TestRun_ProgramArguments(t *testing.T) {
+	source := `
+function greeting() string {
+    name := getenv("HLC_TEST_NAME");
+    if name == null {
+        return "nobody";
+    }
+    return name;
+}
+
+function main() int {
+    a := args();
+    for i, s := range a {
+        if i > 0 {
+            print(s);
+        }
+    }
+    print(greeting());
+    if len(a) > 3 {
+        exit(5);
+    }
+    return len(a) - 1;
+}
+`
+	t.Setenv("HLC_TEST_NAME", "h")
+
+	tests := []struct {
+		args   []string
+		output string
+		status int
+	}{
+		{nil, "h\n", 0},
+		{[]string{"a", "b"}, "a\nb\nh\n", 2},
+		{[]string{"a", "b", "c"}, "a\nb\nc\nh\n", 5},
+	}
+	for _, tt := range tests {
+		output, err := compileUnitsAndRun(t, source, codegen.New(), tt.args...)
+		if _, ok := err.(*compileError); ok {
+			t.Fatal(err)
+		}
+		status := 0
+		if exit, ok := err.(*exec.ExitError); ok {
+			status = exit.ExitCode()
+		} else if err != nil {
+			t.Fatalf("args %v: %v", tt.args, err)
+		}
+		if output != tt.output || status != tt.status {
+			t.Errorf("args %v: expected %q with status %d, got %q with status %d",
+				tt.args, tt.output, tt.status, output, status)
+		}
+	}
+}
+
 // compileOnly compiles H-lang code to C and verifies C compilation succeeds
+func TestRun_LineDirectives(t *testing.T) {
+	source := `
+function half(n int) int {
+    defer print("half");
+    return n / 2;
+}
+
+function main() {
+    print(half(8));
+}
+`
+	g := codegen.New()
+	g.SetSourceName("prog.hl")
+	g.SetLineDirectives(true)
+	output, err := compileUnitsAndRun(t, source, g)
+	if err != nil {
+		t.Fatalf("failed: %v\n%s", err, output)
+	}
+	if output != "half\n4\n" {
+		t.Errorf("expected %q, got %q", "half\n4\n", output)
+	}
+
+	// The C compiler reports the H line
+	g = codegen.New()
+	g.SetSourceName("prog.hl")
+	g.SetLineDirectives(true)
+	_, err = compileUnitsAndRun(t, `
+function main() {
+    var n int = 1;
+}
+`, g)
+	if err == nil || !strings.Contains(err.Error(), "prog.hl:3:") {
+		t.Errorf("expected a C diagnostic at prog.hl:3, got %v", err)
+	}
+}
+
+// TestInterp_Examples runs every example with the interpreter and checks
+// that it prints what the compiled program prints
+func TestInterp_Examples(t *testing.T) {
+	files, err := filepath.Glob("../examples/*.hl")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no examples found: %v", err)
+	}
+	resolver := func(path, basePath string) (*ast.Program, error) {
+		src, err := os.ReadFile(filepath.Join(basePath, path))
+		if err != nil {
+			return nil, err
+		}
+		return parser.New(lexer.New(string(src))).ParseProgram(), nil
+	}
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			source, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			g := codegen.New()
+			g.SetImportResolver(resolver, "../examples")
+			want, err := compileAndRunWith(t, string(source), g)
+			if err != nil {
+				t.Fatalf("compiled program failed: %v\n%s", err, want)
+			}
+
+			var out bytes.Buffer
+			in := interp.New()
+			in.Stdout = &out
+			in.SetImportResolver(resolver, "../examples")
+			program := parser.New(lexer.New(string(source))).ParseProgram()
+			if status, err := in.Run(program); err != nil || status != 0 {
+				t.Fatalf("status %d, error %v\n%s", status, err, out.String())
+			}
+			if out.String() != want {
+				t.Errorf("interpreter printed %q, compiled program %q", out.String(), want)
+			}
+		})
+	}
+}
+
+// TestInterp_InferredTypes checks that variables declared with := get the
+// type the C backend declares them with
+func TestInterp_InferredTypes(t *testing.T) {
+	source := `function main() {
+    n := 2000000000;
+    z := n + n;
+    print(z);
+    f := 2.5;
+    h := 1 + f;
+    print(h);
+    b := 1 < 2;
+    print(b);
+    var far long = 5000000000;
+    print(far);
+}`
+	want, err := compileAndRun(t, source)
+	if err != nil {
+		t.Fatalf("compiled program failed: %v\n%s", err, want)
+	}
+	var out bytes.Buffer
+	in := interp.New()
+	in.Stdout = &out
+	if status, err := in.Run(parser.New(lexer.New(source)).ParseProgram()); err != nil || status != 0 {
+		t.Fatalf("status %d, error %v\n%s", status, err, out.String())
+	}
+	if out.String() != want {
+		t.Errorf("interpreter printed %q, compiled program %q", out.String(), want)
+	}
+}
+
 func compileOnly(t *testing.T, source string) error {
 	t.Helper()
 
@@ -501,6 +1239,12 @@ func compileOnly(t *testing.T, source string) error {
 // Helper function to compile and run H-lang code
 func compileAndRun(t *testing.T, source string) (string, error) {
 	t.Helper()
+	return compileAndRunWith(t, source, codegen.New())
+}
+
+// compileAndRunWith compiles and runs H-lang code using a configured generator
+func compileAndRunWith(t *testing.T, source string, g *codegen.Generator) (string, error) {
+	t.Helper()
 
 	// Skip if no C compiler available
 	compiler := findCompiler()
@@ -518,7 +1262,6 @@ func compileAndRun(t *testing.T, source string) (string, error) {
 	}
 
 	// Generate C code
-	g := codegen.New()
 	cCode := g.Generate(program)
 
 	// Create temp directory
@@ -557,6 +1300,62 @@ func compileAndRun(t *testing.T, source string) (string, error) {
 	return string(output), nil
 }
 
+// compileUnitsAndRun compiles every module to its own object file, links
+// them and runs the program with args
+func compileUnitsAndRun(t *testing.T, source string, g *codegen.Generator, args ...string) (string, error) {
+	t.Helper()
+
+	compiler := findCompiler()
+	if compiler == "" {
+		t.Skip("no C compiler found (gcc, clang)")
+	}
+
+	p := parser.New(lexer.New(source))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		return "", &compileError{errors: p.Errors()}
+	}
+
+	units := g.GenerateUnits(program)
+	if len(g.Errors()) > 0 {
+		return "", &compileError{errors: g.Errors()}
+	}
+
+	tmpDir := t.TempDir()
+	var objects []string
+	for _, u := range units {
+		for ext, code := range map[string]string{".h": u.Header, ".c": u.Source} {
+			if err := os.WriteFile(filepath.Join(tmpDir, u.Name+ext), []byte(code), 0644); err != nil {
+				return "", err
+			}
+		}
+	}
+	for _, u := range units {
+		object := filepath.Join(tmpDir, u.Name+".o")
+		cmd := exec.Command(compiler, "-Wall", "-Werror", "-c", "-o", object, filepath.Join(tmpDir, u.Name+".c"))
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return "", &compileError{
+				errors: []string{
+					"C compilation of " + u.Name + ".c failed: " + err.Error(),
+					"Output: " + string(output),
+					"Header:\n" + u.Header,
+					"Source:\n" + u.Source,
+				},
+			}
+		}
+		objects = append(objects, object)
+	}
+
+	binary := filepath.Join(tmpDir, "test")
+	link := exec.Command(compiler, append([]string{"-o", binary}, objects...)...)
+	if output, err := link.CombinedOutput(); err != nil {
+		return "", &compileError{errors: []string{"linking failed: " + err.Error(), "Output: " + string(output)}}
+	}
+
+	output, err := exec.Command(binary, args...).CombinedOutput()
+	return string(output), err
+}
+
 func findCompiler() string {
 	compilers := []string{"gcc", "clang", "cc"}
 	for _, c := range compilers {